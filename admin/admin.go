@@ -5,7 +5,10 @@
 package admin
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
@@ -36,10 +39,56 @@ type responseWrapper struct {
 	elapsedTime   time.Duration
 }
 
+// Options configures the admin console.
+type Options struct {
+	// Authenticator authenticates requests. If nil, requests are not authenticated.
+	Authenticator Authenticator
+	// PublicReads allows read-only requests without credentials when an Authenticator is set.
+	PublicReads bool
+	// Roles maps principals to roles. If nil, every principal may perform every operation.
+	Roles RoleMapper
+	// ReadOnly rejects every mutating request, regardless of roles. Useful where config is managed
+	// elsewhere.
+	ReadOnly bool
+	// CORS allows the API to be called from other origins. If nil, browsers only allow same-origin
+	// calls.
+	CORS *CORSOptions
+	// CSRF requires mutating requests to carry a CSRF token. Set it if browsers send credentials
+	// ambiently, e.g. with cookie-based auth.
+	CSRF *CSRFOptions
+}
+
 // ServeAdminConsole serves up an admin console for an Administrable using Go's built-in HTTP server
 // library. `assetsDirectory` contains HTML templates and other UI assets. If empty, no UI will be
 // served, and only REST endpoints under `/api/` will be served.
 func ServeAdminConsole(a Administrable, mux *http.ServeMux, assetsDirectory string, development bool) {
+	ServeAdminConsoleWithOptions(a, mux, assetsDirectory, development, nil)
+}
+
+// ServeAdminConsoleWithOptions is like ServeAdminConsole, but allows passing in Options. A nil
+// Options is equivalent to the zero value.
+func ServeAdminConsoleWithOptions(a Administrable, mux *http.ServeMux, assetsDirectory string, development bool, opts *Options) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	secured := func(required func(*http.Request) Role, next http.Handler) http.Handler {
+		return readOnlyHandler(opts, csrfHandler(opts, authHandler(opts, rbacHandler(opts, required, next))))
+	}
+
+	handler := func(next http.Handler) http.Handler {
+		return loggingHandler(secured(roleForMethod, next))
+	}
+
+	// API routes also answer CORS preflights, which carry no credentials, before authenticating.
+	apiWithRoles := func(required func(*http.Request) Role, next http.Handler) http.Handler {
+		return loggingHandler(corsHandler(opts, secured(required, next)))
+	}
+
+	api := func(next http.Handler) http.Handler {
+		return apiWithRoles(roleForMethod, next)
+	}
+
 	if assetsDirectory != "" {
 		msg := "Serving assets from %s"
 
@@ -49,9 +98,9 @@ func ServeAdminConsole(a Administrable, mux *http.ServeMux, assetsDirectory stri
 
 		logging.Printf(msg, assetsDirectory)
 
-		mux.Handle("/", loggingHandler(http.RedirectHandler("/admin/", 301)))
-		mux.Handle("/admin/", loggingHandler(newUIHandler(a, assetsDirectory, development)))
-		mux.Handle("/js/", loggingHandler(http.FileServer(http.Dir(assetsDirectory))))
+		mux.Handle("/", handler(http.RedirectHandler("/admin/", 301)))
+		mux.Handle("/admin/", handler(newUIHandler(a, assetsDirectory, development)))
+		mux.Handle("/js/", handler(http.FileServer(http.Dir(assetsDirectory))))
 		mux.Handle("/favicon.ico", http.NotFoundHandler())
 	} else {
 		logging.Print("Not serving admin web UI.")
@@ -61,11 +110,14 @@ func ServeAdminConsole(a Administrable, mux *http.ServeMux, assetsDirectory stri
 	bucketsHandler := newBucketsAPIHandler(a)
 	namespacesHandler := newNamespacesAPIHandler(a)
 
-	apiHandler := loggingHandler(
+	apiHandler := api(
 		jsonResponseHandler(
-			apiVersionHandler(
+			configuredHandler(
 				a,
-				apiRequestHandler(namespacesHandler, bucketsHandler),
+				apiVersionHandler(
+					a,
+					apiRequestHandler(namespacesHandler, bucketsHandler),
+				),
 			),
 		),
 	)
@@ -73,13 +125,41 @@ func ServeAdminConsole(a Administrable, mux *http.ServeMux, assetsDirectory stri
 	mux.Handle("/api", apiHandler)
 	mux.Handle("/api/", apiHandler)
 
-	statsHandler := loggingHandler(jsonResponseHandler(newStatsAPIHandler(a)))
+	statsHandler := api(jsonResponseHandler(configuredHandler(a, newStatsAPIHandler(a))))
 	mux.Handle("/api/stats", statsHandler)
 	mux.Handle("/api/stats/", statsHandler)
+	mux.Handle("/api/stats/top", api(jsonResponseHandler(newTopStatsAPIHandler(a))))
+	mux.Handle("/api/stats/reset", api(jsonResponseHandler(configuredHandler(a, newResetStatsAPIHandler(a)))))
+	mux.Handle("/api/metrics/summary", api(jsonResponseHandler(configuredHandler(a, newMetricsSummaryAPIHandler(a)))))
 
-	configsHandler := loggingHandler(jsonResponseHandler(newConfigsAPIHandler(a)))
+	configsHandler := api(jsonResponseHandler(newConfigsAPIHandler(a)))
 	mux.Handle("/api/configs", configsHandler)
 	mux.Handle("/api/configs/", configsHandler)
+
+	inspectHandler := api(jsonResponseHandler(newInspectAPIHandler(a)))
+	mux.Handle("/api/buckets", inspectHandler)
+	mux.Handle("/api/buckets/", inspectHandler)
+
+	configHandler := api(jsonResponseHandler(configuredHandler(a, newConfigAPIHandler(a))))
+	mux.Handle("/api/config", configHandler)
+	mux.Handle("/api/config/", configHandler)
+
+	mux.Handle("/api/namespaces/", api(jsonResponseHandler(configuredHandler(a, newNamespaceActionsAPIHandler(a)))))
+
+	mux.Handle("/api/status", api(jsonResponseHandler(newStatusAPIHandler(a, opts))))
+
+	mux.Handle("/api/audit", api(jsonResponseHandler(newAuditAPIHandler(a))))
+
+	templatesHandler := apiWithRoles(roleForTemplateMethod, jsonResponseHandler(configuredHandler(a, newTemplatesAPIHandler(a))))
+	mux.Handle("/api/templates", templatesHandler)
+	mux.Handle("/api/templates/", templatesHandler)
+
+	if opts.CSRF != nil {
+		mux.Handle("/api/csrf", api(jsonResponseHandler(newCSRFAPIHandler(opts.CSRF))))
+	}
+
+	mux.Handle("/v1/config/events", api(newConfigEventsHandler(a)))
+	mux.Handle("/api/events/ws", api(newLiveEventsHandler(a, opts)))
 }
 
 func (r *responseWrapper) Write(p []byte) (int, error) {
@@ -97,6 +177,24 @@ func (r *responseWrapper) WriteHeader(status int) {
 	r.ResponseWriter.WriteHeader(status)
 }
 
+// Flush implements http.Flusher, so streaming handlers can be wrapped by the loggingHandler.
+func (r *responseWrapper) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker, so WebSocket handlers can be wrapped by the loggingHandler.
+func (r *responseWrapper) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+
+	r.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
 func (r *responseWrapper) log() {
 	timeFormatted := r.time.Format("02/Jan/2006 03:04:05")
 	requestLine := fmt.Sprintf("%s %s %s", r.method, r.uri, r.protocol)
@@ -112,6 +210,19 @@ func jsonResponseHandler(next http.Handler) http.Handler {
 	})
 }
 
+// configuredHandler responds 503 while the Administrable has no config to read or change, e.g.
+// while a server that couldn't read its config at startup grants every request.
+func configuredHandler(a Administrable, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.Configs() == nil {
+			writeJSONError(w, &httpError{"No config has been read yet", http.StatusServiceUnavailable})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 func apiVersionHandler(a Administrable, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		versionHeader := r.Header.Get("Version")
@@ -179,10 +290,16 @@ func loggingHandler(next http.Handler) http.Handler {
 	})
 }
 
+// getUsername returns the name of the authenticated principal making the request, falling back
+// to any name set by a proxy in the X-Forwarded-User header.
 func getUsername(r *http.Request) string {
+	if p := PrincipalFromContext(r.Context()); p != nil {
+		return p.Name
+	}
+
 	if username, exists := r.Header["X-Forwarded-User"]; exists {
 		return username[0]
 	}
 
-	return "quotaservice"
+	return AnonymousPrincipal
 }
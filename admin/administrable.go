@@ -4,6 +4,11 @@
 package admin
 
 import (
+	"time"
+
+	"github.com/square/quotaservice/audit"
+	"github.com/square/quotaservice/config"
+	"github.com/square/quotaservice/events"
 	pb "github.com/square/quotaservice/protos/config"
 	"github.com/square/quotaservice/stats"
 )
@@ -11,14 +16,40 @@ import (
 // Administrable defines something that can be administered via this package.
 type Administrable interface {
 	Configs() *pb.ServiceConfig
+	// PendingConfig returns the latest config persisted with an activation time that hasn't passed
+	// yet, or nil if there is none.
+	PendingConfig() *pb.ServiceConfig
+	// EffectiveConfig returns the current config as applied to buckets, with the configs buckets are
+	// created with, including defaults and canaries, in place of those configured.
+	EffectiveConfig() *pb.ServiceConfig
 	HistoricalConfigs() ([]*pb.ServiceConfig, error)
 
 	UpdateConfig(*pb.ServiceConfig, string) error
+	// UpdateConfigIfLatest is like UpdateConfig, but returns config.ErrStaleConfig if the config the
+	// change is based on, with the given version, is no longer the latest.
+	UpdateConfigIfLatest(*pb.ServiceConfig, int32, string) error
+	// PersistConfig validates and persists a config as the next version on behalf of a user,
+	// returning the version assigned. Validation failures are returned as config.ValidationErrors.
+	PersistConfig(*pb.ServiceConfig, string) (int32, error)
+	// RollbackConfig persists a copy of a historical config version as the next version on behalf
+	// of a user, returning the version assigned, or config.ErrUnknownVersion if there is no such
+	// version.
+	RollbackConfig(int32, string) (int32, error)
+	// ReloadConfig polls the persister for a new config immediately, if it is a
+	// config.ForcePoller, and applies the latest config persisted, returning the version in force.
+	ReloadConfig() (int32, error)
 
 	DeleteBucket(string, string, string) error
 	AddBucket(string, *pb.BucketConfig, string) error
 	UpdateBucket(string, *pb.BucketConfig, string) error
 
+	// AddTemplate, UpdateTemplate and DeleteTemplate change the bucket templates of the config on
+	// behalf of a user, persisting the result as the next version. See config.CreateTemplate,
+	// config.UpdateTemplate and config.DeleteTemplate for the errors returned.
+	AddTemplate(*pb.BucketConfig, string) error
+	UpdateTemplate(*pb.BucketConfig, string) error
+	DeleteTemplate(string, string) error
+
 	DeleteNamespace(string, string) error
 	AddNamespace(*pb.NamespaceConfig, string) error
 	UpdateNamespace(*pb.NamespaceConfig, string) error
@@ -26,4 +57,39 @@ type Administrable interface {
 	TopDynamicHits(string) []*stats.BucketScore
 	TopDynamicMisses(string) []*stats.BucketScore
 	DynamicBucketStats(string, string) *stats.BucketScores
+	// TopBuckets returns up to n of the busiest buckets by a metric, or nil if no top tracker is
+	// configured.
+	TopBuckets(metric stats.TopMetric, n int) []*stats.TopBucket
+	// ResetStats zeroes the stats, top buckets, wait time histograms and rates of a namespace, or
+	// of every namespace if empty. Returns false if none of them are configured.
+	ResetStats(namespace string) bool
+	// NamespaceRates returns the rates of requests granted and rejected per namespace, and the
+	// window they are averaged over, or nil if no rate tracker is configured.
+	NamespaceRates() ([]*stats.NamespaceRate, time.Duration)
+	// PersisterHealth describes the outcome of the latest operations on the config persister.
+	PersisterHealth() *PersisterHealth
+	// ConfigHealth describes whether config changes are still reaching the server.
+	ConfigHealth() *ConfigHealth
+	// SubscribeEvents subscribes to the events matching a filter, or every event if it is nil,
+	// buffered to the given size. Returns nil if no event broadcaster is configured.
+	SubscribeEvents(bufSize int, filter func(events.Event) bool) *events.Subscription
+
+	// InspectBucket describes the live state of a bucket, or returns nil if no such bucket is
+	// active. Dynamic buckets are not created by inspection.
+	InspectBucket(string, string) (*BucketInspection, error)
+	// InspectBuckets describes up to limit of the active buckets, including default buckets and
+	// namespace limits, ordered by namespace and name, and returns whether there were more.
+	InspectBuckets(limit int) ([]*BucketInspection, bool, error)
+	// DynamicBuckets returns up to limit of the active dynamic buckets in a namespace with names
+	// starting with a prefix and sorting after a cursor, in name order. It also returns the total
+	// number of active dynamic buckets matching the prefix, and whether the namespace exists.
+	DynamicBuckets(namespace, prefix, cursor string, limit int) ([]*DynamicBucket, int, bool)
+
+	// AuditEntries returns a page of the audit log of config changes, newest first, and the total
+	// number of entries. Returns audit.ErrListingUnsupported if the audit sink can't be read.
+	AuditEntries(offset, limit int) ([]*audit.Entry, int, error)
+
+	// SubscribeConfigChanges returns a channel notified of every config applied, buffered to the
+	// given size, and a function to unsubscribe.
+	SubscribeConfigChanges(int) (<-chan *config.ConfigChange, func())
 }
@@ -0,0 +1,62 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package admin
+
+import (
+	"net/http"
+
+	"github.com/square/quotaservice/audit"
+)
+
+const (
+	defaultAuditListLimit = 50
+	maxAuditListLimit     = 1000
+)
+
+type auditListResponse struct {
+	Entries []*audit.Entry `json:"entries"`
+	Total   int            `json:"total"`
+	Offset  int            `json:"offset"`
+	Limit   int            `json:"limit"`
+}
+
+type auditAPIHandler struct {
+	a Administrable
+}
+
+func newAuditAPIHandler(admin Administrable) *auditAPIHandler {
+	return &auditAPIHandler{a: admin}
+}
+
+// ServeHTTP writes a page of the audit log, newest first, selected using the "offset" and "limit"
+// query parameters.
+func (a *auditAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, &httpError{"Unknown method " + r.Method, http.StatusBadRequest})
+		return
+	}
+
+	offset, err := intParam(r, "offset", 0)
+	if err != nil || offset < 0 {
+		writeJSONError(w, &httpError{"Invalid offset " + r.URL.Query().Get("offset"), http.StatusBadRequest})
+		return
+	}
+
+	limit, err := intParam(r, "limit", defaultAuditListLimit)
+	if err != nil || limit < 1 || limit > maxAuditListLimit {
+		writeJSONError(w, &httpError{"Invalid limit " + r.URL.Query().Get("limit"), http.StatusBadRequest})
+		return
+	}
+
+	entries, total, err := a.a.AuditEntries(offset, limit)
+
+	switch {
+	case err == audit.ErrListingUnsupported:
+		writeJSONError(w, &httpError{err.Error(), http.StatusNotImplemented})
+	case err != nil:
+		writeJSONError(w, &httpError{"Unable to read audit log: " + err.Error(), http.StatusInternalServerError})
+	default:
+		writeJSON(w, &auditListResponse{entries, total, offset, limit})
+	}
+}
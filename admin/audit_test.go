@@ -0,0 +1,48 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/square/quotaservice/test/helpers"
+)
+
+func TestAuditList(t *testing.T) {
+	a := NewMockAdministrable()
+	for i := 0; i < 3; i++ {
+		w := doConfigPost(t, a, "application/json", validConfigJSON, alice)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %v %v", w.Code, w.Body.String())
+		}
+	}
+
+	w := doConfigRequest(t, a, http.MethodGet, "/api/audit?offset=1&limit=1", "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %v %v", w.Code, w.Body.String())
+	}
+
+	response := &auditListResponse{}
+	helpers.CheckError(t, json.Unmarshal(w.Body.Bytes(), response))
+
+	if response.Total != 3 || len(response.Entries) != 1 {
+		t.Fatalf("Expected 1 of 3 entries, got %+v", response)
+	}
+
+	e := response.Entries[0]
+	if e.Principal != "alice" || e.OldVersion != 1 || e.NewVersion != 2 {
+		t.Errorf("Unexpected entry %+v", e)
+	}
+}
+
+func TestAuditListInvalidParams(t *testing.T) {
+	for _, path := range []string{"/api/audit?offset=-1", "/api/audit?limit=0", "/api/audit?limit=x"} {
+		w := doConfigRequest(t, NewMockAdministrable(), http.MethodGet, path, "", "")
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %v, got %v", path, w.Code)
+		}
+	}
+}
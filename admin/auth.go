@@ -0,0 +1,148 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package admin
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// AnonymousPrincipal is the name recorded for requests that were not authenticated.
+const AnonymousPrincipal = "quotaservice"
+
+// ErrNoCredentials is returned by an Authenticator when a request carries no credentials it
+// understands. This is distinct from a request carrying invalid credentials.
+var ErrNoCredentials = errors.New("no credentials provided")
+
+// Principal is an authenticated caller of the admin API.
+type Principal struct {
+	Name string
+	// Scheme is the authentication scheme used, e.g. "basic" or "bearer".
+	Scheme string
+	// Claims holds any claims carried by a bearer token.
+	Claims map[string]interface{}
+}
+
+// Authenticator authenticates admin API requests.
+type Authenticator interface {
+	// Authenticate returns the principal making the request, ErrNoCredentials if the request
+	// carries no credentials for this authenticator, or any other error if the credentials are
+	// invalid.
+	Authenticate(r *http.Request) (*Principal, error)
+	// Challenge is sent as the WWW-Authenticate header on 401 responses.
+	Challenge() string
+}
+
+type principalKey struct{}
+
+// PrincipalFromContext returns the principal stored in a request context by the auth handler, or
+// nil if there is none.
+func PrincipalFromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+func withPrincipal(r *http.Request, p *Principal) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+}
+
+func isReadOnlyMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// authHandler authenticates requests using the configured Authenticator, storing the principal in
+// the request context. Mutating requests without valid credentials are rejected with a 401, as
+// are read-only requests unless PublicReads is set.
+func authHandler(opts *Options, next http.Handler) http.Handler {
+	if opts.Authenticator == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := opts.Authenticator.Authenticate(r)
+
+		if err == ErrNoCredentials && opts.PublicReads && isReadOnlyMethod(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", opts.Authenticator.Challenge())
+			writeJSONError(w, &httpError{"Authentication failed: " + err.Error(), http.StatusUnauthorized})
+			return
+		}
+
+		next.ServeHTTP(w, withPrincipal(r, p))
+	})
+}
+
+type basicAuthenticator struct {
+	realm string
+	// username -> SHA256 of password
+	credentials map[string][sha256.Size]byte
+}
+
+// NewBasicAuthenticator creates an Authenticator using HTTP basic auth against a set of
+// credentials, mapping username to password.
+func NewBasicAuthenticator(realm string, credentials map[string]string) Authenticator {
+	b := &basicAuthenticator{realm: realm, credentials: make(map[string][sha256.Size]byte, len(credentials))}
+	for user, pass := range credentials {
+		b.credentials[user] = sha256.Sum256([]byte(pass))
+	}
+
+	return b
+}
+
+func (b *basicAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+
+	expected, exists := b.credentials[user]
+	actual := sha256.Sum256([]byte(pass))
+
+	// Always compare, so unknown users take as long as known ones.
+	if subtle.ConstantTimeCompare(expected[:], actual[:]) != 1 || !exists {
+		return nil, errors.New("invalid username or password")
+	}
+
+	return &Principal{Name: user, Scheme: "basic"}, nil
+}
+
+func (b *basicAuthenticator) Challenge() string {
+	return `Basic realm="` + b.realm + `"`
+}
+
+type multiAuthenticator []Authenticator
+
+// NewMultiAuthenticator creates an Authenticator that tries each of the given authenticators in
+// turn, using the first that recognizes the request's credentials.
+func NewMultiAuthenticator(authenticators ...Authenticator) Authenticator {
+	return multiAuthenticator(authenticators)
+}
+
+func (m multiAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	for _, a := range m {
+		p, err := a.Authenticate(r)
+		if err != ErrNoCredentials {
+			return p, err
+		}
+	}
+
+	return nil, ErrNoCredentials
+}
+
+func (m multiAuthenticator) Challenge() string {
+	challenges := make([]string, len(m))
+	for i, a := range m {
+		challenges[i] = a.Challenge()
+	}
+
+	return strings.Join(challenges, ", ")
+}
@@ -0,0 +1,315 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package admin
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/square/quotaservice/logging"
+)
+
+const (
+	defaultJWKSRefreshInterval = time.Minute
+	defaultJWTLeeway           = 30 * time.Second
+)
+
+// JWTConfig configures an Authenticator validating OIDC/JWT bearer tokens. Tokens must be signed
+// with RS256, RS384 or RS512.
+type JWTConfig struct {
+	// Issuer is the expected "iss" claim.
+	Issuer string
+	// Audience, if set, must be present in the "aud" claim.
+	Audience string
+	// JWKSURL is where signing keys are fetched from. If empty, it is discovered from the issuer's
+	// /.well-known/openid-configuration document.
+	JWKSURL string
+	// UsernameClaim is the claim used as the principal name. Defaults to "sub".
+	UsernameClaim string
+	// MinRefreshInterval limits how often keys are re-fetched when a token references an unknown
+	// key ID. Defaults to 1 minute.
+	MinRefreshInterval time.Duration
+	// Leeway allowed for clock skew when validating "exp" and "nbf". Defaults to 30 seconds.
+	Leeway time.Duration
+	// HTTPClient used to fetch keys. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+type jwtAuthenticator struct {
+	cfg         JWTConfig
+	keys        map[string]*rsa.PublicKey
+	lastRefresh time.Time
+	now         func() time.Time
+	sync.Mutex
+}
+
+// NewJWTAuthenticator creates an Authenticator that validates bearer tokens against an OIDC
+// issuer's published JWKS.
+func NewJWTAuthenticator(cfg JWTConfig) Authenticator {
+	if cfg.UsernameClaim == "" {
+		cfg.UsernameClaim = "sub"
+	}
+
+	if cfg.MinRefreshInterval == 0 {
+		cfg.MinRefreshInterval = defaultJWKSRefreshInterval
+	}
+
+	if cfg.Leeway == 0 {
+		cfg.Leeway = defaultJWTLeeway
+	}
+
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = http.DefaultClient
+	}
+
+	return &jwtAuthenticator{cfg: cfg, keys: make(map[string]*rsa.PublicKey), now: time.Now}
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type jwks struct {
+	Keys []*jwk `json:"keys"`
+}
+
+func (j *jwtAuthenticator) Challenge() string {
+	return `Bearer realm="` + j.cfg.Issuer + `"`
+}
+
+func (j *jwtAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	authz := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authz, "Bearer ") {
+		return nil, ErrNoCredentials
+	}
+
+	claims, err := j.verify(strings.TrimSpace(strings.TrimPrefix(authz, "Bearer ")))
+	if err != nil {
+		return nil, err
+	}
+
+	name, _ := claims[j.cfg.UsernameClaim].(string)
+	if name == "" {
+		return nil, fmt.Errorf("token has no %q claim", j.cfg.UsernameClaim)
+	}
+
+	return &Principal{Name: name, Scheme: "bearer", Claims: claims}, nil
+}
+
+func (j *jwtAuthenticator) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	header := &jwtHeader{}
+	if err := decodeSegment(parts[0], header); err != nil {
+		return nil, err
+	}
+
+	var hash crypto.Hash
+	switch header.Alg {
+	case "RS256":
+		hash = crypto.SHA256
+	case "RS384":
+		hash = crypto.SHA384
+	case "RS512":
+		hash = crypto.SHA512
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", header.Alg)
+	}
+
+	key, err := j.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+
+	h := hash.New()
+	_, _ = h.Write([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, hash, h.Sum(nil), sig); err != nil {
+		return nil, errors.New("invalid token signature")
+	}
+
+	claims := make(map[string]interface{})
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	return claims, j.validateClaims(claims)
+}
+
+func (j *jwtAuthenticator) validateClaims(claims map[string]interface{}) error {
+	now := j.now()
+
+	if iss, _ := claims["iss"].(string); iss != j.cfg.Issuer {
+		return fmt.Errorf("unexpected issuer %q", iss)
+	}
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("token has no expiry")
+	}
+
+	if now.After(time.Unix(int64(exp), 0).Add(j.cfg.Leeway)) {
+		return errors.New("token has expired")
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(j.cfg.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token is not yet valid")
+	}
+
+	if j.cfg.Audience != "" && !hasAudience(claims["aud"], j.cfg.Audience) {
+		return fmt.Errorf("token is not intended for audience %q", j.cfg.Audience)
+	}
+
+	return nil
+}
+
+func hasAudience(aud interface{}, expected string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == expected
+	case []interface{}:
+		for _, v := range a {
+			if s, _ := v.(string); s == expected {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return errors.New("malformed token segment")
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		return errors.New("malformed token segment")
+	}
+
+	return nil
+}
+
+// key returns the public key for a key ID, refreshing the key set if the ID isn't known.
+func (j *jwtAuthenticator) key(kid string) (*rsa.PublicKey, error) {
+	j.Lock()
+	defer j.Unlock()
+
+	if k, exists := j.keys[kid]; exists {
+		return k, nil
+	}
+
+	if j.now().Sub(j.lastRefresh) < j.cfg.MinRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	j.lastRefresh = j.now()
+	if err := j.refreshLocked(); err != nil {
+		logging.Printf("Unable to refresh JWKS for issuer %v: %v", j.cfg.Issuer, err)
+		return nil, errors.New("unable to fetch signing keys")
+	}
+
+	if k, exists := j.keys[kid]; exists {
+		return k, nil
+	}
+
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func (j *jwtAuthenticator) refreshLocked() error {
+	if j.cfg.JWKSURL == "" {
+		discovery := &struct {
+			JWKSURI string `json:"jwks_uri"`
+		}{}
+
+		if err := j.fetchJSON(strings.TrimSuffix(j.cfg.Issuer, "/")+"/.well-known/openid-configuration", discovery); err != nil {
+			return err
+		}
+
+		if discovery.JWKSURI == "" {
+			return errors.New("OIDC discovery document has no jwks_uri")
+		}
+
+		j.cfg.JWKSURL = discovery.JWKSURI
+	}
+
+	set := &jwks{}
+	if err := j.fetchJSON(j.cfg.JWKSURL, set); err != nil {
+		return err
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+
+		pk, err := k.rsaPublicKey()
+		if err != nil {
+			logging.Printf("Ignoring invalid JWK %v: %v", k.Kid, err)
+			continue
+		}
+
+		keys[k.Kid] = pk
+	}
+
+	j.keys = keys
+	return nil
+}
+
+func (j *jwtAuthenticator) fetchJSON(url string, v interface{}) error {
+	res, err := j.cfg.HTTPClient.Get(url)
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = res.Body.Close() }()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %v returned %v", url, res.Status)
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func (k *jwk) rsaPublicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64())}, nil
+}
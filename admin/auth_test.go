@@ -0,0 +1,230 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package admin
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/square/quotaservice/test/helpers"
+)
+
+func newAuthTestServer(opts *Options) *httptest.Server {
+	return httptest.NewServer(authHandler(opts, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(getUsername(r)))
+	})))
+}
+
+func doAuthRequest(t *testing.T, ts *httptest.Server, method string, setAuth func(*http.Request)) (int, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, ts.URL, strings.NewReader(""))
+	helpers.CheckError(t, err)
+
+	if setAuth != nil {
+		setAuth(req)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	helpers.CheckError(t, err)
+	defer func() { _ = res.Body.Close() }()
+
+	b, err := ioutil.ReadAll(res.Body)
+	helpers.CheckError(t, err)
+
+	return res.StatusCode, string(b)
+}
+
+func TestBasicAuth(t *testing.T) {
+	ts := newAuthTestServer(&Options{
+		Authenticator: NewBasicAuthenticator("qs", map[string]string{"alice": "s3cret"})})
+	defer ts.Close()
+
+	status, body := doAuthRequest(t, ts, http.MethodPost, func(r *http.Request) { r.SetBasicAuth("alice", "s3cret") })
+	if status != http.StatusOK || body != "alice" {
+		t.Fatalf("Expected 200 for alice, got %v %v", status, body)
+	}
+
+	status, _ = doAuthRequest(t, ts, http.MethodPost, func(r *http.Request) { r.SetBasicAuth("alice", "wrong") })
+	if status != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for a bad password, got %v", status)
+	}
+
+	status, _ = doAuthRequest(t, ts, http.MethodPost, func(r *http.Request) { r.SetBasicAuth("bob", "s3cret") })
+	if status != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for an unknown user, got %v", status)
+	}
+
+	status, _ = doAuthRequest(t, ts, http.MethodGet, nil)
+	if status != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for an unauthenticated read, got %v", status)
+	}
+}
+
+func TestPublicReads(t *testing.T) {
+	ts := newAuthTestServer(&Options{
+		Authenticator: NewBasicAuthenticator("qs", map[string]string{"alice": "s3cret"}),
+		PublicReads:   true})
+	defer ts.Close()
+
+	status, body := doAuthRequest(t, ts, http.MethodGet, nil)
+	if status != http.StatusOK || body != AnonymousPrincipal {
+		t.Fatalf("Expected 200 for a public read, got %v %v", status, body)
+	}
+
+	status, _ = doAuthRequest(t, ts, http.MethodDelete, nil)
+	if status != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for an unauthenticated mutation, got %v", status)
+	}
+
+	// Bad credentials are still rejected on reads.
+	status, _ = doAuthRequest(t, ts, http.MethodGet, func(r *http.Request) { r.SetBasicAuth("alice", "wrong") })
+	if status != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for a read with bad credentials, got %v", status)
+	}
+}
+
+type testIssuer struct {
+	key    *rsa.PrivateKey
+	kid    string
+	server *httptest.Server
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	helpers.CheckError(t, err)
+
+	i := &testIssuer{key: key, kid: "test-key"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]string{"jwks_uri": i.server.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": i.kid,
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())}}})
+	})
+	i.server = httptest.NewServer(mux)
+
+	return i
+}
+
+func (i *testIssuer) sign(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": i.kid, "typ": "JWT"})
+	helpers.CheckError(t, err)
+	payload, err := json.Marshal(claims)
+	helpers.CheckError(t, err)
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	helpers.CheckError(t, err)
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTAuth(t *testing.T) {
+	issuer := newTestIssuer(t)
+	defer issuer.server.Close()
+
+	ts := newAuthTestServer(&Options{
+		Authenticator: NewJWTAuthenticator(JWTConfig{
+			Issuer:             issuer.server.URL,
+			Audience:           "quotaservice",
+			MinRefreshInterval: time.Nanosecond})})
+	defer ts.Close()
+
+	validClaims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss": issuer.server.URL,
+			"aud": []string{"quotaservice"},
+			"sub": "carol",
+			"exp": time.Now().Add(time.Hour).Unix()}
+	}
+
+	bearer := func(token string) func(*http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+	}
+
+	status, body := doAuthRequest(t, ts, http.MethodPost, bearer(issuer.sign(t, issuer.key, validClaims())))
+	if status != http.StatusOK || body != "carol" {
+		t.Fatalf("Expected 200 for a valid token, got %v %v", status, body)
+	}
+
+	expired := validClaims()
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+	status, _ = doAuthRequest(t, ts, http.MethodPost, bearer(issuer.sign(t, issuer.key, expired)))
+	if status != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for an expired token, got %v", status)
+	}
+
+	wrongIssuer := validClaims()
+	wrongIssuer["iss"] = "https://elsewhere"
+	status, _ = doAuthRequest(t, ts, http.MethodPost, bearer(issuer.sign(t, issuer.key, wrongIssuer)))
+	if status != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for a token from another issuer, got %v", status)
+	}
+
+	wrongAudience := validClaims()
+	wrongAudience["aud"] = "someone-else"
+	status, _ = doAuthRequest(t, ts, http.MethodPost, bearer(issuer.sign(t, issuer.key, wrongAudience)))
+	if status != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for a token for another audience, got %v", status)
+	}
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	helpers.CheckError(t, err)
+	status, _ = doAuthRequest(t, ts, http.MethodPost, bearer(issuer.sign(t, otherKey, validClaims())))
+	if status != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for a token signed by an untrusted key, got %v", status)
+	}
+
+	status, _ = doAuthRequest(t, ts, http.MethodPost, bearer("not.a.token"))
+	if status != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for a malformed token, got %v", status)
+	}
+}
+
+func TestMultiAuthenticator(t *testing.T) {
+	issuer := newTestIssuer(t)
+	defer issuer.server.Close()
+
+	ts := newAuthTestServer(&Options{
+		Authenticator: NewMultiAuthenticator(
+			NewBasicAuthenticator("qs", map[string]string{"alice": "s3cret"}),
+			NewJWTAuthenticator(JWTConfig{Issuer: issuer.server.URL}))})
+	defer ts.Close()
+
+	status, body := doAuthRequest(t, ts, http.MethodPost, func(r *http.Request) { r.SetBasicAuth("alice", "s3cret") })
+	if status != http.StatusOK || body != "alice" {
+		t.Fatalf("Expected 200 for basic auth, got %v %v", status, body)
+	}
+
+	token := issuer.sign(t, issuer.key, map[string]interface{}{
+		"iss": issuer.server.URL,
+		"sub": "carol",
+		"exp": time.Now().Add(time.Hour).Unix()})
+	status, body = doAuthRequest(t, ts, http.MethodPost, func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) })
+	if status != http.StatusOK || body != "carol" {
+		t.Fatalf("Expected 200 for a bearer token, got %v %v", status, body)
+	}
+
+	status, _ = doAuthRequest(t, ts, http.MethodPost, nil)
+	if status != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 with no credentials, got %v", status)
+	}
+}
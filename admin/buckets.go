@@ -67,7 +67,11 @@ func changeBucket(w http.ResponseWriter, r *http.Request, bucket string, updater
 
 	e = updater(c)
 
-	if e != nil {
+	if e == config.ErrActivationPending {
+		writeJSONError(w, &httpError{activationPendingMessage, http.StatusConflict})
+	} else if errs, ok := e.(config.ValidationErrors); ok {
+		writeJSONValidationErrors(w, errs)
+	} else if e != nil {
 		writeJSONError(w, &httpError{e.Error(), http.StatusInternalServerError})
 	} else {
 		writeJSONOk(w)
@@ -0,0 +1,336 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package admin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/square/quotaservice/config"
+	"github.com/square/quotaservice/logging"
+	pb "github.com/square/quotaservice/protos/config"
+)
+
+type configAPIHandler struct {
+	a Administrable
+}
+
+func newConfigAPIHandler(admin Administrable) *configAPIHandler {
+	return &configAPIHandler{a: admin}
+}
+
+type persistConfigResponse struct {
+	Version int32 `json:"version"`
+}
+
+type importConfigResponse struct {
+	// Version is the version assigned to the imported config, unset for dry runs.
+	Version int32              `json:"version,omitempty"`
+	DryRun  bool               `json:"dryRun"`
+	Diff    *config.ConfigDiff `json:"diff"`
+	Summary string             `json:"summary"`
+	// Warnings lists parts of the config that are valid but likely mistakes.
+	Warnings config.ValidationErrors `json:"warnings,omitempty"`
+}
+
+func (a *configAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/config"), "/")
+
+	switch {
+	case action == "" && r.Method == http.MethodPost:
+		a.persist(w, r)
+	case action == "export" && r.Method == http.MethodGet:
+		a.export(w, r)
+	case action == "effective" && r.Method == http.MethodGet:
+		a.effective(w, r)
+	case action == "import" && r.Method == http.MethodPost:
+		a.importConfig(w, r)
+	case action == "diff" && r.Method == http.MethodGet:
+		a.diff(w, r)
+	case action == "rollback" && r.Method == http.MethodPost:
+		a.rollback(w, r)
+	case action == "reload" && r.Method == http.MethodPost:
+		a.reload(w)
+	case action == "" || action == "export" || action == "effective" || action == "import" || action == "diff" ||
+		action == "rollback" || action == "reload":
+		writeJSONError(w, &httpError{"Unknown method " + r.Method, http.StatusBadRequest})
+	default:
+		writeJSONError(w, &httpError{"", http.StatusNotFound})
+	}
+}
+
+func (a *configAPIHandler) persist(w http.ResponseWriter, r *http.Request) {
+	c, err := readConfig(r)
+	if err != nil {
+		writeReadConfigError(w, err)
+		return
+	}
+
+	version, err := a.a.PersistConfig(c, getUsername(r))
+	if err != nil {
+		writePersistError(w, err)
+		return
+	}
+
+	writeJSON(w, &persistConfigResponse{version})
+}
+
+// export writes the current config, or the historical config with the version in the "version"
+// query parameter, as JSON or, if the "format" parameter is "yaml", as YAML.
+func (a *configAPIHandler) export(w http.ResponseWriter, r *http.Request) {
+	c, httpErr := a.configAtVersion(r.URL.Query().Get("version"))
+	if httpErr != nil {
+		writeJSONError(w, httpErr)
+		return
+	}
+
+	writeConfig(w, r, c)
+}
+
+// effective writes the current config as applied to buckets, as the export endpoint does. Unlike
+// the config exported, every field defaulted or resolved for a canary is made explicit.
+func (a *configAPIHandler) effective(w http.ResponseWriter, r *http.Request) {
+	c := a.a.EffectiveConfig()
+	if c == nil {
+		writeJSONError(w, &httpError{"No config applied yet", http.StatusNotFound})
+		return
+	}
+
+	writeConfig(w, r, c)
+}
+
+// writeConfig writes a config as JSON or, if the "format" query parameter is "yaml", as YAML.
+func writeConfig(w http.ResponseWriter, r *http.Request, c *pb.ServiceConfig) {
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+		writeJSON(w, c)
+	case "yaml":
+		b, err := config.ToYAML(c)
+		if err != nil {
+			writeJSONError(w, &httpError{"Unable to render config: " + err.Error(), http.StatusInternalServerError})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/yaml")
+		if _, err := w.Write(b); err != nil {
+			logging.Printf("Error writing YAML! %+v", err)
+		}
+	default:
+		writeJSONError(w, &httpError{"Unknown format " + format, http.StatusBadRequest})
+	}
+}
+
+// diff writes the changes between the config versions in the "from" and "to" query parameters. "to"
+// defaults to the current config. If "from" is later than "to", the diff describes reverting to
+// the earlier version.
+func (a *configAPIHandler) diff(w http.ResponseWriter, r *http.Request) {
+	from := r.URL.Query().Get("from")
+	if from == "" {
+		writeJSONError(w, &httpError{"Missing from version", http.StatusBadRequest})
+		return
+	}
+
+	fromCfg, httpErr := a.configAtVersion(from)
+	if httpErr != nil {
+		writeJSONError(w, httpErr)
+		return
+	}
+
+	toCfg, httpErr := a.configAtVersion(r.URL.Query().Get("to"))
+	if httpErr != nil {
+		writeJSONError(w, httpErr)
+		return
+	}
+
+	writeJSON(w, config.Diff(fromCfg, toCfg))
+}
+
+// rollback persists a copy of the historical config with the version in the "version" query
+// parameter as the next version.
+func (a *configAPIHandler) rollback(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query().Get("version")
+	version, err := strconv.ParseInt(v, 10, 32)
+	if err != nil {
+		writeJSONError(w, &httpError{"Invalid version " + v, http.StatusBadRequest})
+		return
+	}
+
+	newVersion, err := a.a.RollbackConfig(int32(version), getUsername(r))
+	if err == config.ErrUnknownVersion {
+		writeJSONError(w, &httpError{"Unable to locate config version " + v, http.StatusNotFound})
+		return
+	}
+
+	if err != nil {
+		writePersistError(w, err)
+		return
+	}
+
+	writeJSON(w, &persistConfigResponse{newVersion})
+}
+
+// reload applies the latest config in the persister without waiting for it to poll, e.g. after the
+// store was edited directly, and writes the version in force.
+func (a *configAPIHandler) reload(w http.ResponseWriter) {
+	version, err := a.a.ReloadConfig()
+	if err != nil {
+		writeJSONError(w, &httpError{"Unable to reload config: " + err.Error(), http.StatusInternalServerError})
+		return
+	}
+
+	writeJSON(w, &persistConfigResponse{version})
+}
+
+func (a *configAPIHandler) configAtVersion(v string) (*pb.ServiceConfig, *httpError) {
+	if v == "" {
+		return a.a.Configs(), nil
+	}
+
+	version, err := strconv.ParseInt(v, 10, 32)
+	if err != nil {
+		return nil, &httpError{"Invalid version " + v, http.StatusBadRequest}
+	}
+
+	configs, err := a.a.HistoricalConfigs()
+	if err != nil {
+		return nil, &httpError{"Error reading configs " + err.Error(), http.StatusInternalServerError}
+	}
+
+	for _, c := range configs {
+		if c != nil && c.Version == int32(version) {
+			return c, nil
+		}
+	}
+
+	return nil, &httpError{"Unable to locate config version " + v, http.StatusNotFound}
+}
+
+// importConfig validates a config and persists it as a new version, responding with its diff against
+// the current config. If the "dryRun" query parameter is true, the config is validated and diffed
+// but not persisted.
+func (a *configAPIHandler) importConfig(w http.ResponseWriter, r *http.Request) {
+	dryRun := false
+	if v := r.URL.Query().Get("dryRun"); v != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			writeJSONError(w, &httpError{"Invalid dryRun " + v, http.StatusBadRequest})
+			return
+		}
+	}
+
+	c, err := readConfig(r)
+	if err != nil {
+		writeReadConfigError(w, err)
+		return
+	}
+
+	if err := config.Validate(c); err != nil {
+		writePersistError(w, err)
+		return
+	}
+
+	current := a.a.Configs()
+
+	// Diff against the config as it will be applied, so defaulted fields aren't reported as changes.
+	applied := config.CloneConfig(c)
+	config.ApplyDefaults(applied)
+	applied.Version = current.Version + 1
+
+	response := &importConfigResponse{DryRun: dryRun, Warnings: config.Warnings(c)}
+
+	if !dryRun {
+		if response.Version, err = a.a.PersistConfig(c, getUsername(r)); err != nil {
+			writePersistError(w, err)
+			return
+		}
+
+		applied.Version = response.Version
+	}
+
+	response.Diff = config.Diff(current, applied)
+	response.Summary = response.Diff.Summary()
+	writeJSON(w, response)
+}
+
+// writeReadConfigError writes an error returned by readConfig, reporting malformed fields, such as
+// rate strings that can't be parsed, like validation errors.
+func writeReadConfigError(w http.ResponseWriter, err error) {
+	if errs, ok := err.(config.ValidationErrors); ok {
+		writeJSONValidationErrors(w, errs)
+		return
+	}
+
+	if parseErr, ok := err.(*config.ParseError); ok {
+		writeJSONError(w, &httpError{
+			fmt.Sprintf("Unable to parse config as %v: %v", parseErr.Format, parseErr.Err),
+			http.StatusBadRequest})
+		return
+	}
+
+	writeJSONError(w, &httpError{"Unable to parse config: " + err.Error(), http.StatusBadRequest})
+}
+
+// readConfig reads a config from a request body in the format its content type names, detecting it
+// if the content type names none.
+func readConfig(r *http.Request) (*pb.ServiceConfig, error) {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return config.Load(configFormat(r.Header.Get("Content-Type")), b)
+}
+
+// configFormat returns the config format a content type names, or config.FormatAuto if none.
+func configFormat(contentType string) config.Format {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml":
+		return config.FormatYAML
+	case "application/json":
+		return config.FormatJSON
+	case "application/x-protobuf", "application/protobuf", "application/octet-stream":
+		return config.FormatProto
+	}
+
+	return config.FormatAuto
+}
+
+// staleConfigMessage is sent when a change was based on a config that has since been superseded.
+const staleConfigMessage = "The config was changed concurrently, so this change is based on stale data. Please refresh and redo your changes."
+
+// activationPendingMessage is sent when a change was based on the active config while another is
+// pending activation.
+const activationPendingMessage = "A config is pending activation, and this change would drop it. Change the pending config, or wait for it to activate."
+
+// writePersistError translates errors from persisting a config into responses.
+func writePersistError(w http.ResponseWriter, err error) {
+	switch e := err.(type) {
+	case config.ValidationErrors:
+		writeJSONValidationErrors(w, e)
+	default:
+		if err == config.ErrStaleConfig {
+			writeJSONError(w, &httpError{staleConfigMessage, http.StatusConflict})
+			return
+		}
+
+		if err == config.ErrActivationPending {
+			writeJSONError(w, &httpError{activationPendingMessage, http.StatusConflict})
+			return
+		}
+
+		if err == config.ErrDuplicateConfig {
+			writeJSONError(w, &httpError{
+				"A config with this version already exists, probably due to a concurrent update. Please retry.",
+				http.StatusConflict})
+			return
+		}
+
+		writeJSONError(w, &httpError{"Unable to persist config: " + err.Error(), http.StatusInternalServerError})
+	}
+}
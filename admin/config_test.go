@@ -0,0 +1,573 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/square/quotaservice/config"
+	"github.com/square/quotaservice/test/helpers"
+)
+
+const validConfigJSON = `{"namespaces": {"foo": {"buckets": {"bar": {"size": 10, "fill_rate": 5}}}}}`
+
+func doConfigPost(t *testing.T, a Administrable, contentType, body string, setAuth func(*http.Request)) *httptest.ResponseRecorder {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	ServeAdminConsoleWithOptions(a, mux, "", false, &Options{
+		Authenticator: NewBasicAuthenticator("qs", map[string]string{"alice": "s3cret"}),
+		PublicReads:   true})
+
+	req := httptest.NewRequest(http.MethodPost, "/api/config", strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	if setAuth != nil {
+		setAuth(req)
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	return w
+}
+
+func alice(r *http.Request) {
+	r.SetBasicAuth("alice", "s3cret")
+}
+
+func TestConfigPostValid(t *testing.T) {
+	a := NewMockAdministrable()
+	a.cfg.Version = 4
+
+	w := doConfigPost(t, a, "application/json", validConfigJSON, alice)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %v %v", w.Code, w.Body.String())
+	}
+
+	response := &persistConfigResponse{}
+	helpers.CheckError(t, json.Unmarshal(w.Body.Bytes(), response))
+
+	if response.Version != 5 {
+		t.Errorf("Expected version 5 to be assigned, got %+v", response)
+	}
+
+	persisted := a.persisted[5]
+	if persisted == nil || persisted.Namespaces["foo"].Buckets["bar"].Size != 10 {
+		t.Fatalf("Config was not persisted: %+v", persisted)
+	}
+
+	if persisted.User != "alice" {
+		t.Errorf("Expected author alice, got %v", persisted.User)
+	}
+}
+
+func TestConfigPostYAML(t *testing.T) {
+	a := NewMockAdministrable()
+	body := "namespaces:\n  foo:\n    buckets:\n      bar:\n        size: 10\n"
+
+	w := doConfigPost(t, a, "application/x-yaml", body, alice)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %v %v", w.Code, w.Body.String())
+	}
+
+	if a.persisted[1] == nil || a.persisted[1].Namespaces["foo"].Buckets["bar"].Size != 10 {
+		t.Fatalf("Config was not persisted: %+v", a.persisted[1])
+	}
+}
+
+func TestConfigPostInvalid(t *testing.T) {
+	a := NewMockAdministrable()
+	body := `{"namespaces": {"foo": {
+		"default_bucket": {},
+		"dynamic_bucket_template": {},
+		"buckets": {"bar": {"size": -1}}}}}`
+
+	w := doConfigPost(t, a, "application/json", body, alice)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected 422, got %v %v", w.Code, w.Body.String())
+	}
+
+	response := &validationErrorResponse{}
+	helpers.CheckError(t, json.Unmarshal(w.Body.Bytes(), response))
+
+	fields := make(map[string]bool)
+	for _, e := range response.ValidationErrors {
+		fields[e.Field] = true
+	}
+
+	for _, f := range []string{"namespaces.foo", "namespaces.foo.buckets.bar.size"} {
+		if !fields[f] {
+			t.Errorf("Expected a validation error for %v, got %+v", f, response)
+		}
+	}
+
+	if len(a.persisted) != 0 {
+		t.Errorf("Invalid config should not be persisted: %+v", a.persisted)
+	}
+}
+
+func TestConfigPostDuplicateVersion(t *testing.T) {
+	a := NewMockAdministrable()
+	a.persisted[1] = config.NewDefaultServiceConfig()
+
+	w := doConfigPost(t, a, "application/json", validConfigJSON, alice)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected 409, got %v %v", w.Code, w.Body.String())
+	}
+}
+
+func TestConfigPostMalformed(t *testing.T) {
+	w := doConfigPost(t, NewMockAdministrable(), "application/json", "{", alice)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400, got %v %v", w.Code, w.Body.String())
+	}
+}
+
+func TestConfigPostRequiresAuthentication(t *testing.T) {
+	a := NewMockAdministrable()
+
+	w := doConfigPost(t, a, "application/json", validConfigJSON, nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401, got %v %v", w.Code, w.Body.String())
+	}
+}
+
+func newExportTestAdministrable(t *testing.T) *MockAdministrable {
+	a := NewMockAdministrable()
+	ns := config.NewDefaultNamespaceConfig("foo")
+	helpers.CheckError(t, config.AddBucket(ns, config.NewDefaultBucketConfig("bar")))
+	helpers.CheckError(t, config.AddNamespace(a.cfg, ns))
+	config.ApplyDefaults(a.cfg)
+	a.cfg.Version = 7
+	return a
+}
+
+func doConfigRequest(t *testing.T, a Administrable, method, path, contentType, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	ServeAdminConsole(a, mux, "", false)
+
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	return w
+}
+
+func TestConfigExportImportRoundTrip(t *testing.T) {
+	for _, format := range []struct{ name, contentType string }{
+		{"json", "application/json"},
+		{"yaml", "application/yaml"},
+	} {
+		staging := newExportTestAdministrable(t)
+
+		w := doConfigRequest(t, staging, http.MethodGet, "/api/config/export?format="+format.name, "", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200 exporting %v, got %v %v", format.name, w.Code, w.Body.String())
+		}
+
+		if ct := w.Header().Get("Content-Type"); ct != format.contentType {
+			t.Errorf("Expected content type %v, got %v", format.contentType, ct)
+		}
+
+		exported := w.Body.String()
+		production := NewMockAdministrable()
+
+		w = doConfigRequest(t, production, http.MethodPost, "/api/config/import", format.contentType, exported)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200 importing %v, got %v %v", format.name, w.Code, w.Body.String())
+		}
+
+		response := &importConfigResponse{}
+		helpers.CheckError(t, json.Unmarshal(w.Body.Bytes(), response))
+
+		if response.DryRun || response.Version != 1 {
+			t.Errorf("Expected import to persist version 1, got %+v", response)
+		}
+
+		if !reflect.DeepEqual(response.Diff.AddedNamespaces, []string{"foo"}) {
+			t.Errorf("Expected import to add namespace foo, got %+v", response.Diff)
+		}
+
+		if config.DifferentNamespaceConfigs(staging.cfg.Namespaces["foo"], production.persisted[1].Namespaces["foo"]) {
+			t.Errorf("Imported %+v does not match exported %+v", production.persisted[1], staging.cfg)
+		}
+
+		// Importing the same config again is a no-op.
+		w = doConfigRequest(t, production, http.MethodPost, "/api/config/import?dryRun=true", format.contentType, exported)
+		helpers.CheckError(t, json.Unmarshal(w.Body.Bytes(), response))
+
+		if !response.Diff.Empty() {
+			t.Errorf("Expected re-importing %v to be a no-op, got %+v", format.name, response.Diff)
+		}
+	}
+}
+
+func TestConfigImportDryRun(t *testing.T) {
+	a := newExportTestAdministrable(t)
+
+	w := doConfigRequest(t, a, http.MethodPost, "/api/config/import?dryRun=true", "application/json", validConfigJSON)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %v %v", w.Code, w.Body.String())
+	}
+
+	response := &importConfigResponse{}
+	helpers.CheckError(t, json.Unmarshal(w.Body.Bytes(), response))
+
+	if !response.DryRun || response.Version != 0 {
+		t.Errorf("Expected a dry run, got %+v", response)
+	}
+
+	if len(response.Diff.ModifiedNamespaces) != 1 || !reflect.DeepEqual(response.Diff.ModifiedNamespaces[0].ModifiedBuckets, []string{"bar"}) {
+		t.Errorf("Expected bucket foo:bar to be modified, got %+v", response.Diff)
+	}
+
+	if response.Diff.FromVersion != 7 || response.Diff.ToVersion != 8 {
+		t.Errorf("Expected a diff from version 7 to 8, got %+v", response.Diff)
+	}
+
+	if len(a.persisted) != 0 {
+		t.Errorf("Dry run should not persist: %+v", a.persisted)
+	}
+}
+
+func TestConfigImportWarnings(t *testing.T) {
+	a := newExportTestAdministrable(t)
+
+	w := doConfigRequest(t, a, http.MethodPost, "/api/config/import?dryRun=true", "application/json",
+		`{"namespaces": {"foo": {"buckets": {"bar": {"size": 10, "fill_rate": 20}}}}}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %v %v", w.Code, w.Body.String())
+	}
+
+	response := &importConfigResponse{}
+	helpers.CheckError(t, json.Unmarshal(w.Body.Bytes(), response))
+
+	if len(response.Warnings) != 1 || response.Warnings[0].Field != "namespaces.foo.buckets.bar.fill_rate" {
+		t.Errorf("Expected a warning for the fill rate above the size, got %+v", response.Warnings)
+	}
+}
+
+func TestConfigImportInvalid(t *testing.T) {
+	a := NewMockAdministrable()
+
+	w := doConfigRequest(t, a, http.MethodPost, "/api/config/import?dryRun=true", "application/json",
+		`{"namespaces": {"foo": {"max_dynamic_buckets": -1}}}`)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected 422, got %v %v", w.Code, w.Body.String())
+	}
+}
+
+func TestConfigImportMalformedRate(t *testing.T) {
+	a := NewMockAdministrable()
+
+	w := doConfigRequest(t, a, http.MethodPost, "/api/config/import?dryRun=true", "application/json",
+		`{"namespaces": {"foo": {"buckets": {"bar": {"fill_rate": "100/fortnight"}}}}}`)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected 422, got %v %v", w.Code, w.Body.String())
+	}
+
+	if !strings.Contains(w.Body.String(), "namespaces.foo.buckets.bar.fill_rate") {
+		t.Errorf("Expected the malformed rate's field to be reported, got %v", w.Body.String())
+	}
+}
+
+func TestConfigImportFormats(t *testing.T) {
+	cfg := config.NewDefaultServiceConfig()
+	ns := config.NewDefaultNamespaceConfig("foo")
+	helpers.CheckError(t, config.AddBucket(ns, config.NewDefaultBucketConfig("bar")))
+	helpers.CheckError(t, config.AddNamespace(cfg, ns))
+
+	marshalled, err := proto.Marshal(cfg)
+	helpers.CheckError(t, err)
+
+	for _, format := range []struct{ name, contentType, body string }{
+		{"protobuf", "application/x-protobuf", string(marshalled)},
+		{"detected protobuf", "", string(marshalled)},
+		{"detected YAML", "", "namespaces:\n  foo:\n    buckets:\n      bar: {}\n"},
+		{"detected JSON", "text/plain", `{"namespaces": {"foo": {"buckets": {"bar": {}}}}}`},
+	} {
+		a := NewMockAdministrable()
+
+		w := doConfigRequest(t, a, http.MethodPost, "/api/config/import", format.contentType, format.body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200 importing %v, got %v %v", format.name, w.Code, w.Body.String())
+		}
+
+		if a.persisted[1] == nil || a.persisted[1].Namespaces["foo"].Buckets["bar"] == nil {
+			t.Errorf("Expected %v config to be persisted, got %+v", format.name, a.persisted[1])
+		}
+	}
+}
+
+func TestConfigImportMalformedProto(t *testing.T) {
+	w := doConfigRequest(t, NewMockAdministrable(), http.MethodPost, "/api/config/import", "application/x-protobuf", "\xff\xff")
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "as proto") {
+		t.Fatalf("Expected 400 for malformed protobuf, got %v %v", w.Code, w.Body.String())
+	}
+}
+
+func TestConfigExportVersion(t *testing.T) {
+	a := newExportTestAdministrable(t)
+	old := config.NewDefaultServiceConfig()
+	old.Version = 3
+	a.persisted[3] = old
+
+	w := doConfigRequest(t, a, http.MethodGet, "/api/config/export?version=3", "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %v %v", w.Code, w.Body.String())
+	}
+
+	exported, err := config.FromJSON(w.Body.Bytes())
+	helpers.CheckError(t, err)
+
+	if exported.Version != 3 || len(exported.Namespaces) != 0 {
+		t.Errorf("Expected version 3 to be exported, got %+v", exported)
+	}
+
+	if w = doConfigRequest(t, a, http.MethodGet, "/api/config/export?version=4", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown version, got %v", w.Code)
+	}
+
+	if w = doConfigRequest(t, a, http.MethodGet, "/api/config/export?format=xml", "", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown format, got %v", w.Code)
+	}
+}
+
+func TestConfigEffective(t *testing.T) {
+	a := newExportTestAdministrable(t)
+
+	w := doConfigRequest(t, a, http.MethodGet, "/api/config/effective", "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %v %v", w.Code, w.Body.String())
+	}
+
+	effective, err := config.FromJSON(w.Body.Bytes())
+	helpers.CheckError(t, err)
+
+	if !proto.Equal(effective, a.EffectiveConfig()) {
+		t.Errorf("Expected the effective config %+v, got %+v", a.EffectiveConfig(), effective)
+	}
+
+	if w = doConfigRequest(t, a, http.MethodGet, "/api/config/effective?format=yaml", "", ""); w.Code != http.StatusOK ||
+		w.Header().Get("Content-Type") != "application/yaml" {
+		t.Errorf("Expected the effective config as YAML, got %v %v", w.Code, w.Body.String())
+	}
+
+	if w = doConfigRequest(t, a, http.MethodPost, "/api/config/effective", "", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown method, got %v", w.Code)
+	}
+}
+
+// newDiffTestAdministrable has two persisted versions: version 3, with namespaces "gone" and
+// "changed", and version 4, with namespaces "changed" and "new". In version 4, bucket "old" was
+// removed from "changed", "edited" was modified and "added" was added.
+func newDiffTestAdministrable(t *testing.T) *MockAdministrable {
+	a := NewMockAdministrable()
+
+	v3 := config.NewDefaultServiceConfig()
+	v3.Version = 3
+	changed := config.NewDefaultNamespaceConfig("changed")
+	helpers.CheckError(t, config.AddBucket(changed, config.NewDefaultBucketConfig("old")))
+	helpers.CheckError(t, config.AddBucket(changed, config.NewDefaultBucketConfig("edited")))
+	helpers.CheckError(t, config.AddNamespace(v3, changed))
+	helpers.CheckError(t, config.AddNamespace(v3, config.NewDefaultNamespaceConfig("gone")))
+
+	v4 := config.CloneConfig(v3)
+	v4.Version = 4
+	helpers.CheckError(t, config.DeleteNamespace(v4, "gone"))
+	helpers.CheckError(t, config.DeleteBucket(v4, "changed", "old"))
+	edited := config.NewDefaultBucketConfig("edited")
+	edited.Size = 1234
+	helpers.CheckError(t, config.UpdateBucket(v4, "changed", edited))
+	helpers.CheckError(t, config.CreateBucket(v4, "changed", config.NewDefaultBucketConfig("added")))
+	helpers.CheckError(t, config.AddNamespace(v4, config.NewDefaultNamespaceConfig("new")))
+
+	a.persisted[3] = v3
+	a.persisted[4] = v4
+	a.cfg = v4
+	return a
+}
+
+func getDiff(t *testing.T, a Administrable, query string) *config.ConfigDiff {
+	t.Helper()
+
+	w := doConfigRequest(t, a, http.MethodGet, "/api/config/diff?"+query, "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %v %v", w.Code, w.Body.String())
+	}
+
+	d := &config.ConfigDiff{}
+	helpers.CheckError(t, json.Unmarshal(w.Body.Bytes(), d))
+	return d
+}
+
+func TestConfigDiff(t *testing.T) {
+	d := getDiff(t, newDiffTestAdministrable(t), "from=3&to=4")
+
+	if d.FromVersion != 3 || d.ToVersion != 4 {
+		t.Errorf("Unexpected versions %+v", d)
+	}
+
+	if !reflect.DeepEqual(d.AddedNamespaces, []string{"new"}) ||
+		!reflect.DeepEqual(d.RemovedNamespaces, []string{"gone"}) {
+		t.Errorf("Unexpected namespace changes %+v", d)
+	}
+
+	if len(d.ModifiedNamespaces) != 1 {
+		t.Fatalf("Expected 1 modified namespace, got %+v", d.ModifiedNamespaces)
+	}
+
+	nd := d.ModifiedNamespaces[0]
+	if nd.Name != "changed" ||
+		!reflect.DeepEqual(nd.AddedBuckets, []string{"added"}) ||
+		!reflect.DeepEqual(nd.RemovedBuckets, []string{"old"}) ||
+		!reflect.DeepEqual(nd.ModifiedBuckets, []string{"edited"}) {
+		t.Errorf("Unexpected namespace diff %+v", nd)
+	}
+}
+
+func TestConfigDiffReversed(t *testing.T) {
+	a := newDiffTestAdministrable(t)
+	d := getDiff(t, a, "from=4&to=3")
+
+	if d.FromVersion != 4 || d.ToVersion != 3 ||
+		!reflect.DeepEqual(d.AddedNamespaces, []string{"gone"}) ||
+		!reflect.DeepEqual(d.RemovedNamespaces, []string{"new"}) {
+		t.Errorf("Expected the diff to describe reverting to version 3, got %+v", d)
+	}
+
+	// "to" defaults to the current config
+	if d = getDiff(t, a, "from=3"); d.ToVersion != 4 {
+		t.Errorf("Expected a diff against the current version, got %+v", d)
+	}
+}
+
+func TestConfigDiffErrors(t *testing.T) {
+	a := newDiffTestAdministrable(t)
+
+	for query, expected := range map[string]int{
+		"from=3&to=5": http.StatusNotFound,
+		"from=2&to=4": http.StatusNotFound,
+		"to=4":        http.StatusBadRequest,
+		"from=x&to=4": http.StatusBadRequest,
+	} {
+		w := doConfigRequest(t, a, http.MethodGet, "/api/config/diff?"+query, "", "")
+		if w.Code != expected {
+			t.Errorf("Expected %v for %v, got %v %v", expected, query, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestConfigRollback(t *testing.T) {
+	a := newDiffTestAdministrable(t)
+
+	w := doConfigRequest(t, a, http.MethodPost, "/api/config/rollback?version=3", "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %v %v", w.Code, w.Body.String())
+	}
+
+	response := &persistConfigResponse{}
+	helpers.CheckError(t, json.Unmarshal(w.Body.Bytes(), response))
+
+	if response.Version != 5 {
+		t.Fatalf("Expected version 5 to be assigned, got %+v", response)
+	}
+
+	latest := a.persisted[5]
+	expected := config.CloneConfig(a.persisted[3])
+	expected.Version, expected.User = 5, latest.User
+	if !reflect.DeepEqual(latest, expected) {
+		t.Errorf("Expected version 3 to be restored as version 5, got %+v", latest)
+	}
+
+	if a.persisted[3].Version != 3 {
+		t.Error("Expected history to be preserved")
+	}
+
+	entries, _, err := a.AuditEntries(0, 1)
+	helpers.CheckError(t, err)
+
+	if len(entries) != 1 || entries[0].Note != "rollback to version 3" {
+		t.Errorf("Expected the rollback to be audited, got %+v", entries)
+	}
+}
+
+func TestConfigRollbackErrors(t *testing.T) {
+	a := newDiffTestAdministrable(t)
+
+	for query, expected := range map[string]int{
+		"version=9": http.StatusNotFound,
+		"version=x": http.StatusBadRequest,
+		"":          http.StatusBadRequest,
+	} {
+		w := doConfigRequest(t, a, http.MethodPost, "/api/config/rollback?"+query, "", "")
+		if w.Code != expected {
+			t.Errorf("Expected %v for %q, got %v %v", expected, query, w.Code, w.Body.String())
+		}
+	}
+
+	if w := doConfigRequest(t, a, http.MethodGet, "/api/config/rollback?version=3", "", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for GET, got %v", w.Code)
+	}
+}
+
+func TestConfigRollbackRequiresEditor(t *testing.T) {
+	a := newDiffTestAdministrable(t)
+	mux := http.NewServeMux()
+	ServeAdminConsoleWithOptions(a, mux, "", false, &Options{
+		Authenticator: NewBasicAuthenticator("qs", map[string]string{"vera": "pw"}),
+		Roles:         NewStaticRoleMapper(rbacTestRoles, RoleNone)})
+
+	req := httptest.NewRequest(http.MethodPost, "/api/config/rollback?version=3", nil)
+	req.SetBasicAuth("vera", "pw")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a rollback by a viewer, got %v %v", w.Code, w.Body.String())
+	}
+
+	if a.cfg.Version != 4 {
+		t.Errorf("Expected no rollback, got version %v", a.cfg.Version)
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	a := NewMockAdministrable()
+
+	// Persisted directly in the store, bypassing the admin API.
+	edited := config.NewDefaultServiceConfig()
+	edited.Version = a.cfg.Version + 1
+	a.persisted[edited.Version] = edited
+
+	w := doConfigRequest(t, a, http.MethodPost, "/api/config/reload", "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %v %v", w.Code, w.Body.String())
+	}
+
+	response := &persistConfigResponse{}
+	helpers.CheckError(t, json.Unmarshal(w.Body.Bytes(), response))
+
+	if response.Version != edited.Version {
+		t.Errorf("Expected version %v to be reloaded, got %+v", edited.Version, response)
+	}
+
+	if w := doConfigRequest(t, a, http.MethodGet, "/api/config/reload", "", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a GET, got %v %v", w.Code, w.Body.String())
+	}
+
+	if w := doConfigRequest(t, NewMockErrorAdministrable(), http.MethodPost, "/api/config/reload", "", ""); w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 when reloading fails, got %v %v", w.Code, w.Body.String())
+	}
+}
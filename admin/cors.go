@@ -0,0 +1,139 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package admin
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	defaultCORSMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete}
+	defaultCORSHeaders = []string{"Authorization", "Content-Type", "Version"}
+)
+
+// CORSOptions allows the admin API to be called from other origins, such as a central ops
+// dashboard.
+type CORSOptions struct {
+	// AllowedOrigins lists the origins allowed, e.g. "https://ops.example.com". "*" allows any
+	// origin, but never with credentials.
+	AllowedOrigins []string
+	// AllowedMethods defaults to GET, HEAD, POST, PUT and DELETE.
+	AllowedMethods []string
+	// AllowedHeaders defaults to Authorization, Content-Type and Version.
+	AllowedHeaders []string
+	// AllowCredentials lets browsers send cookies and credentials with cross-origin requests.
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache a preflight response. If 0, browsers use their default.
+	MaxAge time.Duration
+}
+
+// allowsOrigin returns whether an origin is allowed, and whether it was only allowed by "*".
+func (c *CORSOptions) allowsOrigin(origin string) (allowed, wildcard bool) {
+	for _, o := range c.AllowedOrigins {
+		if strings.EqualFold(o, origin) {
+			return true, false
+		}
+
+		if o == "*" {
+			wildcard = true
+		}
+	}
+
+	return wildcard, wildcard
+}
+
+func (c *CORSOptions) methods() []string {
+	if len(c.AllowedMethods) == 0 {
+		return defaultCORSMethods
+	}
+
+	return c.AllowedMethods
+}
+
+func (c *CORSOptions) headers() []string {
+	if len(c.AllowedHeaders) == 0 {
+		return defaultCORSHeaders
+	}
+
+	return c.AllowedHeaders
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sameOrigin returns true if a request's origin is the host it was sent to, as browsers send Origin
+// on some same-origin requests too.
+func sameOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// corsHandler answers preflight requests from allowed origins and sets the CORS headers on their
+// requests. Cross-origin requests from other origins are rejected with a 403. If CORS isn't
+// configured, no CORS headers are set, so browsers only allow same-origin requests.
+func corsHandler(opts *Options, next http.Handler) http.Handler {
+	c := opts.CORS
+	if c == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || sameOrigin(r, origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+
+		allowed, wildcard := c.allowsOrigin(origin)
+		if !allowed {
+			writeJSONError(w, &httpError{"Origin " + origin + " is not allowed", http.StatusForbidden})
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if c.AllowCredentials && !wildcard {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		requestedMethod := r.Header.Get("Access-Control-Request-Method")
+		if r.Method != http.MethodOptions || requestedMethod == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// A preflight request, asking whether the actual request may be sent.
+		if !containsFold(c.methods(), requestedMethod) {
+			writeJSONError(w, &httpError{"Method " + requestedMethod + " is not allowed", http.StatusForbidden})
+			return
+		}
+
+		for _, h := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+			if h = strings.TrimSpace(h); h != "" && !containsFold(c.headers(), h) {
+				writeJSONError(w, &httpError{"Header " + h + " is not allowed", http.StatusForbidden})
+				return
+			}
+		}
+
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(c.methods(), ", "))
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(c.headers(), ", "))
+		if c.MaxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge/time.Second)))
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
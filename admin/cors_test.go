@@ -0,0 +1,141 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const opsOrigin = "https://ops.example.org"
+
+func serveCORSConsole(cors *CORSOptions) *http.ServeMux {
+	mux := http.NewServeMux()
+	ServeAdminConsoleWithOptions(NewMockAdministrable(), mux, "", false, &Options{
+		Authenticator: NewBasicAuthenticator("qs", map[string]string{"alice": "s3cret"}),
+		CORS:          cors})
+
+	return mux
+}
+
+func doCORSRequest(mux *http.ServeMux, method, origin string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/api/configs", nil)
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	return w
+}
+
+func TestCORSPreflight(t *testing.T) {
+	mux := serveCORSConsole(&CORSOptions{
+		AllowedOrigins:   []string{opsOrigin},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute})
+
+	// Preflights carry no credentials, so must be answered before authenticating.
+	w := doCORSRequest(mux, http.MethodOptions, opsOrigin, map[string]string{
+		"Access-Control-Request-Method":  http.MethodPost,
+		"Access-Control-Request-Headers": "authorization, content-type"})
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 for a preflight, got %v %v", w.Code, w.Body.String())
+	}
+
+	expected := map[string]string{
+		"Access-Control-Allow-Origin":      opsOrigin,
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Allow-Methods":     "GET, HEAD, POST, PUT, DELETE",
+		"Access-Control-Allow-Headers":     "Authorization, Content-Type, Version",
+		"Access-Control-Max-Age":           "600",
+		"Vary":                             "Origin"}
+
+	for k, v := range expected {
+		if actual := w.Header().Get(k); actual != v {
+			t.Errorf("Expected %v to be %q, got %q", k, v, actual)
+		}
+	}
+
+	w = doCORSRequest(mux, http.MethodOptions, opsOrigin, map[string]string{
+		"Access-Control-Request-Method": http.MethodPatch})
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a preflight of a method not allowed, got %v", w.Code)
+	}
+
+	w = doCORSRequest(mux, http.MethodOptions, opsOrigin, map[string]string{
+		"Access-Control-Request-Method":  http.MethodGet,
+		"Access-Control-Request-Headers": "X-Custom"})
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a preflight of a header not allowed, got %v", w.Code)
+	}
+
+	// Actual requests are still authenticated.
+	w = doCORSRequest(mux, http.MethodGet, opsOrigin, nil)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("Access-Control-Allow-Origin") != opsOrigin {
+		t.Errorf("Expected an unauthenticated request to be rejected with CORS headers, got %v %v", w.Code, w.Header())
+	}
+}
+
+func TestCORSDisallowedOrigin(t *testing.T) {
+	mux := serveCORSConsole(&CORSOptions{AllowedOrigins: []string{opsOrigin}})
+
+	for _, method := range []string{http.MethodOptions, http.MethodGet} {
+		w := doCORSRequest(mux, method, "https://evil.example.org", map[string]string{
+			"Access-Control-Request-Method": http.MethodGet})
+
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected 403 for %v from a disallowed origin, got %v", method, w.Code)
+		}
+
+		if h := w.Header().Get("Access-Control-Allow-Origin"); h != "" {
+			t.Errorf("Expected no CORS headers for a disallowed origin, got %v", h)
+		}
+	}
+
+	// Browsers send Origin on some same-origin requests, which aren't cross-origin.
+	w := doCORSRequest(mux, http.MethodGet, "http://example.com", nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a same-origin request to be passed on, got %v", w.Code)
+	}
+}
+
+func TestCORSWildcard(t *testing.T) {
+	mux := serveCORSConsole(&CORSOptions{AllowedOrigins: []string{"*"}, AllowCredentials: true})
+
+	w := doCORSRequest(mux, http.MethodOptions, opsOrigin, map[string]string{
+		"Access-Control-Request-Method": http.MethodGet})
+
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != opsOrigin {
+		t.Fatalf("Expected any origin to be allowed, got %v %v", w.Code, w.Header())
+	}
+
+	if w.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Error("Expected credentials never to be allowed for any origin")
+	}
+}
+
+func TestCORSDisabledByDefault(t *testing.T) {
+	mux := serveCORSConsole(nil)
+
+	w := doCORSRequest(mux, http.MethodOptions, opsOrigin, map[string]string{
+		"Access-Control-Request-Method": http.MethodGet})
+
+	if h := w.Header().Get("Access-Control-Allow-Origin"); h != "" {
+		t.Errorf("Expected no CORS headers by default, got %v", h)
+	}
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the preflight to be authenticated as any request, got %v", w.Code)
+	}
+}
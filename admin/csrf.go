@@ -0,0 +1,130 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package admin
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+const (
+	defaultCSRFCookieName = "quotaservice_csrf"
+	defaultCSRFHeaderName = "X-CSRF-Token"
+	csrfTokenBytes        = 32
+)
+
+// CSRFOptions protects mutating admin requests against cross-site request forgery, for consoles
+// authenticated with cookies or other credentials browsers send ambiently. Mutating requests must
+// echo the token set in a cookie by GET /api/csrf in a header.
+type CSRFOptions struct {
+	// CookieName defaults to quotaservice_csrf.
+	CookieName string
+	// HeaderName defaults to X-CSRF-Token.
+	HeaderName string
+	// Secure only sends the cookie over HTTPS.
+	Secure bool
+}
+
+func (c *CSRFOptions) cookieName() string {
+	if c.CookieName == "" {
+		return defaultCSRFCookieName
+	}
+
+	return c.CookieName
+}
+
+func (c *CSRFOptions) headerName() string {
+	if c.HeaderName == "" {
+		return defaultCSRFHeaderName
+	}
+
+	return c.HeaderName
+}
+
+// bearerAuthenticated returns true for requests carrying a bearer token, which browsers never send
+// ambiently, so can't be forged across sites.
+func bearerAuthenticated(r *http.Request) bool {
+	scheme := strings.SplitN(r.Header.Get("Authorization"), " ", 2)[0]
+	return strings.EqualFold(scheme, "bearer")
+}
+
+// csrfHandler rejects mutating requests with a 403 unless they carry the token in the CSRF cookie
+// in the CSRF header too. Requests authenticated by a bearer token aren't checked.
+func csrfHandler(opts *Options, next http.Handler) http.Handler {
+	c := opts.CSRF
+	if c == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isReadOnlyMethod(r.Method) || bearerAuthenticated(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cookie, err := r.Cookie(c.cookieName())
+		if err != nil || cookie.Value == "" {
+			writeJSONError(w, &httpError{"Missing CSRF cookie", http.StatusForbidden})
+			return
+		}
+
+		header := r.Header.Get(c.headerName())
+		if subtle.ConstantTimeCompare([]byte(header), []byte(cookie.Value)) != 1 {
+			writeJSONError(w, &httpError{"Missing or mismatched " + c.headerName() + " header", http.StatusForbidden})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// csrfAPIHandler hands out the CSRF token for the UI to echo, setting the cookie if the caller
+// doesn't have one yet. Other sites can't read the response, so the token stays secret.
+type csrfAPIHandler struct {
+	opts *CSRFOptions
+}
+
+type csrfResponse struct {
+	Token  string `json:"token"`
+	Header string `json:"header"`
+}
+
+func newCSRFAPIHandler(opts *CSRFOptions) *csrfAPIHandler {
+	return &csrfAPIHandler{opts}
+}
+
+func (h *csrfAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, &httpError{"Unknown method " + r.Method, http.StatusBadRequest})
+		return
+	}
+
+	token := ""
+	if cookie, err := r.Cookie(h.opts.cookieName()); err == nil {
+		token = cookie.Value
+	}
+
+	if token == "" {
+		b := make([]byte, csrfTokenBytes)
+		if _, err := rand.Read(b); err != nil {
+			writeJSONError(w, &httpError{"Unable to generate a CSRF token: " + err.Error(), http.StatusInternalServerError})
+			return
+		}
+
+		token = base64.RawURLEncoding.EncodeToString(b)
+		http.SetCookie(w, &http.Cookie{
+			Name:     h.opts.cookieName(),
+			Value:    token,
+			Path:     "/",
+			Secure:   h.opts.Secure,
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode})
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, &csrfResponse{token, h.opts.headerName()})
+}
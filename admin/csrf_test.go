@@ -0,0 +1,129 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func serveCSRFConsole() *http.ServeMux {
+	mux := http.NewServeMux()
+	ServeAdminConsoleWithOptions(NewMockAdministrable(), mux, "", false, &Options{CSRF: &CSRFOptions{}})
+	return mux
+}
+
+func fetchCSRFToken(t *testing.T, mux *http.ServeMux) (*http.Cookie, string) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/csrf", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 fetching a CSRF token, got %v %v", w.Code, w.Body.String())
+	}
+
+	var rsp csrfResponse
+	if err := unmarshalJSON(w.Body, &rsp); err != nil {
+		t.Fatal(err)
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != rsp.Token || !cookies[0].HttpOnly ||
+		cookies[0].SameSite != http.SameSiteStrictMode {
+		t.Fatalf("Expected a strict, HTTP-only cookie carrying token %v, got %v", rsp.Token, cookies)
+	}
+
+	if rsp.Header != defaultCSRFHeaderName {
+		t.Errorf("Expected header %v, got %v", defaultCSRFHeaderName, rsp.Header)
+	}
+
+	return cookies[0], rsp.Token
+}
+
+func doCSRFRequest(mux *http.ServeMux, cookie *http.Cookie, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodDelete, "/api/foo", nil)
+	req.Header.Set("Version", "0")
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+
+	if token != "" {
+		req.Header.Set(defaultCSRFHeaderName, token)
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	return w
+}
+
+func TestCSRFAccepted(t *testing.T) {
+	mux := serveCSRFConsole()
+	cookie, token := fetchCSRFToken(t, mux)
+
+	if w := doCSRFRequest(mux, cookie, token); w.Code != http.StatusOK {
+		t.Fatalf("Expected a request with a matching token to be accepted, got %v %v", w.Code, w.Body.String())
+	}
+
+	// Callers with a token keep it.
+	req := httptest.NewRequest(http.MethodGet, "/api/csrf", nil)
+	req.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	var rsp csrfResponse
+	if err := unmarshalJSON(w.Body, &rsp); err != nil {
+		t.Fatal(err)
+	}
+
+	if rsp.Token != token || len(w.Result().Cookies()) != 0 {
+		t.Errorf("Expected token %v to be kept, got %v", token, rsp.Token)
+	}
+}
+
+func TestCSRFRejected(t *testing.T) {
+	mux := serveCSRFConsole()
+	cookie, token := fetchCSRFToken(t, mux)
+
+	tests := map[string]struct {
+		cookie *http.Cookie
+		token  string
+	}{
+		"no token":         {cookie, ""},
+		"no cookie":        {nil, token},
+		"mismatched token": {cookie, token + "x"},
+	}
+
+	for name, test := range tests {
+		if w := doCSRFRequest(mux, test.cookie, test.token); w.Code != http.StatusForbidden {
+			t.Errorf("Expected 403 for a request with %v, got %v", name, w.Code)
+		}
+	}
+
+	// Reads aren't checked.
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/configs", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected a read without a token to be accepted, got %v", w.Code)
+	}
+}
+
+func TestCSRFSkippedForBearerTokens(t *testing.T) {
+	ts := httptest.NewServer(csrfHandler(&Options{CSRF: &CSRFOptions{}}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSONOk(w)
+	})))
+	defer ts.Close()
+
+	status, _ := doAuthRequest(t, ts, http.MethodPost, func(r *http.Request) { r.Header.Set("Authorization", "Bearer abc") })
+	if status != http.StatusOK {
+		t.Errorf("Expected a bearer-authenticated request to skip CSRF checks, got %v", status)
+	}
+
+	// Browsers send basic auth credentials ambiently.
+	status, _ = doAuthRequest(t, ts, http.MethodPost, func(r *http.Request) { r.SetBasicAuth("alice", "s3cret") })
+	if status != http.StatusForbidden {
+		t.Errorf("Expected a basic-authenticated request without a token to be rejected, got %v", status)
+	}
+}
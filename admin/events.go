@@ -0,0 +1,70 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/square/quotaservice/logging"
+)
+
+// configEventsBufSize is the number of config changes buffered per subscriber before changes are
+// dropped for that subscriber.
+const configEventsBufSize = 16
+
+// configEventsHandler streams config changes to clients as server-sent events.
+type configEventsHandler struct {
+	a Administrable
+}
+
+func newConfigEventsHandler(admin Administrable) *configEventsHandler {
+	return &configEventsHandler{a: admin}
+}
+
+func (h *configEventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, &httpError{"Unknown method " + r.Method, http.StatusBadRequest})
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, &httpError{"Streaming not supported", http.StatusInternalServerError})
+		return
+	}
+
+	changes, unsubscribe := h.a.SubscribeConfigChanges(configEventsBufSize)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case c, ok := <-changes:
+			if !ok {
+				return
+			}
+
+			b, err := json.Marshal(c)
+			if err != nil {
+				logging.Printf("Unable to marshal config change %+v: %v", c, err)
+				continue
+			}
+
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: config\ndata: %s\n\n", c.Version, b); err != nil {
+				return
+			}
+
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package admin
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/square/quotaservice/config"
+)
+
+func TestConfigEventsStream(t *testing.T) {
+	a := NewMockAdministrable()
+	mux := http.NewServeMux()
+	ServeAdminConsole(a, mux, "", false)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/v1/config/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected Content-Type text/event-stream, was %v", ct)
+	}
+
+	oldCfg := config.NewDefaultServiceConfig()
+	newCfg := config.NewDefaultServiceConfig()
+	newCfg.Version = 7
+	newCfg.Namespaces["added"] = config.NewDefaultNamespaceConfig("added")
+	diff := config.Diff(oldCfg, newCfg)
+
+	// The subscription is registered once the response headers are flushed.
+	a.PublishConfigChange(&config.ConfigChange{Version: 7, Diff: diff, Summary: diff.Summary()})
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	for {
+		select {
+		case line := <-lines:
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+
+			c := &config.ConfigChange{}
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), c); err != nil {
+				t.Fatal(err)
+			}
+
+			if c.Version != 7 {
+				t.Fatalf("Expected version 7, was %v", c.Version)
+			}
+
+			if len(c.Diff.AddedNamespaces) != 1 || c.Diff.AddedNamespaces[0] != "added" {
+				t.Fatalf("Expected namespace 'added' in diff, was %+v", c.Diff)
+			}
+
+			return
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for config event")
+		}
+	}
+}
+
+func TestConfigChangeBroadcasterDropsOnSlowSubscriber(t *testing.T) {
+	b := config.NewConfigChangeBroadcaster()
+	_, unsubscribe := b.Subscribe(1)
+	defer unsubscribe()
+
+	b.Publish(&config.ConfigChange{Version: 1})
+	b.Publish(&config.ConfigChange{Version: 2})
+
+	if b.Dropped() != 1 {
+		t.Fatalf("Expected 1 dropped change, was %v", b.Dropped())
+	}
+}
@@ -0,0 +1,179 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package admin
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/square/quotaservice/events"
+	"github.com/square/quotaservice/logging"
+)
+
+const (
+	// liveEventsBufSize is the number of events buffered per connection before events are dropped
+	// for that connection.
+	liveEventsBufSize = 256
+	// liveEventsWriteTimeout bounds how long a write to a stalled connection may take before the
+	// connection is closed.
+	liveEventsWriteTimeout = 10 * time.Second
+)
+
+// liveEvent is the message sent for each event.
+type liveEvent struct {
+	// Time is when the event was sent, in millis since the epoch.
+	Time       int64  `json:"time"`
+	Type       string `json:"type"`
+	Namespace  string `json:"namespace,omitempty"`
+	Bucket     string `json:"bucket,omitempty"`
+	Dynamic    bool   `json:"dynamic"`
+	Tokens     int64  `json:"tokens"`
+	WaitMillis int64  `json:"waitMillis"`
+	// Dropped is the number of events dropped for this connection since the previous message,
+	// because it couldn't keep up.
+	Dropped uint64 `json:"dropped,omitempty"`
+}
+
+// liveEventFilter selects the events streamed to a connection.
+type liveEventFilter struct {
+	namespace string
+	prefix    string
+	types     events.EventTypeSet
+}
+
+func (f *liveEventFilter) matches(e events.Event) bool {
+	return f.types.Contains(e.EventType()) &&
+		(f.namespace == "" || e.Namespace() == f.namespace) &&
+		strings.HasPrefix(e.BucketName(), f.prefix)
+}
+
+// parseLiveEventFilter reads a filter from the "namespace", "prefix" and "type" query parameters.
+// Types may be repeated or comma-separated, and default to every type.
+func parseLiveEventFilter(r *http.Request) (*liveEventFilter, error) {
+	q := r.URL.Query()
+	f := &liveEventFilter{namespace: q.Get("namespace"), prefix: q.Get("prefix"), types: events.AllEventTypes}
+
+	var types []events.EventType
+	for _, v := range q["type"] {
+		for _, name := range strings.Split(v, ",") {
+			t, ok := events.ParseEventType(strings.TrimSpace(name))
+			if !ok {
+				return nil, errors.New("Unknown event type " + name)
+			}
+
+			types = append(types, t)
+		}
+	}
+
+	if len(types) > 0 {
+		f.types = events.NewEventTypeSet(types...)
+	}
+
+	return f, nil
+}
+
+// liveEventsHandler streams events to WebSocket clients, filtered on the server. Each connection
+// has its own bounded buffer; events are dropped for connections that can't keep up.
+type liveEventsHandler struct {
+	a    Administrable
+	opts *Options
+}
+
+func newLiveEventsHandler(admin Administrable, opts *Options) *liveEventsHandler {
+	return &liveEventsHandler{a: admin, opts: opts}
+}
+
+func (h *liveEventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, &httpError{"Unknown method " + r.Method, http.StatusBadRequest})
+		return
+	}
+
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		writeJSONError(w, &httpError{"Expected a WebSocket upgrade", http.StatusBadRequest})
+		return
+	}
+
+	// Browsers don't apply the same-origin policy to WebSockets, so without CORS configured, other
+	// origins are rejected here. With CORS configured, the corsHandler has vetted the origin.
+	if origin := r.Header.Get("Origin"); origin != "" && !sameOrigin(r, origin) && h.opts.CORS == nil {
+		writeJSONError(w, &httpError{"Origin " + origin + " is not allowed", http.StatusForbidden})
+		return
+	}
+
+	filter, err := parseLiveEventFilter(r)
+	if err != nil {
+		writeJSONError(w, &httpError{err.Error(), http.StatusBadRequest})
+		return
+	}
+
+	sub := h.a.SubscribeEvents(liveEventsBufSize, filter.matches)
+	if sub == nil {
+		writeJSONError(w, &httpError{"No event broadcaster configured", http.StatusBadRequest})
+		return
+	}
+
+	defer sub.Unsubscribe()
+
+	websocket.Server{
+		// The origin has been checked already.
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			h.stream(ws, sub)
+		},
+	}.ServeHTTP(w, r)
+}
+
+func (h *liveEventsHandler) stream(ws *websocket.Conn, sub *events.Subscription) {
+	defer ws.Close()
+
+	// Clients don't send anything, but reading notices when they close the connection.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+
+		var msg string
+		for websocket.Message.Receive(ws, &msg) == nil {
+		}
+	}()
+
+	var dropped uint64
+	for {
+		select {
+		case <-closed:
+			return
+		case e, ok := <-sub.C:
+			if !ok {
+				return
+			}
+
+			msg := &liveEvent{
+				Time:       time.Now().UnixNano() / int64(time.Millisecond),
+				Type:       e.EventType().String(),
+				Namespace:  e.Namespace(),
+				Bucket:     e.BucketName(),
+				Dynamic:    e.Dynamic(),
+				Tokens:     e.NumTokens(),
+				WaitMillis: int64(e.WaitTime() / time.Millisecond)}
+
+			if total := sub.Dropped(); total > dropped {
+				msg.Dropped = total - dropped
+				dropped = total
+			}
+
+			if err := ws.SetWriteDeadline(time.Now().Add(liveEventsWriteTimeout)); err != nil {
+				return
+			}
+
+			if err := websocket.JSON.Send(ws, msg); err != nil {
+				logging.Printf("Closing live events connection from %v: %v", ws.Request().RemoteAddr, err)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/square/quotaservice/events"
+)
+
+func serveLiveEvents(a Administrable, opts *Options) *httptest.Server {
+	mux := http.NewServeMux()
+	ServeAdminConsoleWithOptions(a, mux, "", false, opts)
+	return httptest.NewServer(mux)
+}
+
+func dialLiveEvents(ts *httptest.Server, query, origin string) (*websocket.Conn, error) {
+	return websocket.Dial(strings.Replace(ts.URL, "http", "ws", 1)+"/api/events/ws"+query, "", origin)
+}
+
+func TestLiveEvents(t *testing.T) {
+	a := NewMockAdministrable()
+	ts := serveLiveEvents(a, nil)
+	defer ts.Close()
+
+	ws, err := dialLiveEvents(ts, "?namespace=ns&prefix=b&type=EVENT_BUCKET_MISS,timeout_serving_tokens", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range []events.Event{
+		events.NewTokensServedEvent("ns", "b1", false, 1, 0),
+		events.NewBucketMissedEvent("other", "b1", true),
+		events.NewBucketMissedEvent("ns", "a1", true),
+		events.NewBucketMissedEvent("ns", "b1", true),
+		events.NewTimedOutEvent("ns", "b2", false, 5),
+	} {
+		a.broadcaster.HandleEvent(e)
+	}
+
+	setReadDeadline(t, ws)
+	for _, expected := range []liveEvent{
+		{Type: "EVENT_BUCKET_MISS", Namespace: "ns", Bucket: "b1", Dynamic: true},
+		{Type: "EVENT_TIMEOUT_SERVING_TOKENS", Namespace: "ns", Bucket: "b2", Tokens: 5},
+	} {
+		var actual liveEvent
+		if err := websocket.JSON.Receive(ws, &actual); err != nil {
+			t.Fatal(err)
+		}
+
+		actual.Time = 0
+		if actual != expected {
+			t.Errorf("Expected %+v, got %+v", expected, actual)
+		}
+	}
+
+	ws.Close()
+	for start := time.Now(); a.broadcaster.Subscribers() != 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("Expected closing the connection to unsubscribe")
+		}
+	}
+}
+
+// setReadDeadline fails reads that take too long, instead of hanging the test.
+func setReadDeadline(t *testing.T, ws *websocket.Conn) {
+	t.Helper()
+
+	if err := ws.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLiveEventsRejected(t *testing.T) {
+	a := NewMockAdministrable()
+	ts := serveLiveEvents(a, nil)
+	defer ts.Close()
+
+	if _, err := dialLiveEvents(ts, "", "https://evil.example.com"); err == nil {
+		t.Error("Expected a cross-origin connection to be rejected without CORS configured")
+	}
+
+	if _, err := dialLiveEvents(ts, "?type=nope", ts.URL); err == nil {
+		t.Error("Expected an unknown event type to be rejected")
+	}
+
+	if a.broadcaster.Subscribers() != 0 {
+		t.Errorf("Expected rejected connections not to subscribe, got %v", a.broadcaster.Subscribers())
+	}
+
+	errTs := serveLiveEvents(NewMockErrorAdministrable(), nil)
+	defer errTs.Close()
+
+	if _, err := dialLiveEvents(errTs, "", errTs.URL); err == nil {
+		t.Error("Expected a connection to be rejected without an event broadcaster")
+	}
+
+	res, err := http.Get(ts.URL + "/api/events/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a request that isn't a WebSocket upgrade, got %v", res.StatusCode)
+	}
+}
@@ -0,0 +1,194 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package admin
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+
+	pb "github.com/square/quotaservice/protos/config"
+	"github.com/square/quotaservice/stats"
+)
+
+const (
+	defaultBucketListLimit = 100
+	maxBucketListLimit     = 1000
+	defaultBucketDumpLimit = 1000
+	maxBucketDumpLimit     = 10000
+)
+
+// BucketInspection describes the live state of a bucket.
+type BucketInspection struct {
+	Namespace string           `json:"namespace"`
+	Name      string           `json:"name"`
+	Dynamic   bool             `json:"dynamic"`
+	Config    *pb.BucketConfig `json:"config"`
+	// AvailableTokens is the number of tokens that could be taken without waiting, or negative if
+	// the bucket is in debt. Nil if the bucket implementation can't report it.
+	AvailableTokens *int64 `json:"availableTokens,omitempty"`
+	// Saturation is the fraction of recent time the bucket had no tokens available. Nil if the
+	// bucket implementation can't report it.
+	Saturation *float64 `json:"saturation,omitempty"`
+	// LastActivityMillis is when the bucket was last looked up, in millis since the epoch, or 0
+	// if it never has been.
+	LastActivityMillis int64           `json:"lastActivityMillis"`
+	Activity           *BucketActivity `json:"activity"`
+	// Stats are the hits and misses recorded by the stats listener, if there is one.
+	Stats *stats.BucketScores `json:"stats,omitempty"`
+}
+
+// BucketActivity counts requests served by a bucket since it was created.
+type BucketActivity struct {
+	TokensServed int64 `json:"tokensServed"`
+	// Waits is the number of requests that were served after waiting.
+	Waits      int64 `json:"waits"`
+	WaitMillis int64 `json:"waitMillis"`
+	// Timeouts is the number of requests that could not be served within their max wait time.
+	Timeouts int64 `json:"timeouts"`
+	// Waiters is the number of requests granted waits that haven't passed, unlike the other counts,
+	// which are cumulative.
+	Waiters int64 `json:"waiters"`
+}
+
+// DynamicBucket summarizes an active dynamic bucket.
+type DynamicBucket struct {
+	Name string `json:"name"`
+	// LastActivityMillis is when the bucket was last looked up, in millis since the epoch.
+	LastActivityMillis int64 `json:"lastActivityMillis"`
+}
+
+type bucketListResponse struct {
+	Namespace string           `json:"namespace"`
+	Prefix    string           `json:"prefix"`
+	Buckets   []*DynamicBucket `json:"buckets"`
+	// Total is the number of active dynamic buckets matching the prefix.
+	Total int `json:"total"`
+	Limit int `json:"limit"`
+	// NextCursor fetches the next page, and is omitted from the last page.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+type bucketDumpResponse struct {
+	Buckets []*BucketInspection `json:"buckets"`
+	Limit   int                 `json:"limit"`
+	// Truncated is set if there were more active buckets than the limit.
+	Truncated bool `json:"truncated"`
+}
+
+type inspectAPIHandler struct {
+	a Administrable
+}
+
+func newInspectAPIHandler(admin Administrable) *inspectAPIHandler {
+	return &inspectAPIHandler{a: admin}
+}
+
+func (a *inspectAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, &httpError{"Unknown method " + r.Method, http.StatusBadRequest})
+		return
+	}
+
+	// [{namespace}, {bucket}]
+	params := strings.SplitN(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/buckets"), "/"), "/", 2)
+
+	switch {
+	case params[0] == "":
+		a.dump(w, r)
+	case len(params) == 1:
+		a.list(w, r, params[0])
+	default:
+		a.inspect(w, params[0], params[1])
+	}
+}
+
+func (a *inspectAPIHandler) inspect(w http.ResponseWriter, namespace, name string) {
+	b, err := a.a.InspectBucket(namespace, name)
+
+	switch {
+	case err != nil:
+		writeJSONError(w, &httpError{"Unable to inspect bucket: " + err.Error(), http.StatusInternalServerError})
+	case b == nil:
+		writeJSONError(w, &httpError{"No active bucket " + namespace + ":" + name, http.StatusNotFound})
+	default:
+		writeJSON(w, b)
+	}
+}
+
+// dump writes the live state of every active bucket, up to the "limit" query parameter, e.g. to
+// snapshot them for analysis during an incident.
+func (a *inspectAPIHandler) dump(w http.ResponseWriter, r *http.Request) {
+	limit, err := intParam(r, "limit", defaultBucketDumpLimit)
+	if err != nil || limit < 1 || limit > maxBucketDumpLimit {
+		writeJSONError(w, &httpError{"Invalid limit " + r.URL.Query().Get("limit"), http.StatusBadRequest})
+		return
+	}
+
+	buckets, truncated, err := a.a.InspectBuckets(limit)
+	if err != nil {
+		writeJSONError(w, &httpError{"Unable to inspect buckets: " + err.Error(), http.StatusInternalServerError})
+		return
+	}
+
+	if buckets == nil {
+		buckets = []*BucketInspection{}
+	}
+
+	writeJSON(w, &bucketDumpResponse{Buckets: buckets, Limit: limit, Truncated: truncated})
+}
+
+// list writes a page of the active dynamic buckets in a namespace with names starting with the
+// "prefix" query parameter. Pages are selected using the "limit" and "cursor" parameters, where the
+// cursor is the "nextCursor" from the previous page.
+func (a *inspectAPIHandler) list(w http.ResponseWriter, r *http.Request, namespace string) {
+	limit, err := intParam(r, "limit", defaultBucketListLimit)
+	if err != nil || limit < 1 || limit > maxBucketListLimit {
+		writeJSONError(w, &httpError{"Invalid limit " + r.URL.Query().Get("limit"), http.StatusBadRequest})
+		return
+	}
+
+	after, err := decodeCursor(r.URL.Query().Get("cursor"))
+	if err != nil {
+		writeJSONError(w, &httpError{"Invalid cursor " + r.URL.Query().Get("cursor"), http.StatusBadRequest})
+		return
+	}
+
+	prefix := r.URL.Query().Get("prefix")
+
+	// Fetch one more than requested to find out whether there's another page.
+	buckets, total, exists := a.a.DynamicBuckets(namespace, prefix, after, limit+1)
+	if !exists {
+		writeJSONError(w, &httpError{"Unable to locate namespace " + namespace, http.StatusNotFound})
+		return
+	}
+
+	response := &bucketListResponse{Namespace: namespace, Prefix: prefix, Buckets: buckets, Total: total, Limit: limit}
+	if len(buckets) > limit {
+		response.Buckets = buckets[:limit]
+		response.NextCursor = encodeCursor(buckets[limit-1].Name)
+	}
+
+	writeJSON(w, response)
+}
+
+// Cursors are opaque to clients, but are simply the encoded name of the last bucket on a page.
+func encodeCursor(name string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(name))
+}
+
+func decodeCursor(cursor string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	return string(b), err
+}
+
+func intParam(r *http.Request, name string, defaultValue int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return defaultValue, nil
+	}
+
+	return strconv.Atoi(v)
+}
@@ -0,0 +1,155 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/square/quotaservice/test/helpers"
+)
+
+func TestInspectBucket(t *testing.T) {
+	a := NewMockAdministrable()
+
+	w := doConfigRequest(t, a, http.MethodGet, "/api/buckets/foo/bar", "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %v %v", w.Code, w.Body.String())
+	}
+
+	inspection := &BucketInspection{}
+	helpers.CheckError(t, json.Unmarshal(w.Body.Bytes(), inspection))
+
+	if inspection.AvailableTokens == nil || *inspection.AvailableTokens != 42 || inspection.Config.Name != "bar" {
+		t.Errorf("Unexpected inspection %+v", inspection)
+	}
+
+	if w = doConfigRequest(t, a, http.MethodGet, "/api/buckets/foo/baz", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an inactive bucket, got %v", w.Code)
+	}
+
+	if w = doConfigRequest(t, a, http.MethodPost, "/api/buckets/foo/bar", "", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a POST, got %v", w.Code)
+	}
+
+	if w = doConfigRequest(t, NewMockErrorAdministrable(), http.MethodGet, "/api/buckets/foo/bar", "", ""); w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 when inspection fails, got %v", w.Code)
+	}
+}
+
+func TestDumpBuckets(t *testing.T) {
+	a := NewMockAdministrable()
+
+	w := doConfigRequest(t, a, http.MethodGet, "/api/buckets", "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %v %v", w.Code, w.Body.String())
+	}
+
+	response := &bucketDumpResponse{}
+	helpers.CheckError(t, json.Unmarshal(w.Body.Bytes(), response))
+
+	if len(response.Buckets) != 1 || response.Buckets[0].Name != "bar" || response.Truncated || response.Limit != defaultBucketDumpLimit {
+		t.Errorf("Unexpected dump %+v", response)
+	}
+
+	for _, limit := range []string{"0", "10001", "x"} {
+		if w = doConfigRequest(t, a, http.MethodGet, "/api/buckets?limit="+limit, "", ""); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for limit %v, got %v", limit, w.Code)
+		}
+	}
+
+	if w = doConfigRequest(t, NewMockErrorAdministrable(), http.MethodGet, "/api/buckets", "", ""); w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 when inspection fails, got %v", w.Code)
+	}
+}
+
+func listDynamicBuckets(t *testing.T, a Administrable, query string) *bucketListResponse {
+	t.Helper()
+
+	w := doConfigRequest(t, a, http.MethodGet, "/api/buckets/dyn"+query, "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 for %v, got %v %v", query, w.Code, w.Body.String())
+	}
+
+	response := &bucketListResponse{}
+	helpers.CheckError(t, json.Unmarshal(w.Body.Bytes(), response))
+	return response
+}
+
+func bucketNames(buckets []*DynamicBucket) []string {
+	names := make([]string, len(buckets))
+	for i, b := range buckets {
+		names[i] = b.Name
+	}
+
+	return names
+}
+
+func TestListDynamicBuckets(t *testing.T) {
+	a := NewMockAdministrable()
+
+	response := listDynamicBuckets(t, a, "")
+	if len(response.Buckets) != 25 || response.Total != 25 || response.Limit != defaultBucketListLimit ||
+		response.NextCursor != "" {
+		t.Errorf("Expected all buckets with the default limit, got %+v", response)
+	}
+
+	if b := response.Buckets[7]; b.Name != "b07" || b.LastActivityMillis != 7 {
+		t.Errorf("Expected last activity to be listed, got %+v", b)
+	}
+
+	response = listDynamicBuckets(t, a, "?prefix=b1")
+	if response.Total != 10 || !reflect.DeepEqual(bucketNames(response.Buckets),
+		[]string{"b10", "b11", "b12", "b13", "b14", "b15", "b16", "b17", "b18", "b19"}) {
+		t.Errorf("Expected buckets matching b1, got %+v", response)
+	}
+
+	for _, query := range []string{"?limit=0", "?limit=100000", "?limit=x", "?cursor=!!!"} {
+		if w := doConfigRequest(t, a, http.MethodGet, "/api/buckets/dyn"+query, "", ""); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %v, got %v", query, w.Code)
+		}
+	}
+
+	if w := doConfigRequest(t, a, http.MethodGet, "/api/buckets/nonexistent", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown namespace, got %v", w.Code)
+	}
+}
+
+func TestListDynamicBucketsCursor(t *testing.T) {
+	a := NewMockAdministrable()
+
+	var pages [][]string
+	query := "?prefix=b0&limit=4"
+	for {
+		response := listDynamicBuckets(t, a, query)
+		pages = append(pages, bucketNames(response.Buckets))
+
+		if response.NextCursor == "" {
+			break
+		}
+
+		if len(pages) > 3 {
+			t.Fatalf("Expected 3 pages, got %v", pages)
+		}
+
+		query = "?prefix=b0&limit=4&cursor=" + response.NextCursor
+	}
+
+	expected := [][]string{
+		{"b00", "b01", "b02", "b03"},
+		{"b04", "b05", "b06", "b07"},
+		{"b08", "b09"},
+	}
+
+	if !reflect.DeepEqual(pages, expected) {
+		t.Errorf("Expected pages %v, got %v", expected, pages)
+	}
+
+	// A page ending exactly at the last match has no next cursor.
+	if response := listDynamicBuckets(t, a, "?prefix=b0&limit=10"); response.NextCursor != "" {
+		t.Errorf("Expected no next cursor, got %+v", response)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"net/http"
 
+	"github.com/square/quotaservice/config"
 	"github.com/square/quotaservice/logging"
 )
 
@@ -35,6 +36,22 @@ func writeJSONError(w http.ResponseWriter, err *httpError) {
 	writeJSON(w, response)
 }
 
+type validationErrorResponse struct {
+	Error            string                    `json:"error"`
+	Description      string                    `json:"description"`
+	ValidationErrors []*config.ValidationError `json:"validationErrors"`
+}
+
+func writeJSONValidationErrors(w http.ResponseWriter, errs config.ValidationErrors) {
+	logging.Printf("Response error: %v", errs)
+
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	writeJSON(w, &validationErrorResponse{
+		http.StatusText(http.StatusUnprocessableEntity),
+		errs.Error(),
+		errs})
+}
+
 func writeJSONOk(w http.ResponseWriter) {
 	if _, e := w.Write(emptyJSONResponse); e != nil {
 		logging.Printf("Error writing JSON! %+v", e)
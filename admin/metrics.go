@@ -0,0 +1,153 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package admin
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/square/quotaservice/stats"
+)
+
+const (
+	// metricsSummaryTTL is how long a summary is served from cache, so dashboards polling it don't
+	// add load.
+	metricsSummaryTTL   = time.Second
+	metricsTopThrottled = 5
+)
+
+// PersisterHealth describes the outcome of the latest operations on the config persister.
+type PersisterHealth struct {
+	// Healthy is false if the latest operation failed.
+	Healthy   bool   `json:"healthy"`
+	LastError string `json:"lastError,omitempty"`
+	// LastErrorAt and LastSuccessAt are in seconds since the epoch, or 0 if there has been none.
+	LastErrorAt   int64 `json:"lastErrorAt,omitempty"`
+	LastSuccessAt int64 `json:"lastSuccessAt,omitempty"`
+}
+
+// ConfigHealth describes whether config changes are still reaching the server, since a persister
+// that stopped fetching them leaves the server enforcing stale limits.
+type ConfigHealth struct {
+	// Healthy is false if neither a config change was observed nor the persister polled its store
+	// within the staleness threshold. Always true if no threshold is set.
+	Healthy bool `json:"healthy"`
+	// LastChangeAt is when a config change was last observed, and LastPolledAt when the persister
+	// last polled its store, if it reports it. Both are in seconds since the epoch, or 0 if never.
+	LastChangeAt int64 `json:"lastChangeAt,omitempty"`
+	LastPolledAt int64 `json:"lastPolledAt,omitempty"`
+	// StalenessThresholdSeconds is 0 if staleness isn't checked.
+	StalenessThresholdSeconds int64 `json:"stalenessThresholdSeconds,omitempty"`
+	// Degraded is the startup policy the server started with, "fail-open" or "last-known-good",
+	// if it couldn't read the persister's config at startup and hasn't since. Empty otherwise.
+	Degraded string `json:"degraded,omitempty"`
+	// SnapshotVersion is the version of the config snapshot in force while degraded under
+	// "last-known-good", or 0.
+	SnapshotVersion int32 `json:"snapshotVersion,omitempty"`
+}
+
+type metricsSummaryResponse struct {
+	// SampledAt is when the summary was computed, in millis since the epoch.
+	SampledAt int64 `json:"sampledAt"`
+	// WindowSeconds is the period rates are averaged over, or 0 if no rate tracker is configured.
+	WindowSeconds float64 `json:"windowSeconds"`
+	// QPS is the rate of requests granted and rejected across namespaces.
+	QPS            float64             `json:"qps"`
+	GrantRate      float64             `json:"grantRate"`
+	RejectRate     float64             `json:"rejectRate"`
+	DynamicBuckets int                 `json:"dynamicBuckets"`
+	Namespaces     []*namespaceMetrics `json:"namespaces"`
+	// TopThrottled are the buckets with the most rejections, if a top tracker is configured.
+	TopThrottled []*stats.TopBucket `json:"topThrottled"`
+	Persister    *PersisterHealth   `json:"persister"`
+}
+
+type namespaceMetrics struct {
+	Namespace      string  `json:"namespace"`
+	GrantRate      float64 `json:"grantRate"`
+	RejectRate     float64 `json:"rejectRate"`
+	DynamicBuckets int     `json:"dynamicBuckets"`
+	// DynamicBucketCreateRate is the rate dynamic buckets are created, per second.
+	DynamicBucketCreateRate float64 `json:"dynamicBucketCreateRate"`
+}
+
+// metricsSummaryAPIHandler serves a snapshot of the stats subsystem for dashboards, cached briefly.
+type metricsSummaryAPIHandler struct {
+	a       Administrable
+	now     func() time.Time
+	cached  *metricsSummaryResponse
+	expires time.Time
+	sync.Mutex
+}
+
+func newMetricsSummaryAPIHandler(admin Administrable) *metricsSummaryAPIHandler {
+	return &metricsSummaryAPIHandler{a: admin, now: time.Now}
+}
+
+func (m *metricsSummaryAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, &httpError{"Unknown method " + r.Method, http.StatusBadRequest})
+		return
+	}
+
+	writeJSON(w, m.summary())
+}
+
+func (m *metricsSummaryAPIHandler) summary() *metricsSummaryResponse {
+	m.Lock()
+	defer m.Unlock()
+
+	now := m.now()
+	if m.cached != nil && now.Before(m.expires) {
+		return m.cached
+	}
+
+	rsp := &metricsSummaryResponse{
+		SampledAt:    now.UnixNano() / int64(time.Millisecond),
+		TopThrottled: m.a.TopBuckets(stats.TopByRejections, metricsTopThrottled),
+		Persister:    m.a.PersisterHealth()}
+
+	if rsp.TopThrottled == nil {
+		rsp.TopThrottled = make([]*stats.TopBucket, 0)
+	}
+
+	namespaces := make(map[string]*namespaceMetrics)
+	for name := range m.a.Configs().Namespaces {
+		_, total, _ := m.a.DynamicBuckets(name, "", "", 0)
+		namespaces[name] = &namespaceMetrics{Namespace: name, DynamicBuckets: total}
+		rsp.DynamicBuckets += total
+	}
+
+	rates, window := m.a.NamespaceRates()
+	rsp.WindowSeconds = window.Seconds()
+	for _, rate := range rates {
+		ns := namespaces[rate.Namespace]
+		if ns == nil {
+			// Requests for namespaces that aren't configured are rejected as misses.
+			ns = &namespaceMetrics{Namespace: rate.Namespace}
+			namespaces[rate.Namespace] = ns
+		}
+
+		ns.GrantRate = rate.Granted
+		ns.RejectRate = rate.Rejected
+		ns.DynamicBucketCreateRate = rate.DynamicBucketsCreated
+		rsp.GrantRate += rate.Granted
+		rsp.RejectRate += rate.Rejected
+	}
+
+	rsp.QPS = rsp.GrantRate + rsp.RejectRate
+
+	rsp.Namespaces = make([]*namespaceMetrics, 0, len(namespaces))
+	for _, ns := range namespaces {
+		rsp.Namespaces = append(rsp.Namespaces, ns)
+	}
+
+	sort.Slice(rsp.Namespaces, func(i, j int) bool { return rsp.Namespaces[i].Namespace < rsp.Namespaces[j].Namespace })
+
+	m.cached = rsp
+	m.expires = now.Add(metricsSummaryTTL)
+	return rsp
+}
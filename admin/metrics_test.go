@@ -0,0 +1,110 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/square/quotaservice/config"
+	"github.com/square/quotaservice/events"
+	"github.com/square/quotaservice/test/helpers"
+)
+
+func getMetricsSummary(t *testing.T, h http.Handler) *metricsSummaryResponse {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/metrics/summary", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %v %v", w.Code, w.Body.String())
+	}
+
+	rsp := &metricsSummaryResponse{}
+	helpers.CheckError(t, json.Unmarshal(w.Body.Bytes(), rsp))
+	return rsp
+}
+
+func TestMetricsSummary(t *testing.T) {
+	a := NewMockAdministrable()
+	helpers.CheckError(t, config.AddNamespace(a.cfg, config.NewDefaultNamespaceConfig("dyn")))
+
+	for _, e := range []events.Event{
+		events.NewTokensServedEvent("dyn", "b00", true, 1, 0),
+		events.NewTokensServedEvent("dyn", "b01", true, 1, 0),
+		events.NewTimedOutEvent("dyn", "b01", true, 1),
+		events.NewBucketMissedEvent("unknown", "a", false),
+		events.NewBucketCreatedEvent("dyn", "b02", true),
+	} {
+		a.rateTracker.HandleEvent(e)
+		a.topTracker.HandleEvent(e)
+	}
+
+	rsp := getMetricsSummary(t, newMetricsSummaryAPIHandler(a))
+
+	if rsp.WindowSeconds != 10 || rsp.QPS != 0.4 || rsp.GrantRate != 0.2 || rsp.RejectRate != 0.2 {
+		t.Errorf("Expected 4 requests over 10 seconds, half rejected, got %+v", rsp)
+	}
+
+	if len(rsp.Namespaces) != 2 || rsp.Namespaces[0].Namespace != "dyn" || rsp.Namespaces[0].GrantRate != 0.2 ||
+		rsp.Namespaces[0].RejectRate != 0.1 || rsp.Namespaces[0].DynamicBuckets != 25 || rsp.Namespaces[0].DynamicBucketCreateRate != 0.1 ||
+		rsp.Namespaces[1].Namespace != "unknown" || rsp.Namespaces[1].RejectRate != 0.1 {
+		t.Errorf("Unexpected namespaces %+v", rsp.Namespaces)
+	}
+
+	if rsp.DynamicBuckets != 25 {
+		t.Errorf("Expected 25 dynamic buckets, got %v", rsp.DynamicBuckets)
+	}
+
+	if len(rsp.TopThrottled) != 2 || rsp.TopThrottled[0].Namespace != "dyn" || rsp.TopThrottled[0].Bucket != "b01" {
+		t.Errorf("Expected b01 and a to be the most throttled, got %+v", rsp.TopThrottled)
+	}
+
+	if rsp.Persister == nil || !rsp.Persister.Healthy {
+		t.Errorf("Expected a healthy persister, got %+v", rsp.Persister)
+	}
+}
+
+func TestMetricsSummaryCached(t *testing.T) {
+	a := NewMockAdministrable()
+	h := newMetricsSummaryAPIHandler(a)
+	now := time.Unix(1000, 0)
+	h.now = func() time.Time { return now }
+
+	if rsp := getMetricsSummary(t, h); rsp.QPS != 0 || len(rsp.Namespaces) != 0 {
+		t.Fatalf("Expected no requests, got %+v", rsp)
+	}
+
+	a.rateTracker.HandleEvent(events.NewTokensServedEvent("ns", "a", false, 1, 0))
+
+	if rsp := getMetricsSummary(t, h); rsp.QPS != 0 {
+		t.Errorf("Expected the summary to be served from cache, got %+v", rsp)
+	}
+
+	now = now.Add(metricsSummaryTTL)
+	if rsp := getMetricsSummary(t, h); rsp.QPS == 0 || rsp.SampledAt != now.UnixNano()/int64(time.Millisecond) {
+		t.Errorf("Expected the summary to reflect the recent request once the cache expired, got %+v", rsp)
+	}
+}
+
+func TestMetricsSummaryWithoutTrackers(t *testing.T) {
+	w := doConfigRequest(t, NewMockErrorAdministrable(), http.MethodGet, "/api/metrics/summary", "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %v %v", w.Code, w.Body.String())
+	}
+
+	rsp := &metricsSummaryResponse{}
+	helpers.CheckError(t, json.Unmarshal(w.Body.Bytes(), rsp))
+
+	if rsp.WindowSeconds != 0 || rsp.TopThrottled == nil || rsp.Persister.Healthy {
+		t.Errorf("Expected an empty summary reporting an unhealthy persister, got %+v", rsp)
+	}
+
+	if w := doConfigRequest(t, NewMockAdministrable(), http.MethodPost, "/api/metrics/summary", "", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a POST, got %v", w.Code)
+	}
+}
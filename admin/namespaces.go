@@ -4,8 +4,10 @@
 package admin
 
 import (
+	"encoding/json"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/square/quotaservice/config"
@@ -93,9 +95,15 @@ func updateConfig(a *namespacesAPIHandler, w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	e = a.a.UpdateConfig(c, getUsername(r))
+	// The apiVersionHandler has checked the version is set, and current when the request arrived.
+	version, _ := strconv.Atoi(r.Header.Get("Version"))
+	e = a.a.UpdateConfigIfLatest(c, int32(version), getUsername(r))
 
-	if e != nil {
+	if e == config.ErrStaleConfig {
+		writeJSONError(w, &httpError{staleConfigMessage, http.StatusConflict})
+	} else if e == config.ErrActivationPending {
+		writeJSONError(w, &httpError{activationPendingMessage, http.StatusConflict})
+	} else if e != nil {
 		writeJSONError(w, &httpError{e.Error(), http.StatusInternalServerError})
 	} else {
 		writeJSONOk(w)
@@ -116,7 +124,11 @@ func changeNamespace(w http.ResponseWriter, r *http.Request, namespace string, u
 
 	e = updater(c)
 
-	if e != nil {
+	if e == config.ErrActivationPending {
+		writeJSONError(w, &httpError{activationPendingMessage, http.StatusConflict})
+	} else if errs, ok := e.(config.ValidationErrors); ok {
+		writeJSONValidationErrors(w, errs)
+	} else if e != nil {
 		writeJSONError(w, &httpError{e.Error(), http.StatusInternalServerError})
 	} else {
 		writeJSONOk(w)
@@ -128,3 +140,82 @@ func getNamespaceConfig(r io.Reader) (*pb.NamespaceConfig, error) {
 	err := unmarshalJSON(r, c)
 	return c, err
 }
+
+type cloneNamespaceRequest struct {
+	Name string `json:"name"`
+	// Overrides is a JSON merge patch applied to the cloned namespace.
+	Overrides json.RawMessage `json:"overrides,omitempty"`
+}
+
+// namespaceActionsAPIHandler serves actions on namespaces, at /api/namespaces/{namespace}/{action}.
+type namespaceActionsAPIHandler struct {
+	a Administrable
+}
+
+func newNamespaceActionsAPIHandler(admin Administrable) *namespaceActionsAPIHandler {
+	return &namespaceActionsAPIHandler{a: admin}
+}
+
+func (a *namespaceActionsAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// [{namespace}, {action}]
+	params := strings.SplitN(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/namespaces"), "/"), "/", 2)
+
+	if len(params) != 2 || params[0] == "" || params[1] != "clone" {
+		writeJSONError(w, &httpError{"", http.StatusNotFound})
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		writeJSONError(w, &httpError{"Unknown method " + r.Method, http.StatusBadRequest})
+		return
+	}
+
+	a.clone(w, r, params[0])
+}
+
+// clone persists a new config version with a copy of a namespace added under a new name.
+func (a *namespaceActionsAPIHandler) clone(w http.ResponseWriter, r *http.Request, src string) {
+	req := &cloneNamespaceRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writeJSONError(w, &httpError{"Unable to parse request: " + err.Error(), http.StatusBadRequest})
+		return
+	}
+
+	if req.Name == "" {
+		writeJSONError(w, &httpError{"Missing name for the cloned namespace", http.StatusBadRequest})
+		return
+	}
+
+	cfg := config.CloneConfig(a.a.Configs())
+
+	srcCfg := cfg.Namespaces[src]
+	if srcCfg == nil {
+		writeJSONError(w, &httpError{"Unable to locate namespace " + src, http.StatusNotFound})
+		return
+	}
+
+	if _, exists := cfg.Namespaces[req.Name]; exists {
+		writeJSONError(w, &httpError{"Namespace " + req.Name + " already exists", http.StatusConflict})
+		return
+	}
+
+	cloned, err := config.CloneNamespace(srcCfg, req.Name, req.Overrides)
+	if err != nil {
+		writeJSONError(w, &httpError{"Unable to apply overrides: " + err.Error(), http.StatusBadRequest})
+		return
+	}
+
+	if cfg.Namespaces == nil {
+		cfg.Namespaces = make(map[string]*pb.NamespaceConfig)
+	}
+
+	cfg.Namespaces[req.Name] = cloned
+
+	version, err := a.a.PersistConfig(cfg, getUsername(r))
+	if err != nil {
+		writePersistError(w, err)
+		return
+	}
+
+	writeJSON(w, &persistConfigResponse{version})
+}
@@ -4,6 +4,7 @@
 package admin
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -11,6 +12,7 @@ import (
 
 	"github.com/square/quotaservice/config"
 	pb "github.com/square/quotaservice/protos/config"
+	"github.com/square/quotaservice/test/helpers"
 )
 
 func TestNamespacesGetEmpty(t *testing.T) {
@@ -62,6 +64,23 @@ func TestNamespacesPostError(t *testing.T) {
 	}
 }
 
+func TestConfigPostStale(t *testing.T) {
+	a := NewMockAdministrable()
+	a.Configs().Version = 3
+	h := newNamespacesAPIHandler(a)
+
+	for version, expected := range map[string]int{"3": http.StatusOK, "2": http.StatusConflict} {
+		req := httptest.NewRequest(http.MethodPost, "/api/", strings.NewReader("{}"))
+		req.Header.Set("Version", version)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != expected {
+			t.Errorf("Expected %v posting a config based on version %v, got %v %v", expected, version, w.Code, w.Body.String())
+		}
+	}
+}
+
 func TestNamespacesPut(t *testing.T) {
 	jsonResponse := make(map[string]string)
 	doNamespacesRequest(t, NewMockAdministrable(), &jsonResponse, "PUT", "/api/test", "")
@@ -118,3 +137,66 @@ func doNamespacesRequest(t *testing.T, a Administrable, object interface{}, meth
 		t.Fatal(err)
 	}
 }
+
+func TestNamespacesClone(t *testing.T) {
+	a := newExportTestAdministrable(t)
+	body := `{"name": "baz", "overrides": {"max_dynamic_buckets": 5, "buckets": {"bar": {"size": 1234}}}}`
+
+	w := doConfigRequest(t, a, http.MethodPost, "/api/namespaces/foo/clone", "application/json", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %v %v", w.Code, w.Body.String())
+	}
+
+	response := &persistConfigResponse{}
+	helpers.CheckError(t, json.Unmarshal(w.Body.Bytes(), response))
+
+	persisted := a.persisted[response.Version]
+	if response.Version != 8 || persisted == nil {
+		t.Fatalf("Expected version 8 to be persisted, got %+v", response)
+	}
+
+	src, cloned := persisted.Namespaces["foo"], persisted.Namespaces["baz"]
+	if src == nil || cloned == nil {
+		t.Fatalf("Expected foo and baz namespaces, got %+v", persisted.Namespaces)
+	}
+
+	if cloned.Name != "baz" || cloned.MaxDynamicBuckets != 5 {
+		t.Errorf("Unexpected cloned namespace %+v", cloned)
+	}
+
+	b := cloned.Buckets["bar"]
+	if b == nil || b.Size != 1234 || b.Namespace != "baz" || b.FillRate != src.Buckets["bar"].FillRate {
+		t.Errorf("Expected bar to be cloned with an overridden size, got %+v", b)
+	}
+
+	if src.Buckets["bar"].Size == 1234 {
+		t.Error("Expected the source namespace to be unchanged")
+	}
+}
+
+func TestNamespacesCloneErrors(t *testing.T) {
+	a := newExportTestAdministrable(t)
+
+	tests := []struct {
+		path, body string
+		expected   int
+	}{
+		{"/api/namespaces/foo/clone", `{"name": "foo"}`, http.StatusConflict},
+		{"/api/namespaces/nonexistent/clone", `{"name": "baz"}`, http.StatusNotFound},
+		{"/api/namespaces/foo/clone", `{}`, http.StatusBadRequest},
+		{"/api/namespaces/foo/clone", `{"name": "baz", "overrides": {"buckets": {"bar": {"size": -1}}}}`, http.StatusUnprocessableEntity},
+		{"/api/namespaces/foo/clone", `not json`, http.StatusBadRequest},
+		{"/api/namespaces/foo/copy", `{"name": "baz"}`, http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		w := doConfigRequest(t, a, http.MethodPost, test.path, "application/json", test.body)
+		if w.Code != test.expected {
+			t.Errorf("Expected %v for %v %v, got %v %v", test.expected, test.path, test.body, w.Code, w.Body.String())
+		}
+	}
+
+	if a.cfg.Version != 7 {
+		t.Errorf("Expected no config to be persisted, got version %v", a.cfg.Version)
+	}
+}
@@ -2,6 +2,7 @@ import React from 'react'
 import { CALL_API } from 'redux-api-middleware'
 
 import { confirm } from './confirmation.jsx'
+import { csrfHeaders, fetchCSRFToken } from '../csrf.js'
 
 export const CONFIGS_FAILURE = 'CONFIGS_FAILURE'
 export const CONFIGS_REQUEST = 'CONFIGS_REQUEST'
@@ -21,6 +22,7 @@ export function fetchConfigs() {
   return async dispatch => {
     try {
       dispatch({ type: CONFIGS_REQUEST });
+      await fetchCSRFToken();
       const response = await fetch('/api/configs', { method: 'GET', credentials: 'same-origin' });
       return dispatch({ type: CONFIGS_FETCH_SUCCESS, payload: await response.json() });
     } catch (e) {
@@ -36,10 +38,10 @@ export function commitConfig(namespaces, version) {
     [CALL_API]: {
       endpoint: '/api',
       method: 'POST',
-      headers: {
+      headers: () => Object.assign({
         'Content-Type': 'application/json',
         'Version': version
-      },
+      }, csrfHeaders()),
       body: json,
       credentials: 'same-origin',
       types: [CONFIGS_REQUEST, CONFIGS_COMMIT_SUCCESS, CONFIGS_FAILURE]
@@ -0,0 +1,15 @@
+// The CSRF token mutating requests must echo, if the server requires one.
+let csrf = null;
+
+export async function fetchCSRFToken() {
+  const response = await fetch('/api/csrf', { method: 'GET', credentials: 'same-origin' });
+
+  // The server doesn't serve tokens unless CSRF protection is enabled.
+  if (response.ok) {
+    csrf = await response.json();
+  }
+}
+
+export function csrfHeaders() {
+  return csrf ? { [csrf.header]: csrf.token } : {};
+}
@@ -0,0 +1,163 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package admin
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Role is a level of privilege on the admin API. Each role includes the privileges of the roles
+// below it.
+type Role int
+
+const (
+	// RoleNone may not access the admin API.
+	RoleNone Role = iota
+	// RoleViewer may read configs and stats.
+	RoleViewer
+	// RoleEditor may also persist config changes.
+	RoleEditor
+	// RoleAdmin may also perform administrative operations, such as pruning history and managing
+	// templates.
+	RoleAdmin
+)
+
+var roleNames = []string{
+	RoleNone:   "none",
+	RoleViewer: "viewer",
+	RoleEditor: "editor",
+	RoleAdmin:  "admin",
+}
+
+func (r Role) String() string {
+	if r < 0 || int(r) >= len(roleNames) {
+		return fmt.Sprintf("Role(%d)", int(r))
+	}
+
+	return roleNames[r]
+}
+
+// ParseRole parses a role name, returning RoleNone for unknown names.
+func ParseRole(name string) Role {
+	for r, n := range roleNames {
+		if n == name {
+			return Role(r)
+		}
+	}
+
+	return RoleNone
+}
+
+// RoleMapper maps a principal to its role.
+type RoleMapper interface {
+	Role(p *Principal) Role
+}
+
+type staticRoleMapper struct {
+	roles       map[string]Role
+	defaultRole Role
+}
+
+// NewStaticRoleMapper creates a RoleMapper from a map of principal name to role. Principals not in
+// the map, including the anonymous principal, get defaultRole.
+func NewStaticRoleMapper(roles map[string]Role, defaultRole Role) RoleMapper {
+	return &staticRoleMapper{roles: roles, defaultRole: defaultRole}
+}
+
+func (s *staticRoleMapper) Role(p *Principal) Role {
+	if r, exists := s.roles[p.Name]; exists {
+		return r
+	}
+
+	return s.defaultRole
+}
+
+type claimRoleMapper struct {
+	claim    string
+	fallback RoleMapper
+}
+
+// NewClaimRoleMapper creates a RoleMapper that reads role names from a bearer token claim, which
+// may be a string or a list of strings; the highest role present wins. Principals without the
+// claim are mapped using fallback, which may be nil to map them to RoleNone.
+func NewClaimRoleMapper(claim string, fallback RoleMapper) RoleMapper {
+	return &claimRoleMapper{claim: claim, fallback: fallback}
+}
+
+func (c *claimRoleMapper) Role(p *Principal) Role {
+	var names []string
+	switch v := p.Claims[c.claim].(type) {
+	case string:
+		names = []string{v}
+	case []interface{}:
+		for _, n := range v {
+			if s, ok := n.(string); ok {
+				names = append(names, s)
+			}
+		}
+	}
+
+	if len(names) == 0 {
+		if c.fallback == nil {
+			return RoleNone
+		}
+
+		return c.fallback.Role(p)
+	}
+
+	role := RoleNone
+	for _, n := range names {
+		if r := ParseRole(n); r > role {
+			role = r
+		}
+	}
+
+	return role
+}
+
+// roleForMethod returns the role required for a request on one of the standard read/write
+// endpoints: reads require a viewer and anything else requires an editor.
+func roleForMethod(r *http.Request) Role {
+	if isReadOnlyMethod(r.Method) {
+		return RoleViewer
+	}
+
+	return RoleEditor
+}
+
+// roleForTemplateMethod returns the role required for a request on the template endpoints: reads
+// require a viewer and anything else requires an admin, since a template can change many buckets.
+func roleForTemplateMethod(r *http.Request) Role {
+	if isReadOnlyMethod(r.Method) {
+		return RoleViewer
+	}
+
+	return RoleAdmin
+}
+
+// rbacHandler rejects requests whose principal doesn't have the role required, as computed by
+// required. If no RoleMapper is configured, all requests are allowed.
+func rbacHandler(opts *Options, required func(*http.Request) Role, next http.Handler) http.Handler {
+	if opts.Roles == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := PrincipalFromContext(r.Context())
+		if p == nil {
+			p = &Principal{Name: AnonymousPrincipal}
+		}
+
+		need := required(r)
+		if has := opts.Roles.Role(p); has < need {
+			writeJSONError(w, &httpError{
+				fmt.Sprintf("%v has role %v, but %v %v requires role %v", p.Name, has, r.Method, r.URL.Path, need),
+				http.StatusForbidden})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
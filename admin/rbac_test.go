@@ -0,0 +1,129 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var rbacTestRoles = map[string]Role{
+	"vera":  RoleViewer,
+	"ed":    RoleEditor,
+	"adele": RoleAdmin,
+}
+
+func newRBACTestServer(opts *Options, required func(*http.Request) Role) *httptest.Server {
+	return httptest.NewServer(authHandler(opts, rbacHandler(opts, required, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			writeJSONOk(w)
+		}))))
+}
+
+// requireRole returns a function for rbacHandler that requires the same role for every request.
+func requireRole(role Role) func(*http.Request) Role {
+	return func(*http.Request) Role {
+		return role
+	}
+}
+
+func TestRBACEndpointClasses(t *testing.T) {
+	credentials := map[string]string{"vera": "pw", "ed": "pw", "adele": "pw", "nobody": "pw"}
+	opts := &Options{
+		Authenticator: NewBasicAuthenticator("qs", credentials),
+		Roles:         NewStaticRoleMapper(rbacTestRoles, RoleNone)}
+
+	standard := newRBACTestServer(opts, roleForMethod)
+	defer standard.Close()
+	adminOnly := newRBACTestServer(opts, requireRole(RoleAdmin))
+	defer adminOnly.Close()
+
+	tests := []struct {
+		user                        string
+		read, write, administrative int
+	}{
+		{"nobody", http.StatusForbidden, http.StatusForbidden, http.StatusForbidden},
+		{"vera", http.StatusOK, http.StatusForbidden, http.StatusForbidden},
+		{"ed", http.StatusOK, http.StatusOK, http.StatusForbidden},
+		{"adele", http.StatusOK, http.StatusOK, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		user := test.user
+		auth := func(r *http.Request) { r.SetBasicAuth(user, "pw") }
+
+		if status, body := doAuthRequest(t, standard, http.MethodGet, auth); status != test.read {
+			t.Errorf("Expected %v for a read by %v, got %v %v", test.read, user, status, body)
+		}
+
+		if status, body := doAuthRequest(t, standard, http.MethodPost, auth); status != test.write {
+			t.Errorf("Expected %v for a write by %v, got %v %v", test.write, user, status, body)
+		}
+
+		if status, body := doAuthRequest(t, adminOnly, http.MethodPost, auth); status != test.administrative {
+			t.Errorf("Expected %v for an admin operation by %v, got %v %v", test.administrative, user, status, body)
+		}
+	}
+}
+
+func TestRBACAnonymousPublicReads(t *testing.T) {
+	opts := &Options{
+		Authenticator: NewBasicAuthenticator("qs", map[string]string{"ed": "pw"}),
+		PublicReads:   true,
+		Roles:         NewStaticRoleMapper(rbacTestRoles, RoleViewer)}
+
+	ts := newRBACTestServer(opts, roleForMethod)
+	defer ts.Close()
+
+	if status, body := doAuthRequest(t, ts, http.MethodGet, nil); status != http.StatusOK {
+		t.Fatalf("Expected 200 for an anonymous read, got %v %v", status, body)
+	}
+}
+
+func TestRBACServedConsole(t *testing.T) {
+	mux := http.NewServeMux()
+	ServeAdminConsoleWithOptions(NewMockAdministrable(), mux, "", false, &Options{
+		Authenticator: NewBasicAuthenticator("qs", map[string]string{"vera": "pw"}),
+		Roles:         NewStaticRoleMapper(rbacTestRoles, RoleNone)})
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/foo", nil)
+	req.SetBasicAuth("vera", "pw")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403 for a viewer deleting a namespace, got %v %v", w.Code, w.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/configs", nil)
+	req.SetBasicAuth("vera", "pw")
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 for a viewer reading configs, got %v %v", w.Code, w.Body.String())
+	}
+}
+
+func TestClaimRoleMapper(t *testing.T) {
+	m := NewClaimRoleMapper("roles", NewStaticRoleMapper(map[string]Role{"ops": RoleAdmin}, RoleNone))
+
+	tests := []struct {
+		p        *Principal
+		expected Role
+	}{
+		{&Principal{Name: "a", Claims: map[string]interface{}{"roles": "editor"}}, RoleEditor},
+		{&Principal{Name: "b", Claims: map[string]interface{}{"roles": []interface{}{"viewer", "admin"}}}, RoleAdmin},
+		{&Principal{Name: "c", Claims: map[string]interface{}{"roles": []interface{}{"superuser"}}}, RoleNone},
+		{&Principal{Name: "ops"}, RoleAdmin},
+		{&Principal{Name: "d"}, RoleNone},
+	}
+
+	for _, test := range tests {
+		if r := m.Role(test.p); r != test.expected {
+			t.Errorf("Expected %v for %+v, got %v", test.expected, test.p, r)
+		}
+	}
+}
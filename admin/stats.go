@@ -83,3 +83,96 @@ func writeStats(a *statsAPIHandler, w http.ResponseWriter, path string) *httpErr
 
 	return nil
 }
+
+const (
+	defaultTopBuckets = 10
+	maxTopBuckets     = 1000
+)
+
+type topBucketsResponse struct {
+	By      stats.TopMetric    `json:"by"`
+	Buckets []*stats.TopBucket `json:"buckets"`
+}
+
+type topStatsAPIHandler struct {
+	a Administrable
+}
+
+func newTopStatsAPIHandler(admin Administrable) *topStatsAPIHandler {
+	return &topStatsAPIHandler{a: admin}
+}
+
+// ServeHTTP writes the busiest buckets, ranked by the metric in the "by" query parameter (requests
+// by default), limited to "n" buckets.
+func (a *topStatsAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, &httpError{"Unknown method " + r.Method, http.StatusBadRequest})
+		return
+	}
+
+	by := stats.TopByRequests
+	if v := r.URL.Query().Get("by"); v != "" {
+		by = stats.TopMetric(v)
+	}
+
+	valid := false
+	for _, m := range stats.TopMetrics {
+		valid = valid || m == by
+	}
+
+	if !valid {
+		writeJSONError(w, &httpError{"Unknown metric " + string(by), http.StatusBadRequest})
+		return
+	}
+
+	n, err := intParam(r, "n", defaultTopBuckets)
+	if err != nil || n < 1 || n > maxTopBuckets {
+		writeJSONError(w, &httpError{"Invalid n " + r.URL.Query().Get("n"), http.StatusBadRequest})
+		return
+	}
+
+	top := a.a.TopBuckets(by, n)
+	if top == nil {
+		writeJSONError(w, &httpError{"No top tracker configured", http.StatusBadRequest})
+		return
+	}
+
+	writeJSON(w, &topBucketsResponse{by, top})
+}
+
+type resetStatsResponse struct {
+	// Namespace is the namespace whose stats were reset, or empty for all of them.
+	Namespace string `json:"namespace"`
+}
+
+type resetStatsAPIHandler struct {
+	a Administrable
+}
+
+func newResetStatsAPIHandler(admin Administrable) *resetStatsAPIHandler {
+	return &resetStatsAPIHandler{a: admin}
+}
+
+// ServeHTTP resets the stats of the namespace in the "namespace" query parameter, or of every
+// namespace if there is none.
+func (a *resetStatsAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, &httpError{"Unknown method " + r.Method, http.StatusBadRequest})
+		return
+	}
+
+	namespace := r.URL.Query().Get("namespace")
+	if namespace != "" {
+		if _, exists := a.a.Configs().Namespaces[namespace]; !exists {
+			writeJSONError(w, &httpError{"Unable to locate namespace " + namespace, http.StatusNotFound})
+			return
+		}
+	}
+
+	if !a.a.ResetStats(namespace) {
+		writeJSONError(w, &httpError{"No stats listener configured", http.StatusBadRequest})
+		return
+	}
+
+	writeJSON(w, &resetStatsResponse{namespace})
+}
@@ -4,13 +4,16 @@
 package admin
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
 
 	"github.com/square/quotaservice/config"
+	"github.com/square/quotaservice/events"
 	"github.com/square/quotaservice/stats"
+	"github.com/square/quotaservice/test/helpers"
 )
 
 func TestStatsErrors(t *testing.T) {
@@ -115,3 +118,96 @@ func doStatsRequest(t *testing.T, a Administrable, object interface{}, method, p
 		t.Fatal(err)
 	}
 }
+
+func TestTopStats(t *testing.T) {
+	a := NewMockAdministrable()
+	a.topTracker.HandleEvent(events.NewBucketMissedEvent("ns", "a", true))
+	a.topTracker.HandleEvent(events.NewBucketMissedEvent("ns", "b", true))
+	a.topTracker.HandleEvent(events.NewBucketMissedEvent("ns", "b", true))
+	a.topTracker.HandleEvent(events.NewTokensServedEvent("ns", "c", false, 1, 0))
+
+	w := doConfigRequest(t, a, http.MethodGet, "/api/stats/top?by=rejections&n=1", "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %v %v", w.Code, w.Body.String())
+	}
+
+	response := &topBucketsResponse{}
+	helpers.CheckError(t, json.Unmarshal(w.Body.Bytes(), response))
+
+	if response.By != stats.TopByRejections || len(response.Buckets) != 1 ||
+		response.Buckets[0].Bucket != "b" || response.Buckets[0].Score != 2 {
+		t.Errorf("Unexpected response %+v", response)
+	}
+
+	w = doConfigRequest(t, a, http.MethodGet, "/api/stats/top", "", "")
+	helpers.CheckError(t, json.Unmarshal(w.Body.Bytes(), response))
+
+	if response.By != stats.TopByRequests || len(response.Buckets) != 3 {
+		t.Errorf("Expected all buckets ranked by requests, got %+v", response)
+	}
+}
+
+func TestTopStatsErrors(t *testing.T) {
+	for _, path := range []string{"/api/stats/top?by=unknown", "/api/stats/top?n=0", "/api/stats/top?n=x"} {
+		w := doConfigRequest(t, NewMockAdministrable(), http.MethodGet, path, "", "")
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %v, got %v", path, w.Code)
+		}
+	}
+
+	w := doConfigRequest(t, NewMockErrorAdministrable(), http.MethodGet, "/api/stats/top", "", "")
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "No top tracker configured") {
+		t.Errorf("Expected 400 without a tracker, got %v %v", w.Code, w.Body.String())
+	}
+}
+
+func TestResetStats(t *testing.T) {
+	a := NewMockAdministrable()
+	a.Configs().Namespaces["ns"] = config.NewDefaultNamespaceConfig("ns")
+	a.topTracker.HandleEvent(events.NewBucketMissedEvent("ns", "a", true))
+	a.topTracker.HandleEvent(events.NewBucketMissedEvent("other", "b", true))
+
+	w := doConfigRequest(t, a, http.MethodPost, "/api/stats/reset?namespace=ns", "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %v %v", w.Code, w.Body.String())
+	}
+
+	response := &resetStatsResponse{}
+	helpers.CheckError(t, json.Unmarshal(w.Body.Bytes(), response))
+
+	if response.Namespace != "ns" {
+		t.Errorf("Unexpected response %+v", response)
+	}
+
+	if top := a.topTracker.Top(stats.TopByRejections, 10); len(top) != 1 || top[0].Namespace != "other" {
+		t.Errorf("Expected only other's bucket after resetting ns, got %v", top)
+	}
+
+	w = doConfigRequest(t, a, http.MethodPost, "/api/stats/reset", "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %v %v", w.Code, w.Body.String())
+	}
+
+	if top := a.topTracker.Top(stats.TopByRejections, 10); len(top) != 0 {
+		t.Errorf("Expected no buckets after resetting all namespaces, got %v", top)
+	}
+}
+
+func TestResetStatsErrors(t *testing.T) {
+	a := NewMockAdministrable()
+
+	w := doConfigRequest(t, a, http.MethodGet, "/api/stats/reset", "", "")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for GET, got %v", w.Code)
+	}
+
+	w = doConfigRequest(t, a, http.MethodPost, "/api/stats/reset?namespace=unknown", "", "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown namespace, got %v", w.Code)
+	}
+
+	w = doConfigRequest(t, NewMockErrorAdministrable(), http.MethodPost, "/api/stats/reset", "", "")
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "No stats listener configured") {
+		t.Errorf("Expected 400 without a stats listener, got %v %v", w.Code, w.Body.String())
+	}
+}
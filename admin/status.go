@@ -0,0 +1,145 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package admin
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/square/quotaservice/config"
+	pb "github.com/square/quotaservice/protos/config"
+)
+
+// started is when the process started, for reporting uptime.
+var started = time.Now()
+
+type statusResponse struct {
+	// Version is the version of the config in force, and Fingerprint a hash of it, identical on
+	// every node with the same config loaded.
+	Version     int32  `json:"version"`
+	Fingerprint string `json:"fingerprint"`
+	// UptimeSeconds is how long the process has been running.
+	UptimeSeconds int64            `json:"uptimeSeconds"`
+	Persister     *PersisterHealth `json:"persister"`
+	// ConfigHealth is unhealthy if config changes may have stopped reaching the server.
+	ConfigHealth *ConfigHealth `json:"configHealth"`
+	Buckets      *bucketCounts `json:"buckets"`
+
+	ReadOnly bool `json:"readOnly"`
+	// Principal is the caller, if authenticated.
+	Principal string `json:"principal,omitempty"`
+	// Role is the caller's role, if roles are configured.
+	Role string `json:"role,omitempty"`
+	// CanEdit is true if the caller may change the config.
+	CanEdit bool `json:"canEdit"`
+	// PendingActivation describes the config persisted to take effect later, if any.
+	PendingActivation *pendingActivation `json:"pendingActivation,omitempty"`
+}
+
+type bucketCounts struct {
+	Namespaces int `json:"namespaces"`
+	// Static buckets are those configured, and Dynamic those created from templates and active.
+	Static  int `json:"static"`
+	Dynamic int `json:"dynamic"`
+}
+
+type pendingActivation struct {
+	Version int32 `json:"version"`
+	// ActivateAt is in seconds since the epoch.
+	ActivateAt int64 `json:"activateAt"`
+}
+
+// readOnlyHandler rejects every mutating request with a 403 if the ReadOnly option is set,
+// regardless of the caller's role.
+func readOnlyHandler(opts *Options, next http.Handler) http.Handler {
+	if !opts.ReadOnly {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isReadOnlyMethod(r.Method) {
+			writeJSONError(w, &httpError{"The admin API is read-only", http.StatusForbidden})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// statusAPIHandler describes the admin API to the caller, so the UI can hide controls the caller
+// can't use, and the config the server is running, for checking configs have propagated across a
+// fleet.
+type statusAPIHandler struct {
+	a    Administrable
+	opts *Options
+
+	// fingerprinted is the config last fingerprinted, since configs are replaced rather than
+	// changed in place when reloading.
+	fingerprinted *pb.ServiceConfig
+	fingerprint   string
+	sync.Mutex
+}
+
+func newStatusAPIHandler(a Administrable, opts *Options) *statusAPIHandler {
+	return &statusAPIHandler{a: a, opts: opts}
+}
+
+func (s *statusAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, &httpError{"Unknown method " + r.Method, http.StatusBadRequest})
+		return
+	}
+
+	response := &statusResponse{
+		UptimeSeconds: int64(time.Since(started) / time.Second),
+		Persister:     s.a.PersisterHealth(),
+		ConfigHealth:  s.a.ConfigHealth(),
+		Buckets:       &bucketCounts{},
+		ReadOnly:      s.opts.ReadOnly,
+		CanEdit:       !s.opts.ReadOnly}
+
+	if cfg := s.a.Configs(); cfg != nil {
+		response.Version = cfg.Version
+		response.Fingerprint = s.fingerprintOf(cfg)
+		response.Buckets.Namespaces = len(cfg.Namespaces)
+
+		for name, ns := range cfg.Namespaces {
+			response.Buckets.Static += len(ns.Buckets)
+			_, dynamic, _ := s.a.DynamicBuckets(name, "", "", 0)
+			response.Buckets.Dynamic += dynamic
+		}
+	}
+
+	if pending := s.a.PendingConfig(); pending != nil {
+		response.PendingActivation = &pendingActivation{Version: pending.Version, ActivateAt: pending.ActivateAt}
+	}
+
+	p := PrincipalFromContext(r.Context())
+	if p != nil {
+		response.Principal = p.Name
+	} else {
+		p = &Principal{Name: AnonymousPrincipal}
+	}
+
+	if s.opts.Roles != nil {
+		role := s.opts.Roles.Role(p)
+		response.Role = role.String()
+		response.CanEdit = response.CanEdit && role >= RoleEditor
+	}
+
+	writeJSON(w, response)
+}
+
+func (s *statusAPIHandler) fingerprintOf(cfg *pb.ServiceConfig) string {
+	s.Lock()
+	defer s.Unlock()
+
+	if cfg != s.fingerprinted {
+		s.fingerprinted = cfg
+		s.fingerprint = config.Fingerprint(cfg)
+	}
+
+	return s.fingerprint
+}
@@ -0,0 +1,163 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/square/quotaservice/config"
+	"github.com/square/quotaservice/test/helpers"
+)
+
+func doOptionsRequest(t *testing.T, a Administrable, opts *Options, method, path, body string, auth func(*http.Request)) *httptest.ResponseRecorder {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	ServeAdminConsoleWithOptions(a, mux, "", false, opts)
+
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if auth != nil {
+		auth(req)
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	return w
+}
+
+func TestReadOnlyBlocksMutations(t *testing.T) {
+	a := newDiffTestAdministrable(t)
+	opts := &Options{ReadOnly: true}
+
+	mutations := []struct{ method, path, body string }{
+		{http.MethodPost, "/api/config", validConfigJSON},
+		{http.MethodPost, "/api/config/import", validConfigJSON},
+		{http.MethodPost, "/api/config/rollback?version=3", ""},
+		{http.MethodPost, "/api/changed", `{"name": "changed"}`},
+		{http.MethodPut, "/api/changed/edited", `{"name": "edited", "size": 1}`},
+		{http.MethodDelete, "/api/changed", ""},
+	}
+
+	for _, m := range mutations {
+		if w := doOptionsRequest(t, a, opts, m.method, m.path, m.body, nil); w.Code != http.StatusForbidden {
+			t.Errorf("Expected 403 for %v %v, got %v %v", m.method, m.path, w.Code, w.Body.String())
+		}
+	}
+
+	if a.cfg.Version != 4 || len(a.persisted) != 2 {
+		t.Errorf("Expected no config to be persisted, got version %v", a.cfg.Version)
+	}
+
+	for _, path := range []string{"/api", "/api/configs", "/api/config/export", "/api/config/diff?from=3&to=4", "/api/audit"} {
+		if w := doOptionsRequest(t, a, opts, http.MethodGet, path, "", nil); w.Code != http.StatusOK {
+			t.Errorf("Expected 200 for GET %v, got %v %v", path, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestReadOnlyOverridesRoles(t *testing.T) {
+	opts := &Options{
+		Authenticator: NewBasicAuthenticator("qs", map[string]string{"adele": "pw"}),
+		Roles:         NewStaticRoleMapper(rbacTestRoles, RoleNone),
+		ReadOnly:      true}
+	auth := func(r *http.Request) { r.SetBasicAuth("adele", "pw") }
+
+	w := doOptionsRequest(t, NewMockAdministrable(), opts, http.MethodPost, "/api/config", validConfigJSON, auth)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for an admin in read-only mode, got %v %v", w.Code, w.Body.String())
+	}
+}
+
+func getStatus(t *testing.T, a Administrable, opts *Options, auth func(*http.Request)) *statusResponse {
+	t.Helper()
+
+	w := doOptionsRequest(t, a, opts, http.MethodGet, "/api/status", "", auth)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %v %v", w.Code, w.Body.String())
+	}
+
+	response := &statusResponse{}
+	helpers.CheckError(t, json.Unmarshal(w.Body.Bytes(), response))
+	return response
+}
+
+func TestStatus(t *testing.T) {
+	if s := getStatus(t, NewMockAdministrable(), nil, nil); s.ReadOnly || !s.CanEdit || s.Principal != "" || s.Role != "" {
+		t.Errorf("Unexpected status with default options %+v", s)
+	}
+
+	if s := getStatus(t, NewMockAdministrable(), &Options{ReadOnly: true}, nil); !s.ReadOnly || s.CanEdit {
+		t.Errorf("Expected a read-only status, got %+v", s)
+	}
+
+	opts := &Options{
+		Authenticator: NewBasicAuthenticator("qs", map[string]string{"vera": "pw", "ed": "pw"}),
+		Roles:         NewStaticRoleMapper(rbacTestRoles, RoleNone)}
+
+	if s := getStatus(t, NewMockAdministrable(), opts, func(r *http.Request) { r.SetBasicAuth("vera", "pw") }); s.Principal != "vera" ||
+		s.Role != RoleViewer.String() || s.CanEdit {
+		t.Errorf("Unexpected status for a viewer %+v", s)
+	}
+
+	if s := getStatus(t, NewMockAdministrable(), opts, func(r *http.Request) { r.SetBasicAuth("ed", "pw") }); s.Role != RoleEditor.String() || !s.CanEdit {
+		t.Errorf("Unexpected status for an editor %+v", s)
+	}
+}
+
+func TestStatusPendingActivation(t *testing.T) {
+	a := NewMockAdministrable()
+	if s := getStatus(t, a, nil, nil); s.PendingActivation != nil {
+		t.Errorf("Expected no pending activation, got %+v", s.PendingActivation)
+	}
+
+	pending := config.NewDefaultServiceConfig()
+	pending.Version = 5
+	pending.ActivateAt = 1500000000
+	a.SetPendingConfig(pending)
+
+	if s := getStatus(t, a, nil, nil); s.PendingActivation == nil || s.PendingActivation.Version != 5 || s.PendingActivation.ActivateAt != 1500000000 {
+		t.Errorf("Expected version 5 pending activation, got %+v", s.PendingActivation)
+	}
+}
+
+func TestStatusConfig(t *testing.T) {
+	a := NewMockAdministrable()
+	a.Configs().Version = 42
+
+	dyn := config.NewDefaultNamespaceConfig("dyn")
+	helpers.CheckError(t, config.AddBucket(dyn, config.NewDefaultBucketConfig("a")))
+	helpers.CheckError(t, config.AddBucket(dyn, config.NewDefaultBucketConfig("b")))
+	helpers.CheckError(t, config.AddNamespace(a.Configs(), dyn))
+
+	s := getStatus(t, a, nil, nil)
+	if s.Version != 42 || s.Fingerprint != config.Fingerprint(a.Configs()) || s.Fingerprint == "" {
+		t.Errorf("Expected version 42 with its fingerprint, got %+v", s)
+	}
+
+	if s.Buckets == nil || *s.Buckets != (bucketCounts{Namespaces: 1, Static: 2, Dynamic: 25}) {
+		t.Errorf("Unexpected bucket counts %+v", s.Buckets)
+	}
+
+	if s.Persister == nil || !s.Persister.Healthy {
+		t.Errorf("Expected a healthy persister, got %+v", s.Persister)
+	}
+
+	if s.ConfigHealth == nil || !s.ConfigHealth.Healthy {
+		t.Errorf("Expected config changes to be reaching the server, got %+v", s.ConfigHealth)
+	}
+
+	// Loading another config changes the fingerprint.
+	next := config.CloneConfig(a.Configs())
+	next.Version = 43
+	a.cfg = next
+
+	if s2 := getStatus(t, a, nil, nil); s2.Version != 43 || s2.Fingerprint == s.Fingerprint {
+		t.Errorf("Expected version 43 with a new fingerprint, got %+v", s2)
+	}
+}
@@ -0,0 +1,137 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package admin
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/square/quotaservice/config"
+	pb "github.com/square/quotaservice/protos/config"
+)
+
+// templatesAPIHandler manages the bucket templates of the config, under /api/templates.
+type templatesAPIHandler struct {
+	a Administrable
+}
+
+type templateResponse struct {
+	Name   string           `json:"name"`
+	Config *pb.BucketConfig `json:"config"`
+	// UsedBy lists the fully qualified names of the buckets created from the template.
+	UsedBy []string `json:"usedBy"`
+}
+
+type templatesResponse struct {
+	Templates []*templateResponse `json:"templates"`
+}
+
+func newTemplatesAPIHandler(admin Administrable) *templatesAPIHandler {
+	return &templatesAPIHandler{a: admin}
+}
+
+func (a *templatesAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/templates"), "/")
+	user := getUsername(r)
+
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		a.list(w)
+	case name == "":
+		writeJSONError(w, &httpError{"Unknown method " + r.Method, http.StatusBadRequest})
+	case r.Method == http.MethodGet:
+		a.get(w, name)
+	case r.Method == http.MethodPost:
+		a.change(w, r, name, func(t *pb.BucketConfig) error {
+			return a.a.AddTemplate(t, user)
+		})
+	case r.Method == http.MethodPut:
+		a.change(w, r, name, func(t *pb.BucketConfig) error {
+			return a.a.UpdateTemplate(t, user)
+		})
+	case r.Method == http.MethodDelete:
+		if err := a.a.DeleteTemplate(name, user); err != nil {
+			writeTemplateError(w, err)
+			return
+		}
+
+		writeJSONOk(w)
+	default:
+		writeJSONError(w, &httpError{"Unknown method " + r.Method, http.StatusBadRequest})
+	}
+}
+
+func (a *templatesAPIHandler) list(w http.ResponseWriter) {
+	cfg := a.a.Configs()
+	names := make([]string, 0, len(cfg.Templates))
+	for name := range cfg.Templates {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	response := &templatesResponse{make([]*templateResponse, len(names))}
+	for i, name := range names {
+		response.Templates[i] = newTemplateResponse(cfg, name)
+	}
+
+	writeJSON(w, response)
+}
+
+func (a *templatesAPIHandler) get(w http.ResponseWriter, name string) {
+	cfg := a.a.Configs()
+	if cfg.Templates[name] == nil {
+		writeJSONError(w, &httpError{"Unable to locate template " + name, http.StatusNotFound})
+		return
+	}
+
+	writeJSON(w, newTemplateResponse(cfg, name))
+}
+
+func newTemplateResponse(cfg *pb.ServiceConfig, name string) *templateResponse {
+	usedBy := config.TemplateReferences(cfg, name)
+	if usedBy == nil {
+		usedBy = make([]string, 0)
+	}
+
+	return &templateResponse{name, cfg.Templates[name], usedBy}
+}
+
+func (a *templatesAPIHandler) change(w http.ResponseWriter, r *http.Request, name string, updater func(*pb.BucketConfig) error) {
+	t := &pb.BucketConfig{}
+	if err := unmarshalJSON(r.Body, t); err != nil {
+		writeJSONError(w, &httpError{"Unable to parse template: " + err.Error(), http.StatusBadRequest})
+		return
+	}
+
+	if t.Name != "" && t.Name != name {
+		writeJSONError(w, &httpError{"Template name " + t.Name + " does not match " + name, http.StatusBadRequest})
+		return
+	}
+
+	t.Name = name
+	if err := updater(t); err != nil {
+		writeTemplateError(w, err)
+		return
+	}
+
+	writeJSONOk(w)
+}
+
+func writeTemplateError(w http.ResponseWriter, err error) {
+	if inUse, ok := err.(*config.TemplateInUseError); ok {
+		writeJSONError(w, &httpError{inUse.Error(), http.StatusConflict})
+		return
+	}
+
+	switch err {
+	case config.ErrUnknownTemplate:
+		writeJSONError(w, &httpError{err.Error(), http.StatusNotFound})
+	case config.ErrTemplateExists:
+		writeJSONError(w, &httpError{err.Error(), http.StatusConflict})
+	default:
+		writePersistError(w, err)
+	}
+}
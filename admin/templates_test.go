@@ -0,0 +1,124 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/square/quotaservice/config"
+	pb "github.com/square/quotaservice/protos/config"
+)
+
+func TestTemplatesCRUD(t *testing.T) {
+	a := NewMockAdministrable()
+	version := a.Configs().Version
+
+	w := doConfigRequest(t, a, http.MethodPost, "/api/templates/standard", "", `{"size": 50, "fill_rate": 10}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 creating a template, got %v %v", w.Code, w.Body.String())
+	}
+
+	if a.Configs().Version != version+1 || a.Configs().Templates["standard"].GetSize() != 50 {
+		t.Fatalf("Expected the template to be persisted as the next version, got %+v", a.Configs())
+	}
+
+	if w := doConfigRequest(t, a, http.MethodPost, "/api/templates/standard", "", `{}`); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 creating an existing template, got %v", w.Code)
+	}
+
+	if w := doConfigRequest(t, a, http.MethodPost, "/api/templates/bad", "", `{"size": -1}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 creating an invalid template, got %v", w.Code)
+	}
+
+	if w := doConfigRequest(t, a, http.MethodPost, "/api/templates/other", "", `{"name": "standard"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a mismatched name, got %v", w.Code)
+	}
+
+	w = doConfigRequest(t, a, http.MethodPut, "/api/templates/standard", "", `{"size": 80}`)
+	if w.Code != http.StatusOK || a.Configs().Templates["standard"].GetSize() != 80 {
+		t.Fatalf("Expected 200 updating a template, got %v %v", w.Code, w.Body.String())
+	}
+
+	if w := doConfigRequest(t, a, http.MethodPut, "/api/templates/premium", "", `{}`); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 updating an unknown template, got %v", w.Code)
+	}
+
+	w = doConfigRequest(t, a, http.MethodGet, "/api/templates", "", "")
+	var list templatesResponse
+	if err := unmarshalJSON(w.Body, &list); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list.Templates) != 1 || list.Templates[0].Name != "standard" || list.Templates[0].Config.Size != 80 {
+		t.Errorf("Expected the standard template to be listed, got %+v", list.Templates)
+	}
+
+	if w := doConfigRequest(t, a, http.MethodGet, "/api/templates/premium", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 getting an unknown template, got %v", w.Code)
+	}
+
+	if w := doConfigRequest(t, a, http.MethodDelete, "/api/templates/standard", "", ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 deleting an unused template, got %v %v", w.Code, w.Body.String())
+	}
+
+	if a.Configs().Templates["standard"] != nil || a.Configs().Version != version+3 {
+		t.Errorf("Expected the deletion to be persisted, got %+v", a.Configs())
+	}
+}
+
+func TestTemplatesDeleteInUse(t *testing.T) {
+	a := NewMockAdministrable()
+	cfg := config.NewDefaultServiceConfig()
+	cfg.Templates = map[string]*pb.BucketConfig{"standard": config.NewDefaultBucketConfig("standard")}
+	ns := config.NewDefaultNamespaceConfig("foo")
+	ns.Buckets["bar"] = &pb.BucketConfig{Name: "bar", Template: "standard"}
+	cfg.Namespaces["foo"] = ns
+	_, err := a.PersistConfig(cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version := a.Configs().Version
+
+	w := doConfigRequest(t, a, http.MethodDelete, "/api/templates/standard", "", "")
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "foo:bar") {
+		t.Fatalf("Expected 409 naming the bucket using the template, got %v %v", w.Code, w.Body.String())
+	}
+
+	if a.Configs().Templates["standard"] == nil || a.Configs().Version != version {
+		t.Fatal("Expected a template in use not to be deleted")
+	}
+
+	w = doConfigRequest(t, a, http.MethodGet, "/api/templates/standard", "", "")
+	var rsp templateResponse
+	if err := unmarshalJSON(w.Body, &rsp); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(rsp.UsedBy, []string{"foo:bar"}) {
+		t.Errorf("Expected the template to be used by foo:bar, got %v", rsp.UsedBy)
+	}
+}
+
+func TestTemplatesRequireAdmin(t *testing.T) {
+	mux := http.NewServeMux()
+	ServeAdminConsoleWithOptions(NewMockAdministrable(), mux, "", false, &Options{
+		Authenticator: NewBasicAuthenticator("qs", map[string]string{"ed": "pw", "ops": "pw"}),
+		Roles:         NewStaticRoleMapper(map[string]Role{"ed": RoleEditor, "ops": RoleAdmin}, RoleNone)})
+
+	for user, expected := range map[string]int{"ed": http.StatusForbidden, "ops": http.StatusOK} {
+		req := httptest.NewRequest(http.MethodPost, "/api/templates/standard", strings.NewReader(`{}`))
+		req.SetBasicAuth(user, "pw")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+
+		if w.Code != expected {
+			t.Errorf("Expected %v creating a template as %v, got %v %v", expected, user, w.Code, w.Body.String())
+		}
+	}
+}
@@ -5,29 +5,58 @@ package admin
 
 import (
 	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/square/quotaservice/audit"
 	"github.com/square/quotaservice/config"
+	"github.com/square/quotaservice/events"
 	pb "github.com/square/quotaservice/protos/config"
 	"github.com/square/quotaservice/stats"
 )
 
 type MockAdministrable struct {
-	cfg    *pb.ServiceConfig
-	errors bool
+	cfg           *pb.ServiceConfig
+	pending       *pb.ServiceConfig
+	errors        bool
+	configChanges *config.ConfigChangeBroadcaster
+	persisted     map[int32]*pb.ServiceConfig
+	auditLog      *audit.MemorySink
+	topTracker    *stats.TopTracker
+	rateTracker   *stats.RateTracker
+	broadcaster   *events.Broadcaster
 }
 
 func NewMockErrorAdministrable() *MockAdministrable {
-	return &MockAdministrable{config.NewDefaultServiceConfig(), true}
+	return &MockAdministrable{config.NewDefaultServiceConfig(), nil, true, config.NewConfigChangeBroadcaster(), make(map[int32]*pb.ServiceConfig), audit.NewMemorySink(0), stats.NewTopTracker(stats.TopOptions{}), stats.NewRateTracker(stats.RateOptions{}), events.NewBroadcaster()}
 }
 
 func NewMockAdministrable() *MockAdministrable {
-	return &MockAdministrable{config.NewDefaultServiceConfig(), false}
+	return &MockAdministrable{config.NewDefaultServiceConfig(), nil, false, config.NewConfigChangeBroadcaster(), make(map[int32]*pb.ServiceConfig), audit.NewMemorySink(0), stats.NewTopTracker(stats.TopOptions{}), stats.NewRateTracker(stats.RateOptions{}), events.NewBroadcaster()}
 }
 
 func (m *MockAdministrable) Configs() *pb.ServiceConfig {
 	return m.cfg
 }
 
+func (m *MockAdministrable) PendingConfig() *pb.ServiceConfig {
+	return m.pending
+}
+
+// EffectiveConfig simulates buckets created with the current config, with defaults applied.
+func (m *MockAdministrable) EffectiveConfig() *pb.ServiceConfig {
+	effective := config.CloneConfig(m.cfg)
+	config.ApplyDefaults(effective)
+	return effective
+}
+
+// SetPendingConfig simulates a config persisted with a future activation time.
+func (m *MockAdministrable) SetPendingConfig(c *pb.ServiceConfig) {
+	m.pending = c
+}
+
 func (m *MockAdministrable) UpdateConfig(config *pb.ServiceConfig, user string) error {
 	if m.errors {
 		return errors.New("UpdateConfig")
@@ -36,6 +65,92 @@ func (m *MockAdministrable) UpdateConfig(config *pb.ServiceConfig, user string)
 	return nil
 }
 
+func (m *MockAdministrable) UpdateConfigIfLatest(c *pb.ServiceConfig, expectedVersion int32, user string) error {
+	if m.errors {
+		return errors.New("UpdateConfigIfLatest")
+	}
+
+	if expectedVersion != m.cfg.Version {
+		return config.ErrStaleConfig
+	}
+
+	return nil
+}
+
+func (m *MockAdministrable) PersistConfig(c *pb.ServiceConfig, user string) (int32, error) {
+	if m.errors {
+		return 0, errors.New("PersistConfig")
+	}
+
+	if err := config.Validate(c); err != nil {
+		return 0, err
+	}
+
+	return m.persist(c, user, "")
+}
+
+func (m *MockAdministrable) RollbackConfig(version int32, user string) (int32, error) {
+	if m.errors {
+		return 0, errors.New("RollbackConfig")
+	}
+
+	target := m.persisted[version]
+	if target == nil && m.cfg.Version == version {
+		target = m.cfg
+	}
+
+	if target == nil {
+		return 0, config.ErrUnknownVersion
+	}
+
+	return m.persist(target, user, fmt.Sprintf("rollback to version %v", version))
+}
+
+// ReloadConfig simulates a config found by polling the persister, the highest version persisted.
+func (m *MockAdministrable) ReloadConfig() (int32, error) {
+	if m.errors {
+		return 0, errors.New("ReloadConfig")
+	}
+
+	for _, c := range m.persisted {
+		if c.Version > m.cfg.Version {
+			m.cfg = c
+		}
+	}
+
+	return m.cfg.Version, nil
+}
+
+func (m *MockAdministrable) persist(c *pb.ServiceConfig, user, note string) (int32, error) {
+	version := m.cfg.Version + 1
+	if _, exists := m.persisted[version]; exists {
+		return 0, config.ErrDuplicateConfig
+	}
+
+	cfg := config.CloneConfig(c)
+	cfg.Version = version
+	cfg.User = user
+	_ = m.auditLog.Write(&audit.Entry{
+		Time:       time.Now(),
+		Principal:  user,
+		OldVersion: m.cfg.Version,
+		NewVersion: version,
+		Summary:    config.Diff(m.cfg, cfg).Summary(),
+		Note:       note})
+	m.persisted[version] = cfg
+	m.cfg = cfg
+
+	return version, nil
+}
+
+func (m *MockAdministrable) AuditEntries(offset, limit int) ([]*audit.Entry, int, error) {
+	if m.errors {
+		return nil, 0, errors.New("AuditEntries")
+	}
+
+	return m.auditLog.Read(offset, limit)
+}
+
 func (m *MockAdministrable) DeleteBucket(namespace, name, user string) error {
 	if m.errors {
 		return errors.New("DeleteBucket")
@@ -84,6 +199,39 @@ func (m *MockAdministrable) UpdateNamespace(n *pb.NamespaceConfig, user string)
 	return nil
 }
 
+func (m *MockAdministrable) AddTemplate(t *pb.BucketConfig, user string) error {
+	return m.changeConfig("AddTemplate", user, func(c *pb.ServiceConfig) error {
+		return config.CreateTemplate(c, t)
+	})
+}
+
+func (m *MockAdministrable) UpdateTemplate(t *pb.BucketConfig, user string) error {
+	return m.changeConfig("UpdateTemplate", user, func(c *pb.ServiceConfig) error {
+		return config.UpdateTemplate(c, t)
+	})
+}
+
+func (m *MockAdministrable) DeleteTemplate(name, user string) error {
+	return m.changeConfig("DeleteTemplate", user, func(c *pb.ServiceConfig) error {
+		return config.DeleteTemplate(c, name)
+	})
+}
+
+// changeConfig simulates persisting a change to a copy of the current config as the next version.
+func (m *MockAdministrable) changeConfig(method, user string, updater func(*pb.ServiceConfig) error) error {
+	if m.errors {
+		return errors.New(method)
+	}
+
+	c := config.CloneConfig(m.cfg)
+	if err := updater(c); err != nil {
+		return err
+	}
+
+	_, err := m.persist(c, user, "")
+	return err
+}
+
 func (m *MockAdministrable) TopDynamicHits(namespace string) []*stats.BucketScore {
 	if m.errors {
 		return nil
@@ -100,6 +248,56 @@ func (m *MockAdministrable) TopDynamicMisses(namespace string) []*stats.BucketSc
 	return make([]*stats.BucketScore, 0)
 }
 
+func (m *MockAdministrable) TopBuckets(metric stats.TopMetric, n int) []*stats.TopBucket {
+	if m.errors {
+		return nil
+	}
+
+	return m.topTracker.Top(metric, n)
+}
+
+func (m *MockAdministrable) ResetStats(namespace string) bool {
+	if m.errors {
+		return false
+	}
+
+	m.topTracker.Reset(namespace)
+	m.rateTracker.Reset(namespace)
+	return true
+}
+
+func (m *MockAdministrable) NamespaceRates() ([]*stats.NamespaceRate, time.Duration) {
+	if m.errors {
+		return nil, 0
+	}
+
+	return m.rateTracker.Rates(), m.rateTracker.Window()
+}
+
+func (m *MockAdministrable) SubscribeEvents(bufSize int, filter func(events.Event) bool) *events.Subscription {
+	if m.errors {
+		return nil
+	}
+
+	return m.broadcaster.Subscribe(bufSize, filter)
+}
+
+func (m *MockAdministrable) PersisterHealth() *PersisterHealth {
+	if m.errors {
+		return &PersisterHealth{Healthy: false, LastError: "PersistConfig"}
+	}
+
+	return &PersisterHealth{Healthy: true}
+}
+
+func (m *MockAdministrable) ConfigHealth() *ConfigHealth {
+	if m.errors {
+		return &ConfigHealth{Healthy: false, LastChangeAt: 1, StalenessThresholdSeconds: 60}
+	}
+
+	return &ConfigHealth{Healthy: true}
+}
+
 func (m *MockAdministrable) DynamicBucketStats(namespace, bucket string) *stats.BucketScores {
 	if m.errors {
 		return nil
@@ -108,10 +306,87 @@ func (m *MockAdministrable) DynamicBucketStats(namespace, bucket string) *stats.
 	return &stats.BucketScores{Hits: 0, Misses: 0}
 }
 
+// InspectBucket describes a single mock bucket, foo:bar.
+func (m *MockAdministrable) InspectBucket(namespace, name string) (*BucketInspection, error) {
+	if m.errors {
+		return nil, errors.New("InspectBucket")
+	}
+
+	if namespace != "foo" || name != "bar" {
+		return nil, nil
+	}
+
+	tokens := int64(42)
+	return &BucketInspection{
+		Namespace:       namespace,
+		Name:            name,
+		Config:          config.NewDefaultBucketConfig(name),
+		AvailableTokens: &tokens,
+		Activity:        &BucketActivity{}}, nil
+}
+
+// InspectBuckets describes the single mock bucket, foo:bar.
+func (m *MockAdministrable) InspectBuckets(limit int) ([]*BucketInspection, bool, error) {
+	b, err := m.InspectBucket("foo", "bar")
+	if err != nil {
+		return nil, false, err
+	}
+
+	if limit < 1 {
+		return nil, true, nil
+	}
+
+	return []*BucketInspection{b}, false, nil
+}
+
+// DynamicBuckets returns from 25 mock dynamic buckets, b00 to b24, in namespace dyn. Bucket bNN
+// was last active at NN millis.
+func (m *MockAdministrable) DynamicBuckets(namespace, prefix, cursor string, limit int) ([]*DynamicBucket, int, bool) {
+	if namespace != "dyn" {
+		return nil, 0, false
+	}
+
+	page := make([]*DynamicBucket, 0)
+	total := 0
+	for i := 0; i < 25; i++ {
+		name := fmt.Sprintf("b%02d", i)
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		total++
+		if name > cursor && len(page) < limit {
+			page = append(page, &DynamicBucket{name, int64(i)})
+		}
+	}
+
+	return page, total, true
+}
+
 func (m *MockAdministrable) HistoricalConfigs() ([]*pb.ServiceConfig, error) {
 	if m.errors {
 		return nil, errors.New("HistoricalConfigs")
 	}
 
-	return make([]*pb.ServiceConfig, 1), nil
+	configs := map[int32]*pb.ServiceConfig{m.cfg.Version: m.cfg}
+	for v, c := range m.persisted {
+		configs[v] = c
+	}
+
+	history := make([]*pb.ServiceConfig, 0, len(configs))
+	for _, c := range configs {
+		history = append(history, c)
+	}
+
+	sort.Slice(history, func(i, j int) bool { return history[i].Version < history[j].Version })
+	return history, nil
+}
+
+func (m *MockAdministrable) SubscribeConfigChanges(bufSize int) (<-chan *config.ConfigChange, func()) {
+	return m.configChanges.Subscribe(bufSize)
+}
+
+// PublishConfigChange simulates the application of a new config.
+func (m *MockAdministrable) PublishConfigChange(c *config.ConfigChange) {
+	m.configChanges.Publish(c)
 }
@@ -5,9 +5,12 @@ package quotaservice
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/square/quotaservice/admin"
+	"github.com/square/quotaservice/audit"
 	"github.com/square/quotaservice/config"
+	"github.com/square/quotaservice/dedupe"
 	"github.com/square/quotaservice/events"
 	"github.com/square/quotaservice/logging"
 	"github.com/square/quotaservice/stats"
@@ -18,12 +21,138 @@ type Server interface {
 	Start() (bool, error)
 	Stop() (bool, error)
 	SetLogger(logger logging.Logger)
+	// SetStructuredLogger sets the logger for leveled logs with fields. Defaults to printing them
+	// to the Logger.
+	SetStructuredLogger(logger logging.StructuredLogger)
 	ServeAdminConsole(*http.ServeMux, string, bool)
+	ServeAdminConsoleWithOptions(*http.ServeMux, string, bool, *admin.Options)
+	// SetListener sets a listener notified of events. Events are buffered, eventQueueBufSize at
+	// most, and delivered by a separate goroutine so a slow listener never blocks serving requests;
+	// events are dropped when the buffer is full.
 	SetListener(listener events.Listener, eventQueueBufSize int)
+	// AddListener adds a listener only notified of events of the given types, or of every event if
+	// no types are given. Events no listener wants are never queued. The event buffer is shared by
+	// all listeners, and sized for the largest eventQueueBufSize requested.
+	AddListener(listener events.Listener, eventQueueBufSize int, types ...events.EventType)
+	// RegisterListener adds a listener under a name while the server runs, notified of events of
+	// the given types, or of every event if no types are given. Unlike listeners added before the
+	// server starts, each has its own buffer of eventQueueBufSize events, so one falling behind
+	// only drops its own events. Fails if the name is already registered.
+	RegisterListener(name string, listener events.Listener, eventQueueBufSize int, types ...events.EventType) error
+	// UnregisterListener removes a listener registered under a name, returning false if there was
+	// none.
+	UnregisterListener(name string) bool
+	// Listeners describes the listeners registered by name, with the events each dropped.
+	Listeners() []events.ListenerInfo
+	// SetEventAggregation rolls up the events of dynamic buckets to their namespace, for the
+	// namespaces chosen by the policy, as events for the bucket events.AggregatedBucket. Listeners
+	// and wait time histograms see the aggregated events; the stats listener and top tracker still
+	// see individual buckets.
+	SetEventAggregation(policy events.AggregationPolicy)
+	// SetEventSampling emits only one in N events.EVENT_TOKENS_SERVED events for each bucket of
+	// the namespaces chosen by the policy. Sampled events carry an events.Weight of N, which the
+	// built-in listeners scale their counts by.
+	SetEventSampling(policy events.SamplingPolicy)
+	// SetEventDropPolicy sets which events are dropped when the event buffer is full. Defaults to
+	// events.DropNewest.
+	SetEventDropPolicy(policy events.DropPolicy)
+	// EventsDropped returns the number of events dropped because the event buffer was full.
+	EventsDropped() uint64
 	SetStatsListener(listener stats.Listener)
+	// SetTopTracker sets a tracker of the busiest buckets, served by the admin API at
+	// /api/stats/top.
+	SetTopTracker(tracker *stats.TopTracker)
+	// SetWaitTimeHistograms sets histograms recording the wait times imposed on requests served.
+	SetWaitTimeHistograms(histograms *stats.WaitTimeHistograms)
+	// SetRateTracker sets a tracker of the rates of requests granted and rejected per namespace,
+	// served by the admin API at /api/metrics/summary.
+	SetRateTracker(tracker *stats.RateTracker)
+	// SetEventBroadcaster sets a broadcaster of events to subscribers that come and go, such as
+	// clients of the admin API at /api/events/ws. Like a listener, it needs events queued.
+	SetEventBroadcaster(broadcaster *events.Broadcaster, eventQueueBufSize int)
+	// SetAuditSink sets where config changes made via the admin API, and versions detected in the
+	// config store however they were persisted, are recorded. Defaults to an in-memory sink
+	// retaining the most recent audit.DefaultMemorySinkSize entries.
+	SetAuditSink(sink audit.Sink)
+	// SetConfigActivationPollInterval sets how often a config persisted with a future activation
+	// time is checked for activation. Defaults to 1 second.
+	SetConfigActivationPollInterval(interval time.Duration)
+	// SetConfigStalenessThreshold reports the server degraded, through the admin API at
+	// /api/status and RPC endpoints' health checks, if no config change was observed and the
+	// persister didn't poll its store successfully within threshold. Persisters that don't
+	// implement config.PollReporter are only considered fresh for threshold after each change.
+	// Disabled by default.
+	SetConfigStalenessThreshold(threshold time.Duration)
+	// SetConfigDebounce waits until no config change was notified for quiet before applying the
+	// latest config, so a burst of changes, such as while editing through the admin API, is applied
+	// once rather than reconciling buckets for each. Changes that keep arriving are still applied
+	// after at most 10 quiet periods. Changes to fast-tracked namespaces are applied at once, without
+	// the debounce or reload jitter. Disabled by default.
+	SetConfigDebounce(quiet time.Duration)
+	// SetWaitJitter adds a random duration of up to maxJitter to the wait times of requests granted
+	// after waiting, so clients throttled at the same time don't all proceed at the same time. Wait
+	// times are never shortened. Disabled by default.
+	SetWaitJitter(maxJitter time.Duration)
+	// SetSharder forwards requests for dynamic buckets owned by another instance to it, so each
+	// dynamic bucket is only held by one instance of a cluster. Requests are served locally if the
+	// owner can't be reached.
+	SetSharder(sharder Sharder)
+	// SetDefaultNamespaceBehavior sets how requests for namespaces missing from the config are
+	// served. Defaults to DefaultNamespaceUseGlobalDefault.
+	SetDefaultNamespaceBehavior(behavior DefaultNamespaceBehavior)
+	// SetDedupeCache remembers the results of granted requests declaring a request ID, answering
+	// repeats of them within the cache's TTL with their original result rather than taking tokens
+	// again, so retried requests aren't charged twice. Use a dedupe.RedisCache to dedupe across
+	// instances. Disabled by default.
+	SetDedupeCache(cache dedupe.Cache)
+	// SetStartupPolicy sets how the server starts if the persister's config can't be read.
+	// Servers starting degraded report it in their config health until the config is read.
+	// Defaults to StartupFailClosed.
+	SetStartupPolicy(policy StartupPolicy)
+	// SetConfigSnapshot saves every config put in force to a local file at path, for
+	// StartupLastKnownGood to start with. Disabled by default.
+	SetConfigSnapshot(path string)
+	// SetDynamicBucketMemoryBudget rejects configs persisted through the server whose dynamic
+	// buckets could use more than maxBytes of memory if every namespace created as many as it
+	// allows, estimating the memory of a bucket from the BucketFactory. Disabled by default.
+	SetDynamicBucketMemoryBudget(maxBytes int64)
+	// DumpBucketState serializes the configs and balances of every active bucket, as portable JSON
+	// for LoadBucketState, e.g. to replay throttling seen in production locally. Unlike memory
+	// bucket snapshots, dumps are taken on demand and include every bucket. Buckets that don't
+	// implement StatefulBucket are dumped without a balance.
+	DumpBucketState() ([]byte, error)
+	// LoadBucketState sets the balances of the server's buckets from a dump by DumpBucketState,
+	// creating the dynamic buckets dumped. Buckets keep their own configs.
+	LoadBucketState(state []byte) error
+	// BucketWaiters calls fn with the number of requests granted waits that haven't passed, for
+	// every active bucket, as visited by ForEachBucket. It implements metrics.WaitersReporter.
+	BucketWaiters(fn func(namespace, bucket string, dynamic bool, waiters int64))
+	// BucketSaturation calls fn with the fraction of recent time each active bucket had no tokens
+	// available, for the buckets whose implementation reports it, as visited by ForEachBucket. It
+	// implements metrics.SaturationReporter.
+	BucketSaturation(fn func(namespace, bucket string, dynamic bool, saturation float64))
 	GetServerAdministrable() admin.Administrable
 }
 
+// DefaultNamespaceBehavior decides how requests for namespaces missing from the config are served,
+// letting operators choose whether unmatched traffic fails open or closed. Either way, each such
+// request emits an EVENT_UNKNOWN_NAMESPACE, so misrouted traffic can be noticed.
+type DefaultNamespaceBehavior int
+
+const (
+	// DefaultNamespaceUseGlobalDefault serves requests for unknown namespaces from the global
+	// default bucket, rejecting them with ER_UNKNOWN_NAMESPACE if there is none.
+	DefaultNamespaceUseGlobalDefault DefaultNamespaceBehavior = iota
+
+	// DefaultNamespaceReject rejects requests for unknown namespaces with ER_UNKNOWN_NAMESPACE, even
+	// if there is a global default bucket.
+	DefaultNamespaceReject
+
+	// DefaultNamespaceAllowAll grants requests for unknown namespaces without taking tokens, as in
+	// disabled namespaces.
+	DefaultNamespaceAllowAll
+)
+
 // NewWithDefaultConfig creates a new quotaservice server with an empty in-memory config and default reaper.
 func NewWithDefaultConfig(bucketFactory BucketFactory, rpcEndpoints ...RpcEndpoint) Server {
 	return New(bucketFactory,
@@ -44,6 +173,11 @@ func New(bucketFactory BucketFactory, persister config.ConfigPersister, reaperCo
 		bucketFactory:   bucketFactory,
 		rpcEndpoints:    rpcEndpoints,
 		maxJitterMillis: maxCfgReloadJitterMs,
-		reaperConfig:    reaperConfig}
+		reaperConfig:    reaperConfig,
+		configChanges:   config.NewConfigChangeBroadcaster(),
+		listeners:       events.NewListenerRegistry(),
+		now:             time.Now,
+		auditSink:       audit.NewMemorySink(0),
+		selfPersisted:   make(map[int32]bool)}
 	return s
 }
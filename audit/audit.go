@@ -0,0 +1,150 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+// Package audit records who changed the quotaservice config, and when.
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// DefaultMemorySinkSize is the number of entries retained by a MemorySink created with a size of 0.
+const DefaultMemorySinkSize = 1000
+
+// DetectedNote is the note of entries recording versions detected in the config store, however
+// they were persisted, rather than persisted through the admin API.
+const DetectedNote = "detected in the config store"
+
+// ErrListingUnsupported is returned when listing entries from a Sink that doesn't implement Reader.
+var ErrListingUnsupported = errors.New("audit log sink does not support listing entries")
+
+// Entry is a single record in the audit log.
+type Entry struct {
+	Time       time.Time `json:"time"`
+	Principal  string    `json:"principal"`
+	OldVersion int32     `json:"oldVersion"`
+	NewVersion int32     `json:"newVersion"`
+	Summary    string    `json:"summary"`
+	// Note describes the change further, e.g. the source version of a rollback.
+	Note string `json:"note,omitempty"`
+	// Error is set if persisting the change failed.
+	Error string `json:"error,omitempty"`
+}
+
+// Sink stores audit log entries. Implementations must be safe for concurrent use.
+type Sink interface {
+	Write(e *Entry) error
+}
+
+// Reader is implemented by sinks that can list the entries written to them.
+type Reader interface {
+	// Read returns up to limit entries, newest first, skipping the newest offset entries, along
+	// with the total number of entries.
+	Read(offset, limit int) (entries []*Entry, total int, err error)
+}
+
+// List reads entries from a sink, returning ErrListingUnsupported if it doesn't implement Reader.
+func List(s Sink, offset, limit int) ([]*Entry, int, error) {
+	r, ok := s.(Reader)
+	if !ok {
+		return nil, 0, ErrListingUnsupported
+	}
+
+	return r.Read(offset, limit)
+}
+
+// MemorySink retains the most recent entries in memory.
+type MemorySink struct {
+	size    int
+	entries []*Entry
+	sync.RWMutex
+}
+
+// NewMemorySink creates a MemorySink retaining up to size entries, or DefaultMemorySinkSize if size
+// is 0.
+func NewMemorySink(size int) *MemorySink {
+	if size <= 0 {
+		size = DefaultMemorySinkSize
+	}
+
+	return &MemorySink{size: size}
+}
+
+func (m *MemorySink) Write(e *Entry) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.entries = append(m.entries, e)
+	if len(m.entries) > m.size {
+		m.entries = m.entries[len(m.entries)-m.size:]
+	}
+
+	return nil
+}
+
+func (m *MemorySink) Read(offset, limit int) ([]*Entry, int, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	return newestFirst(m.entries, offset, limit), len(m.entries), nil
+}
+
+// newestFirst pages through entries stored oldest first.
+func newestFirst(entries []*Entry, offset, limit int) []*Entry {
+	page := make([]*Entry, 0)
+	for i := len(entries) - 1 - offset; i >= 0 && len(page) < limit; i-- {
+		page = append(page, entries[i])
+	}
+
+	return page
+}
+
+type writerSink struct {
+	enc *json.Encoder
+	sync.Mutex
+}
+
+// NewWriterSink creates a Sink writing entries to w as JSON, one per line. Entries can't be listed.
+func NewWriterSink(w io.Writer) Sink {
+	return &writerSink{enc: json.NewEncoder(w)}
+}
+
+func (w *writerSink) Write(e *Entry) error {
+	w.Lock()
+	defer w.Unlock()
+
+	return w.enc.Encode(e)
+}
+
+type multiSink []Sink
+
+// NewMultiSink creates a Sink writing entries to each of the given sinks, and listing them from the
+// first that implements Reader.
+func NewMultiSink(sinks ...Sink) Sink {
+	return multiSink(sinks)
+}
+
+func (m multiSink) Write(e *Entry) error {
+	var firstErr error
+	for _, s := range m {
+		if err := s.Write(e); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+func (m multiSink) Read(offset, limit int) ([]*Entry, int, error) {
+	for _, s := range m {
+		if r, ok := s.(Reader); ok {
+			return r.Read(offset, limit)
+		}
+	}
+
+	return nil, 0, ErrListingUnsupported
+}
@@ -0,0 +1,113 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/square/quotaservice/test/helpers"
+)
+
+func writeEntries(t *testing.T, s Sink, n int) {
+	for i := 0; i < n; i++ {
+		helpers.CheckError(t, s.Write(&Entry{
+			Time:       time.Unix(int64(i), 0),
+			Principal:  "alice",
+			OldVersion: int32(i),
+			NewVersion: int32(i + 1)}))
+	}
+}
+
+func checkPage(t *testing.T, r Reader, offset, limit, expectedTotal int, expectedVersions ...int32) {
+	t.Helper()
+
+	entries, total, err := r.Read(offset, limit)
+	helpers.CheckError(t, err)
+
+	if total != expectedTotal {
+		t.Errorf("Expected %v entries in total, got %v", expectedTotal, total)
+	}
+
+	if len(entries) != len(expectedVersions) {
+		t.Fatalf("Expected %v entries, got %+v", len(expectedVersions), entries)
+	}
+
+	for i, e := range entries {
+		if e.NewVersion != expectedVersions[i] {
+			t.Errorf("Expected entry %v to have version %v, got %+v", i, expectedVersions[i], e)
+		}
+	}
+}
+
+func TestMemorySink(t *testing.T) {
+	s := NewMemorySink(3)
+	writeEntries(t, s, 5)
+
+	checkPage(t, s, 0, 10, 3, 5, 4, 3)
+	checkPage(t, s, 1, 1, 3, 4)
+	checkPage(t, s, 5, 1, 3)
+}
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	helpers.CheckError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	path := filepath.Join(dir, "audit.log")
+	s, err := NewFileSink(path)
+	helpers.CheckError(t, err)
+	writeEntries(t, s, 3)
+
+	// Reopening appends
+	s, err = NewFileSink(path)
+	helpers.CheckError(t, err)
+	writeEntries(t, s, 1)
+
+	checkPage(t, s, 0, 10, 4, 1, 3, 2, 1)
+	checkPage(t, s, 1, 2, 4, 3, 2)
+}
+
+func TestWriterSink(t *testing.T) {
+	b := &bytes.Buffer{}
+	s := NewWriterSink(b)
+	writeEntries(t, s, 2)
+
+	decoder := json.NewDecoder(b)
+	for i := int32(1); i <= 2; i++ {
+		e := &Entry{}
+		helpers.CheckError(t, decoder.Decode(e))
+
+		if e.NewVersion != i {
+			t.Errorf("Expected version %v, got %+v", i, e)
+		}
+	}
+
+	if _, _, err := List(s, 0, 10); err != ErrListingUnsupported {
+		t.Errorf("Expected ErrListingUnsupported, got %v", err)
+	}
+}
+
+func TestMultiSink(t *testing.T) {
+	b := &bytes.Buffer{}
+	m := NewMemorySink(0)
+	s := NewMultiSink(NewWriterSink(b), m)
+	writeEntries(t, s, 2)
+
+	if b.Len() == 0 {
+		t.Error("Expected entries to be written to the writer")
+	}
+
+	entries, total, err := List(s, 0, 10)
+	helpers.CheckError(t, err)
+
+	if total != 2 || len(entries) != 2 {
+		t.Errorf("Expected entries to be listed from the memory sink, got %+v", entries)
+	}
+}
@@ -0,0 +1,91 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// FileSink appends entries to a file as JSON, one per line.
+type FileSink struct {
+	path string
+	sync.Mutex
+}
+
+// NewFileSink creates a FileSink appending to the file at path, creating it if necessary.
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	return &FileSink{path: path}, nil
+}
+
+func (f *FileSink) Write(e *Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(append(b, '\n')); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	// Sync, so entries survive a crash.
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// Read reads the whole file, so is intended for modestly sized logs.
+func (f *FileSink) Read(offset, limit int) ([]*Entry, int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer func() { _ = file.Close() }()
+
+	var entries []*Entry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		e := &Entry{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			return nil, 0, err
+		}
+
+		entries = append(entries, e)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return newestFirst(entries, offset, limit), len(entries), nil
+}
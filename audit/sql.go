@@ -0,0 +1,82 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package audit
+
+import (
+	"database/sql"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+// SQLSink stores entries in a database table, e.g. alongside configs persisted by the MySQL
+// persister. The table must have the columns:
+//
+//	Time BIGINT (nanos since the epoch), Principal VARCHAR, OldVersion INT, NewVersion INT,
+//	Summary TEXT, Note TEXT, Error TEXT
+type SQLSink struct {
+	db    *sql.DB
+	table string
+}
+
+// NewSQLSink creates a SQLSink storing entries in the given table.
+func NewSQLSink(db *sql.DB, table string) *SQLSink {
+	return &SQLSink{db: db, table: table}
+}
+
+func (s *SQLSink) Write(e *Entry) error {
+	q, args, err := sq.Insert(s.table).
+		Columns("Time", "Principal", "OldVersion", "NewVersion", "Summary", "Note", "Error").
+		Values(e.Time.UnixNano(), e.Principal, e.OldVersion, e.NewVersion, e.Summary, e.Note, e.Error).
+		ToSql()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(q, args...)
+	return err
+}
+
+func (s *SQLSink) Read(offset, limit int) ([]*Entry, int, error) {
+	var total int
+	q, args, err := sq.Select("COUNT(*)").From(s.table).ToSql()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err := s.db.QueryRow(q, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	q, args, err = sq.Select("Time", "Principal", "OldVersion", "NewVersion", "Summary", "Note", "Error").
+		From(s.table).
+		OrderBy("Time DESC").
+		Limit(uint64(limit)).
+		Offset(uint64(offset)).
+		ToSql()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.Query(q, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer func() { _ = rows.Close() }()
+
+	entries := make([]*Entry, 0)
+	for rows.Next() {
+		var nanos int64
+		e := &Entry{}
+		if err := rows.Scan(&nanos, &e.Principal, &e.OldVersion, &e.NewVersion, &e.Summary, &e.Note, &e.Error); err != nil {
+			return nil, 0, err
+		}
+
+		e.Time = time.Unix(0, nanos)
+		entries = append(entries, e)
+	}
+
+	return entries, total, rows.Err()
+}
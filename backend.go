@@ -0,0 +1,154 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package quotaservice
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/square/quotaservice/events"
+	"github.com/square/quotaservice/logging"
+	pbconfig "github.com/square/quotaservice/protos/config"
+)
+
+// BackendProvider is implemented by BucketFactories that create the buckets of each namespace with
+// the backend its config selects, to check configs only select backends that are configured.
+type BackendProvider interface {
+	// Backends returns the names of the backends configured.
+	Backends() []string
+}
+
+// BackendBucketFactory is a BucketFactory creating the buckets of each namespace with the factory
+// of the backend selected by the namespace's config, such as config.BackendRedis for namespaces
+// needing limits shared across instances and config.BackendMemory for those fine with limits per
+// instance. Namespaces that don't select a backend, and the global default bucket, use the default
+// backend's factory. Custom bucket implementations are plugged in the same way as the built-in
+// ones, as the factory of a backend of their own, named as namespaces select them.
+type BackendBucketFactory struct {
+	defaultBackend string
+	factories      map[string]BucketFactory
+	namespaces     map[string]string
+	sync.RWMutex
+}
+
+// NewBackendBucketFactory creates a BackendBucketFactory from the factories of the backends
+// configured, keyed by backend name. defaultBackend must be one of them.
+func NewBackendBucketFactory(defaultBackend string, factories map[string]BucketFactory) *BackendBucketFactory {
+	if factories[defaultBackend] == nil {
+		panic("The default backend " + defaultBackend + " has no bucket factory")
+	}
+
+	bf := &BackendBucketFactory{
+		defaultBackend: defaultBackend,
+		factories:      make(map[string]BucketFactory, len(factories)),
+		namespaces:     make(map[string]string)}
+
+	for name, factory := range factories {
+		bf.factories[name] = factory
+	}
+
+	return bf
+}
+
+// Register adds the factory of a backend, such as a custom bucket implementation, selected by the
+// namespaces whose backend is name. Panics if a backend with that name is already configured.
+// Backends must be registered before the factory is passed to New.
+func (bf *BackendBucketFactory) Register(name string, factory BucketFactory) {
+	if name == "" || factory == nil {
+		panic("A backend needs a name and a bucket factory")
+	}
+
+	if bf.factories[name] != nil {
+		panic("Backend " + name + " is already configured")
+	}
+
+	bf.factories[name] = factory
+}
+
+// Init initializes the factory of every backend, and records the backend of each namespace.
+func (bf *BackendBucketFactory) Init(cfg *pbconfig.ServiceConfig) {
+	namespaces := make(map[string]string, len(cfg.Namespaces))
+	for name, ns := range cfg.Namespaces {
+		if ns.Backend == "" {
+			continue
+		}
+
+		if bf.factories[ns.Backend] == nil {
+			logging.Printf("Namespace %v selects backend %v, which isn't configured. Using %v instead.",
+				name, ns.Backend, bf.defaultBackend)
+			continue
+		}
+
+		namespaces[name] = ns.Backend
+	}
+
+	bf.Lock()
+	bf.namespaces = namespaces
+	bf.Unlock()
+
+	for _, f := range bf.factories {
+		f.Init(cfg)
+	}
+}
+
+// factory returns the factory of a namespace's backend.
+func (bf *BackendBucketFactory) factory(namespace string) BucketFactory {
+	bf.RLock()
+	backend, ok := bf.namespaces[namespace]
+	bf.RUnlock()
+
+	if !ok {
+		backend = bf.defaultBackend
+	}
+
+	return bf.factories[backend]
+}
+
+// NewBucket creates a bucket with the factory of its namespace's backend.
+func (bf *BackendBucketFactory) NewBucket(namespace, bucketName string, cfg *pbconfig.BucketConfig, dyn bool) Bucket {
+	return bf.factory(namespace).NewBucket(namespace, bucketName, cfg, dyn)
+}
+
+// Client returns the client of the default backend.
+func (bf *BackendBucketFactory) Client() interface{} {
+	return bf.factories[bf.defaultBackend].Client()
+}
+
+// Backends returns the names of the backends configured, sorted.
+func (bf *BackendBucketFactory) Backends() []string {
+	backends := make([]string, 0, len(bf.factories))
+	for backend := range bf.factories {
+		backends = append(backends, backend)
+	}
+
+	sort.Strings(backends)
+	return backends
+}
+
+// SetEventEmitter sets the event emitter of every backend's factory that is an EventEmitter.
+func (bf *BackendBucketFactory) SetEventEmitter(emit func(events.Event)) {
+	for _, f := range bf.factories {
+		if e, ok := f.(EventEmitter); ok {
+			e.SetEventEmitter(emit)
+		}
+	}
+}
+
+// BucketMemoryBytes returns the largest estimate of the backends' factories, so configs are checked
+// against a memory budget as if every dynamic bucket used the most memory a backend's bucket does.
+func (bf *BackendBucketFactory) BucketMemoryBytes() int64 {
+	var most int64
+	for _, f := range bf.factories {
+		bytes := int64(defaultBucketMemoryBytes)
+		if e, ok := f.(MemoryEstimator); ok {
+			bytes = e.BucketMemoryBytes()
+		}
+
+		if bytes > most {
+			most = bytes
+		}
+	}
+
+	return most
+}
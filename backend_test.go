@@ -0,0 +1,168 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package quotaservice
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/square/quotaservice/config"
+	pb "github.com/square/quotaservice/protos/config"
+	"github.com/square/quotaservice/test/helpers"
+)
+
+func backendTestConfig(backends map[string]string) *pb.ServiceConfig {
+	cfg := config.NewDefaultServiceConfig()
+	for name, backend := range backends {
+		ns := config.NewDefaultNamespaceConfig(name)
+		ns.Backend = backend
+		_ = config.AddBucket(ns, config.NewDefaultBucketConfig("b"))
+		_ = config.AddNamespace(cfg, ns)
+	}
+
+	return cfg
+}
+
+func TestBackendBucketFactory(t *testing.T) {
+	redis, memory := &MockBucketFactory{}, &MockBucketFactory{}
+	bf := NewBackendBucketFactory(config.BackendMemory, map[string]BucketFactory{
+		config.BackendRedis: redis, config.BackendMemory: memory})
+
+	cfg := backendTestConfig(map[string]string{"global": config.BackendRedis, "local": config.BackendMemory, "unset": ""})
+	s := New(bf, config.NewMemoryConfig(cfg), NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	for ns, factory := range map[string]*MockBucketFactory{"global": redis, "local": memory, "unset": memory} {
+		_, _, err := s.Allow(context.Background(), ns, "b", 2, 0, false)
+		helpers.CheckError(t, err)
+
+		if taken := factory.bucket(ns, "b").Taken; taken != 2 {
+			t.Errorf("Expected 2 tokens taken from %v's backend, got %v", ns, taken)
+		}
+	}
+
+	if _, exists := redis.buckets[config.FullyQualifiedName("local", "b")]; exists {
+		t.Error("Expected the memory namespace's buckets not to be created in Redis")
+	}
+
+	// Moving a namespace to another backend recreates its buckets there.
+	changes, unsubscribe := s.SubscribeConfigChanges(1)
+	defer unsubscribe()
+
+	moved := config.CloneConfig(s.Configs())
+	moved.Namespaces["local"].Backend = config.BackendRedis
+	_, err = s.PersistConfig(moved, "alice")
+	helpers.CheckError(t, err)
+	<-changes
+
+	_, _, err = s.Allow(context.Background(), "local", "b", 3, 0, false)
+	helpers.CheckError(t, err)
+
+	if taken := redis.bucket("local", "b").Taken; taken != 3 {
+		t.Errorf("Expected the moved namespace to take tokens from Redis, got %v", taken)
+	}
+}
+
+func TestBackendNotConfigured(t *testing.T) {
+	bf := NewBackendBucketFactory(config.BackendMemory, map[string]BucketFactory{config.BackendMemory: &MockBucketFactory{}})
+	s := New(bf, config.NewMemoryConfig(config.NewDefaultServiceConfig()), NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	cfg := backendTestConfig(map[string]string{"global": config.BackendRedis})
+	if _, err := s.PersistConfig(cfg, "alice"); err == nil {
+		t.Error("Expected a namespace selecting Redis without a Redis connection to be refused")
+	}
+}
+
+// grantingBucket is a custom bucket implementation granting every request, counting the tokens.
+type grantingBucket struct {
+	DefaultBucket
+	cfg     *pb.BucketConfig
+	dynamic bool
+	granted int64
+}
+
+func (b *grantingBucket) Take(_ context.Context, numTokens int64, _ time.Duration) (time.Duration, bool, error) {
+	atomic.AddInt64(&b.granted, numTokens)
+	return 0, true, nil
+}
+
+func (b *grantingBucket) Config() *pb.BucketConfig {
+	return b.cfg
+}
+
+func (b *grantingBucket) Dynamic() bool {
+	return b.dynamic
+}
+
+type grantingBucketFactory struct {
+	sync.Mutex
+	buckets map[string]*grantingBucket
+}
+
+func (bf *grantingBucketFactory) Init(*pb.ServiceConfig) {}
+func (bf *grantingBucketFactory) Client() interface{}    { return nil }
+
+func (bf *grantingBucketFactory) NewBucket(namespace, bucketName string, cfg *pb.BucketConfig, dyn bool) Bucket {
+	bf.Lock()
+	defer bf.Unlock()
+
+	b := &grantingBucket{cfg: cfg, dynamic: dyn}
+	bf.buckets[config.FullyQualifiedName(namespace, bucketName)] = b
+	return b
+}
+
+func TestCustomBackend(t *testing.T) {
+	custom := &grantingBucketFactory{buckets: make(map[string]*grantingBucket)}
+	bf := NewBackendBucketFactory(config.BackendMemory, map[string]BucketFactory{config.BackendMemory: &MockBucketFactory{}})
+	bf.Register("granting", custom)
+
+	p := config.NewMemoryConfig(backendTestConfig(map[string]string{"custom": "granting"}))
+	s := New(bf, p, NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	_, _, err = s.Allow(context.Background(), "custom", "b", 5, 0, false)
+	helpers.CheckError(t, err)
+
+	custom.Lock()
+	b := custom.buckets[config.FullyQualifiedName("custom", "b")]
+	custom.Unlock()
+
+	if b == nil || atomic.LoadInt64(&b.granted) != 5 {
+		t.Fatalf("Expected 5 tokens granted by the custom backend, got %+v", b)
+	}
+
+	// Configs persisted elsewhere selecting a backend that isn't registered are refused once loaded.
+	unknown := backendTestConfig(map[string]string{"custom": "granting", "other": "unregistered"})
+	unknown.Version = s.Configs().Version + 1
+	helpers.CheckError(t, p.PersistAndNotify("", unknown))
+
+	if _, err := s.ReloadConfig(); err == nil {
+		t.Error("Expected a config selecting an unregistered backend to be refused")
+	}
+
+	if _, exists := s.Configs().Namespaces["other"]; exists {
+		t.Error("Expected the refused config not to be applied")
+	}
+}
+
+func TestRegisterConfiguredBackend(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected registering a backend twice to panic")
+		}
+	}()
+
+	bf := NewBackendBucketFactory(config.BackendMemory, map[string]BucketFactory{config.BackendMemory: &MockBucketFactory{}})
+	bf.Register(config.BackendMemory, &MockBucketFactory{})
+}
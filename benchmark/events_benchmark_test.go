@@ -0,0 +1,75 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package benchmark
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/square/quotaservice"
+	"github.com/square/quotaservice/config"
+	"github.com/square/quotaservice/events"
+)
+
+// BenchmarkAllowWithStalledListener shows a listener that never returns doesn't block serving
+// tokens; once the event buffer fills, events are dropped instead.
+func BenchmarkAllowWithStalledListener(b *testing.B) {
+	release := make(chan struct{})
+	defer close(release)
+
+	endpoint := &quotaservice.MockEndpoint{}
+	s := quotaservice.New(&quotaservice.MockBucketFactory{}, config.NewMemoryConfig(benchmarkCfg),
+		config.NewReaperConfig(), 0, endpoint)
+	s.SetListener(func(events.Event) { <-release }, 100)
+
+	if _, err := s.Start(); err != nil {
+		b.Fatal(err)
+	}
+
+	defer func() { _, _ = s.Stop() }()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, _, err := endpoint.QuotaService.Allow(context.Background(), "y", "y", 1, 0, false); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.StopTimer()
+	if b.N > 100 && s.EventsDropped() == 0 {
+		b.Errorf("Expected events to be dropped")
+	}
+}
+
+// BenchmarkAllowHotBucketEvents shows the overhead of emitting an event for every request served
+// by a hot bucket, against sampling one in 100.
+func BenchmarkAllowHotBucketEvents(b *testing.B) {
+	for _, rate := range []int64{1, 100} {
+		b.Run(fmt.Sprintf("1in%d", rate), func(b *testing.B) {
+			endpoint := &quotaservice.MockEndpoint{}
+			s := quotaservice.New(&quotaservice.MockBucketFactory{}, config.NewMemoryConfig(benchmarkCfg),
+				config.NewReaperConfig(), 0, endpoint)
+			s.SetListener(func(events.Event) {}, 10000)
+			s.SetEventSampling(events.SampleNamespaces(map[string]int64{"y": rate}))
+
+			if _, err := s.Start(); err != nil {
+				b.Fatal(err)
+			}
+
+			defer func() { _, _ = s.Stop() }()
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, _, err := endpoint.QuotaService.Allow(context.Background(), "y", "y", 1, 0, false); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
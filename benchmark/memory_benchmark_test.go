@@ -0,0 +1,81 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package benchmark
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/square/quotaservice"
+	"github.com/square/quotaservice/buckets/memory"
+	"github.com/square/quotaservice/config"
+)
+
+var refillStrategies = []struct {
+	name string
+	opts memory.RefillOptions
+}{
+	{"lazy", memory.RefillOptions{Strategy: memory.RefillLazy}},
+	{"background", memory.RefillOptions{Strategy: memory.RefillBackground, Interval: time.Millisecond}},
+}
+
+func newRefillBucket(opts memory.RefillOptions, name string) quotaservice.Bucket {
+	f := memory.NewBucketFactoryWithRefill(opts)
+	f.Init(config.NewDefaultServiceConfig())
+
+	cfg := config.NewDefaultBucketConfig(name)
+	cfg.FillRate = 1000000
+
+	return f.NewBucket("memory", name, cfg, false)
+}
+
+// BenchmarkMemoryRefillHotBucket shows the allocations and contention of concurrent requests on a
+// single hot bucket refilling lazily or in the background.
+func BenchmarkMemoryRefillHotBucket(b *testing.B) {
+	for _, s := range refillStrategies {
+		b.Run(s.name, func(b *testing.B) {
+			bucket := newRefillBucket(s.opts, "hot")
+			defer bucket.Destroy()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					_, _, _ = bucket.Take(context.Background(), 1, 0)
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkMemoryRefillManyBuckets shows the cost of serving a bucket while many others, drained
+// below their size, refill lazily or in the background.
+func BenchmarkMemoryRefillManyBuckets(b *testing.B) {
+	for _, s := range refillStrategies {
+		b.Run(s.name, func(b *testing.B) {
+			drained := make([]quotaservice.Bucket, 1000)
+			for i := range drained {
+				drained[i] = newRefillBucket(s.opts, fmt.Sprintf("drained.%d", i))
+				_, _, _ = drained[i].Take(context.Background(), 1, 0)
+			}
+
+			bucket := newRefillBucket(s.opts, "served")
+
+			defer func() {
+				bucket.Destroy()
+				for _, d := range drained {
+					d.Destroy()
+				}
+			}()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, _, _ = bucket.Take(context.Background(), 1, 0)
+			}
+		})
+	}
+}
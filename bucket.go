@@ -37,7 +37,8 @@ type namespace struct {
 	buckets            map[string]Bucket
 	dynamicBucketCount int32
 	defaultBucket      Bucket
-	sync.RWMutex       // Embedded mutex
+	limit              Bucket // nil unless the namespace has a namespace limit
+	sync.RWMutex              // Embedded mutex
 }
 
 type notifier interface {
@@ -62,6 +63,68 @@ type Bucket interface {
 	ReportActivity()
 }
 
+// Peeker is implemented by buckets that can report how many tokens they have available without
+// taking any.
+type Peeker interface {
+	// Peek returns the number of tokens that could be taken without waiting. This is negative if
+	// the bucket is in debt, i.e. tokens have been claimed ahead of their availability.
+	Peek(ctx context.Context) (int64, error)
+}
+
+// SaturationReporter is implemented by buckets that can report how saturated they are: the
+// fraction of recent time they had no tokens available.
+type SaturationReporter interface {
+	// Saturation returns the fraction, from 0 to 1, of the bucket's observation window during which
+	// it had no tokens available. The window is the implementation's, and no longer than the
+	// bucket's lifetime.
+	Saturation(ctx context.Context) (float64, error)
+}
+
+// Prober is implemented by buckets that can tell whether tokens would be granted, and after how
+// long, without taking them.
+type Prober interface {
+	// Probe returns what Take would for the bucket's current state, without changing it. The wait
+	// time is returned even if the tokens wouldn't be granted within maxWaitTime.
+	Probe(ctx context.Context, numTokens int64, maxWaitTime time.Duration) (waitTime time.Duration, success bool, err error)
+}
+
+// DeadlineTaker is implemented by buckets that can wait for tokens until a deadline rather than for
+// a duration, measuring the time left when the bucket handles the request rather than when it's
+// made.
+type DeadlineTaker interface {
+	// TakeUntil retrieves tokens like Take, succeeding only if the tokens become available by the
+	// deadline.
+	TakeUntil(ctx context.Context, numTokens int64, deadline time.Time) (waitTime time.Duration, success bool, err error)
+}
+
+// Returner is implemented by buckets that can take back tokens taken but left unused, such as those
+// taken from a namespace limit for a request its bucket then denied.
+type Returner interface {
+	// Return gives back tokens taken, settling any debt before adding them to the bucket's balance,
+	// up to its size.
+	Return(ctx context.Context, numTokens int64) error
+}
+
+// TakeUntil retrieves tokens from a bucket, succeeding only if they become available by the
+// deadline. Buckets that aren't DeadlineTakers wait for the time left before the deadline. With a
+// deadline in the past, tokens are only retrieved if available without waiting.
+func TakeUntil(ctx context.Context, b Bucket, numTokens int64, deadline time.Time) (time.Duration, bool, error) {
+	if d, ok := b.(DeadlineTaker); ok {
+		return d.TakeUntil(ctx, numTokens, deadline)
+	}
+
+	return b.Take(ctx, numTokens, MaxWaitUntil(deadline))
+}
+
+// MaxWaitUntil returns the time left before a deadline, or 0 if it has passed.
+func MaxWaitUntil(deadline time.Time) time.Duration {
+	if wait := time.Until(deadline); wait > 0 {
+		return wait
+	}
+
+	return 0
+}
+
 type DefaultBucket struct {
 }
 
@@ -83,7 +146,7 @@ func (ns *namespace) removeBucket(bucketName string) {
 		if bucket.Dynamic() {
 			ns.dynamicBucketCount--
 		}
-		ns.n.Emit(events.NewBucketRemovedEvent(ns.name, bucketName, bucket.Dynamic()))
+		ns.n.Emit(events.WithBucketConfigs(events.NewBucketRemovedEvent(ns.name, bucketName, bucket.Dynamic()), bucket.Config(), nil))
 		bucket.Destroy()
 	}
 }
@@ -93,10 +156,17 @@ func (ns *namespace) destroy() {
 	ns.Lock()
 	defer ns.Unlock()
 	if ns.defaultBucket != nil {
+		ns.n.Emit(events.WithBucketConfigs(events.NewBucketRemovedEvent(ns.name, config.DefaultBucketName, false), ns.defaultBucket.Config(), nil))
 		ns.defaultBucket.Destroy()
 	}
 
-	for _, bucket := range ns.buckets {
+	if ns.limit != nil {
+		ns.n.Emit(events.WithBucketConfigs(events.NewBucketRemovedEvent(ns.name, config.NamespaceLimitBucketName, false), ns.limit.Config(), nil))
+		ns.limit.Destroy()
+	}
+
+	for bucketName, bucket := range ns.buckets {
+		ns.n.Emit(events.WithBucketConfigs(events.NewBucketRemovedEvent(ns.name, bucketName, bucket.Dynamic()), bucket.Config(), nil))
 		bucket.Destroy()
 	}
 }
@@ -120,6 +190,28 @@ type BucketFactory interface {
 	Client() interface{}
 }
 
+// Reconfigurer is implemented by buckets that can carry their balance over to a bucket with a
+// changed config, so reloading the config doesn't reset it.
+type Reconfigurer interface {
+	// Reconfigure creates a bucket with a new config and the balance of this one, clamped to the
+	// new size, returning the number of tokens dropped by clamping. The caller destroys this bucket.
+	Reconfigure(cfg *pbconfig.BucketConfig) (b Bucket, clampedTokens int64)
+}
+
+// EventEmitter is implemented by BucketFactories with events of their own to emit, such as the
+// state of a circuit breaker guarding their backend.
+type EventEmitter interface {
+	// SetEventEmitter sets a function called with every event to emit.
+	SetEventEmitter(emit func(events.Event))
+}
+
+// MemoryEstimator is implemented by BucketFactories that can estimate the memory a bucket uses, to
+// check configs against a dynamic bucket memory budget.
+type MemoryEstimator interface {
+	// BucketMemoryBytes estimates the bytes of memory used by a single bucket.
+	BucketMemoryBytes() int64
+}
+
 // NewBucketContainer creates a new bucket container.
 func NewBucketContainer(bf BucketFactory, n notifier, r config.ReaperConfig) (bc *bucketContainer) {
 	bc = &bucketContainer{
@@ -163,7 +255,13 @@ func (bc *bucketContainer) initLocked(cfg *pbconfig.ServiceConfig) {
 func (bc *bucketContainer) createNamespaceLocked(nsCfg *pbconfig.NamespaceConfig) {
 	nsp := &namespace{n: bc.n, name: nsCfg.Name, cfg: nsCfg, buckets: make(map[string]Bucket)}
 	if nsCfg.DefaultBucket != nil {
-		nsp.defaultBucket = bc.bf.NewBucket(nsCfg.Name, config.DefaultBucketName, nsCfg.DefaultBucket, false)
+		defaultCfg := resolveBucketConfig(nsCfg, config.DefaultBucketName, nsCfg.DefaultBucket)
+		nsp.defaultBucket = newTrackedBucket(bc.bf.NewBucket(nsCfg.Name, config.DefaultBucketName, defaultCfg, false))
+	}
+
+	if nsCfg.NamespaceLimit != nil {
+		limitCfg := resolveBucketConfig(nsCfg, config.NamespaceLimitBucketName, nsCfg.NamespaceLimit)
+		nsp.limit = newTrackedBucket(bc.bf.NewBucket(nsCfg.Name, config.NamespaceLimitBucketName, limitCfg, false))
 	}
 
 	nsp.Lock()
@@ -176,8 +274,15 @@ func (bc *bucketContainer) createNamespaceLocked(nsCfg *pbconfig.NamespaceConfig
 	bc.namespaces[nsCfg.Name] = nsp
 }
 
+// resolveBucketConfig returns the config a bucket of a namespace is created with, cfg resolved for
+// a canary and scaled by the namespace's token scale.
+func resolveBucketConfig(nsCfg *pbconfig.NamespaceConfig, bucketName string, cfg *pbconfig.BucketConfig) *pbconfig.BucketConfig {
+	return config.ScaledBucketConfig(config.CanaryConfig(nsCfg.Name, bucketName, cfg), config.TokenScale(nsCfg))
+}
+
 func (bc *bucketContainer) createGlobalDefaultBucketLocked(cfg *pbconfig.BucketConfig) {
-	bc.defaultBucket = bc.bf.NewBucket(config.GlobalNamespace, config.DefaultBucketName, cfg, false)
+	cfg = config.CanaryConfig(config.GlobalNamespace, config.DefaultBucketName, cfg)
+	bc.defaultBucket = newTrackedBucket(bc.bf.NewBucket(config.GlobalNamespace, config.DefaultBucketName, cfg, false))
 }
 
 // FindBucket locates a bucket for a given name and namespace. If the namespace doesn't exist, and
@@ -267,7 +372,8 @@ func (bc *bucketContainer) countDynamicBuckets(namespace string) int32 {
 }
 
 func (bc *bucketContainer) createNewNamedBucketFromCfg(namespace, bucketName string, ns *namespace, bCfg *pbconfig.BucketConfig, dyn bool) Bucket {
-	bc.n.Emit(events.NewBucketCreatedEvent(namespace, bucketName, dyn))
+	bCfg = resolveBucketConfig(ns.cfg, bucketName, bCfg)
+
 	var bucket Bucket
 	bucket = bc.bf.NewBucket(namespace, bucketName, bCfg, dyn)
 
@@ -276,6 +382,8 @@ func (bc *bucketContainer) createNewNamedBucketFromCfg(namespace, bucketName str
 		return nil
 	}
 
+	bucket = newTrackedBucket(bucket)
+
 	if dyn {
 		// Apply a watcher if a bucket is dynamic. We don't expire
 		// static buckets since FindBucket won't create a new bucket
@@ -287,10 +395,159 @@ func (bc *bucketContainer) createNewNamedBucketFromCfg(namespace, bucketName str
 	}
 	ns.buckets[bucketName] = bucket
 
+	if dyn {
+		// Static buckets are created as configs are loaded, so only dynamic ones are reported.
+		bc.n.Emit(events.WithBucketConfigs(events.NewBucketCreatedEvent(namespace, bucketName, true), nil, bCfg))
+	}
+
 	bucket.ReportActivity()
 	return bucket
 }
 
+// reconcileNamespaceLocked applies a changed config to an existing namespace in place. Buckets
+// whose config is unchanged are kept as they are, buckets whose config changed are reconfigured,
+// and only buckets no longer configured are destroyed. Dynamic buckets follow the dynamic bucket
+// template, and are only destroyed if it's removed.
+func (bc *bucketContainer) reconcileNamespaceLocked(ns *namespace, newCfg *pbconfig.NamespaceConfig) {
+	ns.Lock()
+	defer ns.Unlock()
+
+	ns.cfg = newCfg
+	ns.defaultBucket = bc.reconcileSingletonBucket(ns.name, config.DefaultBucketName, ns.defaultBucket,
+		resolveBucketConfig(newCfg, config.DefaultBucketName, newCfg.DefaultBucket))
+	ns.limit = bc.reconcileSingletonBucket(ns.name, config.NamespaceLimitBucketName, ns.limit,
+		resolveBucketConfig(newCfg, config.NamespaceLimitBucketName, newCfg.NamespaceLimit))
+
+	bucketNames := make([]string, 0, len(ns.buckets))
+	for bucketName := range ns.buckets {
+		bucketNames = append(bucketNames, bucketName)
+	}
+
+	for _, bucketName := range bucketNames {
+		bucket := ns.buckets[bucketName]
+		dyn := bucket.Dynamic()
+
+		bCfg := newCfg.Buckets[bucketName]
+		if dyn && bCfg == nil {
+			bCfg = newCfg.DynamicBucketTemplate
+		}
+
+		// Buckets are configured with their config as resolved for a canary and scaled.
+		resolved := resolveBucketConfig(newCfg, bucketName, bCfg)
+
+		switch {
+		case bCfg == nil || (dyn && newCfg.Buckets[bucketName] != nil):
+			// Removed, or replaced with a statically configured bucket created below.
+			delete(ns.buckets, bucketName)
+			if dyn {
+				ns.dynamicBucketCount--
+			}
+
+			bc.n.Emit(events.WithBucketConfigs(events.NewBucketRemovedEvent(ns.name, bucketName, dyn), bucket.Config(), nil))
+			bucket.Destroy()
+		case config.DifferentBucketConfigs(bucket.Config(), resolved):
+			ns.buckets[bucketName] = bc.reconfigureNamedBucket(ns.name, bucketName, bucket, resolved)
+		}
+	}
+
+	for bucketName, bCfg := range newCfg.Buckets {
+		if _, exists := ns.buckets[bucketName]; !exists {
+			// Buckets added to a namespace by a config change are reported with it.
+			if bucket := bc.createNewNamedBucketFromCfg(ns.name, bucketName, ns, bCfg, false); bucket != nil {
+				bc.n.Emit(events.WithBucketConfigs(events.NewBucketCreatedEvent(ns.name, bucketName, false), nil, bucket.Config()))
+			}
+		}
+	}
+}
+
+// reconcileSingletonBucket returns the default bucket or namespace limit to use for a namespace once
+// its config is changed to cfg, as resolved for the bucket, destroying the existing bucket if it's
+// replaced.
+func (bc *bucketContainer) reconcileSingletonBucket(namespace, bucketName string, existing Bucket, cfg *pbconfig.BucketConfig) Bucket {
+	var existingCfg *pbconfig.BucketConfig
+	if existing != nil {
+		existingCfg = existing.Config()
+	}
+
+	switch {
+	case !config.DifferentBucketConfigs(existingCfg, cfg):
+		return existing
+	case cfg == nil:
+		bc.n.Emit(events.WithBucketConfigs(events.NewBucketRemovedEvent(namespace, bucketName, false), existingCfg, nil))
+		existing.Destroy()
+		return nil
+	case existing == nil:
+		return newTrackedBucket(bc.bf.NewBucket(namespace, bucketName, cfg, false))
+	default:
+		return newTrackedBucket(bc.reconfigureBucket(namespace, bucketName, existing, cfg))
+	}
+}
+
+// reconfigureNamedBucket replaces a named bucket in a namespace with one reconfigured with cfg. A
+// dynamic bucket keeps being watched by the reaper, with the new config's max idle time and
+// eviction grace period.
+func (bc *bucketContainer) reconfigureNamedBucket(namespace, bucketName string, existing Bucket, cfg *pbconfig.BucketConfig) Bucket {
+	maxIdleChanged := existing.Config().MaxIdleMillis != cfg.MaxIdleMillis ||
+		existing.Config().EvictionGraceMillis != cfg.EvictionGraceMillis
+
+	var bucket Bucket
+	bucket = newTrackedBucket(bc.reconfigureBucket(namespace, bucketName, existing, cfg))
+
+	if !existing.Dynamic() {
+		return bucket
+	}
+
+	rb, watched := existing.(*reapableBucket)
+	if watched && !maxIdleChanged {
+		// Keep reporting activity to the existing watcher.
+		return &reapableBucket{Bucket: bucket, activities: rb.activities}
+	}
+
+	if watched {
+		close(rb.activities)
+	}
+
+	bucket, _ = bc.r.applyWatch(bucket, namespace, bucketName, cfg)
+	return bucket
+}
+
+// reconfigureBucket creates a bucket with a changed config, carrying over the balance of the
+// existing bucket if its implementation is a Reconfigurer, and destroys the existing bucket's
+// implementation. Wrappers of the existing bucket are left to the caller.
+func (bc *bucketContainer) reconfigureBucket(namespace, bucketName string, existing Bucket, cfg *pbconfig.BucketConfig) Bucket {
+	bc.n.Emit(events.NewBucketModifiedEvent(namespace, bucketName, existing.Dynamic(), existing.Config(), cfg))
+
+	_, delegate := unwrapBucket(existing)
+	defer delegate.Destroy()
+
+	if r, ok := delegate.(Reconfigurer); ok {
+		bucket, clampedTokens := r.Reconfigure(cfg)
+		if clampedTokens > 0 {
+			bc.n.Emit(events.NewBucketClampedEvent(namespace, bucketName, existing.Dynamic(), clampedTokens))
+		}
+
+		return bucket
+	}
+
+	return bc.bf.NewBucket(namespace, bucketName, cfg, existing.Dynamic())
+}
+
+// NamespaceLimit returns the namespace limit of a namespace, or nil if it has none.
+func (bc *bucketContainer) NamespaceLimit(namespace string) Bucket {
+	bc.RLock()
+	defer bc.RUnlock()
+
+	ns := bc.namespaces[namespace]
+	if ns == nil {
+		return nil
+	}
+
+	ns.RLock()
+	defer ns.RUnlock()
+
+	return ns.limit
+}
+
 func (bc *bucketContainer) NamespaceExists(namespace string) bool {
 	bc.RLock()
 	defer bc.RUnlock()
@@ -5,10 +5,16 @@
 package quotaservice
 
 import (
+	"context"
+	"fmt"
+	"reflect"
 	"strconv"
+	"sync"
 	"testing"
 
+	"github.com/square/quotaservice/admin"
 	"github.com/square/quotaservice/config"
+	"github.com/square/quotaservice/events"
 	"github.com/square/quotaservice/test/helpers"
 
 	"runtime"
@@ -139,3 +145,265 @@ func TestMaxDynamic(t *testing.T) {
 		t.Fatal("Should not have created dynamic bucket z:should_fail")
 	}
 }
+
+func TestDynamicBucketCreatedEvent(t *testing.T) {
+	cfg := config.NewDefaultServiceConfig()
+	ns := config.NewDefaultNamespaceConfig("dyn")
+	config.SetDynamicBucketTemplate(ns, config.NewDefaultBucketConfig(""))
+	helpers.CheckError(t, config.AddNamespace(cfg, ns))
+
+	bc, _, e := NewBucketContainerWithMocks(cfg)
+	e.Events = make(chan events.Event, 100)
+
+	// Concurrent requests for the same new names each create the bucket once.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, name := range []string{"a", "b", "c"} {
+				if b, _ := bc.FindBucket("dyn", name); b == nil {
+					t.Errorf("Expected bucket %v to be created", name)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(e.Events)
+
+	created := make(map[string]int)
+	for evt := range e.Events {
+		if evt.EventType() != events.EVENT_BUCKET_CREATED || evt.Namespace() != "dyn" || !evt.Dynamic() {
+			t.Errorf("Unexpected event %v", evt)
+		}
+
+		created[evt.BucketName()]++
+	}
+
+	if !reflect.DeepEqual(created, map[string]int{"a": 1, "b": 1, "c": 1}) {
+		t.Errorf("Expected an event per new bucket, got %v", created)
+	}
+}
+
+func TestStaticBucketCreatedEvents(t *testing.T) {
+	cfg := config.NewDefaultServiceConfig()
+	cfg.Version = 1
+	ns := config.NewDefaultNamespaceConfig("static")
+	helpers.CheckError(t, config.AddBucket(ns, config.NewDefaultBucketConfig("loaded")))
+	helpers.CheckError(t, config.AddNamespace(cfg, ns))
+
+	e := &MockEmitter{Events: make(chan events.Event, 100)}
+	bc := NewBucketContainer(&MockBucketFactory{}, e, NewReaperConfigForTests())
+	bc.Init(cfg)
+
+	// Buckets the config is loaded with aren't reported as created, unlike those a change adds.
+	newCfg := config.CloneConfig(cfg)
+	newCfg.Version = 2
+	helpers.CheckError(t, config.AddBucket(newCfg.Namespaces["static"], config.NewDefaultBucketConfig("added")))
+	other := config.NewDefaultNamespaceConfig("other")
+	helpers.CheckError(t, config.AddBucket(other, config.NewDefaultBucketConfig("loaded")))
+	helpers.CheckError(t, config.AddNamespace(newCfg, other))
+
+	bc.Lock()
+	bc.reconcileNamespaceLocked(bc.namespaces["static"], newCfg.Namespaces["static"])
+	bc.createNamespaceLocked(newCfg.Namespaces["other"])
+	bc.Unlock()
+	close(e.Events)
+
+	var created []string
+	for evt := range e.Events {
+		if evt.EventType() == events.EVENT_BUCKET_CREATED {
+			created = append(created, config.FullyQualifiedName(evt.Namespace(), evt.BucketName()))
+		}
+	}
+
+	if !reflect.DeepEqual(created, []string{"static:added"}) {
+		t.Errorf("Expected only the bucket added by the change to be reported, got %v", created)
+	}
+}
+
+// failingBucketFactory fails to create any bucket.
+type failingBucketFactory struct {
+	MockBucketFactory
+}
+
+func (bf *failingBucketFactory) NewBucket(namespace, bucketName string, cfg *pbconfig.BucketConfig, dyn bool) Bucket {
+	return nil
+}
+
+func TestDynamicBucketCreatedEventNotEmittedOnFailure(t *testing.T) {
+	cfg := config.NewDefaultServiceConfig()
+	ns := config.NewDefaultNamespaceConfig("dyn")
+	config.SetDynamicBucketTemplate(ns, config.NewDefaultBucketConfig(""))
+	helpers.CheckError(t, config.AddNamespace(cfg, ns))
+
+	e := &MockEmitter{Events: make(chan events.Event, 100)}
+	bc := NewBucketContainer(&failingBucketFactory{}, e, NewReaperConfigForTests())
+	bc.Init(cfg)
+
+	if b, _ := bc.FindBucket("dyn", "a"); b != nil {
+		t.Fatal("Expected the bucket not to be created")
+	}
+
+	close(e.Events)
+	for evt := range e.Events {
+		if evt.EventType() == events.EVENT_BUCKET_CREATED {
+			t.Errorf("Unexpected event %v", evt)
+		}
+	}
+}
+
+func TestForEachBucket(t *testing.T) {
+	c := config.NewDefaultServiceConfig()
+	c.GlobalDefaultBucket = config.NewDefaultBucketConfig(config.DefaultBucketName)
+	for _, name := range []string{"b", "a"} {
+		ns := config.NewDefaultNamespaceConfig(name)
+		ns.DefaultBucket = config.NewDefaultBucketConfig(config.DefaultBucketName)
+		config.SetDynamicBucketTemplate(ns, config.NewDefaultBucketConfig(""))
+		helpers.PanicError(config.AddBucket(ns, config.NewDefaultBucketConfig("static")))
+		helpers.PanicError(config.AddNamespace(c, ns))
+	}
+
+	c.Namespaces["a"].NamespaceLimit = config.NewDefaultBucketConfig("")
+
+	bc, _, _ := NewBucketContainerWithMocks(c)
+	if b, _ := bc.FindBucket("a", "dynamic"); b == nil {
+		t.Fatal("Unable to create dynamic bucket a:dynamic")
+	}
+
+	var visited []string
+	bc.ForEachBucket(func(namespace, name string, b Bucket) bool {
+		visited = append(visited, config.FullyQualifiedName(namespace, name))
+		return true
+	})
+
+	expected := []string{
+		config.FullyQualifiedName(config.GlobalNamespace, config.DefaultBucketName),
+		config.FullyQualifiedName("a", config.DefaultBucketName),
+		config.FullyQualifiedName("a", config.NamespaceLimitBucketName),
+		"a:dynamic",
+		"a:static",
+		config.FullyQualifiedName("b", config.DefaultBucketName),
+		"b:static",
+	}
+
+	if !reflect.DeepEqual(visited, expected) {
+		t.Errorf("Expected to visit %v, got %v", expected, visited)
+	}
+
+	visited = nil
+	bc.ForEachBucket(func(namespace, name string, b Bucket) bool {
+		visited = append(visited, config.FullyQualifiedName(namespace, name))
+		return len(visited) < 3
+	})
+
+	if !reflect.DeepEqual(visited, expected[:3]) {
+		t.Errorf("Expected to stop after 3 buckets, got %v", visited)
+	}
+}
+
+func TestForEachBucketDuringAllows(t *testing.T) {
+	c := config.NewDefaultServiceConfig()
+	ns := config.NewDefaultNamespaceConfig("dyn")
+	config.SetDynamicBucketTemplate(ns, config.NewDefaultBucketConfig(""))
+	helpers.PanicError(config.AddNamespace(c, ns))
+
+	s := New(&MockBucketFactory{}, config.NewMemoryConfig(c), NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				if _, _, err := s.Allow(context.Background(), "dyn", fmt.Sprintf("b%v-%v", i, j%50), 1, 0, false); err != nil {
+					t.Errorf("Unexpected error %v", err)
+					return
+				}
+			}
+		}(i)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	// Visiting slowly doesn't hold up the requests creating buckets.
+	for iterating := true; iterating; {
+		select {
+		case <-done:
+			iterating = false
+		default:
+		}
+
+		s.bucketContainer.ForEachBucket(func(namespace, name string, b Bucket) bool {
+			runtime.Gosched()
+			return b.Config() != nil
+		})
+
+		_, _, err := s.InspectBuckets(10)
+		helpers.CheckError(t, err)
+	}
+
+	inspections, truncated, err := s.InspectBuckets(1000)
+	helpers.CheckError(t, err)
+	if len(inspections) != 200 || truncated {
+		t.Errorf("Expected all 200 dynamic buckets to be inspected, got %v", len(inspections))
+	}
+
+	if _, truncated, _ := s.InspectBuckets(10); !truncated {
+		t.Error("Expected inspecting 10 of 200 buckets to be truncated")
+	}
+}
+
+func TestDynamicBucketsPage(t *testing.T) {
+	c := config.NewDefaultServiceConfig()
+	ns := config.NewDefaultNamespaceConfig("d")
+	ns.DynamicBucketTemplate = config.NewDefaultBucketConfig(config.DefaultBucketName)
+	helpers.PanicError(config.AddBucket(ns, config.NewDefaultBucketConfig("static")))
+	helpers.PanicError(config.AddNamespace(c, ns))
+
+	bc, _, _ := NewBucketContainerWithMocks(c)
+	for _, name := range []string{"foo3", "bar", "foo1", "foo2", "static"} {
+		if b, _ := bc.FindBucket("d", name); b == nil {
+			t.Fatalf("Unable to find bucket %v", name)
+		}
+	}
+
+	names := func(page []*admin.DynamicBucket) []string {
+		n := make([]string, len(page))
+		for i, b := range page {
+			n[i] = b.Name
+		}
+		return n
+	}
+
+	page, total, exists := bc.dynamicBuckets("d", "", "", 10)
+	if !exists || total != 4 || !reflect.DeepEqual(names(page), []string{"bar", "foo1", "foo2", "foo3"}) {
+		t.Errorf("Expected all dynamic buckets, got %v of %v", names(page), total)
+	}
+
+	page, total, _ = bc.dynamicBuckets("d", "foo", "", 2)
+	if total != 3 || !reflect.DeepEqual(names(page), []string{"foo1", "foo2"}) {
+		t.Errorf("Expected the first page of foo buckets, got %v of %v", names(page), total)
+	}
+
+	page, _, _ = bc.dynamicBuckets("d", "foo", "foo2", 2)
+	if !reflect.DeepEqual(names(page), []string{"foo3"}) {
+		t.Errorf("Expected the last page of foo buckets, got %v", names(page))
+	}
+
+	if page[0].LastActivityMillis == 0 {
+		t.Errorf("Expected last activity to be reported, got %+v", page[0])
+	}
+
+	if _, _, exists := bc.dynamicBuckets("nonexistent", "", "", 10); exists {
+		t.Error("Expected an unknown namespace not to exist")
+	}
+}
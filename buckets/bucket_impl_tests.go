@@ -2,6 +2,7 @@ package buckets
 
 import (
 	"context"
+	"reflect"
 	"strconv"
 	"testing"
 	"time"
@@ -65,6 +66,280 @@ func TestTokenAcquisition(t *testing.T, bucket quotaservice.Bucket) {
 	}
 }
 
+// TestTakeUntil checks the bucket waits for tokens until a deadline, including one already past.
+func TestTakeUntil(t *testing.T, bucket quotaservice.Bucket) {
+	if _, ok := bucket.(quotaservice.DeadlineTaker); !ok {
+		t.Fatal("Expecting the bucket to be a DeadlineTaker.")
+	}
+
+	// With tokens available, a past deadline doesn't matter.
+	wait, s, err := quotaservice.TakeUntil(context.Background(), bucket, 1, time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatalf("expected a nil error, got %s", err)
+	}
+	if wait != 0 || !s {
+		t.Fatalf("Expecting success with 0 wait. Was %v, %v", wait, s)
+	}
+
+	// Consume all tokens, and claim some ahead of their availability.
+	wait, s, err = quotaservice.TakeUntil(context.Background(), bucket, 110, time.Now().Add(10*time.Second))
+	if err != nil {
+		t.Fatalf("expected a nil error, got %s", err)
+	}
+	if !s {
+		t.Fatal("Expecting success to be true.")
+	}
+
+	// Tokens are claimed ahead, so a deadline in the past times out...
+	wait, s, err = quotaservice.TakeUntil(context.Background(), bucket, 1, time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatalf("expected a nil error, got %s", err)
+	}
+	if wait != 0 || s {
+		t.Fatalf("Expecting a timeout with 0 wait. Was %v, %v", wait, s)
+	}
+
+	// ... as does one before the tokens are available...
+	wait, s, err = quotaservice.TakeUntil(context.Background(), bucket, 1, time.Now().Add(time.Millisecond))
+	if err != nil {
+		t.Fatalf("expected a nil error, got %s", err)
+	}
+	if s {
+		t.Fatal("Expecting success to be false.")
+	}
+
+	// ... but a later one waits.
+	wait, s, err = quotaservice.TakeUntil(context.Background(), bucket, 1, time.Now().Add(10*time.Second))
+	if err != nil {
+		t.Fatalf("expected a nil error, got %s", err)
+	}
+	if wait < 1 || wait > 10*time.Second || !s {
+		t.Fatalf("Expecting success with a positive wait time. Was %v, %v", wait, s)
+	}
+}
+
+// TestDebt checks a bucket configured with a size of 100, a fill rate of 50 per second and a max
+// debt of 50 serves tokens beyond those available without waiting until it is 50 tokens in debt.
+func TestDebt(t *testing.T, bucket quotaservice.Bucket) {
+	// Drain the bucket, then over-draw it by 40 tokens without waiting...
+	for _, requested := range []int64{100, 40, 20} {
+		wait, s, err := bucket.Take(context.Background(), requested, 0)
+		if err != nil {
+			t.Fatalf("expected a nil error, got %s", err)
+		}
+		if wait != 0 || !s {
+			t.Fatalf("Expecting to take %v tokens without waiting. Was %v, %v", requested, wait, s)
+		}
+	}
+
+	// ... and 20 more, leaving it 60 tokens in debt, past the max debt of 50.
+	wait, s, err := bucket.Take(context.Background(), 1, 0)
+	if err != nil {
+		t.Fatalf("expected a nil error, got %s", err)
+	}
+	if s {
+		t.Fatalf("Expecting a bucket past its max debt to reject a request that can't wait. Was %v, %v", wait, s)
+	}
+
+	// Requests that can wait, wait for the debt past the max to be repaid: 10 tokens, or 200ms.
+	wait, s, err = bucket.Take(context.Background(), 1, 10*time.Second)
+	if err != nil {
+		t.Fatalf("expected a nil error, got %s", err)
+	}
+	if !s || wait <= 0 || wait > 200*time.Millisecond {
+		t.Fatalf("Expecting success with a wait of at most 200ms. Was %v, %v", wait, s)
+	}
+}
+
+// TestTokenCap checks a bucket configured with the default config and a token cap of 150 serves
+// 150 tokens, waiting for those beyond its size, then rejects further requests, even those that
+// could wait, and probes for them, with a quotaservice.CapReachedError.
+func TestTokenCap(t *testing.T, bucket quotaservice.Bucket) {
+	for _, tc := range []struct {
+		requested   int64
+		maxWaitTime time.Duration
+	}{
+		{100, 0},
+		{50, 10 * time.Second},
+	} {
+		if _, s, err := bucket.Take(context.Background(), tc.requested, tc.maxWaitTime); err != nil || !s {
+			t.Fatalf("Expecting to take %v tokens within the cap. Was %v, %v", tc.requested, s, err)
+		}
+	}
+
+	_, s, err := bucket.Take(context.Background(), 1, 10*time.Second)
+	if capReached, ok := err.(*quotaservice.CapReachedError); s || !ok || capReached.TokenCap != 150 {
+		t.Fatalf("Expecting the cap of 150 tokens to be reached. Was %v, %v", s, err)
+	}
+
+	p, ok := bucket.(quotaservice.Prober)
+	if !ok {
+		t.Fatal("Expecting the bucket to be a Prober.")
+	}
+
+	if _, s, err := p.Probe(context.Background(), 1, 10*time.Second); s {
+		t.Fatalf("Expecting a probe past the cap to be rejected. Was %v, %v", s, err)
+	} else if _, ok := err.(*quotaservice.CapReachedError); !ok {
+		t.Fatalf("Expecting a probe past the cap to report it reached. Was %v", err)
+	}
+}
+
+// TestRateWindows checks a bucket configured with the default config and rate windows of 300 tokens
+// a minute and 120 an hour is governed by the tightest of them: once 120 tokens are taken, further
+// requests are rejected and probed as rejected, although the fill rate and the minute-long window
+// would grant them.
+func TestRateWindows(t *testing.T, bucket quotaservice.Bucket) {
+	for _, requested := range []int64{100, 20} {
+		if _, s, err := bucket.Take(context.Background(), requested, 0); err != nil || !s {
+			t.Fatalf("Expecting to take %v tokens within the windows. Was %v, %v", requested, s, err)
+		}
+	}
+
+	// The hourly window would be 30 seconds in debt, beyond the max debt of 10 seconds.
+	if w, s, err := bucket.Take(context.Background(), 1, 10*time.Second); err != nil || s {
+		t.Fatalf("Expecting the hourly window to reject the request. Was %v, %v, %v", w, s, err)
+	}
+
+	p, ok := bucket.(quotaservice.Prober)
+	if !ok {
+		t.Fatal("Expecting the bucket to be a Prober.")
+	}
+
+	if _, s, err := p.Probe(context.Background(), 1, 10*time.Second); err != nil || s {
+		t.Fatalf("Expecting a probe past the hourly window to be rejected. Was %v, %v", s, err)
+	}
+}
+
+// TestProbe checks a bucket with the default config predicts the outcome of the Take immediately
+// following each probe, without probing changing it.
+func TestProbe(t *testing.T, bucket quotaservice.Bucket) {
+	p, ok := bucket.(quotaservice.Prober)
+	if !ok {
+		t.Fatal("Expecting the bucket to be a Prober.")
+	}
+
+	for _, tc := range []struct {
+		requested   int64
+		maxWaitTime time.Duration
+		granted     bool
+	}{
+		// Drain the bucket, probing repeatedly first...
+		{100, 0, true},
+		// ... claim some tokens ahead of their availability...
+		{10, 0, true},
+		// ... which are then waited for by the next request, if it can wait.
+		{10, 0, false},
+		{10, 10 * time.Second, true},
+	} {
+		var probedWait time.Duration
+		for i := 0; i < 3; i++ {
+			wait, s, err := p.Probe(context.Background(), tc.requested, tc.maxWaitTime)
+			if err != nil {
+				t.Fatalf("expected a nil error, got %s", err)
+			}
+			if s != tc.granted {
+				t.Fatalf("Expecting a probe for %v tokens to predict success %v. Was %v, %v", tc.requested, tc.granted, wait, s)
+			}
+			probedWait = wait
+		}
+
+		wait, s, err := bucket.Take(context.Background(), tc.requested, tc.maxWaitTime)
+		if err != nil {
+			t.Fatalf("expected a nil error, got %s", err)
+		}
+		if s != tc.granted {
+			t.Fatalf("Expecting taking %v tokens to match the probe's success %v. Was %v, %v", tc.requested, tc.granted, wait, s)
+		}
+
+		// Takes that fail report no wait; otherwise the wait shrinks as time passes.
+		if s && (wait > probedWait || probedWait-wait > 100*time.Millisecond) {
+			t.Fatalf("Expecting taking %v tokens to wait about the %v probed. Was %v", tc.requested, probedWait, wait)
+		}
+
+		if !s && probedWait <= tc.maxWaitTime {
+			t.Fatalf("Expecting a probe for %v tokens to estimate a wait past %v. Was %v", tc.requested, tc.maxWaitTime, probedWait)
+		}
+	}
+
+	if _, _, err := p.Probe(context.Background(), 1e9, 0); err == nil {
+		t.Fatal("Expecting probing for more tokens than the bucket can serve to fail.")
+	}
+}
+
+// TestInspection runs a server using the given factory and checks the live state reported for its
+// buckets via the admin API.
+func TestInspection(t *testing.T, factory quotaservice.BucketFactory, impl string) {
+	cfg := config.NewDefaultServiceConfig()
+	nsCfg := config.NewDefaultNamespaceConfig("inspected")
+	static := config.NewDefaultBucketConfig("static")
+	static.FillRate = 1
+	helpers.CheckError(t, config.AddBucket(nsCfg, static))
+	config.SetDynamicBucketTemplate(nsCfg, config.NewDefaultBucketConfig(""))
+	helpers.CheckError(t, config.AddNamespace(cfg, nsCfg))
+
+	endpoint := &quotaservice.MockEndpoint{}
+	s := quotaservice.New(factory, config.NewMemoryConfig(cfg), quotaservice.NewReaperConfigForTests(), 0, endpoint)
+	if _, err := s.Start(); err != nil {
+		t.Fatalf("Unable to start server on impl %v: %v", impl, err)
+	}
+
+	defer func() { _, _ = s.Stop() }()
+
+	a := s.GetServerAdministrable()
+	before := time.Now()
+
+	for _, name := range []string{"static", "dyn1", "dyn2", "dyn3"} {
+		if _, _, err := endpoint.QuotaService.Allow(context.Background(), "inspected", name, 10, 0, false); err != nil {
+			t.Fatalf("Unable to take tokens from %v on impl %v: %v", name, impl, err)
+		}
+	}
+
+	inspection, err := a.InspectBucket("inspected", "static")
+	helpers.CheckError(t, err)
+
+	if inspection == nil {
+		t.Fatalf("Expected bucket static to be inspectable on impl %v", impl)
+	}
+
+	if inspection.Dynamic || inspection.Config.FillRate != 1 {
+		t.Errorf("Unexpected bucket inspected on impl %v: %+v", impl, inspection)
+	}
+
+	// With a fill rate of 1/s, no more than one token should be replenished during the test.
+	if inspection.AvailableTokens == nil || *inspection.AvailableTokens < 90 || *inspection.AvailableTokens > 91 {
+		t.Errorf("Expected 90 tokens to be available on impl %v, got %+v", impl, inspection)
+	}
+
+	if inspection.LastActivityMillis < before.UnixNano()/1e6 {
+		t.Errorf("Expected last activity after %v on impl %v, got %v", before, impl, inspection.LastActivityMillis)
+	}
+
+	if inspection.Activity.TokensServed != 10 || inspection.Activity.Timeouts != 0 {
+		t.Errorf("Unexpected activity on impl %v: %+v", impl, inspection.Activity)
+	}
+
+	// Inspecting an inactive dynamic bucket shouldn't create it.
+	inspection, err = a.InspectBucket("inspected", "dyn4")
+	helpers.CheckError(t, err)
+
+	if inspection != nil {
+		t.Errorf("Expected no inspection of an inactive bucket on impl %v, got %+v", impl, inspection)
+	}
+
+	dynamic, total, exists := a.DynamicBuckets("inspected", "dyn", "", 10)
+	names := make([]string, len(dynamic))
+	for i, b := range dynamic {
+		names[i] = b.Name
+		if b.LastActivityMillis < before.UnixNano()/1e6 {
+			t.Errorf("Expected last activity after %v on impl %v, got %+v", before, impl, b)
+		}
+	}
+
+	if !exists || total != 3 || !reflect.DeepEqual(names, []string{"dyn1", "dyn2", "dyn3"}) {
+		t.Errorf("Expected dynamic buckets dyn1-3 on impl %v, got %v", impl, names)
+	}
+}
+
 func TestGC(t *testing.T, factory quotaservice.BucketFactory, impl string) {
 	cfg := config.NewDefaultServiceConfig()
 	nsCfg := config.NewDefaultNamespaceConfig("n")
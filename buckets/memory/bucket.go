@@ -10,6 +10,7 @@ package memory
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	"github.com/square/quotaservice"
@@ -20,38 +21,104 @@ import (
 )
 
 type bucketFactory struct {
-	cfg *pbconfig.ServiceConfig
+	cfg            *pbconfig.ServiceConfig
+	snapshots      *snapshotter  // nil unless snapshotting
+	refillInterval time.Duration // 0 unless refilling in the background
+	now            func() time.Time
 }
 
 func (bf *bucketFactory) Init(cfg *pbconfig.ServiceConfig) {
 	bf.cfg = cfg
+
+	if bf.snapshots != nil {
+		bf.snapshots.start()
+	}
 }
 
 func (bf *bucketFactory) Client() interface{} {
 	return nil
 }
 
+// bucketMemoryBytes estimates the memory used by a bucket: the goroutine waking it to refill or
+// evict it, its channels and its state.
+const bucketMemoryBytes = 4096
+
+// BucketMemoryBytes implements quotaservice.MemoryEstimator.
+func (bf *bucketFactory) BucketMemoryBytes() int64 {
+	return bucketMemoryBytes
+}
+
 func (bf *bucketFactory) NewBucket(namespace, bucketName string, cfg *pbconfig.BucketConfig, dyn bool) quotaservice.Bucket {
+	if bf.snapshots == nil {
+		return newTokenBucket(namespace, bucketName, cfg, dyn, bf.now, bf.refillInterval, nil)
+	}
+
+	restored := bf.snapshots.restore(config.FullyQualifiedName(namespace, bucketName))
+	bucket := newTokenBucket(namespace, bucketName, cfg, dyn, bf.now, bf.refillInterval, restored)
+	bucket.snapshots = bf.snapshots
+	bf.snapshots.track(bucket)
+
+	return bucket
+}
+
+// newTokenBucket creates a bucket using now to tell the time, so tests can control it. The bucket
+// refills in the background every refillInterval if set, and starts full, or with the balance of a
+// restored snapshot if not nil.
+func newTokenBucket(namespace, bucketName string, cfg *pbconfig.BucketConfig, dyn bool, now func() time.Time,
+	refillInterval time.Duration, restored *bucketSnapshot) *tokenBucket {
 	// fill rate is tokens-per-second.
 	bucket := &tokenBucket{
 		dynamic:            dyn,
 		cfg:                cfg,
 		nanosBetweenTokens: 1e9 / cfg.FillRate,
+		maxTokens:          config.MaxTokensAtOnce(cfg),
+		ramp:               newFillRateRamp(cfg, now()),
+		windows:            newRateWindows(cfg),
 		accumulatedTokens:  cfg.Size, // Start full
+		namespace:          namespace,
+		name:               bucketName,
 		fullName:           config.FullyQualifiedName(namespace, bucketName),
+		now:                now,
+		refillInterval:     refillInterval,
 		waitTimer:          make(chan *waitTimeReq),
+		peeker:             make(chan chan int64),
+		saturations:        make(chan chan float64),
+		prober:             make(chan *probeReq),
+		returns:            make(chan int64),
+		snapshotter:        make(chan chan *bucketSnapshot),
+		restorer:           make(chan *bucketSnapshot),
 		closer:             make(chan struct{})}
 
+	bucket.saturation = newSaturation(saturationWindow, now().UnixNano())
+	if restored != nil && restored.saturation != nil {
+		bucket.saturation = restored.saturation
+	}
+
+	if restored != nil {
+		bucket.restore(restored)
+		// Only snapshots, unlike loaded states, carry the tokens served towards the token cap.
+		bucket.tokensServed = restored.Served
+		bucket.servedWindowNanos = restored.ServedWindowNanos
+		bucket.restoreWindows(restored)
+	}
+
 	go bucket.waitTimeLoop()
 
 	return bucket
 }
 
 func NewBucketFactory() quotaservice.BucketFactory {
-	return &bucketFactory{}
+	return &bucketFactory{now: time.Now}
 }
 
 var _ quotaservice.Bucket = (*tokenBucket)(nil)
+var _ quotaservice.Peeker = (*tokenBucket)(nil)
+var _ quotaservice.Prober = (*tokenBucket)(nil)
+var _ quotaservice.DeadlineTaker = (*tokenBucket)(nil)
+var _ quotaservice.Reconfigurer = (*tokenBucket)(nil)
+var _ quotaservice.Returner = (*tokenBucket)(nil)
+var _ quotaservice.SaturationReporter = (*tokenBucket)(nil)
+var _ quotaservice.StatefulBucket = (*tokenBucket)(nil)
 
 // tokenBucket is a single-threaded implementation. A single goroutine updates the values of
 // tokensNextAvailable and accumulatedTokens. When requesting tokens, Take() puts a request on
@@ -62,64 +129,406 @@ type tokenBucket struct {
 	dynamic                    bool
 	cfg                        *pbconfig.BucketConfig
 	nanosBetweenTokens         int64
+	maxTokens                  int64
+	ramp                       *fillRateRamp // nil unless the fill rate ramps
+	windows                    []rateWindow
 	tokensNextAvailableNanos   int64
 	accumulatedTokens          int64
-	fullName                   string
+	servedWindowNanos          int64 // start of the token cap window tokensServed were served in
+	tokensServed               int64
+	namespace, name, fullName  string
+	now                        func() time.Time
+	refillInterval             time.Duration
+	refillTimer                *time.Timer
+	refills                    <-chan time.Time // nil unless the refill timer is running
+	snapshots                  *snapshotter     // nil unless snapshotting
+	saturation                 *saturation
 	waitTimer                  chan *waitTimeReq
+	peeker                     chan chan int64
+	saturations                chan chan float64
+	prober                     chan *probeReq
+	returns                    chan int64
+	snapshotter                chan chan *bucketSnapshot
+	restorer                   chan *bucketSnapshot
 	closer                     chan struct{}
 	quotaservice.DefaultBucket // Extension for default methods on interface
 }
 
 // waitTimeReq is a request that you put on the channel for the waitTimer goroutine to pick up and
-// process.
+// process. If deadlineNanos is set, the max wait time is the time left before it when the request
+// is processed.
 type waitTimeReq struct {
+	requested, maxWaitTimeNanos, deadlineNanos int64
+	response                                   chan takeResult
+}
+
+type takeResult struct {
+	waitTimeNanos int64 // negative if timed out
+	capReached    *quotaservice.CapReachedError
+}
+
+// probeReq asks the waitTimer goroutine how a waitTimeReq would be answered, without claiming
+// tokens.
+type probeReq struct {
 	requested, maxWaitTimeNanos int64
-	response                    chan int64
+	response                    chan probeResult
+}
+
+type probeResult struct {
+	waitTimeNanos int64
+	granted       bool
+	capReached    *quotaservice.CapReachedError
 }
 
 func (b *tokenBucket) Take(_ context.Context, numTokens int64, maxWaitTime time.Duration) (time.Duration, bool, error) {
-	rsp := make(chan int64, 1)
-	b.waitTimer <- &waitTimeReq{numTokens, maxWaitTime.Nanoseconds(), rsp}
-	waitTimeNanos := <-rsp
+	return b.take(&waitTimeReq{requested: numTokens, maxWaitTimeNanos: maxWaitTime.Nanoseconds()})
+}
 
-	if waitTimeNanos < 0 {
+// TakeUntil implements quotaservice.DeadlineTaker.
+func (b *tokenBucket) TakeUntil(_ context.Context, numTokens int64, deadline time.Time) (time.Duration, bool, error) {
+	return b.take(&waitTimeReq{requested: numTokens, deadlineNanos: deadline.UnixNano()})
+}
+
+func (b *tokenBucket) take(req *waitTimeReq) (time.Duration, bool, error) {
+	if req.requested > b.maxTokens {
+		return 0, false, &quotaservice.TooManyTokensError{MaxTokens: b.maxTokens}
+	}
+
+	req.response = make(chan takeResult, 1)
+	b.waitTimer <- req
+	rsp := <-req.response
+
+	if rsp.capReached != nil {
+		return 0, false, rsp.capReached
+	}
+
+	if rsp.waitTimeNanos < 0 {
 		// Timed out
 		return 0, false, nil
 	}
 
-	return time.Duration(waitTimeNanos) * time.Nanosecond, true, nil
+	return time.Duration(rsp.waitTimeNanos) * time.Nanosecond, true, nil
 }
 
 // calcWaitTime is designed to run in a single event loop and is not thread-safe.
-func (b *tokenBucket) calcWaitTime(requested, maxWaitTimeNanos int64) (waitTimeNanos int64) {
-	currentTimeNanos := time.Now().UnixNano()
-	tna := b.tokensNextAvailableNanos
-	ac := b.accumulatedTokens
+func (b *tokenBucket) calcWaitTime(requested, maxWaitTimeNanos, deadlineNanos int64) takeResult {
+	currentTimeNanos := b.now().UnixNano()
+	if deadlineNanos != 0 {
+		maxWaitTimeNanos = deadlineNanos - currentTimeNanos
+	}
+
+	if capReached := b.checkCap(requested, currentTimeNanos); capReached != nil {
+		return takeResult{waitTimeNanos: -1, capReached: capReached}
+	}
+
+	waitTimeNanos, tna, ac, windows, granted := b.claim(requested, maxWaitTimeNanos, currentTimeNanos)
+	if !granted {
+		return takeResult{waitTimeNanos: -1}
+	}
+
+	b.tokensNextAvailableNanos = tna
+	b.accumulatedTokens = ac
+	b.windows = windows
+	b.countServed(requested, currentTimeNanos)
+	b.trackSaturation(currentTimeNanos)
+	return takeResult{waitTimeNanos: waitTimeNanos}
+}
+
+// capWindow returns the start and end of the token cap window including a time, in nanos since
+// the epoch. A cap without a window has a single window, starting at 0 and ending never, at 0.
+func (b *tokenBucket) capWindow(nanos int64) (start, end int64) {
+	windowNanos := b.cfg.TokenCapWindowMillis * 1e6
+	if windowNanos <= 0 {
+		return 0, 0
+	}
+
+	start = nanos - nanos%windowNanos
+	return start, start + windowNanos
+}
+
+// checkCap returns the error for requested tokens that would take the tokens served in the window
+// including a time beyond the bucket's token cap, or nil if they wouldn't or the bucket is
+// uncapped. It is designed to run in a single event loop and is not thread-safe.
+func (b *tokenBucket) checkCap(requested, nanos int64) *quotaservice.CapReachedError {
+	if b.cfg.TokenCap <= 0 || b.servedIn(nanos)+requested <= b.cfg.TokenCap {
+		return nil
+	}
+
+	capReached := &quotaservice.CapReachedError{TokenCap: b.cfg.TokenCap}
+	if _, end := b.capWindow(nanos); end > 0 {
+		capReached.ResetAt = time.Unix(0, end)
+	}
+
+	return capReached
+}
+
+// servedIn returns the tokens served in the token cap window including a time. It is designed to
+// run in a single event loop and is not thread-safe.
+func (b *tokenBucket) servedIn(nanos int64) int64 {
+	if start, _ := b.capWindow(nanos); start != b.servedWindowNanos {
+		return 0
+	}
+
+	return b.tokensServed
+}
+
+// countServed counts tokens served at a time towards the token cap, starting the count afresh once
+// the window rolls over. It is designed to run in a single event loop and is not thread-safe.
+func (b *tokenBucket) countServed(tokens, nanos int64) {
+	if b.cfg.TokenCap <= 0 {
+		return
+	}
+
+	b.tokensServed = b.servedIn(nanos) + tokens
+	b.servedWindowNanos, _ = b.capWindow(nanos)
+}
+
+// claim computes the wait for tokens requested at a time, the longest of those of the fill rate and
+// of the rate windows, and the state of the bucket once they are claimed, without changing it. It
+// is designed to run in a single event loop and is not thread-safe.
+func (b *tokenBucket) claim(requested, maxWaitTimeNanos, currentTimeNanos int64) (waitTimeNanos, tna, ac int64, windows []rateWindow, granted bool) {
+	tna = b.tokensNextAvailableNanos
+	ac = b.accumulatedTokens
 
 	var freshTokens int64
 
 	if currentTimeNanos > tna {
-		freshTokens = (currentTimeNanos - tna) / b.nanosBetweenTokens
+		freshTokens = b.tokensBetween(tna, currentTimeNanos)
 		ac = min(b.cfg.Size, ac+freshTokens)
 		tna = currentTimeNanos
 	}
 
-	waitTimeNanos = tna - currentTimeNanos
+	nanosBetweenTokens := b.nanosBetweenTokensAt(currentTimeNanos)
+
+	// Debt of up to max_debt tokens is tolerated without waiting; only the rest is waited for.
+	overdraftNanos := b.cfg.MaxDebt * nanosBetweenTokens
+	waitTimeNanos = tna - currentTimeNanos - overdraftNanos
+	if waitTimeNanos < 0 {
+		waitTimeNanos = 0
+	}
+
 	accumulatedTokensUsed := min(ac, requested)
 	tokensToWaitFor := requested - accumulatedTokensUsed
-	futureWaitNanos := tokensToWaitFor * b.nanosBetweenTokens
+	futureWaitNanos := tokensToWaitFor * nanosBetweenTokens
 
 	tna += futureWaitNanos
 	ac -= accumulatedTokensUsed
 
-	if (tna-currentTimeNanos > b.cfg.MaxDebtMillis*1e6) || (waitTimeNanos > 0 && waitTimeNanos > maxWaitTimeNanos) {
-		waitTimeNanos = -1
+	windowWaitNanos, windows, windowsWithinDebt := b.claimWindows(requested, currentTimeNanos)
+	waitTimeNanos = maxNanos(waitTimeNanos, windowWaitNanos)
+
+	granted = windowsWithinDebt && tna-currentTimeNanos <= b.cfg.MaxDebtMillis*1e6+overdraftNanos &&
+		(waitTimeNanos == 0 || waitTimeNanos <= maxWaitTimeNanos)
+	return waitTimeNanos, tna, ac, windows, granted
+}
+
+// Probe implements quotaservice.Prober, asking the waitTimeLoop how a Take would be answered.
+func (b *tokenBucket) Probe(ctx context.Context, numTokens int64, maxWaitTime time.Duration) (time.Duration, bool, error) {
+	if numTokens > b.maxTokens {
+		return 0, false, &quotaservice.TooManyTokensError{MaxTokens: b.maxTokens}
+	}
+
+	req := &probeReq{requested: numTokens, maxWaitTimeNanos: maxWaitTime.Nanoseconds(), response: make(chan probeResult, 1)}
+
+	select {
+	case b.prober <- req:
+		rsp := <-req.response
+		if rsp.capReached != nil {
+			return 0, false, rsp.capReached
+		}
+
+		return time.Duration(rsp.waitTimeNanos), rsp.granted, nil
+	case <-b.closer:
+		return 0, false, errors.New("bucket " + b.fullName + " has been destroyed")
+	case <-ctx.Done():
+		return 0, false, ctx.Err()
+	}
+}
+
+// Peek implements quotaservice.Peeker, asking the waitTimeLoop for the tokens available.
+func (b *tokenBucket) Peek(ctx context.Context) (int64, error) {
+	rsp := make(chan int64, 1)
+
+	select {
+	case b.peeker <- rsp:
+		return <-rsp, nil
+	case <-b.closer:
+		return 0, errors.New("bucket " + b.fullName + " has been destroyed")
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// Saturation implements quotaservice.SaturationReporter, asking the waitTimeLoop for the fraction of
+// the last minute the bucket had no tokens available.
+func (b *tokenBucket) Saturation(ctx context.Context) (float64, error) {
+	rsp := make(chan float64, 1)
+
+	select {
+	case b.saturations <- rsp:
+		return <-rsp, nil
+	case <-b.closer:
+		return 0, errors.New("bucket " + b.fullName + " has been destroyed")
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// Return implements quotaservice.Returner, handing the tokens to the waitTimeLoop.
+func (b *tokenBucket) Return(ctx context.Context, numTokens int64) error {
+	select {
+	case b.returns <- numTokens:
+		return nil
+	case <-b.closer:
+		return errors.New("bucket " + b.fullName + " has been destroyed")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// returnTokens is designed to run in a single event loop and is not thread-safe. Tokens returned
+// settle the bucket's debt first, by making the tokens claimed ahead of their availability
+// available sooner, and are returned to each rate window alike. They no longer count towards the
+// token cap.
+func (b *tokenBucket) returnTokens(tokens int64) {
+	currentTimeNanos := b.now().UnixNano()
+
+	if served := b.servedIn(currentTimeNanos); served > 0 {
+		b.countServed(-min(served, tokens), currentTimeNanos)
+	}
+
+	for i := range b.windows {
+		b.windows[i].returnTokens(tokens, currentTimeNanos)
+	}
+
+	if debtNanos := b.tokensNextAvailableNanos - currentTimeNanos; debtNanos > 0 {
+		nanosBetweenTokens := b.nanosBetweenTokensAt(currentTimeNanos)
+		if settledNanos := tokens * nanosBetweenTokens; settledNanos < debtNanos {
+			b.tokensNextAvailableNanos -= settledNanos
+			b.trackSaturation(currentTimeNanos)
+			return
+		}
+
+		tokens -= debtNanos / nanosBetweenTokens
+		b.tokensNextAvailableNanos = currentTimeNanos
+	}
+
+	b.accumulatedTokens = min(b.cfg.Size, b.accumulatedTokens+tokens)
+	b.trackSaturation(currentTimeNanos)
+}
+
+// availableTokens returns the tokens available at the fill rate and in every rate window. It is
+// designed to run in a single event loop and is not thread-safe.
+func (b *tokenBucket) availableTokens() int64 {
+	currentTimeNanos := b.now().UnixNano()
+	available := b.bucketTokens(currentTimeNanos)
+
+	for _, w := range b.windows {
+		available = min(available, w.availableTokens(currentTimeNanos))
+	}
+
+	return available
+}
+
+// bucketTokens returns the tokens available at the fill rate at a time. It is designed to run in a
+// single event loop and is not thread-safe.
+func (b *tokenBucket) bucketTokens(currentTimeNanos int64) int64 {
+	tna := b.tokensNextAvailableNanos
+
+	if currentTimeNanos >= tna {
+		return min(b.cfg.Size, b.accumulatedTokens+b.tokensBetween(tna, currentTimeNanos))
+	}
+
+	// In debt; tokens have been claimed until tna.
+	return b.accumulatedTokens - (tna-currentTimeNanos)/b.nanosBetweenTokensAt(currentTimeNanos)
+}
+
+// nanosBetweenTokensAt returns the nanos between tokens at the fill rate in effect at a time.
+func (b *tokenBucket) nanosBetweenTokensAt(nanos int64) int64 {
+	if b.ramp == nil {
+		return b.nanosBetweenTokens
+	}
+
+	return b.ramp.nanosBetweenTokens(nanos)
+}
+
+// tokensBetween returns the tokens added between two times.
+func (b *tokenBucket) tokensBetween(fromNanos, toNanos int64) int64 {
+	if b.ramp == nil {
+		return (toNanos - fromNanos) / b.nanosBetweenTokens
+	}
+
+	return b.ramp.tokensBetween(fromNanos, toNanos)
+}
+
+// Reconfigure implements quotaservice.Reconfigurer, creating a bucket with the balance of this one
+// clamped to the new size.
+func (b *tokenBucket) Reconfigure(cfg *pbconfig.BucketConfig) (quotaservice.Bucket, int64) {
+	snap := b.snapshot()
+	bucket := newTokenBucket(b.namespace, b.name, cfg, b.dynamic, b.now, b.refillInterval, snap)
+
+	if b.snapshots != nil {
+		bucket.snapshots = b.snapshots
+		b.snapshots.track(bucket)
+	}
+
+	if snap != nil && snap.Tokens > cfg.Size {
+		return bucket, snap.Tokens - cfg.Size
+	}
+
+	return bucket, 0
+}
+
+// snapshot asks the waitTimeLoop for the bucket's balance, returning nil if it has been destroyed.
+func (b *tokenBucket) snapshot() *bucketSnapshot {
+	rsp := make(chan *bucketSnapshot, 1)
+
+	select {
+	case b.snapshotter <- rsp:
+		return <-rsp
+	case <-b.closer:
+		return nil
+	}
+}
+
+// State implements quotaservice.StatefulBucket.
+func (b *tokenBucket) State() (int64, time.Time, bool) {
+	snap := b.snapshot()
+	if snap == nil {
+		return 0, time.Time{}, false
+	}
+
+	return snap.Tokens, time.Unix(0, snap.AtNanos), true
+}
+
+// SetState implements quotaservice.StatefulBucket, restoring the balance like a snapshot.
+func (b *tokenBucket) SetState(tokens int64, at time.Time) bool {
+	snap := &bucketSnapshot{Namespace: b.namespace, Bucket: b.name, Tokens: tokens, AtNanos: at.UnixNano()}
+
+	select {
+	case b.restorer <- snap:
+		return true
+	case <-b.closer:
+		return false
+	}
+}
+
+// restore sets the balance of a bucket from a snapshot, clamped to its size, before the bucket
+// starts its waitTimeLoop or from within it. Tokens accumulate from the time of the snapshot, crediting the time the
+// bucket wasn't running.
+func (b *tokenBucket) restore(snap *bucketSnapshot) {
+	tokens := min(snap.Tokens, b.cfg.Size)
+	b.tokensNextAvailableNanos = snap.AtNanos
+
+	if tokens >= 0 {
+		b.accumulatedTokens = tokens
 	} else {
-		b.tokensNextAvailableNanos = tna
-		b.accumulatedTokens = ac
+		// In debt; the tokens claimed become available in the future.
+		b.accumulatedTokens = 0
+		b.tokensNextAvailableNanos += -tokens * b.nanosBetweenTokensAt(snap.AtNanos)
 	}
 
-	return waitTimeNanos
+	b.trackSaturation(b.now().UnixNano())
 }
 
 func min(x, y int64) int64 {
@@ -131,12 +540,45 @@ func min(x, y int64) int64 {
 
 // waitTimeLoop is the single event loop that claims tokens on a given bucket.
 func (b *tokenBucket) waitTimeLoop() {
+	b.armRefill()
+
 	for {
 		select {
 		case req := <-b.waitTimer:
-			req.response <- b.calcWaitTime(req.requested, req.maxWaitTimeNanos)
+			req.response <- b.calcWaitTime(req.requested, req.maxWaitTimeNanos, req.deadlineNanos)
+			b.armRefill()
+		case <-b.refills:
+			b.refills = nil
+			b.refill(b.now().UnixNano())
+			b.armRefill()
+		case rsp := <-b.peeker:
+			rsp <- b.availableTokens()
+		case rsp := <-b.saturations:
+			rsp <- b.saturation.fraction(b.now().UnixNano())
+		case req := <-b.prober:
+			currentTimeNanos := b.now().UnixNano()
+			if capReached := b.checkCap(req.requested, currentTimeNanos); capReached != nil {
+				req.response <- probeResult{capReached: capReached}
+				continue
+			}
+
+			wait, _, _, _, granted := b.claim(req.requested, req.maxWaitTimeNanos, currentTimeNanos)
+			req.response <- probeResult{waitTimeNanos: wait, granted: granted}
+		case tokens := <-b.returns:
+			b.returnTokens(tokens)
+		case rsp := <-b.snapshotter:
+			currentTimeNanos := b.now().UnixNano()
+			rsp <- &bucketSnapshot{Namespace: b.namespace, Bucket: b.name, Tokens: b.bucketTokens(currentTimeNanos), AtNanos: currentTimeNanos,
+				Served: b.tokensServed, ServedWindowNanos: b.servedWindowNanos, Windows: b.windowSnapshots(currentTimeNanos),
+				saturation: b.saturation.copy()}
+		case snap := <-b.restorer:
+			b.restore(snap)
+			b.armRefill()
 		case <-b.closer:
 			logging.Printf("Garbage collecting bucket %v", b.fullName)
+			if b.refillTimer != nil {
+				b.refillTimer.Stop()
+			}
 			// TODO(manik) properly notify goroutines who are currently trying to write to waitTimer
 			return
 		}
@@ -152,6 +594,10 @@ func (b *tokenBucket) Dynamic() bool {
 }
 
 func (b *tokenBucket) Destroy() {
+	if b.snapshots != nil {
+		b.snapshots.forget(b)
+	}
+
 	// Signal the waitTimeLoop to exit
 	close(b.closer)
 }
@@ -4,11 +4,16 @@
 package memory
 
 import (
+	"context"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/square/quotaservice"
 	"github.com/square/quotaservice/buckets"
 	"github.com/square/quotaservice/config"
+	pbconfig "github.com/square/quotaservice/protos/config"
+	"github.com/square/quotaservice/test/helpers"
 )
 
 var factory = NewBucketFactory()
@@ -28,6 +33,526 @@ func TestTokenAcquisition(t *testing.T) {
 	buckets.TestTokenAcquisition(t, bucket)
 }
 
+func TestTakeUntil(t *testing.T) {
+	bucket := factory.NewBucket("memory", "until", config.NewDefaultBucketConfig(""), false)
+	defer bucket.Destroy()
+	buckets.TestTakeUntil(t, bucket)
+}
+
+func TestProbe(t *testing.T) {
+	bucket := factory.NewBucket("memory", "probe", config.NewDefaultBucketConfig(""), false)
+	defer bucket.Destroy()
+	buckets.TestProbe(t, bucket)
+}
+
+func newDebtConfig() *pbconfig.BucketConfig {
+	cfg := config.NewDefaultBucketConfig("")
+	cfg.MaxDebt = 50
+	return cfg
+}
+
+func TestDebt(t *testing.T) {
+	bucket := factory.NewBucket("memory", "debt", newDebtConfig(), false)
+	defer bucket.Destroy()
+	buckets.TestDebt(t, bucket)
+}
+
+func TestDebtRepaid(t *testing.T) {
+	clock := &fakeClock{time.Unix(1000, 0)}
+	bucket := newTokenBucket("memory", "repaid", newDebtConfig(), false, clock.now, 0, nil)
+	defer bucket.Destroy()
+
+	if _, ok, _ := bucket.Take(context.Background(), 150, 0); !ok {
+		t.Fatal("Expected to over-draw the bucket by its max debt")
+	}
+
+	tokens, err := bucket.Peek(context.Background())
+	helpers.CheckError(t, err)
+	if tokens != -50 {
+		t.Fatalf("Expected the bucket to be 50 tokens in debt, got %v", tokens)
+	}
+
+	// The fill rate of 50 per second repays 25 tokens...
+	clock.t = clock.t.Add(500 * time.Millisecond)
+	if _, ok, _ := bucket.Take(context.Background(), 26, 0); !ok {
+		t.Fatal("Expected to over-draw the bucket again once part of the debt is repaid")
+	}
+
+	// ... but the bucket is now a token past its max debt.
+	if wait, ok, _ := bucket.Take(context.Background(), 1, time.Minute); !ok || wait != 20*time.Millisecond {
+		t.Fatalf("Expected to wait 20ms for a token, got %v, %v", wait, ok)
+	}
+
+	// Once the debt is repaid, the bucket accumulates tokens again.
+	clock.t = clock.t.Add(3 * time.Second)
+	tokens, err = bucket.Peek(context.Background())
+	helpers.CheckError(t, err)
+	if tokens != 98 {
+		t.Fatalf("Expected 98 tokens once the debt is repaid, got %v", tokens)
+	}
+}
+
+func TestTokenCap(t *testing.T) {
+	cfg := config.NewDefaultBucketConfig("")
+	cfg.TokenCap = 150
+	bucket := factory.NewBucket("memory", "cap", cfg, false)
+	defer bucket.Destroy()
+	buckets.TestTokenCap(t, bucket)
+}
+
+func TestRateWindows(t *testing.T) {
+	cfg := config.NewDefaultBucketConfig("")
+	cfg.RateWindows = []*pbconfig.RateWindow{{Tokens: 300, WindowMillis: 60000}, {Tokens: 120, WindowMillis: 3600000}}
+	bucket := factory.NewBucket("memory", "windows", cfg, false)
+	defer bucket.Destroy()
+	buckets.TestRateWindows(t, bucket)
+}
+
+func TestRateWindowWait(t *testing.T) {
+	clock := &fakeClock{time.Unix(1000, 0)}
+	cfg := config.NewDefaultBucketConfig("")
+	cfg.Size = 10
+	cfg.FillRate = 10
+	// A token a second, slower than the fill rate's token every 100 millis.
+	cfg.RateWindows = []*pbconfig.RateWindow{{Tokens: 10, WindowMillis: 10000}}
+	bucket := newTokenBucket("memory", "window_wait", cfg, false, clock.now, 0, nil)
+	defer bucket.Destroy()
+
+	for _, tc := range []struct {
+		requested int64
+		wait      time.Duration
+	}{
+		{10, 0},
+		{1, 0},
+		// The window's wait governs.
+		{1, time.Second},
+	} {
+		if w, s, err := bucket.Take(context.Background(), tc.requested, 5*time.Second); err != nil || !s || w != tc.wait {
+			t.Fatalf("Expected to take %v tokens after %v, got %v, %v, %v", tc.requested, tc.wait, w, s, err)
+		}
+	}
+
+	if available, err := bucket.Peek(context.Background()); err != nil || available != -2 {
+		t.Errorf("Expected the window to be 2 tokens in debt, got %v, %v", available, err)
+	}
+
+	// The fill rate has repaid its debt, but not the window.
+	clock.t = clock.t.Add(500 * time.Millisecond)
+	if w, s, err := bucket.Take(context.Background(), 1, 0); err != nil || s {
+		t.Fatalf("Expected the window to reject tokens without waiting, got %v, %v, %v", w, s, err)
+	}
+
+	// Reconfigured buckets keep the balance of their windows.
+	reconfigured, _ := bucket.Reconfigure(cfg)
+	defer reconfigured.Destroy()
+
+	if w, s, err := reconfigured.Take(context.Background(), 1, 0); err != nil || s {
+		t.Fatalf("Expected the reconfigured window to reject tokens without waiting, got %v, %v, %v", w, s, err)
+	}
+
+	// Balances carry over in whole tokens, so the part of a token repaid is forgiven.
+	if w, s, err := reconfigured.Take(context.Background(), 1, 2*time.Second); err != nil || !s || w != time.Second {
+		t.Fatalf("Expected to wait for the window to repay its debt, got %v, %v, %v", w, s, err)
+	}
+}
+
+func TestTokenCapWindow(t *testing.T) {
+	// Midway through a minute-long window.
+	clock := &fakeClock{time.Unix(1020, 0)}
+	cfg := config.NewDefaultBucketConfig("")
+	cfg.Size = 10
+	cfg.FillRate = 10
+	cfg.TokenCap = 15
+	cfg.TokenCapWindowMillis = 60000
+	bucket := newTokenBucket("memory", "cap_window", cfg, false, clock.now, 0, nil)
+	defer bucket.Destroy()
+
+	take := func(tokens int64) error {
+		_, _, err := bucket.Take(context.Background(), tokens, 0)
+		return err
+	}
+
+	helpers.CheckError(t, take(10))
+
+	// Refilled, but the returned tokens are the only ones left under the cap.
+	clock.t = clock.t.Add(time.Second)
+	helpers.CheckError(t, bucket.Return(context.Background(), 2))
+	helpers.CheckError(t, take(7))
+
+	err := take(1)
+	if capReached, ok := err.(*quotaservice.CapReachedError); !ok || !capReached.ResetAt.Equal(time.Unix(1080, 0)) {
+		t.Fatalf("Expected the cap to be reached until the window rolls over, got %v", err)
+	}
+
+	// Reconfigured buckets keep counting towards the cap.
+	reconfigured, _ := bucket.Reconfigure(cfg)
+	defer reconfigured.Destroy()
+
+	if _, _, err := reconfigured.Take(context.Background(), 1, 0); err == nil {
+		t.Fatal("Expected the reconfigured bucket to have reached the cap")
+	}
+
+	clock.t = time.Unix(1080, 0)
+	if _, ok, err := reconfigured.Take(context.Background(), 10, 0); !ok || err != nil {
+		t.Fatalf("Expected the cap to be reset once the window rolled over, got %v, %v", ok, err)
+	}
+}
+
 func TestGC(t *testing.T) {
 	buckets.TestGC(t, factory, "memory")
 }
+
+func TestInspection(t *testing.T) {
+	buckets.TestInspection(t, NewBucketFactory(), "memory")
+}
+
+func TestPeek(t *testing.T) {
+	cfg := config.NewDefaultBucketConfig("")
+	cfg.FillRate = 1
+	bucket := factory.NewBucket("memory", "peek", cfg, false).(*tokenBucket)
+	defer bucket.Destroy()
+
+	tokens, err := bucket.Peek(context.Background())
+	helpers.CheckError(t, err)
+
+	if tokens != cfg.Size {
+		t.Fatalf("Expected a new bucket to be full with %v tokens, got %v", cfg.Size, tokens)
+	}
+
+	// Claim all tokens, plus 5 ahead of their availability.
+	if _, ok, _ := bucket.Take(context.Background(), cfg.Size+5, 10*time.Second); !ok {
+		t.Fatal("Expected to claim tokens")
+	}
+
+	tokens, err = bucket.Peek(context.Background())
+	helpers.CheckError(t, err)
+
+	if tokens > -4 || tokens < -5 {
+		t.Fatalf("Expected a debt of 5 tokens, got %v", tokens)
+	}
+}
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func TestFillRateRamp(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		steps    int32
+		startIn  time.Duration
+		expected map[time.Duration]int64
+	}{
+		// Rising from 10 to 100 tokens/sec over 10 seconds.
+		{"linear", 0, 0, map[time.Duration]int64{
+			time.Second: 14, 5 * time.Second: 162, 10 * time.Second: 550, 12 * time.Second: 750}},
+		// At 10 tokens/sec for 5 seconds, then 55 tokens/sec for 5 seconds.
+		{"stepwise", 2, 0, map[time.Duration]int64{
+			time.Second: 10, 5 * time.Second: 50, 7 * time.Second: 160, 10 * time.Second: 325, 12 * time.Second: 525}},
+		// At 10 tokens/sec until the ramp starts.
+		{"scheduled", 0, 5 * time.Second, map[time.Duration]int64{
+			time.Second: 10, 5 * time.Second: 50, 6 * time.Second: 64, 15 * time.Second: 600}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clock := &fakeClock{time.Unix(1000, 0)}
+			cfg := config.NewDefaultBucketConfig("")
+			cfg.Size = 10000
+			cfg.FillRate = 100
+			cfg.RampStartFillRate = 10
+			cfg.RampDurationMillis = 10000
+			cfg.RampSteps = tc.steps
+			if tc.startIn > 0 {
+				cfg.RampStartMillis = clock.t.Add(tc.startIn).UnixNano() / int64(time.Millisecond)
+			}
+
+			bucket := newTokenBucket("memory", "ramp", cfg, false, clock.now, 0, nil)
+			defer bucket.Destroy()
+
+			// Drain the bucket, so only tokens added since are available.
+			if _, ok, _ := bucket.Take(context.Background(), cfg.Size, 0); !ok {
+				t.Fatal("Expected to claim tokens")
+			}
+
+			start := clock.t
+			for _, elapsed := range []time.Duration{time.Second, 5 * time.Second, 6 * time.Second, 7 * time.Second, 10 * time.Second, 12 * time.Second, 15 * time.Second} {
+				expected, ok := tc.expected[elapsed]
+				if !ok {
+					continue
+				}
+
+				clock.t = start.Add(elapsed)
+				tokens, err := bucket.Peek(context.Background())
+				helpers.CheckError(t, err)
+
+				if tokens != expected {
+					t.Errorf("Expected %v tokens after %v, got %v", expected, elapsed, tokens)
+				}
+			}
+		})
+	}
+}
+
+func TestFillRateRampWaitTime(t *testing.T) {
+	clock := &fakeClock{time.Unix(1000, 0)}
+	cfg := config.NewDefaultBucketConfig("")
+	cfg.Size = 1
+	cfg.FillRate = 100
+	cfg.RampStartFillRate = 10
+	cfg.RampDurationMillis = 10000
+	bucket := newTokenBucket("memory", "ramp_wait", cfg, false, clock.now, 0, nil)
+	defer bucket.Destroy()
+
+	expectWait := func(expected time.Duration) {
+		t.Helper()
+
+		// Drain the bucket and claim the next token, so the token after waits.
+		_, _, _ = bucket.Take(context.Background(), 1, 0)
+		_, _, _ = bucket.Take(context.Background(), 1, 0)
+		w, ok, err := bucket.Take(context.Background(), 1, time.Second)
+		helpers.CheckError(t, err)
+
+		if !ok || w != expected {
+			t.Errorf("Expected to wait %v at %v, got %v", expected, clock.t, w)
+		}
+
+		// Repay the debt.
+		clock.t = clock.t.Add(time.Second)
+	}
+
+	// A token every 100ms to begin with, then every 10ms once the ramp ends.
+	expectWait(100 * time.Millisecond)
+	clock.t = clock.t.Add(10 * time.Second)
+	expectWait(10 * time.Millisecond)
+
+	if tokens, _ := bucket.Peek(context.Background()); tokens != cfg.Size {
+		t.Errorf("Expected a full bucket, got %v tokens", tokens)
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	clock := &fakeClock{time.Unix(1000, 0)}
+	cfg := config.NewDefaultBucketConfig("")
+	cfg.Size = 100
+	cfg.FillRate = 10
+	bucket := newTokenBucket("memory", "reconfigure", cfg, false, clock.now, 0, nil)
+	defer bucket.Destroy()
+
+	if _, ok, _ := bucket.Take(context.Background(), 30, 0); !ok {
+		t.Fatal("Expected to take tokens")
+	}
+
+	for _, tc := range []struct {
+		size, tokens, clamped int64
+	}{
+		{200, 70, 0},
+		{50, 50, 20},
+	} {
+		newCfg := config.NewDefaultBucketConfig("")
+		newCfg.Size = tc.size
+		newCfg.FillRate = 10
+
+		b, clamped := bucket.Reconfigure(newCfg)
+		tokens, err := b.(*tokenBucket).Peek(context.Background())
+		helpers.CheckError(t, err)
+		b.Destroy()
+
+		if tokens != tc.tokens || clamped != tc.clamped {
+			t.Errorf("Expected a bucket of size %v to keep %v tokens, clamping %v; got %v, clamping %v",
+				tc.size, tc.tokens, tc.clamped, tokens, clamped)
+		}
+	}
+}
+
+func TestTooManyTokens(t *testing.T) {
+	cfg := config.NewDefaultBucketConfig("")
+	cfg.Size = 10
+	cfg.FillRate = 10
+	cfg.MaxDebtMillis = 1000
+	bucket := factory.NewBucket("memory", "too_many", cfg, false)
+	defer bucket.Destroy()
+
+	// At most the size plus 1 second of debt can be served at once.
+	_, ok, err := bucket.Take(context.Background(), 21, time.Minute)
+	if tooMany, isTooMany := err.(*quotaservice.TooManyTokensError); ok || !isTooMany || tooMany.MaxTokens != 20 {
+		t.Fatalf("Expected a max of 20 tokens, got %v, %v", ok, err)
+	}
+
+	if _, ok, err := bucket.Take(context.Background(), 20, 0); !ok || err != nil {
+		t.Fatalf("Expected to take 20 tokens, got %v, %v", ok, err)
+	}
+
+	// Throttled, rather than too many tokens.
+	if _, ok, err := bucket.Take(context.Background(), 1, 0); ok || err != nil {
+		t.Fatalf("Expected to time out without an error, got %v, %v", ok, err)
+	}
+}
+
+func TestServerMaxWaiters(t *testing.T) {
+	cfg := config.NewDefaultServiceConfig()
+	ns := config.NewDefaultNamespaceConfig("ns")
+	for name, fillRate := range map[string]int64{"slow": 1, "fast": 20} {
+		b := config.NewDefaultBucketConfig(name)
+		b.Size = 1
+		b.FillRate = fillRate
+		b.WaitTimeoutMillis = 10000
+		b.MaxWaiters = 1
+		helpers.PanicError(config.AddBucket(ns, b))
+	}
+	helpers.PanicError(config.AddNamespace(cfg, ns))
+
+	s := quotaservice.New(NewBucketFactory(), config.NewMemoryConfig(cfg),
+		quotaservice.NewReaperConfigForTests(), 0, &quotaservice.MockEndpoint{})
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer func() { _, _ = s.Stop() }()
+	qs := s.(quotaservice.QuotaService)
+
+	allow := func(bucket string) (time.Duration, error) {
+		w, _, err := qs.Allow(context.Background(), "ns", bucket, 1, 0, false)
+		return w, err
+	}
+
+	expectTooManyWaiters := func(bucket string) {
+		t.Helper()
+		w, err := allow(bucket)
+		if qsErr, ok := err.(quotaservice.QuotaServiceError); !ok || qsErr.Reason != quotaservice.ER_TOO_MANY_WAITERS {
+			t.Fatalf("Expected too many waiters, got %v, %v", w, err)
+		}
+	}
+
+	// The bucket's token and the debt it falls into are granted without waiting, then a wait, which
+	// the client waits out, so it counts as a waiter until the wait passes.
+	for i, expectWait := range []bool{false, false, true} {
+		if w, err := allow("slow"); err != nil || (w > 0) != expectWait {
+			t.Fatalf("Expected request %v to be granted waiting %v, got %v, %v", i, expectWait, w, err)
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		expectTooManyWaiters("slow")
+	}
+
+	inspection, err := s.GetServerAdministrable().InspectBucket("ns", "slow")
+	helpers.CheckError(t, err)
+	if inspection.Activity.Waiters != 1 {
+		t.Errorf("Expected 1 waiter, got %+v", inspection.Activity)
+	}
+
+	// Once the wait passes, requests may wait again.
+	var w time.Duration
+	for i := 0; i < 3; i++ {
+		w, err = allow("fast")
+		helpers.CheckError(t, err)
+	}
+
+	if w <= 0 {
+		t.Fatalf("Expected a wait to be granted, got %v", w)
+	}
+
+	expectTooManyWaiters("fast")
+	time.Sleep(w)
+
+	if _, err := allow("fast"); err != nil {
+		t.Errorf("Expected requests to be served once the wait passed, got %v", err)
+	}
+}
+
+func TestReturn(t *testing.T) {
+	clock := &fakeClock{time.Unix(1000, 0)}
+	cfg := config.NewDefaultBucketConfig("")
+	cfg.Size = 10
+	cfg.FillRate = 10
+	cfg.MaxDebtMillis = 10000
+	bucket := newTokenBucket("memory", "return", cfg, false, clock.now, 0, nil)
+	defer bucket.Destroy()
+
+	// Claim all tokens, plus 5 ahead of their availability.
+	if _, ok, _ := bucket.Take(context.Background(), 15, time.Minute); !ok {
+		t.Fatal("Expected to take tokens")
+	}
+
+	for _, tc := range []struct {
+		returned, tokens int64
+	}{
+		// Settling part of the debt, then all of it and adding the rest.
+		{3, -2},
+		{4, 2},
+		// Up to the size.
+		{20, 10},
+	} {
+		helpers.CheckError(t, bucket.Return(context.Background(), tc.returned))
+
+		tokens, err := bucket.Peek(context.Background())
+		helpers.CheckError(t, err)
+
+		if tokens != tc.tokens {
+			t.Errorf("Expected %v tokens after returning %v, got %v", tc.tokens, tc.returned, tokens)
+		}
+	}
+}
+
+func TestFractionalTokens(t *testing.T) {
+	cfg := config.NewDefaultServiceConfig()
+	ns := config.NewDefaultNamespaceConfig("ns")
+	ns.TokenScale = 1000
+
+	b := config.NewDefaultBucketConfig("b")
+	b.Size, b.FillRate = 10, 1
+	helpers.PanicError(config.AddBucket(ns, b))
+	helpers.PanicError(config.AddNamespace(cfg, ns))
+
+	// A stopped clock, so no tokens are refilled.
+	clock := &fakeClock{time.Unix(1000, 0)}
+	s := quotaservice.New(&bucketFactory{now: clock.now}, config.NewMemoryConfig(cfg),
+		quotaservice.NewReaperConfigForTests(), 0, &quotaservice.MockEndpoint{})
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer func() { _, _ = s.Stop() }()
+
+	qs := s.(quotaservice.FractionGranter)
+	ctx := context.Background()
+
+	// Thousandths of a token add up to whole tokens, without the drift of summing floats.
+	for i := 0; i < 3000; i++ {
+		granted, _, _, err := qs.AllowFraction(ctx, "ns", "b", 0.001, 0, false)
+		helpers.CheckError(t, err)
+
+		if granted != 0.001 {
+			t.Fatalf("Expected 0.001 tokens granted, got %v", granted)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		_, _, _, err := qs.AllowFraction(ctx, "ns", "b", 0.25, 0, false)
+		helpers.CheckError(t, err)
+	}
+
+	// Whole tokens requested are scaled too.
+	_, _, err = s.(quotaservice.QuotaService).Allow(ctx, "ns", "b", 2, 0, false)
+	helpers.CheckError(t, err)
+
+	inspection, err := s.GetServerAdministrable().InspectBucket("ns", "b")
+	helpers.CheckError(t, err)
+
+	// 10 tokens, less 3, 2.5 and 2, in thousandths.
+	if inspection.AvailableTokens == nil || *inspection.AvailableTokens != 2500 {
+		t.Errorf("Expected 2500 thousandths of a token left, got %+v", inspection)
+	}
+
+	if inspection.Config.Size != 10000 {
+		t.Errorf("Expected the bucket to count thousandths of a token, got size %v", inspection.Config.Size)
+	}
+
+	if effective := s.(quotaservice.ConfigReader).EffectiveConfig(); effective.Namespaces["ns"].Buckets["b"].Size != 10 {
+		t.Errorf("Expected the effective config to count whole tokens, got %v", effective.Namespaces["ns"].Buckets["b"])
+	}
+
+	_, _, _, err = qs.AllowFraction(ctx, "ns", "b", 0.0001, 0, false)
+	if qsErr, ok := err.(quotaservice.QuotaServiceError); !ok || qsErr.Reason != quotaservice.ER_TOO_FEW_TOKENS_REQUESTED {
+		t.Errorf("Expected a request finer than the token scale to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package memory
+
+import (
+	"math"
+	"time"
+
+	pbconfig "github.com/square/quotaservice/protos/config"
+)
+
+// fillRateRamp raises the fill rate of a bucket from an initial rate to its configured fill rate
+// over a duration, linearly or in equal steps. All times are in nanos since the epoch.
+type fillRateRamp struct {
+	from, to                  float64
+	startNanos, durationNanos float64
+	steps                     float64
+}
+
+// newFillRateRamp creates the ramp configured on a bucket, or returns nil if the bucket doesn't
+// ramp. A ramp without a start time starts at created.
+func newFillRateRamp(cfg *pbconfig.BucketConfig, created time.Time) *fillRateRamp {
+	if cfg.RampDurationMillis <= 0 {
+		return nil
+	}
+
+	start := created.UnixNano()
+	if cfg.RampStartMillis > 0 {
+		start = cfg.RampStartMillis * int64(time.Millisecond)
+	}
+
+	return &fillRateRamp{
+		from:          float64(cfg.RampStartFillRate),
+		to:            float64(cfg.FillRate),
+		startNanos:    float64(start),
+		durationNanos: float64(cfg.RampDurationMillis * int64(time.Millisecond)),
+		steps:         float64(cfg.RampSteps)}
+}
+
+// nanosBetweenTokens returns the nanos between tokens at the fill rate in effect at a time.
+func (r *fillRateRamp) nanosBetweenTokens(nanos int64) int64 {
+	elapsed := float64(nanos) - r.startNanos
+
+	rate := r.to
+	switch {
+	case elapsed <= 0:
+		rate = r.from
+	case elapsed < r.durationNanos && r.steps > 0:
+		rate = r.from + (r.to-r.from)*math.Floor(elapsed*r.steps/r.durationNanos)/r.steps
+	case elapsed < r.durationNanos:
+		rate = r.from + (r.to-r.from)*elapsed/r.durationNanos
+	}
+
+	return int64(1e9 / math.Max(rate, 1))
+}
+
+// tokensBetween returns the whole number of tokens added between two times, following the fill
+// rate as it changes over the ramp.
+func (r *fillRateRamp) tokensBetween(fromNanos, toNanos int64) int64 {
+	// Guard against rounding turning a whole number of tokens into slightly fewer.
+	return int64(math.Floor(r.tokensSinceStart(toNanos) - r.tokensSinceStart(fromNanos) + 1e-6))
+}
+
+// tokensSinceStart returns the tokens added between the start of the ramp and a time, which is
+// negative for times before the start.
+func (r *fillRateRamp) tokensSinceStart(nanos int64) float64 {
+	elapsed := float64(nanos) - r.startNanos
+
+	switch {
+	case elapsed <= 0:
+		return elapsed * r.from / 1e9
+	case elapsed >= r.durationNanos:
+		return r.tokensDuringRamp(r.durationNanos) + (elapsed-r.durationNanos)*r.to/1e9
+	default:
+		return r.tokensDuringRamp(elapsed)
+	}
+}
+
+// tokensDuringRamp returns the tokens added over the first elapsed nanos of the ramp.
+func (r *fillRateRamp) tokensDuringRamp(elapsed float64) float64 {
+	diff := r.to - r.from
+
+	if r.steps <= 0 {
+		// The area under a line rising from r.from.
+		return (r.from*elapsed + diff*elapsed*elapsed/(2*r.durationNanos)) / 1e9
+	}
+
+	// Whole steps completed, each at the rate of its step, then part of the current step.
+	stepNanos := r.durationNanos / r.steps
+	k := math.Min(math.Floor(elapsed/stepNanos), r.steps)
+	whole := stepNanos * (k*r.from + diff*k*(k-1)/(2*r.steps))
+	partial := (r.from + diff*k/r.steps) * (elapsed - k*stepNanos)
+
+	return (whole + partial) / 1e9
+}
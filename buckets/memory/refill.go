@@ -0,0 +1,106 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package memory
+
+import (
+	"time"
+
+	"github.com/square/quotaservice"
+)
+
+const defaultRefillInterval = 100 * time.Millisecond
+
+// RefillStrategy selects when memory buckets credit the tokens they accumulate.
+type RefillStrategy int
+
+const (
+	// RefillLazy computes the tokens accumulated when a bucket is accessed. Idle buckets cost
+	// nothing, and hot buckets pay a little arithmetic per request. This is the default.
+	RefillLazy RefillStrategy = iota
+	// RefillBackground also credits the tokens accumulated on a timer while a bucket is below its
+	// size, so its stored balance never lags by more than the refill interval. Each refilling
+	// bucket then wakes up every interval until it's full again.
+	RefillBackground
+)
+
+// RefillOptions configures how memory buckets refill.
+type RefillOptions struct {
+	Strategy RefillStrategy
+	// Interval is the time between refills of buckets refilling in the background. Defaults to
+	// 100 milliseconds.
+	Interval time.Duration
+}
+
+// NewBucketFactoryWithRefill creates a BucketFactory whose buckets refill according to opts.
+func NewBucketFactoryWithRefill(opts RefillOptions) quotaservice.BucketFactory {
+	bf := &bucketFactory{now: time.Now}
+
+	if opts.Strategy == RefillBackground {
+		bf.refillInterval = opts.Interval
+		if bf.refillInterval <= 0 {
+			bf.refillInterval = defaultRefillInterval
+		}
+	}
+
+	return bf
+}
+
+// refill credits the tokens accumulated since they were last credited. Only whole tokens are
+// credited, leaving the time towards the next one to accumulate, unless the bucket fills up.
+func (b *tokenBucket) refill(currentTimeNanos int64) {
+	tna := b.tokensNextAvailableNanos
+	if currentTimeNanos <= tna {
+		// In debt, or already credited.
+		return
+	}
+
+	freshTokens := b.tokensBetween(tna, currentTimeNanos)
+
+	switch {
+	case b.accumulatedTokens+freshTokens >= b.cfg.Size:
+		b.accumulatedTokens = b.cfg.Size
+		b.tokensNextAvailableNanos = currentTimeNanos
+	case freshTokens > 0:
+		b.accumulatedTokens += freshTokens
+		b.tokensNextAvailableNanos = b.nanosAfterTokens(tna, freshTokens, currentTimeNanos)
+	}
+}
+
+// nanosAfterTokens returns the earliest time, no later than toNanos, by which tokens have been
+// added since fromNanos.
+func (b *tokenBucket) nanosAfterTokens(fromNanos, tokens, toNanos int64) int64 {
+	if b.ramp == nil {
+		return fromNanos + tokens*b.nanosBetweenTokens
+	}
+
+	// The fill rate changes over the ramp, so search for the time.
+	lo, hi := fromNanos, toNanos
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if b.ramp.tokensBetween(fromNanos, mid) >= tokens {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+
+	return hi
+}
+
+// armRefill starts the refill timer of a bucket refilling in the background if it's below its size
+// and the timer isn't already running. The timer is only read by the waitTimeLoop.
+func (b *tokenBucket) armRefill() {
+	if b.refillInterval <= 0 || b.refills != nil || b.accumulatedTokens >= b.cfg.Size {
+		return
+	}
+
+	if b.refillTimer == nil {
+		b.refillTimer = time.NewTimer(b.refillInterval)
+	} else {
+		// The timer has fired and been drained, so can be reset.
+		b.refillTimer.Reset(b.refillInterval)
+	}
+
+	b.refills = b.refillTimer.C
+}
@@ -0,0 +1,90 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package memory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/square/quotaservice/buckets"
+	"github.com/square/quotaservice/config"
+)
+
+func newBackgroundRefillFactory() *bucketFactory {
+	f := NewBucketFactoryWithRefill(RefillOptions{Strategy: RefillBackground, Interval: time.Millisecond}).(*bucketFactory)
+	f.Init(config.NewDefaultServiceConfig())
+	return f
+}
+
+func TestBackgroundRefillTokenAcquisition(t *testing.T) {
+	bucket := newBackgroundRefillFactory().NewBucket("memory", "background", config.NewDefaultBucketConfig(""), false)
+	defer bucket.Destroy()
+	buckets.TestTokenAcquisition(t, bucket)
+}
+
+func TestBackgroundRefillTakeUntil(t *testing.T) {
+	bucket := newBackgroundRefillFactory().NewBucket("memory", "background_until", config.NewDefaultBucketConfig(""), false)
+	defer bucket.Destroy()
+	buckets.TestTakeUntil(t, bucket)
+}
+
+func TestLazyRefillByDefault(t *testing.T) {
+	if f := NewBucketFactoryWithRefill(RefillOptions{Interval: time.Second}).(*bucketFactory); f.refillInterval != 0 {
+		t.Errorf("Expected buckets to refill lazily, got a refill interval of %v", f.refillInterval)
+	}
+
+	if f := NewBucketFactoryWithRefill(RefillOptions{Strategy: RefillBackground}).(*bucketFactory); f.refillInterval != defaultRefillInterval {
+		t.Errorf("Expected a refill interval of %v, got %v", defaultRefillInterval, f.refillInterval)
+	}
+}
+
+func TestRefill(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		ramp       bool
+		at         time.Duration
+		tokens     int64
+		creditedTo time.Duration
+	}{
+		// A token every 100ms; the partial token accumulated stays towards the next.
+		{"partial", false, 250 * time.Millisecond, 4, 200 * time.Millisecond},
+		{"none", false, 50 * time.Millisecond, 2, 0},
+		// Filling up credits the time since, which would only add tokens beyond the size.
+		{"full", false, 2 * time.Second, 10, 2 * time.Second},
+		// Ramping from 10 to 100 tokens/sec over 10 seconds, 2.18 tokens accumulate over the first
+		// 200ms, the second of them whole after 184.7ms.
+		{"ramp", true, 200 * time.Millisecond, 4, 184 * time.Millisecond},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := config.NewDefaultBucketConfig("")
+			cfg.Size = 10
+			cfg.FillRate = 10
+			start := time.Unix(1000, 0)
+
+			if tc.ramp {
+				cfg.FillRate = 100
+				cfg.RampStartFillRate = 10
+				cfg.RampDurationMillis = 10000
+			}
+
+			// Not started, so the bucket's state can be inspected.
+			b := &tokenBucket{
+				cfg:                      cfg,
+				nanosBetweenTokens:       1e9 / cfg.FillRate,
+				ramp:                     newFillRateRamp(cfg, start),
+				accumulatedTokens:        2,
+				tokensNextAvailableNanos: start.UnixNano()}
+
+			b.refill(start.Add(tc.at).UnixNano())
+
+			if b.accumulatedTokens != tc.tokens {
+				t.Errorf("Expected %v tokens, got %v", tc.tokens, b.accumulatedTokens)
+			}
+
+			if credited := time.Duration(b.tokensNextAvailableNanos - start.UnixNano()); credited/time.Millisecond != tc.creditedTo/time.Millisecond {
+				t.Errorf("Expected tokens to be credited to %v, got %v", tc.creditedTo, credited)
+			}
+		})
+	}
+}
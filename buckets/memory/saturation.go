@@ -0,0 +1,155 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package memory
+
+import (
+	"time"
+)
+
+// saturationWindow is how far back memory buckets report their saturation over.
+const saturationWindow = time.Minute
+
+// saturationSlots is the number of slots the saturation window is split into. The window reported
+// over ends with the current slot, so is shorter by up to one slot while it fills.
+const saturationSlots = 10
+
+// saturation accounts for the time a bucket had no tokens available, over a rolling window. The
+// balance of a bucket only drops when tokens are claimed, so rather than sampling it, each change
+// to the balance records when the bucket will next have a token, and the time until then is known
+// to be spent empty unless the balance changes again. It is designed to run in a single event
+// loop and is not thread-safe.
+type saturation struct {
+	slotNanos int64
+	// emptyNanos are the nanos spent empty in each slot, for the slot numbered slotIndexes.
+	emptyNanos  [saturationSlots]int64
+	slotIndexes [saturationSlots]int64
+	// startNanos is when accounting started; younger buckets report over their lifetime.
+	startNanos int64
+	// emptySinceNanos and emptyUntilNanos span the latest spell without tokens, which may end in
+	// the future. emptyUntilNanos is 0 if there hasn't been one since it was last recorded.
+	emptySinceNanos, emptyUntilNanos int64
+}
+
+func newSaturation(window time.Duration, startNanos int64) *saturation {
+	slotNanos := int64(window / saturationSlots)
+	if slotNanos <= 0 {
+		slotNanos = 1
+	}
+
+	return &saturation{slotNanos: slotNanos, startNanos: startNanos}
+}
+
+func (s *saturation) copy() *saturation {
+	c := *s
+	return &c
+}
+
+// update records the balance of the bucket changing at a time, after which it has no tokens
+// available until emptyUntilNanos, or has some if that isn't later than the time.
+func (s *saturation) update(currentTimeNanos, emptyUntilNanos int64) {
+	empty := emptyUntilNanos > currentTimeNanos
+
+	if s.emptyUntilNanos > 0 {
+		if s.emptyUntilNanos >= currentTimeNanos {
+			// Still in the spell, which is extended or cut short.
+			if empty {
+				s.emptyUntilNanos = emptyUntilNanos
+				return
+			}
+
+			s.emptyUntilNanos = currentTimeNanos
+		}
+
+		s.record(s.emptySinceNanos, s.emptyUntilNanos)
+		s.emptyUntilNanos = 0
+	}
+
+	if empty {
+		s.emptySinceNanos, s.emptyUntilNanos = currentTimeNanos, emptyUntilNanos
+	}
+}
+
+// record adds the time between two times, spent empty, to the slots they fall in. Time before the
+// window ending at toNanos is left out.
+func (s *saturation) record(fromNanos, toNanos int64) {
+	if oldest := (toNanos/s.slotNanos - saturationSlots + 1) * s.slotNanos; fromNanos < oldest {
+		fromNanos = oldest
+	}
+
+	for fromNanos < toNanos {
+		index := fromNanos / s.slotNanos
+		end := min(toNanos, (index+1)*s.slotNanos)
+
+		slot := index % saturationSlots
+		if s.slotIndexes[slot] != index {
+			s.slotIndexes[slot] = index
+			s.emptyNanos[slot] = 0
+		}
+
+		s.emptyNanos[slot] += end - fromNanos
+		fromNanos = end
+	}
+}
+
+// fraction returns the fraction of the window ending at a time that was spent empty.
+func (s *saturation) fraction(currentTimeNanos int64) float64 {
+	current := currentTimeNanos / s.slotNanos
+	windowStartNanos := (current - saturationSlots + 1) * s.slotNanos
+	if windowStartNanos < s.startNanos {
+		windowStartNanos = s.startNanos
+	}
+
+	windowNanos := currentTimeNanos - windowStartNanos
+	if windowNanos <= 0 {
+		return 0
+	}
+
+	var emptyNanos int64
+	for i, index := range s.slotIndexes {
+		if index > current-saturationSlots && index <= current {
+			emptyNanos += s.emptyNanos[i]
+		}
+	}
+
+	// The latest spell, up to now, hasn't been recorded yet.
+	if s.emptyUntilNanos > 0 {
+		from := s.emptySinceNanos
+		if from < windowStartNanos {
+			from = windowStartNanos
+		}
+
+		if to := min(s.emptyUntilNanos, currentTimeNanos); to > from {
+			emptyNanos += to - from
+		}
+	}
+
+	if emptyNanos >= windowNanos {
+		return 1
+	}
+
+	return float64(emptyNanos) / float64(windowNanos)
+}
+
+// emptyUntilNanos returns when the bucket next has a token available at the fill rate, or a time
+// no later than the given one if it has one then. It is designed to run in a single event loop and
+// is not thread-safe.
+func (b *tokenBucket) emptyUntilNanos(currentTimeNanos int64) int64 {
+	available := b.bucketTokens(currentTimeNanos)
+	if available > 0 {
+		return currentTimeNanos
+	}
+
+	if tna := b.tokensNextAvailableNanos; b.accumulatedTokens == 0 {
+		// The next token is the one after those claimed until tna.
+		return tna + b.nanosBetweenTokensAt(tna)
+	}
+
+	return currentTimeNanos + (1-available)*b.nanosBetweenTokensAt(currentTimeNanos)
+}
+
+// trackSaturation records a change to the balance of the bucket at a time. It is designed to run
+// in a single event loop and is not thread-safe.
+func (b *tokenBucket) trackSaturation(currentTimeNanos int64) {
+	b.saturation.update(currentTimeNanos, b.emptyUntilNanos(currentTimeNanos))
+}
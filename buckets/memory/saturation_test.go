@@ -0,0 +1,154 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package memory
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/square/quotaservice"
+	"github.com/square/quotaservice/config"
+	pbconfig "github.com/square/quotaservice/protos/config"
+	"github.com/square/quotaservice/test/helpers"
+)
+
+func newSaturationConfig() *pbconfig.BucketConfig {
+	cfg := config.NewDefaultBucketConfig("")
+	// A token every 100ms.
+	cfg.Size = 10
+	cfg.FillRate = 10
+	return cfg
+}
+
+func expectSaturation(t *testing.T, bucket *tokenBucket, expected float64) {
+	t.Helper()
+
+	saturation, err := bucket.Saturation(context.Background())
+	helpers.CheckError(t, err)
+
+	if math.Abs(saturation-expected) > 1e-9 {
+		t.Errorf("Expected saturation %v, got %v", expected, saturation)
+	}
+}
+
+func TestSaturation(t *testing.T) {
+	// At the start of a saturation slot.
+	start := time.Unix(960, 0)
+	clock := &fakeClock{start}
+	bucket := newTokenBucket("memory", "saturation", newSaturationConfig(), false, clock.now, 0, nil)
+	defer bucket.Destroy()
+
+	expectSaturation(t, bucket, 0)
+
+	// Emptied, then empty until the next token 100ms later.
+	take(t, bucket, 10, time.Minute)
+	clock.t = start.Add(time.Second)
+	expectSaturation(t, bucket, 0.1)
+
+	// Emptied again once refilled, and in debt until 500ms later, so empty for 600ms.
+	clock.t = start.Add(2 * time.Second)
+	take(t, bucket, 10, time.Minute)
+	take(t, bucket, 5, time.Minute)
+
+	// Reported during the spell, so only up to now.
+	clock.t = start.Add(2*time.Second + 300*time.Millisecond)
+	expectSaturation(t, bucket, 0.4/2.3)
+
+	clock.t = start.Add(3 * time.Second)
+	expectSaturation(t, bucket, 0.7/3)
+
+	// Emptied again, and claiming tokens while in debt extends the spell.
+	take(t, bucket, 10, time.Minute)
+	take(t, bucket, 10, time.Minute)
+	clock.t = start.Add(4 * time.Second)
+	expectSaturation(t, bucket, 1.7/4)
+
+	// Returned tokens end it early.
+	helpers.CheckError(t, bucket.Return(context.Background(), 20))
+	expectSaturation(t, bucket, 1.7/4)
+	clock.t = start.Add(5 * time.Second)
+	expectSaturation(t, bucket, 1.7/5)
+}
+
+func TestSaturationWindow(t *testing.T) {
+	start := time.Unix(960, 0)
+	clock := &fakeClock{start}
+	bucket := newTokenBucket("memory", "saturation_window", newSaturationConfig(), false, clock.now, 0, nil)
+	defer bucket.Destroy()
+
+	// Kept empty for minutes by claiming the 10 tokens of each second ahead of their availability.
+	take(t, bucket, 20, time.Minute)
+	for i := 1; i <= 180; i++ {
+		clock.t = start.Add(time.Duration(i) * time.Second)
+		take(t, bucket, 10, time.Minute)
+	}
+
+	expectSaturation(t, bucket, 1)
+
+	// At the start of a slot, the window is the 54s of the 9 slots before it, starting 156s in. The
+	// bucket had a token again 181.1s in.
+	clock.t = start.Add(210 * time.Second)
+	expectSaturation(t, bucket, 25.1/54)
+
+	// Only the idle time is left in the window.
+	clock.t = clock.t.Add(saturationWindow)
+	expectSaturation(t, bucket, 0)
+}
+
+func TestSaturationReconfigure(t *testing.T) {
+	start := time.Unix(960, 0)
+	clock := &fakeClock{start}
+	bucket := newTokenBucket("memory", "saturation_reconfigure", newSaturationConfig(), false, clock.now, 0, nil)
+	defer bucket.Destroy()
+
+	take(t, bucket, 15, time.Minute)
+	clock.t = start.Add(time.Second)
+
+	reconfigured, _ := bucket.Reconfigure(newSaturationConfig())
+	defer reconfigured.Destroy()
+
+	// Empty for 600ms, before and after being reconfigured.
+	expectSaturation(t, reconfigured.(*tokenBucket), 0.6)
+}
+
+func TestServerSaturation(t *testing.T) {
+	cfg := config.NewDefaultServiceConfig()
+	ns := config.NewDefaultNamespaceConfig("ns")
+	b := newSaturationConfig()
+	b.Name = "b"
+	helpers.PanicError(config.AddBucket(ns, b))
+	helpers.PanicError(config.AddNamespace(cfg, ns))
+
+	start := time.Unix(960, 0)
+	clock := &fakeClock{start}
+	s := quotaservice.New(&bucketFactory{now: clock.now}, config.NewMemoryConfig(cfg),
+		quotaservice.NewReaperConfigForTests(), 0, &quotaservice.MockEndpoint{})
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer func() { _, _ = s.Stop() }()
+
+	_, _, err = s.(quotaservice.QuotaService).Allow(context.Background(), "ns", "b", 10, 0, false)
+	helpers.CheckError(t, err)
+	clock.t = start.Add(time.Second)
+
+	reported := -1.0
+	s.BucketSaturation(func(namespace, bucket string, dynamic bool, saturation float64) {
+		if namespace == "ns" && bucket == "b" {
+			reported = saturation
+		}
+	})
+
+	if math.Abs(reported-0.1) > 1e-9 {
+		t.Errorf("Expected saturation 0.1 to be reported, got %v", reported)
+	}
+
+	inspection, err := s.GetServerAdministrable().InspectBucket("ns", "b")
+	helpers.CheckError(t, err)
+
+	if inspection.Saturation == nil || math.Abs(*inspection.Saturation-0.1) > 1e-9 {
+		t.Errorf("Expected saturation 0.1 to be inspected, got %+v", inspection)
+	}
+}
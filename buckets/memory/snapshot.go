@@ -0,0 +1,245 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package memory
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/square/quotaservice"
+	"github.com/square/quotaservice/config"
+	"github.com/square/quotaservice/logging"
+)
+
+const (
+	defaultSnapshotInterval   = time.Minute
+	defaultMaxSnapshotBuckets = 10000
+	snapshotFormatVersion     = 1
+)
+
+// SnapshotOptions configures periodic snapshots of the balances of memory buckets, so limits survive
+// restarts of single-node deployments instead of every bucket starting full.
+type SnapshotOptions struct {
+	// Path is the file snapshots are written to, and restored from on startup.
+	Path string
+	// Interval is the time between snapshots. Defaults to 1 minute.
+	Interval time.Duration
+	// MaxBuckets caps the buckets in a snapshot, keeping those furthest below their size. Only
+	// buckets below their size are written, since the others start full anyway. Defaults to 10000.
+	MaxBuckets int
+}
+
+// SnapshottingBucketFactory is a memory BucketFactory snapshotting the balances of its buckets.
+type SnapshottingBucketFactory interface {
+	quotaservice.BucketFactory
+	// Snapshot writes a snapshot of the balances of the buckets now.
+	Snapshot() error
+	// Close stops periodic snapshots, writing a final one.
+	Close() error
+}
+
+// bucketSnapshot is the state of a bucket at a point in time. Tokens is negative if the bucket is
+// in debt.
+type bucketSnapshot struct {
+	Namespace string `json:"namespace"`
+	Bucket    string `json:"bucket"`
+	Tokens    int64  `json:"tokens"`
+	AtNanos   int64  `json:"atNanos"`
+	// Served is the tokens served towards the token cap in the window starting at ServedWindowNanos.
+	Served            int64 `json:"served,omitempty"`
+	ServedWindowNanos int64 `json:"servedWindowNanos,omitempty"`
+	// Windows are the balances of the rate windows below their size.
+	Windows []windowSnapshot `json:"windows,omitempty"`
+	// saturation is the bucket's saturation accounting, carried over when it is reconfigured but
+	// not written to snapshot files.
+	saturation *saturation
+}
+
+type snapshotFile struct {
+	Version int               `json:"version"`
+	Buckets []*bucketSnapshot `json:"buckets"`
+}
+
+// snapshotter tracks the buckets of a factory, writing and restoring their balances.
+type snapshotter struct {
+	opts     SnapshotOptions
+	buckets  map[string]*tokenBucket
+	restored map[string]*bucketSnapshot
+	stop     chan struct{}
+	stopped  sync.WaitGroup
+	started  bool
+	sync.Mutex
+}
+
+// NewBucketFactoryWithSnapshots creates a BucketFactory whose buckets' balances are snapshotted to
+// opts.Path periodically once the factory is initialized, and restored from it when buckets are
+// created. Restored balances are clamped to the current size of each bucket, in case the config
+// changed, and credited with the tokens they would have accumulated since the snapshot.
+func NewBucketFactoryWithSnapshots(opts SnapshotOptions) SnapshottingBucketFactory {
+	if opts.Interval <= 0 {
+		opts.Interval = defaultSnapshotInterval
+	}
+
+	if opts.MaxBuckets < 1 {
+		opts.MaxBuckets = defaultMaxSnapshotBuckets
+	}
+
+	s := &snapshotter{
+		opts:     opts,
+		buckets:  make(map[string]*tokenBucket),
+		restored: make(map[string]*bucketSnapshot),
+		stop:     make(chan struct{})}
+
+	if err := s.load(); err != nil {
+		logging.Printf("Unable to restore memory bucket snapshot from %v: %v", opts.Path, err)
+	}
+
+	return &bucketFactory{snapshots: s, now: time.Now}
+}
+
+func (bf *bucketFactory) Snapshot() error {
+	return bf.snapshots.write()
+}
+
+func (bf *bucketFactory) Close() error {
+	bf.snapshots.Lock()
+	started := bf.snapshots.started
+	bf.snapshots.started = false
+	bf.snapshots.Unlock()
+
+	if started {
+		close(bf.snapshots.stop)
+		bf.snapshots.stopped.Wait()
+	}
+
+	return bf.snapshots.write()
+}
+
+// start begins writing snapshots periodically, unless already started.
+func (s *snapshotter) start() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.started {
+		return
+	}
+
+	s.started = true
+	s.stopped.Add(1)
+
+	go func() {
+		defer s.stopped.Done()
+
+		ticker := time.NewTicker(s.opts.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.write(); err != nil {
+					logging.Printf("Unable to write memory bucket snapshot to %v: %v", s.opts.Path, err)
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (s *snapshotter) load() error {
+	b, err := ioutil.ReadFile(s.opts.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var f snapshotFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return errors.Wrap(err, "malformed snapshot")
+	}
+
+	if f.Version != snapshotFormatVersion {
+		return errors.Errorf("unknown snapshot version %v", f.Version)
+	}
+
+	for _, b := range f.Buckets {
+		s.restored[config.FullyQualifiedName(b.Namespace, b.Bucket)] = b
+	}
+
+	return nil
+}
+
+// restore returns the snapshot of a bucket restored on startup, or nil if there is none. Each is
+// only returned once, so buckets recreated later start afresh.
+func (s *snapshotter) restore(fullName string) *bucketSnapshot {
+	s.Lock()
+	defer s.Unlock()
+
+	restored := s.restored[fullName]
+	delete(s.restored, fullName)
+
+	return restored
+}
+
+// track adds a bucket to future snapshots.
+func (s *snapshotter) track(b *tokenBucket) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.buckets[b.fullName] = b
+}
+
+// forget removes a destroyed bucket from future snapshots, unless it has been replaced.
+func (s *snapshotter) forget(b *tokenBucket) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.buckets[b.fullName] == b {
+		delete(s.buckets, b.fullName)
+	}
+}
+
+// write snapshots the buckets below their size, or with rate windows below theirs, replacing the previous snapshot atomically so a
+// crash while writing leaves it intact.
+func (s *snapshotter) write() error {
+	s.Lock()
+	buckets := make([]*tokenBucket, 0, len(s.buckets))
+	for _, b := range s.buckets {
+		buckets = append(buckets, b)
+	}
+	s.Unlock()
+
+	snaps := make([]*bucketSnapshot, 0, len(buckets))
+	for _, b := range buckets {
+		if snap := b.snapshot(); snap != nil && (snap.Tokens < b.cfg.Size || len(snap.Windows) > 0) {
+			snaps = append(snaps, snap)
+		}
+	}
+
+	// Keep the buckets furthest below their size, which a restart would otherwise be most generous to.
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].Tokens < snaps[j].Tokens })
+	if len(snaps) > s.opts.MaxBuckets {
+		snaps = snaps[:s.opts.MaxBuckets]
+	}
+
+	b, err := json.Marshal(&snapshotFile{Version: snapshotFormatVersion, Buckets: snaps})
+	if err != nil {
+		return err
+	}
+
+	tmp := s.opts.Path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.opts.Path)
+}
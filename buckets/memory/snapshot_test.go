@@ -0,0 +1,169 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/square/quotaservice"
+	"github.com/square/quotaservice/config"
+	pbconfig "github.com/square/quotaservice/protos/config"
+	"github.com/square/quotaservice/test/helpers"
+)
+
+func newSnapshottingFactory(t *testing.T, path string, maxBuckets int, clock *fakeClock) *bucketFactory {
+	t.Helper()
+
+	f := NewBucketFactoryWithSnapshots(SnapshotOptions{Path: path, Interval: time.Hour, MaxBuckets: maxBuckets}).(*bucketFactory)
+	f.now = clock.now
+	f.Init(config.NewDefaultServiceConfig())
+
+	return f
+}
+
+func newSnapshotDir(t *testing.T) (string, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "snapshots")
+	helpers.CheckError(t, err)
+
+	return filepath.Join(dir, "buckets.json"), func() { _ = os.RemoveAll(dir) }
+}
+
+func snapshotBucketConfig(size int64) *pbconfig.BucketConfig {
+	cfg := config.NewDefaultBucketConfig("")
+	cfg.Size = size
+	cfg.FillRate = 10
+	return cfg
+}
+
+func take(t *testing.T, b quotaservice.Bucket, tokens int64, maxWait time.Duration) {
+	t.Helper()
+
+	if _, ok, err := b.Take(context.Background(), tokens, maxWait); !ok || err != nil {
+		t.Fatalf("Expected to take %v tokens, got %v, %v", tokens, ok, err)
+	}
+}
+
+func expectTokens(t *testing.T, f *bucketFactory, name string, cfg *pbconfig.BucketConfig, expected int64) {
+	t.Helper()
+
+	b := f.NewBucket("ns", name, cfg, false)
+	defer b.Destroy()
+
+	tokens, err := b.(*tokenBucket).Peek(context.Background())
+	helpers.CheckError(t, err)
+
+	if tokens != expected {
+		t.Errorf("Expected %v tokens in %v, got %v", expected, name, tokens)
+	}
+}
+
+func readSnapshot(t *testing.T, path string) *snapshotFile {
+	t.Helper()
+
+	b, err := ioutil.ReadFile(path)
+	helpers.CheckError(t, err)
+
+	var f snapshotFile
+	helpers.CheckError(t, json.Unmarshal(b, &f))
+	return &f
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	path, cleanup := newSnapshotDir(t)
+	defer cleanup()
+
+	clock := &fakeClock{time.Unix(1000, 0)}
+	cfg := snapshotBucketConfig(100)
+
+	f := newSnapshottingFactory(t, path, 0, clock)
+	take(t, f.NewBucket("ns", "partial", cfg, false), 60, 0)
+	debt := f.NewBucket("ns", "debt", cfg, false)
+	take(t, debt, 100, 0)
+	take(t, debt, 20, 5*time.Second)
+	helpers.CheckError(t, f.Close())
+
+	// Restarting 1 second later, the buckets have accumulated 10 tokens each since the snapshot.
+	clock.t = clock.t.Add(time.Second)
+	f = newSnapshottingFactory(t, path, 0, clock)
+	defer func() { _ = f.Close() }()
+
+	expectTokens(t, f, "partial", cfg, 50)
+	expectTokens(t, f, "debt", cfg, -10)
+	expectTokens(t, f, "untouched", cfg, 100)
+
+	// Restored balances are only used once; recreated buckets start full.
+	expectTokens(t, f, "partial", cfg, 100)
+}
+
+func TestSnapshotClampsToSize(t *testing.T) {
+	path, cleanup := newSnapshotDir(t)
+	defer cleanup()
+
+	clock := &fakeClock{time.Unix(1000, 0)}
+
+	f := newSnapshottingFactory(t, path, 0, clock)
+	take(t, f.NewBucket("ns", "shrunk", snapshotBucketConfig(100), false), 20, 0)
+	helpers.CheckError(t, f.Snapshot())
+
+	// The config changed to shrink the bucket below its snapshotted balance.
+	f = newSnapshottingFactory(t, path, 0, clock)
+	defer func() { _ = f.Close() }()
+
+	expectTokens(t, f, "shrunk", snapshotBucketConfig(50), 50)
+}
+
+func TestSnapshotBounded(t *testing.T) {
+	path, cleanup := newSnapshotDir(t)
+	defer cleanup()
+
+	clock := &fakeClock{time.Unix(1000, 0)}
+	cfg := snapshotBucketConfig(100)
+
+	f := newSnapshottingFactory(t, path, 2, clock)
+	defer func() { _ = f.Close() }()
+
+	f.NewBucket("ns", "full", cfg, false)
+	take(t, f.NewBucket("ns", "a", cfg, false), 10, 0)
+	take(t, f.NewBucket("ns", "b", cfg, false), 30, 0)
+	take(t, f.NewBucket("ns", "c", cfg, false), 20, 0)
+
+	// Destroyed buckets are no longer snapshotted.
+	destroyed := f.NewBucket("ns", "destroyed", cfg, false)
+	take(t, destroyed, 90, 0)
+	destroyed.Destroy()
+
+	helpers.CheckError(t, f.Snapshot())
+
+	// Only buckets below their size are written, those furthest below it first.
+	s := readSnapshot(t, path)
+	if s.Version != snapshotFormatVersion || len(s.Buckets) != 2 {
+		t.Fatalf("Expected 2 buckets in the snapshot, got %+v", s)
+	}
+
+	if s.Buckets[0].Bucket != "b" || s.Buckets[0].Tokens != 70 || s.Buckets[1].Bucket != "c" || s.Buckets[1].Tokens != 80 {
+		t.Errorf("Expected buckets b and c in the snapshot, got %+v, %+v", s.Buckets[0], s.Buckets[1])
+	}
+}
+
+func TestSnapshotMalformed(t *testing.T) {
+	path, cleanup := newSnapshotDir(t)
+	defer cleanup()
+
+	helpers.CheckError(t, ioutil.WriteFile(path, []byte("{"), 0644))
+
+	// A snapshot that can't be restored is ignored, and every bucket starts full.
+	clock := &fakeClock{time.Unix(1000, 0)}
+	f := newSnapshottingFactory(t, path, 0, clock)
+	defer func() { _ = f.Close() }()
+
+	expectTokens(t, f, "b", snapshotBucketConfig(100), 100)
+}
@@ -0,0 +1,128 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package memory
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/square/quotaservice"
+	"github.com/square/quotaservice/config"
+	pbconfig "github.com/square/quotaservice/protos/config"
+	"github.com/square/quotaservice/test/helpers"
+)
+
+func stateTestConfig() *pbconfig.ServiceConfig {
+	cfg := config.NewDefaultServiceConfig()
+	ns := config.NewDefaultNamespaceConfig("ns")
+
+	b := config.NewDefaultBucketConfig("static")
+	b.Size, b.FillRate = 10, 1
+	helpers.PanicError(config.AddBucket(ns, b))
+
+	template := config.NewDefaultBucketConfig("")
+	template.Size, template.FillRate = 10, 1
+	config.SetDynamicBucketTemplate(ns, template)
+
+	helpers.PanicError(config.AddNamespace(cfg, ns))
+	return cfg
+}
+
+func startStateTestServer(t *testing.T, cfg *pbconfig.ServiceConfig, clock *fakeClock) quotaservice.Server {
+	t.Helper()
+
+	s := quotaservice.New(&bucketFactory{now: clock.now}, config.NewMemoryConfig(cfg),
+		quotaservice.NewReaperConfigForTests(), 0, &quotaservice.MockEndpoint{})
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+
+	return s
+}
+
+func availableTokens(t *testing.T, s quotaservice.Server, name string) int64 {
+	t.Helper()
+
+	inspection, err := s.GetServerAdministrable().InspectBucket("ns", name)
+	helpers.CheckError(t, err)
+	if inspection == nil || inspection.AvailableTokens == nil {
+		t.Fatalf("Expected bucket %v to report its tokens, got %+v", name, inspection)
+	}
+
+	return *inspection.AvailableTokens
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	clock := &fakeClock{time.Unix(1000, 0)}
+	production := startStateTestServer(t, stateTestConfig(), clock)
+	defer func() { _, _ = production.Stop() }()
+
+	ctx := context.Background()
+	for name, tokens := range map[string]int64{"static": 8, "dynamic": 10} {
+		_, _, err := production.(quotaservice.QuotaService).Allow(ctx, "ns", name, tokens, 0, false)
+		helpers.CheckError(t, err)
+	}
+
+	state, err := production.DumpBucketState()
+	helpers.CheckError(t, err)
+
+	// Replayed later, on a clock set back to when the state was dumped.
+	replayClock := &fakeClock{clock.t}
+	replay := startStateTestServer(t, stateTestConfig(), replayClock)
+	defer func() { _, _ = replay.Stop() }()
+
+	helpers.CheckError(t, replay.LoadBucketState(state))
+
+	for _, name := range []string{"static", "dynamic"} {
+		if expected, loaded := availableTokens(t, production, name), availableTokens(t, replay, name); loaded != expected {
+			t.Errorf("Expected %v to have %v tokens once loaded, got %v", name, expected, loaded)
+		}
+	}
+
+	// Both go into debt alike, and refill alike as time passes.
+	for _, s := range []quotaservice.Server{production, replay} {
+		_, _, err := s.(quotaservice.QuotaService).Allow(ctx, "ns", "dynamic", 1, 0, false)
+		helpers.CheckError(t, err)
+	}
+
+	if expected, loaded := availableTokens(t, production, "dynamic"), availableTokens(t, replay, "dynamic"); expected >= 0 || loaded != expected {
+		t.Errorf("Expected the drained dynamic bucket to go into debt alike once loaded, got %v and %v", expected, loaded)
+	}
+
+	clock.t = clock.t.Add(2 * time.Second)
+	replayClock.t = replayClock.t.Add(2 * time.Second)
+
+	for _, name := range []string{"static", "dynamic"} {
+		if expected, loaded := availableTokens(t, production, name), availableTokens(t, replay, name); loaded != expected {
+			t.Errorf("Expected %v to have refilled to %v tokens, got %v", name, expected, loaded)
+		}
+	}
+}
+
+func TestLoadStateErrors(t *testing.T) {
+	clock := &fakeClock{time.Unix(1000, 0)}
+	s := startStateTestServer(t, stateTestConfig(), clock)
+	defer func() { _, _ = s.Stop() }()
+
+	if err := s.LoadBucketState([]byte("not json")); err == nil {
+		t.Error("Expected malformed state to be refused")
+	}
+
+	if err := s.LoadBucketState([]byte(`{"version": 2, "buckets": []}`)); err == nil {
+		t.Error("Expected an unknown state version to be refused")
+	}
+
+	// Buckets missing from the server aren't loaded, but the others are.
+	err := s.LoadBucketState([]byte(`{"version": 1, "buckets": [
+		{"namespace": "ns", "bucket": "static", "tokens": 3, "atNanos": 1000000000000},
+		{"namespace": "other", "bucket": "missing", "tokens": 3, "atNanos": 1000000000000}]}`))
+	if err == nil || !strings.Contains(err.Error(), "other:missing") || strings.Contains(err.Error(), "ns:static") {
+		t.Errorf("Expected only the missing bucket to fail loading, got %v", err)
+	}
+
+	if tokens := availableTokens(t, s, "static"); tokens != 3 {
+		t.Errorf("Expected the static bucket's state to be loaded, got %v tokens", tokens)
+	}
+}
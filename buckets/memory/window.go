@@ -0,0 +1,183 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package memory
+
+import (
+	pbconfig "github.com/square/quotaservice/protos/config"
+)
+
+// rateWindow is the state of one of a bucket's rate windows, a bucket of its own of the window's
+// tokens, refilling evenly over the window. All times are in nanos since the epoch.
+type rateWindow struct {
+	windowMillis, size, nanosBetweenTokens int64
+	tokensNextAvailableNanos               int64
+	accumulatedTokens                      int64
+}
+
+// windowSnapshot is the balance of a rate window in a bucketSnapshot, negative if it is in debt.
+type windowSnapshot struct {
+	WindowMillis int64 `json:"windowMillis"`
+	Tokens       int64 `json:"tokens"`
+}
+
+// newRateWindows creates the rate windows configured on a bucket, full, or returns nil if the bucket
+// has none.
+func newRateWindows(cfg *pbconfig.BucketConfig) []rateWindow {
+	var windows []rateWindow
+	for _, w := range cfg.RateWindows {
+		if w.Tokens <= 0 || w.WindowMillis <= 0 {
+			continue
+		}
+
+		nanosBetweenTokens := w.WindowMillis * 1e6 / w.Tokens
+		if nanosBetweenTokens < 1 {
+			nanosBetweenTokens = 1
+		}
+
+		windows = append(windows, rateWindow{
+			windowMillis:       w.WindowMillis,
+			size:               w.Tokens,
+			nanosBetweenTokens: nanosBetweenTokens,
+			accumulatedTokens:  w.Tokens})
+	}
+
+	return windows
+}
+
+// refill credits the tokens the window accumulated by a time, keeping the time towards the next one
+// unless the window fills up, since the windows of long periods accumulate tokens slowly.
+func (w *rateWindow) refill(nanos int64) {
+	if nanos <= w.tokensNextAvailableNanos {
+		return
+	}
+
+	freshTokens := (nanos - w.tokensNextAvailableNanos) / w.nanosBetweenTokens
+	if w.accumulatedTokens+freshTokens >= w.size {
+		w.accumulatedTokens = w.size
+		w.tokensNextAvailableNanos = nanos
+		return
+	}
+
+	w.accumulatedTokens += freshTokens
+	w.tokensNextAvailableNanos += freshTokens * w.nanosBetweenTokens
+}
+
+// claim computes the wait for tokens requested from the window at a time, and the state of the
+// window once they are claimed, without changing it.
+func (w rateWindow) claim(requested, nanos int64) (waitTimeNanos int64, claimed rateWindow) {
+	w.refill(nanos)
+
+	if w.tokensNextAvailableNanos > nanos {
+		waitTimeNanos = w.tokensNextAvailableNanos - nanos
+	}
+
+	accumulatedTokensUsed := min(w.accumulatedTokens, requested)
+	// Tokens waited for accumulate from the time kept towards the next one.
+	w.tokensNextAvailableNanos += (requested - accumulatedTokensUsed) * w.nanosBetweenTokens
+	w.accumulatedTokens -= accumulatedTokensUsed
+
+	return waitTimeNanos, w
+}
+
+// returnTokens settles the window's debt with tokens returned at a time, before adding them to its
+// balance, up to its size.
+func (w *rateWindow) returnTokens(tokens, nanos int64) {
+	w.refill(nanos)
+
+	if debtNanos := w.tokensNextAvailableNanos - nanos; debtNanos > 0 {
+		if settledNanos := tokens * w.nanosBetweenTokens; settledNanos < debtNanos {
+			w.tokensNextAvailableNanos -= settledNanos
+			return
+		}
+
+		tokens -= debtNanos / w.nanosBetweenTokens
+		w.tokensNextAvailableNanos = nanos
+	}
+
+	w.accumulatedTokens = min(w.size, w.accumulatedTokens+tokens)
+}
+
+// availableTokens returns the tokens that could be claimed from the window at a time without
+// waiting, negative if it is in debt.
+func (w rateWindow) availableTokens(nanos int64) int64 {
+	w.refill(nanos)
+
+	if debtNanos := w.tokensNextAvailableNanos - nanos; debtNanos > 0 {
+		return w.accumulatedTokens - debtNanos/w.nanosBetweenTokens
+	}
+
+	return w.accumulatedTokens
+}
+
+// restore sets the balance of the window from a snapshot taken at a time, clamped to its size, with
+// tokens accumulating from then on.
+func (w *rateWindow) restore(snap windowSnapshot, atNanos int64) {
+	tokens := min(snap.Tokens, w.size)
+	w.tokensNextAvailableNanos = atNanos
+
+	if tokens >= 0 {
+		w.accumulatedTokens = tokens
+	} else {
+		w.accumulatedTokens = 0
+		w.tokensNextAvailableNanos += -tokens * w.nanosBetweenTokens
+	}
+}
+
+// claimWindows computes the wait for tokens requested at a time from each of the bucket's rate
+// windows, returning the longest, and the windows' states once the tokens are claimed, without
+// changing them. withinDebt is false if any window would be in more than max_debt_millis of debt.
+// It is designed to run in a single event loop and is not thread-safe.
+func (b *tokenBucket) claimWindows(requested, currentTimeNanos int64) (waitTimeNanos int64, claimed []rateWindow, withinDebt bool) {
+	if len(b.windows) == 0 {
+		return 0, nil, true
+	}
+
+	withinDebt = true
+	claimed = make([]rateWindow, len(b.windows))
+	for i, w := range b.windows {
+		var windowWaitNanos int64
+		windowWaitNanos, claimed[i] = w.claim(requested, currentTimeNanos)
+		waitTimeNanos = maxNanos(waitTimeNanos, windowWaitNanos)
+
+		if claimed[i].tokensNextAvailableNanos-currentTimeNanos > b.cfg.MaxDebtMillis*1e6 {
+			withinDebt = false
+		}
+	}
+
+	return waitTimeNanos, claimed, withinDebt
+}
+
+// windowSnapshots returns the balances of the bucket's rate windows below their size at a time, the
+// others being full when restored anyway. It is designed to run in a single event loop and is not
+// thread-safe.
+func (b *tokenBucket) windowSnapshots(nanos int64) []windowSnapshot {
+	var snaps []windowSnapshot
+	for _, w := range b.windows {
+		if tokens := w.availableTokens(nanos); tokens < w.size {
+			snaps = append(snaps, windowSnapshot{WindowMillis: w.windowMillis, Tokens: tokens})
+		}
+	}
+
+	return snaps
+}
+
+// restoreWindows sets the balances of the bucket's rate windows from a snapshot, matching windows
+// by their length, so a window given more or fewer tokens keeps its balance, clamped to its size.
+// It is designed to run in a single event loop and is not thread-safe.
+func (b *tokenBucket) restoreWindows(snap *bucketSnapshot) {
+	for _, ws := range snap.Windows {
+		for i := range b.windows {
+			if b.windows[i].windowMillis == ws.WindowMillis {
+				b.windows[i].restore(ws, snap.AtNanos)
+			}
+		}
+	}
+}
+
+func maxNanos(x, y int64) int64 {
+	if x > y {
+		return x
+	}
+	return y
+}
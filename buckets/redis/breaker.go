@@ -0,0 +1,176 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package redis
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/square/quotaservice"
+	"github.com/square/quotaservice/events"
+	"github.com/square/quotaservice/logging"
+)
+
+// ErrCircuitOpen is returned by buckets while the circuit breaker in front of Redis is open, unless
+// a fallback is configured.
+var ErrCircuitOpen = errors.New("redis circuit breaker is open")
+
+const (
+	defaultBreakerCooldown = 5 * time.Second
+	breakerBackend         = "redis"
+)
+
+// BreakerOptions configures a circuit breaker in front of Redis, so buckets stop adding the latency
+// of a degraded Redis to every request. After FailureThreshold consecutive failures the breaker
+// opens, short-circuiting calls for Cooldown. It then half-opens, letting one call at a time
+// through to probe Redis, and closes again after ProbeSuccesses of them succeed. A failed probe
+// opens it again. The breaker is disabled unless FailureThreshold is set.
+type BreakerOptions struct {
+	// FailureThreshold is the number of consecutive failed calls to Redis opening the breaker.
+	FailureThreshold int
+	// SlowCallThreshold counts calls taking longer as failures, even if they succeed. Disabled if
+	// unset, in which case only errors, including the client's timeouts, count.
+	SlowCallThreshold time.Duration
+	// Cooldown is how long the breaker stays open before probing Redis. Defaults to 5 seconds.
+	Cooldown time.Duration
+	// ProbeSuccesses is the number of consecutive successful probes closing the breaker. Defaults
+	// to 1.
+	ProbeSuccesses int
+	// Fallback creates buckets serving requests locally while the breaker is open, such as
+	// memory.NewBucketFactory(). Each node then enforces the full limit of every bucket by itself.
+	// If unset, requests fail fast with ErrCircuitOpen instead.
+	Fallback quotaservice.BucketFactory
+}
+
+// circuitBreaker tracks the health of Redis according to BreakerOptions. A nil *circuitBreaker
+// lets every call through.
+type circuitBreaker struct {
+	opts      BreakerOptions
+	state     events.CircuitState
+	failures  int
+	successes int
+	openedAt  time.Time
+	probing   bool
+	now       func() time.Time
+	emit      func(events.Event)
+	sync.Mutex
+}
+
+// newCircuitBreaker creates a circuit breaker, or returns nil if opts disable it.
+func newCircuitBreaker(opts BreakerOptions) *circuitBreaker {
+	if opts.FailureThreshold < 1 {
+		return nil
+	}
+
+	if opts.Cooldown <= 0 {
+		opts.Cooldown = defaultBreakerCooldown
+	}
+
+	if opts.ProbeSuccesses < 1 {
+		opts.ProbeSuccesses = 1
+	}
+
+	return &circuitBreaker{opts: opts, now: time.Now}
+}
+
+// allow returns whether a call may go through to Redis. Every call allowed must be followed by
+// a call to record with its outcome.
+func (c *circuitBreaker) allow() bool {
+	if c == nil {
+		return true
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	switch c.state {
+	case events.CircuitOpen:
+		if c.now().Sub(c.openedAt) < c.opts.Cooldown {
+			return false
+		}
+
+		c.transitionLocked(events.CircuitHalfOpen)
+		c.probing = true
+		return true
+	case events.CircuitHalfOpen:
+		if c.probing {
+			// Only one probe at a time.
+			return false
+		}
+
+		c.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// record the outcome of a call allowed through to Redis.
+func (c *circuitBreaker) record(err error, elapsed time.Duration) {
+	if c == nil {
+		return
+	}
+
+	failed := err != nil || (c.opts.SlowCallThreshold > 0 && elapsed > c.opts.SlowCallThreshold)
+
+	c.Lock()
+	defer c.Unlock()
+
+	switch c.state {
+	case events.CircuitClosed:
+		if !failed {
+			c.failures = 0
+		} else if c.failures++; c.failures >= c.opts.FailureThreshold {
+			c.transitionLocked(events.CircuitOpen)
+		}
+	case events.CircuitHalfOpen:
+		c.probing = false
+		if failed {
+			c.transitionLocked(events.CircuitOpen)
+		} else if c.successes++; c.successes >= c.opts.ProbeSuccesses {
+			c.transitionLocked(events.CircuitClosed)
+		}
+	}
+
+	// Calls completing while open were allowed before the breaker opened, so are ignored.
+}
+
+func (c *circuitBreaker) transitionLocked(state events.CircuitState) {
+	logging.Printf("Redis circuit breaker changed from %v to %v", c.state, state)
+
+	c.state = state
+	c.failures = 0
+	c.successes = 0
+	if state == events.CircuitOpen {
+		c.openedAt = c.now()
+	}
+
+	if c.emit != nil {
+		c.emit(events.NewCircuitBreakerEvent(breakerBackend, state))
+	}
+}
+
+// State returns the current state of the breaker.
+func (c *circuitBreaker) State() events.CircuitState {
+	if c == nil {
+		return events.CircuitClosed
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	return c.state
+}
+
+func (c *circuitBreaker) setEmitter(emit func(events.Event)) {
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.emit = emit
+}
@@ -0,0 +1,203 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package redis
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+
+	"github.com/square/quotaservice/buckets/memory"
+	"github.com/square/quotaservice/config"
+	"github.com/square/quotaservice/events"
+)
+
+var errRedis = errors.New("redis is down")
+
+type breakerClock struct {
+	t time.Time
+}
+
+func (c *breakerClock) now() time.Time {
+	return c.t
+}
+
+func newTestBreaker(opts BreakerOptions) (*circuitBreaker, *breakerClock, *[]events.CircuitState) {
+	clock := &breakerClock{time.Unix(1000, 0)}
+	b := newCircuitBreaker(opts)
+	b.now = clock.now
+
+	var states []events.CircuitState
+	b.setEmitter(func(e events.Event) {
+		states = append(states, e.(events.CircuitBreakerEvent).State())
+	})
+
+	return b, clock, &states
+}
+
+func expectBreakerState(t *testing.T, b *circuitBreaker, expected events.CircuitState) {
+	t.Helper()
+
+	if s := b.State(); s != expected {
+		t.Fatalf("Expected breaker to be %v, was %v", expected, s)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	b, clock, states := newTestBreaker(BreakerOptions{FailureThreshold: 3, Cooldown: 10 * time.Second, ProbeSuccesses: 2})
+
+	// Failures must be consecutive to open the breaker.
+	for _, err := range []error{errRedis, errRedis, nil, errRedis, errRedis} {
+		if !b.allow() {
+			t.Fatal("Expected a closed breaker to allow calls")
+		}
+
+		b.record(err, 0)
+	}
+
+	expectBreakerState(t, b, events.CircuitClosed)
+
+	b.allow()
+	b.record(errRedis, 0)
+	expectBreakerState(t, b, events.CircuitOpen)
+
+	if b.allow() {
+		t.Fatal("Expected an open breaker to short-circuit calls")
+	}
+
+	// After the cooldown, one probe at a time is let through.
+	clock.t = clock.t.Add(10 * time.Second)
+	if !b.allow() {
+		t.Fatal("Expected a probe to be allowed after the cooldown")
+	}
+
+	expectBreakerState(t, b, events.CircuitHalfOpen)
+
+	if b.allow() {
+		t.Fatal("Expected one probe at a time")
+	}
+
+	// A failed probe opens the breaker again.
+	b.record(errRedis, 0)
+	expectBreakerState(t, b, events.CircuitOpen)
+
+	if b.allow() {
+		t.Fatal("Expected the cooldown to restart")
+	}
+
+	clock.t = clock.t.Add(10 * time.Second)
+	for i := 0; i < 2; i++ {
+		if !b.allow() {
+			t.Fatalf("Expected probe %v to be allowed", i)
+		}
+
+		b.record(nil, 0)
+	}
+
+	expectBreakerState(t, b, events.CircuitClosed)
+
+	expected := []events.CircuitState{events.CircuitOpen, events.CircuitHalfOpen, events.CircuitOpen, events.CircuitHalfOpen, events.CircuitClosed}
+	if len(*states) != len(expected) {
+		t.Fatalf("Expected state changes %v, got %v", expected, *states)
+	}
+
+	for i, s := range expected {
+		if (*states)[i] != s {
+			t.Errorf("Expected state changes %v, got %v", expected, *states)
+		}
+	}
+}
+
+func TestCircuitBreakerSlowCalls(t *testing.T) {
+	b, _, _ := newTestBreaker(BreakerOptions{FailureThreshold: 2, SlowCallThreshold: 100 * time.Millisecond})
+
+	b.allow()
+	b.record(nil, 50*time.Millisecond)
+	b.allow()
+	b.record(nil, 200*time.Millisecond)
+	expectBreakerState(t, b, events.CircuitClosed)
+
+	b.allow()
+	b.record(nil, time.Second)
+	expectBreakerState(t, b, events.CircuitOpen)
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	b := newCircuitBreaker(BreakerOptions{})
+	if b != nil {
+		t.Fatal("Expected no breaker without a failure threshold")
+	}
+
+	b.record(errRedis, 0)
+	if !b.allow() || b.State() != events.CircuitClosed {
+		t.Fatal("Expected a disabled breaker to allow every call")
+	}
+}
+
+// newUnreachableFactory creates a factory pointing at an address Redis isn't listening on.
+func newUnreachableFactory(opts BreakerOptions) *bucketFactory {
+	f := NewBucketFactoryWithBreaker(&redis.Options{Addr: "localhost:1", MaxRetries: 0}, 1, 0, opts).(*bucketFactory)
+	f.Init(config.NewDefaultServiceConfig())
+	return f
+}
+
+func TestCircuitBreakerFailFast(t *testing.T) {
+	f := newUnreachableFactory(BreakerOptions{FailureThreshold: 2, Cooldown: time.Minute})
+	defer func() { _ = f.client.Close() }()
+
+	b := f.NewBucket("ns", "b", config.NewDefaultBucketConfig("b"), false)
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := b.Take(context.Background(), 1, 0); err == nil || err == ErrCircuitOpen {
+			t.Fatalf("Expected an error from Redis, got %v", err)
+		}
+	}
+
+	if s := f.BreakerState(); s != events.CircuitOpen {
+		t.Fatalf("Expected the breaker to open, was %v", s)
+	}
+
+	if _, _, err := b.Take(context.Background(), 1, 0); err != ErrCircuitOpen {
+		t.Fatalf("Expected %v, got %v", ErrCircuitOpen, err)
+	}
+}
+
+func TestCircuitBreakerFallback(t *testing.T) {
+	f := newUnreachableFactory(BreakerOptions{FailureThreshold: 1, Cooldown: time.Minute, Fallback: memory.NewBucketFactory()})
+	defer func() { _ = f.client.Close() }()
+
+	var emitted []events.Event
+	f.SetEventEmitter(func(e events.Event) {
+		emitted = append(emitted, e)
+	})
+
+	cfg := config.NewDefaultBucketConfig("b")
+	cfg.Size = 3
+	cfg.FillRate = 1
+	b := f.NewBucket("ns", "b", cfg, false)
+	defer b.Destroy()
+
+	if _, _, err := b.Take(context.Background(), 1, 0); err == nil {
+		t.Fatal("Expected an error from Redis")
+	}
+
+	// The fallback bucket serves requests, enforcing the bucket's limits locally. Once its tokens
+	// run out, the next is claimed ahead of its availability, and the one after that would wait.
+	for i := 0; i < 4; i++ {
+		if _, ok, err := b.Take(context.Background(), 1, 0); !ok || err != nil {
+			t.Fatalf("Expected the fallback to serve tokens, got %v, %v", ok, err)
+		}
+	}
+
+	if _, ok, _ := b.Take(context.Background(), 1, 0); ok {
+		t.Fatal("Expected the fallback to run out of tokens")
+	}
+
+	if len(emitted) != 1 || emitted[0].EventType() != events.EVENT_CIRCUIT_BREAKER_STATE_CHANGED {
+		t.Fatalf("Expected an event for the breaker opening, got %v", emitted)
+	}
+}
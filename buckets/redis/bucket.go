@@ -8,6 +8,7 @@ package redis
 import (
 	"context"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis"
@@ -15,6 +16,8 @@ import (
 	"github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
 	"github.com/square/quotaservice"
+	"github.com/square/quotaservice/config"
+	"github.com/square/quotaservice/events"
 	"github.com/square/quotaservice/logging"
 	pbconfig "github.com/square/quotaservice/protos/config"
 )
@@ -26,6 +29,11 @@ type configAttributes struct {
 	maxTokensToAccumulate       string
 	maxIdleTimeMillis           string
 	maxDebtNanos                string
+	overdraftNanos              string
+	tokenCap                    string
+	tokenCapWindowMillis        string
+	rateWindows                 []interface{}
+	params                      bucketParams
 	*quotaservice.DefaultBucket // Extension for default methods on interface
 }
 
@@ -35,6 +43,13 @@ type abstractBucket struct {
 	cfg     *pbconfig.BucketConfig
 	factory *bucketFactory
 	keys    []string
+
+	namespace, name string
+	dynamic         bool
+
+	// fallback serves requests while the circuit breaker is open, created when first needed.
+	fallback     quotaservice.Bucket
+	fallbackLock sync.Mutex
 }
 
 func (a *abstractBucket) Config() *pbconfig.BucketConfig {
@@ -42,17 +57,28 @@ func (a *abstractBucket) Config() *pbconfig.BucketConfig {
 }
 
 func (a *abstractBucket) Take(ctx context.Context, requested int64, maxWaitTime time.Duration) (time.Duration, bool, error) {
-	maxIdleTimeMillis := a.maxIdleTimeMillis
-	if a.maxIdleTimeMillis == "0" {
-		// bucket MaxIdleMillis was not set; fall back to factory setting
-		maxIdleTimeMillis = strconv.FormatInt(int64(a.factory.keyMaxIdleTime/time.Millisecond), 10)
+	if maxTokens := config.MaxTokensAtOnce(a.cfg); requested > maxTokens {
+		return 0, false, &quotaservice.TooManyTokensError{MaxTokens: maxTokens}
+	}
+
+	args := a.scriptArgs(requested, maxWaitTime)
+
+	if !a.factory.breaker.allow() {
+		if fallback := a.fallbackBucket(); fallback != nil {
+			return fallback.Take(ctx, requested, maxWaitTime)
+		}
+
+		return 0, false, ErrCircuitOpen
 	}
-	args := []interface{}{a.nanosBetweenTokens, a.maxTokensToAccumulate,
-		strconv.FormatInt(requested, 10), strconv.FormatInt(maxWaitTime.Nanoseconds(), 10),
-		maxIdleTimeMillis, a.maxDebtNanos}
 
 	client := a.factory.Client().(*redis.Client)
+	start := time.Now()
 	res := a.takeFromRedis(ctx, client, args)
+	a.factory.breaker.record(res.Err(), time.Since(start))
+	if cache := a.factory.clientCache(); cache != nil {
+		// Peeks and probes following the Take needn't wait for Redis to invalidate the balance.
+		cache.invalidate(a.keys[0])
+	}
 	if err := res.Err(); err != nil {
 		if isRedisClientClosedError(err) {
 			logging.Print("Failed to take token from redis because the client was closed, reconnecting")
@@ -65,6 +91,12 @@ func (a *abstractBucket) Take(ctx context.Context, requested int64, maxWaitTime
 	switch val := res.Val().(type) {
 	case int64:
 		waitTime = time.Nanosecond * time.Duration(val)
+	case []interface{}:
+		if len(val) != 1 {
+			return 0, false, errors.Errorf("unknown response %v", val)
+		}
+
+		return 0, false, a.capReachedError(val[0])
 	default:
 		return 0, false, errors.Errorf("unknown response of type %[1]T: %[1]v", val)
 	}
@@ -77,6 +109,176 @@ func (a *abstractBucket) Take(ctx context.Context, requested int64, maxWaitTime
 	return waitTime, true, nil
 }
 
+// scriptArgs returns the arguments of luaScript and probeScript.
+func (a *abstractBucket) scriptArgs(requested int64, maxWaitTime time.Duration) []interface{} {
+	maxIdleTimeMillis := a.maxIdleTimeMillis
+	if a.maxIdleTimeMillis == "0" {
+		// bucket MaxIdleMillis was not set; fall back to factory setting
+		maxIdleTimeMillis = strconv.FormatInt(int64(a.factory.keyMaxIdleTime/time.Millisecond), 10)
+	}
+
+	args := []interface{}{a.nanosBetweenTokens, a.maxTokensToAccumulate,
+		strconv.FormatInt(requested, 10), strconv.FormatInt(maxWaitTime.Nanoseconds(), 10),
+		maxIdleTimeMillis, a.maxDebtNanos, a.overdraftNanos, a.tokenCap, a.tokenCapWindowMillis}
+
+	return append(args, a.rateWindows...)
+}
+
+// TakeUntil implements quotaservice.DeadlineTaker. The time left before the deadline is measured
+// just before the request is sent to Redis, or to the fallback bucket.
+func (a *abstractBucket) TakeUntil(ctx context.Context, requested int64, deadline time.Time) (time.Duration, bool, error) {
+	return a.Take(ctx, requested, quotaservice.MaxWaitUntil(deadline))
+}
+
+// Peek implements quotaservice.Peeker.
+func (a *abstractBucket) Peek(ctx context.Context) (int64, error) {
+	if s, redisNanos := a.cachedState(); s != nil {
+		return s.peek(&a.params, redisNanos), nil
+	}
+
+	if !a.factory.breaker.allow() {
+		if p, ok := a.fallbackBucket().(quotaservice.Peeker); ok {
+			return p.Peek(ctx)
+		}
+
+		return 0, ErrCircuitOpen
+	}
+
+	span, _ := opentracing.StartSpanFromContext(ctx, "peekScript.Run")
+	defer span.Finish()
+
+	client := a.factory.Client().(*redis.Client)
+	start := time.Now()
+	args := append([]interface{}{a.nanosBetweenTokens, a.maxTokensToAccumulate}, a.rateWindows...)
+	res := a.factory.peekScript.Run(client, a.keys, args...)
+	a.factory.breaker.record(res.Err(), time.Since(start))
+	if err := res.Err(); err != nil {
+		return 0, errors.Wrap(err, "failed to peek at redis bucket")
+	}
+
+	tokens, ok := res.Val().(int64)
+	if !ok {
+		return 0, errors.Errorf("unknown response of type %[1]T: %[1]v", res.Val())
+	}
+
+	return tokens, nil
+}
+
+// Probe implements quotaservice.Prober, running the arithmetic of Take in Redis without storing
+// its result.
+func (a *abstractBucket) Probe(ctx context.Context, requested int64, maxWaitTime time.Duration) (time.Duration, bool, error) {
+	if maxTokens := config.MaxTokensAtOnce(a.cfg); requested > maxTokens {
+		return 0, false, &quotaservice.TooManyTokensError{MaxTokens: maxTokens}
+	}
+
+	if s, redisNanos := a.cachedState(); s != nil {
+		waitNanos, granted, capReached, capWindowEnd := s.probe(&a.params, requested, maxWaitTime.Nanoseconds(), redisNanos)
+		if capReached {
+			return 0, false, a.capReachedError(capWindowEnd)
+		}
+
+		return time.Duration(waitNanos), granted, nil
+	}
+
+	if !a.factory.breaker.allow() {
+		if p, ok := a.fallbackBucket().(quotaservice.Prober); ok {
+			return p.Probe(ctx, requested, maxWaitTime)
+		}
+
+		return 0, false, ErrCircuitOpen
+	}
+
+	span, _ := opentracing.StartSpanFromContext(ctx, "probeScript.Run")
+	defer span.Finish()
+
+	client := a.factory.Client().(*redis.Client)
+	start := time.Now()
+	res := a.factory.probeScript.Run(client, a.keys, a.scriptArgs(requested, maxWaitTime)...)
+	a.factory.breaker.record(res.Err(), time.Since(start))
+	if err := res.Err(); err != nil {
+		return 0, false, errors.Wrap(err, "failed to probe redis bucket")
+	}
+
+	vals, ok := res.Val().([]interface{})
+	if !ok || len(vals) < 2 || len(vals) > 3 {
+		return 0, false, errors.Errorf("unknown response of type %[1]T: %[1]v", res.Val())
+	}
+
+	if len(vals) == 3 {
+		return 0, false, a.capReachedError(vals[2])
+	}
+
+	waitTime, okWait := vals[0].(int64)
+	granted, okGranted := vals[1].(int64)
+	if !okWait || !okGranted {
+		return 0, false, errors.Errorf("unknown response %v", vals)
+	}
+
+	return time.Duration(waitTime), granted == 1, nil
+}
+
+// cachedState returns the state of the bucket from the client-side cache, reading it into the cache
+// if missing, and the current time in the Redis node's clock, as the cache's clock tracks it. The
+// state is nil if the cache is disabled or the state couldn't be read, in which case the scripts
+// are run instead. The cache is bypassed unless the circuit breaker is closed.
+func (a *abstractBucket) cachedState() (*bucketState, int64) {
+	cache := a.factory.clientCache()
+	if cache == nil || a.factory.breaker.State() != events.CircuitClosed {
+		return nil, 0
+	}
+
+	s := cache.state(a.factory.Client().(*redis.Client), a.keys)
+	if s == nil {
+		return nil, 0
+	}
+
+	return s, s.redisNanos(cache.now())
+}
+
+// capReachedError returns the error for the token cap being reached, given the end of its window
+// returned by the scripts.
+func (a *abstractBucket) capReachedError(windowEnd interface{}) error {
+	millis, ok := windowEnd.(int64)
+	if !ok {
+		return errors.Errorf("unknown token cap window end %v", windowEnd)
+	}
+
+	capReached := &quotaservice.CapReachedError{TokenCap: a.cfg.TokenCap}
+	if millis > 0 {
+		capReached.ResetAt = time.Unix(0, millis*int64(time.Millisecond))
+	}
+
+	return capReached
+}
+
+// fallbackBucket returns the bucket serving requests while the circuit breaker is open, or nil to
+// fail fast.
+func (a *abstractBucket) fallbackBucket() quotaservice.Bucket {
+	if a.factory.fallback == nil {
+		return nil
+	}
+
+	a.fallbackLock.Lock()
+	defer a.fallbackLock.Unlock()
+
+	if a.fallback == nil {
+		a.fallback = a.factory.fallback.NewBucket(a.namespace, a.name, a.cfg, a.dynamic)
+	}
+
+	return a.fallback
+}
+
+// Destroy destroys the fallback bucket, if one was created.
+func (a *abstractBucket) Destroy() {
+	a.fallbackLock.Lock()
+	defer a.fallbackLock.Unlock()
+
+	if a.fallback != nil {
+		a.fallback.Destroy()
+		a.fallback = nil
+	}
+}
+
 func (a *abstractBucket) takeFromRedis(ctx context.Context, client *redis.Client, args []interface{}) *redis.Cmd {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "script.Run")
 	defer span.Finish()
@@ -84,6 +286,9 @@ func (a *abstractBucket) takeFromRedis(ctx context.Context, client *redis.Client
 }
 
 var _ quotaservice.Bucket = (*staticBucket)(nil)
+var _ quotaservice.Peeker = (*staticBucket)(nil)
+var _ quotaservice.Prober = (*staticBucket)(nil)
+var _ quotaservice.DeadlineTaker = (*staticBucket)(nil)
 
 // staticBucket is an implementation of quotaservice.Bucket for use with static, named buckets.
 type staticBucket struct {
@@ -95,6 +300,9 @@ func (s *staticBucket) Dynamic() bool {
 }
 
 var _ quotaservice.Bucket = (*dynamicBucket)(nil)
+var _ quotaservice.Peeker = (*dynamicBucket)(nil)
+var _ quotaservice.Prober = (*dynamicBucket)(nil)
+var _ quotaservice.DeadlineTaker = (*dynamicBucket)(nil)
 
 // dynamicBucket is an implementation of quotaservice.Bucket for use with dynamic buckets created from a template.
 type dynamicBucket struct {
@@ -106,6 +314,8 @@ func (d *dynamicBucket) Dynamic() bool {
 }
 
 func (d *dynamicBucket) Destroy() {
+	d.abstractBucket.Destroy()
+
 	// decrease ref-count common
 	d.factory.Lock()
 	defer d.factory.Unlock()
@@ -15,11 +15,16 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/square/quotaservice"
+	"github.com/square/quotaservice/events"
 	"github.com/square/quotaservice/logging"
 	pbconfig "github.com/square/quotaservice/protos/config"
 )
 
-const luaScript = `
+// claimScript computes the wait for the tokens requested, and the state of the bucket once they are
+// claimed, leaving the scripts it prefixes to decide whether to store it. Buckets with a token cap
+// count the tokens served in the cap's current window in a hash, KEYS[3], and buckets with rate
+// windows keep the state of each in a hash, KEYS[4].
+const claimScript = `
 local tokensNextAvailableNanos = tonumber(redis.call("GET", KEYS[1]))
 if not tokensNextAvailableNanos then
 	tokensNextAvailableNanos = 0
@@ -32,6 +37,8 @@ if not accumulatedTokens then
 	accumulatedTokens = maxTokensToAccumulate
 end
 
+-- The Redis node's clock is the only one used, so skewed clocks on the quotaservice instances can't
+-- over- or under-credit buckets
 local redisTime = redis.call("TIME")
 local second = tonumber(redisTime[1])
 local microsecond = tonumber(redisTime[2])
@@ -41,6 +48,7 @@ local requested = tonumber(ARGV[3])
 local maxWaitTime = tonumber(ARGV[4])
 local lifespan = tonumber(ARGV[5])
 local maxDebtNanos = tonumber(ARGV[6])
+local overdraftNanos = tonumber(ARGV[7])
 local freshTokens = 0
 
 if currentTimeNanos > tokensNextAvailableNanos then
@@ -49,7 +57,8 @@ if currentTimeNanos > tokensNextAvailableNanos then
 	tokensNextAvailableNanos = currentTimeNanos
 end
 
-local waitTime = tokensNextAvailableNanos - currentTimeNanos
+-- Debt within the overdraft is tolerated without waiting
+local waitTime = math.max(0, tokensNextAvailableNanos - currentTimeNanos - overdraftNanos)
 local accumulatedTokensUsed = math.min(accumulatedTokens, requested)
 local tokensToWaitFor = requested - accumulatedTokensUsed
 local futureWaitNanos = tokensToWaitFor * nanosBetweenTokens
@@ -57,7 +66,81 @@ local futureWaitNanos = tokensToWaitFor * nanosBetweenTokens
 tokensNextAvailableNanos = tokensNextAvailableNanos + futureWaitNanos
 accumulatedTokens = accumulatedTokens - accumulatedTokensUsed
 
-if (tokensNextAvailableNanos - currentTimeNanos > maxDebtNanos) or (waitTime > 0 and waitTime > maxWaitTime) then
+-- Rate windows are buckets of their own, each given by its length, size and nanos between tokens
+-- following ARGV[10], their count. Every window must grant the tokens, the longest wait of all
+-- being waited for. Windows keep the time towards their next token, since windows of long periods
+-- accumulate tokens slowly
+local numWindows = tonumber(ARGV[10])
+local windowState = {}
+local windowsTooFarInDebt = false
+for i = 0, numWindows - 1 do
+	local windowMillis = ARGV[11 + i * 3]
+	local windowSize = tonumber(ARGV[12 + i * 3])
+	local windowNanosBetweenTokens = tonumber(ARGV[13 + i * 3])
+
+	local stored = redis.call("HMGET", KEYS[4], windowMillis .. ":TNA", windowMillis .. ":AT")
+	local windowTna = tonumber(stored[1]) or 0
+	local windowTokens = tonumber(stored[2]) or windowSize
+
+	if currentTimeNanos > windowTna then
+		local windowFreshTokens = math.floor((currentTimeNanos - windowTna) / windowNanosBetweenTokens)
+		if windowTokens + windowFreshTokens >= windowSize then
+			windowTokens = windowSize
+			windowTna = currentTimeNanos
+		else
+			windowTokens = windowTokens + windowFreshTokens
+			windowTna = windowTna + windowFreshTokens * windowNanosBetweenTokens
+		end
+	end
+
+	waitTime = math.max(waitTime, windowTna - currentTimeNanos)
+
+	local windowTokensUsed = math.min(windowTokens, requested)
+	windowTna = windowTna + (requested - windowTokensUsed) * windowNanosBetweenTokens
+	windowTokens = windowTokens - windowTokensUsed
+
+	if windowTna - currentTimeNanos > maxDebtNanos then
+		windowsTooFarInDebt = true
+	end
+
+	table.insert(windowState, windowMillis .. ":TNA")
+	table.insert(windowState, windowTna)
+	table.insert(windowState, windowMillis .. ":AT")
+	table.insert(windowState, math.floor(windowTokens))
+end
+
+-- Token cap windows are counted from the epoch, in the Redis node's time like the rate. Caps
+-- without a window have a single window, starting at 0 and never ending
+local tokenCap = tonumber(ARGV[8])
+local capWindowMillis = tonumber(ARGV[9])
+local capWindowStart = 0
+local capWindowEnd = 0
+local tokensServed = 0
+if tokenCap > 0 then
+	if capWindowMillis > 0 then
+		local currentTimeMillis = second * 1000 + math.floor(microsecond / 1000)
+		capWindowStart = currentTimeMillis - currentTimeMillis % capWindowMillis
+		capWindowEnd = capWindowStart + capWindowMillis
+	end
+
+	local served = redis.call("HMGET", KEYS[3], "window", "served")
+	if tonumber(served[1]) == capWindowStart then
+		tokensServed = tonumber(served[2])
+	end
+end
+
+local capReached = tokenCap > 0 and tokensServed + requested > tokenCap
+`
+
+// luaScript claims the tokens requested, returning the wait for them, -1 if they can't be claimed
+// within the max wait time, or, if the token cap is reached, the millis since the epoch its window
+// ends at, 0 if never, in a table.
+const luaScript = claimScript + `
+if capReached then
+	return {capWindowEnd}
+end
+
+if windowsTooFarInDebt or (tokensNextAvailableNanos - currentTimeNanos > maxDebtNanos + overdraftNanos) or (waitTime > 0 and waitTime > maxWaitTime) then
 	waitTime = -1
 else
 	-- Redis doesn't allow non-deterministic functions unless we use replicating commands instead of scripts
@@ -69,15 +152,98 @@ else
 		redis.call("SET", KEYS[1], tokensNextAvailableNanos)
 		redis.call("SET", KEYS[2], math.floor(accumulatedTokens))
 	end
+
+	-- The tokens served outlive idle buckets, until the window rolls over
+	if tokenCap > 0 then
+		redis.call("HMSET", KEYS[3], "window", capWindowStart, "served", tokensServed + requested)
+		if capWindowEnd > 0 then
+			redis.call("PEXPIREAT", KEYS[3], capWindowEnd)
+		end
+	end
+
+	if numWindows > 0 then
+		redis.call("HMSET", KEYS[4], unpack(windowState))
+		if lifespan > 0 then
+			redis.call("PEXPIRE", KEYS[4], lifespan)
+		end
+	end
 end
 
 return waitTime
 `
 
+// probeScript returns the wait for the tokens requested and whether they would be granted, as
+// luaScript would, without claiming them, followed by the end of the token cap's window if it is
+// reached.
+const probeScript = claimScript + `
+if capReached then
+	return {0, 0, capWindowEnd}
+end
+
+local granted = 1
+if windowsTooFarInDebt or (tokensNextAvailableNanos - currentTimeNanos > maxDebtNanos + overdraftNanos) or (waitTime > 0 and waitTime > maxWaitTime) then
+	granted = 0
+end
+
+return {waitTime, granted}
+`
+
+// peekScript computes the tokens available in a bucket, the fewest of those at its fill rate and in
+// its rate windows, using the same arithmetic as luaScript, without claiming any.
+const peekScript = `
+local tokensNextAvailableNanos = tonumber(redis.call("GET", KEYS[1]))
+if not tokensNextAvailableNanos then
+	tokensNextAvailableNanos = 0
+end
+
+local maxTokensToAccumulate = tonumber(ARGV[2])
+
+local accumulatedTokens = tonumber(redis.call("GET", KEYS[2]))
+if not accumulatedTokens then
+	accumulatedTokens = maxTokensToAccumulate
+end
+
+local redisTime = redis.call("TIME")
+local currentTimeNanos = tonumber(redisTime[1]) * 1e+9 + tonumber(redisTime[2]) * 1e+3
+local nanosBetweenTokens = tonumber(ARGV[1])
+
+local available
+if currentTimeNanos >= tokensNextAvailableNanos then
+	local freshTokens = math.floor((currentTimeNanos - tokensNextAvailableNanos) / nanosBetweenTokens)
+	available = math.min(maxTokensToAccumulate, accumulatedTokens + freshTokens)
+else
+	available = accumulatedTokens - math.floor((tokensNextAvailableNanos - currentTimeNanos) / nanosBetweenTokens)
+end
+
+-- Rate windows are given as for luaScript, following their count in ARGV[3]
+local numWindows = tonumber(ARGV[3])
+for i = 0, numWindows - 1 do
+	local windowMillis = ARGV[4 + i * 3]
+	local windowSize = tonumber(ARGV[5 + i * 3])
+	local windowNanosBetweenTokens = tonumber(ARGV[6 + i * 3])
+
+	local stored = redis.call("HMGET", KEYS[4], windowMillis .. ":TNA", windowMillis .. ":AT")
+	local windowTna = tonumber(stored[1]) or 0
+	local windowTokens = tonumber(stored[2]) or windowSize
+
+	if currentTimeNanos >= windowTna then
+		windowTokens = math.min(windowSize, windowTokens + math.floor((currentTimeNanos - windowTna) / windowNanosBetweenTokens))
+	else
+		windowTokens = windowTokens - math.floor((windowTna - currentTimeNanos) / windowNanosBetweenTokens)
+	end
+
+	available = math.min(available, windowTokens)
+end
+
+return available
+`
+
 // Suffixes for Redis keys
 const (
 	tokensNextAvblNanosSuffix = "TNA"
 	accumulatedTokensSuffix   = "AT"
+	tokensServedSuffix        = "SERVED"
+	rateWindowsSuffix         = "WINDOWS"
 )
 
 // defaultBucket is a "const"
@@ -102,7 +268,9 @@ type bucketFactory struct {
 	cfg                       *pbconfig.ServiceConfig
 	client                    *redis.Client
 	redisOpts                 *redis.Options
-	script                    *redis.Script
+	script                    *cachedScript
+	peekScript                *cachedScript
+	probeScript               *cachedScript
 	connectionRetries         int
 	connectionNeedsResolution bool
 	numTimesConnResolved      int // For testing and debugging purposes
@@ -110,10 +278,34 @@ type bucketFactory struct {
 	// keyMaxIdleTime will be set as the Redis key TTL unless it is overridden by the per bucket
 	// config MaxIdleMillis
 	keyMaxIdleTime time.Duration
+
+	// breaker guards calls to Redis, or is nil if disabled. fallback creates the buckets serving
+	// requests while it's open, or is nil to fail fast.
+	breaker  *circuitBreaker
+	fallback quotaservice.BucketFactory
+
+	// cache is the client-side cache of the current client, or nil if disabled, protected by the
+	// embedded mutex.
+	cacheOpts ClientCacheOptions
+	cache     *clientCache
 }
 
 // NewBucketFactory creates a new bucketFactory instance.
 func NewBucketFactory(redisOpts *redis.Options, connectionRetries int, keyMaxIdleTime time.Duration) quotaservice.BucketFactory {
+	return NewBucketFactoryWithBreaker(redisOpts, connectionRetries, keyMaxIdleTime, BreakerOptions{})
+}
+
+// NewBucketFactoryWithBreaker creates a new bucketFactory instance, with a circuit breaker in front
+// of Redis configured by breakerOpts. The factory emits an events.EVENT_CIRCUIT_BREAKER_STATE_CHANGED
+// event whenever the breaker changes state.
+func NewBucketFactoryWithBreaker(redisOpts *redis.Options, connectionRetries int, keyMaxIdleTime time.Duration, breakerOpts BreakerOptions) quotaservice.BucketFactory {
+	return NewBucketFactoryWithClientCache(redisOpts, connectionRetries, keyMaxIdleTime, breakerOpts, ClientCacheOptions{})
+}
+
+// NewBucketFactoryWithClientCache creates a new bucketFactory instance, with a circuit breaker
+// configured by breakerOpts, whose buckets cache their balances for Peek and Probe as configured by
+// cacheOpts. The cache is disabled if Redis doesn't support it.
+func NewBucketFactoryWithClientCache(redisOpts *redis.Options, connectionRetries int, keyMaxIdleTime time.Duration, breakerOpts BreakerOptions, cacheOpts ClientCacheOptions) quotaservice.BucketFactory {
 	if connectionRetries < 1 {
 		connectionRetries = 1
 	}
@@ -130,9 +322,27 @@ func NewBucketFactory(redisOpts *redis.Options, connectionRetries int, keyMaxIdl
 		connectionNeedsResolution: false,
 		numTimesConnResolved:      0,
 		keyMaxIdleTime:            keyMaxIdleTime,
+		script:                    newCachedScript("take", luaScript),
+		peekScript:                newCachedScript("peek", peekScript),
+		probeScript:               newCachedScript("probe", probeScript),
+		breaker:                   newCircuitBreaker(breakerOpts),
+		fallback:                  breakerOpts.Fallback,
+		cacheOpts:                 cacheOpts,
 	}
 }
 
+// SetEventEmitter implements quotaservice.EventEmitter, emitting changes in the state of the
+// circuit breaker.
+func (bf *bucketFactory) SetEventEmitter(emit func(events.Event)) {
+	bf.breaker.setEmitter(emit)
+}
+
+// BreakerState returns the state of the circuit breaker in front of Redis, which is always
+// events.CircuitClosed if the breaker is disabled.
+func (bf *bucketFactory) BreakerState() events.CircuitState {
+	return bf.breaker.State()
+}
+
 // Init initializes a bucketFactory for use, implementing Init() on the quotaservice.BucketFactory interface
 func (bf *bucketFactory) Init(cfg *pbconfig.ServiceConfig) {
 	start := time.Now()
@@ -148,23 +358,70 @@ func (bf *bucketFactory) Init(cfg *pbconfig.ServiceConfig) {
 		logging.Printf("Re-established Redis connections in %v", time.Since(connStart))
 	}
 
-	bf.script = redis.NewScript(luaScript)
+	if bf.fallback != nil && bf.breaker != nil {
+		bf.fallback.Init(cfg)
+	}
 
 	logging.Printf("Initialized redis.BucketFactory in %v", time.Since(start))
 }
 
 func (bf *bucketFactory) connectToRedisLocked() {
+	// The cache of the previous client may have missed invalidations.
+	if bf.cache != nil {
+		bf.cache.close()
+		bf.cache = nil
+	}
+
 	// Set up connection to Redis
 	bf.client = redis.NewClient(bf.redisOpts)
 
 	_, err := bf.client.Touch("areYouAlive?").Result()
 	if err != nil {
 		logging.Printf("Cannot connect to Redis. TOUCH returned %v", err)
-	} else {
-		logging.Printf("Connection established")
+		return
+	}
+
+	logging.Printf("Connection established")
+
+	// Scripts are loaded up front, so the first requests needn't load them. Scripts that fail to
+	// load are loaded when first run instead.
+	if err := bf.loadScripts(bf.client); err != nil {
+		logging.Printf("Unable to load scripts into Redis: %v", err)
+	}
+
+	if bf.cacheOpts.Enabled {
+		cache, err := newClientCache(bf.client, bf.redisOpts, bf.cacheOpts)
+		if err != nil {
+			logging.Printf("Redis client-side cache disabled: %v", err)
+			return
+		}
+
+		bf.cache = cache
+		logging.Printf("Redis client-side cache enabled")
 	}
 }
 
+// Scripts describes the Lua scripts the factory runs in Redis, for debugging.
+func (bf *bucketFactory) Scripts() []ScriptInfo {
+	return []ScriptInfo{bf.script.info(), bf.peekScript.info(), bf.probeScript.info()}
+}
+
+// ReloadScripts loads the Lua scripts the factory runs into Redis again with SCRIPT LOAD. Scripts
+// missing from Redis are reloaded when run anyway, so this is only needed for debugging.
+func (bf *bucketFactory) ReloadScripts() error {
+	return bf.loadScripts(bf.Client().(*redis.Client))
+}
+
+func (bf *bucketFactory) loadScripts(c scripter) error {
+	for _, s := range []*cachedScript{bf.script, bf.peekScript, bf.probeScript} {
+		if err := s.load(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (bf *bucketFactory) reconnectToRedis(oldClient *redis.Client) {
 	bf.Lock()
 	defer bf.Unlock()
@@ -243,6 +500,14 @@ func (bf *bucketFactory) getNumTimesConnResolved() int {
 	return bf.numTimesConnResolved
 }
 
+// clientCache returns the client-side cache of the current client, or nil if disabled.
+func (bf *bucketFactory) clientCache() *clientCache {
+	bf.Lock()
+	defer bf.Unlock()
+
+	return bf.cache
+}
+
 // Client returns a reference to the underlying client instance, implementing Client() on the quotaservice.BucketFactory
 // interface
 func (bf *bucketFactory) Client() interface{} {
@@ -252,17 +517,29 @@ func (bf *bucketFactory) Client() interface{} {
 	return bf.client
 }
 
+// bucketMemoryBytes estimates the memory used by a bucket in the process, whose balance is kept in
+// Redis: its keys and script arguments.
+const bucketMemoryBytes = 512
+
+// BucketMemoryBytes implements quotaservice.MemoryEstimator.
+func (bf *bucketFactory) BucketMemoryBytes() int64 {
+	return bucketMemoryBytes
+}
+
 // NewBucket creates and returns a new instance of quotaservice.Bucket, implementing NewBucket() on the
 // quotaservice.BucketFactory interface
 func (bf *bucketFactory) NewBucket(namespace, bucketName string, cfg *pbconfig.BucketConfig, dyn bool) quotaservice.Bucket {
 	idle := "0"
 	if cfg.MaxIdleMillis > 0 {
-		idle = strconv.FormatInt(int64(cfg.MaxIdleMillis), 10)
+		// Keys outlive the bucket's grace period, so a stale bucket accessed again keeps its tokens.
+		idle = strconv.FormatInt(int64(cfg.MaxIdleMillis+cfg.EvictionGraceMillis), 10)
 	}
 
 	keys := []string{
 		toRedisKey(namespace, bucketName, tokensNextAvblNanosSuffix, bf.cfg.Version),
 		toRedisKey(namespace, bucketName, accumulatedTokensSuffix, bf.cfg.Version),
+		tokensServedKey(namespace, bucketName),
+		toRedisKey(namespace, bucketName, rateWindowsSuffix, bf.cfg.Version),
 	}
 
 	if dyn {
@@ -284,6 +561,9 @@ func (bf *bucketFactory) NewBucket(namespace, bucketName string, cfg *pbconfig.B
 				cfg:              cfg,
 				factory:          bf,
 				keys:             keys,
+				namespace:        namespace,
+				name:             bucketName,
+				dynamic:          true,
 			}}
 	} else {
 		// Create a staticBucket with its own non-shared configAttributes
@@ -293,6 +573,8 @@ func (bf *bucketFactory) NewBucket(namespace, bucketName string, cfg *pbconfig.B
 				cfg:              cfg,
 				factory:          bf,
 				keys:             keys,
+				namespace:        namespace,
+				name:             bucketName,
 			}}
 	}
 }
@@ -304,13 +586,39 @@ func newConfigAttributes(cfg *pbconfig.BucketConfig, idle string, dyn bool) *con
 		idle,
 		// Convert millis to nanos
 		strconv.FormatInt(cfg.MaxDebtMillis*1e6, 10),
+		// The time the fill rate takes to repay the max debt
+		strconv.FormatInt(cfg.MaxDebt*(1e9/cfg.FillRate), 10),
+		strconv.FormatInt(cfg.TokenCap, 10),
+		strconv.FormatInt(cfg.TokenCapWindowMillis, 10),
+		rateWindowArgs(cfg.RateWindows),
+		newBucketParams(cfg),
 		defaultBucket}
 }
 
+// rateWindowArgs returns the arguments of the scripts giving rate windows: their count, followed by
+// the length, size and nanos between tokens of each.
+func rateWindowArgs(windows []*pbconfig.RateWindow) []interface{} {
+	params := rateWindowParams(windows)
+
+	args := []interface{}{strconv.Itoa(len(params))}
+	for _, w := range params {
+		args = append(args, w.millis, strconv.FormatInt(w.size, 10), strconv.FormatInt(w.nanosBetweenTokens, 10))
+	}
+
+	return args
+}
+
 func toRedisKey(namespace, bucketName, suffix string, version int32) string {
 	return fmt.Sprintf("{%s:%s}:%s:%v", namespace, bucketName, suffix, version)
 }
 
+// tokensServedKey returns the key counting the tokens a bucket served towards its token cap. Unlike
+// the keys of its balance, it doesn't change with the config version, so the cap holds across
+// config changes.
+func tokensServedKey(namespace, bucketName string) string {
+	return fmt.Sprintf("{%s:%s}:%s", namespace, bucketName, tokensServedSuffix)
+}
+
 const redisClientClosedError = "redis: client is closed"
 
 func isRedisClientClosedError(err error) bool {
@@ -11,6 +11,7 @@ import (
 
 	"github.com/go-redis/redis"
 
+	"github.com/square/quotaservice"
 	"github.com/square/quotaservice/buckets"
 	"github.com/square/quotaservice/config"
 	"github.com/square/quotaservice/protos/config"
@@ -106,6 +107,20 @@ func TestTokenAcquisition(t *testing.T) {
 	buckets.TestTokenAcquisition(t, bucket)
 }
 
+func TestTakeUntil(t *testing.T) {
+	buckets.TestTakeUntil(t, factory.NewBucket("redis", "until", config.NewDefaultBucketConfig(""), false))
+}
+
+func TestProbe(t *testing.T) {
+	buckets.TestProbe(t, factory.NewBucket("redis", "probe", config.NewDefaultBucketConfig(""), false))
+}
+
+func TestDebt(t *testing.T) {
+	cfg := config.NewDefaultBucketConfig("")
+	cfg.MaxDebt = 50
+	buckets.TestDebt(t, factory.NewBucket("redis", "debt", cfg, false))
+}
+
 func TestGC(t *testing.T) {
 	buckets.TestGC(t, factory, "redis")
 }
@@ -172,3 +187,391 @@ func assertRefCounts(ns string, expected int, t *testing.T) {
 		}
 	}
 }
+
+func TestInspection(t *testing.T) {
+	buckets.TestInspection(t, NewBucketFactory(&redis.Options{Addr: "localhost:6379"}, 2, 0), "redis")
+}
+
+func TestBalanceUsesRedisClock(t *testing.T) {
+	cached := NewBucketFactoryWithClientCache(&redis.Options{Addr: "localhost:6379"}, 2, 0, BreakerOptions{},
+		ClientCacheOptions{Enabled: true}).(*bucketFactory)
+	cached.Init(cfg)
+	if cache := cached.clientCache(); cache != nil {
+		// The local clock is minutes behind the Redis node's.
+		cache.now = func() time.Time { return time.Now().Add(-10 * time.Minute) }
+	}
+
+	for name, f := range map[string]*bucketFactory{"scripts": factory, "cached": cached} {
+		t.Run(name, func(t *testing.T) {
+			if f == cached && f.clientCache() == nil {
+				t.Skip("Redis doesn't support client-side caching")
+			}
+
+			b := f.NewBucket("redis", "clock_"+name, config.NewDefaultBucketConfig("clock_"+name), false).(*staticBucket)
+			client := factory.client
+
+			// The bucket is in debt for another second by the Redis node's clock, whatever the local
+			// clock says.
+			redisNow, err := client.Time().Result()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := client.Set(b.keys[0], redisNow.Add(time.Second).UnixNano(), 0).Err(); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := client.Set(b.keys[1], 0, 0).Err(); err != nil {
+				t.Fatal(err)
+			}
+
+			// The default fill rate is 50 tokens a second.
+			tokens, err := b.Peek(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tokens < -50 || tokens > -45 {
+				t.Errorf("Expected a debt of about 50 tokens, got %v", tokens)
+			}
+
+			wait, granted, err := b.Probe(context.Background(), 1, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !granted || wait <= 900*time.Millisecond || wait > time.Second {
+				t.Errorf("Expected a token to be granted after about a second, got %v after %v", granted, wait)
+			}
+		})
+	}
+}
+
+// newCappedBucket creates a bucket with a token cap, clearing any state left in Redis by previous
+// runs.
+func newCappedBucket(t *testing.T, name string, tokenCap, windowMillis int64) *staticBucket {
+	cfg := config.NewDefaultBucketConfig(name)
+	cfg.TokenCap = tokenCap
+	cfg.TokenCapWindowMillis = windowMillis
+	b := factory.NewBucket("redis", name, cfg, false).(*staticBucket)
+
+	if err := factory.client.Del(b.keys...).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func TestTokenCap(t *testing.T) {
+	buckets.TestTokenCap(t, newCappedBucket(t, "cap", 150, 0))
+}
+
+func TestTokenCapWindow(t *testing.T) {
+	b := newCappedBucket(t, "cap_window", 10, 1000)
+
+	if _, s, err := b.Take(context.Background(), 10, 0); err != nil || !s {
+		t.Fatalf("Expected to take 10 tokens within the cap, got %v, %v", s, err)
+	}
+
+	_, _, err := b.Take(context.Background(), 1, 0)
+	capReached, ok := err.(*quotaservice.CapReachedError)
+	if !ok || capReached.ResetAt.IsZero() || time.Until(capReached.ResetAt) > time.Second {
+		t.Fatalf("Expected the cap to be reached until the window rolls over within a second, got %v", err)
+	}
+
+	// The count expires with its window, rather than when the bucket is idle.
+	if ttl, err := factory.client.PTTL(b.keys[2]).Result(); err != nil || ttl <= 0 || ttl > time.Second {
+		t.Fatalf("Expected the tokens served to expire with the window, got a TTL of %v, %v", ttl, err)
+	}
+
+	time.Sleep(time.Until(capReached.ResetAt) + 50*time.Millisecond)
+
+	if _, s, err := b.Take(context.Background(), 10, 0); err != nil || !s {
+		t.Fatalf("Expected the cap to be reset once the window rolled over, got %v, %v", s, err)
+	}
+}
+
+func TestRateWindows(t *testing.T) {
+	cfg := config.NewDefaultBucketConfig("windows")
+	cfg.RateWindows = []*quotaservice_configs.RateWindow{{Tokens: 300, WindowMillis: 60000}, {Tokens: 120, WindowMillis: 3600000}}
+	b := factory.NewBucket("redis", "windows", cfg, false).(*staticBucket)
+
+	if err := factory.client.Del(b.keys...).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	buckets.TestRateWindows(t, b)
+
+	// The windows are kept together with the bucket's balance, in its key group.
+	if n, err := factory.client.HLen(b.keys[3]).Result(); err != nil || n != 4 {
+		t.Fatalf("Expected the state of both windows to be stored, got %v fields, %v", n, err)
+	}
+
+	if tokens, err := b.Peek(context.Background()); err != nil || tokens > 0 {
+		t.Fatalf("Expected no tokens to be available from the hourly window, got %v, %v", tokens, err)
+	}
+}
+
+func TestClientCache(t *testing.T) {
+	cached := NewBucketFactoryWithClientCache(&redis.Options{Addr: "localhost:6379"}, 2, 0, BreakerOptions{},
+		ClientCacheOptions{Enabled: true}).(*bucketFactory)
+	cached.Init(cfg)
+	if cached.clientCache() == nil {
+		t.Skip("Redis doesn't support client-side caching")
+	}
+
+	bCfg := config.NewDefaultBucketConfig("cached")
+	b := cached.NewBucket("redis", "cached", bCfg, false).(*staticBucket)
+	// The same bucket on another instance, without caching.
+	other := factory.NewBucket("redis", "cached", bCfg, false).(*staticBucket)
+
+	if err := factory.client.Del(b.keys...).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	peek := func(b *staticBucket) int64 {
+		t.Helper()
+
+		tokens, err := b.Peek(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return tokens
+	}
+
+	// Caching doesn't change the balance peeked or the outcome of probes.
+	for _, requested := range []int64{1, 100, 150} {
+		cachedWait, cachedGranted, err := b.Probe(context.Background(), requested, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wait, granted, err := other.Probe(context.Background(), requested, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if cachedGranted != granted || (cachedWait-wait).Round(100*time.Millisecond) != 0 {
+			t.Errorf("Expected probing %v tokens to be granted %v after %v, got %v after %v", requested, granted, wait, cachedGranted, cachedWait)
+		}
+	}
+
+	if tokens := peek(b); tokens != peek(other) || tokens != 100 {
+		t.Errorf("Expected a full bucket with and without caching, got %v", tokens)
+	}
+
+	if s := cached.clientCache().state(cached.client, b.keys); s == nil || !s.filled {
+		t.Error("Expected the bucket's balance to be cached")
+	}
+
+	// Tokens taken by other instances invalidate the cached balance.
+	if _, granted, err := other.Take(context.Background(), 60, 0); err != nil || !granted {
+		t.Fatalf("Expected tokens to be granted, got %v, %v", granted, err)
+	}
+
+	for deadline := time.Now().Add(time.Second); peek(b) > 50; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the tokens taken by another instance to be peeked")
+		}
+	}
+
+	// Tokens taken through the cached bucket are peeked at once.
+	if _, granted, err := b.Take(context.Background(), 40, 0); err != nil || !granted {
+		t.Fatalf("Expected tokens to be granted, got %v, %v", granted, err)
+	}
+
+	if tokens := peek(b); tokens > 10 {
+		t.Errorf("Expected the tokens taken to be peeked at once, got %v", tokens)
+	}
+
+	if _, granted, _ := b.Probe(context.Background(), 100, 0); granted {
+		t.Error("Expected a probe for more tokens than available not to be granted")
+	}
+}
+
+// cachedArithmeticCase is a bucket config and the state stored for it in Redis, with times given
+// as offsets from the Redis node's clock.
+type cachedArithmeticCase struct {
+	cfg func(*quotaservice_configs.BucketConfig)
+	// tna and at are the bucket's balance, unset if missing.
+	tna, at *int64
+	// windows are the states of its rate windows, by their length in millis: the offset of the next
+	// token, and the tokens accumulated.
+	windows map[int64][2]int64
+	// served are the tokens served in the token cap's current window, unset if none.
+	served    *int64
+	requested int64
+	maxWait   time.Duration
+}
+
+func TestCachedArithmeticMatchesScripts(t *testing.T) {
+	// 10 tokens a second, and offsets between token boundaries, so the time between reading the
+	// Redis node's clock and running a script can't change the result.
+	rate := func(cfg *quotaservice_configs.BucketConfig) {
+		cfg.Size = 20
+		cfg.FillRate = 10
+	}
+
+	withWindow := func(cfg *quotaservice_configs.BucketConfig) {
+		rate(cfg)
+		cfg.RateWindows = []*quotaservice_configs.RateWindow{{WindowMillis: 1000, Tokens: 5}}
+	}
+
+	withCap := func(windowMillis int64) func(*quotaservice_configs.BucketConfig) {
+		return func(cfg *quotaservice_configs.BucketConfig) {
+			rate(cfg)
+			cfg.TokenCap = 10
+			cfg.TokenCapWindowMillis = windowMillis
+		}
+	}
+
+	cases := map[string]cachedArithmeticCase{
+		"full":      {cfg: rate, requested: 5},
+		"refilling": {cfg: rate, tna: int64p(-1250 * 1e6), at: int64p(3), requested: 18},
+		"in debt": {cfg: rate, tna: int64p(1250 * 1e6), at: int64p(0), requested: 1,
+			maxWait: 500 * time.Millisecond},
+		"in debt, waiting": {cfg: rate, tna: int64p(1250 * 1e6), at: int64p(0), requested: 1,
+			maxWait: 2 * time.Second},
+		"overdraft": {cfg: func(cfg *quotaservice_configs.BucketConfig) {
+			rate(cfg)
+			cfg.MaxDebt = 5
+		}, tna: int64p(350 * 1e6), at: int64p(0), requested: 1},
+		"too far in debt": {cfg: func(cfg *quotaservice_configs.BucketConfig) {
+			rate(cfg)
+			cfg.MaxDebtMillis = 1000
+		}, tna: int64p(950 * 1e6), at: int64p(0), requested: 5, maxWait: time.Minute},
+		"rate window":         {cfg: withWindow, windows: map[int64][2]int64{1000: {-250 * 1e6, 1}}, requested: 4},
+		"rate window in debt": {cfg: withWindow, windows: map[int64][2]int64{1000: {550 * 1e6, 0}}, requested: 1, maxWait: time.Second},
+		"rate window missing": {cfg: withWindow, requested: 6},
+		"token cap":           {cfg: withCap(60000), served: int64p(8), requested: 2},
+		"token cap reached":   {cfg: withCap(60000), served: int64p(8), requested: 3},
+		"token cap forever":   {cfg: withCap(0), served: int64p(10), requested: 1},
+	}
+
+	client := factory.client
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			bCfg := config.NewDefaultBucketConfig("arithmetic")
+			c.cfg(bCfg)
+			b := factory.NewBucket("redis", "arithmetic", bCfg, false).(*staticBucket)
+			s := storeArithmeticCase(t, client, b, &c)
+
+			// The scripts run between two reads of the Redis node's clock, so their results must be
+			// those computed at either.
+			before, tokens, after := scriptResult(t, client, func() *redis.Cmd {
+				args := append([]interface{}{b.nanosBetweenTokens, b.maxTokensToAccumulate}, b.rateWindows...)
+				return factory.peekScript.Run(client, b.keys, args...)
+			})
+
+			if expected := [2]int64{s.peek(&b.params, before), s.peek(&b.params, after)}; tokens != expected[0] && tokens != expected[1] {
+				t.Errorf("Expected %v tokens peeked, as computed from the cache, got %v", expected, tokens)
+			}
+
+			var probed interface{}
+			before, probed, after = scriptResult(t, client, func() *redis.Cmd {
+				return factory.probeScript.Run(client, b.keys, b.scriptArgs(c.requested, c.maxWait)...)
+			})
+
+			vals := probed.([]interface{})
+			matched := false
+			for _, at := range []int64{before, after} {
+				waitNanos, granted, capReached, capWindowEnd := s.probe(&b.params, c.requested, c.maxWait.Nanoseconds(), at)
+				if capReached {
+					matched = matched || (len(vals) == 3 && vals[2].(int64) == capWindowEnd)
+					continue
+				}
+
+				if len(vals) != 2 {
+					continue
+				}
+
+				// The wait shortens as time passes, and the scripts' clock is a float, precise to a
+				// microsecond.
+				waitDelta := vals[0].(int64) - waitNanos
+				matched = matched || ((vals[1].(int64) == 1) == granted && waitDelta <= 1000 && waitDelta >= before-after-1000)
+			}
+
+			if !matched {
+				t.Errorf("Expected the probe %v to be computed from the cache", vals)
+			}
+		})
+	}
+}
+
+// storeArithmeticCase stores the state of a case in Redis, returning it as the cache would hold it.
+func storeArithmeticCase(t *testing.T, client *redis.Client, b *staticBucket, c *cachedArithmeticCase) *bucketState {
+	t.Helper()
+
+	if err := client.Del(b.keys...).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	redisNow, err := client.Time().Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := func(cmd redis.Cmder) {
+		if err := cmd.Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := redisNow.UnixNano()
+	s := &bucketState{key: b.keys[0], filled: true, windows: make(map[string]int64)}
+	if c.tna != nil {
+		s.tokensNextAvailableNanos = int64p(now + *c.tna)
+		store(client.Set(b.keys[0], *s.tokensNextAvailableNanos, 0))
+	}
+
+	if c.at != nil {
+		s.accumulatedTokens = c.at
+		store(client.Set(b.keys[1], *c.at, 0))
+	}
+
+	if c.served != nil {
+		var capWindow int64
+		if windowMillis := b.cfg.TokenCapWindowMillis; windowMillis > 0 {
+			nowMillis := now / 1e6
+			capWindow = nowMillis - nowMillis%windowMillis
+		}
+
+		s.capWindow, s.capServed = int64p(capWindow), c.served
+		store(client.HMSet(b.keys[2], map[string]interface{}{"window": capWindow, "served": *c.served}))
+	}
+
+	for millis, w := range c.windows {
+		fields := map[string]interface{}{fmt.Sprintf("%v:TNA", millis): now + w[0], fmt.Sprintf("%v:AT", millis): w[1]}
+		for field, v := range fields {
+			s.windows[field] = v.(int64)
+		}
+
+		store(client.HMSet(b.keys[3], fields))
+	}
+
+	return s
+}
+
+// scriptResult runs a script between two reads of the Redis node's clock, returning the times read
+// in nanos since the epoch and the script's result.
+func scriptResult(t *testing.T, client *redis.Client, run func() *redis.Cmd) (int64, interface{}, int64) {
+	t.Helper()
+
+	before, err := client.Time().Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := run()
+	if err := res.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := client.Time().Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return before.UnixNano(), res.Val(), after.UnixNano()
+}
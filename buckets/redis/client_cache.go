@@ -0,0 +1,626 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package redis
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	"github.com/square/quotaservice/logging"
+	pbconfig "github.com/square/quotaservice/protos/config"
+)
+
+const (
+	defaultClientCacheMaxBuckets = 10000
+	defaultClientCacheMaxAge     = 10 * time.Second
+
+	// invalidationChannel is the channel Redis publishes the keys of tracked clients to, once they
+	// change, when tracking is redirected to another connection.
+	invalidationChannel = "__redis__:invalidate"
+)
+
+// ClientCacheOptions configures caching the balances of buckets in the process for Peek and Probe,
+// so read-heavy callers don't make a round trip to Redis for each. Redis 6 tracks the keys read
+// into the cache and notifies the factory once another client, or a Take, changes them, evicting
+// them from the cache, so cached balances only lag changes by the time the notification takes to
+// arrive. Take always runs in Redis. The cache is disabled unless Enabled is set, and on servers
+// older than Redis 6, which can't track keys.
+type ClientCacheOptions struct {
+	Enabled bool
+	// MaxBuckets bounds the buckets whose balances are cached. Defaults to 10000.
+	MaxBuckets int
+	// MaxAge is how long a balance is cached for at most, bounding how stale it gets if a
+	// notification is lost. Defaults to 10 seconds.
+	MaxAge time.Duration
+}
+
+// bucketParams are the numeric arguments of the scripts computing the balance of a bucket, for
+// computing Peek and Probe from cached state.
+type bucketParams struct {
+	nanosBetweenTokens   int64
+	size                 int64
+	maxDebtNanos         int64
+	overdraftNanos       int64
+	tokenCap             int64
+	tokenCapWindowMillis int64
+	windows              []windowParams
+}
+
+// windowParams describes one of the rate windows of a bucket.
+type windowParams struct {
+	millis             string
+	size               int64
+	nanosBetweenTokens int64
+}
+
+func newBucketParams(cfg *pbconfig.BucketConfig) bucketParams {
+	return bucketParams{
+		nanosBetweenTokens:   1e9 / cfg.FillRate,
+		size:                 cfg.Size,
+		maxDebtNanos:         cfg.MaxDebtMillis * 1e6,
+		overdraftNanos:       cfg.MaxDebt * (1e9 / cfg.FillRate),
+		tokenCap:             cfg.TokenCap,
+		tokenCapWindowMillis: cfg.TokenCapWindowMillis,
+		windows:              rateWindowParams(cfg.RateWindows)}
+}
+
+// rateWindowParams returns the rate windows of a bucket the scripts are given, skipping those
+// without tokens or a length.
+func rateWindowParams(windows []*pbconfig.RateWindow) []windowParams {
+	var params []windowParams
+	for _, w := range windows {
+		if w.Tokens <= 0 || w.WindowMillis <= 0 {
+			continue
+		}
+
+		nanosBetweenTokens := w.WindowMillis * 1e6 / w.Tokens
+		if nanosBetweenTokens < 1 {
+			nanosBetweenTokens = 1
+		}
+
+		params = append(params, windowParams{strconv.FormatInt(w.WindowMillis, 10), w.Tokens, nanosBetweenTokens})
+	}
+
+	return params
+}
+
+// bucketState is the state of a bucket as stored in Redis, read into the client-side cache. Keys
+// missing from Redis are left unset, as the scripts treat them.
+type bucketState struct {
+	// key is the first of the bucket's keys, which changes with the config version.
+	key      string
+	filled   bool
+	filledAt time.Time
+	// clockOffsetNanos is how far ahead of the local clock the Redis node's was when the state was
+	// read, so balances are computed in the Redis node's time, like the scripts do.
+	clockOffsetNanos int64
+
+	tokensNextAvailableNanos, accumulatedTokens *int64
+	windows                                     map[string]int64
+	capWindow, capServed                        *int64
+}
+
+// redisNanos returns the time in the Redis node's clock, in nanos since the epoch.
+func (s *bucketState) redisNanos(now time.Time) int64 {
+	return now.UnixNano() + s.clockOffsetNanos
+}
+
+func (s *bucketState) balance(p *bucketParams) (tokensNextAvailableNanos, accumulatedTokens int64) {
+	accumulatedTokens = p.size
+	if s.tokensNextAvailableNanos != nil {
+		tokensNextAvailableNanos = *s.tokensNextAvailableNanos
+	}
+
+	if s.accumulatedTokens != nil {
+		accumulatedTokens = *s.accumulatedTokens
+	}
+
+	return tokensNextAvailableNanos, accumulatedTokens
+}
+
+func (s *bucketState) window(w *windowParams) (tokensNextAvailableNanos, tokens int64) {
+	tokens = w.size
+	if tna, ok := s.windows[w.millis+":TNA"]; ok {
+		tokensNextAvailableNanos = tna
+	}
+
+	if at, ok := s.windows[w.millis+":AT"]; ok {
+		tokens = at
+	}
+
+	return tokensNextAvailableNanos, tokens
+}
+
+// peek computes the tokens available in the bucket at a time, as peekScript does.
+func (s *bucketState) peek(p *bucketParams, currentTimeNanos int64) int64 {
+	tna, accumulatedTokens := s.balance(p)
+
+	var available int64
+	if currentTimeNanos >= tna {
+		available = min(p.size, accumulatedTokens+(currentTimeNanos-tna)/p.nanosBetweenTokens)
+	} else {
+		available = accumulatedTokens - (tna-currentTimeNanos)/p.nanosBetweenTokens
+	}
+
+	for i := range p.windows {
+		w := &p.windows[i]
+		windowTna, windowTokens := s.window(w)
+		if currentTimeNanos >= windowTna {
+			windowTokens = min(w.size, windowTokens+(currentTimeNanos-windowTna)/w.nanosBetweenTokens)
+		} else {
+			windowTokens -= (windowTna - currentTimeNanos) / w.nanosBetweenTokens
+		}
+
+		available = min(available, windowTokens)
+	}
+
+	return available
+}
+
+// probe computes the wait for the tokens requested at a time and whether they would be granted, as
+// probeScript does. If the token cap is reached, capReached is set, with the millis since the epoch
+// its window ends at, 0 if never.
+func (s *bucketState) probe(p *bucketParams, requested, maxWaitNanos, currentTimeNanos int64) (waitNanos int64, granted, capReached bool, capWindowEnd int64) {
+	tna, accumulatedTokens := s.balance(p)
+	if currentTimeNanos > tna {
+		accumulatedTokens = min(p.size, accumulatedTokens+(currentTimeNanos-tna)/p.nanosBetweenTokens)
+		tna = currentTimeNanos
+	}
+
+	// Debt within the overdraft is tolerated without waiting.
+	waitNanos = maxNanos(0, tna-currentTimeNanos-p.overdraftNanos)
+	tna += (requested - min(accumulatedTokens, requested)) * p.nanosBetweenTokens
+
+	windowsTooFarInDebt := false
+	for i := range p.windows {
+		w := &p.windows[i]
+		windowTna, windowTokens := s.window(w)
+		if currentTimeNanos > windowTna {
+			freshTokens := (currentTimeNanos - windowTna) / w.nanosBetweenTokens
+			if windowTokens+freshTokens >= w.size {
+				windowTokens = w.size
+				windowTna = currentTimeNanos
+			} else {
+				windowTokens += freshTokens
+				windowTna += freshTokens * w.nanosBetweenTokens
+			}
+		}
+
+		waitNanos = maxNanos(waitNanos, windowTna-currentTimeNanos)
+		windowTna += (requested - min(windowTokens, requested)) * w.nanosBetweenTokens
+		if windowTna-currentTimeNanos > p.maxDebtNanos {
+			windowsTooFarInDebt = true
+		}
+	}
+
+	if p.tokenCap > 0 {
+		var capWindowStart, tokensServed int64
+		if p.tokenCapWindowMillis > 0 {
+			currentTimeMillis := currentTimeNanos / 1e6
+			capWindowStart = currentTimeMillis - currentTimeMillis%p.tokenCapWindowMillis
+			capWindowEnd = capWindowStart + p.tokenCapWindowMillis
+		}
+
+		if s.capWindow != nil && *s.capWindow == capWindowStart && s.capServed != nil {
+			tokensServed = *s.capServed
+		}
+
+		if tokensServed+requested > p.tokenCap {
+			return 0, false, true, capWindowEnd
+		}
+	}
+
+	granted = !windowsTooFarInDebt && tna-currentTimeNanos <= p.maxDebtNanos+p.overdraftNanos &&
+		(waitNanos <= 0 || waitNanos <= maxWaitNanos)
+	return waitNanos, granted, false, 0
+}
+
+// clientCache caches the state of buckets in the process, relying on Redis tracking the keys read
+// into it to invalidate them. Tracking is redirected to a connection of its own, subscribed to the
+// invalidation channel, since the client's connections speak RESP2 and can't receive pushes. The
+// client's RESP2 pub/sub can't parse invalidations either, which carry an array of keys, so the
+// connection is read by the cache itself. The cache is disabled for good once the connection is
+// lost, since invalidations may have been missed, until the factory reconnects to Redis.
+type clientCache struct {
+	opts       ClientCacheOptions
+	conn       net.Conn
+	redirectID int64
+	now        func() time.Time
+
+	sync.Mutex
+	// entries are the states cached, by the hash tag of their keys, "{namespace:bucket}". Entries
+	// not yet filled are placeholders for states being read, removed if invalidated meanwhile.
+	entries map[string]*bucketState
+	closed  bool
+}
+
+// newClientCache creates a client-side cache for the buckets of a client, failing if the Redis
+// server can't track keys or the invalidation connection can't be established.
+func newClientCache(client *redis.Client, redisOpts *redis.Options, opts ClientCacheOptions) (*clientCache, error) {
+	info, err := client.Info("server").Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the Redis version")
+	}
+
+	if version := redisVersion(info); !supportsTracking(version) {
+		return nil, errors.Errorf("Redis %v doesn't support client-side caching, which needs Redis 6", version)
+	}
+
+	conn, r, id, err := dialInvalidations(redisOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	return startClientCache(conn, r, id, opts), nil
+}
+
+// startClientCache creates a client-side cache reading invalidations from a connection subscribed
+// to them, whose client ID is redirectID.
+func startClientCache(conn net.Conn, r *bufio.Reader, redirectID int64, opts ClientCacheOptions) *clientCache {
+	if opts.MaxBuckets < 1 {
+		opts.MaxBuckets = defaultClientCacheMaxBuckets
+	}
+
+	if opts.MaxAge <= 0 {
+		opts.MaxAge = defaultClientCacheMaxAge
+	}
+
+	c := &clientCache{
+		opts:       opts,
+		conn:       conn,
+		redirectID: redirectID,
+		now:        time.Now,
+		entries:    make(map[string]*bucketState)}
+
+	go c.receive(r)
+	return c
+}
+
+func redisVersion(info string) string {
+	for _, line := range strings.Split(info, "\n") {
+		if strings.HasPrefix(line, "redis_version:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "redis_version:"))
+		}
+	}
+
+	return "unknown"
+}
+
+func supportsTracking(version string) bool {
+	major, err := strconv.Atoi(strings.SplitN(version, ".", 2)[0])
+	return err == nil && major >= 6
+}
+
+// dialInvalidations opens a connection to Redis subscribed to the invalidation channel, returning
+// its client ID to redirect tracking to.
+func dialInvalidations(redisOpts *redis.Options) (net.Conn, *bufio.Reader, int64, error) {
+	conn, err := redisOpts.Dialer()
+	if err != nil {
+		return nil, nil, 0, errors.Wrap(err, "failed to connect to Redis for invalidations")
+	}
+
+	timeout := redisOpts.DialTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	r := bufio.NewReader(conn)
+	id, err := subscribeInvalidations(conn, r, redisOpts.Password)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, 0, errors.Wrap(err, "failed to subscribe to invalidations")
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+	return conn, r, id, nil
+}
+
+func subscribeInvalidations(w io.Writer, r *bufio.Reader, password string) (int64, error) {
+	if password != "" {
+		if _, err := roundTrip(w, r, "AUTH", password); err != nil {
+			return 0, err
+		}
+	}
+
+	reply, err := roundTrip(w, r, "CLIENT", "ID")
+	if err != nil {
+		return 0, err
+	}
+
+	id, ok := reply.(int64)
+	if !ok {
+		return 0, errors.Errorf("unknown CLIENT ID response %v", reply)
+	}
+
+	reply, err = roundTrip(w, r, "SUBSCRIBE", invalidationChannel)
+	if err != nil {
+		return 0, err
+	}
+
+	if sub, ok := reply.([]interface{}); !ok || len(sub) != 3 || sub[0] != "subscribe" {
+		return 0, errors.Errorf("unknown SUBSCRIBE response %v", reply)
+	}
+
+	return id, nil
+}
+
+func roundTrip(w io.Writer, r *bufio.Reader, args ...string) (interface{}, error) {
+	if err := writeCommand(w, args...); err != nil {
+		return nil, err
+	}
+
+	return readReply(r)
+}
+
+// writeCommand writes a command in RESP2, as an array of bulk strings.
+func writeCommand(w io.Writer, args ...string) error {
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		b.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// readReply reads a RESP2 reply: a string for simple and bulk strings, an int64 for integers, an
+// []interface{} for arrays, and nil for null bulk strings and arrays. Error replies are returned as
+// errors.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.Errorf("malformed reply %q", line)
+	}
+
+	body := line[1 : len(line)-2]
+	switch line[0] {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, errors.New(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+
+		elems := make([]interface{}, n)
+		for i := range elems {
+			if elems[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+
+		return elems, nil
+	default:
+		return nil, errors.Errorf("malformed reply %q", line)
+	}
+}
+
+// receive evicts the states of the keys invalidated, or all of them if Redis flushed its keys, until
+// the connection is lost.
+func (c *clientCache) receive(r *bufio.Reader) {
+	for {
+		reply, err := readReply(r)
+		if err != nil {
+			if c.close() {
+				logging.Printf("Disabled the Redis client-side cache after losing invalidations: %v", err)
+			}
+			return
+		}
+
+		msg, ok := reply.([]interface{})
+		if !ok || len(msg) != 3 || msg[0] != "message" || msg[1] != invalidationChannel {
+			continue
+		}
+
+		switch keys := msg[2].(type) {
+		case nil:
+			c.flush()
+		case []interface{}:
+			for _, key := range keys {
+				if k, ok := key.(string); ok {
+					c.invalidate(k)
+				}
+			}
+		}
+	}
+}
+
+// close disables the cache, returning false if it was already disabled.
+func (c *clientCache) close() bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.closed {
+		return false
+	}
+
+	c.closed = true
+	c.entries = nil
+	_ = c.conn.Close()
+	return true
+}
+
+func (c *clientCache) flush() {
+	c.Lock()
+	defer c.Unlock()
+
+	if !c.closed {
+		c.entries = make(map[string]*bucketState)
+	}
+}
+
+// invalidate evicts the state of the bucket a key belongs to.
+func (c *clientCache) invalidate(key string) {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.entries, hashTag(key))
+}
+
+// hashTag returns the hash tag of a bucket's key, shared by all of its keys.
+func hashTag(key string) string {
+	if end := strings.IndexByte(key, '}'); strings.HasPrefix(key, "{") && end > 0 {
+		return key[:end+1]
+	}
+
+	return key
+}
+
+// state returns the state of the bucket with the given keys, reading it from Redis into the cache
+// if it isn't cached, or nil if the cache is disabled or the state couldn't be read.
+func (c *clientCache) state(client *redis.Client, keys []string) *bucketState {
+	tag := hashTag(keys[0])
+
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		return nil
+	}
+
+	if s := c.entries[tag]; s != nil && s.filled && s.key == keys[0] && c.now().Sub(s.filledAt) < c.opts.MaxAge {
+		c.Unlock()
+		return s
+	}
+
+	pending := &bucketState{key: keys[0]}
+	if _, exists := c.entries[tag]; !exists && len(c.entries) >= c.opts.MaxBuckets {
+		for evicted := range c.entries {
+			delete(c.entries, evicted)
+			break
+		}
+	}
+
+	c.entries[tag] = pending
+	c.Unlock()
+
+	s, err := c.read(client, keys)
+	if err != nil {
+		c.Lock()
+		if c.entries[tag] == pending {
+			delete(c.entries, tag)
+		}
+		c.Unlock()
+		return nil
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	// Only cached if not invalidated while being read.
+	if !c.closed && c.entries[tag] == pending {
+		c.entries[tag] = s
+	}
+
+	return s
+}
+
+// read reads the state of a bucket from Redis, tracking its keys on the connection reading them.
+// Tracking is turned on for each read, since the client may read through any of its connections.
+func (c *clientCache) read(client *redis.Client, keys []string) (*bucketState, error) {
+	var (
+		tracking *redis.Cmd
+		redisNow *redis.TimeCmd
+		balance  *redis.SliceCmd
+		windows  *redis.StringStringMapCmd
+		served   *redis.SliceCmd
+	)
+
+	localNow := c.now()
+	_, err := client.Pipelined(func(p redis.Pipeliner) error {
+		tracking = p.Do("CLIENT", "TRACKING", "on", "REDIRECT", c.redirectID)
+		redisNow = p.Time()
+		balance = p.MGet(keys[0], keys[1])
+		windows = p.HGetAll(keys[3])
+		served = p.HMGet(keys[2], "window", "served")
+		return nil
+	})
+	if err == nil {
+		err = tracking.Err()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	s := &bucketState{
+		key:              keys[0],
+		filled:           true,
+		filledAt:         localNow,
+		clockOffsetNanos: redisNow.Val().UnixNano() - localNow.UnixNano(),
+		windows:          make(map[string]int64)}
+
+	vals := balance.Val()
+	s.tokensNextAvailableNanos, s.accumulatedTokens = parseStored(vals[0]), parseStored(vals[1])
+	for field, val := range windows.Val() {
+		if v := parseStored(val); v != nil {
+			s.windows[field] = *v
+		}
+	}
+
+	vals = served.Val()
+	s.capWindow, s.capServed = parseStored(vals[0]), parseStored(vals[1])
+
+	return s, nil
+}
+
+// parseStored parses a number stored by the scripts, which Lua may have formatted in exponent
+// notation, or returns nil if it is missing.
+func parseStored(val interface{}) *int64 {
+	str, ok := val.(string)
+	if !ok {
+		return nil
+	}
+
+	f, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return nil
+	}
+
+	v := int64(f)
+	return &v
+}
+
+func min(x, y int64) int64 {
+	if x < y {
+		return x
+	}
+	return y
+}
+
+func maxNanos(x, y int64) int64 {
+	if x > y {
+		return x
+	}
+	return y
+}
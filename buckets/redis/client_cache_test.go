@@ -0,0 +1,202 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/square/quotaservice/config"
+	"github.com/square/quotaservice/protos/config"
+)
+
+func int64p(v int64) *int64 {
+	return &v
+}
+
+func TestBucketStatePeekProbe(t *testing.T) {
+	const now = int64(1e18) + 123456789
+
+	cfg := config.NewDefaultBucketConfig("")
+	p := newBucketParams(cfg)
+
+	// Keys missing from Redis are a full bucket.
+	empty := &bucketState{}
+	if tokens := empty.peek(&p, now); tokens != 100 {
+		t.Errorf("Expected a full bucket, got %v tokens", tokens)
+	}
+
+	if wait, granted, _, _ := empty.probe(&p, 10, 0, now); wait != 0 || !granted {
+		t.Errorf("Expected tokens to be granted at once, got %v, %v", wait, granted)
+	}
+
+	// A second in debt, at 50 tokens per second.
+	inDebt := &bucketState{tokensNextAvailableNanos: int64p(now + 1e9), accumulatedTokens: int64p(0)}
+	if tokens := inDebt.peek(&p, now); tokens != -50 {
+		t.Errorf("Expected 50 tokens of debt, got %v tokens", tokens)
+	}
+
+	if wait, granted, _, _ := inDebt.probe(&p, 1, 0, now); wait != 1e9 || granted {
+		t.Errorf("Expected a wait of 1s too long to be granted, got %v, %v", wait, granted)
+	}
+
+	if wait, granted, _, _ := inDebt.probe(&p, 1, 2e9, now); wait != 1e9 || !granted {
+		t.Errorf("Expected a wait of 1s to be granted, got %v, %v", wait, granted)
+	}
+
+	// Windows hold back tokens the bucket has.
+	cfg.RateWindows = []*quotaservice_configs.RateWindow{{Tokens: 10, WindowMillis: 1000}}
+	p = newBucketParams(cfg)
+	windowed := &bucketState{windows: map[string]int64{"1000:TNA": now + 5e8, "1000:AT": 0}}
+	if tokens := windowed.peek(&p, now); tokens != -5 {
+		t.Errorf("Expected the window to be 5 tokens in debt, got %v tokens", tokens)
+	}
+
+	if wait, granted, _, _ := windowed.probe(&p, 1, 1e9, now); wait != 5e8 || !granted {
+		t.Errorf("Expected the window's wait of 500ms to be granted, got %v, %v", wait, granted)
+	}
+
+	// The cap counts the tokens served in its current window only.
+	cfg.TokenCap = 5
+	cfg.TokenCapWindowMillis = 1000
+	p = newBucketParams(cfg)
+	capped := &bucketState{capWindow: int64p(1e12), capServed: int64p(5)}
+	if _, _, capReached, end := capped.probe(&p, 1, 0, now); !capReached || end != 1e12+1000 {
+		t.Errorf("Expected the cap to be reached until its window ends, got %v, %v", capReached, end)
+	}
+
+	capped.capWindow = int64p(1e12 - 1000)
+	if _, granted, capReached, _ := capped.probe(&p, 1, 0, now); capReached || !granted {
+		t.Errorf("Expected tokens served in earlier windows not to count, got %v, %v", capReached, granted)
+	}
+}
+
+func TestParseStored(t *testing.T) {
+	for val, expected := range map[interface{}]*int64{
+		"42":      int64p(42),
+		"-7":      int64p(-7),
+		"1.6e+18": int64p(1600000000000000000),
+		"nope":    nil,
+	} {
+		if v := parseStored(val); !reflect.DeepEqual(v, expected) {
+			t.Errorf("Expected %v to parse as %v, got %v", val, expected, v != nil)
+		}
+	}
+
+	if v := parseStored(nil); v != nil {
+		t.Errorf("Expected missing values to be unset, got %v", *v)
+	}
+}
+
+func TestSupportsTracking(t *testing.T) {
+	if v := redisVersion("# Server\r\nredis_version:6.2.6\r\nredis_git_sha1:00000000\r\n"); v != "6.2.6" {
+		t.Errorf("Expected version 6.2.6, got %v", v)
+	}
+
+	for version, expected := range map[string]bool{"5.0.7": false, "6.0.0": true, "7.2.4": true, "unknown": false} {
+		if supportsTracking(version) != expected {
+			t.Errorf("Expected Redis %v to support tracking: %v", version, expected)
+		}
+	}
+}
+
+func TestSubscribeInvalidations(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	received := make(chan []interface{}, 3)
+	go func() {
+		defer server.Close()
+
+		r := bufio.NewReader(server)
+		for _, reply := range []string{"+OK\r\n", ":42\r\n", "*3\r\n$9\r\nsubscribe\r\n$20\r\n__redis__:invalidate\r\n:1\r\n"} {
+			cmd, err := readReply(r)
+			if err != nil {
+				return
+			}
+
+			received <- cmd.([]interface{})
+			_, _ = io.WriteString(server, reply)
+		}
+	}()
+
+	id, err := subscribeInvalidations(client, bufio.NewReader(client), "secret")
+	if err != nil || id != 42 {
+		t.Fatalf("Expected client ID 42, got %v, %v", id, err)
+	}
+
+	for _, expected := range [][]interface{}{{"AUTH", "secret"}, {"CLIENT", "ID"}, {"SUBSCRIBE", invalidationChannel}} {
+		if cmd := <-received; !reflect.DeepEqual(cmd, expected) {
+			t.Errorf("Expected command %v, got %v", expected, cmd)
+		}
+	}
+}
+
+func TestClientCacheInvalidations(t *testing.T) {
+	server, client := net.Pipe()
+	c := startClientCache(client, bufio.NewReader(client), 7, ClientCacheOptions{})
+
+	fill := func(keys ...string) {
+		c.Lock()
+		defer c.Unlock()
+
+		for _, key := range keys {
+			c.entries[hashTag(key)] = &bucketState{key: key, filled: true, filledAt: c.now()}
+		}
+	}
+
+	cached := func(key string) bool {
+		c.Lock()
+		defer c.Unlock()
+
+		return c.entries[hashTag(key)] != nil
+	}
+
+	eventually := func(cond func() bool, msg string) {
+		t.Helper()
+
+		for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal(msg)
+			}
+		}
+	}
+
+	invalidation := func(payload string) string {
+		return fmt.Sprintf("*3\r\n$7\r\nmessage\r\n$%v\r\n%v\r\n%v", len(invalidationChannel), invalidationChannel, payload)
+	}
+
+	fill("{ns:a}:TNA:1", "{ns:b}:TNA:1")
+
+	// Any of a bucket's keys invalidate its state.
+	_, _ = io.WriteString(server, invalidation("*1\r\n$11\r\n{ns:a}:AT:1\r\n"))
+	eventually(func() bool { return !cached("{ns:a}:TNA:1") }, "Expected the invalidated bucket to be evicted")
+	if !cached("{ns:b}:TNA:1") {
+		t.Error("Expected other buckets to stay cached")
+	}
+
+	// Flushing Redis invalidates every key.
+	fill("{ns:a}:TNA:1")
+	_, _ = io.WriteString(server, invalidation("*-1\r\n"))
+	eventually(func() bool { return !cached("{ns:a}:TNA:1") && !cached("{ns:b}:TNA:1") }, "Expected a flush to evict every bucket")
+
+	// Invalidations may be missed once the connection is lost.
+	fill("{ns:a}:TNA:1")
+	_ = server.Close()
+	eventually(func() bool {
+		c.Lock()
+		defer c.Unlock()
+
+		return c.closed
+	}, "Expected the cache to be disabled once the connection is lost")
+
+	if s := c.state(nil, []string{"{ns:a}:TNA:1", "{ns:a}:AT:1", "{ns:a}:SERVED", "{ns:a}:WINDOWS:1"}); s != nil {
+		t.Errorf("Expected a disabled cache not to return states, got %+v", s)
+	}
+}
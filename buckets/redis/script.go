@@ -0,0 +1,78 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package redis
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+)
+
+// scripter is the part of a Redis client scripts are run with, satisfied by *redis.Client.
+type scripter interface {
+	Eval(script string, keys []string, args ...interface{}) *redis.Cmd
+	EvalSha(sha1 string, keys []string, args ...interface{}) *redis.Cmd
+	ScriptExists(hashes ...string) *redis.BoolSliceCmd
+	ScriptLoad(script string) *redis.StringCmd
+}
+
+// ScriptInfo describes a Lua script run in Redis by the bucket factory.
+type ScriptInfo struct {
+	Name string
+	// SHA is the SHA1 digest of the script, which it is run by with EVALSHA.
+	SHA string
+	// Loads counts the times the script was loaded into Redis with SCRIPT LOAD.
+	Loads int64
+}
+
+// cachedScript is a Lua script only sent to Redis to load it, and otherwise run by its SHA1 digest.
+type cachedScript struct {
+	*redis.Script
+	name  string
+	loads int64
+}
+
+func newCachedScript(name, src string) *cachedScript {
+	return &cachedScript{Script: redis.NewScript(src), name: name}
+}
+
+// Run runs the script with EVALSHA. If Redis doesn't have the script, e.g. after a restart or
+// SCRIPT FLUSH, it is loaded with SCRIPT LOAD and run again.
+func (s *cachedScript) Run(c scripter, keys []string, args ...interface{}) *redis.Cmd {
+	res := s.EvalSha(c, keys, args...)
+	if !isNoScriptError(res.Err()) {
+		return res
+	}
+
+	if err := s.load(c); err != nil {
+		return redis.NewCmdResult(nil, err)
+	}
+
+	return s.EvalSha(c, keys, args...)
+}
+
+// load loads the script into Redis, failing if Redis digests it differently than expected.
+func (s *cachedScript) load(c scripter) error {
+	sha, err := s.Load(c).Result()
+	if err != nil {
+		return errors.Wrapf(err, "failed to load script %v", s.name)
+	}
+
+	atomic.AddInt64(&s.loads, 1)
+	if sha != s.Hash() {
+		return errors.Errorf("script %v loaded with SHA %v, expected %v", s.name, sha, s.Hash())
+	}
+
+	return nil
+}
+
+func (s *cachedScript) info() ScriptInfo {
+	return ScriptInfo{Name: s.name, SHA: s.Hash(), Loads: atomic.LoadInt64(&s.loads)}
+}
+
+func isNoScriptError(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT ")
+}
@@ -0,0 +1,103 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package redis
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-redis/redis"
+)
+
+// flushedRedis is a scripter for a Redis that has lost its scripts, until they are loaded again.
+// It has no Eval, so scripts must not be sent to it to run.
+type flushedRedis struct {
+	scripter
+	loaded    map[string]bool
+	loads     int
+	evalShas  int
+	loadError error
+}
+
+func (f *flushedRedis) EvalSha(sha string, keys []string, args ...interface{}) *redis.Cmd {
+	f.evalShas++
+	if !f.loaded[sha] {
+		return redis.NewCmdResult(nil, errors.New("NOSCRIPT No matching script. Please use EVAL."))
+	}
+
+	return redis.NewCmdResult(int64(42), nil)
+}
+
+func (f *flushedRedis) ScriptLoad(src string) *redis.StringCmd {
+	f.loads++
+	if f.loadError != nil {
+		return redis.NewStringResult("", f.loadError)
+	}
+
+	sha := redis.NewScript(src).Hash()
+	f.loaded[sha] = true
+	return redis.NewStringResult(sha, nil)
+}
+
+func TestScriptReloadedOnNoScript(t *testing.T) {
+	s := newCachedScript("take", luaScript)
+	r := &flushedRedis{loaded: make(map[string]bool)}
+
+	res := s.Run(r, []string{"k"}, 1)
+	if v, err := res.Result(); err != nil || v != int64(42) {
+		t.Fatalf("Expected the script to be reloaded and run, got %v, %v", v, err)
+	}
+
+	if r.loads != 1 || r.evalShas != 2 {
+		t.Errorf("Expected 1 load and the call retried, got %v loads and %v calls", r.loads, r.evalShas)
+	}
+
+	// Once loaded, the script is only run by its SHA.
+	s.Run(r, []string{"k"}, 1)
+	if r.loads != 1 || r.evalShas != 3 {
+		t.Errorf("Expected no more loads, got %v loads and %v calls", r.loads, r.evalShas)
+	}
+
+	if info := s.info(); info.Name != "take" || info.SHA != s.Hash() || info.Loads != 1 {
+		t.Errorf("Unexpected script info %+v", info)
+	}
+
+	// Flushed again, e.g. by a restart.
+	r.loaded = make(map[string]bool)
+	if err := s.Run(r, []string{"k"}, 1).Err(); err != nil {
+		t.Errorf("Expected the script to be reloaded after a flush, got %v", err)
+	}
+
+	if s.info().Loads != 2 {
+		t.Errorf("Expected 2 loads, got %+v", s.info())
+	}
+}
+
+func TestScriptReloadFails(t *testing.T) {
+	s := newCachedScript("take", luaScript)
+	r := &flushedRedis{loaded: make(map[string]bool), loadError: errors.New("READONLY")}
+
+	if err := s.Run(r, []string{"k"}, 1).Err(); err == nil {
+		t.Error("Expected an error if the script can't be reloaded")
+	}
+
+	if r.evalShas != 1 {
+		t.Errorf("Expected the call not to be retried, got %v calls", r.evalShas)
+	}
+}
+
+func TestReloadScripts(t *testing.T) {
+	f := NewBucketFactory(&redis.Options{Addr: "localhost:1"}, 1, 0).(*bucketFactory)
+	r := &flushedRedis{loaded: make(map[string]bool)}
+
+	if err := f.loadScripts(r); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, info := range f.Scripts() {
+		if !r.loaded[info.SHA] || info.Loads != 1 {
+			t.Errorf("Expected script %v to be loaded once, got %+v", info.Name, info)
+		}
+	}
+}
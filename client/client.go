@@ -2,6 +2,7 @@ package client
 
 import (
 	"errors"
+	"net"
 	"time"
 
 	"github.com/square/quotaservice/protos"
@@ -21,6 +22,18 @@ func (c *Client) Allow(request *quotaservice.AllowRequest) (*quotaservice.AllowR
 	return c.qsClient.Allow(context.Background(), request)
 }
 
+// AllowWithContext is like Allow, but takes a context, e.g. carrying a deadline or metadata, and
+// call options.
+func (c *Client) AllowWithContext(ctx context.Context, request *quotaservice.AllowRequest, opts ...grpc.CallOption) (*quotaservice.AllowResponse, error) {
+	return c.qsClient.Allow(ctx, request, opts...)
+}
+
+// Probe invokes "Probe()", reporting whether the tokens of a raw ProbeRequest would be granted and
+// the estimated wait, without taking them.
+func (c *Client) Probe(ctx context.Context, request *quotaservice.ProbeRequest, opts ...grpc.CallOption) (*quotaservice.ProbeResponse, error) {
+	return c.qsClient.Probe(ctx, request, opts...)
+}
+
 // AllowBlocking adds some syntactic sugar, parsing the response from the QuotaService and blocking,
 // if necessary, until the requested quota is available. If this method doesn't return an error
 // response, it means quota has been granted and is usable by the time the method returns.
@@ -58,3 +71,13 @@ func New(target string, opts ...grpc.DialOption) (*Client, error) {
 
 	return &Client{conn, quotaservice.NewQuotaServiceClient(conn)}, nil
 }
+
+// NewUnix is like New, but connects to a server listening on the Unix domain socket at path, such
+// as a sidecar on the same host.
+func NewUnix(path string, opts ...grpc.DialOption) (*Client, error) {
+	dialer := grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+		return net.DialTimeout("unix", addr, timeout)
+	})
+
+	return New(path, append([]grpc.DialOption{dialer}, opts...)...)
+}
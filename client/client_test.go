@@ -1,8 +1,13 @@
 package client
 
 import (
+	"encoding/json"
+	"io/ioutil"
 	"math"
+	"net"
+	"net/http"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -13,7 +18,10 @@ import (
 	pb "github.com/square/quotaservice/protos"
 	qsgrpc "github.com/square/quotaservice/rpc/grpc"
 	"github.com/square/quotaservice/test/helpers"
+	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 )
 
 const target = "localhost:10990"
@@ -39,6 +47,16 @@ func setUp() {
 	helpers.PanicError(config.AddBucket(nsc, bc))
 	helpers.PanicError(config.AddNamespace(cfg, nsc))
 
+	// Serves at most 20 tokens at once: its size, plus 1 second of debt.
+	capped := config.NewDefaultNamespaceConfig("capped")
+	cappedBucket := config.NewDefaultBucketConfig("capped")
+	cappedBucket.Size = 10
+	cappedBucket.FillRate = 10
+	cappedBucket.MaxDebtMillis = 1000
+	cappedBucket.MaxTokensPerRequest = 100
+	helpers.PanicError(config.AddBucket(capped, cappedBucket))
+	helpers.PanicError(config.AddNamespace(cfg, capped))
+
 	server = quotaservice.New(memory.NewBucketFactory(),
 		config.NewMemoryConfig(cfg),
 		quotaservice.NewReaperConfigForTests(),
@@ -66,6 +84,91 @@ func TestClient(t *testing.T) {
 	}
 }
 
+func TestUnixSocketClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quotaservice")
+	helpers.CheckError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	socket := filepath.Join(dir, "qs.sock")
+
+	// Left behind by a server that didn't shut down.
+	stale, err := net.Listen("unix", socket)
+	helpers.CheckError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	helpers.CheckError(t, stale.Close())
+
+	cfg := config.NewDefaultServiceConfig()
+	cfg.GlobalDefaultBucket = config.NewDefaultBucketConfig(config.DefaultBucketName)
+	s := quotaservice.New(memory.NewBucketFactory(), config.NewMemoryConfig(cfg),
+		quotaservice.NewReaperConfigForTests(), 0,
+		qsgrpc.NewWithOptions("", events.NewNilProducer(), &qsgrpc.Options{UnixSocket: socket}))
+	_, err = s.Start()
+	helpers.CheckError(t, err)
+
+	client, err := NewUnix(socket, grpc.WithInsecure())
+	helpers.CheckError(t, err)
+	defer func() { _ = client.Close() }()
+
+	resp, err := client.Allow(&pb.AllowRequest{Namespace: "ns", BucketName: "b", TokensRequested: 1})
+	helpers.CheckError(t, err)
+	if resp.Status != pb.AllowResponse_OK {
+		t.Errorf("Expected OK over the socket. Was %v", pb.AllowResponse_Status_name[int32(resp.Status)])
+	}
+
+	_, err = s.Stop()
+	helpers.CheckError(t, err)
+
+	if _, err := os.Lstat(socket); !os.IsNotExist(err) {
+		t.Errorf("Expected the socket to be removed on shutdown, got %v", err)
+	}
+}
+
+func TestSharedPortClient(t *testing.T) {
+	const shared = "localhost:10991"
+
+	cfg := config.NewDefaultServiceConfig()
+	cfg.GlobalDefaultBucket = config.NewDefaultBucketConfig(config.DefaultBucketName)
+	mux := http.NewServeMux()
+	s := quotaservice.New(memory.NewBucketFactory(), config.NewMemoryConfig(cfg),
+		quotaservice.NewReaperConfigForTests(), 0,
+		qsgrpc.NewWithOptions(shared, events.NewNilProducer(), &qsgrpc.Options{HTTPHandler: mux}))
+	s.ServeAdminConsole(mux, "", false)
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+
+	client, err := New(shared, grpc.WithInsecure())
+	helpers.CheckError(t, err)
+
+	resp, err := client.Allow(&pb.AllowRequest{Namespace: "ns", BucketName: "b", TokensRequested: 1})
+	helpers.CheckError(t, err)
+	if resp.Status != pb.AllowResponse_OK {
+		t.Errorf("Expected OK over the shared port. Was %v", pb.AllowResponse_Status_name[int32(resp.Status)])
+	}
+
+	httpResp, err := http.Get("http://" + shared + "/api/status")
+	helpers.CheckError(t, err)
+
+	var status struct {
+		Version *int32 `json:"version"`
+	}
+	err = json.NewDecoder(httpResp.Body).Decode(&status)
+	_ = httpResp.Body.Close()
+	helpers.CheckError(t, err)
+
+	if httpResp.StatusCode != http.StatusOK || status.Version == nil {
+		t.Errorf("Expected the admin status over the shared port, got %v %+v", httpResp.Status, status)
+	}
+
+	helpers.CheckError(t, client.Close())
+	_, err = s.Stop()
+	helpers.CheckError(t, err)
+
+	if conn, err := net.Dial("tcp", shared); err == nil {
+		_ = conn.Close()
+		t.Error("Expected the shared port to be closed on shutdown")
+	}
+}
+
 func TestBlockingClient(t *testing.T) {
 	// Claim tokens
 	client, err := New(target, grpc.WithInsecure())
@@ -102,3 +205,40 @@ func TestBlockingClient(t *testing.T) {
 	}
 
 }
+
+func TestTooManyTokens(t *testing.T) {
+	client, err := New(target, grpc.WithInsecure())
+	helpers.CheckError(t, err)
+	defer func() { _ = client.Close() }()
+
+	allow := func(tokens int64, opts ...grpc.CallOption) (*pb.AllowResponse, error) {
+		return client.qsClient.Allow(context.Background(), &pb.AllowRequest{
+			Namespace:           "capped",
+			BucketName:          "capped",
+			TokensRequested:     tokens,
+			MaxWaitTimeOverride: true}, opts...)
+	}
+
+	// More tokens than the bucket could ever serve at once fail the call, naming the maximum.
+	var trailer metadata.MD
+	if _, err := allow(21, grpc.Trailer(&trailer)); grpc.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected %v, got %v", codes.InvalidArgument, err)
+	}
+
+	if max := trailer[qsgrpc.MaxTokensMetadataKey]; len(max) != 1 || max[0] != "20" {
+		t.Errorf("Expected a max of 20 tokens in the trailer, got %v", trailer)
+	}
+
+	// A request the bucket can serve, but not without waiting, is merely throttled.
+	resp, err := allow(20)
+	helpers.CheckError(t, err)
+	if resp.Status != pb.AllowResponse_OK {
+		t.Fatalf("Expected OK. Was %v", resp.Status)
+	}
+
+	resp, err = allow(1)
+	helpers.CheckError(t, err)
+	if resp.Status != pb.AllowResponse_REJECTED_TIMEOUT {
+		t.Fatalf("Expected %v. Was %v", pb.AllowResponse_REJECTED_TIMEOUT, resp.Status)
+	}
+}
@@ -0,0 +1,86 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package config
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// ConfigChange describes a config that has been applied by the quotaservice.
+type ConfigChange struct {
+	Version int32 `json:"version"`
+	// User is who persisted the config, if known.
+	User string `json:"user,omitempty"`
+	// Date is when the config was persisted, in seconds since the epoch, if known.
+	Date    int64       `json:"date,omitempty"`
+	Diff    *ConfigDiff `json:"diff,omitempty"`
+	Summary string      `json:"summary,omitempty"`
+}
+
+// ConfigChangeSource publishes the config changes applied by the quotaservice. The server's
+// admin.Administrable is one.
+type ConfigChangeSource interface {
+	// SubscribeConfigChanges returns a channel notified of every config applied, buffered to the
+	// given size, and a function to unsubscribe.
+	SubscribeConfigChanges(int) (<-chan *ConfigChange, func())
+}
+
+// ConfigChangeBroadcaster fans out config changes to multiple subscribers. Each subscriber has its
+// own buffer; changes are dropped for subscribers that are too slow to keep up, rather than
+// blocking the publisher.
+type ConfigChangeBroadcaster struct {
+	subscribers map[chan *ConfigChange]struct{}
+	dropped     uint64
+	sync.RWMutex
+}
+
+// NewConfigChangeBroadcaster creates a new ConfigChangeBroadcaster with no subscribers.
+func NewConfigChangeBroadcaster() *ConfigChangeBroadcaster {
+	return &ConfigChangeBroadcaster{subscribers: make(map[chan *ConfigChange]struct{})}
+}
+
+// Subscribe registers a new subscriber with a buffer of bufSize changes. The returned function
+// unsubscribes, and closes the channel.
+func (b *ConfigChangeBroadcaster) Subscribe(bufSize int) (<-chan *ConfigChange, func()) {
+	if bufSize < 1 {
+		bufSize = 1
+	}
+
+	ch := make(chan *ConfigChange, bufSize)
+
+	b.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.Lock()
+			delete(b.subscribers, ch)
+			b.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Publish sends a change to all subscribers, without blocking.
+func (b *ConfigChangeBroadcaster) Publish(c *ConfigChange) {
+	b.RLock()
+	defer b.RUnlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- c:
+		// OK
+		default:
+			atomic.AddUint64(&b.dropped, 1)
+		}
+	}
+}
+
+// Dropped returns the number of changes dropped due to slow subscribers.
+func (b *ConfigChangeBroadcaster) Dropped() uint64 {
+	return atomic.LoadUint64(&b.dropped)
+}
@@ -0,0 +1,81 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package config
+
+import (
+	"sort"
+
+	pb "github.com/square/quotaservice/protos/config"
+)
+
+// MemoryBudget caps the memory dynamic buckets may use if every namespace creates as many as it
+// allows.
+type MemoryBudget struct {
+	// MaxBytes is the memory all dynamic buckets may use together.
+	MaxBytes int64
+	// BytesPerBucket estimates the memory used by a single bucket, which depends on the backend.
+	BytesPerBucket int64
+}
+
+// ValidateWithBudget is Validate, additionally checking a config against a MemoryBudget with
+// ValidateMemoryBudget. A nil budget isn't checked.
+func ValidateWithBudget(cfg *pb.ServiceConfig, budget *MemoryBudget) error {
+	err := Validate(cfg)
+	if cfg == nil {
+		return err
+	}
+
+	errs, _ := err.(ValidationErrors)
+	if budgetErr, ok := ValidateMemoryBudget(cfg, budget).(ValidationErrors); ok {
+		errs = append(errs, budgetErr...)
+	}
+
+	if len(errs) == 0 {
+		return err
+	}
+
+	return errs
+}
+
+// ValidateMemoryBudget returns ValidationErrors if the dynamic buckets of a config could use more
+// memory than a budget allows: namespaces with a dynamic bucket template must cap their dynamic
+// buckets, and together may only create as many as the budget fits. A nil budget always passes.
+func ValidateMemoryBudget(cfg *pb.ServiceConfig, budget *MemoryBudget) error {
+	if cfg == nil || budget == nil {
+		return nil
+	}
+
+	var errs ValidationErrors
+	var total int64
+
+	names := NamespaceNames(cfg)
+	sort.Strings(names)
+
+	for _, name := range names {
+		ns := cfg.Namespaces[name]
+		if ns == nil || ns.DynamicBucketTemplate == nil {
+			continue
+		}
+
+		// 0 allows any number of dynamic buckets.
+		if ns.MaxDynamicBuckets <= 0 {
+			errs.add("namespaces."+name+".max_dynamic_buckets",
+				"must be set to stay within the dynamic bucket memory budget of %v bytes", budget.MaxBytes)
+			continue
+		}
+
+		total += int64(ns.MaxDynamicBuckets) * budget.BytesPerBucket
+	}
+
+	if total > budget.MaxBytes {
+		errs.add("namespaces", "dynamic buckets could use %v bytes, exceeding the memory budget of %v bytes",
+			total, budget.MaxBytes)
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return errs
+}
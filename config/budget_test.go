@@ -0,0 +1,81 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package config
+
+import (
+	"testing"
+
+	pb "github.com/square/quotaservice/protos/config"
+)
+
+func budgetTestConfig(maxDynamicBuckets ...int32) *pb.ServiceConfig {
+	cfg := NewDefaultServiceConfig()
+	for i, max := range maxDynamicBuckets {
+		ns := NewDefaultNamespaceConfig(string(rune('a' + i)))
+		SetDynamicBucketTemplate(ns, NewDefaultBucketConfig(""))
+		ns.MaxDynamicBuckets = max
+		_ = AddNamespace(cfg, ns)
+	}
+
+	// Namespaces without dynamic buckets take no part in the budget.
+	_ = AddNamespace(cfg, NewDefaultNamespaceConfig("static"))
+
+	return cfg
+}
+
+func budgetErrorFields(t *testing.T, err error) map[string]bool {
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("Expected ValidationErrors, got %v", err)
+	}
+
+	fields := make(map[string]bool)
+	for _, e := range errs {
+		fields[e.Field] = true
+	}
+
+	return fields
+}
+
+func TestValidateMemoryBudget(t *testing.T) {
+	budget := &MemoryBudget{MaxBytes: 1 << 20, BytesPerBucket: 1024}
+
+	if err := ValidateMemoryBudget(budgetTestConfig(512, 512), budget); err != nil {
+		t.Errorf("Expected a config exactly within the budget to be valid, got %v", err)
+	}
+
+	fields := budgetErrorFields(t, ValidateMemoryBudget(budgetTestConfig(512, 100000), budget))
+	if !fields["namespaces"] || len(fields) != 1 {
+		t.Errorf("Expected a config overshooting the budget to be rejected, got %v", fields)
+	}
+
+	fields = budgetErrorFields(t, ValidateMemoryBudget(budgetTestConfig(1, 0), budget))
+	if !fields["namespaces.b.max_dynamic_buckets"] || len(fields) != 1 {
+		t.Errorf("Expected unlimited dynamic buckets to be rejected, got %v", fields)
+	}
+
+	if err := ValidateMemoryBudget(budgetTestConfig(100000, 0), nil); err != nil {
+		t.Errorf("Expected no budget to allow any config, got %v", err)
+	}
+}
+
+func TestValidateWithBudget(t *testing.T) {
+	budget := &MemoryBudget{MaxBytes: 1024, BytesPerBucket: 1024}
+	cfg := budgetTestConfig(2)
+	cfg.GlobalDefaultBucket = &pb.BucketConfig{Size: -1}
+
+	fields := budgetErrorFields(t, ValidateWithBudget(cfg, budget))
+	if !fields["global_default_bucket.size"] || !fields["namespaces"] {
+		t.Errorf("Expected both validation and budget errors, got %v", fields)
+	}
+
+	cfg.GlobalDefaultBucket = nil
+	if err := Validate(cfg); err != nil {
+		t.Errorf("Expected Validate to ignore the budget, got %v", err)
+	}
+
+	if ValidateWithBudget(nil, budget) == nil {
+		t.Error("Expected a nil config to be invalid")
+	}
+}
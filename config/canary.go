@@ -0,0 +1,113 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package config
+
+import (
+	"hash/fnv"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/square/quotaservice/protos/config"
+)
+
+const (
+	// CanaryLabel is the label set on buckets configured with a canary, to CanaryGroup on buckets
+	// evaluated against the canary and BaselineGroup on the rest, so their events can be compared.
+	CanaryLabel   = "canary"
+	CanaryGroup   = "canary"
+	BaselineGroup = "baseline"
+)
+
+// InCanary returns true if a bucket falls within the percent of buckets evaluated against a canary.
+// Buckets are chosen by hashing their name, so a bucket is consistently in or out of the canary, and
+// stays in it as the percent grows.
+func InCanary(namespace, bucketName string, percent int32) bool {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(FullyQualifiedName(namespace, bucketName)))
+
+	return int32(h.Sum32()%100) < percent
+}
+
+// CanaryConfig returns the config a bucket is evaluated against. If b has a canary, this is a copy
+// of b with the canary's fields applied if the bucket is in the canary, labeled with its group.
+// Otherwise b is returned.
+func CanaryConfig(namespace, bucketName string, b *pb.BucketConfig) *pb.BucketConfig {
+	if b == nil || b.Canary == nil {
+		return b
+	}
+
+	group := BaselineGroup
+	resolved := proto.Clone(b).(*pb.BucketConfig)
+	resolved.Canary = nil
+	resolved.CanaryPercent = 0
+
+	if InCanary(namespace, bucketName, b.CanaryPercent) {
+		group = CanaryGroup
+		applyOverrides(resolved, b.Canary)
+	}
+
+	if resolved.Labels == nil {
+		resolved.Labels = make(map[string]string, 1)
+	}
+
+	resolved.Labels[CanaryLabel] = group
+	return resolved
+}
+
+// applyOverrides overrides the fields of b set on overrides, such as those of a canary.
+func applyOverrides(b, overrides *pb.BucketConfig) {
+	fields := []struct {
+		field *int64
+		value int64
+	}{
+		{&b.Size, overrides.Size},
+		{&b.FillRate, overrides.FillRate},
+		{&b.WaitTimeoutMillis, overrides.WaitTimeoutMillis},
+		{&b.MaxIdleMillis, overrides.MaxIdleMillis},
+		{&b.EvictionGraceMillis, overrides.EvictionGraceMillis},
+		{&b.MaxDebtMillis, overrides.MaxDebtMillis},
+		{&b.MaxTokensPerRequest, overrides.MaxTokensPerRequest},
+		{&b.RampStartFillRate, overrides.RampStartFillRate},
+		{&b.RampStartMillis, overrides.RampStartMillis},
+		{&b.RampDurationMillis, overrides.RampDurationMillis},
+		{&b.MaxDebt, overrides.MaxDebt},
+		{&b.MaxWaiters, overrides.MaxWaiters},
+		{&b.TokenCap, overrides.TokenCap},
+		{&b.TokenCapWindowMillis, overrides.TokenCapWindowMillis},
+	}
+
+	for _, f := range fields {
+		if f.value != 0 {
+			*f.field = f.value
+		}
+	}
+
+	if overrides.RampSteps != 0 {
+		b.RampSteps = overrides.RampSteps
+	}
+
+	if overrides.OverMaxTokensPolicy != "" {
+		b.OverMaxTokensPolicy = overrides.OverMaxTokensPolicy
+	}
+
+	// Rate windows are overridden together, since windows don't have names to be matched by.
+	if len(overrides.RateWindows) > 0 {
+		b.RateWindows = make([]*pb.RateWindow, len(overrides.RateWindows))
+		for i, w := range overrides.RateWindows {
+			b.RateWindows[i] = proto.Clone(w).(*pb.RateWindow)
+		}
+	}
+
+	// Overrides can disable b, but not re-enable it, since an unset bool is false.
+	if overrides.Disabled {
+		b.Disabled = true
+	}
+
+	if len(overrides.Labels) > 0 && b.Labels == nil {
+		b.Labels = make(map[string]string, len(overrides.Labels))
+	}
+
+	for name, value := range overrides.Labels {
+		b.Labels[name] = value
+	}
+}
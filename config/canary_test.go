@@ -0,0 +1,88 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package config
+
+import (
+	"fmt"
+	"testing"
+
+	pb "github.com/square/quotaservice/protos/config"
+)
+
+func TestInCanary(t *testing.T) {
+	const numBuckets = 10000
+
+	for _, percent := range []int32{0, 5, 20, 50, 100} {
+		inCanary := 0
+		for i := 0; i < numBuckets; i++ {
+			name := fmt.Sprintf("client.%v", i)
+			in := InCanary("foo", name, percent)
+
+			for j := 0; j < 3; j++ {
+				if InCanary("foo", name, percent) != in {
+					t.Fatalf("Expected bucket %v to be consistently in or out of a %v%% canary", name, percent)
+				}
+			}
+
+			// Buckets stay in the canary as it grows.
+			if in && !InCanary("foo", name, percent+1) {
+				t.Errorf("Expected bucket %v to stay in the canary growing from %v%%", name, percent)
+			}
+
+			if in {
+				inCanary++
+			}
+		}
+
+		// Within 1.5%.
+		if expected := int(percent) * numBuckets / 100; inCanary < expected-150 || inCanary > expected+150 {
+			t.Errorf("Expected about %v buckets in a %v%% canary, got %v", expected, percent, inCanary)
+		}
+	}
+}
+
+func TestCanaryConfig(t *testing.T) {
+	b := NewDefaultBucketConfig("bar")
+	ApplyBucketDefaults(b)
+
+	if CanaryConfig("foo", "bar", b) != b {
+		t.Error("Expected a bucket without a canary to use its config")
+	}
+
+	b.Labels = map[string]string{"team": "search"}
+	b.Canary = &pb.BucketConfig{FillRate: 500, Labels: map[string]string{"team": "ads"}}
+
+	b.CanaryPercent = 0
+	baseline := CanaryConfig("foo", "bar", b)
+
+	b.CanaryPercent = 100
+	canary := CanaryConfig("foo", "bar", b)
+
+	for _, tc := range []struct {
+		group    string
+		resolved *pb.BucketConfig
+		fillRate int64
+		team     string
+	}{
+		{BaselineGroup, baseline, b.FillRate, "search"},
+		{CanaryGroup, canary, 500, "ads"},
+	} {
+		r := tc.resolved
+		if r.Labels[CanaryLabel] != tc.group || r.Labels["team"] != tc.team {
+			t.Errorf("Expected the %v config to be labeled with team %v, got %v", tc.group, tc.team, r.Labels)
+		}
+
+		if r.FillRate != tc.fillRate || r.Size != b.Size || r.Name != b.Name {
+			t.Errorf("Expected the %v config to fill at %v, inheriting the rest, got %v", tc.group, tc.fillRate, r)
+		}
+
+		if r.Canary != nil || r.CanaryPercent != 0 {
+			t.Errorf("Expected the %v config to be resolved, got %v", tc.group, r)
+		}
+	}
+
+	if b.Labels[CanaryLabel] != "" || b.FillRate == 500 {
+		t.Errorf("Expected the bucket config to be left unchanged, got %v", b)
+	}
+}
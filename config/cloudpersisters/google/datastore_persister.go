@@ -22,10 +22,10 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/datastore"
-	"github.com/golang/protobuf/proto"
 	"golang.org/x/net/context"
 	"google.golang.org/api/option"
 
@@ -55,12 +55,15 @@ type DatastoreConfigPersister struct {
 	*internal.Notifier
 	version     int
 	newVersions chan int
+	// lastPolled is when Datastore was last polled successfully, in nanoseconds since the epoch.
+	lastPolled int64
+	unknown    config.UnknownFields
 }
 
 func (p *DatastoreConfigPersister) PersistAndNotify(oldHash string, cfg *pb.ServiceConfig) error {
 	// TODO(manik) Optimistic version check with oldHash
 
-	b, e := proto.Marshal(cfg)
+	b, e := p.unknown.Marshal(cfg)
 	if e != nil {
 		return e
 	}
@@ -89,7 +92,7 @@ func (p *DatastoreConfigPersister) PersistAndNotify(oldHash string, cfg *pb.Serv
 			}
 
 			// This version already exists. Do not overwrite.
-			logging.Printf("Version %v already exists; not clobbering.", cfg.Version)
+			logging.Warnf("Version %v already exists; not clobbering.", cfg.Version)
 			return nil
 		}
 
@@ -115,6 +118,11 @@ func (p *DatastoreConfigPersister) ConfigChangedWatcher() <-chan struct{} {
 	return p.Notifier.Watcher
 }
 
+// UnknownFields implements config.UnknownFieldsKeeper.
+func (p *DatastoreConfigPersister) UnknownFields() *config.UnknownFields {
+	return &p.unknown
+}
+
 func (p *DatastoreConfigPersister) ReadPersistedConfig() (*pb.ServiceConfig, error) {
 	_, s, e := p.getLatest(false)
 	if e != nil {
@@ -123,6 +131,7 @@ func (p *DatastoreConfigPersister) ReadPersistedConfig() (*pb.ServiceConfig, err
 
 	p.newVersions <- int(s.Version)
 
+	p.unknown.Observe(s.Contents)
 	return config.UnmarshalBytes(s.Contents)
 }
 
@@ -181,9 +190,10 @@ func (p *DatastoreConfigPersister) poll(pollingDuration time.Duration) {
 		case <-t.C:
 			k, _, e := p.getLatest(true)
 			if e != nil {
-				logging.Printf("Caught error %v when polling Google Datastore", e)
+				logging.Warnf("Caught error %v when polling Google Datastore", e)
 			} else {
-				logging.Printf("Latest version is %v", versionOf(k))
+				atomic.StoreInt64(&p.lastPolled, time.Now().UnixNano())
+				logging.Debugf("Latest version is %v", versionOf(k))
 				if versionOf(k) > p.version {
 					p.Notify()
 				}
@@ -194,6 +204,15 @@ func (p *DatastoreConfigPersister) poll(pollingDuration time.Duration) {
 	}
 }
 
+// LastPolled returns when Datastore was last polled for a new version successfully.
+func (p *DatastoreConfigPersister) LastPolled() time.Time {
+	if polled := atomic.LoadInt64(&p.lastPolled); polled != 0 {
+		return time.Unix(0, polled)
+	}
+
+	return time.Time{}
+}
+
 func versionOf(k *datastore.Key) int {
 	parts := strings.Split(k.Name, ":")
 	i, _ := strconv.ParseInt(parts[1], 10, 64)
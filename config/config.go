@@ -24,16 +24,40 @@ const (
 	GlobalNamespace           = "___GLOBAL___"
 	DefaultBucketName         = "___DEFAULT_BUCKET___"
 	DynamicBucketTemplateName = "___DYNAMIC_BUCKET_TPL___"
+	NamespaceLimitBucketName  = "___NAMESPACE_LIMIT___"
 	initialVersion            = 0
 	initialHash               = "___INITIAL_HASH___"
 )
 
+// The policies for requests over the max_tokens_per_request of a bucket.
+const (
+	// OverMaxTokensReject fails requests over max_tokens_per_request. Buckets without a policy
+	// reject them.
+	OverMaxTokensReject = "reject"
+	// OverMaxTokensClamp grants requests over max_tokens_per_request as many tokens as it allows.
+	OverMaxTokensClamp = "clamp"
+)
+
+// The backends a namespace's buckets may be held by, if the service's bucket factory is a
+// quotaservice.BackendBucketFactory.
+const (
+	// BackendRedis holds buckets in Redis, so their limits are shared by every instance.
+	BackendRedis = "redis"
+	// BackendMemory holds buckets in the memory of each instance, so each enforces its own limits.
+	BackendMemory = "memory"
+)
+
 func ApplyDefaults(sc *pb.ServiceConfig) {
 	if sc.GlobalDefaultBucket != nil {
 		ApplyBucketDefaults(sc.GlobalDefaultBucket)
 		sc.GlobalDefaultBucket.Name = DefaultBucketName
 	}
 
+	for name, t := range sc.Templates {
+		ApplyBucketDefaults(t)
+		t.Name = name
+	}
+
 	for name, ns := range sc.Namespaces {
 		ns.Name = name
 		if ns.DefaultBucket != nil && ns.DynamicBucketTemplate != nil {
@@ -57,6 +81,12 @@ func ApplyDefaults(sc *pb.ServiceConfig) {
 			ns.DynamicBucketTemplate.Namespace = ns.Name
 		}
 
+		if ns.NamespaceLimit != nil {
+			ApplyBucketDefaults(ns.NamespaceLimit)
+			ns.NamespaceLimit.Name = NamespaceLimitBucketName
+			ns.NamespaceLimit.Namespace = ns.Name
+		}
+
 		for n, b := range ns.Buckets {
 			ApplyBucketDefaults(b)
 			b.Name = n
@@ -78,7 +108,37 @@ func NamespaceNames(sc *pb.ServiceConfig) []string {
 	return names
 }
 
+// CatchAllBucket returns the namespace and name of the bucket serving requests that match no
+// bucket, or false if the config declares none. Configs declaring several, which don't validate,
+// return the first in order of namespace and bucket names.
+func CatchAllBucket(sc *pb.ServiceConfig) (namespace, bucketName string, ok bool) {
+	if sc == nil {
+		return "", "", false
+	}
+
+	visitBuckets(sc, func(field, ns, name string, b *pb.BucketConfig) {
+		if b.CatchAll && !ok && !reservedBucket(ns, name) {
+			namespace, bucketName, ok = ns, name, true
+		}
+	})
+
+	return namespace, bucketName, ok
+}
+
+// reservedBucket returns true for the buckets of a config that aren't named buckets, such as the
+// global and namespace default buckets.
+func reservedBucket(namespace, bucketName string) bool {
+	return namespace == GlobalNamespace || bucketName == DefaultBucketName ||
+		bucketName == DynamicBucketTemplateName || bucketName == NamespaceLimitBucketName
+}
+
+// ApplyBucketDefaults fills in the fields of a bucket config left unset. Buckets created from a
+// template are left as they are, taking the fields they don't set from the template instead.
 func ApplyBucketDefaults(b *pb.BucketConfig) {
+	if b.Template != "" {
+		return
+	}
+
 	if b.Size == 0 {
 		b.Size = 100
 	}
@@ -104,6 +164,17 @@ func ApplyBucketDefaults(b *pb.BucketConfig) {
 	}
 }
 
+// MaxTokensAtOnce returns the most tokens a bucket could ever serve a single request: its size and
+// max debt, plus the tokens it may claim ahead of their availability within its max debt millis at
+// its fill rate.
+func MaxTokensAtOnce(b *pb.BucketConfig) int64 {
+	if b.MaxDebtMillis <= 0 {
+		return b.Size + b.MaxDebt
+	}
+
+	return b.Size + b.MaxDebt + b.MaxDebtMillis*b.FillRate/1000
+}
+
 func FQN(b *pb.BucketConfig) string {
 	if b.Namespace == "" {
 		// This is a global default.
@@ -132,6 +203,11 @@ func ReadConfig(yamlStream io.Reader) *pb.ServiceConfig {
 }
 
 func readConfigFromBytes(bytes []byte) *pb.ServiceConfig {
+	bytes, err := yamlWithRates(bytes)
+	if err != nil {
+		panic(fmt.Sprintf("Unable to read YAML. Error: %v", err))
+	}
+
 	cfg := NewDefaultServiceConfig()
 	cfg.GlobalDefaultBucket = nil
 	if err := yaml.Unmarshal(bytes, cfg); err != nil {
@@ -167,7 +243,14 @@ func NewDefaultBucketConfig(name string) *pb.BucketConfig {
 		Name:              name}
 }
 
+// FromJSON parses a config in JSON. Rates such as fill_rate may be written as rate strings, e.g.
+// "100/s", as described by ParseRate, returning ValidationErrors for those that can't be parsed.
 func FromJSON(j []byte) (*pb.ServiceConfig, error) {
+	j, err := jsonWithRates(j)
+	if err != nil {
+		return nil, err
+	}
+
 	p := &pb.ServiceConfig{}
 	e := json.Unmarshal(j, p)
 	if e != nil {
@@ -177,7 +260,34 @@ func FromJSON(j []byte) (*pb.ServiceConfig, error) {
 	return p, nil
 }
 
+// FromYAML parses a config in the same YAML format as ReadConfig, returning an error rather than
+// panicking on bad input. Defaults are not applied. Rate strings are parsed as by FromJSON.
+func FromYAML(y []byte) (*pb.ServiceConfig, error) {
+	y, err := yamlWithRates(y)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &pb.ServiceConfig{}
+	if e := yaml.Unmarshal(y, p); e != nil {
+		return nil, e
+	}
+
+	return p, nil
+}
+
+// ToYAML renders a config in the YAML format read by FromYAML and ReadConfig.
+func ToYAML(p *pb.ServiceConfig) ([]byte, error) {
+	return yaml.Marshal(p)
+}
+
+// NamespaceFromJSON parses a namespace config in JSON, with rate strings parsed as by FromJSON.
 func NamespaceFromJSON(j []byte) (*pb.NamespaceConfig, error) {
+	j, err := jsonWithRates(j)
+	if err != nil {
+		return nil, err
+	}
+
 	p := &pb.NamespaceConfig{}
 	e := json.Unmarshal(j, p)
 	if e != nil {
@@ -245,6 +355,14 @@ func SetDynamicBucketTemplate(n *pb.NamespaceConfig, b *pb.BucketConfig) {
 	n.DynamicBucketTemplate = b
 }
 
+// SetRequestCost declares the number of tokens taken by requests of a kind in a namespace.
+func SetRequestCost(n *pb.NamespaceConfig, kind string, cost int64) {
+	if n.RequestCosts == nil {
+		n.RequestCosts = make(map[string]int64)
+	}
+	n.RequestCosts[kind] = cost
+}
+
 func AddNamespace(s *pb.ServiceConfig, n *pb.NamespaceConfig) error {
 	if n.Name == "" {
 		return errors.New("Namespace name cannot be nil or empty.")
@@ -270,15 +388,62 @@ func DifferentBucketConfigs(c1, c2 *pb.BucketConfig) bool {
 		c1.FillRate != c2.FillRate ||
 		c1.WaitTimeoutMillis != c2.WaitTimeoutMillis ||
 		c1.MaxIdleMillis != c2.MaxIdleMillis ||
+		c1.EvictionGraceMillis != c2.EvictionGraceMillis ||
 		c1.MaxDebtMillis != c2.MaxDebtMillis ||
-		c1.MaxTokensPerRequest != c2.MaxTokensPerRequest
+		c1.MaxTokensPerRequest != c2.MaxTokensPerRequest ||
+		c1.RampStartFillRate != c2.RampStartFillRate ||
+		c1.RampStartMillis != c2.RampStartMillis ||
+		c1.RampDurationMillis != c2.RampDurationMillis ||
+		c1.RampSteps != c2.RampSteps ||
+		differentLabels(c1.Labels, c2.Labels) ||
+		c1.CanaryPercent != c2.CanaryPercent ||
+		DifferentBucketConfigs(c1.Canary, c2.Canary) ||
+		c1.Template != c2.Template ||
+		c1.MaxDebt != c2.MaxDebt ||
+		c1.Disabled != c2.Disabled ||
+		c1.OverMaxTokensPolicy != c2.OverMaxTokensPolicy ||
+		c1.MaxWaiters != c2.MaxWaiters ||
+		c1.TokenCap != c2.TokenCap ||
+		c1.TokenCapWindowMillis != c2.TokenCapWindowMillis ||
+		differentRateWindows(c1.RateWindows, c2.RateWindows) ||
+		c1.CatchAll != c2.CatchAll
+}
+
+func differentRateWindows(w1, w2 []*pb.RateWindow) bool {
+	if len(w1) != len(w2) {
+		return true
+	}
+
+	for i := range w1 {
+		if w1[i].Tokens != w2[i].Tokens || w1[i].WindowMillis != w2[i].WindowMillis {
+			return true
+		}
+	}
+
+	return false
+}
+
+func differentLabels(l1, l2 map[string]string) bool {
+	if len(l1) != len(l2) {
+		return true
+	}
+
+	for name, value := range l1 {
+		if v2, exists := l2[name]; !exists || v2 != value {
+			return true
+		}
+	}
+
+	return false
 }
 
 func DifferentNamespaceConfigs(c1, c2 *pb.NamespaceConfig) bool {
 	different := c1.Name != c2.Name ||
 		c1.MaxDynamicBuckets != c2.MaxDynamicBuckets ||
+		c1.Backend != c2.Backend ||
 		DifferentBucketConfigs(c1.DefaultBucket, c2.DefaultBucket) ||
 		DifferentBucketConfigs(c1.DynamicBucketTemplate, c2.DynamicBucketTemplate) ||
+		DifferentBucketConfigs(c1.NamespaceLimit, c2.NamespaceLimit) ||
 		len(c1.Buckets) != len(c2.Buckets)
 
 	if different {
@@ -297,6 +462,23 @@ func DifferentNamespaceConfigs(c1, c2 *pb.NamespaceConfig) bool {
 	return false
 }
 
+// DifferentRequestCosts returns true if two namespace configs declare different token costs for
+// request kinds. Unlike other namespace changes, these apply without recreating buckets, so
+// DifferentNamespaceConfigs ignores them, as it does disabling a namespace.
+func DifferentRequestCosts(c1, c2 *pb.NamespaceConfig) bool {
+	if len(c1.RequestCosts) != len(c2.RequestCosts) {
+		return true
+	}
+
+	for kind, cost := range c1.RequestCosts {
+		if c2Cost, exists := c2.RequestCosts[kind]; !exists || c2Cost != cost {
+			return true
+		}
+	}
+
+	return false
+}
+
 func CloneConfig(cfg *pb.ServiceConfig) *pb.ServiceConfig {
 	return proto.Clone(cfg).(*pb.ServiceConfig)
 }
@@ -17,6 +17,9 @@ const cfgYaml = `namespaces:
   no_default_no_dynamic:
     buckets:
       one:
+        labels:
+          team: search
+          tier: "1"
         fill_rate: 321
         wait_timeout_millis: 9999
         max_idle_millis: 20000
@@ -30,7 +33,10 @@ const cfgYaml = `namespaces:
       wait_timeout_millis: 8888
       max_idle_millis: 30000
       max_tokens_per_request: 5
+    namespace_limit:
+      fill_rate: 2000
   only_default:
+    disabled: true
     default_bucket:
       fill_rate: 800
       wait_timeout_millis: 7777
@@ -60,12 +66,23 @@ func TestConfig(t *testing.T) {
 
 	assertNamespace(t, namespace, ns, 0, false, true, 50)
 	assertBucket(t, DynamicBucketTemplateName, namespace, ns.DynamicBucketTemplate, 100, 999, 8888, 30000, 10000, 5)
+	assertBucket(t, NamespaceLimitBucketName, namespace, ns.NamespaceLimit, 100, 2000, 1000, -1, 10000, 2000)
 
 	namespace = "only_default"
 	ns = cfg.Namespaces[namespace]
 
 	assertNamespace(t, namespace, ns, 0, true, false, 0)
 	assertBucket(t, DefaultBucketName, namespace, ns.DefaultBucket, 100, 800, 7777, 40000, 10000, 800)
+
+	one := cfg.Namespaces["no_default_no_dynamic"].Buckets["one"]
+	if one.Labels["team"] != "search" || one.Labels["tier"] != "1" || len(one.Labels) != 2 {
+		t.Fatalf("Expected bucket one to be labeled, got %v", one.Labels)
+	}
+
+	// Namespaces are enabled unless disabled.
+	if cfg.Namespaces["no_default_no_dynamic"].Disabled || !ns.Disabled {
+		t.Fatalf("Expected only namespace %v to be disabled", namespace)
+	}
 }
 
 func assertNamespace(t *testing.T, namespace string, ns *pbconfig.NamespaceConfig, numBuckets int, expectDefault, expectDynamic bool, maxDynamic int32) {
@@ -132,6 +149,61 @@ func assertBucket(t *testing.T, name, namespace string, b *pbconfig.BucketConfig
 	}
 }
 
+func TestLabelsRoundTrip(t *testing.T) {
+	cfg := ReadConfig(strings.NewReader(cfgYaml))
+
+	y, err := ToYAML(cfg)
+	helpers.CheckError(t, err)
+	fromYAML, err := FromYAML(y)
+	helpers.CheckError(t, err)
+
+	r, err := Marshal(cfg)
+	helpers.CheckError(t, err)
+	unmarshalled, err := Unmarshal(r)
+	helpers.CheckError(t, err)
+
+	for _, c := range []*pbconfig.ServiceConfig{fromYAML, unmarshalled} {
+		labels := c.Namespaces["no_default_no_dynamic"].Buckets["one"].Labels
+		if labels["team"] != "search" || labels["tier"] != "1" || len(labels) != 2 {
+			t.Errorf("Expected labels to survive a round trip, got %v", labels)
+		}
+	}
+}
+
+func TestDisabledBucketConfig(t *testing.T) {
+	cfg, err := FromYAML([]byte(`
+namespaces:
+  foo:
+    buckets:
+      bar:
+        disabled: true
+        canary:
+          fill_rate: 10
+        canary_percent: 100
+      baz:
+        canary:
+          disabled: true
+        canary_percent: 100
+`))
+	helpers.CheckError(t, err)
+	helpers.CheckError(t, Validate(cfg))
+
+	ns := cfg.Namespaces["foo"]
+	if !CanaryConfig("foo", "bar", ns.Buckets["bar"]).Disabled {
+		t.Error("Expected a canary to stay disabled with its bucket")
+	}
+
+	if !CanaryConfig("foo", "baz", ns.Buckets["baz"]).Disabled {
+		t.Error("Expected a canary to disable its bucket")
+	}
+
+	enabled := CloneConfig(cfg).Namespaces["foo"].Buckets["bar"]
+	enabled.Disabled = false
+	if !DifferentBucketConfigs(ns.Buckets["bar"], enabled) {
+		t.Error("Expected re-enabling a bucket to change its config")
+	}
+}
+
 func TestNonexistentFile(t *testing.T) {
 	helpers.ExpectingPanic(t, func() {
 		_ = ReadConfigFromFile("/does/not/exist")
@@ -0,0 +1,250 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	pb "github.com/square/quotaservice/protos/config"
+)
+
+// ConfigDiff describes the namespaces that differ between two service configs.
+type ConfigDiff struct {
+	FromVersion                int32            `json:"fromVersion"`
+	ToVersion                  int32            `json:"toVersion"`
+	GlobalDefaultBucketChanged bool             `json:"globalDefaultBucketChanged"`
+	AddedNamespaces            []string         `json:"addedNamespaces"`
+	RemovedNamespaces          []string         `json:"removedNamespaces"`
+	ModifiedNamespaces         []*NamespaceDiff `json:"modifiedNamespaces"`
+	// ChangedTemplates are the templates added, removed or modified. Buckets created from a modified
+	// template are listed as modified in their namespaces.
+	ChangedTemplates []string `json:"changedTemplates"`
+}
+
+// NamespaceDiff describes the buckets that differ within a namespace present in both configs.
+type NamespaceDiff struct {
+	Name            string   `json:"name"`
+	AddedBuckets    []string `json:"addedBuckets"`
+	RemovedBuckets  []string `json:"removedBuckets"`
+	ModifiedBuckets []string `json:"modifiedBuckets"`
+	// RequestCostsChanged is set if the token costs of request kinds differ.
+	RequestCostsChanged bool `json:"requestCostsChanged"`
+	// DisabledChanged is set if the namespace was disabled or re-enabled.
+	DisabledChanged bool `json:"disabledChanged"`
+}
+
+// Diff compares two service configs, with buckets compared as created from their templates. A nil
+// old config is treated as an empty config.
+func Diff(oldCfg, newCfg *pb.ServiceConfig) *ConfigDiff {
+	if oldCfg == nil {
+		oldCfg = &pb.ServiceConfig{}
+	}
+
+	if newCfg == nil {
+		newCfg = &pb.ServiceConfig{}
+	}
+
+	changedTemplates := diffTemplates(oldCfg.Templates, newCfg.Templates)
+	oldCfg, newCfg = ResolveTemplates(oldCfg), ResolveTemplates(newCfg)
+
+	d := &ConfigDiff{
+		FromVersion:                oldCfg.Version,
+		ToVersion:                  newCfg.Version,
+		GlobalDefaultBucketChanged: DifferentBucketConfigs(oldCfg.GlobalDefaultBucket, newCfg.GlobalDefaultBucket),
+		AddedNamespaces:            make([]string, 0),
+		RemovedNamespaces:          make([]string, 0),
+		ModifiedNamespaces:         make([]*NamespaceDiff, 0),
+		ChangedTemplates:           changedTemplates}
+
+	for name, oldNs := range oldCfg.Namespaces {
+		newNs, exists := newCfg.Namespaces[name]
+		if !exists {
+			d.RemovedNamespaces = append(d.RemovedNamespaces, name)
+		} else if DifferentNamespaceConfigs(oldNs, newNs) || DifferentRequestCosts(oldNs, newNs) || oldNs.Disabled != newNs.Disabled {
+			d.ModifiedNamespaces = append(d.ModifiedNamespaces, diffNamespace(name, oldNs, newNs))
+		}
+	}
+
+	for name := range newCfg.Namespaces {
+		if _, exists := oldCfg.Namespaces[name]; !exists {
+			d.AddedNamespaces = append(d.AddedNamespaces, name)
+		}
+	}
+
+	sort.Strings(d.AddedNamespaces)
+	sort.Strings(d.RemovedNamespaces)
+	sort.Slice(d.ModifiedNamespaces, func(i, j int) bool {
+		return d.ModifiedNamespaces[i].Name < d.ModifiedNamespaces[j].Name
+	})
+
+	return d
+}
+
+// FastTrackedChanges returns the namespaces changed between two configs, added, removed or modified
+// as by Diff, that are marked fast_track in either config, in name order.
+func FastTrackedChanges(oldCfg, newCfg *pb.ServiceConfig) []string {
+	d := Diff(oldCfg, newCfg)
+
+	changed := append(append([]string{}, d.AddedNamespaces...), d.RemovedNamespaces...)
+	for _, nd := range d.ModifiedNamespaces {
+		changed = append(changed, nd.Name)
+	}
+
+	var fastTracked []string
+	for _, name := range changed {
+		if oldCfg.GetNamespaces()[name].GetFastTrack() || newCfg.GetNamespaces()[name].GetFastTrack() {
+			fastTracked = append(fastTracked, name)
+		}
+	}
+
+	sort.Strings(fastTracked)
+	return fastTracked
+}
+
+// ChangedBucketFields returns the names of the fields that differ between two bucket configs, as
+// named in configs, such as fill_rate, in field number order. A nil config is treated as an empty
+// config, so every field set on the other is listed.
+func ChangedBucketFields(oldB, newB *pb.BucketConfig) []string {
+	if oldB == nil {
+		oldB = &pb.BucketConfig{}
+	}
+
+	if newB == nil {
+		newB = &pb.BucketConfig{}
+	}
+
+	oldV, newV := reflect.ValueOf(oldB).Elem(), reflect.ValueOf(newB).Elem()
+
+	changed := make([]string, 0)
+	for i := 0; i < oldV.NumField(); i++ {
+		name := protoFieldName(oldV.Type().Field(i))
+		if name != "" && !equalFields(oldV.Field(i), newV.Field(i)) {
+			changed = append(changed, name)
+		}
+	}
+
+	return changed
+}
+
+// protoFieldName returns the name of a field of a generated message in its .proto, or "" if it
+// isn't a field of the message.
+func protoFieldName(f reflect.StructField) string {
+	for _, part := range strings.Split(f.Tag.Get("protobuf"), ",") {
+		if strings.HasPrefix(part, "name=") {
+			return strings.TrimPrefix(part, "name=")
+		}
+	}
+
+	return ""
+}
+
+// equalFields compares the values of a field of two messages, treating empty and unset maps and
+// repeated fields alike, as they marshal alike.
+func equalFields(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Map, reflect.Slice:
+		if a.Len() == 0 && b.Len() == 0 {
+			return true
+		}
+	}
+
+	return reflect.DeepEqual(a.Interface(), b.Interface())
+}
+
+func diffNamespace(name string, oldNs, newNs *pb.NamespaceConfig) *NamespaceDiff {
+	nd := &NamespaceDiff{
+		Name:                name,
+		AddedBuckets:        make([]string, 0),
+		RemovedBuckets:      make([]string, 0),
+		ModifiedBuckets:     make([]string, 0),
+		RequestCostsChanged: DifferentRequestCosts(oldNs, newNs),
+		DisabledChanged:     oldNs.Disabled != newNs.Disabled}
+
+	diffBucket(nd, DefaultBucketName, oldNs.DefaultBucket, newNs.DefaultBucket)
+	diffBucket(nd, DynamicBucketTemplateName, oldNs.DynamicBucketTemplate, newNs.DynamicBucketTemplate)
+	diffBucket(nd, NamespaceLimitBucketName, oldNs.NamespaceLimit, newNs.NamespaceLimit)
+
+	for bName, oldB := range oldNs.Buckets {
+		diffBucket(nd, bName, oldB, newNs.Buckets[bName])
+	}
+
+	for bName, newB := range newNs.Buckets {
+		if _, exists := oldNs.Buckets[bName]; !exists {
+			diffBucket(nd, bName, nil, newB)
+		}
+	}
+
+	sort.Strings(nd.AddedBuckets)
+	sort.Strings(nd.RemovedBuckets)
+	sort.Strings(nd.ModifiedBuckets)
+
+	return nd
+}
+
+func diffTemplates(oldTemplates, newTemplates map[string]*pb.BucketConfig) []string {
+	changed := make([]string, 0)
+	for name, oldT := range oldTemplates {
+		if DifferentBucketConfigs(oldT, newTemplates[name]) {
+			changed = append(changed, name)
+		}
+	}
+
+	for name := range newTemplates {
+		if _, exists := oldTemplates[name]; !exists {
+			changed = append(changed, name)
+		}
+	}
+
+	sort.Strings(changed)
+	return changed
+}
+
+func diffBucket(nd *NamespaceDiff, name string, oldB, newB *pb.BucketConfig) {
+	switch {
+	case oldB == nil && newB == nil:
+		return
+	case oldB == nil:
+		nd.AddedBuckets = append(nd.AddedBuckets, name)
+	case newB == nil:
+		nd.RemovedBuckets = append(nd.RemovedBuckets, name)
+	case DifferentBucketConfigs(oldB, newB):
+		nd.ModifiedBuckets = append(nd.ModifiedBuckets, name)
+	}
+}
+
+// Empty returns true if the diff contains no changes.
+func (d *ConfigDiff) Empty() bool {
+	return !d.GlobalDefaultBucketChanged &&
+		len(d.AddedNamespaces) == 0 &&
+		len(d.RemovedNamespaces) == 0 &&
+		len(d.ModifiedNamespaces) == 0 &&
+		len(d.ChangedTemplates) == 0
+}
+
+// Summary returns a short, human-readable description of the diff.
+func (d *ConfigDiff) Summary() string {
+	if d.Empty() {
+		return fmt.Sprintf("version %v -> %v: no changes", d.FromVersion, d.ToVersion)
+	}
+
+	modified := make([]string, len(d.ModifiedNamespaces))
+	for i, nd := range d.ModifiedNamespaces {
+		modified[i] = nd.Name
+	}
+
+	summary := fmt.Sprintf("version %v -> %v: globalDefaultChanged=%v added [%v] removed [%v] modified [%v]",
+		d.FromVersion, d.ToVersion, d.GlobalDefaultBucketChanged,
+		strings.Join(d.AddedNamespaces, ", "),
+		strings.Join(d.RemovedNamespaces, ", "),
+		strings.Join(modified, ", "))
+
+	if len(d.ChangedTemplates) > 0 {
+		summary += fmt.Sprintf(" templates [%v]", strings.Join(d.ChangedTemplates, ", "))
+	}
+
+	return summary
+}
@@ -5,10 +5,10 @@ package config
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 
-	"github.com/golang/protobuf/proto"
 	"github.com/square/quotaservice/config/internal"
 	pb "github.com/square/quotaservice/protos/config"
 )
@@ -16,6 +16,7 @@ import (
 // DiskConfigPersister is a ConfigPersister that saves configs to the local filesystem.
 type DiskConfigPersister struct {
 	location string
+	unknown  UnknownFields
 	*internal.Notifier
 }
 
@@ -28,7 +29,7 @@ func NewDiskConfigPersister(location string) (*DiskConfigPersister, error) {
 		return nil, e
 	}
 
-	d := &DiskConfigPersister{location, internal.NewNotifier()}
+	d := &DiskConfigPersister{location: location, Notifier: internal.NewNotifier()}
 
 	// Notify that we're available for reading
 	d.Notify()
@@ -48,11 +49,16 @@ func writeFile(path string, bytes []byte) error {
 	return e
 }
 
+// UnknownFields implements UnknownFieldsKeeper.
+func (d *DiskConfigPersister) UnknownFields() *UnknownFields {
+	return &d.unknown
+}
+
 // PersistAndNotify persists a configuration passed in.
 func (d *DiskConfigPersister) PersistAndNotify(oldHash string, cfg *pb.ServiceConfig) error {
 	// TODO(manik) Optimistic version check with oldHash
 
-	b, e := proto.Marshal(cfg)
+	b, e := d.unknown.Marshal(cfg)
 	if e != nil {
 		return e
 	}
@@ -86,12 +92,18 @@ func (d *DiskConfigPersister) PersistAndNotify(oldHash string, cfg *pb.ServiceCo
 
 // ReadPersistedConfig provides a config previously persisted.
 func (d *DiskConfigPersister) ReadPersistedConfig() (*pb.ServiceConfig, error) {
-	r, e := os.Open(d.location)
+	b, e := ioutil.ReadFile(d.location)
+	if e != nil {
+		return nil, e
+	}
+
+	cfg, e := UnmarshalBytes(b)
 	if e != nil {
 		return nil, e
 	}
 
-	return Unmarshal(r)
+	d.unknown.Observe(b)
+	return cfg, nil
 }
 
 // ReadHistoricalConfigs returns an array of previously persisted configs
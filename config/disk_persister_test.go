@@ -4,9 +4,14 @@
 package config
 
 import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 
+	"github.com/golang/protobuf/proto"
 	pbconfig "github.com/square/quotaservice/protos/config"
 	"github.com/square/quotaservice/test/helpers"
 )
@@ -66,3 +71,91 @@ func TestDiskPersistence(t *testing.T) {
 		t.Fatalf("Configs should be equal! %+v != %+v", s, unmarshalled)
 	}
 }
+
+func TestDiskPersistenceKeepsUnknownFields(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qs_test_unknown")
+	helpers.CheckError(t, err)
+	defer os.RemoveAll(dir)
+
+	location := filepath.Join(dir, "config")
+	persister, err := NewDiskConfigPersister(location)
+	helpers.CheckError(t, err)
+
+	// A config written by a newer version, with fields this schema lacks in the config and in its
+	// buckets.
+	ns, err := proto.Marshal(NewDefaultNamespaceConfig("ns"))
+	helpers.CheckError(t, err)
+	for _, name := range []string{"b", "removed"} {
+		b, err := proto.Marshal(NewDefaultBucketConfig(name))
+		helpers.CheckError(t, err)
+		ns = appendMapEntry(t, ns, 5, name, withUnknownField(t, b, "newer field of "+name))
+	}
+
+	newer, err := proto.Marshal(NewDefaultServiceConfig())
+	helpers.CheckError(t, err)
+	newer = withUnknownField(t, appendMapEntry(t, newer, 2, "ns", ns), "newer config field")
+	helpers.CheckError(t, ioutil.WriteFile(location, newer, 0644))
+
+	// Read by this version, changed and persisted again.
+	cfg, err := persister.ReadPersistedConfig()
+	helpers.CheckError(t, err)
+	cfg.Version++
+	helpers.CheckError(t, AddNamespace(cfg, NewDefaultNamespaceConfig("added")))
+	delete(cfg.Namespaces["ns"].Buckets, "removed")
+	helpers.CheckError(t, persister.PersistAndNotify("", cfg))
+
+	persisted, err := ioutil.ReadFile(location)
+	helpers.CheckError(t, err)
+
+	for _, field := range []string{"newer config field", "newer field of b"} {
+		if !bytes.Contains(persisted, []byte(field)) {
+			t.Errorf("Expected the %v to survive a re-persist, got %q", field, persisted)
+		}
+	}
+
+	if bytes.Contains(persisted, []byte("newer field of removed")) {
+		t.Errorf("Expected the fields of a removed bucket to be removed with it, got %q", persisted)
+	}
+
+	// Merged back in place, so a newer version reads them where it wrote them.
+	unknown, err := parseUnknown(persisted, serviceConfigType)
+	helpers.CheckError(t, err)
+	bucket := unknown.child(childKey{2, "ns"}).child(childKey{5, "b"})
+	if bucket == nil || !bytes.Contains(bucket.fields, []byte("newer field of b")) {
+		t.Errorf("Expected the bucket's fields to be merged back into the bucket, got %+v", unknown)
+	}
+
+	reread, err := persister.ReadPersistedConfig()
+	helpers.CheckError(t, err)
+
+	if reread.Namespaces["added"] == nil || reread.Namespaces["ns"].Buckets["b"].Size != NewDefaultBucketConfig("b").Size {
+		t.Errorf("Expected the known fields to be persisted, got %+v", reread)
+	}
+}
+
+// withUnknownField appends to a marshalled message a field no version of this schema has.
+func withUnknownField(t *testing.T, msg []byte, value string) []byte {
+	t.Helper()
+
+	buf := proto.NewBuffer(append([]byte(nil), msg...))
+	helpers.CheckError(t, buf.EncodeVarint(1000<<3|proto.WireBytes))
+	helpers.CheckError(t, buf.EncodeStringBytes(value))
+	return buf.Bytes()
+}
+
+// appendMapEntry appends to a marshalled message an entry of the map field of a number, with a
+// marshalled message as its value.
+func appendMapEntry(t *testing.T, msg []byte, number uint64, key string, value []byte) []byte {
+	t.Helper()
+
+	entry := proto.NewBuffer(nil)
+	helpers.CheckError(t, entry.EncodeVarint(1<<3|proto.WireBytes))
+	helpers.CheckError(t, entry.EncodeStringBytes(key))
+	helpers.CheckError(t, entry.EncodeVarint(2<<3|proto.WireBytes))
+	helpers.CheckError(t, entry.EncodeRawBytes(value))
+
+	buf := proto.NewBuffer(append([]byte(nil), msg...))
+	helpers.CheckError(t, buf.EncodeVarint(number<<3|proto.WireBytes))
+	helpers.CheckError(t, buf.EncodeRawBytes(entry.Bytes()))
+	return buf.Bytes()
+}
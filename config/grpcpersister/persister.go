@@ -0,0 +1,281 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+// Package grpcpersister lets followers read configs from a leader quotaservice over gRPC, rather
+// than each polling the config store. The leader serves its persister with a Server; followers
+// use a Persister, notified of changes over a stream instead of by polling.
+package grpcpersister
+
+import (
+	"sync"
+	"time"
+
+	"github.com/square/quotaservice/config"
+	"github.com/square/quotaservice/config/internal"
+	"github.com/square/quotaservice/logging"
+	pb "github.com/square/quotaservice/protos/config"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	defaultFallbackAfter = 10 * time.Second
+	defaultRetryInterval = time.Second
+	defaultTimeout       = 5 * time.Second
+)
+
+// Options configures a Persister.
+type Options struct {
+	// Fallback is read and written instead of the leader while the leader is unreachable, e.g. a
+	// persister on the database the leader uses. If nil, reads and writes fail while the leader is
+	// unreachable.
+	Fallback config.ConfigPersister
+	// FallbackAfter is how long the leader must be unreachable before using Fallback. Defaults to
+	// 10 seconds.
+	FallbackAfter time.Duration
+	// RetryInterval is how often to try reconnecting to the leader. Defaults to 1 second.
+	RetryInterval time.Duration
+	// Timeout bounds each call to the leader. Defaults to 5 seconds.
+	Timeout time.Duration
+}
+
+// Persister is a config.ConfigPersister reading and writing configs through a leader's Server, and
+// notified of changes over a stream from it.
+type Persister struct {
+	client   pb.ConfigPersisterServiceClient
+	opts     Options
+	notifier *internal.Notifier
+
+	// fallingBack is true while the leader is unreachable and Fallback is used instead.
+	fallingBack bool
+	m           sync.RWMutex
+
+	shutdown chan struct{}
+	watchers sync.WaitGroup
+}
+
+// New creates a Persister using a connection to the leader. A nil Options is equivalent to the
+// zero value. Close the Persister to stop watching the leader; conn is not closed.
+func New(conn *grpc.ClientConn, opts *Options) *Persister {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	p := &Persister{
+		client:   pb.NewConfigPersisterServiceClient(conn),
+		opts:     *opts,
+		notifier: internal.NewNotifier(),
+		shutdown: make(chan struct{})}
+
+	if p.opts.FallbackAfter <= 0 {
+		p.opts.FallbackAfter = defaultFallbackAfter
+	}
+
+	if p.opts.RetryInterval <= 0 {
+		p.opts.RetryInterval = defaultRetryInterval
+	}
+
+	if p.opts.Timeout <= 0 {
+		p.opts.Timeout = defaultTimeout
+	}
+
+	p.watchers.Add(1)
+	go p.watchLeader()
+
+	if p.opts.Fallback != nil {
+		p.watchers.Add(1)
+		go p.watchFallback()
+	}
+
+	return p
+}
+
+// watchLeader streams changes from the leader, reconnecting when the stream breaks, and switches
+// to the fallback while the leader has been unreachable for too long.
+func (p *Persister) watchLeader() {
+	defer p.watchers.Done()
+
+	var unreachableSince time.Time
+	for {
+		err := p.streamChanges(func() {
+			unreachableSince = time.Time{}
+			if p.setFallingBack(false) {
+				logging.Info("Reconnected to the config leader")
+			}
+		})
+
+		select {
+		case <-p.shutdown:
+			return
+		default:
+		}
+
+		logging.Warn("Lost the config change stream from the leader", "error", err)
+
+		now := time.Now()
+		if unreachableSince.IsZero() {
+			unreachableSince = now
+		}
+
+		if p.opts.Fallback != nil && now.Sub(unreachableSince) >= p.opts.FallbackAfter && p.setFallingBack(true) {
+			logging.Warn("Config leader unreachable, falling back", "since", unreachableSince)
+			p.notifier.Notify()
+		}
+
+		select {
+		case <-time.After(p.opts.RetryInterval):
+		case <-p.shutdown:
+			return
+		}
+	}
+}
+
+// streamChanges notifies the watcher of each change streamed by the leader, until the stream
+// breaks or the Persister is closed. connected is called on receiving a notification.
+func (p *Persister) streamChanges(connected func()) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-p.shutdown:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	stream, err := p.client.WatchConfigChanges(ctx, &pb.WatchConfigChangesRequest{})
+	if err != nil {
+		return err
+	}
+
+	for {
+		if _, err := stream.Recv(); err != nil {
+			return err
+		}
+
+		connected()
+		p.notifier.Notify()
+	}
+}
+
+// watchFallback forwards the fallback's notifications while falling back.
+func (p *Persister) watchFallback() {
+	defer p.watchers.Done()
+
+	watcher := p.opts.Fallback.ConfigChangedWatcher()
+	for {
+		select {
+		case _, ok := <-watcher:
+			if !ok {
+				return
+			}
+
+			if p.isFallingBack() {
+				p.notifier.Notify()
+			}
+		case <-p.shutdown:
+			return
+		}
+	}
+}
+
+// setFallingBack returns true if this changed whether the Persister is falling back.
+func (p *Persister) setFallingBack(fallingBack bool) bool {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	changed := p.fallingBack != fallingBack
+	p.fallingBack = fallingBack
+	return changed
+}
+
+func (p *Persister) isFallingBack() bool {
+	p.m.RLock()
+	defer p.m.RUnlock()
+
+	return p.fallingBack
+}
+
+func (p *Persister) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), p.opts.Timeout)
+}
+
+// PersistAndNotify persists a configuration with the leader, which notifies followers once it has
+// applied it.
+func (p *Persister) PersistAndNotify(oldHash string, cfg *pb.ServiceConfig) error {
+	_, err := p.PersistAndNotifyV(oldHash, cfg)
+	return err
+}
+
+// PersistAndNotifyV is PersistAndNotify, returning the version the leader persisted.
+func (p *Persister) PersistAndNotifyV(oldHash string, cfg *pb.ServiceConfig) (int32, error) {
+	if p.isFallingBack() {
+		return config.PersistAndNotifyV(p.opts.Fallback, oldHash, cfg)
+	}
+
+	ctx, cancel := p.context()
+	defer cancel()
+
+	rsp, err := p.client.PersistAndNotify(ctx, &pb.PersistAndNotifyRequest{OldHash: oldHash, Config: cfg})
+	if err != nil {
+		return 0, fromStatus(err)
+	}
+
+	if rsp.Version == 0 {
+		// Leaders predating versioned responses persist the config as is.
+		return cfg.Version, nil
+	}
+
+	return rsp.Version, nil
+}
+
+// ConfigChangedWatcher returns a channel that is notified whenever the leader applies a config,
+// when connecting to the leader, and when falling back. Changes are coalesced so that a single
+// notification may be emitted for multiple changes.
+func (p *Persister) ConfigChangedWatcher() <-chan struct{} {
+	return p.notifier.Watcher
+}
+
+// ReadPersistedConfig provides the leader's current config.
+func (p *Persister) ReadPersistedConfig() (*pb.ServiceConfig, error) {
+	if p.isFallingBack() {
+		return p.opts.Fallback.ReadPersistedConfig()
+	}
+
+	ctx, cancel := p.context()
+	defer cancel()
+
+	cfg, err := p.client.ReadPersistedConfig(ctx, &pb.ReadPersistedConfigRequest{})
+	if grpc.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+
+	return cfg, fromStatus(err)
+}
+
+// ReadHistoricalConfigs returns an array of the configs the leader has persisted.
+func (p *Persister) ReadHistoricalConfigs() ([]*pb.ServiceConfig, error) {
+	if p.isFallingBack() {
+		return p.opts.Fallback.ReadHistoricalConfigs()
+	}
+
+	ctx, cancel := p.context()
+	defer cancel()
+
+	rsp, err := p.client.ReadHistoricalConfigs(ctx, &pb.ReadHistoricalConfigsRequest{})
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+
+	return rsp.Configs, nil
+}
+
+// Close stops watching the leader and the fallback. The fallback isn't closed.
+func (p *Persister) Close() {
+	logging.Info("Shutting down gRPC persister")
+	close(p.shutdown)
+	p.watchers.Wait()
+	close(p.notifier.Watcher)
+}
@@ -0,0 +1,206 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package grpcpersister
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/square/quotaservice/config"
+	pb "github.com/square/quotaservice/protos/config"
+	"google.golang.org/grpc"
+)
+
+// changeSource publishes the changes a test makes to the leader's configs.
+type changeSource struct {
+	*config.ConfigChangeBroadcaster
+}
+
+func (c changeSource) SubscribeConfigChanges(bufSize int) (<-chan *config.ConfigChange, func()) {
+	return c.Subscribe(bufSize)
+}
+
+type leader struct {
+	persister config.ConfigPersister
+	changes   *config.ConfigChangeBroadcaster
+	server    *grpc.Server
+	addr      string
+}
+
+func startLeader(t *testing.T, persister config.ConfigPersister, addr string) *leader {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := &leader{
+		persister: persister,
+		changes:   config.NewConfigChangeBroadcaster(),
+		server:    grpc.NewServer(),
+		addr:      lis.Addr().String()}
+
+	NewServer(persister, changeSource{l.changes}).Register(l.server)
+	go l.server.Serve(lis)
+
+	return l
+}
+
+// apply persists a config with the leader, and publishes it as the leader's server would once it
+// has applied it.
+func (l *leader) apply(t *testing.T, version int32) {
+	t.Helper()
+
+	persist(t, l.persister, version)
+	l.changes.Publish(&config.ConfigChange{Version: version})
+}
+
+func persist(t *testing.T, p config.ConfigPersister, version int32) {
+	t.Helper()
+
+	cfg := config.NewDefaultServiceConfig()
+	cfg.Version = version
+	if err := p.PersistAndNotify("", cfg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func dial(t *testing.T, l *leader, opts *Options) *Persister {
+	t.Helper()
+
+	conn, err := grpc.Dial(l.addr, grpc.WithInsecure(), grpc.WithBackoffMaxDelay(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return New(conn, opts)
+}
+
+func waitNotified(t *testing.T, p *Persister) {
+	t.Helper()
+
+	select {
+	case <-p.ConfigChangedWatcher():
+	case <-time.After(time.Second):
+		t.Fatal("Expected a notification")
+	}
+}
+
+func checkVersion(t *testing.T, p config.ConfigPersister, expected int32) {
+	t.Helper()
+
+	cfg, err := p.ReadPersistedConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Version != expected {
+		t.Errorf("Expected version %v, got %v", expected, cfg.Version)
+	}
+}
+
+func TestPersister(t *testing.T) {
+	l := startLeader(t, config.NewMemoryConfigPersister(), "127.0.0.1:0")
+	defer l.server.Stop()
+	l.apply(t, 1)
+
+	p := dial(t, l, nil)
+	defer p.Close()
+
+	waitNotified(t, p)
+	checkVersion(t, p, 1)
+
+	l.apply(t, 2)
+	waitNotified(t, p)
+	checkVersion(t, p, 2)
+
+	persist(t, p, 3)
+	checkVersion(t, l.persister, 3)
+
+	cfgs, err := p.ReadHistoricalConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfgs) != 3 {
+		t.Errorf("Expected 3 historical configs, got %v", len(cfgs))
+	}
+}
+
+func TestPersisterReportsVersion(t *testing.T) {
+	l := startLeader(t, config.NewMemoryConfigPersister(), "127.0.0.1:0")
+	defer l.server.Stop()
+
+	p := dial(t, l, nil)
+	defer p.Close()
+
+	cfg := config.NewDefaultServiceConfig()
+	cfg.Version = 7
+	version, err := config.PersistAndNotifyV(p, "", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if version != 7 {
+		t.Errorf("Expected version 7 to be reported, got %v", version)
+	}
+
+	// As read from the leader, which followers read once notified.
+	checkVersion(t, l.persister, version)
+}
+
+type duplicatePersister struct {
+	*config.MemoryConfigPersister
+}
+
+func (d duplicatePersister) PersistAndNotify(string, *pb.ServiceConfig) error {
+	return config.ErrDuplicateConfig
+}
+
+func TestPersisterDuplicate(t *testing.T) {
+	l := startLeader(t, duplicatePersister{config.NewMemoryConfigPersister()}, "127.0.0.1:0")
+	defer l.server.Stop()
+
+	p := dial(t, l, nil)
+	defer p.Close()
+
+	if err := p.PersistAndNotify("", config.NewDefaultServiceConfig()); err != config.ErrDuplicateConfig {
+		t.Errorf("Expected ErrDuplicateConfig, got %v", err)
+	}
+
+	if cfg, err := p.ReadPersistedConfig(); cfg != nil || err != nil {
+		t.Errorf("Expected no config, got %v %v", cfg, err)
+	}
+}
+
+func TestPersisterFallback(t *testing.T) {
+	l := startLeader(t, config.NewMemoryConfigPersister(), "127.0.0.1:0")
+	l.apply(t, 1)
+
+	fallback := config.NewMemoryConfigPersister()
+	persist(t, fallback, 5)
+
+	p := dial(t, l, &Options{Fallback: fallback, FallbackAfter: 20 * time.Millisecond, RetryInterval: 5 * time.Millisecond})
+	defer p.Close()
+
+	waitNotified(t, p)
+	checkVersion(t, p, 1)
+
+	l.server.Stop()
+	waitNotified(t, p)
+	checkVersion(t, p, 5)
+
+	persist(t, p, 6)
+	checkVersion(t, fallback, 6)
+	waitNotified(t, p)
+
+	// Reconnecting to the leader stops falling back.
+	l = startLeader(t, l.persister, l.addr)
+	defer l.server.Stop()
+
+	waitNotified(t, p)
+	checkVersion(t, p, 1)
+}
@@ -0,0 +1,123 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package grpcpersister
+
+import (
+	"github.com/square/quotaservice/config"
+	"github.com/square/quotaservice/logging"
+	pb "github.com/square/quotaservice/protos/config"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// changeBufSize is the number of config changes buffered per follower before changes are dropped
+// for that follower. Followers re-read the latest config on every notification, so dropping changes
+// only delays them.
+const changeBufSize = 16
+
+// Server exposes the configs of a leader's ConfigPersister over gRPC, for followers using a
+// Persister. Register it with the leader's gRPC server.
+type Server struct {
+	persister config.ConfigPersister
+	changes   config.ConfigChangeSource
+}
+
+// NewServer creates a Server reading and writing configs with persister, and streaming the changes
+// published by changes, typically the leader's admin.Administrable. Changes are streamed as the
+// leader applies them, rather than as persister notices them, since a persister's
+// ConfigChangedWatcher only has a single consumer.
+func NewServer(persister config.ConfigPersister, changes config.ConfigChangeSource) *Server {
+	return &Server{persister: persister, changes: changes}
+}
+
+// Register registers the ConfigPersisterService with a gRPC server.
+func (s *Server) Register(g *grpc.Server) {
+	pb.RegisterConfigPersisterServiceServer(g, s)
+}
+
+func (s *Server) ReadPersistedConfig(ctx context.Context, _ *pb.ReadPersistedConfigRequest) (*pb.ServiceConfig, error) {
+	cfg, err := s.persister.ReadPersistedConfig()
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	if cfg == nil {
+		return nil, grpc.Errorf(codes.NotFound, "no config has been persisted")
+	}
+
+	return cfg, nil
+}
+
+func (s *Server) ReadHistoricalConfigs(ctx context.Context, _ *pb.ReadHistoricalConfigsRequest) (*pb.ReadHistoricalConfigsResponse, error) {
+	cfgs, err := s.persister.ReadHistoricalConfigs()
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &pb.ReadHistoricalConfigsResponse{Configs: cfgs}, nil
+}
+
+func (s *Server) PersistAndNotify(ctx context.Context, req *pb.PersistAndNotifyRequest) (*pb.PersistAndNotifyResponse, error) {
+	if req.Config == nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "config is required")
+	}
+
+	version, err := config.PersistAndNotifyV(s.persister, req.OldHash, req.Config)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &pb.PersistAndNotifyResponse{Version: version}, nil
+}
+
+// WatchConfigChanges notifies a follower of every config the leader applies, starting with the
+// current one so followers catch up on changes made while they were disconnected.
+func (s *Server) WatchConfigChanges(_ *pb.WatchConfigChangesRequest, stream pb.ConfigPersisterService_WatchConfigChangesServer) error {
+	changes, unsubscribe := s.changes.SubscribeConfigChanges(changeBufSize)
+	defer unsubscribe()
+
+	var version int32
+	if cfg, err := s.persister.ReadPersistedConfig(); err == nil && cfg != nil {
+		version = cfg.Version
+	}
+
+	if err := stream.Send(&pb.ConfigChangedNotification{Version: version}); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case c, ok := <-changes:
+			if !ok {
+				return grpc.Errorf(codes.Unavailable, "config changes are no longer published")
+			}
+
+			if err := stream.Send(&pb.ConfigChangedNotification{Version: c.Version}); err != nil {
+				logging.Printf("Could not notify follower of config version %v: %v", c.Version, err)
+				return err
+			}
+		}
+	}
+}
+
+func toStatus(err error) error {
+	switch err {
+	case config.ErrDuplicateConfig:
+		return grpc.Errorf(codes.AlreadyExists, err.Error())
+	default:
+		return grpc.Errorf(codes.Internal, err.Error())
+	}
+}
+
+func fromStatus(err error) error {
+	switch grpc.Code(err) {
+	case codes.AlreadyExists:
+		return config.ErrDuplicateConfig
+	default:
+		return err
+	}
+}
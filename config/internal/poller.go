@@ -0,0 +1,54 @@
+package internal
+
+import "sync"
+
+// Poller runs polls of a config store one at a time. Polls requested while one is running are
+// coalesced into a single poll, started once it finishes so it sees changes made since.
+type Poller struct {
+	poll    func() (bool, error)
+	mu      sync.Mutex
+	running bool
+	next    *pollCall
+}
+
+type pollCall struct {
+	done    chan struct{}
+	changed bool
+	err     error
+}
+
+func NewPoller(poll func() (bool, error)) *Poller {
+	return &Poller{poll: poll}
+}
+
+// Poll polls the store, returning whether a new config was found.
+func (p *Poller) Poll() (bool, error) {
+	p.mu.Lock()
+	if p.next == nil {
+		p.next = &pollCall{done: make(chan struct{})}
+	}
+
+	own := p.next
+	if p.running {
+		// The running poll starts the next one once it finishes.
+		p.mu.Unlock()
+		<-own.done
+		return own.changed, own.err
+	}
+
+	p.running = true
+	for c := own; c != nil; c = p.next {
+		p.next = nil
+		p.mu.Unlock()
+
+		c.changed, c.err = p.poll()
+		close(c.done)
+
+		p.mu.Lock()
+	}
+
+	p.running = false
+	p.mu.Unlock()
+
+	return own.changed, own.err
+}
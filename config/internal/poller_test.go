@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPollerCoalesces(t *testing.T) {
+	var polls int32
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+
+	p := NewPoller(func() (bool, error) {
+		n := atomic.AddInt32(&polls, 1)
+		started <- struct{}{}
+		<-release
+		return n == 1, nil
+	})
+
+	first := make(chan bool)
+	go func() {
+		changed, _ := p.Poll()
+		first <- changed
+	}()
+
+	<-started
+
+	// Requested while the first poll runs, so they share the next one.
+	var wg sync.WaitGroup
+	results := make([]bool, 3)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = p.Poll()
+		}(i)
+	}
+
+	// Give the waiting polls time to queue up behind the first.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	if !<-first {
+		t.Error("Expected the first poll to find a change")
+	}
+
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&polls); n != 2 {
+		t.Fatalf("Expected polls requested while polling to be coalesced into 1, got %v polls", n)
+	}
+
+	for i, changed := range results {
+		if changed {
+			t.Errorf("Expected poll %v to share the result of the second poll", i)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/square/quotaservice/protos/config"
+)
+
+// Format is an encoding of a config, as loaded by Load.
+type Format int
+
+const (
+	// FormatAuto detects the format of a config: JSON if it is an object, YAML if it is other text,
+	// and protobuf otherwise.
+	FormatAuto Format = iota
+	// FormatProto is a config marshalled as protobuf, as persisters store it.
+	FormatProto
+	// FormatJSON is a config in JSON, as read by FromJSON.
+	FormatJSON
+	// FormatYAML is a config in YAML, as read by FromYAML.
+	FormatYAML
+)
+
+var formatNames = map[Format]string{
+	FormatAuto:  "auto",
+	FormatProto: "proto",
+	FormatJSON:  "json",
+	FormatYAML:  "yaml",
+}
+
+func (f Format) String() string {
+	if name, ok := formatNames[f]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// ParseFormat returns the format with the given name, as returned by Format.String.
+func ParseFormat(name string) (Format, error) {
+	for f, n := range formatNames {
+		if strings.EqualFold(n, name) {
+			return f, nil
+		}
+	}
+
+	return FormatAuto, fmt.Errorf("unknown config format %q", name)
+}
+
+// ParseError is returned by Load for data that can't be parsed in its format.
+type ParseError struct {
+	// Format is the format the data was parsed as, detected if FormatAuto was asked for.
+	Format Format
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("unable to parse config as %v: %v", e.Format, e.Err)
+}
+
+// DetectFormat returns the format of a config: JSON if it is an object, YAML if it is other text,
+// and protobuf otherwise.
+func DetectFormat(data []byte) Format {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		return FormatJSON
+	}
+
+	if !utf8.Valid(data) {
+		return FormatProto
+	}
+
+	for _, r := range string(data) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return FormatProto
+		}
+	}
+
+	return FormatYAML
+}
+
+// Load parses a config in a format, detecting it if FormatAuto. Malformed rate strings are
+// returned as ValidationErrors, as by FromJSON, and data that can't be parsed otherwise as a
+// ParseError. The config is neither validated nor defaulted.
+func Load(format Format, data []byte) (*pb.ServiceConfig, error) {
+	if format == FormatAuto {
+		format = DetectFormat(data)
+	}
+
+	var c *pb.ServiceConfig
+	var err error
+	switch format {
+	case FormatProto:
+		c = &pb.ServiceConfig{}
+		err = proto.Unmarshal(data, c)
+	case FormatJSON:
+		c, err = FromJSON(data)
+	case FormatYAML:
+		c, err = FromYAML(data)
+	default:
+		return nil, fmt.Errorf("unknown config format %v", format)
+	}
+
+	if _, ok := err.(ValidationErrors); ok {
+		return nil, err
+	}
+
+	if err != nil {
+		return nil, &ParseError{Format: format, Err: err}
+	}
+
+	return c, nil
+}
+
+// LoadAndPersist loads a config from data as Load does, validates it, and persists it with defaults
+// applied as the version following the one persisted, returning the version assigned. Configs that
+// don't validate are returned as ValidationErrors. With a ConditionalPersister, the config is only
+// persisted if no other version was persisted meanwhile, failing with ErrStaleConfig otherwise.
+func LoadAndPersist(p ConfigPersister, format Format, data []byte) (int, error) {
+	c, err := Load(format, data)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := Validate(c); err != nil {
+		return 0, err
+	}
+
+	current, err := p.ReadPersistedConfig()
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	currentVersion := int32(initialVersion)
+	oldHash := initialHash
+	if current != nil {
+		currentVersion = current.Version
+		oldHash = HashConfig(current)
+	}
+
+	ApplyDefaults(c)
+	c.Date = time.Now().Unix()
+	c.Version = currentVersion + 1
+
+	if cp, ok := p.(ConditionalPersister); ok {
+		if err := cp.PersistIfLatest(int(currentVersion), c); err != nil {
+			return 0, err
+		}
+
+		return int(c.Version), nil
+	}
+
+	version, err := PersistAndNotifyV(p, oldHash, c)
+	return int(version), err
+}
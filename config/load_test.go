@@ -0,0 +1,188 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	pbconfig "github.com/square/quotaservice/protos/config"
+	"github.com/square/quotaservice/test/helpers"
+)
+
+const loadTestJSON = `{"namespaces": {"foo": {"buckets": {"bar": {"size": 10, "fill_rate": "5/s"}}}}}`
+
+const loadTestYAML = `
+namespaces:
+  foo:
+    buckets:
+      bar:
+        size: 10
+        fill_rate: 5/s
+`
+
+func loadTestProto(t *testing.T) []byte {
+	t.Helper()
+
+	cfg := NewDefaultServiceConfig()
+	ns := NewDefaultNamespaceConfig("foo")
+	b := NewDefaultBucketConfig("bar")
+	b.Size, b.FillRate = 10, 5
+	helpers.CheckError(t, AddBucket(ns, b))
+	helpers.CheckError(t, AddNamespace(cfg, ns))
+
+	data, err := proto.Marshal(cfg)
+	helpers.CheckError(t, err)
+	return data
+}
+
+func checkLoadedBucket(t *testing.T, name string, cfg *pbconfig.ServiceConfig) {
+	t.Helper()
+
+	b := cfg.GetNamespaces()["foo"].GetBuckets()["bar"]
+	if b.GetSize() != 10 || b.GetFillRate() != 5 {
+		t.Errorf("Expected bucket foo:bar of size 10 filling at 5 loading %v, got %+v", name, b)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		format Format
+		data   []byte
+	}{
+		{"proto", FormatProto, loadTestProto(t)},
+		{"JSON", FormatJSON, []byte(loadTestJSON)},
+		{"YAML", FormatYAML, []byte(loadTestYAML)},
+		{"detected proto", FormatAuto, loadTestProto(t)},
+		{"detected JSON", FormatAuto, []byte(loadTestJSON)},
+		{"detected YAML", FormatAuto, []byte(loadTestYAML)},
+	} {
+		cfg, err := Load(tc.format, tc.data)
+		helpers.CheckError(t, err)
+		checkLoadedBucket(t, tc.name, cfg)
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	for data, expected := range map[string]Format{
+		loadTestJSON:             FormatJSON,
+		"  \n" + loadTestJSON:    FormatJSON,
+		loadTestYAML:             FormatYAML,
+		string(loadTestProto(t)): FormatProto,
+		"\xff\xfe":               FormatProto,
+	} {
+		if f := DetectFormat([]byte(data)); f != expected {
+			t.Errorf("Expected %q to be detected as %v, got %v", data, expected, f)
+		}
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		format Format
+		data   string
+	}{
+		{"proto", FormatProto, "\xff\xff"},
+		{"JSON", FormatJSON, "{"},
+		{"YAML", FormatYAML, "namespaces: ["},
+	} {
+		_, err := Load(tc.format, []byte(tc.data))
+		if parseErr, ok := err.(*ParseError); !ok || parseErr.Format != tc.format {
+			t.Errorf("Expected a ParseError loading malformed %v, got %v", tc.name, err)
+		}
+	}
+
+	_, err := Load(FormatJSON, []byte(`{"namespaces": {"foo": {"buckets": {"bar": {"fill_rate": "5/fortnight"}}}}}`))
+	if _, ok := err.(ValidationErrors); !ok {
+		t.Errorf("Expected ValidationErrors loading a malformed rate, got %v", err)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for _, f := range []Format{FormatAuto, FormatProto, FormatJSON, FormatYAML} {
+		parsed, err := ParseFormat(f.String())
+		helpers.CheckError(t, err)
+
+		if parsed != f {
+			t.Errorf("Expected %v to parse as itself, got %v", f, parsed)
+		}
+	}
+
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Error("Expected an error parsing an unknown format")
+	}
+}
+
+func TestLoadAndPersist(t *testing.T) {
+	persister := NewMemoryConfigPersister()
+
+	for i, tc := range []struct {
+		format Format
+		data   []byte
+	}{
+		{FormatProto, loadTestProto(t)},
+		{FormatJSON, []byte(loadTestJSON)},
+		{FormatYAML, []byte(loadTestYAML)},
+	} {
+		version, err := LoadAndPersist(persister, tc.format, tc.data)
+		helpers.CheckError(t, err)
+
+		if version != i+1 {
+			t.Errorf("Expected version %v to be assigned loading %v, got %v", i+1, tc.format, version)
+		}
+
+		persisted, err := persister.ReadPersistedConfig()
+		helpers.CheckError(t, err)
+
+		if int(persisted.Version) != version || persisted.Date == 0 {
+			t.Errorf("Expected version %v to be persisted with a date, got %+v", version, persisted)
+		}
+
+		checkLoadedBucket(t, tc.format.String(), persisted)
+
+		if persisted.Namespaces["foo"].Buckets["bar"].WaitTimeoutMillis == 0 {
+			t.Errorf("Expected defaults to be applied loading %v, got %+v", tc.format, persisted)
+		}
+	}
+}
+
+func TestLoadAndPersistToDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qs_test_load")
+	helpers.CheckError(t, err)
+	defer os.RemoveAll(dir)
+
+	persister, err := NewDiskConfigPersister(filepath.Join(dir, "config"))
+	helpers.CheckError(t, err)
+
+	for expected := 1; expected <= 2; expected++ {
+		version, err := LoadAndPersist(persister, FormatAuto, []byte(loadTestYAML))
+		helpers.CheckError(t, err)
+
+		if version != expected {
+			t.Errorf("Expected version %v to be assigned, got %v", expected, version)
+		}
+	}
+}
+
+func TestLoadAndPersistInvalid(t *testing.T) {
+	persister := NewMemoryConfigPersister()
+
+	_, err := LoadAndPersist(persister, FormatJSON, []byte(`{"namespaces": {"foo": {"max_dynamic_buckets": -1}}}`))
+	if _, ok := err.(ValidationErrors); !ok {
+		t.Fatalf("Expected ValidationErrors, got %v", err)
+	}
+
+	if _, err := LoadAndPersist(persister, FormatYAML, []byte("namespaces: [")); err == nil {
+		t.Fatal("Expected an error persisting a malformed config")
+	}
+
+	if persisted, _ := persister.ReadPersistedConfig(); persisted != nil {
+		t.Errorf("Expected nothing to be persisted, got %+v", persisted)
+	}
+}
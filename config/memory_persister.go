@@ -43,6 +43,28 @@ func (m *MemoryConfigPersister) PersistAndNotify(oldHash string, cfg *pb.Service
 	return nil
 }
 
+// PersistIfLatest persists a configuration passed in, if the latest version persisted is
+// expectedVersion. Returns ErrStaleConfig otherwise.
+func (m *MemoryConfigPersister) PersistIfLatest(expectedVersion int, cfg *pb.ServiceConfig) error {
+	m.Lock()
+	defer m.Unlock()
+
+	var latest int
+	if current := m.configs[m.config]; current != nil {
+		latest = int(current.Version)
+	}
+
+	if latest != expectedVersion {
+		return ErrStaleConfig
+	}
+
+	m.config = HashConfig(cfg)
+	m.configs[m.config] = CloneConfig(cfg)
+	m.Notify()
+
+	return nil
+}
+
 // ReadPersistedConfig provides a config previously persisted.
 func (m *MemoryConfigPersister) ReadPersistedConfig() (*pb.ServiceConfig, error) {
 	m.RLock()
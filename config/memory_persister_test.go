@@ -63,3 +63,54 @@ func TestMemoryPersistence(t *testing.T) {
 		t.Fatalf("Configs should be equal! %+v != %+v", s, cfgs[0])
 	}
 }
+
+func TestPersistAndNotifyV(t *testing.T) {
+	persister := NewMemoryConfigPersister()
+
+	cfg := NewDefaultServiceConfig()
+	cfg.Version = 12
+	version, err := PersistAndNotifyV(persister, "", cfg)
+	helpers.CheckError(t, err)
+
+	persisted, err := persister.ReadPersistedConfig()
+	helpers.CheckError(t, err)
+
+	if version != 12 || persisted.Version != version {
+		t.Errorf("Expected version 12 to be reported and read back, got %v and %v", version, persisted.Version)
+	}
+}
+
+func TestMemoryPersistIfLatest(t *testing.T) {
+	persister := NewMemoryConfigPersister()
+	<-persister.ConfigChangedWatcher()
+
+	first := NewDefaultServiceConfig()
+	first.Version = 1
+	helpers.CheckError(t, persister.PersistIfLatest(0, first))
+
+	// Two changes based on version 1: the second is stale once the first is persisted.
+	second := NewDefaultServiceConfig()
+	second.Version = 2
+	second.User = "alice"
+	helpers.CheckError(t, persister.PersistIfLatest(1, second))
+	<-persister.ConfigChangedWatcher()
+
+	conflicting := NewDefaultServiceConfig()
+	conflicting.Version = 2
+	conflicting.User = "bob"
+	if err := persister.PersistIfLatest(1, conflicting); err != ErrStaleConfig {
+		t.Fatalf("Expected ErrStaleConfig, got %v", err)
+	}
+
+	select {
+	case <-persister.ConfigChangedWatcher():
+		t.Error("Expected no notification for a stale config")
+	default:
+	}
+
+	latest, e := persister.ReadPersistedConfig()
+	helpers.CheckError(t, e)
+	if latest.Version != 2 || latest.User != "alice" {
+		t.Errorf("Expected the first change to be kept, got %+v", latest)
+	}
+}
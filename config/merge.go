@@ -0,0 +1,93 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package config
+
+import (
+	"encoding/json"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/square/quotaservice/protos/config"
+)
+
+// CloneNamespace copies a namespace under a new name, then applies overrides to the copy as a JSON
+// merge patch (RFC 7386), so only the fields present in the overrides are changed. E.g.
+// `{"buckets": {"b": {"size": 10}}}` changes the size of bucket b, and `{"buckets": {"b": null}}`
+// removes it. Empty overrides are ignored. Defaults are not applied.
+func CloneNamespace(ns *pb.NamespaceConfig, name string, overrides []byte) (*pb.NamespaceConfig, error) {
+	cloned := proto.Clone(ns).(*pb.NamespaceConfig)
+
+	if len(overrides) > 0 {
+		var err error
+		if cloned, err = mergeNamespace(cloned, overrides); err != nil {
+			return nil, err
+		}
+	}
+
+	cloned.Name = name
+	for _, b := range cloned.Buckets {
+		if b != nil {
+			b.Namespace = name
+		}
+	}
+
+	if cloned.DefaultBucket != nil {
+		cloned.DefaultBucket.Namespace = name
+	}
+
+	if cloned.DynamicBucketTemplate != nil {
+		cloned.DynamicBucketTemplate.Namespace = name
+	}
+
+	return cloned, nil
+}
+
+func mergeNamespace(ns *pb.NamespaceConfig, patch []byte) (*pb.NamespaceConfig, error) {
+	b, err := json.Marshal(ns)
+	if err != nil {
+		return nil, err
+	}
+
+	var target, p interface{}
+	if err := json.Unmarshal(b, &target); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, err
+	}
+
+	if b, err = json.Marshal(mergePatch(target, p)); err != nil {
+		return nil, err
+	}
+
+	merged := &pb.NamespaceConfig{}
+	if err := json.Unmarshal(b, merged); err != nil {
+		return nil, err
+	}
+
+	return merged, nil
+}
+
+// mergePatch applies a JSON merge patch to a decoded JSON document.
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+
+	return t
+}
@@ -0,0 +1,41 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package config
+
+import (
+	"testing"
+
+	"github.com/square/quotaservice/test/helpers"
+)
+
+func TestCloneNamespace(t *testing.T) {
+	ns := NewDefaultNamespaceConfig("src")
+	helpers.CheckError(t, AddBucket(ns, NewDefaultBucketConfig("kept")))
+	helpers.CheckError(t, AddBucket(ns, NewDefaultBucketConfig("changed")))
+	helpers.CheckError(t, AddBucket(ns, NewDefaultBucketConfig("removed")))
+
+	overrides := []byte(`{"buckets": {"changed": {"fill_rate": 7}, "removed": null, "added": {"size": 3}}}`)
+	cloned, err := CloneNamespace(ns, "dst", overrides)
+	helpers.CheckError(t, err)
+
+	if cloned.Name != "dst" || len(cloned.Buckets) != 3 || cloned.Buckets["removed"] != nil {
+		t.Fatalf("Unexpected clone %+v", cloned)
+	}
+
+	if b := cloned.Buckets["changed"]; b.FillRate != 7 || b.Size != ns.Buckets["changed"].Size || b.Namespace != "dst" {
+		t.Errorf("Expected only the fill rate to change, got %+v", b)
+	}
+
+	if b := cloned.Buckets["added"]; b == nil || b.Size != 3 || b.Namespace != "dst" {
+		t.Errorf("Expected bucket added, got %+v", b)
+	}
+
+	if len(ns.Buckets) != 3 || ns.Buckets["changed"].FillRate == 7 || ns.Buckets["kept"].Namespace != "src" {
+		t.Errorf("Expected the source namespace to be unchanged, got %+v", ns)
+	}
+
+	if _, err := CloneNamespace(ns, "dst", []byte("{")); err == nil {
+		t.Error("Expected invalid overrides to be rejected")
+	}
+}
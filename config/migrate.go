@@ -0,0 +1,94 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package config
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/square/quotaservice/logging"
+	pb "github.com/square/quotaservice/protos/config"
+)
+
+// MigrateOptions configures Migrate.
+type MigrateOptions struct {
+	// DryRun reports the versions that would be migrated, without writing to the destination.
+	DryRun bool
+}
+
+// MigrationResult describes the versions copied by Migrate.
+type MigrationResult struct {
+	// Migrated are the versions written to the destination, or that would be in a dry run, in
+	// version order.
+	Migrated []int32
+	// Skipped are the versions the destination already had, in version order.
+	Skipped []int32
+}
+
+// Migrate copies the config history of src to dst, e.g. when switching storage backends. Versions
+// are written in order with their version numbers preserved, so the latest version of src becomes
+// the latest of dst. Versions dst already has are skipped, so an interrupted migration can be
+// resumed. If dst is a MetaPersister, each version's User is stored as its author. A nil
+// MigrateOptions is equivalent to the zero value.
+func Migrate(src, dst ConfigPersister, opts *MigrateOptions) (*MigrationResult, error) {
+	if opts == nil {
+		opts = &MigrateOptions{}
+	}
+
+	cfgs, err := src.ReadHistoricalConfigs()
+	if err != nil {
+		return nil, fmt.Errorf("reading source configs: %v", err)
+	}
+
+	existing, err := dst.ReadHistoricalConfigs()
+	if err != nil {
+		return nil, fmt.Errorf("reading destination configs: %v", err)
+	}
+
+	persisted := make(map[int32]bool, len(existing))
+	for _, c := range existing {
+		if c != nil {
+			persisted[c.Version] = true
+		}
+	}
+
+	sorted := make([]*pb.ServiceConfig, 0, len(cfgs))
+	for _, c := range cfgs {
+		if c != nil {
+			sorted = append(sorted, c)
+		}
+	}
+
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+
+	result := &MigrationResult{}
+	for _, c := range sorted {
+		if persisted[c.Version] {
+			result.Skipped = append(result.Skipped, c.Version)
+			continue
+		}
+
+		// Only the first of several configs sharing a version is migrated.
+		persisted[c.Version] = true
+
+		if !opts.DryRun {
+			_, err := PersistAndNotifyWithMeta(dst, "", CloneConfig(c), &PersistMeta{Author: c.User, Note: "migrated"})
+			if err == ErrDuplicateConfig {
+				result.Skipped = append(result.Skipped, c.Version)
+				continue
+			}
+
+			if err != nil {
+				return result, fmt.Errorf("migrating version %v: %v", c.Version, err)
+			}
+		}
+
+		result.Migrated = append(result.Migrated, c.Version)
+	}
+
+	logging.Info("Migrated configs", "migrated", len(result.Migrated), "skipped", len(result.Skipped),
+		"dryRun", opts.DryRun)
+
+	return result, nil
+}
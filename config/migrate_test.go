@@ -0,0 +1,87 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package config
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/square/quotaservice/test/helpers"
+)
+
+func newMigrationPersister(t *testing.T, versions ...int32) *MemoryConfigPersister {
+	p := NewMemoryConfigPersister()
+	for _, v := range versions {
+		cfg := NewDefaultServiceConfig()
+		cfg.Version = v
+		cfg.User = "alice"
+		helpers.CheckError(t, p.PersistAndNotify("", cfg))
+	}
+
+	return p
+}
+
+func historicalVersions(t *testing.T, p ConfigPersister) map[int32]bool {
+	cfgs, err := p.ReadHistoricalConfigs()
+	helpers.CheckError(t, err)
+
+	versions := make(map[int32]bool)
+	for _, c := range cfgs {
+		versions[c.Version] = true
+	}
+
+	return versions
+}
+
+func TestMigrate(t *testing.T) {
+	src := newMigrationPersister(t, 3, 1, 2)
+	dst := newMigrationPersister(t, 2)
+
+	result, err := Migrate(src, dst, &MigrateOptions{DryRun: true})
+	helpers.CheckError(t, err)
+
+	expected := &MigrationResult{Migrated: []int32{1, 3}, Skipped: []int32{2}}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected a dry run to report %+v, got %+v", expected, result)
+	}
+
+	if versions := historicalVersions(t, dst); len(versions) != 1 {
+		t.Errorf("Expected a dry run not to write to the destination, got versions %v", versions)
+	}
+
+	result, err = Migrate(src, dst, nil)
+	helpers.CheckError(t, err)
+
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, result)
+	}
+
+	if versions := historicalVersions(t, dst); !reflect.DeepEqual(versions, map[int32]bool{1: true, 2: true, 3: true}) {
+		t.Errorf("Expected versions 1 to 3 to be migrated, got %v", versions)
+	}
+
+	latest, err := dst.ReadPersistedConfig()
+	helpers.CheckError(t, err)
+
+	if latest.Version != 3 || latest.User != "alice" {
+		t.Errorf("Expected the latest version to be preserved, got %+v", latest)
+	}
+
+	// Migrating again has nothing left to do.
+	result, err = Migrate(src, dst, nil)
+	helpers.CheckError(t, err)
+
+	if len(result.Migrated) != 0 || len(result.Skipped) != 3 {
+		t.Errorf("Expected every version to be skipped, got %+v", result)
+	}
+}
+
+func TestMigrateEmpty(t *testing.T) {
+	result, err := Migrate(NewMemoryConfigPersister(), NewMemoryConfigPersister(), nil)
+	helpers.CheckError(t, err)
+
+	if len(result.Migrated) != 0 || len(result.Skipped) != 0 {
+		t.Errorf("Expected nothing to migrate, got %+v", result)
+	}
+}
@@ -0,0 +1,63 @@
+package mysqlpersister
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/square/quotaservice/config"
+	qsc "github.com/square/quotaservice/protos/config"
+)
+
+// ImportLegacyConfig reads a config from a schema predating the versioned quotaservice table, such
+// as a single-row "current config" table, to migrate it to a MysqlPersister. The query must return
+// a single row with a single column, the config blob, either marshalled as protobuf, as in the
+// quotaservice table, or in JSON. The config is returned as stored, to be persisted through the
+// normal path, such as the admin's config import, which also validates it.
+func ImportLegacyConfig(db *sql.DB, query string) (*qsc.ServiceConfig, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+
+		return nil, errors.New("legacy config query returned no rows")
+	}
+
+	var blob []byte
+	if err := rows.Scan(&blob); err != nil {
+		return nil, err
+	}
+
+	if rows.Next() {
+		return nil, errors.New("legacy config query returned more than one row")
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if trimmed := bytes.TrimSpace(blob); len(trimmed) > 0 && trimmed[0] == '{' {
+		c, err := config.FromJSON(trimmed)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse legacy config as JSON: %v", err)
+		}
+
+		return c, nil
+	}
+
+	var c qsc.ServiceConfig
+	if err := proto.Unmarshal(blob, &c); err != nil {
+		return nil, fmt.Errorf("could not unmarshal legacy config: %v", err)
+	}
+
+	return &c, nil
+}
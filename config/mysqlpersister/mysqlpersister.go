@@ -17,7 +17,8 @@ import (
 	qsc "github.com/square/quotaservice/protos/config"
 )
 
-var ErrDuplicateConfig = errors.New("config with provided version number already exists")
+// ErrDuplicateConfig is an alias of config.ErrDuplicateConfig, kept for compatibility.
+var ErrDuplicateConfig = config.ErrDuplicateConfig
 
 const (
 	mysqlErrDuplicateEntry = 1062
@@ -29,10 +30,22 @@ type MysqlPersister struct {
 	m             *sync.RWMutex
 
 	notifier        *internal.Notifier
+	poller          *internal.Poller
 	shutdown        chan struct{}
 	fetcherShutdown chan struct{}
 
 	configs map[int]*qsc.ServiceConfig
+	// unknown keeps the fields of the latest config unknown to this schema.
+	unknown config.UnknownFields
+
+	onReloadFailure func(version int32, err error)
+	lastPolled      time.Time
+	// lastErr is the error of the latest poll or write, which failed at lastErrAt, or nil.
+	lastErr   error
+	lastErrAt time.Time
+	// highestVersion is the highest version seen in MySQL, unlike latestVersion including versions
+	// that couldn't be unmarshalled.
+	highestVersion int
 }
 
 type configRow struct {
@@ -45,14 +58,14 @@ type Connector interface {
 }
 
 func New(c Connector, pollingInterval time.Duration) (*MysqlPersister, error) {
-	logging.Print("Connecting to MySQL")
+	logging.Info("Connecting to MySQL")
 	db, err := c.Connect()
 	if err != nil {
 		return nil, err
 	}
-	logging.Print("Connecting to MySQL: OK")
+	logging.Info("Connecting to MySQL: OK")
 
-	logging.Print("Verifying table exists")
+	logging.Debug("Verifying table exists")
 	q, args, err := sq.Select("1").From("quotaservice").Limit(1).ToSql()
 	if err != nil {
 		return nil, err
@@ -62,7 +75,7 @@ func New(c Connector, pollingInterval time.Duration) (*MysqlPersister, error) {
 	if err != nil {
 		return nil, errors.New("table quotaservice does not exist")
 	}
-	logging.Print("Verifying table exists: OK")
+	logging.Debug("Verifying table exists: OK")
 
 	mp := &MysqlPersister{
 		db:              db,
@@ -72,9 +85,12 @@ func New(c Connector, pollingInterval time.Duration) (*MysqlPersister, error) {
 		shutdown:        make(chan struct{}),
 		fetcherShutdown: make(chan struct{}),
 		latestVersion:   -1,
+		highestVersion:  -1,
 	}
+	mp.poller = internal.NewPoller(mp.pollAndNotify)
 
-	logging.Print("Pulling configs from MySQL")
+	logging.Info("Pulling configs from MySQL")
+	start := time.Now()
 	if _, err := mp.pullConfigs(); err != nil {
 		return nil, err
 	}
@@ -82,7 +98,7 @@ func New(c Connector, pollingInterval time.Duration) (*MysqlPersister, error) {
 	mp.m.RLock()
 	v := mp.latestVersion
 	mp.m.RUnlock()
-	logging.Printf("Pulling configs from MySQL: OK; Latest Version: %v", v)
+	logging.Info("Pulling configs from MySQL: OK", "latestVersion", v, "duration", time.Since(start))
 
 	mp.notifyWatcher()
 
@@ -99,26 +115,43 @@ func (mp *MysqlPersister) configFetcher(pollingInterval time.Duration) {
 	for {
 		select {
 		case <-time.After(pollingInterval):
-			if newConf, err := mp.pullConfigs(); err != nil {
-				logging.Printf("Received an error trying to fetch config updates: %s", err)
-			} else if newConf {
-				logging.Print("New config(s) found in MySQL")
-				mp.notifyWatcher()
+			if _, err := mp.poller.Poll(); err != nil {
+				logging.Warn("Received an error trying to fetch config updates", "error", err)
+				mp.reportReloadFailure(-1, err)
 			}
 		case <-mp.shutdown:
-			logging.Print("Received shutdown signal, shutting down mysql watcher")
+			logging.Info("Received shutdown signal, shutting down mysql watcher")
 			return
 		}
 	}
 }
 
+// ForcePoll checks the database for new configs immediately rather than at the next polling
+// interval, notifying the watcher if there are any. Coalesced with polls already running.
+func (mp *MysqlPersister) ForcePoll() (bool, error) {
+	return mp.poller.Poll()
+}
+
+// pollAndNotify pulls configs, notifying the watcher if there is a new one.
+func (mp *MysqlPersister) pollAndNotify() (bool, error) {
+	newConf, err := mp.pullConfigs()
+	mp.recordResult(err)
+	if newConf {
+		logging.Info("New config(s) found in MySQL")
+		mp.notifyWatcher()
+	}
+
+	return newConf, err
+}
+
 // pullConfigs checks the database for new configs and returns true if there is a new config
 func (mp *MysqlPersister) pullConfigs() (bool, error) {
 	mp.m.RLock()
 	v := mp.latestVersion
 	mp.m.RUnlock()
 
-	logging.Printf("Fetching configs later than %v", v)
+	logging.Debug("Fetching configs", "laterThanVersion", v)
+	start := time.Now()
 	q, args, err := sq.
 		Select("Version", "Config").
 		From("quotaservice").
@@ -132,7 +165,11 @@ func (mp *MysqlPersister) pullConfigs() (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	logging.Printf("Fetching configs later than %v: OK", v)
+	logging.Debug("Fetching configs: OK", "laterThanVersion", v, "duration", time.Since(start))
+
+	mp.m.Lock()
+	mp.lastPolled = time.Now()
+	mp.m.Unlock()
 
 	rowCount := 0
 	maxVersion := -1
@@ -145,10 +182,17 @@ func (mp *MysqlPersister) pullConfigs() (bool, error) {
 			return false, err
 		}
 
+		mp.m.Lock()
+		if r.Version > mp.highestVersion {
+			mp.highestVersion = r.Version
+		}
+		mp.m.Unlock()
+
 		var c qsc.ServiceConfig
 		err = proto.Unmarshal([]byte(r.Config), &c)
 		if err != nil {
-			logging.Printf("Could not unmarshal config version %v, error: %s", r.Version, err)
+			logging.Error("Could not unmarshal config", "version", r.Version, "error", err)
+			mp.reportReloadFailure(int32(r.Version), err)
 			continue
 		}
 
@@ -157,14 +201,15 @@ func (mp *MysqlPersister) pullConfigs() (bool, error) {
 		mp.m.Unlock()
 
 		maxVersion = r.Version
+		mp.unknown.Observe([]byte(r.Config))
 	}
 
 	if rowCount == 0 {
-		logging.Printf("No versions later than %v found", v)
+		logging.Debug("No newer configs found", "laterThanVersion", v)
 		return false, nil
 	}
 
-	logging.Printf("Upgrading from version %v to %v", v, maxVersion)
+	logging.Info("Upgrading config", "fromVersion", v, "toVersion", maxVersion)
 
 	mp.m.Lock()
 	mp.latestVersion = maxVersion
@@ -173,15 +218,89 @@ func (mp *MysqlPersister) pullConfigs() (bool, error) {
 	return true, nil
 }
 
+// OnReloadFailure sets a function called for every config that can't be fetched or unmarshalled.
+func (mp *MysqlPersister) OnReloadFailure(f func(version int32, err error)) {
+	mp.m.Lock()
+	defer mp.m.Unlock()
+
+	mp.onReloadFailure = f
+}
+
+// LastPolled returns when MySQL was last queried for new configs successfully.
+func (mp *MysqlPersister) LastPolled() time.Time {
+	mp.m.RLock()
+	defer mp.m.RUnlock()
+
+	return mp.lastPolled
+}
+
+// LatestVersion returns the highest version seen in MySQL, whether or not it could be unmarshalled,
+// and when MySQL was last queried for new configs successfully.
+func (mp *MysqlPersister) LatestVersion() (int32, time.Time) {
+	mp.m.RLock()
+	defer mp.m.RUnlock()
+
+	return int32(mp.highestVersion), mp.lastPolled
+}
+
+// LastError returns the error of the latest poll of MySQL or write to it and when it occurred, or
+// nil if it succeeded. Configs that couldn't be unmarshalled, and writes refused as duplicate or
+// stale, don't count as failures.
+func (mp *MysqlPersister) LastError() (error, time.Time) {
+	mp.m.RLock()
+	defer mp.m.RUnlock()
+
+	return mp.lastErr, mp.lastErrAt
+}
+
+// recordResult records the outcome of a poll or write, clearing the last error once one succeeds.
+func (mp *MysqlPersister) recordResult(err error) {
+	mp.m.Lock()
+	defer mp.m.Unlock()
+
+	if err == ErrDuplicateConfig || err == config.ErrStaleConfig {
+		// MySQL was reached, refusing a change that conflicts with another.
+		err = nil
+	}
+
+	mp.lastErr = err
+	if err != nil {
+		mp.lastErrAt = time.Now()
+	} else {
+		mp.lastErrAt = time.Time{}
+	}
+}
+
+func (mp *MysqlPersister) reportReloadFailure(version int32, err error) {
+	mp.m.RLock()
+	f := mp.onReloadFailure
+	mp.m.RUnlock()
+
+	if f != nil {
+		f(version, err)
+	}
+}
+
 func (mp *MysqlPersister) notifyWatcher() {
-	logging.Print("Notifying config watcher")
+	logging.Debug("Notifying config watcher")
 	mp.notifier.Notify()
 }
 
 // PersistAndNotify persists a marshalled configuration passed in.
 func (mp *MysqlPersister) PersistAndNotify(_ string, c *qsc.ServiceConfig) error {
-	logging.Printf("Persisting version %v", c.GetVersion())
-	b, err := proto.Marshal(c)
+	err := mp.persist(c)
+	mp.recordResult(err)
+	return err
+}
+
+func (mp *MysqlPersister) persist(c *qsc.ServiceConfig) error {
+	logging.Info("Persisting config", "version", c.GetVersion())
+	start := time.Now()
+	b, err := mp.unknown.Marshal(c)
+	if err != nil {
+		return err
+	}
+
 	q, args, err := sq.Insert("quotaservice").Columns("Version", "Config").Values(c.GetVersion(), string(b)).ToSql()
 	if err != nil {
 		return err
@@ -196,7 +315,58 @@ func (mp *MysqlPersister) PersistAndNotify(_ string, c *qsc.ServiceConfig) error
 		return err
 	}
 
-	logging.Printf("Persisting version %v: OK", c.GetVersion())
+	logging.Info("Persisting config: OK", "version", c.GetVersion(), "duration", time.Since(start))
+	return nil
+}
+
+// PersistIfLatest persists a marshalled configuration passed in, if the latest version in the table
+// is expectedVersion. The check and the insert are a single statement, so of concurrent changes
+// based on the same version, only one is persisted; the others get config.ErrStaleConfig.
+func (mp *MysqlPersister) PersistIfLatest(expectedVersion int, c *qsc.ServiceConfig) error {
+	err := mp.persistIfLatest(expectedVersion, c)
+	mp.recordResult(err)
+	return err
+}
+
+func (mp *MysqlPersister) persistIfLatest(expectedVersion int, c *qsc.ServiceConfig) error {
+	logging.Info("Persisting config", "version", c.GetVersion(), "expectedVersion", expectedVersion)
+	start := time.Now()
+	b, err := mp.unknown.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	// The aggregate yields a single row even if the table is empty, which HAVING discards unless
+	// the latest version is the one expected.
+	latest := sq.
+		Select().
+		Column("?", c.GetVersion()).
+		Column("?", string(b)).
+		From("quotaservice").
+		Having("COALESCE(MAX(Version), 0) = ?", expectedVersion)
+
+	q, args, err := sq.Insert("quotaservice").Columns("Version", "Config").Select(latest).ToSql()
+	if err != nil {
+		return err
+	}
+
+	res, err := mp.db.Exec(q, args...)
+	if err != nil {
+		if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == mysqlErrDuplicateEntry {
+			// A concurrent change based on the same version was persisted first.
+			return config.ErrStaleConfig
+		}
+
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return config.ErrStaleConfig
+	}
+
+	logging.Info("Persisting config: OK", "version", c.GetVersion(), "duration", time.Since(start))
 	return nil
 }
 
@@ -205,6 +375,11 @@ func (mp *MysqlPersister) ConfigChangedWatcher() <-chan struct{} {
 	return mp.notifier.Watcher
 }
 
+// UnknownFields implements config.UnknownFieldsKeeper.
+func (mp *MysqlPersister) UnknownFields() *config.UnknownFields {
+	return &mp.unknown
+}
+
 // ReadPersistedConfig provides a config previously persisted.
 func (mp *MysqlPersister) ReadPersistedConfig() (*qsc.ServiceConfig, error) {
 	mp.m.RLock()
@@ -239,16 +414,43 @@ func (mp *MysqlPersister) ReadHistoricalConfigs() ([]*qsc.ServiceConfig, error)
 	return configs, nil
 }
 
+// RangeHistoricalConfigs calls fn with each previously persisted config, in ascending order of
+// version, until fn returns false. Unlike ReadHistoricalConfigs, each config is cloned only when it
+// is yielded, so memory stays flat however deep the history. The lock isn't held while fn runs, so
+// configs persisted meanwhile past the versions read at the start aren't yielded.
+func (mp *MysqlPersister) RangeHistoricalConfigs(fn func(version int, c *qsc.ServiceConfig) bool) error {
+	mp.m.RLock()
+	versions := make([]int, 0, len(mp.configs))
+	for k := range mp.configs {
+		versions = append(versions, k)
+	}
+	mp.m.RUnlock()
+
+	sort.Ints(versions)
+
+	for _, v := range versions {
+		mp.m.RLock()
+		c := config.CloneConfig(mp.configs[v])
+		mp.m.RUnlock()
+
+		if !fn(v, c) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
 func (mp *MysqlPersister) Close() {
-	logging.Print("Shutting down MySQL persister")
+	logging.Info("Shutting down MySQL persister")
 	close(mp.shutdown)
 	<-mp.fetcherShutdown
 
 	close(mp.notifier.Watcher)
 	err := mp.db.Close()
 	if err != nil {
-		logging.Printf("Could not terminate mysql connection: %v", err)
+		logging.Warn("Could not terminate mysql connection", "error", err)
 	} else {
-		logging.Printf("Shutting down MySQL persister: OK")
+		logging.Info("Shutting down MySQL persister: OK")
 	}
 }
@@ -13,6 +13,7 @@ import (
 	dockertest "github.com/ory/dockertest/v3"
 	r "github.com/stretchr/testify/require"
 
+	"github.com/square/quotaservice/config"
 	qsc "github.com/square/quotaservice/protos/config"
 )
 
@@ -234,6 +235,52 @@ func TestReadHistoricalConfig(t *testing.T) {
 	require.Equal([]*qsc.ServiceConfig{c1233, c1234, c1235}, cHistorical)
 }
 
+func TestRangeHistoricalConfigs(t *testing.T) {
+	require := r.New(t)
+
+	setup(require, db)
+
+	p, err := New(NewUnsafeConnector("root", "secret", "localhost", int(port), "quotaservice"), pollingInterval)
+	require.NoError(err)
+	defer p.Close()
+
+	// Clear the notify that's sent when the persister starts
+	<-p.ConfigChangedWatcher()
+
+	// In a single statement, so all are fetched by the same poll.
+	var args []interface{}
+	for _, v := range []int32{12, 10, 11} {
+		b, err := proto.Marshal(&qsc.ServiceConfig{Version: v})
+		require.NoError(err)
+		args = append(args, v, string(b))
+	}
+
+	_, err = db.Query("INSERT INTO quotaservice.quotaservice (Version, Config) VALUES (?, ?), (?, ?), (?, ?)", args...)
+	require.NoError(err)
+
+	select {
+	case <-time.After(2 * pollingInterval):
+		require.Fail("No notification received for new config")
+	case <-p.ConfigChangedWatcher():
+	}
+
+	var versions []int
+	require.NoError(p.RangeHistoricalConfigs(func(version int, c *qsc.ServiceConfig) bool {
+		require.Equal(int32(version), c.Version)
+		versions = append(versions, version)
+		return true
+	}))
+	require.Equal([]int{10, 11, 12}, versions)
+
+	// Returning false stops the iteration.
+	versions = nil
+	require.NoError(p.RangeHistoricalConfigs(func(version int, c *qsc.ServiceConfig) bool {
+		versions = append(versions, version)
+		return version < 11
+	}))
+	require.Equal([]int{10, 11}, versions)
+}
+
 func TestFetchConfigsAtBoot(t *testing.T) {
 	require := r.New(t)
 
@@ -261,6 +308,32 @@ func TestFetchConfigsAtBoot(t *testing.T) {
 	require.Equal(firstConfig, cPersisted)
 }
 
+func TestReloadFailureReported(t *testing.T) {
+	require := r.New(t)
+
+	setup(require, db)
+
+	p, err := New(NewUnsafeConnector("root", "secret", "localhost", int(port), "quotaservice"), pollingInterval)
+	require.NoError(err)
+	defer p.Close()
+
+	failures := make(chan int32, 10)
+	p.OnReloadFailure(func(version int32, err error) {
+		require.Error(err)
+		failures <- version
+	})
+
+	_, err = db.Query("INSERT INTO quotaservice.quotaservice (Version, Config) VALUES (?, ?)", 7, "\xff\xff\xff")
+	require.NoError(err)
+
+	select {
+	case <-time.After(2 * pollingInterval):
+		require.Fail("No reload failure reported for an invalid config")
+	case v := <-failures:
+		require.Equal(int32(7), v)
+	}
+}
+
 func TestDuplicateConfig(t *testing.T) {
 	require := r.New(t)
 
@@ -281,6 +354,113 @@ func TestDuplicateConfig(t *testing.T) {
 	require.Equal(ErrDuplicateConfig, p.PersistAndNotify("", config))
 }
 
+func TestPersistIfLatest(t *testing.T) {
+	require := r.New(t)
+
+	setup(require, db)
+
+	p, err := New(NewUnsafeConnector("root", "secret", "localhost", int(port), "quotaservice"), pollingInterval)
+	require.NoError(err)
+	defer p.Close()
+
+	// Clear the notify that's sent when the persister starts
+	<-p.ConfigChangedWatcher()
+
+	require.NoError(p.PersistIfLatest(0, &qsc.ServiceConfig{Version: 1}))
+	require.NoError(p.PersistIfLatest(1, &qsc.ServiceConfig{Version: 2}))
+
+	// Both based on version 2, the second loses.
+	require.NoError(p.PersistIfLatest(2, &qsc.ServiceConfig{Version: 3, User: "alice"}))
+	require.Equal(config.ErrStaleConfig, p.PersistIfLatest(2, &qsc.ServiceConfig{Version: 3, User: "bob"}))
+	require.Equal(config.ErrStaleConfig, p.PersistIfLatest(2, &qsc.ServiceConfig{Version: 4, User: "bob"}))
+
+	var cfg *qsc.ServiceConfig
+	for start := time.Now(); cfg == nil || cfg.Version != 3; time.Sleep(pollingInterval) {
+		require.True(time.Since(start) < 10*pollingInterval, "Expected version 3 to be fetched")
+		cfg, _ = p.ReadPersistedConfig()
+	}
+
+	require.Equal("alice", cfg.User)
+}
+
+func TestLastPolled(t *testing.T) {
+	require := r.New(t)
+
+	setup(require, db)
+	p, err := New(NewUnsafeConnector("root", "secret", "localhost", int(port), "quotaservice"), pollingInterval)
+	require.NoError(err)
+	defer p.Close()
+
+	booted := p.LastPolled()
+	require.False(booted.IsZero(), "Expected configs pulled at boot to count as a poll")
+
+	for start := time.Now(); !p.LastPolled().After(booted); time.Sleep(pollingInterval) {
+		require.True(time.Since(start) < 10*pollingInterval, "Expected MySQL to be polled")
+	}
+}
+
+func TestLatestVersion(t *testing.T) {
+	require := r.New(t)
+
+	setup(require, db)
+	p, err := New(NewUnsafeConnector("root", "secret", "localhost", int(port), "quotaservice"), pollingInterval)
+	require.NoError(err)
+	defer p.Close()
+
+	_, err = db.Query("INSERT INTO quotaservice.quotaservice (Version, Config) VALUES (?, ?)", 7, "\xff\xff\xff")
+	require.NoError(err)
+
+	// The invalid version is never loaded, but still counts as the latest version in MySQL.
+	for start := time.Now(); ; time.Sleep(pollingInterval) {
+		require.True(time.Since(start) < 10*pollingInterval, "Expected version 7 to be seen")
+		if v, polled := p.LatestVersion(); v == 7 {
+			require.False(polled.IsZero())
+			break
+		}
+	}
+}
+
+func TestForcePoll(t *testing.T) {
+	require := r.New(t)
+
+	setup(require, db)
+
+	// Neither persister polls during the test, so configs are only seen by forcing a poll.
+	p, err := New(NewUnsafeConnector("root", "secret", "localhost", int(port), "quotaservice"), time.Hour)
+	require.NoError(err)
+	defer p.Close()
+
+	writer, err := New(NewUnsafeConnector("root", "secret", "localhost", int(port), "quotaservice"), time.Hour)
+	require.NoError(err)
+	defer writer.Close()
+
+	// Clear the notify that's sent when the persister starts
+	<-p.ConfigChangedWatcher()
+
+	require.NoError(writer.PersistAndNotify("", &qsc.ServiceConfig{Version: 1, User: "alice"}))
+
+	_, err = p.ReadPersistedConfig()
+	require.Error(err, "Expected the config not to be seen before polling")
+
+	changed, err := p.ForcePoll()
+	require.NoError(err)
+	require.True(changed)
+
+	select {
+	case <-p.ConfigChangedWatcher():
+	default:
+		require.Fail("Expected the watcher to be notified of the config found")
+	}
+
+	cfg, err := p.ReadPersistedConfig()
+	require.NoError(err)
+	require.Equal(int32(1), cfg.Version)
+
+	changed, err = p.ForcePoll()
+	require.NoError(err)
+	require.False(changed)
+}
+
 func TestNoTable(t *testing.T) {
 	require := r.New(t)
 
@@ -298,3 +478,96 @@ func TestNoTable(t *testing.T) {
 	require.Error(err)
 
 }
+
+func TestLastError(t *testing.T) {
+	require := r.New(t)
+
+	setup(require, db)
+
+	p, err := New(NewUnsafeConnector("root", "secret", "localhost", int(port), "quotaservice"), pollingInterval)
+	require.NoError(err)
+	defer p.Close()
+
+	err, at := p.LastError()
+	require.NoError(err)
+	require.True(at.IsZero())
+
+	_, err = db.Exec("RENAME TABLE quotaservice.quotaservice TO quotaservice.quotaservice_moved")
+	require.NoError(err)
+
+	restored := false
+	defer func() {
+		if !restored {
+			_, err := db.Exec("RENAME TABLE quotaservice.quotaservice_moved TO quotaservice.quotaservice")
+			require.NoError(err)
+		}
+	}()
+
+	_, err = p.ForcePoll()
+	require.Error(err)
+
+	err, at = p.LastError()
+	require.Error(err, "Expected the poll error to be reported")
+	require.False(at.IsZero())
+
+	_, err = db.Exec("RENAME TABLE quotaservice.quotaservice_moved TO quotaservice.quotaservice")
+	require.NoError(err)
+	restored = true
+
+	_, err = p.ForcePoll()
+	require.NoError(err)
+
+	err, at = p.LastError()
+	require.NoError(err, "Expected the poll error to clear once a poll succeeds")
+	require.True(at.IsZero())
+}
+
+func TestImportLegacyConfig(t *testing.T) {
+	require := r.New(t)
+
+	_, err := db.Exec("CREATE TABLE quotaservice.current_config (ID INT PRIMARY KEY, Config BLOB)")
+	require.NoError(err)
+
+	defer func() {
+		_, err := db.Exec("DROP TABLE quotaservice.current_config")
+		require.NoError(err)
+	}()
+
+	const query = "SELECT Config FROM quotaservice.current_config"
+
+	_, err = ImportLegacyConfig(db, query)
+	require.Error(err, "Expected an empty table to be refused")
+
+	legacy := config.NewDefaultServiceConfig()
+	legacy.Version = 42
+	require.NoError(config.AddNamespace(legacy, config.NewDefaultNamespaceConfig("legacy")))
+	b, err := proto.Marshal(legacy)
+	require.NoError(err)
+
+	_, err = db.Exec("INSERT INTO quotaservice.current_config (ID, Config) VALUES (1, ?)", string(b))
+	require.NoError(err)
+
+	imported, err := ImportLegacyConfig(db, query)
+	require.NoError(err)
+	require.True(proto.Equal(legacy, imported))
+
+	_, err = db.Exec("UPDATE quotaservice.current_config SET Config = ? WHERE ID = 1",
+		`{"namespaces": {"legacy": {"name": "legacy", "max_dynamic_buckets": 5}}}`)
+	require.NoError(err)
+
+	imported, err = ImportLegacyConfig(db, query)
+	require.NoError(err)
+	require.Equal(int32(5), imported.Namespaces["legacy"].MaxDynamicBuckets)
+
+	_, err = db.Exec("UPDATE quotaservice.current_config SET Config = ? WHERE ID = 1", "\xff\xff\xff")
+	require.NoError(err)
+
+	_, err = ImportLegacyConfig(db, query)
+	require.Error(err, "Expected a malformed config to be refused")
+
+	_, err = db.Exec("INSERT INTO quotaservice.current_config (ID, Config) VALUES (2, ?)", string(b))
+	require.NoError(err)
+
+	_, err = ImportLegacyConfig(db, query)
+	require.Error(err, "Expected more than one row to be refused")
+}
@@ -5,12 +5,34 @@ package config
 
 import (
 	"crypto/md5"
+	"errors"
 	"fmt"
+	"github.com/golang/protobuf/proto"
 	"github.com/square/quotaservice/logging"
 	pb "github.com/square/quotaservice/protos/config"
 	"io/ioutil"
+	"time"
 )
 
+// ErrDuplicateConfig is returned by a ConfigPersister asked to persist a config with a version that
+// has already been persisted.
+var ErrDuplicateConfig = errors.New("config with provided version number already exists")
+
+// ErrStaleConfig is returned by a ConditionalPersister asked to persist a config based on a version
+// that is no longer the latest, e.g. because another admin persisted a change concurrently.
+var ErrStaleConfig = errors.New("config is based on a version that is no longer the latest")
+
+// ErrActivationPending is returned when changing a server's config while a later version is pending
+// activation, unless the change is based on the pending version.
+var ErrActivationPending = errors.New("a config is pending activation; changes must be based on its version")
+
+// ErrNoConfig is returned when changing a server's config before it has read one, e.g. while it
+// grants every request, having started without a config under a fail-open startup policy.
+var ErrNoConfig = errors.New("no config has been read yet")
+
+// ErrUnknownVersion is returned when looking up a historical config version that doesn't exist.
+var ErrUnknownVersion = errors.New("no config with the requested version exists")
+
 // ConfigPersister is an interface that persists configs and notifies a channel of changes.
 type ConfigPersister interface {
 	// PersistAndNotify persists a configuration passed in.
@@ -25,6 +47,115 @@ type ConfigPersister interface {
 	ReadHistoricalConfigs() ([]*pb.ServiceConfig, error)
 }
 
+// PersistMeta describes a change being persisted.
+type PersistMeta struct {
+	// Author is the principal that made the change.
+	Author string
+	// Note explains the change, e.g. that it is a rollback. May be empty.
+	Note string
+}
+
+// MetaPersister is implemented by ConfigPersisters that store who wrote each version alongside it,
+// e.g. in metadata columns. Changes persisted with other ConfigPersisters are only attributed in
+// the config's User field and the audit log.
+type MetaPersister interface {
+	// PersistAndNotifyWithMeta is like PersistAndNotify, also storing meta with the config.
+	PersistAndNotifyWithMeta(oldHash string, newConfig *pb.ServiceConfig, meta *PersistMeta) error
+}
+
+// ConditionalPersister is implemented by ConfigPersisters that can persist a config only if it is
+// based on the latest version, atomically, so concurrent changes based on the same version are
+// detected as conflicts rather than one overwriting the other.
+type ConditionalPersister interface {
+	// PersistIfLatest is like PersistAndNotify, but only persists the config if the latest version
+	// persisted is expectedVersion, returning ErrStaleConfig otherwise.
+	PersistIfLatest(expectedVersion int, newConfig *pb.ServiceConfig) error
+}
+
+// PersistAndNotifyWithMeta persists a config with a ConfigPersister, storing meta with it if the
+// persister is a MetaPersister. Returns whether meta was stored.
+func PersistAndNotifyWithMeta(p ConfigPersister, oldHash string, newConfig *pb.ServiceConfig, meta *PersistMeta) (bool, error) {
+	if m, ok := p.(MetaPersister); ok {
+		return true, m.PersistAndNotifyWithMeta(oldHash, newConfig, meta)
+	}
+
+	return false, p.PersistAndNotify(oldHash, newConfig)
+}
+
+// VersionPersister is implemented by ConfigPersisters that report the version they persisted, such
+// as those persisting through another process, so callers can confirm which version was written.
+type VersionPersister interface {
+	// PersistAndNotifyV is like PersistAndNotify, also returning the version persisted, which
+	// ReadPersistedConfig then reports.
+	PersistAndNotifyV(oldHash string, newConfig *pb.ServiceConfig) (int32, error)
+}
+
+// PersistAndNotifyV persists a config with a ConfigPersister, returning the version persisted: the
+// one the persister reports if it is a VersionPersister, or else the config's own.
+func PersistAndNotifyV(p ConfigPersister, oldHash string, newConfig *pb.ServiceConfig) (int32, error) {
+	if v, ok := p.(VersionPersister); ok {
+		return v.PersistAndNotifyV(oldHash, newConfig)
+	}
+
+	if err := p.PersistAndNotify(oldHash, newConfig); err != nil {
+		return 0, err
+	}
+
+	return newConfig.GetVersion(), nil
+}
+
+// ReloadFailureReporter is implemented by ConfigPersisters that load configs in the background, to
+// report configs that couldn't be loaded, e.g. because they couldn't be unmarshalled. Such configs
+// are otherwise skipped silently, leaving the server on a stale config.
+type ReloadFailureReporter interface {
+	// OnReloadFailure sets a function called with the version, or -1 if it isn't known, and error
+	// of every config that fails to load.
+	OnReloadFailure(func(version int32, err error))
+}
+
+// PollReporter is implemented by ConfigPersisters that poll their config store for changes, so a
+// config that is stable can be told apart from a persister that can no longer reach its store.
+type PollReporter interface {
+	// LastPolled returns when the store was last polled successfully, or the zero time if it
+	// hasn't been.
+	LastPolled() time.Time
+}
+
+// LastErrorReporter is implemented by ConfigPersisters that poll or write to a config store, to
+// report the latest failure, such as one only logged by a background poll, for health checks.
+type LastErrorReporter interface {
+	// LastError returns the error of the latest poll or write to the store and when it occurred,
+	// or nil and the zero time if it succeeded.
+	LastError() (err error, at time.Time)
+}
+
+// LatestVersionReporter is implemented by ConfigPersisters that poll their config store for changes,
+// to report the highest version in the store, so a server lagging behind it, such as one unable to
+// load the latest config, can be told apart from one that is up to date.
+type LatestVersionReporter interface {
+	// LatestVersion returns the highest config version seen in the store, including versions that
+	// couldn't be loaded, and when it was observed, at the last successful poll. Returns -1 and the
+	// zero time if the store hasn't been polled.
+	LatestVersion() (int32, time.Time)
+}
+
+// ForcePoller is implemented by ConfigPersisters that poll their config store for changes, to poll
+// it immediately, e.g. after the store was edited directly, rather than at the next scheduled poll.
+type ForcePoller interface {
+	// ForcePoll polls the store, notifying the watcher of a new config as a scheduled poll would,
+	// and returns whether there was one. Polls forced while another is running are coalesced.
+	ForcePoll() (bool, error)
+}
+
+// UnknownFieldsKeeper is implemented by ConfigPersisters that keep the fields, unknown to this
+// schema, of the latest config they read, to merge into the configs they write. A SigningPersister
+// signs and verifies configs along with those fields, so configs signed by versions of the schema
+// that know them still verify.
+type UnknownFieldsKeeper interface {
+	// UnknownFields returns the unknown fields kept.
+	UnknownFields() *UnknownFields
+}
+
 // HashConfigBytes returns the MD5 of a config byte array.
 func HashConfigBytes(cfgBytes []byte) string {
 	return fmt.Sprintf("%x", md5.Sum(cfgBytes))
@@ -47,3 +178,26 @@ func HashConfig(config *pb.ServiceConfig) string {
 
 	return HashConfigBytes(b)
 }
+
+// Fingerprint returns the MD5 of a service config marshalled deterministically, so nodes that
+// loaded the same config report the same fingerprint, unlike with HashConfig.
+func Fingerprint(config *pb.ServiceConfig) string {
+	b, err := marshalDeterministic(config)
+	if err != nil {
+		logging.Printf("Unable to marshal config %+v: %v", config, err)
+		return ""
+	}
+
+	return HashConfigBytes(b)
+}
+
+// marshalDeterministic marshals a config with map entries in a consistent order.
+func marshalDeterministic(config *pb.ServiceConfig) ([]byte, error) {
+	buf := proto.NewBuffer(nil)
+	buf.SetDeterministic(true)
+	if err := buf.Marshal(config); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
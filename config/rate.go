@@ -0,0 +1,221 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "github.com/square/quotaservice/protos/config"
+	"gopkg.in/yaml.v2"
+)
+
+// rateUnits are the units of rate strings, by the period they stand for.
+var rateUnits = map[string]time.Duration{
+	"s":      time.Second,
+	"sec":    time.Second,
+	"second": time.Second,
+	"min":    time.Minute,
+	"minute": time.Minute,
+	"h":      time.Hour,
+	"hour":   time.Hour,
+}
+
+const (
+	fillRateField    = "fill_rate"
+	rateWindowsField = "rate_windows"
+)
+
+// rateFields are the bucket fields, in tokens per second, that may be written as rate strings.
+var rateFields = map[string]bool{
+	fillRateField:          true,
+	"ramp_start_fill_rate": true,
+}
+
+// ParseRate parses a rate string, a whole number of tokens per unit, such as "100/s", "6000/min"
+// or "360000/h", into tokens per second. Units are s, min and h, or sec, second, minute and hour.
+// Since fill rates are whole numbers of tokens per second, rates that aren't, such as "1/h" or
+// "30/min", are returned rounded up to one, along with a rate window of the tokens per unit to
+// enforce alongside it. Rates of no tokens, which would otherwise be replaced by the default fill
+// rate, are refused.
+func ParseRate(rate string) (int64, *pb.RateWindow, error) {
+	parts := strings.SplitN(rate, "/", 2)
+	if len(parts) != 2 {
+		return 0, nil, fmt.Errorf("%q is not a rate such as 100/s", rate)
+	}
+
+	tokens, err := strconv.ParseInt(strings.TrimSpace(parts[0]), 10, 64)
+	if err != nil || tokens <= 0 {
+		return 0, nil, fmt.Errorf("%q must have a positive whole number of tokens", rate)
+	}
+
+	unit, ok := rateUnits[strings.TrimSpace(parts[1])]
+	if !ok {
+		return 0, nil, fmt.Errorf("%q has unknown unit %q, expected s, min or h", rate, strings.TrimSpace(parts[1]))
+	}
+
+	seconds := int64(unit / time.Second)
+	if tokens%seconds != 0 {
+		window := &pb.RateWindow{Tokens: tokens, WindowMillis: int64(unit / time.Millisecond)}
+		return tokens/seconds + 1, window, nil
+	}
+
+	return tokens / seconds, nil, nil
+}
+
+// jsonWithRates returns JSON with the rate strings of rateFields replaced by tokens per second, and
+// the rate windows of fill rates that aren't whole numbers of tokens per second added, or
+// ValidationErrors for rate strings that can't be parsed. JSON without rate strings, including
+// JSON that can't be parsed, is returned as is, to be reported by the config's own unmarshalling.
+func jsonWithRates(j []byte) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(j))
+	// Keeps large integers exact when reencoded.
+	d.UseNumber()
+
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return j, nil
+	}
+
+	var errs ValidationErrors
+	if !replaceRates(v, "", &errs) {
+		return j, nil
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	return json.Marshal(v)
+}
+
+// yamlWithRates is jsonWithRates for YAML.
+func yamlWithRates(y []byte) ([]byte, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(y, &v); err != nil {
+		return y, nil
+	}
+
+	var errs ValidationErrors
+	if !replaceRates(v, "", &errs) {
+		return y, nil
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	return yaml.Marshal(v)
+}
+
+// replaceRates replaces the rate strings of rateFields, in a config decoded into generic maps and
+// slices, by tokens per second, adding errors for those that can't be parsed. Fill rates that
+// aren't whole numbers of tokens per second add their rate window to their bucket's rate_windows.
+// Returns whether any rate strings were found.
+func replaceRates(v interface{}, field string, errs *ValidationErrors) bool {
+	found := false
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			if replaced, window, ok := replaceRate(v[k], joinField(field, k), k, errs); ok {
+				v[k] = replaced
+				if window != nil {
+					v[rateWindowsField] = appendRateWindow(v[rateWindowsField], map[string]interface{}{
+						"tokens": window.Tokens, "window_millis": window.WindowMillis})
+				}
+
+				found = true
+			} else {
+				found = replaceRates(v[k], joinField(field, k), errs) || found
+			}
+		}
+	case map[interface{}]interface{}:
+		keys := make([]string, 0, len(v))
+		byName := make(map[string]interface{}, len(v))
+		for k := range v {
+			name := fmt.Sprint(k)
+			keys = append(keys, name)
+			byName[name] = k
+		}
+
+		sort.Strings(keys)
+
+		for _, name := range keys {
+			k := byName[name]
+			if replaced, window, ok := replaceRate(v[k], joinField(field, name), name, errs); ok {
+				v[k] = replaced
+				if window != nil {
+					v[rateWindowsField] = appendRateWindow(v[rateWindowsField], map[interface{}]interface{}{
+						"tokens": window.Tokens, "window_millis": window.WindowMillis})
+				}
+
+				found = true
+			} else {
+				found = replaceRates(v[k], joinField(field, name), errs) || found
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			found = replaceRates(e, joinField(field, strconv.Itoa(i)), errs) || found
+		}
+	}
+
+	return found
+}
+
+// replaceRate returns the tokens per second of the value of a key if the key is one of rateFields
+// and the value a string, and the rate window to enforce alongside a fill rate that isn't a whole
+// number of tokens per second, adding an error if it can't be parsed. Ramp start fill rates must be
+// whole numbers of tokens per second, since a rate window would limit the bucket past its ramp.
+func replaceRate(v interface{}, field, key string, errs *ValidationErrors) (interface{}, *pb.RateWindow, bool) {
+	rate, ok := v.(string)
+	if !ok || !rateFields[key] {
+		return nil, nil, false
+	}
+
+	perSecond, window, err := ParseRate(rate)
+	if err != nil {
+		errs.add(field, "%v", err)
+	} else if window != nil && key != fillRateField {
+		errs.add(field, "%q is not a whole number of tokens per second", rate)
+		window = nil
+	}
+
+	return perSecond, window, true
+}
+
+// appendRateWindow returns the rate windows of a bucket, decoded into generic slices, with a window
+// appended. Rate windows that aren't a list are returned as is, to be reported by the config's own
+// unmarshalling.
+func appendRateWindow(windows, window interface{}) interface{} {
+	switch w := windows.(type) {
+	case nil:
+		return []interface{}{window}
+	case []interface{}:
+		return append(w, window)
+	default:
+		return windows
+	}
+}
+
+func joinField(field, key string) string {
+	if field == "" {
+		return key
+	}
+
+	return field + "." + key
+}
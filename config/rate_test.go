@@ -0,0 +1,200 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	pb "github.com/square/quotaservice/protos/config"
+)
+
+func TestParseRate(t *testing.T) {
+	for rate, expected := range map[string]int64{
+		"100/s":       100,
+		"100/sec":     100,
+		"100/second":  100,
+		" 100 / s ":   100,
+		"6000/min":    100,
+		"6000/minute": 100,
+		"3600/h":      1,
+		"7200/hour":   2,
+	} {
+		perSecond, window, err := ParseRate(rate)
+		if err != nil {
+			t.Errorf("Expected %q to parse, got %v", rate, err)
+		} else if perSecond != expected || window != nil {
+			t.Errorf("Expected %q to be %v tokens per second, got %v, %v", rate, expected, perSecond, window)
+		}
+	}
+
+	// Rates that aren't whole numbers of tokens per second are enforced by a rate window.
+	for rate, expected := range map[string]pb.RateWindow{
+		"1/h":    {Tokens: 1, WindowMillis: 3600000},
+		"1/min":  {Tokens: 1, WindowMillis: 60000},
+		"30/min": {Tokens: 30, WindowMillis: 60000},
+		"90/min": {Tokens: 90, WindowMillis: 60000},
+	} {
+		perSecond, window, err := ParseRate(rate)
+		if err != nil {
+			t.Errorf("Expected %q to parse, got %v", rate, err)
+		} else if window == nil || *window != expected {
+			t.Errorf("Expected %q to have window %+v, got %+v", rate, expected, window)
+		} else if perSecond != (expected.Tokens*1000+expected.WindowMillis-1)/expected.WindowMillis {
+			t.Errorf("Expected %q to be rounded up to whole tokens per second, got %v", rate, perSecond)
+		}
+	}
+
+	for _, rate := range []string{"", "100", "100/", "/s", "abc/s", "1.5/s", "-1/s", "0/s", "0/h", "100/d", "100/ms"} {
+		if _, _, err := ParseRate(rate); err == nil {
+			t.Errorf("Expected %q not to parse", rate)
+		}
+	}
+}
+
+func TestFromJSONRateWindows(t *testing.T) {
+	cfg, err := FromJSON([]byte(`{"namespaces": {"foo": {
+		"default_bucket": {"fill_rate": "1/h"},
+		"buckets": {
+			"bar": {"fill_rate": "30/min", "rate_windows": [{"tokens": 1000, "window_millis": 3600000}]},
+			"baz": {"fill_rate": "1/min", "ramp_start_fill_rate": "1/s"}}}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ns := cfg.Namespaces["foo"]
+	for name, tc := range map[string]struct {
+		b        *pb.BucketConfig
+		expected []*pb.RateWindow
+	}{
+		"default_bucket": {ns.DefaultBucket, []*pb.RateWindow{{Tokens: 1, WindowMillis: 3600000}}},
+		"bar":            {ns.Buckets["bar"], []*pb.RateWindow{{Tokens: 1000, WindowMillis: 3600000}, {Tokens: 30, WindowMillis: 60000}}},
+		"baz":            {ns.Buckets["baz"], []*pb.RateWindow{{Tokens: 1, WindowMillis: 60000}}},
+	} {
+		if tc.b.FillRate != 1 || !reflect.DeepEqual(tc.b.RateWindows, tc.expected) {
+			t.Errorf("Expected %v to fill a token per second with windows %v, got %+v", name, tc.expected, tc.b)
+		}
+	}
+
+	if err := Validate(cfg); err != nil {
+		t.Errorf("Expected the config to be valid, got %v", err)
+	}
+
+	// A rate window can't enforce a ramp's start fill rate, since it would outlast the ramp.
+	_, err = FromJSON([]byte(`{"namespaces": {"foo": {"buckets": {"bar": {"fill_rate": 10, "ramp_start_fill_rate": "1/min"}}}}}`))
+	if errs, ok := err.(ValidationErrors); !ok || len(errs) != 1 || errs[0].Field != "namespaces.foo.buckets.bar.ramp_start_fill_rate" {
+		t.Errorf("Expected a validation error for the ramp start fill rate, got %v", err)
+	}
+
+	y, err := FromYAML([]byte("namespaces:\n  foo:\n    buckets:\n      bar:\n        fill_rate: 30/min\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bar := y.Namespaces["foo"].Buckets["bar"]; bar.FillRate != 1 || !reflect.DeepEqual(bar.RateWindows, []*pb.RateWindow{{Tokens: 30, WindowMillis: 60000}}) {
+		t.Errorf("Expected YAML rates to add a rate window, got %+v", bar)
+	}
+}
+
+func TestFromJSONRates(t *testing.T) {
+	cfg, err := FromJSON([]byte(`{
+		"global_default_bucket": {"fill_rate": "60/min"},
+		"namespaces": {"foo": {"buckets": {
+			"bar": {"size": 200, "fill_rate": "100/s", "ramp_start_fill_rate": "3600/h"},
+			"baz": {"fill_rate": 5}}}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.GlobalDefaultBucket.FillRate != 1 {
+		t.Errorf("Expected a global default fill rate of 1, got %v", cfg.GlobalDefaultBucket.FillRate)
+	}
+
+	bar := cfg.Namespaces["foo"].Buckets["bar"]
+	if bar.Size != 200 || bar.FillRate != 100 || bar.RampStartFillRate != 1 {
+		t.Errorf("Expected rates to be converted to tokens per second, got %+v", bar)
+	}
+
+	if baz := cfg.Namespaces["foo"].Buckets["baz"]; baz.FillRate != 5 {
+		t.Errorf("Expected numeric fill rates to be read as is, got %v", baz.FillRate)
+	}
+
+	ns, err := NamespaceFromJSON([]byte(`{"buckets": {"bar": {"fill_rate": "6000/min"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ns.Buckets["bar"].FillRate != 100 {
+		t.Errorf("Expected a fill rate of 100, got %v", ns.Buckets["bar"].FillRate)
+	}
+}
+
+func TestFromYAMLRates(t *testing.T) {
+	cfg, err := FromYAML([]byte(`
+namespaces:
+  foo:
+    buckets:
+      bar:
+        size: 200
+        fill_rate: 6000/min
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fillRate := cfg.Namespaces["foo"].Buckets["bar"].FillRate; fillRate != 100 {
+		t.Fatalf("Expected a fill rate of 100, got %v", fillRate)
+	}
+
+	// Exported configs use the numeric form.
+	y, err := ToYAML(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(y), "fill_rate: 100\n") {
+		t.Errorf("Expected the fill rate to be exported as a number, got:\n%s", y)
+	}
+
+	cfg = ReadConfig(strings.NewReader("namespaces:\n  foo:\n    buckets:\n      bar:\n        fill_rate: 100/s\n"))
+	if fillRate := cfg.Namespaces["foo"].Buckets["bar"].FillRate; fillRate != 100 {
+		t.Errorf("Expected ReadConfig to read a fill rate of 100, got %v", fillRate)
+	}
+}
+
+func TestMalformedRates(t *testing.T) {
+	_, err := FromJSON([]byte(`{"namespaces": {"foo": {
+		"default_bucket": {"fill_rate": "0/h"},
+		"buckets": {"bar": {"fill_rate": "fast"}, "baz": {"fill_rate": "100/s"}}}}}`))
+
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("Expected ValidationErrors, got %v", err)
+	}
+
+	expected := []string{
+		"namespaces.foo.buckets.bar.fill_rate",
+		"namespaces.foo.default_bucket.fill_rate",
+	}
+
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %v validation errors, got %v", len(expected), errs)
+	}
+
+	for i, f := range expected {
+		if errs[i].Field != f {
+			t.Errorf("Expected a validation error for %v, got %v", f, errs[i])
+		}
+	}
+
+	if _, err := FromYAML([]byte("namespaces:\n  foo:\n    buckets:\n      bar:\n        fill_rate: 10/day\n")); err == nil {
+		t.Error("Expected a rate with an unknown unit to be refused")
+	}
+
+	// Strings elsewhere are left to the config's own unmarshalling.
+	if _, err := FromJSON([]byte(`{"namespaces": {"foo": {"buckets": {"bar": {"size": "10"}}}}}`)); err == nil {
+		t.Error("Expected a string size to be refused")
+	}
+}
@@ -10,6 +10,8 @@ type ReaperConfig struct {
 	BucketWatcherBuffer int
 	InitSleep           time.Duration
 	MinFrequency        time.Duration
+	// Now returns the time buckets are checked for idleness at, time.Now if unset.
+	Now func() time.Time
 }
 
 // NewReaperConfig returns a new ReaperConfig with defaults.
@@ -0,0 +1,132 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package config
+
+import (
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/square/quotaservice/protos/config"
+)
+
+// TokenScale returns the fractions of a token the buckets of a namespace count, 1 unless the
+// namespace sets a token scale.
+func TokenScale(ns *pb.NamespaceConfig) int64 {
+	if scale := ns.GetTokenScale(); scale > 1 {
+		return scale
+	}
+
+	return 1
+}
+
+// ScaledBucketConfig returns the config a bucket of a namespace counting fractions of tokens is
+// created with: a copy of b with the fields counting tokens multiplied by the scale. Returns b if
+// the scale is 1.
+func ScaledBucketConfig(b *pb.BucketConfig, scale int64) *pb.BucketConfig {
+	if b == nil || scale <= 1 {
+		return b
+	}
+
+	scaled := proto.Clone(b).(*pb.BucketConfig)
+	for _, f := range tokenFields(scaled) {
+		*f.value *= scale
+	}
+
+	return scaled
+}
+
+// UnscaledBucketConfig reverses ScaledBucketConfig, returning a copy of b with the fields counting
+// tokens in whole tokens. Returns b if the scale is 1.
+func UnscaledBucketConfig(b *pb.BucketConfig, scale int64) *pb.BucketConfig {
+	if b == nil || scale <= 1 {
+		return b
+	}
+
+	unscaled := proto.Clone(b).(*pb.BucketConfig)
+	for _, f := range tokenFields(unscaled) {
+		*f.value /= scale
+	}
+
+	return unscaled
+}
+
+type tokenField struct {
+	name  string
+	value *int64
+}
+
+// tokenFields returns the fields of a bucket config counting tokens, or tokens per second, including
+// those of its rate windows.
+func tokenFields(b *pb.BucketConfig) []tokenField {
+	fields := []tokenField{
+		{"size", &b.Size},
+		{"fill_rate", &b.FillRate},
+		{"max_tokens_per_request", &b.MaxTokensPerRequest},
+		{"ramp_start_fill_rate", &b.RampStartFillRate},
+		{"max_debt", &b.MaxDebt},
+		{"token_cap", &b.TokenCap},
+	}
+
+	for i, w := range b.RateWindows {
+		fields = append(fields, tokenField{joinField("rate_windows", strconv.Itoa(i)) + ".tokens", &w.Tokens})
+	}
+
+	return fields
+}
+
+// validateTokenScale checks that the buckets and request costs of a namespace can be scaled by its
+// token scale without overflowing, and that its buckets still fill at most a token per nanosecond.
+func validateTokenScale(errs *ValidationErrors, field string, ns *pb.NamespaceConfig) {
+	if ns.TokenScale < 0 {
+		errs.add(field+".token_scale", "must not be negative")
+		return
+	}
+
+	scale := TokenScale(ns)
+	if scale == 1 {
+		return
+	}
+
+	limit := math.MaxInt64 / scale
+	for _, b := range namespaceBuckets(ns) {
+		for _, f := range tokenFields(b.cfg) {
+			if *f.value > limit {
+				errs.add(field+".token_scale", "%v %v of bucket %v overflows when scaled by %v",
+					f.name, *f.value, b.name, scale)
+			}
+		}
+	}
+
+	for _, b := range namespaceBuckets(ns) {
+		for _, f := range []tokenField{{"fill_rate", &b.cfg.FillRate}, {"ramp_start_fill_rate", &b.cfg.RampStartFillRate}} {
+			if *f.value > maxFillRate/scale {
+				errs.add(field+".token_scale", "%v %v of bucket %v is above a token per nanosecond when scaled by %v",
+					f.name, *f.value, b.name, scale)
+			}
+		}
+
+		for i, w := range b.cfg.RateWindows {
+			if w.WindowMillis > 0 && w.Tokens > w.WindowMillis*1e6/scale {
+				errs.add(field+".token_scale", "tokens %v of rate window %v of bucket %v are above a token per nanosecond when scaled by %v",
+					w.Tokens, i, b.name, scale)
+			}
+		}
+	}
+
+	kinds := make([]string, 0, len(ns.RequestCosts))
+	for kind, cost := range ns.RequestCosts {
+		if cost > limit {
+			kinds = append(kinds, kind)
+		}
+	}
+
+	sort.Strings(kinds)
+
+	for _, kind := range kinds {
+		errs.add(field+".token_scale", "cost %v of request kind %v overflows when scaled by %v",
+			ns.RequestCosts[kind], kind, scale)
+	}
+}
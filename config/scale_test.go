@@ -0,0 +1,129 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package config
+
+import (
+	"math"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/square/quotaservice/protos/config"
+)
+
+func TestScaledBucketConfig(t *testing.T) {
+	b := &pb.BucketConfig{Size: 10, FillRate: 2, MaxTokensPerRequest: 5, RampStartFillRate: 1, MaxDebt: 3, WaitTimeoutMillis: 100,
+		RateWindows: []*pb.RateWindow{{Tokens: 60, WindowMillis: 60000}}}
+	if ScaledBucketConfig(b, 1) != b {
+		t.Error("Expected a config not to be copied without a scale")
+	}
+
+	scaled := ScaledBucketConfig(b, 1000)
+	expected := &pb.BucketConfig{Size: 10000, FillRate: 2000, MaxTokensPerRequest: 5000, RampStartFillRate: 1000, MaxDebt: 3000, WaitTimeoutMillis: 100,
+		RateWindows: []*pb.RateWindow{{Tokens: 60000, WindowMillis: 60000}}}
+	if !proto.Equal(scaled, expected) {
+		t.Errorf("Expected %v, got %v", expected, scaled)
+	}
+
+	if b.Size != 10 {
+		t.Error("Expected the config scaled to be left as it was")
+	}
+
+	if unscaled := UnscaledBucketConfig(scaled, 1000); !proto.Equal(unscaled, b) {
+		t.Errorf("Expected %v once unscaled, got %v", b, unscaled)
+	}
+}
+
+func TestValidateTokenScale(t *testing.T) {
+	ns := NewDefaultNamespaceConfig("foo")
+	ns.TokenScale = 1000
+	ns.RequestCosts = map[string]int64{"cheap": 1, "huge": math.MaxInt64 / 10}
+
+	for name, size := range map[string]int64{"small": 10, "large": math.MaxInt64 / 10} {
+		b := NewDefaultBucketConfig(name)
+		b.Size = size
+		b.MaxTokensPerRequest = 1
+		if err := AddBucket(ns, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := NewDefaultServiceConfig()
+	if err := AddNamespace(cfg, ns); err != nil {
+		t.Fatal(err)
+	}
+
+	errs, _ := Validate(cfg).(ValidationErrors)
+
+	var scaleErrs ValidationErrors
+	for _, err := range errs {
+		if err.Field == "namespaces.foo.token_scale" {
+			scaleErrs = append(scaleErrs, err)
+		}
+	}
+
+	if len(scaleErrs) != 2 {
+		t.Errorf("Expected the large bucket and the huge request cost to overflow, got %v", errs)
+	}
+
+	ns.TokenScale = -1
+	if errs, _ := Validate(cfg).(ValidationErrors); len(errs) == 0 || errs[len(errs)-1].Field != "namespaces.foo.token_scale" {
+		t.Errorf("Expected a negative token scale to be refused, got %v", errs)
+	}
+}
+
+func TestValidateScaledFillRate(t *testing.T) {
+	ns := NewDefaultNamespaceConfig("foo")
+	ns.TokenScale = 1000
+
+	fast := NewDefaultBucketConfig("fast")
+	fast.FillRate = 2000000
+	fast.RampStartFillRate = 2000000
+	fast.RampDurationMillis = 1000
+	fast.RateWindows = []*pb.RateWindow{{WindowMillis: 1000, Tokens: 2000000}}
+	fast.MaxTokensPerRequest = 1
+
+	// A token per nanosecond once scaled.
+	fastest := NewDefaultBucketConfig("fastest")
+	fastest.FillRate = 1000000
+	fastest.MaxTokensPerRequest = 1
+
+	for _, b := range []*pb.BucketConfig{fast, fastest} {
+		if err := AddBucket(ns, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := NewDefaultServiceConfig()
+	if err := AddNamespace(cfg, ns); err != nil {
+		t.Fatal(err)
+	}
+
+	errs, _ := Validate(cfg).(ValidationErrors)
+
+	var scaleErrs ValidationErrors
+	for _, err := range errs {
+		if err.Field == "namespaces.foo.token_scale" {
+			scaleErrs = append(scaleErrs, err)
+		}
+	}
+
+	if len(scaleErrs) != 3 {
+		t.Errorf("Expected the fill rate, ramp and rate window of the fast bucket to be refused, got %v", errs)
+	}
+
+	// Unscaled buckets are held to the same rate.
+	ns.TokenScale = 0
+	fast.FillRate = 2e9
+	fast.MaxTokensPerRequest = 1
+	errs, _ = Validate(cfg).(ValidationErrors)
+
+	refused := false
+	for _, err := range errs {
+		refused = refused || err.Field == "namespaces.foo.buckets.fast.fill_rate"
+	}
+
+	if !refused {
+		t.Errorf("Expected a fill rate above a token per nanosecond to be refused, got %v", errs)
+	}
+}
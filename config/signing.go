@@ -0,0 +1,313 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package config
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/square/quotaservice/logging"
+	pb "github.com/square/quotaservice/protos/config"
+)
+
+// SignatureError is returned when a config's signature can't be verified, because it is unsigned,
+// signed by an untrusted key, or was altered after being signed.
+type SignatureError struct {
+	Version int32
+	KeyID   string
+	Reason  string
+}
+
+func (e *SignatureError) Error() string {
+	return fmt.Sprintf("config version %v signed by key %q: %v", e.Version, e.KeyID, e.Reason)
+}
+
+// Signer signs configs with an Ed25519 private key.
+type Signer struct {
+	keyID string
+	key   ed25519.PrivateKey
+}
+
+// NewSigner creates a Signer with a private key, identified by keyID in the configs it signs so
+// verifiers can tell which public key to verify them with.
+func NewSigner(keyID string, key ed25519.PrivateKey) *Signer {
+	if len(key) != ed25519.PrivateKeySize {
+		panic(fmt.Sprintf("Ed25519 private keys are %v bytes, got %v", ed25519.PrivateKeySize, len(key)))
+	}
+
+	return &Signer{keyID: keyID, key: key}
+}
+
+// Sign sets the signature fields of a config.
+func (s *Signer) Sign(cfg *pb.ServiceConfig) error {
+	return s.sign(cfg, nil)
+}
+
+// sign signs a config along with the unknown fields it will be persisted with, if any.
+func (s *Signer) sign(cfg *pb.ServiceConfig, unknown *UnknownFields) error {
+	b, err := signedBytes(cfg, unknown)
+	if err != nil {
+		return err
+	}
+
+	cfg.Signature = ed25519.Sign(s.key, b)
+	cfg.SignatureKeyId = s.keyID
+	return nil
+}
+
+// Verifier verifies configs were signed by a trusted key. Trusting several keys allows rotating
+// keys: configs signed by the old key still verify once the new key signs new ones.
+type Verifier struct {
+	keys map[string]ed25519.PublicKey
+}
+
+// NewVerifier creates a Verifier trusting public keys, keyed by the IDs of their Signers.
+func NewVerifier(keys map[string]ed25519.PublicKey) *Verifier {
+	trusted := make(map[string]ed25519.PublicKey, len(keys))
+	for id, key := range keys {
+		if len(key) != ed25519.PublicKeySize {
+			panic(fmt.Sprintf("Ed25519 public key %v is %v bytes, expected %v", id, len(key), ed25519.PublicKeySize))
+		}
+
+		trusted[id] = key
+	}
+
+	return &Verifier{keys: trusted}
+}
+
+// Verify returns a *SignatureError unless a config was signed by a trusted key and is unchanged
+// since.
+func (v *Verifier) Verify(cfg *pb.ServiceConfig) error {
+	return v.verify(cfg, nil)
+}
+
+// verify is Verify for a config read along with fields unknown to this schema, if any. Configs
+// signed by versions knowing those fields were signed along with them, unlike historical configs
+// persisted before the fields were, so configs are tried without them first.
+func (v *Verifier) verify(cfg *pb.ServiceConfig, unknown *UnknownFields) error {
+	sigErr := &SignatureError{Version: cfg.Version, KeyID: cfg.SignatureKeyId}
+
+	if len(cfg.Signature) == 0 {
+		sigErr.Reason = "config is not signed"
+		return sigErr
+	}
+
+	key, ok := v.keys[cfg.SignatureKeyId]
+	if !ok {
+		sigErr.Reason = "key is not trusted"
+		return sigErr
+	}
+
+	b, err := signedBytes(cfg, nil)
+	if err != nil {
+		return err
+	}
+
+	if ed25519.Verify(key, b, cfg.Signature) {
+		return nil
+	}
+
+	if unknown != nil {
+		if b, err = signedBytes(cfg, unknown); err != nil {
+			return err
+		}
+
+		if ed25519.Verify(key, b, cfg.Signature) {
+			return nil
+		}
+	}
+
+	sigErr.Reason = "signature does not match the config"
+	return sigErr
+}
+
+// signedBytes returns the bytes of a config that are signed: the config marshalled without its
+// signature fields, deterministically so the bytes can be reproduced on verification. The unknown
+// fields it is persisted with, if any, are merged in, as a version of the schema knowing them
+// marshals them, so configs signed by newer versions verify on older ones, and the reverse.
+func signedBytes(cfg *pb.ServiceConfig, unknown *UnknownFields) ([]byte, error) {
+	unsigned := CloneConfig(cfg)
+	unsigned.Signature = nil
+	unsigned.SignatureKeyId = ""
+
+	if unknown != nil {
+		return unknown.Marshal(unsigned)
+	}
+
+	return marshalDeterministic(unsigned)
+}
+
+// SigningPersister is a ConfigPersister that signs the configs it persists with a Signer, and
+// refuses to read configs that don't verify with a Verifier, returning a *SignatureError instead.
+// Historical configs that don't verify are left out, so they can't be rolled back to.
+type SigningPersister struct {
+	ConfigPersister
+	signer   *Signer
+	verifier *Verifier
+}
+
+// NewSigningPersister wraps a ConfigPersister. Nodes that only read configs may have a nil signer,
+// in which case persisting fails.
+func NewSigningPersister(p ConfigPersister, signer *Signer, verifier *Verifier) *SigningPersister {
+	if verifier == nil {
+		panic("verifier was nil")
+	}
+
+	return &SigningPersister{ConfigPersister: p, signer: signer, verifier: verifier}
+}
+
+// unknownFields returns the unknown fields kept by the wrapped persister, if it is an
+// UnknownFieldsKeeper, which it merges into the configs it persists.
+func (s *SigningPersister) unknownFields() *UnknownFields {
+	if k, ok := s.ConfigPersister.(UnknownFieldsKeeper); ok {
+		return k.UnknownFields()
+	}
+
+	return nil
+}
+
+func (s *SigningPersister) sign(cfg *pb.ServiceConfig) (*pb.ServiceConfig, error) {
+	if s.signer == nil {
+		return nil, errors.New("no signer configured, so configs can't be persisted")
+	}
+
+	signed := CloneConfig(cfg)
+	if err := s.signer.sign(signed, s.unknownFields()); err != nil {
+		return nil, err
+	}
+
+	return signed, nil
+}
+
+// PersistAndNotify signs and persists a configuration passed in.
+func (s *SigningPersister) PersistAndNotify(oldHash string, cfg *pb.ServiceConfig) error {
+	signed, err := s.sign(cfg)
+	if err != nil {
+		return err
+	}
+
+	return s.ConfigPersister.PersistAndNotify(oldHash, signed)
+}
+
+// PersistAndNotifyV signs and persists a configuration passed in, returning the version persisted
+// as reported by the wrapped persister.
+func (s *SigningPersister) PersistAndNotifyV(oldHash string, cfg *pb.ServiceConfig) (int32, error) {
+	signed, err := s.sign(cfg)
+	if err != nil {
+		return 0, err
+	}
+
+	return PersistAndNotifyV(s.ConfigPersister, oldHash, signed)
+}
+
+// PersistAndNotifyWithMeta signs and persists a configuration passed in, storing meta with it if
+// the wrapped persister is a MetaPersister.
+func (s *SigningPersister) PersistAndNotifyWithMeta(oldHash string, cfg *pb.ServiceConfig, meta *PersistMeta) error {
+	signed, err := s.sign(cfg)
+	if err != nil {
+		return err
+	}
+
+	_, err = PersistAndNotifyWithMeta(s.ConfigPersister, oldHash, signed, meta)
+	return err
+}
+
+// PersistIfLatest signs and persists a configuration passed in. The version is only checked if the
+// wrapped persister is a ConditionalPersister.
+func (s *SigningPersister) PersistIfLatest(expectedVersion int, cfg *pb.ServiceConfig) error {
+	signed, err := s.sign(cfg)
+	if err != nil {
+		return err
+	}
+
+	if p, ok := s.ConfigPersister.(ConditionalPersister); ok {
+		return p.PersistIfLatest(expectedVersion, signed)
+	}
+
+	return s.ConfigPersister.PersistAndNotify("", signed)
+}
+
+// ReadPersistedConfig provides a config previously persisted, if its signature verifies.
+func (s *SigningPersister) ReadPersistedConfig() (*pb.ServiceConfig, error) {
+	cfg, err := s.ConfigPersister.ReadPersistedConfig()
+	if err != nil || cfg == nil {
+		return cfg, err
+	}
+
+	if err := s.verifier.verify(cfg, s.unknownFields()); err != nil {
+		logging.Error("Refusing config that failed signature verification", "version", cfg.Version, "error", err)
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// ReadHistoricalConfigs returns the previously persisted configs whose signatures verify.
+func (s *SigningPersister) ReadHistoricalConfigs() ([]*pb.ServiceConfig, error) {
+	cfgs, err := s.ConfigPersister.ReadHistoricalConfigs()
+	if err != nil {
+		return nil, err
+	}
+
+	verified := make([]*pb.ServiceConfig, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		if cfg == nil {
+			continue
+		}
+
+		if err := s.verifier.verify(cfg, s.unknownFields()); err != nil {
+			logging.Warn("Leaving out historical config that failed signature verification", "version", cfg.Version, "error", err)
+			continue
+		}
+
+		verified = append(verified, cfg)
+	}
+
+	return verified, nil
+}
+
+// OnReloadFailure forwards to the wrapped persister, if it is a ReloadFailureReporter.
+func (s *SigningPersister) OnReloadFailure(f func(version int32, err error)) {
+	if r, ok := s.ConfigPersister.(ReloadFailureReporter); ok {
+		r.OnReloadFailure(f)
+	}
+}
+
+// LastPolled forwards to the wrapped persister, returning the zero time if it isn't a PollReporter.
+func (s *SigningPersister) LastPolled() time.Time {
+	if r, ok := s.ConfigPersister.(PollReporter); ok {
+		return r.LastPolled()
+	}
+
+	return time.Time{}
+}
+
+// LastError forwards to the wrapped persister, returning nil if it isn't a LastErrorReporter.
+func (s *SigningPersister) LastError() (error, time.Time) {
+	if r, ok := s.ConfigPersister.(LastErrorReporter); ok {
+		return r.LastError()
+	}
+
+	return nil, time.Time{}
+}
+
+// LatestVersion forwards to the wrapped persister, returning -1 if it isn't a LatestVersionReporter.
+func (s *SigningPersister) LatestVersion() (int32, time.Time) {
+	if r, ok := s.ConfigPersister.(LatestVersionReporter); ok {
+		return r.LatestVersion()
+	}
+
+	return -1, time.Time{}
+}
+
+// ForcePoll forwards to the wrapped persister, returning false if it isn't a ForcePoller.
+func (s *SigningPersister) ForcePoll() (bool, error) {
+	if p, ok := s.ConfigPersister.(ForcePoller); ok {
+		return p.ForcePoll()
+	}
+
+	return false, nil
+}
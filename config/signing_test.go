@@ -0,0 +1,182 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package config
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/square/quotaservice/protos/config"
+	"github.com/square/quotaservice/test/helpers"
+)
+
+func newTestSigner(t *testing.T, keyID string) (*Signer, ed25519.PublicKey) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	helpers.CheckError(t, err)
+
+	return NewSigner(keyID, private), public
+}
+
+func signedTestConfig(version int32) *pb.ServiceConfig {
+	cfg := NewDefaultServiceConfig()
+	cfg.Version = version
+	nsc := NewDefaultNamespaceConfig("ns")
+	_ = AddBucket(nsc, NewDefaultBucketConfig("b"))
+	_ = AddNamespace(cfg, nsc)
+
+	return cfg
+}
+
+func TestSigningPersister(t *testing.T) {
+	signer, public := newTestSigner(t, "k1")
+	store := NewMemoryConfigPersister()
+	p := NewSigningPersister(store, signer, NewVerifier(map[string]ed25519.PublicKey{"k1": public}))
+
+	helpers.CheckError(t, p.PersistAndNotify("", signedTestConfig(1)))
+
+	stored, err := store.ReadPersistedConfig()
+	helpers.CheckError(t, err)
+	if len(stored.Signature) == 0 || stored.SignatureKeyId != "k1" {
+		t.Fatalf("Expected the config to be stored with its signature, got %+v", stored)
+	}
+
+	cfg, err := p.ReadPersistedConfig()
+	helpers.CheckError(t, err)
+	if cfg.Version != 1 {
+		t.Errorf("Expected version 1, got %+v", cfg)
+	}
+
+	// Tamper with the stored config.
+	stored.Version = 2
+	stored.Namespaces["ns"].Buckets["b"].Size = 1000000
+	helpers.CheckError(t, store.PersistAndNotify("", stored))
+
+	if _, err := p.ReadPersistedConfig(); err == nil {
+		t.Fatal("Expected a tampered config to be refused")
+	} else if sigErr, ok := err.(*SignatureError); !ok || sigErr.Version != 2 {
+		t.Errorf("Expected a SignatureError for version 2, got %v", err)
+	}
+
+	cfgs, err := p.ReadHistoricalConfigs()
+	helpers.CheckError(t, err)
+	if len(cfgs) != 1 || cfgs[0].Version != 1 {
+		t.Errorf("Expected only the valid historical config, got %+v", cfgs)
+	}
+}
+
+func TestSigningPersisterWrongKey(t *testing.T) {
+	trusted, public := newTestSigner(t, "k1")
+	untrusted, _ := newTestSigner(t, "k1")
+	store := NewMemoryConfigPersister()
+	verifier := NewVerifier(map[string]ed25519.PublicKey{"k1": public})
+
+	// Signed with a key claiming a trusted ID.
+	helpers.CheckError(t, NewSigningPersister(store, untrusted, verifier).PersistAndNotify("", signedTestConfig(1)))
+	if _, err := NewSigningPersister(store, trusted, verifier).ReadPersistedConfig(); err == nil {
+		t.Error("Expected a config signed with the wrong key to be refused")
+	}
+
+	// Signed with an untrusted key ID.
+	other, _ := newTestSigner(t, "k2")
+	helpers.CheckError(t, NewSigningPersister(store, other, verifier).PersistAndNotify("", signedTestConfig(2)))
+	if _, err := NewSigningPersister(store, trusted, verifier).ReadPersistedConfig(); err == nil {
+		t.Error("Expected a config signed with an untrusted key to be refused")
+	}
+
+	// Unsigned.
+	helpers.CheckError(t, store.PersistAndNotify("", signedTestConfig(3)))
+	if _, err := NewSigningPersister(store, trusted, verifier).ReadPersistedConfig(); err == nil {
+		t.Error("Expected an unsigned config to be refused")
+	}
+}
+
+func TestSigningPersisterKeyRotation(t *testing.T) {
+	oldSigner, oldPublic := newTestSigner(t, "2017")
+	newSigner, newPublic := newTestSigner(t, "2018")
+	store := NewMemoryConfigPersister()
+	verifier := NewVerifier(map[string]ed25519.PublicKey{"2017": oldPublic, "2018": newPublic})
+
+	helpers.CheckError(t, NewSigningPersister(store, oldSigner, verifier).PersistAndNotify("", signedTestConfig(1)))
+	p := NewSigningPersister(store, newSigner, verifier)
+	helpers.CheckError(t, p.PersistAndNotify("", signedTestConfig(2)))
+
+	cfg, err := p.ReadPersistedConfig()
+	helpers.CheckError(t, err)
+	if cfg.Version != 2 || cfg.SignatureKeyId != "2018" {
+		t.Errorf("Expected version 2 signed by the new key, got %+v", cfg)
+	}
+
+	cfgs, err := p.ReadHistoricalConfigs()
+	helpers.CheckError(t, err)
+	if len(cfgs) != 2 {
+		t.Errorf("Expected configs signed by either key to verify, got %+v", cfgs)
+	}
+}
+
+func TestSigningPersisterUnknownFields(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qs_test_signing")
+	helpers.CheckError(t, err)
+	defer os.RemoveAll(dir)
+
+	location := filepath.Join(dir, "config")
+	disk, err := NewDiskConfigPersister(location)
+	helpers.CheckError(t, err)
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	helpers.CheckError(t, err)
+	p := NewSigningPersister(disk, NewSigner("k1", private), NewVerifier(map[string]ed25519.PublicKey{"k1": public}))
+
+	// Signed and written by a newer version, with a field this schema lacks, which it marshals after
+	// the signature fields.
+	cfg := signedTestConfig(1)
+	unsigned, err := marshalDeterministic(cfg)
+	helpers.CheckError(t, err)
+	cfg.Signature = ed25519.Sign(private, withUnknownField(t, unsigned, "newer config field"))
+	cfg.SignatureKeyId = "k1"
+	signed, err := marshalDeterministic(cfg)
+	helpers.CheckError(t, err)
+	helpers.CheckError(t, ioutil.WriteFile(location, withUnknownField(t, signed, "newer config field"), 0644))
+
+	// Verified by this version along with the field it doesn't know.
+	read, err := p.ReadPersistedConfig()
+	helpers.CheckError(t, err)
+
+	// Changed and signed by this version, which the newer version verifies with the field it knows.
+	read.Version++
+	helpers.CheckError(t, p.PersistAndNotify("", read))
+
+	persisted, err := ioutil.ReadFile(location)
+	helpers.CheckError(t, err)
+
+	reread, err := p.ReadPersistedConfig()
+	helpers.CheckError(t, err)
+
+	unsignedReread := CloneConfig(reread)
+	unsignedReread.Signature = nil
+	unsignedReread.SignatureKeyId = ""
+	unsigned, err = marshalDeterministic(unsignedReread)
+	helpers.CheckError(t, err)
+
+	if !bytes.Contains(persisted, []byte("newer config field")) {
+		t.Fatalf("Expected the newer field to survive a re-persist, got %q", persisted)
+	}
+
+	if !ed25519.Verify(public, withUnknownField(t, unsigned, "newer config field"), reread.Signature) {
+		t.Error("Expected the config signed by this version to verify with the newer field")
+	}
+}
+
+func TestSigningPersisterWithoutSigner(t *testing.T) {
+	_, public := newTestSigner(t, "k1")
+	p := NewSigningPersister(NewMemoryConfigPersister(), nil, NewVerifier(map[string]ed25519.PublicKey{"k1": public}))
+
+	if err := p.PersistAndNotify("", signedTestConfig(1)); err == nil {
+		t.Error("Expected persisting without a signer to fail")
+	}
+}
@@ -0,0 +1,183 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/square/quotaservice/protos/config"
+)
+
+var (
+	// ErrUnknownTemplate is returned when changing a template that doesn't exist.
+	ErrUnknownTemplate = errors.New("no such template")
+	// ErrTemplateExists is returned when creating a template with the name of an existing one.
+	ErrTemplateExists = errors.New("template already exists")
+)
+
+// TemplateInUseError is returned when deleting a template buckets are still created from.
+type TemplateInUseError struct {
+	Template string
+	// References are the fully qualified names of the buckets created from the template.
+	References []string
+}
+
+func (t *TemplateInUseError) Error() string {
+	return fmt.Sprintf("template %v is used by %v", t.Template, strings.Join(t.References, ", "))
+}
+
+// CreateTemplate adds a template to a config, returning ErrTemplateExists if it has one of the same
+// name, or ValidationErrors if the template is invalid.
+func CreateTemplate(clonedCfg *pb.ServiceConfig, t *pb.BucketConfig) error {
+	if clonedCfg.Templates[t.Name] != nil {
+		return ErrTemplateExists
+	}
+
+	return setTemplate(clonedCfg, t)
+}
+
+// UpdateTemplate replaces a template of a config, returning ErrUnknownTemplate if it has no template
+// of the same name, or ValidationErrors if the template is invalid.
+func UpdateTemplate(clonedCfg *pb.ServiceConfig, t *pb.BucketConfig) error {
+	if clonedCfg.Templates[t.Name] == nil {
+		return ErrUnknownTemplate
+	}
+
+	return setTemplate(clonedCfg, t)
+}
+
+func setTemplate(clonedCfg *pb.ServiceConfig, t *pb.BucketConfig) error {
+	var errs ValidationErrors
+	validateTemplate(&errs, t.Name, t)
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	if clonedCfg.Templates == nil {
+		clonedCfg.Templates = make(map[string]*pb.BucketConfig)
+	}
+
+	clonedCfg.Templates[t.Name] = t
+	return nil
+}
+
+// DeleteTemplate removes a template from a config, returning ErrUnknownTemplate if it has no such
+// template, or a TemplateInUseError if buckets are still created from it.
+func DeleteTemplate(clonedCfg *pb.ServiceConfig, name string) error {
+	if clonedCfg.Templates[name] == nil {
+		return ErrUnknownTemplate
+	}
+
+	if refs := TemplateReferences(clonedCfg, name); len(refs) > 0 {
+		return &TemplateInUseError{name, refs}
+	}
+
+	delete(clonedCfg.Templates, name)
+	return nil
+}
+
+// TemplateReferences returns the fully qualified names of the buckets of a config created from a
+// template, sorted.
+func TemplateReferences(cfg *pb.ServiceConfig, name string) []string {
+	var refs []string
+	visitBuckets(cfg, func(field, namespace, bucketName string, b *pb.BucketConfig) {
+		if b.Template == name {
+			refs = append(refs, FullyQualifiedName(namespace, bucketName))
+		}
+	})
+
+	sort.Strings(refs)
+	return refs
+}
+
+// ResolveTemplates returns a copy of a config with each bucket created from a template replaced by
+// the template, overridden by the fields the bucket sets. Buckets created from templates the config
+// doesn't have are left as they are. Returns cfg itself if it has no templates.
+func ResolveTemplates(cfg *pb.ServiceConfig) *pb.ServiceConfig {
+	if cfg == nil || len(cfg.Templates) == 0 {
+		return cfg
+	}
+
+	resolved := CloneConfig(cfg)
+	visitBuckets(resolved, func(field, namespace, bucketName string, b *pb.BucketConfig) {
+		if t := resolved.Templates[b.Template]; t != nil {
+			*b = *resolveTemplate(t, b)
+		}
+	})
+
+	return resolved
+}
+
+// resolveTemplate returns a copy of a template, overridden by the fields b sets and carrying its
+// name, namespace, canary and whether it is the catch-all.
+func resolveTemplate(template, b *pb.BucketConfig) *pb.BucketConfig {
+	resolved := proto.Clone(template).(*pb.BucketConfig)
+	applyOverrides(resolved, b)
+
+	resolved.Name = b.Name
+	resolved.Namespace = b.Namespace
+	resolved.Template = b.Template
+	resolved.CatchAll = b.CatchAll
+
+	if b.Canary != nil {
+		resolved.Canary = b.Canary
+		resolved.CanaryPercent = b.CanaryPercent
+	}
+
+	return resolved
+}
+
+// visitBuckets calls fn with every bucket config of a config, including global and namespace
+// defaults, dynamic bucket templates and namespace limits, along with the path to its field, in a
+// stable order.
+func visitBuckets(cfg *pb.ServiceConfig, fn func(field, namespace, bucketName string, b *pb.BucketConfig)) {
+	if cfg.GlobalDefaultBucket != nil {
+		fn("global_default_bucket", GlobalNamespace, DefaultBucketName, cfg.GlobalDefaultBucket)
+	}
+
+	names := NamespaceNames(cfg)
+	sort.Strings(names)
+
+	for _, name := range names {
+		ns := cfg.Namespaces[name]
+		if ns == nil {
+			continue
+		}
+
+		field := "namespaces." + name
+		singletons := []struct {
+			field string
+			name  string
+			b     *pb.BucketConfig
+		}{
+			{".default_bucket", DefaultBucketName, ns.DefaultBucket},
+			{".dynamic_bucket_template", DynamicBucketTemplateName, ns.DynamicBucketTemplate},
+			{".namespace_limit", NamespaceLimitBucketName, ns.NamespaceLimit},
+		}
+
+		for _, s := range singletons {
+			if s.b != nil {
+				fn(field+s.field, name, s.name, s.b)
+			}
+		}
+
+		bucketNames := make([]string, 0, len(ns.Buckets))
+		for n := range ns.Buckets {
+			bucketNames = append(bucketNames, n)
+		}
+
+		sort.Strings(bucketNames)
+
+		for _, n := range bucketNames {
+			if b := ns.Buckets[n]; b != nil {
+				fn(field+".buckets."+n, name, n, b)
+			}
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package config
+
+import (
+	"reflect"
+	"testing"
+
+	pb "github.com/square/quotaservice/protos/config"
+)
+
+func newTemplatedConfig() *pb.ServiceConfig {
+	cfg := NewDefaultServiceConfig()
+	cfg.Templates = map[string]*pb.BucketConfig{
+		"standard": {Size: 50, FillRate: 10, Labels: map[string]string{"tier": "standard"}}}
+
+	ns := NewDefaultNamespaceConfig("foo")
+	ns.Buckets["bar"] = &pb.BucketConfig{Template: "standard", FillRate: 20}
+	ns.Buckets["baz"] = NewDefaultBucketConfig("baz")
+	ns.DefaultBucket = &pb.BucketConfig{Template: "standard"}
+	cfg.Namespaces["foo"] = ns
+
+	ApplyDefaults(cfg)
+	return cfg
+}
+
+func TestResolveTemplates(t *testing.T) {
+	cfg := newTemplatedConfig()
+
+	if b := cfg.Namespaces["foo"].Buckets["bar"]; b.Size != 0 || b.WaitTimeoutMillis != 0 {
+		t.Fatalf("Expected defaults not to be applied to a bucket created from a template, got %+v", b)
+	}
+
+	resolved := ResolveTemplates(cfg)
+	if resolved == cfg || cfg.Namespaces["foo"].Buckets["bar"].Size != 0 {
+		t.Fatal("Expected the config to be resolved on a copy")
+	}
+
+	bar := resolved.Namespaces["foo"].Buckets["bar"]
+	if bar.Size != 50 || bar.FillRate != 20 || bar.Name != "bar" || bar.Namespace != "foo" ||
+		bar.Template != "standard" || bar.Labels["tier"] != "standard" {
+		t.Errorf("Expected bar to override the template's fill rate, got %+v", bar)
+	}
+
+	// Fields unset on the template have defaults.
+	if bar.WaitTimeoutMillis != NewDefaultBucketConfig("").WaitTimeoutMillis {
+		t.Errorf("Expected bar to have the default wait timeout, got %+v", bar)
+	}
+
+	if d := resolved.Namespaces["foo"].DefaultBucket; d.Size != 50 || d.Name != DefaultBucketName {
+		t.Errorf("Expected the default bucket to be created from the template, got %+v", d)
+	}
+
+	if baz := resolved.Namespaces["foo"].Buckets["baz"]; DifferentBucketConfigs(baz, cfg.Namespaces["foo"].Buckets["baz"]) {
+		t.Errorf("Expected baz to be left as it is, got %+v", baz)
+	}
+
+	cfg.Namespaces["foo"].Buckets["bar"].CatchAll = true
+	if !ResolveTemplates(cfg).Namespaces["foo"].Buckets["bar"].CatchAll {
+		t.Error("Expected bar to remain the catch-all once resolved")
+	}
+
+	untemplated := NewDefaultServiceConfig()
+	if ResolveTemplates(untemplated) != untemplated {
+		t.Error("Expected a config without templates to be left as it is")
+	}
+}
+
+func TestTemplateMutations(t *testing.T) {
+	cfg := newTemplatedConfig()
+
+	if err := CreateTemplate(cfg, &pb.BucketConfig{Name: "standard"}); err != ErrTemplateExists {
+		t.Errorf("Expected ErrTemplateExists, got %v", err)
+	}
+
+	if err := UpdateTemplate(cfg, &pb.BucketConfig{Name: "premium"}); err != ErrUnknownTemplate {
+		t.Errorf("Expected ErrUnknownTemplate, got %v", err)
+	}
+
+	err := CreateTemplate(cfg, &pb.BucketConfig{Name: "premium", Size: -1})
+	if _, ok := err.(ValidationErrors); !ok {
+		t.Errorf("Expected a template with a negative size to be invalid, got %v", err)
+	}
+
+	if err := CreateTemplate(cfg, &pb.BucketConfig{Name: "premium", Size: 500}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := UpdateTemplate(cfg, &pb.BucketConfig{Name: "premium", Size: 1000}); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Templates["premium"].Size != 1000 {
+		t.Errorf("Expected the template to be updated, got %+v", cfg.Templates["premium"])
+	}
+
+	if err := DeleteTemplate(cfg, "premium"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DeleteTemplate(cfg, "premium"); err != ErrUnknownTemplate {
+		t.Errorf("Expected ErrUnknownTemplate, got %v", err)
+	}
+}
+
+func TestDeleteTemplateInUse(t *testing.T) {
+	cfg := newTemplatedConfig()
+
+	err := DeleteTemplate(cfg, "standard")
+	inUse, ok := err.(*TemplateInUseError)
+	if !ok {
+		t.Fatalf("Expected a TemplateInUseError, got %v", err)
+	}
+
+	expected := []string{
+		FullyQualifiedName("foo", DefaultBucketName),
+		FullyQualifiedName("foo", "bar")}
+	if !reflect.DeepEqual(inUse.References, expected) {
+		t.Errorf("Expected the template to be used by %v, got %v", expected, inUse.References)
+	}
+
+	if cfg.Templates["standard"] == nil {
+		t.Fatal("Expected a template in use not to be deleted")
+	}
+
+	// Once no bucket uses it, it may be deleted.
+	delete(cfg.Namespaces["foo"].Buckets, "bar")
+	cfg.Namespaces["foo"].DefaultBucket = nil
+
+	if err := DeleteTemplate(cfg, "standard"); err != nil {
+		t.Fatalf("Expected an unused template to be deleted, got %v", err)
+	}
+}
+
+func TestValidateTemplates(t *testing.T) {
+	cfg := newTemplatedConfig()
+	if err := Validate(cfg); err != nil {
+		t.Fatalf("Expected config to be valid, got %v", err)
+	}
+
+	cfg.Templates["chained"] = &pb.BucketConfig{Template: "standard"}
+	cfg.Templates["negative"] = &pb.BucketConfig{FillRate: -1}
+	cfg.Namespaces["foo"].Buckets["missing"] = &pb.BucketConfig{Template: "nope"}
+	// Ramps are validated on the bucket as created from its template.
+	cfg.Templates["standard"].RampStartFillRate = 5
+	cfg.Namespaces["foo"].Buckets["bar"].RampDurationMillis = 1000
+
+	errs, ok := Validate(cfg).(ValidationErrors)
+	if !ok {
+		t.Fatalf("Expected ValidationErrors, got %v", errs)
+	}
+
+	fields := make(map[string]bool)
+	for _, e := range errs {
+		fields[e.Field] = true
+	}
+
+	for _, f := range []string{
+		"templates.chained.template",
+		"templates.negative.fill_rate",
+		"namespaces.foo.buckets.missing.template",
+	} {
+		if !fields[f] {
+			t.Errorf("Expected a validation error for %v, got %v", f, errs)
+		}
+	}
+
+	if fields["namespaces.foo.buckets.bar.ramp_start_fill_rate"] {
+		t.Errorf("Expected bar to ramp from the template's start fill rate, got %v", errs)
+	}
+}
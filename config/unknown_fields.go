@@ -0,0 +1,329 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package config
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/square/quotaservice/protos/config"
+)
+
+var errMalformedConfig = errors.New("malformed config")
+
+// UnknownFields keeps the fields, unknown to this schema, of the latest config a persister read, to
+// merge them back into the configs it writes. While servers are upgraded, newer ones may persist
+// fields older ones don't know, which would otherwise be stripped from the store when an older
+// server persists a change. Fields are kept in place: those of a bucket are merged back into the
+// bucket of the same name, if it still exists. The generated config types don't keep unknown
+// fields themselves, so persisters observe the bytes they read and merge into those they write.
+type UnknownFields struct {
+	fields *unknownNode
+	sync.Mutex
+}
+
+// Observe records the unknown fields of a marshalled config read from the store, replacing those
+// of the config read before.
+func (u *UnknownFields) Observe(b []byte) {
+	fields, err := parseUnknown(b, serviceConfigType)
+	if err != nil {
+		// Unmarshalling the config reports it.
+		return
+	}
+
+	u.Lock()
+	u.fields = fields
+	u.Unlock()
+}
+
+// Marshal marshals a config deterministically, merging in the unknown fields last observed.
+func (u *UnknownFields) Marshal(cfg *pb.ServiceConfig) ([]byte, error) {
+	b, err := marshalDeterministic(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	u.Lock()
+	fields := u.fields
+	u.Unlock()
+
+	if fields == nil {
+		return b, nil
+	}
+
+	return mergeUnknown(b, serviceConfigType, fields)
+}
+
+var serviceConfigType = reflect.TypeOf(pb.ServiceConfig{})
+
+// unknownNode holds the unknown fields of a message, as on the wire, and those of the messages
+// nested in it that have any.
+type unknownNode struct {
+	fields   []byte
+	children map[childKey]*unknownNode
+}
+
+// child returns the node of a nested message, or nil if it has no unknown fields.
+func (n *unknownNode) child(k childKey) *unknownNode {
+	if n == nil {
+		return nil
+	}
+
+	return n.children[k]
+}
+
+// childKey locates a nested message by field number and by map key or repeated index, if any.
+type childKey struct {
+	field int32
+	key   string
+}
+
+// fieldInfo describes a field of a message, as far as finding unknown fields needs.
+type fieldInfo struct {
+	// message is the struct type of the message held, nil for scalars.
+	message  reflect.Type
+	isMap    bool
+	repeated bool
+}
+
+var fieldInfos sync.Map // reflect.Type -> map[int32]fieldInfo
+
+// messageFields returns the fields of a generated message type by number, from their struct tags.
+func messageFields(t reflect.Type) map[int32]fieldInfo {
+	if cached, ok := fieldInfos.Load(t); ok {
+		return cached.(map[int32]fieldInfo)
+	}
+
+	fields := make(map[int32]fieldInfo)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		parts := strings.Split(f.Tag.Get("protobuf"), ",")
+		if len(parts) < 3 {
+			continue
+		}
+
+		n, err := strconv.Atoi(parts[1])
+		if err != nil {
+			continue
+		}
+
+		info := fieldInfo{repeated: parts[2] == "rep"}
+		elem := f.Type
+		switch elem.Kind() {
+		case reflect.Map:
+			info.isMap = true
+			elem = elem.Elem()
+		case reflect.Slice:
+			elem = elem.Elem()
+		}
+
+		if elem.Kind() == reflect.Ptr && elem.Elem().Kind() == reflect.Struct {
+			info.message = elem.Elem()
+		}
+
+		fields[int32(n)] = info
+	}
+
+	fieldInfos.Store(t, fields)
+	return fields
+}
+
+// wireField is a field read off the wire.
+type wireField struct {
+	number int32
+	// raw is the whole field, tag included, and payload the contents of a length-delimited one.
+	raw, payload []byte
+}
+
+// readFields splits a marshalled message into its fields.
+func readFields(b []byte) ([]wireField, error) {
+	var fields []wireField
+	for i := 0; i < len(b); {
+		start := i
+		tag, n := binary.Uvarint(b[i:])
+		if n <= 0 {
+			return nil, errMalformedConfig
+		}
+		i += n
+
+		f := wireField{number: int32(tag >> 3)}
+		switch tag & 7 {
+		case proto.WireVarint:
+			if _, n = binary.Uvarint(b[i:]); n <= 0 {
+				return nil, errMalformedConfig
+			}
+			i += n
+		case proto.WireFixed64:
+			i += 8
+		case proto.WireFixed32:
+			i += 4
+		case proto.WireBytes:
+			l, n := binary.Uvarint(b[i:])
+			if n <= 0 || l > uint64(len(b)-i-n) {
+				return nil, errMalformedConfig
+			}
+			i += n
+			f.payload = b[i : i+int(l)]
+			i += int(l)
+		default:
+			// Groups are deprecated, and not used by configs.
+			return nil, errMalformedConfig
+		}
+
+		if i > len(b) {
+			return nil, errMalformedConfig
+		}
+
+		f.raw = b[start:i]
+		fields = append(fields, f)
+	}
+
+	return fields, nil
+}
+
+// nestedMessages calls fn with the key and contents of each message nested in a marshalled
+// message of a type, and for map entries, the entry they are the value of.
+func nestedMessages(fields []wireField, known map[int32]fieldInfo, fn func(i int, k childKey, msg reflect.Type, payload []byte, entry []wireField) error) error {
+	indexes := make(map[int32]int)
+	for i, f := range fields {
+		info, ok := known[f.number]
+		if !ok || info.message == nil || f.payload == nil {
+			continue
+		}
+
+		k := childKey{field: f.number}
+		payload := f.payload
+		var entry []wireField
+
+		switch {
+		case info.isMap:
+			var err error
+			if entry, err = readFields(f.payload); err != nil {
+				return err
+			}
+
+			payload = nil
+			for _, e := range entry {
+				switch e.number {
+				case 1:
+					// Config maps have string keys; others are keyed by their encoding.
+					k.key = string(e.raw)
+					if e.payload != nil {
+						k.key = string(e.payload)
+					}
+				case 2:
+					payload = e.payload
+				}
+			}
+		case info.repeated:
+			k.key = strconv.Itoa(indexes[f.number])
+			indexes[f.number]++
+		}
+
+		if err := fn(i, k, info.message, payload, entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseUnknown returns the unknown fields of a marshalled message of a type, or nil if it has none.
+func parseUnknown(b []byte, t reflect.Type) (*unknownNode, error) {
+	fields, err := readFields(b)
+	if err != nil {
+		return nil, err
+	}
+
+	known := messageFields(t)
+	node := &unknownNode{}
+	for _, f := range fields {
+		if _, ok := known[f.number]; !ok {
+			node.fields = append(node.fields, f.raw...)
+		}
+	}
+
+	err = nestedMessages(fields, known, func(_ int, k childKey, msg reflect.Type, payload []byte, _ []wireField) error {
+		child, err := parseUnknown(payload, msg)
+		if child != nil {
+			if node.children == nil {
+				node.children = make(map[childKey]*unknownNode)
+			}
+
+			node.children[k] = child
+		}
+
+		return err
+	})
+
+	if err != nil || (node.fields == nil && node.children == nil) {
+		return nil, err
+	}
+
+	return node, nil
+}
+
+// mergeUnknown returns a marshalled message of a type with unknown fields merged in, appending
+// those of each message after its known fields.
+func mergeUnknown(b []byte, t reflect.Type, node *unknownNode) ([]byte, error) {
+	fields, err := readFields(b)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := make([][]byte, len(fields))
+	for i, f := range fields {
+		merged[i] = f.raw
+	}
+
+	err = nestedMessages(fields, messageFields(t), func(i int, k childKey, msg reflect.Type, payload []byte, entry []wireField) error {
+		child := node.child(k)
+		if child == nil {
+			return nil
+		}
+
+		value, err := mergeUnknown(payload, msg, child)
+		if err != nil {
+			return err
+		}
+
+		if entry == nil {
+			merged[i] = appendBytesField(nil, fields[i].number, value)
+			return nil
+		}
+
+		// Rebuild the map entry around the merged value, which may have been omitted if empty.
+		var e []byte
+		for _, ef := range entry {
+			if ef.number != 2 {
+				e = append(e, ef.raw...)
+			}
+		}
+
+		merged[i] = appendBytesField(nil, fields[i].number, appendBytesField(e, 2, value))
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	var out []byte
+	for _, m := range merged {
+		out = append(out, m...)
+	}
+
+	return append(out, node.fields...), nil
+}
+
+func appendBytesField(b []byte, number int32, value []byte) []byte {
+	b = append(b, proto.EncodeVarint(uint64(number)<<3|proto.WireBytes)...)
+	b = append(b, proto.EncodeVarint(uint64(len(value)))...)
+	return append(b, value...)
+}
@@ -0,0 +1,586 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/square/quotaservice/protos/config"
+)
+
+const (
+	// MaxBucketLabels is the number of labels a bucket may have.
+	MaxBucketLabels = 10
+	// MaxLabelLength is the length of the longest label name or value.
+	MaxLabelLength = 64
+)
+
+// maxFillRate is the highest rate buckets fill at, in tokens per second: a token per nanosecond.
+const maxFillRate = 1e9
+
+// labelName matches the label names allowed, which are valid metric label names.
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// ValidationError describes a single problem with a config.
+type ValidationError struct {
+	// Field is the path to the offending field, e.g. "namespaces.foo.buckets.bar.size".
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (v *ValidationError) Error() string {
+	return v.Field + ": " + v.Message
+}
+
+// ValidationErrors is returned by Validate, listing every problem found in a config.
+type ValidationErrors []*ValidationError
+
+func (v ValidationErrors) Error() string {
+	msgs := make([]string, len(v))
+	for i, e := range v {
+		msgs[i] = e.Error()
+	}
+
+	return "invalid config: " + strings.Join(msgs, "; ")
+}
+
+func (v *ValidationErrors) add(field, format string, args ...interface{}) {
+	*v = append(*v, &ValidationError{field, fmt.Sprintf(format, args...)})
+}
+
+// Validate checks a config for problems that would prevent it from being applied, returning nil or
+// ValidationErrors. Fields left zero are valid, since ApplyDefaults fills them in.
+func Validate(cfg *pb.ServiceConfig) error {
+	if cfg == nil {
+		return ValidationErrors{{"", "config is missing"}}
+	}
+
+	var errs ValidationErrors
+	validateTemplates(&errs, cfg)
+
+	// Buckets are validated as created from their templates.
+	cfg = ResolveTemplates(cfg)
+
+	if cfg.GlobalDefaultBucket != nil {
+		validateBucket(&errs, "global_default_bucket", cfg.GlobalDefaultBucket)
+	}
+
+	names := NamespaceNames(cfg)
+	sort.Strings(names)
+
+	for _, name := range names {
+		validateNamespace(&errs, name, cfg.Namespaces[name])
+	}
+
+	validateCatchAll(&errs, cfg)
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return errs
+}
+
+// Warnings returns ValidationErrors describing parts of a config that can be applied but are likely
+// mistakes, or nil if there are none: buckets filling faster than their size, so a second's worth of
+// tokens can't accumulate and bursts can't be absorbed. Invalid configs may not be described fully.
+func Warnings(cfg *pb.ServiceConfig) ValidationErrors {
+	if cfg == nil {
+		return nil
+	}
+
+	var warnings ValidationErrors
+	cfg = ResolveTemplates(cfg)
+
+	if cfg.GlobalDefaultBucket != nil {
+		warnBucket(&warnings, "global_default_bucket", cfg.GlobalDefaultBucket)
+	}
+
+	names := NamespaceNames(cfg)
+	sort.Strings(names)
+
+	for _, name := range names {
+		ns := cfg.Namespaces[name]
+		if ns == nil {
+			continue
+		}
+
+		field := "namespaces." + name
+		for _, b := range namespaceBuckets(ns) {
+			switch b.name {
+			case DefaultBucketName:
+				warnBucket(&warnings, field+".default_bucket", b.cfg)
+			case DynamicBucketTemplateName:
+				warnBucket(&warnings, field+".dynamic_bucket_template", b.cfg)
+			case NamespaceLimitBucketName:
+				warnBucket(&warnings, field+".namespace_limit", b.cfg)
+			default:
+				warnBucket(&warnings, field+".buckets."+b.name, b.cfg)
+			}
+		}
+	}
+
+	return warnings
+}
+
+func warnBucket(warnings *ValidationErrors, field string, b *pb.BucketConfig) {
+	effective := withDefaults(b)
+	if effective.FillRate > effective.Size {
+		warnings.add(field+".fill_rate", "fill rate %v is above the size of %v, so bursts can't be absorbed",
+			effective.FillRate, effective.Size)
+	}
+}
+
+// withDefaults returns a copy of a bucket, resolved from its template if any, with defaults applied
+// as they will be when it is created.
+func withDefaults(b *pb.BucketConfig) *pb.BucketConfig {
+	d := proto.Clone(b).(*pb.BucketConfig)
+	d.Template = ""
+	ApplyBucketDefaults(d)
+	return d
+}
+
+// ValidateBackends returns ValidationErrors if a namespace of a config selects a backend that isn't
+// one of backends, such as config.BackendRedis without a Redis connection configured. Nil backends
+// always pass, for services whose buckets are all held by a single backend.
+func ValidateBackends(cfg *pb.ServiceConfig, backends []string) error {
+	if cfg == nil || backends == nil {
+		return nil
+	}
+
+	configured := make(map[string]bool, len(backends))
+	for _, backend := range backends {
+		configured[backend] = true
+	}
+
+	var errs ValidationErrors
+
+	names := NamespaceNames(cfg)
+	sort.Strings(names)
+
+	for _, name := range names {
+		ns := cfg.Namespaces[name]
+		if ns == nil || ns.Backend == "" || configured[ns.Backend] {
+			continue
+		}
+
+		errs.add("namespaces."+name+".backend", "backend %v is not configured, only %v",
+			ns.Backend, strings.Join(backends, ", "))
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return errs
+}
+
+// ValidateTemplates returns ValidationErrors if a bucket of a config is created from a template it
+// doesn't have, or a template is invalid. Buckets created from a template aren't given defaults, so
+// would be applied with the fields they leave unset zero, such as their fill rate.
+func ValidateTemplates(cfg *pb.ServiceConfig) error {
+	if cfg == nil {
+		return nil
+	}
+
+	var errs ValidationErrors
+	validateTemplates(&errs, cfg)
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return errs
+}
+
+// validateTemplates checks the templates of a config, and that buckets are only created from
+// templates it has.
+func validateTemplates(errs *ValidationErrors, cfg *pb.ServiceConfig) {
+	names := make([]string, 0, len(cfg.Templates))
+	for name := range cfg.Templates {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		validateTemplate(errs, name, cfg.Templates[name])
+	}
+
+	visitBuckets(cfg, func(field, namespace, bucketName string, b *pb.BucketConfig) {
+		if b.Template != "" && cfg.Templates[b.Template] == nil {
+			errs.add(field+".template", "no such template %v", b.Template)
+		}
+	})
+}
+
+// validateTemplate checks a template against the same constraints as buckets.
+func validateTemplate(errs *ValidationErrors, name string, t *pb.BucketConfig) {
+	field := "templates." + name
+
+	if name == "" {
+		errs.add(field, "template name cannot be empty")
+	}
+
+	if t == nil {
+		errs.add(field, "template config is missing")
+		return
+	}
+
+	if t.Name != "" && t.Name != name {
+		errs.add(field+".name", "name %v does not match template key %v", t.Name, name)
+	}
+
+	if t.Template != "" {
+		errs.add(field+".template", "a template cannot be created from another template")
+	}
+
+	if t.CatchAll {
+		errs.add(field+".catch_all", "a template cannot be the catch-all")
+	}
+
+	validateBucket(errs, field, t)
+}
+
+// validateCatchAll checks that at most one bucket is the catch-all, and that it is a named bucket.
+func validateCatchAll(errs *ValidationErrors, cfg *pb.ServiceConfig) {
+	var catchAll string
+	visitBuckets(cfg, func(field, namespace, bucketName string, b *pb.BucketConfig) {
+		if !b.CatchAll {
+			return
+		}
+
+		switch {
+		case reservedBucket(namespace, bucketName):
+			errs.add(field+".catch_all", "only a named bucket can be the catch-all")
+		case catchAll != "":
+			errs.add(field+".catch_all", "only one bucket can be the catch-all, and %v already is", catchAll)
+		default:
+			catchAll = FullyQualifiedName(namespace, bucketName)
+		}
+	})
+}
+
+func validateNamespace(errs *ValidationErrors, name string, ns *pb.NamespaceConfig) {
+	field := "namespaces." + name
+
+	if name == "" {
+		errs.add(field, "namespace name cannot be empty")
+	}
+
+	if name == GlobalNamespace {
+		errs.add(field, "namespace name %v is reserved", GlobalNamespace)
+	}
+
+	if ns == nil {
+		errs.add(field, "namespace config is missing")
+		return
+	}
+
+	if ns.Name != "" && ns.Name != name {
+		errs.add(field+".name", "name %v does not match namespace key %v", ns.Name, name)
+	}
+
+	if ns.DefaultBucket != nil && ns.DynamicBucketTemplate != nil {
+		errs.add(field, "namespace cannot have both a default bucket and a dynamic bucket template")
+	}
+
+	if ns.MaxDynamicBuckets < 0 {
+		errs.add(field+".max_dynamic_buckets", "must not be negative")
+	}
+
+	switch ns.Backend {
+	case "", BackendRedis, BackendMemory:
+	default:
+		errs.add(field+".backend", "must be %v or %v, or unset for the default backend, was %v",
+			BackendRedis, BackendMemory, ns.Backend)
+	}
+
+	if ns.DefaultBucket != nil {
+		validateBucket(errs, field+".default_bucket", ns.DefaultBucket)
+	}
+
+	if ns.DynamicBucketTemplate != nil {
+		validateBucket(errs, field+".dynamic_bucket_template", ns.DynamicBucketTemplate)
+	}
+
+	if ns.NamespaceLimit != nil {
+		validateBucket(errs, field+".namespace_limit", ns.NamespaceLimit)
+	}
+
+	bucketNames := make([]string, 0, len(ns.Buckets))
+	for n := range ns.Buckets {
+		bucketNames = append(bucketNames, n)
+	}
+
+	sort.Strings(bucketNames)
+
+	for _, n := range bucketNames {
+		b := ns.Buckets[n]
+		bucketField := field + ".buckets." + n
+
+		switch n {
+		case "":
+			errs.add(bucketField, "bucket name cannot be empty")
+		case DefaultBucketName, DynamicBucketTemplateName, NamespaceLimitBucketName:
+			errs.add(bucketField, "bucket name %v is reserved", n)
+		}
+
+		if b == nil {
+			errs.add(bucketField, "bucket config is missing")
+			continue
+		}
+
+		if b.Name != "" && b.Name != n {
+			errs.add(bucketField+".name", "name %v does not match bucket key %v", b.Name, n)
+		}
+
+		validateBucket(errs, bucketField, b)
+	}
+
+	validateRequestCosts(errs, field, ns)
+	validateTokenScale(errs, field, ns)
+}
+
+// validateRequestCosts checks that the cost of every request kind is positive, and can be served by
+// every bucket of the namespace limiting the tokens per request.
+func validateRequestCosts(errs *ValidationErrors, field string, ns *pb.NamespaceConfig) {
+	kinds := make([]string, 0, len(ns.RequestCosts))
+	for kind := range ns.RequestCosts {
+		kinds = append(kinds, kind)
+	}
+
+	sort.Strings(kinds)
+	buckets := namespaceBuckets(ns)
+
+	for _, kind := range kinds {
+		cost := ns.RequestCosts[kind]
+		costField := field + ".request_costs." + kind
+
+		if kind == "" {
+			errs.add(costField, "request kind cannot be empty")
+		}
+
+		if cost < 1 {
+			errs.add(costField, "must be positive, was %v", cost)
+			continue
+		}
+
+		for _, b := range buckets {
+			if b.cfg.MaxTokensPerRequest > 0 && cost > b.cfg.MaxTokensPerRequest {
+				errs.add(costField, "cost %v exceeds max_tokens_per_request %v of bucket %v",
+					cost, b.cfg.MaxTokensPerRequest, b.name)
+			}
+		}
+	}
+}
+
+type namedBucket struct {
+	name string
+	cfg  *pb.BucketConfig
+}
+
+// namespaceBuckets returns the buckets of a namespace, including its default bucket, dynamic bucket
+// template and namespace limit, sorted by name.
+func namespaceBuckets(ns *pb.NamespaceConfig) []namedBucket {
+	buckets := make([]namedBucket, 0, len(ns.Buckets)+2)
+	if ns.DefaultBucket != nil {
+		buckets = append(buckets, namedBucket{DefaultBucketName, ns.DefaultBucket})
+	}
+
+	if ns.DynamicBucketTemplate != nil {
+		buckets = append(buckets, namedBucket{DynamicBucketTemplateName, ns.DynamicBucketTemplate})
+	}
+
+	if ns.NamespaceLimit != nil {
+		buckets = append(buckets, namedBucket{NamespaceLimitBucketName, ns.NamespaceLimit})
+	}
+
+	for name, b := range ns.Buckets {
+		if b != nil {
+			buckets = append(buckets, namedBucket{name, b})
+		}
+	}
+
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].name < buckets[j].name })
+	return buckets
+}
+
+func validateBucket(errs *ValidationErrors, field string, b *pb.BucketConfig) {
+	validateBucketFields(errs, field, b, b)
+
+	if b.Canary != nil {
+		validateCanary(errs, field, b)
+	} else if b.CanaryPercent != 0 {
+		errs.add(field+".canary_percent", "must not be set without a canary")
+	}
+}
+
+// validateBucketFields checks the fields set on b. Fields depending on each other are checked on
+// resolved instead, which differs from b for a canary inheriting the fields it doesn't set.
+func validateBucketFields(errs *ValidationErrors, field string, b, resolved *pb.BucketConfig) {
+	nonNegative := []struct {
+		name  string
+		value int64
+	}{
+		{"size", b.Size},
+		{"fill_rate", b.FillRate},
+		{"wait_timeout_millis", b.WaitTimeoutMillis},
+		{"max_debt_millis", b.MaxDebtMillis},
+		{"max_tokens_per_request", b.MaxTokensPerRequest},
+		{"ramp_start_fill_rate", b.RampStartFillRate},
+		{"ramp_start_millis", b.RampStartMillis},
+		{"ramp_duration_millis", b.RampDurationMillis},
+		{"ramp_steps", int64(b.RampSteps)},
+		{"max_debt", b.MaxDebt},
+		{"max_waiters", b.MaxWaiters},
+		{"token_cap", b.TokenCap},
+		{"token_cap_window_millis", b.TokenCapWindowMillis},
+		{"eviction_grace_millis", b.EvictionGraceMillis},
+	}
+
+	for _, f := range nonNegative {
+		if f.value < 0 {
+			errs.add(field+"."+f.name, "must not be negative, was %v", f.value)
+		}
+	}
+
+	if b.FillRate > maxFillRate {
+		errs.add(field+".fill_rate", "must be at most a token per nanosecond, was %v", b.FillRate)
+	}
+
+	if b.RampStartFillRate > maxFillRate {
+		errs.add(field+".ramp_start_fill_rate", "must be at most a token per nanosecond, was %v", b.RampStartFillRate)
+	}
+
+	// -1 disables idle eviction.
+	if b.MaxIdleMillis < -1 {
+		errs.add(field+".max_idle_millis", "must be -1 or greater, was %v", b.MaxIdleMillis)
+	}
+
+	// Debt is repaid before a bucket accumulates tokens again, so a debt larger than the bucket
+	// would take longer to repay than the bucket takes to fill. An unset size is defaulted later.
+	if resolved.Size > 0 && resolved.MaxDebt > resolved.Size {
+		errs.add(field+".max_debt", "must be at most the size of %v, was %v", resolved.Size, resolved.MaxDebt)
+	}
+
+	// Requests for more tokens than a bucket could ever serve at once are always rejected, so a
+	// larger max tokens per request only produces rejections.
+	if effective := withDefaults(resolved); effective.MaxTokensPerRequest > MaxTokensAtOnce(effective) {
+		errs.add(field+".max_tokens_per_request",
+			"must be at most the %v tokens the bucket can serve at once, its size plus debt, was %v",
+			MaxTokensAtOnce(effective), effective.MaxTokensPerRequest)
+	}
+
+	// Buckets can't fill from nothing, so a ramp must start with some fill rate.
+	if resolved.RampDurationMillis > 0 && resolved.RampStartFillRate == 0 {
+		errs.add(field+".ramp_start_fill_rate", "must be positive when ramping the fill rate")
+	}
+
+	// A window only resets the cap, so is meaningless without one.
+	if resolved.TokenCapWindowMillis > 0 && resolved.TokenCap == 0 {
+		errs.add(field+".token_cap_window_millis", "must not be set without a token_cap")
+	}
+
+	validateRateWindows(errs, field+".rate_windows", b.RateWindows)
+
+	switch b.OverMaxTokensPolicy {
+	case "", OverMaxTokensReject, OverMaxTokensClamp:
+	default:
+		errs.add(field+".over_max_tokens_policy", "must be %v or %v, was %v",
+			OverMaxTokensReject, OverMaxTokensClamp, b.OverMaxTokensPolicy)
+	}
+
+	validateLabels(errs, field+".labels", b.Labels)
+}
+
+// validateRateWindows checks the rate windows of a bucket, each of which must refill at most a token
+// per nanosecond, and be the only window of its length.
+func validateRateWindows(errs *ValidationErrors, field string, windows []*pb.RateWindow) {
+	lengths := make(map[int64]int, len(windows))
+
+	for i, w := range windows {
+		windowField := joinField(field, strconv.Itoa(i))
+
+		if w.Tokens <= 0 {
+			errs.add(windowField+".tokens", "must be positive, was %v", w.Tokens)
+		}
+
+		if w.WindowMillis <= 0 {
+			errs.add(windowField+".window_millis", "must be positive, was %v", w.WindowMillis)
+			continue
+		}
+
+		if w.Tokens > w.WindowMillis*1e6 {
+			errs.add(windowField+".tokens", "must be at most a token per nanosecond of the window, was %v", w.Tokens)
+		}
+
+		if j, exists := lengths[w.WindowMillis]; exists {
+			errs.add(windowField+".window_millis", "must differ from that of window %v, was %v", j, w.WindowMillis)
+		} else {
+			lengths[w.WindowMillis] = i
+		}
+	}
+}
+
+// validateCanary checks the canary of b, whose fields are validated as resolved for the buckets in
+// the canary.
+func validateCanary(errs *ValidationErrors, field string, b *pb.BucketConfig) {
+	canaryField := field + ".canary"
+
+	if b.CanaryPercent < 0 || b.CanaryPercent > 100 {
+		errs.add(field+".canary_percent", "must be between 0 and 100, was %v", b.CanaryPercent)
+	}
+
+	if b.Canary.Canary != nil || b.Canary.CanaryPercent != 0 {
+		errs.add(canaryField, "a canary cannot have a canary of its own")
+	}
+
+	resolved := proto.Clone(b).(*pb.BucketConfig)
+	applyOverrides(resolved, b.Canary)
+	validateBucketFields(errs, canaryField, b.Canary, resolved)
+
+	if _, exists := b.Labels[CanaryLabel]; exists {
+		errs.add(field+".labels."+CanaryLabel, "label name %v is reserved for buckets with a canary", CanaryLabel)
+	}
+
+	if _, exists := b.Canary.Labels[CanaryLabel]; exists {
+		errs.add(canaryField+".labels."+CanaryLabel, "label name %v is reserved for buckets with a canary", CanaryLabel)
+	}
+}
+
+// validateLabels caps the labels of a bucket, which may end up as metric dimensions.
+func validateLabels(errs *ValidationErrors, field string, labels map[string]string) {
+	if len(labels) > MaxBucketLabels {
+		errs.add(field, "at most %v labels are allowed, found %v", MaxBucketLabels, len(labels))
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		labelField := field + "." + name
+
+		if !labelName.MatchString(name) {
+			errs.add(labelField, "label name must be letters, digits and underscores, not starting with a digit")
+		}
+
+		if len(name) > MaxLabelLength {
+			errs.add(labelField, "label name must be at most %v characters", MaxLabelLength)
+		}
+
+		if len(labels[name]) > MaxLabelLength {
+			errs.add(labelField, "label value must be at most %v characters", MaxLabelLength)
+		}
+	}
+}
@@ -0,0 +1,524 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package config
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	pb "github.com/square/quotaservice/protos/config"
+)
+
+func TestValidateValid(t *testing.T) {
+	cfg := NewDefaultServiceConfig()
+	cfg.GlobalDefaultBucket = NewDefaultBucketConfig(DefaultBucketName)
+	ns := NewDefaultNamespaceConfig("foo")
+	SetDynamicBucketTemplate(ns, NewDefaultBucketConfig(""))
+	ns.NamespaceLimit = NewDefaultBucketConfig("")
+	if err := AddBucket(ns, NewDefaultBucketConfig("bar")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := AddNamespace(cfg, ns); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Validate(cfg); err != nil {
+		t.Fatalf("Expected config to be valid, got %v", err)
+	}
+
+	// Zero values are filled in by defaults, so are valid.
+	if err := Validate(&pb.ServiceConfig{Namespaces: map[string]*pb.NamespaceConfig{
+		"foo": {Buckets: map[string]*pb.BucketConfig{"bar": {}}}}}); err != nil {
+		t.Fatalf("Expected config to be valid, got %v", err)
+	}
+}
+
+func TestValidateInvalid(t *testing.T) {
+	cfg := &pb.ServiceConfig{
+		GlobalDefaultBucket: &pb.BucketConfig{FillRate: -1},
+		Namespaces: map[string]*pb.NamespaceConfig{
+			"foo": {
+				Name:                  "other",
+				DefaultBucket:         &pb.BucketConfig{},
+				DynamicBucketTemplate: &pb.BucketConfig{},
+				MaxDynamicBuckets:     -1,
+				NamespaceLimit:        &pb.BucketConfig{FillRate: -1},
+				Buckets: map[string]*pb.BucketConfig{
+					DefaultBucketName:        {},
+					NamespaceLimitBucketName: {},
+					"bar":                    {Size: -1, MaxIdleMillis: -2, RampDurationMillis: 1000, TokenCapWindowMillis: 1000},
+					"baz":                    nil}},
+			GlobalNamespace: {}}}
+
+	err := Validate(cfg)
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("Expected ValidationErrors, got %v", err)
+	}
+
+	expected := []string{
+		"global_default_bucket.fill_rate",
+		"namespaces.foo.name",
+		"namespaces.foo",
+		"namespaces.foo.max_dynamic_buckets",
+		"namespaces.foo.namespace_limit.fill_rate",
+		"namespaces.foo.buckets." + DefaultBucketName,
+		"namespaces.foo.buckets." + NamespaceLimitBucketName,
+		"namespaces.foo.buckets.bar.size",
+		"namespaces.foo.buckets.bar.max_idle_millis",
+		"namespaces.foo.buckets.bar.ramp_start_fill_rate",
+		"namespaces.foo.buckets.bar.token_cap_window_millis",
+		"namespaces.foo.buckets.baz",
+		"namespaces." + GlobalNamespace,
+	}
+
+	fields := make(map[string]bool)
+	for _, e := range errs {
+		fields[e.Field] = true
+	}
+
+	for _, f := range expected {
+		if !fields[f] {
+			t.Errorf("Expected a validation error for %v, got %v", f, errs)
+		}
+	}
+
+	if Validate(nil) == nil {
+		t.Error("Expected a nil config to be invalid")
+	}
+}
+
+func TestValidateRateWindows(t *testing.T) {
+	b := NewDefaultBucketConfig("bar")
+	b.RateWindows = []*pb.RateWindow{
+		{Tokens: 2000, WindowMillis: 60000},
+		{Tokens: 10000, WindowMillis: 3600000},
+	}
+
+	ns := NewDefaultNamespaceConfig("foo")
+	if err := AddBucket(ns, b); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := NewDefaultServiceConfig()
+	if err := AddNamespace(cfg, ns); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Validate(cfg); err != nil {
+		t.Fatalf("Expected config to be valid, got %v", err)
+	}
+
+	b.RateWindows = append(b.RateWindows,
+		&pb.RateWindow{Tokens: 0, WindowMillis: 1000},
+		&pb.RateWindow{Tokens: 10, WindowMillis: 0},
+		&pb.RateWindow{Tokens: 2000, WindowMillis: 60000},
+		&pb.RateWindow{Tokens: 2e6, WindowMillis: 1})
+
+	errs, ok := Validate(cfg).(ValidationErrors)
+	if !ok {
+		t.Fatalf("Expected ValidationErrors, got %v", errs)
+	}
+
+	expected := []string{
+		"namespaces.foo.buckets.bar.rate_windows.2.tokens",
+		"namespaces.foo.buckets.bar.rate_windows.3.window_millis",
+		"namespaces.foo.buckets.bar.rate_windows.4.window_millis",
+		"namespaces.foo.buckets.bar.rate_windows.5.tokens",
+	}
+
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %v validation errors, got %v", len(expected), errs)
+	}
+
+	for i, f := range expected {
+		if errs[i].Field != f {
+			t.Errorf("Expected a validation error for %v, got %v", f, errs[i])
+		}
+	}
+}
+
+func TestValidateRequestCosts(t *testing.T) {
+	ns := NewDefaultNamespaceConfig("foo")
+	bar := NewDefaultBucketConfig("bar")
+	bar.MaxTokensPerRequest = 10
+	if err := AddBucket(ns, bar); err != nil {
+		t.Fatal(err)
+	}
+
+	// Buckets without a limit on tokens per request accept any cost.
+	if err := AddBucket(ns, NewDefaultBucketConfig("baz")); err != nil {
+		t.Fatal(err)
+	}
+
+	SetRequestCost(ns, "health", 1)
+	SetRequestCost(ns, "search", 10)
+
+	cfg := NewDefaultServiceConfig()
+	if err := AddNamespace(cfg, ns); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Validate(cfg); err != nil {
+		t.Fatalf("Expected config to be valid, got %v", err)
+	}
+
+	SetRequestCost(ns, "export", 11)
+	SetRequestCost(ns, "free", 0)
+	SetRequestCost(ns, "", 1)
+
+	errs, ok := Validate(cfg).(ValidationErrors)
+	if !ok {
+		t.Fatalf("Expected ValidationErrors, got %v", errs)
+	}
+
+	expected := []string{
+		"namespaces.foo.request_costs.",
+		"namespaces.foo.request_costs.export",
+		"namespaces.foo.request_costs.free",
+	}
+
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %v validation errors, got %v", len(expected), errs)
+	}
+
+	for i, f := range expected {
+		if errs[i].Field != f {
+			t.Errorf("Expected a validation error for %v, got %v", f, errs[i])
+		}
+	}
+}
+
+func TestValidateLabels(t *testing.T) {
+	ns := NewDefaultNamespaceConfig("foo")
+	bar := NewDefaultBucketConfig("bar")
+	bar.Labels = map[string]string{"team": "search", "tier": "1"}
+	if err := AddBucket(ns, bar); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := NewDefaultServiceConfig()
+	if err := AddNamespace(cfg, ns); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Validate(cfg); err != nil {
+		t.Fatalf("Expected config to be valid, got %v", err)
+	}
+
+	bar.Labels["cost-center"] = "1234"
+	bar.Labels["owner"] = strings.Repeat("x", MaxLabelLength+1)
+	bar.Labels[strings.Repeat("x", MaxLabelLength+1)] = "long"
+
+	baz := NewDefaultBucketConfig("baz")
+	baz.Labels = make(map[string]string)
+	for i := 0; i <= MaxBucketLabels; i++ {
+		baz.Labels[fmt.Sprintf("label_%v", i)] = "value"
+	}
+
+	if err := AddBucket(ns, baz); err != nil {
+		t.Fatal(err)
+	}
+
+	errs, ok := Validate(cfg).(ValidationErrors)
+	if !ok {
+		t.Fatalf("Expected ValidationErrors, got %v", errs)
+	}
+
+	expected := []string{
+		"namespaces.foo.buckets.bar.labels.cost-center",
+		"namespaces.foo.buckets.bar.labels.owner",
+		"namespaces.foo.buckets.bar.labels." + strings.Repeat("x", MaxLabelLength+1),
+		"namespaces.foo.buckets.baz.labels",
+	}
+
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %v validation errors, got %v", len(expected), errs)
+	}
+
+	for i, f := range expected {
+		if errs[i].Field != f {
+			t.Errorf("Expected a validation error for %v, got %v", f, errs[i])
+		}
+	}
+}
+
+func TestValidateMaxDebt(t *testing.T) {
+	ns := NewDefaultNamespaceConfig("foo")
+	for name, maxDebt := range map[string]int64{"full": 100, "negative": -1, "oversized": 101} {
+		b := NewDefaultBucketConfig(name)
+		b.MaxDebt = maxDebt
+		if err := AddBucket(ns, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := NewDefaultServiceConfig()
+	if err := AddNamespace(cfg, ns); err != nil {
+		t.Fatal(err)
+	}
+
+	errs, ok := Validate(cfg).(ValidationErrors)
+	if !ok {
+		t.Fatalf("Expected ValidationErrors, got %v", errs)
+	}
+
+	expected := []string{
+		"namespaces.foo.buckets.negative.max_debt",
+		"namespaces.foo.buckets.oversized.max_debt",
+	}
+
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %v validation errors, got %v", len(expected), errs)
+	}
+
+	for i, f := range expected {
+		if errs[i].Field != f {
+			t.Errorf("Expected a validation error for %v, got %v", f, errs[i])
+		}
+	}
+
+	full := NewDefaultBucketConfig("full")
+	full.MaxDebt = 100
+	if maxTokens := MaxTokensAtOnce(full); maxTokens != 100+100+10000*50/1000 {
+		t.Errorf("Expected the max debt to count towards the tokens served at once, got %v", maxTokens)
+	}
+}
+
+func TestValidateMaxTokensPerRequest(t *testing.T) {
+	ns := NewDefaultNamespaceConfig("foo")
+	// Debt lets requests take more than the bucket's size: 1s of debt at 50 tokens/s is 50 tokens.
+	buckets := map[string]*pb.BucketConfig{
+		"defaulted": {},
+		"size":      {MaxTokensPerRequest: 100},
+		"debt":      {MaxTokensPerRequest: 200, MaxDebt: 50},
+		"negative":  {MaxTokensPerRequest: -1},
+		"oversized": {MaxTokensPerRequest: 151},
+	}
+
+	for name, b := range buckets {
+		b.Name = name
+		if name != "defaulted" {
+			b.Size, b.FillRate, b.MaxDebtMillis = 100, 50, 1000
+		}
+
+		if err := AddBucket(ns, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := NewDefaultServiceConfig()
+	if err := AddNamespace(cfg, ns); err != nil {
+		t.Fatal(err)
+	}
+
+	errs, ok := Validate(cfg).(ValidationErrors)
+	if !ok {
+		t.Fatalf("Expected ValidationErrors, got %v", errs)
+	}
+
+	expected := []string{
+		"namespaces.foo.buckets.negative.max_tokens_per_request",
+		"namespaces.foo.buckets.oversized.max_tokens_per_request",
+	}
+
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %v validation errors, got %v", len(expected), errs)
+	}
+
+	for i, f := range expected {
+		if errs[i].Field != f {
+			t.Errorf("Expected a validation error for %v, got %v", f, errs[i])
+		}
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	cfg := NewDefaultServiceConfig()
+	cfg.GlobalDefaultBucket = &pb.BucketConfig{Size: 10, FillRate: 20}
+	ns := NewDefaultNamespaceConfig("foo")
+	for name, fillRate := range map[string]int64{"full": 100, "half": 50, "fast": 101} {
+		b := NewDefaultBucketConfig(name)
+		b.FillRate = fillRate
+		if err := AddBucket(ns, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := AddNamespace(cfg, ns); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Validate(cfg); err != nil {
+		t.Fatalf("Expected config to be valid, got %v", err)
+	}
+
+	warnings := Warnings(cfg)
+	expected := []string{
+		"global_default_bucket.fill_rate",
+		"namespaces.foo.buckets.fast.fill_rate",
+	}
+
+	if len(warnings) != len(expected) {
+		t.Fatalf("Expected %v warnings, got %v", len(expected), warnings)
+	}
+
+	for i, f := range expected {
+		if warnings[i].Field != f {
+			t.Errorf("Expected a warning for %v, got %v", f, warnings[i])
+		}
+	}
+
+	if warnings := Warnings(NewDefaultServiceConfig()); warnings != nil {
+		t.Errorf("Expected no warnings for the default config, got %v", warnings)
+	}
+}
+
+func TestValidateOverMaxTokensPolicy(t *testing.T) {
+	ns := NewDefaultNamespaceConfig("foo")
+	for name, policy := range map[string]string{"unset": "", "reject": OverMaxTokensReject, "clamp": OverMaxTokensClamp, "bogus": "truncate"} {
+		b := NewDefaultBucketConfig(name)
+		b.OverMaxTokensPolicy = policy
+		if err := AddBucket(ns, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := NewDefaultServiceConfig()
+	if err := AddNamespace(cfg, ns); err != nil {
+		t.Fatal(err)
+	}
+
+	errs, ok := Validate(cfg).(ValidationErrors)
+	if !ok || len(errs) != 1 || errs[0].Field != "namespaces.foo.buckets.bogus.over_max_tokens_policy" {
+		t.Errorf("Expected only the unknown policy to be invalid, got %v", Validate(cfg))
+	}
+}
+
+func TestValidateBackends(t *testing.T) {
+	cfg := NewDefaultServiceConfig()
+	for name, backend := range map[string]string{"unset": "", "redis": BackendRedis, "memory": BackendMemory, "bogus": "cassandra"} {
+		ns := NewDefaultNamespaceConfig(name)
+		ns.Backend = backend
+		if err := AddNamespace(cfg, ns); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	errs, ok := Validate(cfg).(ValidationErrors)
+	if !ok || len(errs) != 1 || errs[0].Field != "namespaces.bogus.backend" {
+		t.Errorf("Expected only the unknown backend to be invalid, got %v", Validate(cfg))
+	}
+
+	delete(cfg.Namespaces, "bogus")
+
+	if err := ValidateBackends(cfg, nil); err != nil {
+		t.Errorf("Expected backends not to be checked without any configured, got %v", err)
+	}
+
+	if err := ValidateBackends(cfg, []string{BackendMemory, BackendRedis}); err != nil {
+		t.Errorf("Expected every backend to be configured, got %v", err)
+	}
+
+	errs, ok = ValidateBackends(cfg, []string{BackendMemory}).(ValidationErrors)
+	if !ok || len(errs) != 1 || errs[0].Field != "namespaces.redis.backend" {
+		t.Errorf("Expected the namespace selecting Redis without a connection to be invalid, got %v", errs)
+	}
+}
+
+func TestValidateCanary(t *testing.T) {
+	ns := NewDefaultNamespaceConfig("foo")
+	bar := NewDefaultBucketConfig("bar")
+	bar.RampStartFillRate = 10
+	// Ramps from the inherited start fill rate.
+	bar.Canary = &pb.BucketConfig{FillRate: 500, RampDurationMillis: 1000}
+	bar.CanaryPercent = 10
+	if err := AddBucket(ns, bar); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := NewDefaultServiceConfig()
+	if err := AddNamespace(cfg, ns); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Validate(cfg); err != nil {
+		t.Fatalf("Expected config to be valid, got %v", err)
+	}
+
+	bar.CanaryPercent = 101
+	bar.Labels = map[string]string{CanaryLabel: "yes"}
+	bar.Canary.Size = -1
+	bar.Canary.Canary = &pb.BucketConfig{}
+
+	baz := NewDefaultBucketConfig("baz")
+	baz.CanaryPercent = 10
+	if err := AddBucket(ns, baz); err != nil {
+		t.Fatal(err)
+	}
+
+	errs, ok := Validate(cfg).(ValidationErrors)
+	if !ok {
+		t.Fatalf("Expected ValidationErrors, got %v", errs)
+	}
+
+	expected := []string{
+		"namespaces.foo.buckets.bar.canary_percent",
+		"namespaces.foo.buckets.bar.canary",
+		"namespaces.foo.buckets.bar.canary.size",
+		"namespaces.foo.buckets.bar.labels.canary",
+		"namespaces.foo.buckets.baz.canary_percent",
+	}
+
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %v validation errors, got %v", len(expected), errs)
+	}
+
+	for i, f := range expected {
+		if errs[i].Field != f {
+			t.Errorf("Expected a validation error for %v, got %v", f, errs[i])
+		}
+	}
+}
+
+func TestValidateCatchAll(t *testing.T) {
+	cfg := NewDefaultServiceConfig()
+	for _, name := range []string{"bar", "foo"} {
+		ns := NewDefaultNamespaceConfig(name)
+		b := NewDefaultBucketConfig("catchall")
+		b.CatchAll = true
+		if err := AddBucket(ns, b); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := AddNamespace(cfg, ns); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	errs, ok := Validate(cfg).(ValidationErrors)
+	if !ok || len(errs) != 1 || errs[0].Field != "namespaces.foo.buckets.catchall.catch_all" {
+		t.Fatalf("Expected only the second catch-all to be invalid, got %v", Validate(cfg))
+	}
+
+	if ns, name, ok := CatchAllBucket(cfg); !ok || ns != "bar" || name != "catchall" {
+		t.Errorf("Expected bar:catchall to be the catch-all, got %v:%v", ns, name)
+	}
+
+	cfg.Namespaces["foo"].Buckets["catchall"].CatchAll = false
+	if err := Validate(cfg); err != nil {
+		t.Errorf("Expected a single catch-all to be valid, got %v", err)
+	}
+
+	cfg.Namespaces["foo"].DefaultBucket = NewDefaultBucketConfig(DefaultBucketName)
+	cfg.Namespaces["foo"].DefaultBucket.CatchAll = true
+	cfg.Templates = map[string]*pb.BucketConfig{"tpl": {CatchAll: true}}
+
+	errs, ok = Validate(cfg).(ValidationErrors)
+	if !ok || len(errs) != 2 || errs[0].Field != "templates.tpl.catch_all" || errs[1].Field != "namespaces.foo.default_bucket.catch_all" {
+		t.Errorf("Expected the template and default bucket not to be catch-alls, got %v", Validate(cfg))
+	}
+}
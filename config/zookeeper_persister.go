@@ -36,6 +36,7 @@ type ZkConfigPersister struct {
 	// Historical map of configurations
 	// hash -> config
 	configs map[string]*pb.ServiceConfig
+	unknown UnknownFields
 
 	// Base Zookeeper path
 	path string
@@ -121,19 +122,19 @@ func (z *ZkConfigPersister) waitForEvents(watch *zkWatch) {
 		select {
 		case event := <-watch.channel:
 			if event.Err != nil {
-				logging.Print("Received error from zookeeper", event)
+				logging.Warnf("Received error from zookeeper %+v", event)
 			} else {
-				logging.Printf("Received event %+v on zookeeper watch", event)
+				logging.Debugf("Received event %+v on zookeeper watch", event)
 			}
 		case <-watch.stopper:
-			logging.Print("Received stop signal; stopping zookeeper watcher goroutine")
+			logging.Info("Received stop signal; stopping zookeeper watcher goroutine")
 			return
 		}
 
 		channel, err := watch.listener()
 
 		if err != nil {
-			logging.Printf("Received error from zookeeper executing listener: %+v", err)
+			logging.Warnf("Received error from zookeeper executing listener: %+v", err)
 			continue
 		}
 
@@ -157,7 +158,7 @@ func createPath(conn *zk.Conn, path string) (err error) {
 			return nil
 		}
 
-		logging.Printf("Could not create zk path, sleeping for 100ms error=%s", err.Error())
+		logging.Warnf("Could not create zk path, sleeping for 100ms error=%s", err.Error())
 		time.Sleep(100 * time.Millisecond)
 	}
 
@@ -172,7 +173,7 @@ func createPath(conn *zk.Conn, path string) (err error) {
 func (z *ZkConfigPersister) PersistAndNotify(oldHash string, cfg *pb.ServiceConfig) error {
 	// TODO(manik) Optimistic version check with oldHash
 
-	b, e := proto.Marshal(cfg)
+	b, e := z.unknown.Marshal(cfg)
 	if e != nil {
 		return e
 	}
@@ -186,7 +187,7 @@ func (z *ZkConfigPersister) PersistAndNotify(oldHash string, cfg *pb.ServiceConf
 	}
 
 	path := fmt.Sprintf("%s/%s", z.path, key)
-	logging.Printf("Storing config version %v in path %v", cfg.Version, path)
+	logging.Infof("Storing config version %v in path %v", cfg.Version, path)
 
 	if err := z.archiveConfig(path, b); err != nil {
 		return err
@@ -199,6 +200,11 @@ func (z *ZkConfigPersister) PersistAndNotify(oldHash string, cfg *pb.ServiceConf
 	return err
 }
 
+// UnknownFields implements UnknownFieldsKeeper.
+func (z *ZkConfigPersister) UnknownFields() *UnknownFields {
+	return &z.unknown
+}
+
 // ReadPersistedConfig provides a config previously persisted.
 func (z *ZkConfigPersister) ReadPersistedConfig() (*pb.ServiceConfig, error) {
 	z.RLock()
@@ -209,9 +215,9 @@ func (z *ZkConfigPersister) ReadPersistedConfig() (*pb.ServiceConfig, error) {
 
 func (z *ZkConfigPersister) currentConfigEventListener() (<-chan zk.Event, error) {
 	if z.initialized {
-		logging.Printf("Re-establishing zookeeper watch on %v", z.path)
+		logging.Debugf("Re-establishing zookeeper watch on %v", z.path)
 	} else {
-		logging.Printf("Establishing zookeeper watch on %v", z.path)
+		logging.Infof("Establishing zookeeper watch on %v", z.path)
 	}
 
 	// Ignoring the response to getting the contents of the watch. We don't care which node triggered the watch, since
@@ -223,26 +229,27 @@ func (z *ZkConfigPersister) currentConfigEventListener() (<-chan zk.Event, error
 	_, _, ch, err := z.conn.GetW(z.path)
 
 	if err != nil {
-		logging.Printf("Received error from zookeeper when fetching %s: %+v", z.path, err)
+		logging.Warnf("Received error from zookeeper when fetching %s: %+v", z.path, err)
 		return nil, err
 	}
 
 	if z.initialized {
-		logging.Print("Refreshing configs from zookeeper")
+		logging.Debug("Refreshing configs from zookeeper")
 	} else {
-		logging.Print("Reading configs from zookeeper for the first time")
+		logging.Info("Reading configs from zookeeper for the first time")
 	}
 
 	children, _, err := z.conn.Children(z.path)
 
 	if err != nil {
-		logging.Printf("Received error from zookeeper when fetching children of %s: %+v", z.path, err)
+		logging.Warnf("Received error from zookeeper when fetching children of %s: %+v", z.path, err)
 		return nil, err
 	}
 
 	configs := make(map[string]*pb.ServiceConfig)
 	latestHashVersion := int32(0)
 	var latestHash string
+	var latestData []byte
 
 	// Iterate over all children in this path for 2 reasons: add all of them to the historical version map, and to work
 	// out which is the most recent, to use as the current version.
@@ -251,7 +258,7 @@ func (z *ZkConfigPersister) currentConfigEventListener() (<-chan zk.Event, error
 		data, _, err := z.conn.Get(path)
 
 		if err != nil {
-			logging.Printf("Received error from zookeeper when fetching %s: %+v", path, err)
+			logging.Warnf("Received error from zookeeper when fetching %s: %+v", path, err)
 			return nil, err
 		}
 
@@ -264,6 +271,7 @@ func (z *ZkConfigPersister) currentConfigEventListener() (<-chan zk.Event, error
 		if configs[hash].Version >= latestHashVersion {
 			latestHashVersion = configs[hash].Version
 			latestHash = hash
+			latestData = data
 		}
 	}
 
@@ -272,8 +280,9 @@ func (z *ZkConfigPersister) currentConfigEventListener() (<-chan zk.Event, error
 
 	z.configs = configs
 	z.config = latestHash
+	z.unknown.Observe(latestData)
 
-	logging.Printf("Setting latest config hash to %v (version %v)", z.config, latestHashVersion)
+	logging.Infof("Setting latest config hash to %v (version %v)", z.config, latestHashVersion)
 
 	select {
 	case z.watcher <- struct{}{}:
@@ -0,0 +1,29 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+// Package dedupe remembers the results of requests by client-supplied request IDs, so requests
+// retried after being granted are answered with their original result rather than charged again.
+package dedupe
+
+import (
+	"time"
+)
+
+// Result is the outcome of a granted request.
+type Result struct {
+	// Wait is the time the request was told to wait for its tokens.
+	Wait time.Duration
+	// Dynamic is true if the tokens were taken from a dynamic bucket.
+	Dynamic bool
+	// Granted is the number of tokens granted, fewer than requested if the request was clamped. 0
+	// for results remembered before the tokens granted were, which granted those requested.
+	Granted int64
+}
+
+// Cache remembers results for a TTL, keyed on request.
+type Cache interface {
+	// Get returns the result remembered for a key, or nil if there is none.
+	Get(key string) (*Result, error)
+	// Put remembers the result for a key, replacing any remembered already.
+	Put(key string, r *Result) error
+}
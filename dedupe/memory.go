@@ -0,0 +1,100 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package dedupe
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type memoryEntry struct {
+	key     string
+	result  *Result
+	expires time.Time
+}
+
+// MemoryCache is a Cache held in memory, for a single instance. Once it holds maxSize results, the
+// oldest are forgotten to make room, even if their TTL hasn't expired.
+type MemoryCache struct {
+	ttl     time.Duration
+	maxSize int
+	now     func() time.Time
+	// entries are ordered oldest first, so also by expiry.
+	entries *list.List
+	keys    map[string]*list.Element
+	sync.Mutex
+}
+
+// NewMemoryCache creates a MemoryCache remembering up to maxSize results for ttl each.
+func NewMemoryCache(ttl time.Duration, maxSize int) *MemoryCache {
+	if ttl <= 0 {
+		panic("TTL must be positive")
+	}
+
+	if maxSize < 1 {
+		panic("Max size must be at least 1")
+	}
+
+	return &MemoryCache{
+		ttl:     ttl,
+		maxSize: maxSize,
+		now:     time.Now,
+		entries: list.New(),
+		keys:    make(map[string]*list.Element)}
+}
+
+// Get returns the result remembered for a key, or nil if there is none or its TTL has expired.
+func (m *MemoryCache) Get(key string) (*Result, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	el := m.keys[key]
+	if el == nil {
+		return nil, nil
+	}
+
+	e := el.Value.(*memoryEntry)
+	if !m.now().Before(e.expires) {
+		return nil, nil
+	}
+
+	return e.result, nil
+}
+
+// Put remembers the result for a key, forgetting expired results and, if the cache is full, the
+// oldest.
+func (m *MemoryCache) Put(key string, r *Result) error {
+	m.Lock()
+	defer m.Unlock()
+
+	now := m.now()
+	if el := m.keys[key]; el != nil {
+		m.remove(el)
+	}
+
+	for front := m.entries.Front(); front != nil; front = m.entries.Front() {
+		if m.entries.Len() < m.maxSize && now.Before(front.Value.(*memoryEntry).expires) {
+			break
+		}
+
+		m.remove(front)
+	}
+
+	m.keys[key] = m.entries.PushBack(&memoryEntry{key: key, result: r, expires: now.Add(m.ttl)})
+	return nil
+}
+
+// Len returns the number of results held, including any expired but yet to be forgotten.
+func (m *MemoryCache) Len() int {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.entries.Len()
+}
+
+func (m *MemoryCache) remove(el *list.Element) {
+	m.entries.Remove(el)
+	delete(m.keys, el.Value.(*memoryEntry).key)
+}
@@ -0,0 +1,66 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package dedupe
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/square/quotaservice/test/helpers"
+)
+
+func TestMemoryCache(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := NewMemoryCache(time.Minute, 10)
+	c.now = func() time.Time { return now }
+
+	r, err := c.Get("a")
+	helpers.CheckError(t, err)
+	if r != nil {
+		t.Fatalf("Expected no result before one was put, got %+v", r)
+	}
+
+	helpers.CheckError(t, c.Put("a", &Result{Wait: time.Second, Dynamic: true}))
+	now = now.Add(59 * time.Second)
+	if r, _ := c.Get("a"); r == nil || r.Wait != time.Second || !r.Dynamic {
+		t.Errorf("Expected the result put, got %+v", r)
+	}
+
+	now = now.Add(time.Second)
+	if r, _ := c.Get("a"); r != nil {
+		t.Errorf("Expected the result to expire, got %+v", r)
+	}
+
+	// Expired results are forgotten to make room.
+	helpers.CheckError(t, c.Put("b", &Result{}))
+	if c.Len() != 1 {
+		t.Errorf("Expected the expired result to be forgotten, got %v results", c.Len())
+	}
+}
+
+func TestMemoryCacheMaxSize(t *testing.T) {
+	c := NewMemoryCache(time.Hour, 3)
+
+	for i := 0; i < 5; i++ {
+		helpers.CheckError(t, c.Put(fmt.Sprint(i), &Result{Wait: time.Duration(i)}))
+	}
+
+	if c.Len() != 3 {
+		t.Errorf("Expected at most 3 results, got %v", c.Len())
+	}
+
+	for i := 0; i < 5; i++ {
+		r, _ := c.Get(fmt.Sprint(i))
+		if remembered := i >= 2; (r != nil) != remembered {
+			t.Errorf("Expected result %v remembered %v, got %+v", i, remembered, r)
+		}
+	}
+
+	// Replacing a result doesn't count it twice.
+	helpers.CheckError(t, c.Put("4", &Result{Wait: time.Second}))
+	if r, _ := c.Get("4"); c.Len() != 3 || r.Wait != time.Second {
+		t.Errorf("Expected the result to be replaced, got %+v with %v results", r, c.Len())
+	}
+}
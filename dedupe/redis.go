@@ -0,0 +1,83 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package dedupe
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const redisKeyPrefix = "quotaservice:dedupe:"
+
+// RedisCache is a Cache in Redis, shared by every instance using the same Redis. Results expire
+// with Redis' own TTLs, so memory is bounded by the rate of requests with IDs times the TTL.
+type RedisCache struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+// NewRedisCache creates a RedisCache remembering results for ttl each.
+func NewRedisCache(client *redis.Client, ttl time.Duration) *RedisCache {
+	if ttl <= 0 {
+		panic("TTL must be positive")
+	}
+
+	return &RedisCache{client: client, ttl: ttl}
+}
+
+// Get returns the result remembered for a key, or nil if there is none.
+func (c *RedisCache) Get(key string) (*Result, error) {
+	v, err := c.client.Get(redisKeyPrefix + key).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return parseResult(v)
+}
+
+// Put remembers the result for a key.
+func (c *RedisCache) Put(key string, r *Result) error {
+	return c.client.Set(redisKeyPrefix+key, formatResult(r), c.ttl).Err()
+}
+
+// formatResult encodes a Result as its wait in nanoseconds, whether it is dynamic and the tokens
+// granted, separated by colons.
+func formatResult(r *Result) string {
+	return fmt.Sprintf("%d:%t:%d", r.Wait.Nanoseconds(), r.Dynamic, r.Granted)
+}
+
+// parseResult decodes a Result, also accepting those remembered without the tokens granted.
+func parseResult(v string) (*Result, error) {
+	parts := strings.SplitN(v, ":", 3)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("malformed result %q", v)
+	}
+
+	wait, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed wait in result %q: %v", v, err)
+	}
+
+	dynamic, err := strconv.ParseBool(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed dynamic flag in result %q: %v", v, err)
+	}
+
+	var granted int64
+	if len(parts) == 3 {
+		if granted, err = strconv.ParseInt(parts[2], 10, 64); err != nil {
+			return nil, fmt.Errorf("malformed tokens granted in result %q: %v", v, err)
+		}
+	}
+
+	return &Result{Wait: time.Duration(wait), Dynamic: dynamic, Granted: granted}, nil
+}
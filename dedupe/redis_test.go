@@ -0,0 +1,60 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package dedupe
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+
+	"github.com/square/quotaservice/test/helpers"
+)
+
+func TestRedisCache(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+	defer client.Close()
+
+	c := NewRedisCache(client, 50*time.Millisecond)
+	key := "ns:b/" + time.Now().String()
+
+	r, err := c.Get(key)
+	helpers.CheckError(t, err)
+	if r != nil {
+		t.Fatalf("Expected no result before one was put, got %+v", r)
+	}
+
+	helpers.CheckError(t, c.Put(key, &Result{Wait: time.Second, Dynamic: true}))
+	r, err = c.Get(key)
+	helpers.CheckError(t, err)
+	if r == nil || r.Wait != time.Second || !r.Dynamic {
+		t.Errorf("Expected the result put, got %+v", r)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if r, _ := c.Get(key); r != nil {
+		t.Errorf("Expected the result to expire, got %+v", r)
+	}
+}
+
+func TestResultEncoding(t *testing.T) {
+	for _, r := range []*Result{{}, {Wait: 1500 * time.Millisecond, Dynamic: true}, {Granted: 10}} {
+		parsed, err := parseResult(formatResult(r))
+		helpers.CheckError(t, err)
+		if *parsed != *r {
+			t.Errorf("Expected %+v, got %+v", r, parsed)
+		}
+	}
+
+	for _, v := range []string{"", "12", "x:true", "12:maybe", "12:true:x"} {
+		if _, err := parseResult(v); err == nil {
+			t.Errorf("Expected %q to be malformed", v)
+		}
+	}
+
+	// Results remembered before the tokens granted were.
+	if r, err := parseResult("12:true"); err != nil || *r != (Result{Wait: 12, Dynamic: true}) {
+		t.Errorf("Expected a result without the tokens granted to parse, got %+v, %v", r, err)
+	}
+}
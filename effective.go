@@ -0,0 +1,74 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package quotaservice
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/square/quotaservice/config"
+	pbconfig "github.com/square/quotaservice/protos/config"
+)
+
+// effectiveConfig returns a copy of the config the bucket container applies, with the global
+// default, namespace default, namespace limit and static buckets replaced by the configs their
+// buckets were created with, as resolved for canaries. Dynamic bucket templates are left as they
+// are, since each dynamic bucket resolves its template by its own name. Returns nil if the container
+// has no config yet.
+func (bc *bucketContainer) effectiveConfig() *pbconfig.ServiceConfig {
+	bc.RLock()
+	defer bc.RUnlock()
+
+	if bc.cfg == nil {
+		return nil
+	}
+
+	effective := config.CloneConfig(bc.cfg)
+	effective.GlobalDefaultBucket = effectiveBucketConfig(bc.defaultBucket, config.GlobalNamespace,
+		config.DefaultBucketName, bc.cfg.GlobalDefaultBucket, 1)
+
+	for name, ns := range bc.namespaces {
+		nsCfg := effective.Namespaces[name]
+		if nsCfg == nil {
+			continue
+		}
+
+		ns.RLock()
+		scale := config.TokenScale(ns.cfg)
+		nsCfg.DefaultBucket = effectiveBucketConfig(ns.defaultBucket, name, config.DefaultBucketName,
+			ns.cfg.DefaultBucket, scale)
+		nsCfg.NamespaceLimit = effectiveBucketConfig(ns.limit, name, config.NamespaceLimitBucketName,
+			ns.cfg.NamespaceLimit, scale)
+
+		for bucketName, bCfg := range ns.cfg.Buckets {
+			nsCfg.Buckets[bucketName] = effectiveBucketConfig(ns.buckets[bucketName], name, bucketName, bCfg, scale)
+		}
+		ns.RUnlock()
+	}
+
+	return effective
+}
+
+// effectiveBucketConfig returns a copy of the config of a bucket created from cfg, or of cfg as it
+// would be resolved for the bucket if it doesn't exist, e.g. after being invalidated. Tokens are
+// counted in whole tokens, as configured, rather than as the bucket counts them with a token scale.
+func effectiveBucketConfig(b Bucket, namespace, bucketName string, cfg *pbconfig.BucketConfig, scale int64) *pbconfig.BucketConfig {
+	if cfg == nil {
+		return nil
+	}
+
+	resolved := config.CanaryConfig(namespace, bucketName, cfg)
+	if b != nil && !b.Dynamic() {
+		resolved = config.UnscaledBucketConfig(b.Config(), scale)
+	}
+
+	return proto.Clone(resolved).(*pbconfig.BucketConfig)
+}
+
+// EffectiveConfig returns the config as applied by the bucket container. See effectiveConfig.
+func (s *server) EffectiveConfig() *pbconfig.ServiceConfig {
+	s.RLock()
+	bc := s.bucketContainer
+	s.RUnlock()
+
+	return bc.effectiveConfig()
+}
@@ -7,6 +7,8 @@ package quotaservice
 
 import (
 	"errors"
+	"fmt"
+	"time"
 )
 
 // ErrorReason provides details on why calls to Allow may fail.
@@ -24,11 +26,29 @@ const (
 
 	// Too many tokens requested
 	ER_TOO_MANY_TOKENS_REQUESTED
+
+	// Request kind has no cost declared in the namespace
+	ER_UNKNOWN_REQUEST_KIND
+
+	// Namespace isn't configured, and isn't served by a default
+	ER_UNKNOWN_NAMESPACE
+
+	// Fraction of a token requested is finer than the namespace's buckets count
+	ER_TOO_FEW_TOKENS_REQUESTED
+
+	// Bucket already has as many requests waiting for tokens as its max waiters
+	ER_TOO_MANY_WAITERS
+
+	// Bucket has served its token cap for the current window
+	ER_CAP_REACHED
 )
 
 type QuotaServiceError struct {
 	error
 	Reason ErrorReason
+	// MaxTokens is the most tokens a single request may ask for, set with
+	// ER_TOO_MANY_TOKENS_REQUESTED. Such requests can never succeed, so shouldn't be retried.
+	MaxTokens int64
 }
 
 func (e QuotaServiceError) Error() string {
@@ -38,3 +58,75 @@ func (e QuotaServiceError) Error() string {
 func newError(msg string, reason ErrorReason) QuotaServiceError {
 	return QuotaServiceError{error: errors.New(msg), Reason: reason}
 }
+
+// NewQuotaServiceError creates a QuotaServiceError, for QuotaServices relaying the failures of
+// another, such as one forwarding requests to the instance owning their bucket.
+func NewQuotaServiceError(msg string, reason ErrorReason) QuotaServiceError {
+	return newError(msg, reason)
+}
+
+func newTooManyTokensError(namespace, name string, tokensRequested, maxTokens int64) QuotaServiceError {
+	return QuotaServiceError{
+		error: fmt.Errorf("Too many tokens requested. Bucket %v:%v, tokensRequested=%v, maxTokensPerRequest=%v",
+			namespace, name, tokensRequested, maxTokens),
+		Reason:    ER_TOO_MANY_TOKENS_REQUESTED,
+		MaxTokens: maxTokens}
+}
+
+func newTooManyWaitersError(namespace, name string, maxWaiters int64) QuotaServiceError {
+	return newError(fmt.Sprintf("Too many requests waiting. Bucket %v:%v, maxWaiters=%v", namespace, name, maxWaiters),
+		ER_TOO_MANY_WAITERS)
+}
+
+func newCapReachedError(namespace, name string, capReached *CapReachedError) QuotaServiceError {
+	msg := fmt.Sprintf("Token cap reached. Bucket %v:%v, tokenCap=%v", namespace, name, capReached.TokenCap)
+	if !capReached.ResetAt.IsZero() {
+		msg += fmt.Sprintf(", resetAt=%v", capReached.ResetAt.UTC().Format(time.RFC3339))
+	}
+
+	return newError(msg, ER_CAP_REACHED)
+}
+
+func newUnknownNamespaceError(namespace string) QuotaServiceError {
+	return newError("Unknown namespace "+namespace, ER_UNKNOWN_NAMESPACE)
+}
+
+// TooManyTokensError is returned by buckets asked for more tokens than they could ever serve in a
+// single request. Tokens that can't be served within the max wait time are not an error; Take
+// returns success false instead, and a retry may succeed.
+type TooManyTokensError struct {
+	// MaxTokens is the most tokens the bucket can serve a single request.
+	MaxTokens int64
+}
+
+func (e *TooManyTokensError) Error() string {
+	return fmt.Sprintf("too many tokens requested; at most %v can be served at once", e.MaxTokens)
+}
+
+// CapReachedError is returned by buckets asked for tokens that would take the tokens served in
+// the current window beyond their token cap. Unlike tokens that can't be served within the max
+// wait time, no retry succeeds before the window rolls over.
+type CapReachedError struct {
+	// TokenCap is the most tokens the bucket serves per window.
+	TokenCap int64
+	// ResetAt is when the current window rolls over, or zero for a cap over the bucket's lifetime.
+	ResetAt time.Time
+}
+
+func (e *CapReachedError) Error() string {
+	if e.ResetAt.IsZero() {
+		return fmt.Sprintf("token cap of %v reached", e.TokenCap)
+	}
+
+	return fmt.Sprintf("token cap of %v reached until %v", e.TokenCap, e.ResetAt.UTC().Format(time.RFC3339))
+}
+
+// tooManyWaitersError is returned by tracked buckets for requests that would be granted a wait while
+// as many waits as the bucket's max waiters haven't passed.
+type tooManyWaitersError struct {
+	maxWaiters int64
+}
+
+func (e *tooManyWaitersError) Error() string {
+	return fmt.Sprintf("too many requests waiting; at most %v may wait at once", e.maxWaiters)
+}
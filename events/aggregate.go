@@ -0,0 +1,86 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package events
+
+import (
+	"fmt"
+	"time"
+)
+
+// AggregatedBucket is the bucket name of dynamic bucket events rolled up to their namespace.
+const AggregatedBucket = "__dynamic__"
+
+// AggregationPolicy returns whether the events of dynamic buckets in a namespace are rolled up to
+// the namespace, to keep the volume and cardinality of events from namespaces with many ephemeral
+// buckets manageable. Events of named buckets are never rolled up.
+type AggregationPolicy func(namespace string) bool
+
+// AggregateNamespaces creates an AggregationPolicy rolling up the dynamic buckets of the given
+// namespaces.
+func AggregateNamespaces(namespaces ...string) AggregationPolicy {
+	set := make(map[string]struct{}, len(namespaces))
+	for _, ns := range namespaces {
+		set[ns] = struct{}{}
+	}
+
+	return func(namespace string) bool {
+		_, ok := set[namespace]
+		return ok
+	}
+}
+
+// AggregateAll is an AggregationPolicy rolling up the dynamic buckets of every namespace.
+func AggregateAll(string) bool {
+	return true
+}
+
+// aggregatedEvent is a dynamic bucket event attributed to AggregatedBucket. It isn't reported as
+// dynamic, since AggregatedBucket lives as long as its namespace.
+type aggregatedEvent struct {
+	Event
+}
+
+func (a *aggregatedEvent) String() string {
+	return fmt.Sprintf("aggregatedEvent{type: %v, namespace: %v, numTokens: %v, waitTime: %v}",
+		a.EventType(), a.Namespace(), a.NumTokens(), a.WaitTime())
+}
+
+func (a *aggregatedEvent) BucketName() string {
+	return AggregatedBucket
+}
+
+func (a *aggregatedEvent) Dynamic() bool {
+	return false
+}
+
+func (a *aggregatedEvent) Weight() int64 {
+	return Weight(a.Event)
+}
+
+// Labels are those of the dynamic bucket template, shared by the buckets rolled up.
+func (a *aggregatedEvent) Labels() map[string]string {
+	return Labels(a.Event)
+}
+
+func (a *aggregatedEvent) QueueTime() (time.Duration, bool) {
+	return QueueTime(a.Event)
+}
+
+// Aggregate returns an event rolled up to its namespace if the policy says so, or the event itself
+// otherwise. Token counts and wait times are preserved, so counts aggregated from rolled up events
+// match the sum over the underlying buckets.
+func Aggregate(e Event, policy AggregationPolicy) Event {
+	if policy == nil || !e.Dynamic() || !policy(e.Namespace()) {
+		return e
+	}
+
+	return &aggregatedEvent{e}
+}
+
+// AggregatingListener wraps a Listener, rolling up events according to a policy.
+func AggregatingListener(l Listener, policy AggregationPolicy) Listener {
+	return func(e Event) {
+		l(Aggregate(e, policy))
+	}
+}
@@ -0,0 +1,94 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package events
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+type bucketTotals struct {
+	events, tokens int64
+	wait           time.Duration
+}
+
+// totalsListener sums events by namespace, bucket and type.
+func totalsListener(totals map[string]*bucketTotals) Listener {
+	return func(e Event) {
+		key := fmt.Sprintf("%s.%s.%v.%v", e.Namespace(), e.BucketName(), e.Dynamic(), e.EventType())
+		if totals[key] == nil {
+			totals[key] = &bucketTotals{}
+		}
+
+		totals[key].events++
+		totals[key].tokens += e.NumTokens()
+		totals[key].wait += e.WaitTime()
+	}
+}
+
+func TestAggregation(t *testing.T) {
+	raw := make(map[string]*bucketTotals)
+	aggregated := make(map[string]*bucketTotals)
+	rawListener := totalsListener(raw)
+	aggregatingListener := AggregatingListener(totalsListener(aggregated), AggregateNamespaces("agg"))
+
+	var stream []Event
+	for i := 0; i < 100; i++ {
+		bucket := fmt.Sprintf("dyn%d", i%7)
+		stream = append(stream,
+			NewTokensServedEvent("agg", bucket, true, int64(i), time.Duration(i)*time.Millisecond),
+			NewTimedOutEvent("agg", bucket, true, 1),
+			NewTokensServedEvent("agg", "named", false, 2, 0),
+			NewTokensServedEvent("other", bucket, true, 3, 0))
+	}
+
+	stream = append(stream, NewBucketCreatedEvent("agg", "dyn0", true), NewBucketRemovedEvent("agg", "dyn0", true))
+
+	for _, e := range stream {
+		rawListener(e)
+		aggregatingListener(e)
+	}
+
+	// Aggregated totals match the sum over the underlying dynamic buckets.
+	for _, eventType := range []EventType{EVENT_TOKENS_SERVED, EVENT_TIMEOUT_SERVING_TOKENS, EVENT_BUCKET_CREATED, EVENT_BUCKET_REMOVED} {
+		sum := &bucketTotals{}
+		for i := 0; i < 7; i++ {
+			if b := raw[fmt.Sprintf("agg.dyn%d.true.%v", i, eventType)]; b != nil {
+				sum.events += b.events
+				sum.tokens += b.tokens
+				sum.wait += b.wait
+			}
+		}
+
+		agg := aggregated[fmt.Sprintf("agg.%v.false.%v", AggregatedBucket, eventType)]
+		if agg == nil || *agg != *sum {
+			t.Errorf("Expected aggregated %v totals %+v, got %+v", eventType, sum, agg)
+		}
+	}
+
+	// Named buckets and other namespaces are left alone.
+	if len(aggregated) != 4+1+7 {
+		t.Errorf("Unexpected aggregated series %v", len(aggregated))
+	}
+
+	if b := aggregated["agg.named.false.EVENT_TOKENS_SERVED"]; b == nil || b.tokens != 200 {
+		t.Errorf("Expected the named bucket unaggregated, got %+v", b)
+	}
+
+	if b := aggregated["other.dyn3.true.EVENT_TOKENS_SERVED"]; b == nil || *b != *raw["other.dyn3.true.EVENT_TOKENS_SERVED"] {
+		t.Errorf("Expected other namespaces unaggregated, got %+v", b)
+	}
+}
+
+func TestAggregateAll(t *testing.T) {
+	e := NewBucketMissedEvent("ns", "dyn", true)
+	if a := Aggregate(e, AggregateAll); a.BucketName() != AggregatedBucket || a.Namespace() != "ns" || a.Dynamic() {
+		t.Errorf("Unexpected aggregated event %v", a)
+	}
+
+	if Aggregate(e, nil) != e {
+		t.Error("Expected no aggregation without a policy")
+	}
+}
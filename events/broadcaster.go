@@ -0,0 +1,93 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package events
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Broadcaster fans out events to subscribers that come and go while the server runs, such as
+// clients of the admin API tailing events. Each subscriber has its own bounded buffer; events are
+// dropped for subscribers too slow to keep up, rather than blocking other subscribers. Attach it
+// using Server.SetEventBroadcaster.
+type Broadcaster struct {
+	subscribers map[*Subscription]struct{}
+	sync.RWMutex
+}
+
+// Subscription receives the events of a Broadcaster matching its filter.
+type Subscription struct {
+	// C is notified of the events, and closed when unsubscribing.
+	C       <-chan Event
+	c       chan Event
+	filter  func(Event) bool
+	dropped uint64 // Accessed atomically
+	once    sync.Once
+	b       *Broadcaster
+}
+
+// NewBroadcaster creates a Broadcaster with no subscribers.
+func NewBroadcaster() *Broadcaster {
+	return &Broadcaster{subscribers: make(map[*Subscription]struct{})}
+}
+
+// Subscribe registers a subscriber with a buffer of bufSize events, notified of the events for
+// which filter returns true, or of every event if filter is nil. filter is called on the goroutine
+// emitting events, so must be cheap.
+func (b *Broadcaster) Subscribe(bufSize int, filter func(Event) bool) *Subscription {
+	if bufSize < 1 {
+		bufSize = 1
+	}
+
+	c := make(chan Event, bufSize)
+	s := &Subscription{C: c, c: c, filter: filter, b: b}
+
+	b.Lock()
+	b.subscribers[s] = struct{}{}
+	b.Unlock()
+
+	return s
+}
+
+// HandleEvent is a Listener, sending an event to the subscribers it matches without blocking.
+func (b *Broadcaster) HandleEvent(e Event) {
+	b.RLock()
+	defer b.RUnlock()
+
+	for s := range b.subscribers {
+		if s.filter != nil && !s.filter(e) {
+			continue
+		}
+
+		select {
+		case s.c <- e:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
+
+// Subscribers returns the number of subscribers.
+func (b *Broadcaster) Subscribers() int {
+	b.RLock()
+	defer b.RUnlock()
+
+	return len(b.subscribers)
+}
+
+// Dropped returns the number of events dropped because the subscriber's buffer was full.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Unsubscribe stops notifying the subscriber, and closes C. It may be called more than once.
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(func() {
+		s.b.Lock()
+		delete(s.b.subscribers, s)
+		s.b.Unlock()
+		close(s.c)
+	})
+}
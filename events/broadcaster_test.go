@@ -0,0 +1,56 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package events
+
+import (
+	"testing"
+)
+
+func TestBroadcaster(t *testing.T) {
+	b := NewBroadcaster()
+	all := b.Subscribe(10, nil)
+	misses := b.Subscribe(1, func(e Event) bool { return e.EventType() == EVENT_BUCKET_MISS })
+
+	b.HandleEvent(NewTokensServedEvent("ns", "a", false, 1, 0))
+	b.HandleEvent(NewBucketMissedEvent("ns", "b", true))
+	b.HandleEvent(NewBucketMissedEvent("ns", "c", true))
+
+	if len(all.C) != 3 {
+		t.Errorf("Expected every event to be delivered, got %v", len(all.C))
+	}
+
+	if e := <-misses.C; e.BucketName() != "b" || len(misses.C) != 0 {
+		t.Errorf("Expected only the first miss to be buffered, got %v", e)
+	}
+
+	if misses.Dropped() != 1 || all.Dropped() != 0 {
+		t.Errorf("Expected the second miss to be dropped for the slow subscriber, got %v and %v", misses.Dropped(), all.Dropped())
+	}
+
+	misses.Unsubscribe()
+	misses.Unsubscribe()
+	if _, ok := <-misses.C; ok || b.Subscribers() != 1 {
+		t.Error("Expected unsubscribing to close the channel")
+	}
+
+	b.HandleEvent(NewBucketMissedEvent("ns", "d", true))
+	if len(all.C) != 4 {
+		t.Errorf("Expected remaining subscribers to be notified, got %v", len(all.C))
+	}
+}
+
+func TestParseEventType(t *testing.T) {
+	for name, expected := range map[string]EventType{
+		"EVENT_BUCKET_MISS":      EVENT_BUCKET_MISS,
+		"timeout_serving_tokens": EVENT_TIMEOUT_SERVING_TOKENS,
+	} {
+		if actual, ok := ParseEventType(name); !ok || actual != expected {
+			t.Errorf("Expected %v to parse as %v, got %v", name, expected, actual)
+		}
+	}
+
+	if _, ok := ParseEventType("nope"); ok {
+		t.Error("Expected an unknown event type not to parse")
+	}
+}
@@ -0,0 +1,75 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package events
+
+import (
+	"fmt"
+	"time"
+
+	pbconfig "github.com/square/quotaservice/protos/config"
+)
+
+// BucketConfigChange is implemented by events about buckets created, modified or removed, carrying
+// the bucket's config before and after the change, so listeners can record what changed without
+// fetching and diffing the configs themselves. config.ChangedBucketFields lists the fields changed.
+type BucketConfigChange interface {
+	// OldBucketConfig is the config of the bucket before the change, or nil if it was created. It
+	// must not be modified.
+	OldBucketConfig() *pbconfig.BucketConfig
+	// NewBucketConfig is the config of the bucket after the change, or nil if it was removed. It
+	// must not be modified.
+	NewBucketConfig() *pbconfig.BucketConfig
+}
+
+// BucketConfigs returns the configs of the bucket an event is about before and after the change it
+// reports, or false if the event doesn't carry them.
+func BucketConfigs(e Event) (oldCfg, newCfg *pbconfig.BucketConfig, ok bool) {
+	if c, ok := e.(BucketConfigChange); ok {
+		return c.OldBucketConfig(), c.NewBucketConfig(), true
+	}
+
+	return nil, nil, false
+}
+
+// bucketConfigEvent is an event carrying the configs of its bucket before and after a change.
+type bucketConfigEvent struct {
+	Event
+	oldCfg, newCfg *pbconfig.BucketConfig
+}
+
+func (b *bucketConfigEvent) String() string {
+	return fmt.Sprintf("bucketConfigEvent{%v, old: %v, new: %v}", b.Event, b.oldCfg, b.newCfg)
+}
+
+func (b *bucketConfigEvent) OldBucketConfig() *pbconfig.BucketConfig {
+	return b.oldCfg
+}
+
+func (b *bucketConfigEvent) NewBucketConfig() *pbconfig.BucketConfig {
+	return b.newCfg
+}
+
+func (b *bucketConfigEvent) Labels() map[string]string {
+	return Labels(b.Event)
+}
+
+func (b *bucketConfigEvent) Weight() int64 {
+	return Weight(b.Event)
+}
+
+func (b *bucketConfigEvent) QueueTime() (time.Duration, bool) {
+	return QueueTime(b.Event)
+}
+
+// WithBucketConfigs wraps an event about a bucket created, modified or removed to carry its configs
+// before and after the change, which are shared rather than copied.
+func WithBucketConfigs(e Event, oldCfg, newCfg *pbconfig.BucketConfig) Event {
+	return &bucketConfigEvent{Event: e, oldCfg: oldCfg, newCfg: newCfg}
+}
+
+// NewBucketModifiedEvent creates a new event with the type EVENT_BUCKET_MODIFIED. It indicates a
+// bucket was reconfigured by a config change, and carries its configs before and after.
+func NewBucketModifiedEvent(namespace, bucketName string, dynamic bool, oldCfg, newCfg *pbconfig.BucketConfig) Event {
+	return WithBucketConfigs(newNamedEvent(namespace, bucketName, dynamic, EVENT_BUCKET_MODIFIED), oldCfg, newCfg)
+}
@@ -0,0 +1,38 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package events
+
+import (
+	"testing"
+
+	pbconfig "github.com/square/quotaservice/protos/config"
+)
+
+func TestBucketConfigs(t *testing.T) {
+	oldCfg := &pbconfig.BucketConfig{Name: "b", Size: 100}
+	newCfg := &pbconfig.BucketConfig{Name: "b", Size: 50}
+
+	if _, _, ok := BucketConfigs(NewBucketCreatedEvent("ns", "b", false)); ok {
+		t.Error("Expected an event without configs not to report them")
+	}
+
+	e := NewBucketModifiedEvent("ns", "b", true, oldCfg, newCfg)
+	if e.EventType() != EVENT_BUCKET_MODIFIED || e.Namespace() != "ns" || e.BucketName() != "b" || !e.Dynamic() {
+		t.Errorf("Unexpected event %v", e)
+	}
+
+	if o, n, ok := BucketConfigs(e); !ok || o != oldCfg || n != newCfg {
+		t.Errorf("Expected the configs before and after, got %v to %v", o, n)
+	}
+
+	labels := map[string]string{"team": "search"}
+	wrapped := WithBucketConfigs(NewSampledEvent(NewLabeledEvent(NewBucketRemovedEvent("ns", "b", false), labels), 5), oldCfg, nil)
+	if o, n, ok := BucketConfigs(wrapped); !ok || o != oldCfg || n != nil {
+		t.Errorf("Expected the config before only, got %v to %v", o, n)
+	}
+
+	if Labels(wrapped)["team"] != "search" || Weight(wrapped) != 5 {
+		t.Errorf("Expected a labeled event weighing 5, got %v", wrapped)
+	}
+}
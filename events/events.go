@@ -5,6 +5,8 @@ package events
 
 import (
 	"fmt"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/square/quotaservice/logging"
@@ -21,17 +23,62 @@ const (
 	EVENT_BUCKET_REMOVED
 	EVENT_SERVER_ERROR
 	EVENT_BUCKET_ERROR
+	EVENT_CONFIG_RELOADED
+	EVENT_CONFIG_RELOAD_FAILED
+	EVENT_CIRCUIT_BREAKER_STATE_CHANGED
+	EVENT_BUCKET_CLAMPED
+	EVENT_CONFIG_SIGNATURE_INVALID
+	EVENT_UNKNOWN_NAMESPACE
+	EVENT_WOULD_REJECT
+	EVENT_CAP_REACHED
+	EVENT_BUCKET_MODIFIED
+	EVENT_RAMP_COMPLETED
+	EVENT_CONFIG_ACTIVATED
+	EVENT_BUCKET_STALE
 )
 
 var eventNames = []string{
-	EVENT_TOKENS_SERVED:             "EVENT_TOKENS_SERVED",
-	EVENT_TIMEOUT_SERVING_TOKENS:    "EVENT_TIMEOUT_SERVING_TOKENS",
-	EVENT_TOO_MANY_TOKENS_REQUESTED: "EVENT_TOO_MANY_TOKENS_REQUESTED",
-	EVENT_BUCKET_MISS:               "EVENT_BUCKET_MISS",
-	EVENT_BUCKET_CREATED:            "EVENT_BUCKET_CREATED",
-	EVENT_BUCKET_REMOVED:            "EVENT_BUCKET_REMOVED",
-	EVENT_SERVER_ERROR:              "EVENT_SERVER_ERROR",
-	EVENT_BUCKET_ERROR:              "EVENT_BUCKET_ERROR",
+	EVENT_TOKENS_SERVED:                 "EVENT_TOKENS_SERVED",
+	EVENT_TIMEOUT_SERVING_TOKENS:        "EVENT_TIMEOUT_SERVING_TOKENS",
+	EVENT_TOO_MANY_TOKENS_REQUESTED:     "EVENT_TOO_MANY_TOKENS_REQUESTED",
+	EVENT_BUCKET_MISS:                   "EVENT_BUCKET_MISS",
+	EVENT_BUCKET_CREATED:                "EVENT_BUCKET_CREATED",
+	EVENT_BUCKET_REMOVED:                "EVENT_BUCKET_REMOVED",
+	EVENT_SERVER_ERROR:                  "EVENT_SERVER_ERROR",
+	EVENT_BUCKET_ERROR:                  "EVENT_BUCKET_ERROR",
+	EVENT_CONFIG_RELOADED:               "EVENT_CONFIG_RELOADED",
+	EVENT_CONFIG_RELOAD_FAILED:          "EVENT_CONFIG_RELOAD_FAILED",
+	EVENT_CIRCUIT_BREAKER_STATE_CHANGED: "EVENT_CIRCUIT_BREAKER_STATE_CHANGED",
+	EVENT_BUCKET_CLAMPED:                "EVENT_BUCKET_CLAMPED",
+	EVENT_CONFIG_SIGNATURE_INVALID:      "EVENT_CONFIG_SIGNATURE_INVALID",
+	EVENT_UNKNOWN_NAMESPACE:             "EVENT_UNKNOWN_NAMESPACE",
+	EVENT_WOULD_REJECT:                  "EVENT_WOULD_REJECT",
+	EVENT_CAP_REACHED:                   "EVENT_CAP_REACHED",
+	EVENT_BUCKET_MODIFIED:               "EVENT_BUCKET_MODIFIED",
+	EVENT_RAMP_COMPLETED:                "EVENT_RAMP_COMPLETED",
+	EVENT_CONFIG_ACTIVATED:              "EVENT_CONFIG_ACTIVATED",
+	EVENT_BUCKET_STALE:                  "EVENT_BUCKET_STALE",
+}
+
+// EventTypeSet is a set of event types, for listeners that only want some events.
+type EventTypeSet uint64
+
+// AllEventTypes contains every event type, for listeners that want everything.
+const AllEventTypes = ^EventTypeSet(0)
+
+// NewEventTypeSet creates a set of event types.
+func NewEventTypeSet(types ...EventType) EventTypeSet {
+	var set EventTypeSet
+	for _, t := range types {
+		set |= 1 << uint(t)
+	}
+
+	return set
+}
+
+// Contains returns whether a set contains an event type.
+func (s EventTypeSet) Contains(t EventType) bool {
+	return s&(1<<uint(t)) != 0
 }
 
 func (et EventType) String() string {
@@ -43,6 +90,23 @@ func (et EventType) String() string {
 	return name
 }
 
+// ParseEventType returns the event type with a name, such as EVENT_BUCKET_MISS, ignoring case and
+// allowing the EVENT_ prefix to be left out.
+func ParseEventType(name string) (EventType, bool) {
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "EVENT_") {
+		name = "EVENT_" + name
+	}
+
+	for t, n := range eventNames {
+		if n == name {
+			return EventType(t), true
+		}
+	}
+
+	return 0, false
+}
+
 type Event interface {
 	EventType() EventType
 	Namespace() string
@@ -52,19 +116,123 @@ type Event interface {
 	WaitTime() time.Duration
 }
 
+// ConfigEvent is an Event about reloading the config, with the type EVENT_CONFIG_RELOADED,
+// EVENT_CONFIG_RELOAD_FAILED, EVENT_CONFIG_SIGNATURE_INVALID or EVENT_CONFIG_ACTIVATED. It isn't
+// specific to a namespace or bucket.
+type ConfigEvent interface {
+	Event
+	// Version is the version of the config reloaded, or -1 if it isn't known.
+	Version() int32
+	// Error is why the config couldn't be reloaded, or nil on success.
+	Error() error
+}
+
+// CircuitState is the state of a circuit breaker guarding the backend of a bucket implementation.
+type CircuitState int
+
+const (
+	// CircuitClosed lets calls through to the backend.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen short-circuits calls, since the backend is failing.
+	CircuitOpen
+	// CircuitHalfOpen lets a probe through to test whether the backend has recovered.
+	CircuitHalfOpen
+)
+
+var circuitStateNames = []string{
+	CircuitClosed:   "closed",
+	CircuitOpen:     "open",
+	CircuitHalfOpen: "half_open",
+}
+
+func (c CircuitState) String() string {
+	return circuitStateNames[c]
+}
+
+// CircuitBreakerEvent is an Event about a circuit breaker changing state, with the type
+// EVENT_CIRCUIT_BREAKER_STATE_CHANGED. It isn't specific to a namespace or bucket.
+type CircuitBreakerEvent interface {
+	Event
+	// Backend names what the circuit breaker guards, such as "redis".
+	Backend() string
+	// State is the state the circuit breaker changed to.
+	State() CircuitState
+}
+
+// DropPolicy decides which events are dropped when a listener falls behind and the event buffer
+// is full. Events are never allowed to block the goroutine emitting them, since that is usually
+// serving a request.
+type DropPolicy int
+
+const (
+	// DropNewest drops the event being emitted, preserving the events already buffered.
+	DropNewest DropPolicy = iota
+	// DropOldest drops the oldest buffered event to make room for the event being emitted, so
+	// listeners see the most recent events once they catch up.
+	DropOldest
+)
+
+// Only one in every dropLogInterval dropped events is logged, so a stalled listener doesn't flood
+// the log.
+const dropLogInterval = 1000
+
 // EventProducer is a hook into the notification system, to inform listeners that certain events
-// take place.
+// take place. Events are buffered and delivered to the listener by a separate goroutine, so a slow
+// listener never blocks Emit; events are dropped according to the DropPolicy instead.
 type EventProducer struct {
-	c chan Event
+	c       chan Event
+	policy  DropPolicy
+	types   EventTypeSet
+	dropped uint64 // Accessed atomically
 }
 
+// Emit queues an event for the listener, without blocking. Events of types the listener didn't
+// register for are discarded without being queued.
 func (e *EventProducer) Emit(event Event) {
+	if !e.types.Contains(event.EventType()) {
+		return
+	}
+
 	select {
 	case e.c <- event:
-	// OK
+		return
 	default:
-		logging.Printf("Event buffer full; dropping %s event for %s.%s", event.EventType(), event.Namespace(), event.BucketName())
 	}
+
+	if e.policy == DropOldest {
+		// Make room by discarding the oldest event, unless the listener gets there first.
+		select {
+		case oldest := <-e.c:
+			e.drop(oldest)
+		default:
+		}
+
+		select {
+		case e.c <- event:
+			return
+		default:
+		}
+	}
+
+	e.drop(event)
+}
+
+func (e *EventProducer) drop(event Event) {
+	if n := atomic.AddUint64(&e.dropped, 1); n%dropLogInterval == 1 {
+		logging.Printf("Event buffer full; dropping %s event for %s.%s (%d events dropped so far)",
+			event.EventType(), event.Namespace(), event.BucketName(), n)
+	}
+}
+
+// Dropped returns the number of events dropped because the buffer was full.
+func (e *EventProducer) Dropped() uint64 {
+	return atomic.LoadUint64(&e.dropped)
+}
+
+// stop stops the listener once it has been notified of the events already queued. Emit must not be
+// called afterwards.
+func (e *EventProducer) stop() {
+	close(e.c)
 }
 
 func (e *EventProducer) notifyListeners(l Listener) {
@@ -77,13 +245,27 @@ func (e *EventProducer) notifyListeners(l Listener) {
 type Listener func(details Event)
 
 // RegisterListener takes a Listener and a buffer size and
-// returns an EventProducer that consumes events and notifies listeners
+// returns an EventProducer that consumes events and notifies listeners.
+// Events are dropped with the DropNewest policy when the buffer is full.
 func RegisterListener(listener Listener, bufsize int) *EventProducer {
+	return RegisterListenerWithDropPolicy(listener, bufsize, DropNewest)
+}
+
+// RegisterListenerWithDropPolicy is like RegisterListener, with the policy used to drop events
+// when the buffer is full.
+func RegisterListenerWithDropPolicy(listener Listener, bufsize int, policy DropPolicy) *EventProducer {
+	return RegisterFilteredListener(listener, bufsize, policy, AllEventTypes)
+}
+
+// RegisterFilteredListener is like RegisterListenerWithDropPolicy, for a listener that is only
+// notified of events with types in a set. Other events are never queued, so cost the listener
+// nothing.
+func RegisterFilteredListener(listener Listener, bufsize int, policy DropPolicy, types EventTypeSet) *EventProducer {
 	if listener == nil {
 		panic("Cannot register a nil listener")
 	}
 
-	ep := &EventProducer{make(chan Event, bufsize)}
+	ep := &EventProducer{c: make(chan Event, bufsize), policy: policy, types: types}
 
 	go ep.notifyListeners(listener)
 
@@ -191,6 +373,49 @@ func NewBucketRemovedEvent(namespace, bucketName string, dynamic bool) Event {
 	return newNamedEvent(namespace, bucketName, dynamic, EVENT_BUCKET_REMOVED)
 }
 
+// NewBucketStaleEvent creates a new event with the type EVENT_BUCKET_STALE. It indicates a dynamic
+// bucket went idle for its max idle time, and is kept for its eviction grace period before it is
+// removed unless accessed again.
+func NewBucketStaleEvent(namespace, bucketName string) Event {
+	return newNamedEvent(namespace, bucketName, true, EVENT_BUCKET_STALE)
+}
+
+// NewBucketClampedEvent creates a new event with the type EVENT_BUCKET_CLAMPED. It indicates a
+// config reload shrank a bucket below its balance, dropping numTokens from it.
+func NewBucketClampedEvent(namespace, bucketName string, dynamic bool, numTokens int64) Event {
+	return &tokenEvent{
+		namedEvent: newNamedEvent(namespace, bucketName, dynamic, EVENT_BUCKET_CLAMPED),
+		numTokens:  numTokens}
+}
+
+// NewUnknownNamespaceEvent creates a new event with the type EVENT_UNKNOWN_NAMESPACE. It indicates
+// a request for a namespace missing from the config, whether or not it was served.
+func NewUnknownNamespaceEvent(namespace, bucketName string) Event {
+	return newNamedEvent(namespace, bucketName, false, EVENT_UNKNOWN_NAMESPACE)
+}
+
+// NewWouldRejectEvent creates a new event with the type EVENT_WOULD_REJECT. It indicates a request
+// for numTokens from a disabled bucket that was granted, but that the bucket would have rejected.
+func NewWouldRejectEvent(namespace, bucketName string, dynamic bool, numTokens int64) Event {
+	return &tokenEvent{
+		namedEvent: newNamedEvent(namespace, bucketName, dynamic, EVENT_WOULD_REJECT),
+		numTokens:  numTokens}
+}
+
+// NewCapReachedEvent creates a new event with the type EVENT_CAP_REACHED. It indicates a request
+// for numTokens rejected as its bucket has served its token cap for the current window.
+func NewCapReachedEvent(namespace, bucketName string, dynamic bool, numTokens int64) Event {
+	return &tokenEvent{
+		namedEvent: newNamedEvent(namespace, bucketName, dynamic, EVENT_CAP_REACHED),
+		numTokens:  numTokens}
+}
+
+// NewRampCompletedEvent creates a new event with the type EVENT_RAMP_COMPLETED. It indicates the
+// fill rate ramp configured on a bucket finished, so the bucket now fills at its fill_rate.
+func NewRampCompletedEvent(namespace, bucketName string, dynamic bool) Event {
+	return newNamedEvent(namespace, bucketName, dynamic, EVENT_RAMP_COMPLETED)
+}
+
 // NewServerErrorEvent creates a new event with the type EVENT_SERVER_ERROR
 func NewServerErrorEvent(namespace, bucketName string, dynamic bool) Event {
 	return newNamedEvent(namespace, bucketName, dynamic, EVENT_SERVER_ERROR)
@@ -203,6 +428,85 @@ func NewBucketErrorEvent(namespace, bucketName string, dynamic bool) Event {
 	return newNamedEvent(namespace, bucketName, dynamic, EVENT_BUCKET_ERROR)
 }
 
+type configEvent struct {
+	*namedEvent
+	version int32
+	err     error
+}
+
+func (c *configEvent) String() string {
+	return fmt.Sprintf("configEvent{type: %v, version: %v, error: %v}", c.eventType, c.version, c.err)
+}
+
+func (c *configEvent) Version() int32 {
+	return c.version
+}
+
+func (c *configEvent) Error() error {
+	return c.err
+}
+
+// NewConfigReloadedEvent creates a new event with the type EVENT_CONFIG_RELOADED
+func NewConfigReloadedEvent(version int32) ConfigEvent {
+	return &configEvent{
+		namedEvent: newNamedEvent("", "", false, EVENT_CONFIG_RELOADED),
+		version:    version}
+}
+
+// NewConfigReloadFailedEvent creates a new event with the type EVENT_CONFIG_RELOAD_FAILED. It
+// indicates the persisted config couldn't be read or applied, so the server is still running on
+// its previous config. The version is -1 if it isn't known.
+func NewConfigReloadFailedEvent(version int32, err error) ConfigEvent {
+	return &configEvent{
+		namedEvent: newNamedEvent("", "", false, EVENT_CONFIG_RELOAD_FAILED),
+		version:    version,
+		err:        err}
+}
+
+// NewConfigSignatureInvalidEvent creates a new event with the type EVENT_CONFIG_SIGNATURE_INVALID.
+// It indicates the persisted config failed signature verification, so may have been tampered with,
+// and was refused. The version is -1 if it isn't known.
+func NewConfigSignatureInvalidEvent(version int32, err error) ConfigEvent {
+	return &configEvent{
+		namedEvent: newNamedEvent("", "", false, EVENT_CONFIG_SIGNATURE_INVALID),
+		version:    version,
+		err:        err}
+}
+
+// NewConfigActivatedEvent creates a new event with the type EVENT_CONFIG_ACTIVATED. It indicates a
+// config persisted with an activation time took effect once the time passed.
+func NewConfigActivatedEvent(version int32) ConfigEvent {
+	return &configEvent{
+		namedEvent: newNamedEvent("", "", false, EVENT_CONFIG_ACTIVATED),
+		version:    version}
+}
+
+type circuitBreakerEvent struct {
+	*namedEvent
+	backend string
+	state   CircuitState
+}
+
+func (c *circuitBreakerEvent) String() string {
+	return fmt.Sprintf("circuitBreakerEvent{type: %v, backend: %v, state: %v}", c.eventType, c.backend, c.state)
+}
+
+func (c *circuitBreakerEvent) Backend() string {
+	return c.backend
+}
+
+func (c *circuitBreakerEvent) State() CircuitState {
+	return c.state
+}
+
+// NewCircuitBreakerEvent creates a new event with the type EVENT_CIRCUIT_BREAKER_STATE_CHANGED
+func NewCircuitBreakerEvent(backend string, state CircuitState) CircuitBreakerEvent {
+	return &circuitBreakerEvent{
+		namedEvent: newNamedEvent("", "", false, EVENT_CIRCUIT_BREAKER_STATE_CHANGED),
+		backend:    backend,
+		state:      state}
+}
+
 func newNamedEvent(namespace, bucketName string, dynamic bool, eventType EventType) *namedEvent {
 	return &namedEvent{
 		eventType:  eventType,
@@ -0,0 +1,154 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+// stalledListener blocks on every event until released, signalling each event it receives.
+func stalledListener(received chan<- Event, release <-chan struct{}) Listener {
+	return func(e Event) {
+		received <- e
+		<-release
+	}
+}
+
+// fillStalled registers a stalled listener, and emits events with increasing token counts until
+// the listener holds the first and the buffer is full.
+func fillStalled(t *testing.T, policy DropPolicy, bufsize int) (*EventProducer, chan Event, chan struct{}) {
+	t.Helper()
+
+	received := make(chan Event, 100)
+	release := make(chan struct{})
+	p := RegisterListenerWithDropPolicy(stalledListener(received, release), bufsize, policy)
+
+	p.Emit(NewTimedOutEvent("ns", "b", false, 0))
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("Listener didn't receive the first event")
+	}
+
+	for i := 1; i <= bufsize; i++ {
+		p.Emit(NewTimedOutEvent("ns", "b", false, int64(i)))
+	}
+
+	return p, received, release
+}
+
+func TestDropNewest(t *testing.T) {
+	p, received, release := fillStalled(t, DropNewest, 2)
+
+	for i := 3; i <= 5; i++ {
+		p.Emit(NewTimedOutEvent("ns", "b", false, int64(i)))
+	}
+
+	if p.Dropped() != 3 {
+		t.Errorf("Expected 3 events dropped, got %v", p.Dropped())
+	}
+
+	close(release)
+	for _, expected := range []int64{1, 2} {
+		if e := <-received; e.NumTokens() != expected {
+			t.Errorf("Expected the buffered event %v, got %v", expected, e.NumTokens())
+		}
+	}
+}
+
+func TestDropOldest(t *testing.T) {
+	p, received, release := fillStalled(t, DropOldest, 2)
+
+	for i := 3; i <= 5; i++ {
+		p.Emit(NewTimedOutEvent("ns", "b", false, int64(i)))
+	}
+
+	if p.Dropped() != 3 {
+		t.Errorf("Expected 3 events dropped, got %v", p.Dropped())
+	}
+
+	close(release)
+	for _, expected := range []int64{4, 5} {
+		if e := <-received; e.NumTokens() != expected {
+			t.Errorf("Expected the newest event %v, got %v", expected, e.NumTokens())
+		}
+	}
+}
+
+func TestNoDropsWhenKeepingUp(t *testing.T) {
+	received := make(chan Event, 10)
+	p := RegisterListener(func(e Event) { received <- e }, 10)
+
+	for i := 0; i < 10; i++ {
+		p.Emit(NewBucketMissedEvent("ns", "b", false))
+		<-received
+	}
+
+	if p.Dropped() != 0 {
+		t.Errorf("Expected no events dropped, got %v", p.Dropped())
+	}
+}
+
+// BenchmarkEmitStalledListener shows emitting doesn't block while the listener is stalled.
+func BenchmarkEmitStalledListener(b *testing.B) {
+	for _, policy := range []struct {
+		name   string
+		policy DropPolicy
+	}{{"DropNewest", DropNewest}, {"DropOldest", DropOldest}} {
+		b.Run(policy.name, func(b *testing.B) {
+			release := make(chan struct{})
+			defer close(release)
+
+			p := RegisterListenerWithDropPolicy(func(Event) { <-release }, 100, policy.policy)
+			e := NewTokensServedEvent("ns", "b", false, 1, 0)
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					p.Emit(e)
+				}
+			})
+		})
+	}
+}
+
+func TestEventTypeSet(t *testing.T) {
+	set := NewEventTypeSet(EVENT_TIMEOUT_SERVING_TOKENS, EVENT_CONFIG_RELOAD_FAILED)
+
+	for _, et := range []EventType{EVENT_TOKENS_SERVED, EVENT_TIMEOUT_SERVING_TOKENS, EVENT_BUCKET_MISS, EVENT_CONFIG_RELOAD_FAILED} {
+		expected := et == EVENT_TIMEOUT_SERVING_TOKENS || et == EVENT_CONFIG_RELOAD_FAILED
+		if set.Contains(et) != expected {
+			t.Errorf("Expected Contains(%v) to be %v", et, expected)
+		}
+
+		if !AllEventTypes.Contains(et) {
+			t.Errorf("Expected AllEventTypes to contain %v", et)
+		}
+	}
+}
+
+func TestFilteredListener(t *testing.T) {
+	received := make(chan Event, 10)
+	p := RegisterFilteredListener(func(e Event) { received <- e }, 10, DropNewest,
+		NewEventTypeSet(EVENT_TIMEOUT_SERVING_TOKENS, EVENT_CONFIG_RELOAD_FAILED))
+
+	p.Emit(NewTokensServedEvent("ns", "b", false, 1, 0))
+	p.Emit(NewTimedOutEvent("ns", "b", false, 1))
+	p.Emit(NewBucketMissedEvent("ns", "b", false))
+	p.Emit(NewConfigReloadFailedEvent(2, nil))
+	p.Emit(NewBucketCreatedEvent("ns", "b", true))
+
+	for _, expected := range []EventType{EVENT_TIMEOUT_SERVING_TOKENS, EVENT_CONFIG_RELOAD_FAILED} {
+		if e := <-received; e.EventType() != expected {
+			t.Errorf("Expected %v, got %v", expected, e.EventType())
+		}
+	}
+
+	select {
+	case e := <-received:
+		t.Errorf("Received excluded event %v", e.EventType())
+	case <-time.After(50 * time.Millisecond):
+	}
+}
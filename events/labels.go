@@ -0,0 +1,61 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package events
+
+import (
+	"fmt"
+	"time"
+)
+
+// CatchAllLabel is the label of events about requests served by the catch-all bucket as they match
+// no bucket, set to the bucket requested, such as "ns:bucket", so the catch-all's volume can be told
+// apart from requests for the catch-all bucket itself.
+const CatchAllLabel = "catch_all"
+
+// Labeled is implemented by events about buckets configured with labels.
+type Labeled interface {
+	// Labels are the labels of the bucket the event is about. They must not be modified.
+	Labels() map[string]string
+}
+
+// Labels returns the labels of the bucket an event is about, or nil if it has none.
+func Labels(e Event) map[string]string {
+	if l, ok := e.(Labeled); ok {
+		return l.Labels()
+	}
+
+	return nil
+}
+
+// labeledEvent is an event carrying the labels of its bucket.
+type labeledEvent struct {
+	Event
+	labels map[string]string
+}
+
+func (l *labeledEvent) String() string {
+	return fmt.Sprintf("labeledEvent{%v, labels: %v}", l.Event, l.labels)
+}
+
+func (l *labeledEvent) Labels() map[string]string {
+	return l.labels
+}
+
+func (l *labeledEvent) Weight() int64 {
+	return Weight(l.Event)
+}
+
+func (l *labeledEvent) QueueTime() (time.Duration, bool) {
+	return QueueTime(l.Event)
+}
+
+// NewLabeledEvent wraps an event to carry the labels of its bucket, which are shared rather than
+// copied.
+func NewLabeledEvent(e Event, labels map[string]string) Event {
+	if len(labels) == 0 {
+		return e
+	}
+
+	return &labeledEvent{e, labels}
+}
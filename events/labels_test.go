@@ -0,0 +1,42 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package events
+
+import (
+	"testing"
+)
+
+func TestLabels(t *testing.T) {
+	e := NewTokensServedEvent("ns", "dyn", true, 1, 0)
+
+	if l := Labels(e); l != nil {
+		t.Errorf("Expected an unlabeled event to have no labels, got %v", l)
+	}
+
+	if NewLabeledEvent(e, nil) != e {
+		t.Error("Expected an event without labels to be left unwrapped")
+	}
+
+	labels := map[string]string{"team": "search"}
+	labeled := NewLabeledEvent(e, labels)
+
+	if l := Labels(labeled); l["team"] != "search" {
+		t.Errorf("Expected the event to be labeled, got %v", l)
+	}
+
+	if labeled.NumTokens() != 1 || labeled.BucketName() != "dyn" {
+		t.Errorf("Expected the labeled event to describe the same tokens, got %v", labeled)
+	}
+
+	// Labels and weights survive sampling and aggregation in either order.
+	for _, wrapped := range []Event{
+		NewSampledEvent(labeled, 5),
+		NewLabeledEvent(NewSampledEvent(e, 5), labels),
+		Aggregate(NewSampledEvent(labeled, 5), AggregateAll),
+	} {
+		if Labels(wrapped)["team"] != "search" || Weight(wrapped) != 5 {
+			t.Errorf("Expected a labeled event weighing 5, got %v", wrapped)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package events
+
+import (
+	"fmt"
+	"time"
+)
+
+// Queued is implemented by events about requests that were served or timed out, carrying how long
+// the request actually blocked taking tokens. Unlike WaitTime, the wait predicted for the caller,
+// this measures contention, such as for a bucket's waiters or a remote bucket's round trip.
+type Queued interface {
+	// QueueTime is the time from the request starting to take tokens to it being granted them or
+	// giving up, and false if the event doesn't carry one, such as a wrapper of one that doesn't.
+	QueueTime() (time.Duration, bool)
+}
+
+// QueueTime returns how long the request an event is about queued for tokens, and whether the
+// event carries a queue time at all.
+func QueueTime(e Event) (time.Duration, bool) {
+	if q, ok := e.(Queued); ok {
+		return q.QueueTime()
+	}
+
+	return 0, false
+}
+
+// queuedEvent is an event carrying the queue time of its request.
+type queuedEvent struct {
+	Event
+	queueTime time.Duration
+}
+
+func (q *queuedEvent) String() string {
+	return fmt.Sprintf("queuedEvent{%v, queueTime: %v}", q.Event, q.queueTime)
+}
+
+func (q *queuedEvent) QueueTime() (time.Duration, bool) {
+	return q.queueTime, true
+}
+
+func (q *queuedEvent) Labels() map[string]string {
+	return Labels(q.Event)
+}
+
+func (q *queuedEvent) Weight() int64 {
+	return Weight(q.Event)
+}
+
+// NewQueuedEvent wraps an event to carry the time its request queued for tokens.
+func NewQueuedEvent(e Event, queueTime time.Duration) Event {
+	return &queuedEvent{e, queueTime}
+}
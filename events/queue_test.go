@@ -0,0 +1,44 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueueTime(t *testing.T) {
+	e := NewTokensServedEvent("ns", "dyn", true, 1, time.Second)
+
+	if _, ok := QueueTime(e); ok {
+		t.Error("Expected an event without a queue time not to report one")
+	}
+
+	labels := map[string]string{"team": "search"}
+	if _, ok := QueueTime(NewSampledEvent(NewLabeledEvent(e, labels), 5)); ok {
+		t.Error("Expected wrapping an event without a queue time not to report one")
+	}
+
+	queued := NewQueuedEvent(e, 30*time.Millisecond)
+	if queued.WaitTime() != time.Second || queued.NumTokens() != 1 {
+		t.Errorf("Expected the queued event to describe the same tokens, got %v", queued)
+	}
+
+	// Queue times survive labeling, sampling and aggregation, as do labels and weights.
+	for _, wrapped := range []Event{
+		queued,
+		NewSampledEvent(NewLabeledEvent(queued, labels), 5),
+		Aggregate(NewSampledEvent(NewLabeledEvent(queued, labels), 5), AggregateAll),
+		NewQueuedEvent(NewSampledEvent(NewLabeledEvent(e, labels), 5), 30*time.Millisecond),
+	} {
+		if q, ok := QueueTime(wrapped); !ok || q != 30*time.Millisecond {
+			t.Errorf("Expected a queue time of 30ms, got %v from %v", q, wrapped)
+		}
+	}
+
+	wrapped := NewQueuedEvent(NewSampledEvent(NewLabeledEvent(e, labels), 5), 0)
+	if Labels(wrapped)["team"] != "search" || Weight(wrapped) != 5 {
+		t.Errorf("Expected a labeled event weighing 5, got %v", wrapped)
+	}
+}
@@ -0,0 +1,95 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package events
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ListenerRegistry notifies named listeners that may be registered and unregistered while events
+// are emitted. Each listener has its own buffer and goroutine, so a slow listener only drops its
+// own events.
+type ListenerRegistry struct {
+	listeners map[string]*registeredListener
+	sync.RWMutex
+}
+
+type registeredListener struct {
+	producer *EventProducer
+	types    EventTypeSet
+}
+
+// ListenerInfo describes a listener registered with a ListenerRegistry.
+type ListenerInfo struct {
+	Name string
+	// Types are the event types the listener is notified of.
+	Types EventTypeSet
+	// Dropped is the number of events dropped because the listener's buffer was full.
+	Dropped uint64
+}
+
+// NewListenerRegistry creates a ListenerRegistry with no listeners.
+func NewListenerRegistry() *ListenerRegistry {
+	return &ListenerRegistry{listeners: make(map[string]*registeredListener)}
+}
+
+// Register adds a listener under a name, notified of events with types in a set through a buffer
+// of bufSize events, dropped according to policy when full. It fails if the name is taken.
+func (r *ListenerRegistry) Register(name string, listener Listener, bufSize int, policy DropPolicy, types EventTypeSet) error {
+	if bufSize < 1 {
+		bufSize = 1
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if _, exists := r.listeners[name]; exists {
+		return fmt.Errorf("listener %v is already registered", name)
+	}
+
+	r.listeners[name] = &registeredListener{RegisterFilteredListener(listener, bufSize, policy, types), types}
+	return nil
+}
+
+// Unregister removes the listener registered under a name, returning false if there was none. The
+// listener is still notified of the events already in its buffer.
+func (r *ListenerRegistry) Unregister(name string) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	l, exists := r.listeners[name]
+	if !exists {
+		return false
+	}
+
+	delete(r.listeners, name)
+	l.producer.stop()
+	return true
+}
+
+// Emit queues an event for the listeners registered for its type, without blocking.
+func (r *ListenerRegistry) Emit(e Event) {
+	r.RLock()
+	defer r.RUnlock()
+
+	for _, l := range r.listeners {
+		l.producer.Emit(e)
+	}
+}
+
+// Listeners describes the registered listeners, ordered by name.
+func (r *ListenerRegistry) Listeners() []ListenerInfo {
+	r.RLock()
+	defer r.RUnlock()
+
+	infos := make([]ListenerInfo, 0, len(r.listeners))
+	for name, l := range r.listeners {
+		infos = append(infos, ListenerInfo{Name: name, Types: l.types, Dropped: l.producer.Dropped()})
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
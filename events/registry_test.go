@@ -0,0 +1,110 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package events
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestListenerRegistry(t *testing.T) {
+	r := NewListenerRegistry()
+	all := make(chan Event, 10)
+	block := make(chan struct{})
+	defer close(block)
+
+	if err := r.Register("all", func(e Event) { all <- e }, 10, DropNewest, AllEventTypes); err != nil {
+		t.Fatal(err)
+	}
+
+	// Blocks on the first miss, so the third is dropped once the second fills its buffer.
+	if err := r.Register("misses", func(Event) { <-block }, 1, DropNewest, NewEventTypeSet(EVENT_BUCKET_MISS)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Register("all", func(Event) {}, 1, DropNewest, AllEventTypes); err == nil {
+		t.Error("Expected registering a name twice to fail")
+	}
+
+	r.Emit(NewTokensServedEvent("ns", "a", false, 1, 0))
+	r.Emit(NewBucketMissedEvent("ns", "b", true))
+	waitFor(t, func() bool { return len(all) == 2 })
+	r.Emit(NewBucketMissedEvent("ns", "c", true))
+	r.Emit(NewBucketMissedEvent("ns", "d", true))
+	waitFor(t, func() bool { return len(all) == 4 })
+
+	expected := []ListenerInfo{
+		{Name: "all", Types: AllEventTypes},
+		{Name: "misses", Types: NewEventTypeSet(EVENT_BUCKET_MISS), Dropped: 1}}
+	if listeners := r.Listeners(); !reflect.DeepEqual(listeners, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, listeners)
+	}
+
+	if !r.Unregister("all") || r.Unregister("all") {
+		t.Error("Expected a listener to be unregistered once")
+	}
+
+	r.Emit(NewBucketMissedEvent("ns", "e", true))
+	if len(all) != 4 {
+		t.Errorf("Expected an unregistered listener not to be notified, got %v events", len(all))
+	}
+
+	if listeners := r.Listeners(); len(listeners) != 1 || listeners[0].Name != "misses" {
+		t.Errorf("Expected only the remaining listener, got %+v", listeners)
+	}
+}
+
+func TestListenerRegistryConcurrent(t *testing.T) {
+	r := NewListenerRegistry()
+	stop := make(chan struct{})
+	var emitters sync.WaitGroup
+
+	for i := 0; i < 4; i++ {
+		emitters.Add(1)
+		go func() {
+			defer emitters.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					r.Emit(NewTokensServedEvent("ns", "b", false, 1, 0))
+				}
+			}
+		}()
+	}
+
+	var notified int64
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("l%v", i%5)
+		r.Unregister(name)
+		if err := r.Register(name, func(Event) { atomic.AddInt64(&notified, 1) }, 10, DropOldest, AllEventTypes); err != nil {
+			t.Fatal(err)
+		}
+		_ = r.Listeners()
+	}
+
+	waitFor(t, func() bool { return atomic.LoadInt64(&notified) > 0 })
+	close(stop)
+	emitters.Wait()
+
+	if listeners := r.Listeners(); len(listeners) != 5 {
+		t.Errorf("Expected 5 listeners, got %+v", listeners)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,131 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package events
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SamplingPolicy returns N for a namespace whose buckets emit only one in N EVENT_TOKENS_SERVED
+// events, to cut the overhead of events on the hottest buckets. Sampled events carry a Weight of
+// N, so counts scaled by Weight remain approximately correct. Values below 2 disable sampling.
+// Rejections, errors and config events are never sampled, since those matter individually.
+type SamplingPolicy func(namespace string) int64
+
+// SampleNamespaces creates a SamplingPolicy sampling one in N events of the given namespaces,
+// keyed by namespace name.
+func SampleNamespaces(rates map[string]int64) SamplingPolicy {
+	set := make(map[string]int64, len(rates))
+	for ns, n := range rates {
+		set[ns] = n
+	}
+
+	return func(namespace string) int64 {
+		return set[namespace]
+	}
+}
+
+// Weighted is implemented by events standing in for several occurrences, such as sampled events.
+type Weighted interface {
+	// Weight is the number of occurrences the event stands for.
+	Weight() int64
+}
+
+// Weight returns the number of occurrences an event stands for: its Weight if it is Weighted, or
+// 1 otherwise. Listeners counting events or tokens should scale their counts by it.
+func Weight(e Event) int64 {
+	if w, ok := e.(Weighted); ok {
+		return w.Weight()
+	}
+
+	return 1
+}
+
+// sampledEvent is an event standing in for weight events, of which the others weren't emitted.
+type sampledEvent struct {
+	Event
+	weight int64
+}
+
+func (s *sampledEvent) String() string {
+	return fmt.Sprintf("sampledEvent{%v, weight: %v}", s.Event, s.weight)
+}
+
+func (s *sampledEvent) Weight() int64 {
+	return s.weight
+}
+
+func (s *sampledEvent) Labels() map[string]string {
+	return Labels(s.Event)
+}
+
+func (s *sampledEvent) QueueTime() (time.Duration, bool) {
+	return QueueTime(s.Event)
+}
+
+// NewSampledEvent wraps an event to stand in for weight occurrences.
+func NewSampledEvent(e Event, weight int64) Event {
+	if weight <= 1 {
+		return e
+	}
+
+	return &sampledEvent{e, weight}
+}
+
+// Sampler decides which EVENT_TOKENS_SERVED events are emitted according to a SamplingPolicy,
+// counting requests per bucket so every bucket is sampled evenly however busy the others are.
+type Sampler struct {
+	policy  SamplingPolicy
+	buckets map[sampleKey]*uint64
+	sync.RWMutex
+}
+
+type sampleKey struct {
+	namespace, bucket string
+}
+
+// NewSampler creates a Sampler.
+func NewSampler(policy SamplingPolicy) *Sampler {
+	return &Sampler{policy: policy, buckets: make(map[sampleKey]*uint64)}
+}
+
+// Sample counts a request served by a bucket, returning the weight to emit its event with, or 0 if
+// it shouldn't be emitted. The first of every N requests is emitted.
+func (s *Sampler) Sample(namespace, bucket string) int64 {
+	n := s.policy(namespace)
+	if n <= 1 {
+		return 1
+	}
+
+	key := sampleKey{namespace, bucket}
+	s.RLock()
+	c := s.buckets[key]
+	s.RUnlock()
+
+	if c == nil {
+		s.Lock()
+		if c = s.buckets[key]; c == nil {
+			c = new(uint64)
+			s.buckets[key] = c
+		}
+		s.Unlock()
+	}
+
+	if (atomic.AddUint64(c, 1)-1)%uint64(n) != 0 {
+		return 0
+	}
+
+	return n
+}
+
+// Forget discards the count of a bucket, such as one that was removed.
+func (s *Sampler) Forget(namespace, bucket string) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.buckets, sampleKey{namespace, bucket})
+}
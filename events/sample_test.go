@@ -0,0 +1,83 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package events
+
+import (
+	"testing"
+)
+
+func TestSampler(t *testing.T) {
+	s := NewSampler(SampleNamespaces(map[string]int64{"hot": 10}))
+
+	var emitted, weight int64
+	for i := 0; i < 100; i++ {
+		if w := s.Sample("hot", "a"); w > 0 {
+			emitted++
+			weight += w
+		}
+
+		// Requests to another bucket don't change which of a's requests are sampled.
+		s.Sample("hot", "b")
+	}
+
+	if emitted != 10 || weight != 100 {
+		t.Errorf("Expected 10 events weighing 100 in total, got %v weighing %v", emitted, weight)
+	}
+
+	for i := 0; i < 10; i++ {
+		if w := s.Sample("cold", "a"); w != 1 {
+			t.Fatalf("Expected every event of an unsampled namespace, got weight %v", w)
+		}
+	}
+}
+
+func TestSamplerForget(t *testing.T) {
+	s := NewSampler(SampleNamespaces(map[string]int64{"hot": 3}))
+
+	if w := s.Sample("hot", "a"); w != 3 {
+		t.Errorf("Expected the first event to be emitted, got weight %v", w)
+	}
+
+	s.Forget("hot", "a")
+
+	if w := s.Sample("hot", "a"); w != 3 {
+		t.Errorf("Expected the first event after forgetting to be emitted, got weight %v", w)
+	}
+
+	if len(s.buckets) != 1 {
+		t.Errorf("Expected a single counter, got %v", len(s.buckets))
+	}
+}
+
+func TestWeight(t *testing.T) {
+	e := NewTokensServedEvent("ns", "dyn", true, 1, 0)
+
+	if w := Weight(e); w != 1 {
+		t.Errorf("Expected an unsampled event to weigh 1, got %v", w)
+	}
+
+	if NewSampledEvent(e, 1) != e {
+		t.Error("Expected an event sampled one in one to be unwrapped")
+	}
+
+	sampled := NewSampledEvent(e, 5)
+	if w := Weight(sampled); w != 5 {
+		t.Errorf("Expected a weight of 5, got %v", w)
+	}
+
+	aggregated := Aggregate(sampled, AggregateAll)
+	if w := Weight(aggregated); w != 5 || aggregated.BucketName() != AggregatedBucket {
+		t.Errorf("Expected an aggregated event weighing 5, got %v weighing %v", aggregated, w)
+	}
+}
+
+func BenchmarkSampler(b *testing.B) {
+	s := NewSampler(SampleNamespaces(map[string]int64{"hot": 100}))
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			s.Sample("hot", "a")
+		}
+	})
+}
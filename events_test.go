@@ -66,7 +66,7 @@ func setUp() {
 		helpers.PanicError(e)
 	}
 	qs = me.QuotaService
-	// EVENTS_BUCKET_CREATED event
+	// EVENT_CONFIG_RELOADED event
 	eventsChan = ecLocal
 	<-ecLocal
 }
@@ -103,6 +103,28 @@ func TestWithWait(t *testing.T) {
 	mbf.SetWaitTime("nodyn", "b", 0)
 }
 
+func TestAllowUntil(t *testing.T) {
+	defer mbf.SetWaitTime("nodyn", "b", 0)
+	mbf.SetWaitTime("nodyn", "b", 100*time.Millisecond)
+
+	if w, _, e := qs.AllowUntil(context.Background(), "nodyn", "b", 1, time.Now().Add(time.Second)); e != nil || w != 100*time.Millisecond {
+		t.Fatalf("Not expecting error %+v, wait %v", e, w)
+	}
+	checkEvent("nodyn", "b", false, events.EVENT_TOKENS_SERVED, 1, 100*time.Millisecond, <-eventsChan, t)
+
+	if _, _, e := qs.AllowUntil(context.Background(), "nodyn", "b", 1, time.Now().Add(-time.Second)); e == nil {
+		t.Fatal("Expecting error \"Timed out waiting\" for a past deadline")
+	}
+	checkEvent("nodyn", "b", false, events.EVENT_TIMEOUT_SERVING_TOKENS, 1, 0, <-eventsChan, t)
+
+	// The bucket's max wait time of 1s still applies.
+	mbf.SetWaitTime("nodyn", "b", 2*time.Second)
+	if _, _, e := qs.AllowUntil(context.Background(), "nodyn", "b", 1, time.Now().Add(time.Hour)); e == nil {
+		t.Fatal("Expecting error \"Timed out waiting\" beyond the bucket's max wait time")
+	}
+	checkEvent("nodyn", "b", false, events.EVENT_TIMEOUT_SERVING_TOKENS, 1, 0, <-eventsChan, t)
+}
+
 func TestNoSuchBucket(t *testing.T) {
 	if _, _, e := qs.Allow(context.Background(), "nodyn", "x", 1, 0, false); e == nil {
 		t.Fatal("Expecting error \"No such bucket\"")
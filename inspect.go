@@ -0,0 +1,495 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package quotaservice
+
+import (
+	"container/heap"
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/square/quotaservice/admin"
+	"github.com/square/quotaservice/config"
+)
+
+// peekTimeout bounds how long inspecting a bucket waits for its implementation to report the
+// available tokens.
+const peekTimeout = time.Second
+
+// trackedBucket is a wrapper around a bucket that records its activity, for inspection via the
+// admin API. All buckets in a bucketContainer are tracked.
+type trackedBucket struct {
+	Bucket
+	// Accessed atomically
+	lastActivityNanos, tokensServed, waits, waitNanos, timeouts int64
+
+	// Guards waitEnds and taking, which bound the requests waiting by the bucket's max waiters
+	waitMu sync.Mutex
+	// The ends of the waits granted that haven't passed, since buckets grant a wait rather than
+	// serving the tokens once it passes, leaving clients to wait for them
+	waitEnds waitEndHeap
+	// Requests in Take or TakeUntil that may be granted a wait
+	taking int64
+}
+
+func newTrackedBucket(delegate Bucket) *trackedBucket {
+	return &trackedBucket{Bucket: delegate}
+}
+
+// Take is overridden to count tokens served, waits and timeouts, and to bound the requests waiting.
+func (t *trackedBucket) Take(ctx context.Context, numTokens int64, maxWaitTime time.Duration) (time.Duration, bool, error) {
+	w, success, err := t.takeBounded(maxWaitTime > 0, func(wait bool) (time.Duration, bool, error) {
+		if !wait {
+			maxWaitTime = 0
+		}
+
+		return t.Bucket.Take(ctx, numTokens, maxWaitTime)
+	})
+
+	t.record(numTokens, w, success, err)
+	return w, success, err
+}
+
+// TakeUntil implements DeadlineTaker, so the tracked bucket's own implementation is used if it has
+// one.
+func (t *trackedBucket) TakeUntil(ctx context.Context, numTokens int64, deadline time.Time) (time.Duration, bool, error) {
+	w, success, err := t.takeBounded(MaxWaitUntil(deadline) > 0, func(wait bool) (time.Duration, bool, error) {
+		if !wait {
+			return t.Bucket.Take(ctx, numTokens, 0)
+		}
+
+		return TakeUntil(ctx, t.Bucket, numTokens, deadline)
+	})
+
+	t.record(numTokens, w, success, err)
+	return w, success, err
+}
+
+// takeBounded takes tokens with take, passing whether the request may be granted a wait. Requests
+// that could wait may not once the waits granted that haven't passed, along with the requests
+// taking tokens that may be granted one, reach the bucket's max waiters. Those requests are still
+// served tokens available immediately, but are rejected with a *tooManyWaitersError rather than
+// timing out if there are none. Requests that can't wait are neither counted nor bounded.
+func (t *trackedBucket) takeBounded(mayWait bool, take func(wait bool) (time.Duration, bool, error)) (time.Duration, bool, error) {
+	if !mayWait {
+		return take(false)
+	}
+
+	maxWaiters := t.Config().MaxWaiters
+
+	t.waitMu.Lock()
+	t.waitEnds.prune(time.Now().UnixNano())
+	wait := maxWaiters <= 0 || int64(t.waitEnds.Len())+t.taking < maxWaiters
+	if wait {
+		t.taking++
+	}
+	t.waitMu.Unlock()
+
+	w, success, err := take(wait)
+
+	t.waitMu.Lock()
+	if wait {
+		t.taking--
+	}
+
+	if err == nil && success && w > 0 {
+		heap.Push(&t.waitEnds, time.Now().Add(w).UnixNano())
+	}
+	t.waitMu.Unlock()
+
+	if !wait && err == nil && !success {
+		return 0, false, &tooManyWaitersError{maxWaiters: maxWaiters}
+	}
+
+	return w, success, err
+}
+
+// waiters returns the number of requests granted waits that haven't passed.
+func (t *trackedBucket) waiters() int64 {
+	t.waitMu.Lock()
+	defer t.waitMu.Unlock()
+
+	t.waitEnds.prune(time.Now().UnixNano())
+	return int64(t.waitEnds.Len())
+}
+
+// waitEndHeap is a min-heap of the ends of waits, in Unix nanoseconds, implementing heap.Interface.
+type waitEndHeap []int64
+
+func (h waitEndHeap) Len() int {
+	return len(h)
+}
+
+func (h waitEndHeap) Less(i, j int) bool {
+	return h[i] < h[j]
+}
+
+func (h waitEndHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *waitEndHeap) Push(x interface{}) {
+	*h = append(*h, x.(int64))
+}
+
+func (h *waitEndHeap) Pop() interface{} {
+	old := *h
+	end := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return end
+}
+
+// prune removes the waits that ended by nowNanos.
+func (h *waitEndHeap) prune(nowNanos int64) {
+	for h.Len() > 0 && (*h)[0] <= nowNanos {
+		heap.Pop(h)
+	}
+}
+
+func (t *trackedBucket) record(numTokens int64, w time.Duration, success bool, err error) {
+	switch {
+	case err != nil:
+		// Not counted
+	case !success:
+		atomic.AddInt64(&t.timeouts, 1)
+	default:
+		atomic.AddInt64(&t.tokensServed, numTokens)
+		if w > 0 {
+			atomic.AddInt64(&t.waits, 1)
+			atomic.AddInt64(&t.waitNanos, w.Nanoseconds())
+		}
+	}
+}
+
+// ReportActivity is overridden to record the time of the activity.
+func (t *trackedBucket) ReportActivity() {
+	atomic.StoreInt64(&t.lastActivityNanos, time.Now().UnixNano())
+	t.Bucket.ReportActivity()
+}
+
+func (t *trackedBucket) activity() *admin.BucketActivity {
+	return &admin.BucketActivity{
+		TokensServed: atomic.LoadInt64(&t.tokensServed),
+		Waits:        atomic.LoadInt64(&t.waits),
+		WaitMillis:   atomic.LoadInt64(&t.waitNanos) / 1e6,
+		Timeouts:     atomic.LoadInt64(&t.timeouts),
+		Waiters:      t.waiters()}
+}
+
+// unwrapBucket strips the wrappers applied by the bucketContainer and reaper, returning the
+// trackedBucket, if any, and the bucket created by the BucketFactory.
+func unwrapBucket(b Bucket) (*trackedBucket, Bucket) {
+	var tracked *trackedBucket
+
+	for {
+		switch w := b.(type) {
+		case *reapableBucket:
+			b = w.Bucket
+		case *trackedBucket:
+			tracked = w
+			b = w.Bucket
+		default:
+			return tracked, b
+		}
+	}
+}
+
+// inspectableBucket returns the bucket in use for a given namespace and name, without creating it
+// or recording activity. The namespace and global default buckets are found using the name
+// config.DefaultBucketName, and namespace limits using config.NamespaceLimitBucketName.
+func (bc *bucketContainer) inspectableBucket(namespace, name string) Bucket {
+	bc.RLock()
+	defer bc.RUnlock()
+
+	if namespace == config.GlobalNamespace {
+		if name == config.DefaultBucketName {
+			return bc.defaultBucket
+		}
+
+		return nil
+	}
+
+	ns := bc.namespaces[namespace]
+	if ns == nil {
+		return nil
+	}
+
+	ns.RLock()
+	defer ns.RUnlock()
+
+	switch name {
+	case config.DefaultBucketName:
+		return ns.defaultBucket
+	case config.NamespaceLimitBucketName:
+		return ns.limit
+	}
+
+	return ns.buckets[name]
+}
+
+// namedBucket is a bucket and the name it is held under.
+type namedBucket struct {
+	name string
+	b    Bucket
+}
+
+// ForEachBucket calls fn with every active bucket until fn returns false: the global default bucket,
+// then the default bucket, namespace limit and buckets of each namespace, in name order. Default
+// buckets and namespace limits are named as by inspectableBucket. Each namespace is only read locked
+// while its buckets are collected, not while fn runs, so a slow fn doesn't hold up creating buckets.
+// Buckets created during the iteration may be missed, and buckets removed during it still visited.
+func (bc *bucketContainer) ForEachBucket(fn func(namespace, name string, b Bucket) bool) {
+	bc.RLock()
+	global := bc.defaultBucket
+	namespaces := make([]string, 0, len(bc.namespaces))
+	for name := range bc.namespaces {
+		namespaces = append(namespaces, name)
+	}
+	bc.RUnlock()
+
+	if global != nil && !fn(config.GlobalNamespace, config.DefaultBucketName, global) {
+		return
+	}
+
+	sort.Strings(namespaces)
+
+	stopped := false
+	for _, namespace := range namespaces {
+		bc.forEachNamespaceBucket(namespace, func(name string, b Bucket) bool {
+			stopped = !fn(namespace, name, b)
+			return !stopped
+		})
+
+		if stopped {
+			return
+		}
+	}
+}
+
+// forEachNamespaceBucket is ForEachBucket for the buckets of a single namespace, returning false if
+// the namespace doesn't exist.
+func (bc *bucketContainer) forEachNamespaceBucket(namespace string, fn func(name string, b Bucket) bool) bool {
+	bc.RLock()
+	ns := bc.namespaces[namespace]
+	bc.RUnlock()
+
+	if ns == nil {
+		return false
+	}
+
+	var singletons []namedBucket
+
+	ns.RLock()
+	if ns.defaultBucket != nil {
+		singletons = append(singletons, namedBucket{config.DefaultBucketName, ns.defaultBucket})
+	}
+
+	if ns.limit != nil {
+		singletons = append(singletons, namedBucket{config.NamespaceLimitBucketName, ns.limit})
+	}
+
+	buckets := make([]namedBucket, 0, len(ns.buckets))
+	for name, b := range ns.buckets {
+		buckets = append(buckets, namedBucket{name, b})
+	}
+	ns.RUnlock()
+
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].name < buckets[j].name })
+
+	for _, b := range append(singletons, buckets...) {
+		if !fn(b.name, b.b) {
+			break
+		}
+	}
+
+	return true
+}
+
+// dynamicBuckets returns up to limit of the dynamic buckets in a namespace with names starting with
+// prefix and sorting after the cursor, in name order. It also returns the total number of dynamic
+// buckets matching the prefix, and whether the namespace exists. The namespace is only read locked
+// while its buckets are collected, so creating buckets is blocked only briefly.
+func (bc *bucketContainer) dynamicBuckets(namespace, prefix, cursor string, limit int) ([]*admin.DynamicBucket, int, bool) {
+	var matches []namedBucket
+	total := 0
+
+	exists := bc.forEachNamespaceBucket(namespace, func(name string, b Bucket) bool {
+		if b.Dynamic() && strings.HasPrefix(name, prefix) {
+			total++
+			if name > cursor && len(matches) < limit {
+				matches = append(matches, namedBucket{name, b})
+			}
+		}
+
+		return true
+	})
+
+	if !exists {
+		return nil, 0, false
+	}
+
+	page := make([]*admin.DynamicBucket, len(matches))
+	for i, m := range matches {
+		page[i] = &admin.DynamicBucket{Name: m.name}
+		if tracked, _ := unwrapBucket(m.b); tracked != nil {
+			page[i].LastActivityMillis = atomic.LoadInt64(&tracked.lastActivityNanos) / 1e6
+		}
+	}
+
+	return page, total, true
+}
+
+// Implements admin.Administrable
+func (s *server) InspectBucket(namespace, name string) (*admin.BucketInspection, error) {
+	s.RLock()
+	bc := s.bucketContainer
+	s.RUnlock()
+
+	if bc == nil {
+		return nil, nil
+	}
+
+	b := bc.inspectableBucket(namespace, name)
+
+	if b == nil {
+		return nil, nil
+	}
+
+	return s.inspect(namespace, name, b)
+}
+
+// InspectBuckets describes up to limit of the active buckets, in the order visited by
+// ForEachBucket, and whether there were more.
+func (s *server) InspectBuckets(limit int) ([]*admin.BucketInspection, bool, error) {
+	s.RLock()
+	bc := s.bucketContainer
+	s.RUnlock()
+
+	var inspections []*admin.BucketInspection
+	var err error
+	truncated := false
+
+	bc.ForEachBucket(func(namespace, name string, b Bucket) bool {
+		if len(inspections) == limit {
+			truncated = true
+			return false
+		}
+
+		var inspection *admin.BucketInspection
+		if inspection, err = s.inspect(namespace, name, b); err != nil {
+			return false
+		}
+
+		inspections = append(inspections, inspection)
+		return true
+	})
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	return inspections, truncated, nil
+}
+
+// inspect describes the live state of a bucket held by the bucket container.
+func (s *server) inspect(namespace, name string, b Bucket) (*admin.BucketInspection, error) {
+	tracked, delegate := unwrapBucket(b)
+	inspection := &admin.BucketInspection{
+		Namespace: namespace,
+		Name:      name,
+		Dynamic:   b.Dynamic(),
+		Config:    b.Config(),
+		Stats:     s.DynamicBucketStats(namespace, name)}
+
+	if tracked != nil {
+		if nanos := atomic.LoadInt64(&tracked.lastActivityNanos); nanos > 0 {
+			inspection.LastActivityMillis = nanos / 1e6
+		}
+
+		inspection.Activity = tracked.activity()
+	}
+
+	if p, ok := delegate.(Peeker); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), peekTimeout)
+		defer cancel()
+
+		tokens, err := p.Peek(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		inspection.AvailableTokens = &tokens
+	}
+
+	if r, ok := delegate.(SaturationReporter); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), peekTimeout)
+		defer cancel()
+
+		saturation, err := r.Saturation(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		inspection.Saturation = &saturation
+	}
+
+	return inspection, nil
+}
+
+func (s *server) DynamicBuckets(namespace, prefix, cursor string, limit int) ([]*admin.DynamicBucket, int, bool) {
+	s.RLock()
+	bc := s.bucketContainer
+	s.RUnlock()
+
+	return bc.dynamicBuckets(namespace, prefix, cursor, limit)
+}
+
+func (s *server) BucketWaiters(fn func(namespace, bucket string, dynamic bool, waiters int64)) {
+	s.RLock()
+	bc := s.bucketContainer
+	s.RUnlock()
+
+	if bc == nil {
+		return
+	}
+
+	bc.ForEachBucket(func(namespace, name string, b Bucket) bool {
+		if tracked, _ := unwrapBucket(b); tracked != nil {
+			fn(namespace, name, b.Dynamic(), tracked.waiters())
+		}
+
+		return true
+	})
+}
+
+func (s *server) BucketSaturation(fn func(namespace, bucket string, dynamic bool, saturation float64)) {
+	s.RLock()
+	bc := s.bucketContainer
+	s.RUnlock()
+
+	if bc == nil {
+		return
+	}
+
+	bc.ForEachBucket(func(namespace, name string, b Bucket) bool {
+		_, delegate := unwrapBucket(b)
+		r, ok := delegate.(SaturationReporter)
+		if !ok {
+			return true
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), peekTimeout)
+		defer cancel()
+
+		// Buckets destroyed while visited are skipped.
+		if saturation, err := r.Saturation(ctx); err == nil {
+			fn(namespace, name, b.Dynamic(), saturation)
+		}
+
+		return true
+	})
+}
@@ -0,0 +1,65 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package logging
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// Level is the severity of a log message.
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{
+	LevelDebug: "DEBUG",
+	LevelInfo:  "INFO",
+	LevelWarn:  "WARN",
+	LevelError: "ERROR",
+}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("Level(%d)", l)
+	}
+
+	return levelNames[l]
+}
+
+// ParseLevel parses a level name such as "debug" or "WARN".
+func ParseLevel(s string) (Level, error) {
+	for l, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(l), nil
+		}
+	}
+
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+// Messages logged below the minimum level are suppressed. Accessed atomically.
+var minLevel = int32(LevelInfo)
+
+// SetLevel sets the minimum level of messages logged by Debug, Info, Warn, Error and their printf
+// style equivalents. Defaults to LevelInfo. Print, Printf and Println are always logged.
+func SetLevel(l Level) {
+	atomic.StoreInt32(&minLevel, int32(l))
+}
+
+// CurrentLevel gets the minimum level of messages logged.
+func CurrentLevel() Level {
+	return Level(atomic.LoadInt32(&minLevel))
+}
+
+// Enabled returns whether messages at a level are logged, to skip building expensive messages.
+func Enabled(l Level) bool {
+	return l >= CurrentLevel()
+}
@@ -0,0 +1,57 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package logging
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLevelThreshold(t *testing.T) {
+	previous := CurrentStructuredLogger()
+	defer SetStructuredLogger(previous)
+	defer SetLevel(CurrentLevel())
+
+	r := &recordingLogger{}
+	SetStructuredLogger(r)
+
+	if CurrentLevel() != LevelInfo {
+		t.Fatalf("Expected the default level to be info, got %v", CurrentLevel())
+	}
+
+	Debug("suppressed by default")
+	Debugf("suppressed %v", "by default")
+	Info("info")
+
+	SetLevel(LevelWarn)
+	Infof("suppressed %v", "at warn")
+	Warnf("warn %v", 1)
+	Error("error")
+
+	SetLevel(LevelDebug)
+	Debugf("debug %v", 2)
+
+	var msgs []string
+	for _, rec := range r.records {
+		msgs = append(msgs, rec.level+": "+rec.msg)
+	}
+
+	expected := []string{"info: info", "warn: warn 1", "error: error", "debug: debug 2"}
+	if !reflect.DeepEqual(msgs, expected) {
+		t.Errorf("Expected %q, got %q", expected, msgs)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for s, expected := range map[string]Level{"debug": LevelDebug, "INFO": LevelInfo, "Warn": LevelWarn, "error": LevelError} {
+		l, err := ParseLevel(s)
+		if err != nil || l != expected {
+			t.Errorf("Expected %v for %q, got %v %v", expected, s, l, err)
+		}
+	}
+
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("Expected an error for an unknown level")
+	}
+}
@@ -0,0 +1,45 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+//go:build go1.21
+// +build go1.21
+
+package logging
+
+import (
+	"log/slog"
+)
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// NewSlogLogger creates a StructuredLogger logging to a slog.Logger, or to slog.Default() if l is
+// nil.
+func NewSlogLogger(l *slog.Logger) StructuredLogger {
+	return &slogLogger{l}
+}
+
+func (s *slogLogger) logger() *slog.Logger {
+	if s.l == nil {
+		return slog.Default()
+	}
+
+	return s.l
+}
+
+func (s *slogLogger) Debug(msg string, keysAndValues ...interface{}) {
+	s.logger().Debug(msg, keysAndValues...)
+}
+
+func (s *slogLogger) Info(msg string, keysAndValues ...interface{}) {
+	s.logger().Info(msg, keysAndValues...)
+}
+
+func (s *slogLogger) Warn(msg string, keysAndValues ...interface{}) {
+	s.logger().Warn(msg, keysAndValues...)
+}
+
+func (s *slogLogger) Error(msg string, keysAndValues ...interface{}) {
+	s.logger().Error(msg, keysAndValues...)
+}
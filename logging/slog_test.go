@@ -0,0 +1,36 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+//go:build go1.21
+// +build go1.21
+
+package logging
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+)
+
+func TestSlogLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	h := slog.NewTextHandler(buf, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+		ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		}})
+
+	l := NewSlogLogger(slog.New(h))
+	l.Debug("Filtered out", "version", 1)
+	l.Info("Upgrading config", "fromVersion", 2, "toVersion", 3)
+	l.Warn("Fetch failed", "error", "timeout")
+
+	expected := "level=INFO msg=\"Upgrading config\" fromVersion=2 toVersion=3\n" +
+		"level=WARN msg=\"Fetch failed\" error=timeout\n"
+	if buf.String() != expected {
+		t.Errorf("Expected:\n%vgot:\n%v", expected, buf.String())
+	}
+}
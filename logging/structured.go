@@ -0,0 +1,156 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package logging
+
+import (
+	"fmt"
+	"strings"
+)
+
+// StructuredLogger logs messages at a level, with fields given as alternating keys and values,
+// e.g. Warn("Config fetch failed", "version", 3, "error", err). Implementations can adapt zap,
+// zerolog, slog and so on. Messages below the level set by SetLevel are suppressed before reaching
+// the StructuredLogger.
+type StructuredLogger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
+// By default, structured logs are printed to the current Logger.
+var structuredLogger StructuredLogger = NewPrintLogger(nil)
+
+// SetStructuredLogger sets the structured logger to be used
+func SetStructuredLogger(l StructuredLogger) {
+	structuredLogger = l
+}
+
+// CurrentStructuredLogger gets the structured logger to be used
+func CurrentStructuredLogger() StructuredLogger {
+	return structuredLogger
+}
+
+// Debug logs a message and fields at the debug level.
+func Debug(msg string, keysAndValues ...interface{}) {
+	if Enabled(LevelDebug) {
+		structuredLogger.Debug(msg, keysAndValues...)
+	}
+}
+
+// Info logs a message and fields at the info level.
+func Info(msg string, keysAndValues ...interface{}) {
+	if Enabled(LevelInfo) {
+		structuredLogger.Info(msg, keysAndValues...)
+	}
+}
+
+// Warn logs a message and fields at the warn level.
+func Warn(msg string, keysAndValues ...interface{}) {
+	if Enabled(LevelWarn) {
+		structuredLogger.Warn(msg, keysAndValues...)
+	}
+}
+
+// Error logs a message and fields at the error level.
+func Error(msg string, keysAndValues ...interface{}) {
+	if Enabled(LevelError) {
+		structuredLogger.Error(msg, keysAndValues...)
+	}
+}
+
+// Debugf logs at the debug level. Arguments are handled in the manner of fmt.Printf.
+func Debugf(format string, args ...interface{}) {
+	if Enabled(LevelDebug) {
+		structuredLogger.Debug(fmt.Sprintf(format, args...))
+	}
+}
+
+// Infof logs at the info level. Arguments are handled in the manner of fmt.Printf.
+func Infof(format string, args ...interface{}) {
+	if Enabled(LevelInfo) {
+		structuredLogger.Info(fmt.Sprintf(format, args...))
+	}
+}
+
+// Warnf logs at the warn level. Arguments are handled in the manner of fmt.Printf.
+func Warnf(format string, args ...interface{}) {
+	if Enabled(LevelWarn) {
+		structuredLogger.Warn(fmt.Sprintf(format, args...))
+	}
+}
+
+// Errorf logs at the error level. Arguments are handled in the manner of fmt.Printf.
+func Errorf(format string, args ...interface{}) {
+	if Enabled(LevelError) {
+		structuredLogger.Error(fmt.Sprintf(format, args...))
+	}
+}
+
+type printLogger struct {
+	l Logger
+}
+
+// NewPrintLogger creates a StructuredLogger printing to a Logger, as a line such as
+// "WARN Config fetch failed version=3 error=timeout". If l is nil, it prints to the current Logger,
+// as set by SetLogger.
+func NewPrintLogger(l Logger) StructuredLogger {
+	return &printLogger{l}
+}
+
+func (p *printLogger) Debug(msg string, keysAndValues ...interface{}) {
+	p.print(LevelDebug, msg, keysAndValues)
+}
+
+func (p *printLogger) Info(msg string, keysAndValues ...interface{}) {
+	p.print(LevelInfo, msg, keysAndValues)
+}
+
+func (p *printLogger) Warn(msg string, keysAndValues ...interface{}) {
+	p.print(LevelWarn, msg, keysAndValues)
+}
+
+func (p *printLogger) Error(msg string, keysAndValues ...interface{}) {
+	p.print(LevelError, msg, keysAndValues)
+}
+
+func (p *printLogger) print(level Level, msg string, keysAndValues []interface{}) {
+	l := p.l
+	if l == nil {
+		l = logger
+	}
+
+	l.Print(formatLine(level, msg, keysAndValues))
+}
+
+func formatLine(level Level, msg string, keysAndValues []interface{}) string {
+	b := &strings.Builder{}
+	b.WriteString(level.String())
+	b.WriteByte(' ')
+	b.WriteString(msg)
+
+	for i := 0; i < len(keysAndValues); i += 2 {
+		if i+1 == len(keysAndValues) {
+			// A value without a key
+			fmt.Fprintf(b, " !BADKEY=%v", keysAndValues[i])
+			break
+		}
+
+		fmt.Fprintf(b, " %v=%v", keysAndValues[i], keysAndValues[i+1])
+	}
+
+	return b.String()
+}
+
+type nopLogger struct{}
+
+// NewNopLogger creates a StructuredLogger that discards everything.
+func NewNopLogger() StructuredLogger {
+	return nopLogger{}
+}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
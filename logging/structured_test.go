@@ -0,0 +1,119 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+type record struct {
+	level         string
+	msg           string
+	keysAndValues []interface{}
+}
+
+// recordingLogger captures the records logged to it.
+type recordingLogger struct {
+	records []record
+}
+
+func (r *recordingLogger) log(level, msg string, keysAndValues []interface{}) {
+	r.records = append(r.records, record{level, msg, keysAndValues})
+}
+
+func (r *recordingLogger) Debug(msg string, keysAndValues ...interface{}) {
+	r.log("debug", msg, keysAndValues)
+}
+
+func (r *recordingLogger) Info(msg string, keysAndValues ...interface{}) {
+	r.log("info", msg, keysAndValues)
+}
+
+func (r *recordingLogger) Warn(msg string, keysAndValues ...interface{}) {
+	r.log("warn", msg, keysAndValues)
+}
+
+func (r *recordingLogger) Error(msg string, keysAndValues ...interface{}) {
+	r.log("error", msg, keysAndValues)
+}
+
+// printRecorder is a Logger capturing the lines printed to it.
+type printRecorder struct {
+	Logger
+	lines []string
+}
+
+func (p *printRecorder) Print(args ...interface{}) {
+	p.lines = append(p.lines, fmt.Sprint(args...))
+}
+
+func TestStructuredLogger(t *testing.T) {
+	previous := CurrentStructuredLogger()
+	defer SetStructuredLogger(previous)
+	defer SetLevel(CurrentLevel())
+
+	r := &recordingLogger{}
+	SetStructuredLogger(r)
+	SetLevel(LevelDebug)
+
+	err := errors.New("timeout")
+	Debug("Fetching configs", "laterThanVersion", 2)
+	Info("Upgrading config", "fromVersion", 2, "toVersion", 3)
+	Warn("Fetch failed", "error", err)
+	Error("Could not unmarshal config", "version", 4)
+
+	expected := []record{
+		{"debug", "Fetching configs", []interface{}{"laterThanVersion", 2}},
+		{"info", "Upgrading config", []interface{}{"fromVersion", 2, "toVersion", 3}},
+		{"warn", "Fetch failed", []interface{}{"error", err}},
+		{"error", "Could not unmarshal config", []interface{}{"version", 4}}}
+
+	if !reflect.DeepEqual(r.records, expected) {
+		t.Errorf("Expected records %+v, got %+v", expected, r.records)
+	}
+}
+
+func TestPrintLogger(t *testing.T) {
+	p := &printRecorder{}
+	l := NewPrintLogger(p)
+
+	l.Info("Upgrading config", "fromVersion", 2, "toVersion", 3)
+	l.Warn("Fetch failed", "error", errors.New("timeout"))
+	l.Debug("No fields")
+	l.Error("Odd fields", "version", 4, "orphan")
+
+	expected := []string{
+		"INFO Upgrading config fromVersion=2 toVersion=3",
+		"WARN Fetch failed error=timeout",
+		"DEBUG No fields",
+		"ERROR Odd fields version=4 !BADKEY=orphan"}
+
+	if !reflect.DeepEqual(p.lines, expected) {
+		t.Errorf("Expected lines %q, got %q", expected, p.lines)
+	}
+}
+
+func TestPrintLoggerDefaultsToCurrentLogger(t *testing.T) {
+	previous := CurrentLogger()
+	defer SetLogger(previous)
+
+	p := &printRecorder{}
+	SetLogger(p)
+	NewPrintLogger(nil).Info("Hello", "k", "v")
+
+	if len(p.lines) != 1 || p.lines[0] != "INFO Hello k=v" {
+		t.Errorf("Expected the line to be printed to the current logger, got %q", p.lines)
+	}
+}
+
+func TestNopLogger(t *testing.T) {
+	l := NewNopLogger()
+	l.Debug("a")
+	l.Info("b", "k", "v")
+	l.Warn("c")
+	l.Error("d")
+}
@@ -0,0 +1,361 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package metrics
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/square/quotaservice/events"
+	"github.com/square/quotaservice/logging"
+)
+
+const (
+	defaultCloudWatchNamespace     = "QuotaService"
+	defaultCloudWatchBufferSize    = 10000
+	defaultCloudWatchFlushInterval = time.Minute
+	defaultCloudWatchMaxDatums     = 1000
+	defaultCloudWatchTimeout       = 10 * time.Second
+
+	// CloudWatchMaxDatumsPerRequest is the number of metrics sent per PutMetricData call.
+	CloudWatchMaxDatumsPerRequest = 20
+	// CloudWatchMaxRequestSize bounds the estimated size of each PutMetricData call, in bytes.
+	CloudWatchMaxRequestSize = 1 << 20
+)
+
+// CloudWatch units used by CloudWatchListener.
+const (
+	CloudWatchUnitCount        = "Count"
+	CloudWatchUnitMilliseconds = "Milliseconds"
+)
+
+// CloudWatchClient sends metrics to CloudWatch. It is satisfied by a thin adapter over the AWS
+// SDK's PutMetricData, which carries the region and credentials to use.
+type CloudWatchClient interface {
+	PutMetricData(ctx context.Context, input *CloudWatchPutMetricDataInput) error
+}
+
+// CloudWatchPutMetricDataInput mirrors the AWS SDK's PutMetricDataInput.
+type CloudWatchPutMetricDataInput struct {
+	Namespace  string
+	MetricData []*CloudWatchDatum
+}
+
+// CloudWatchDatum mirrors the AWS SDK's MetricDatum. Counters have a Value; timers have
+// StatisticValues summarizing the waits observed since the previous flush.
+type CloudWatchDatum struct {
+	MetricName      string
+	Dimensions      []CloudWatchDimension
+	Timestamp       time.Time
+	Unit            string
+	Value           float64
+	StatisticValues *CloudWatchStatisticSet
+}
+
+// CloudWatchDimension mirrors the AWS SDK's Dimension.
+type CloudWatchDimension struct {
+	Name  string
+	Value string
+}
+
+// CloudWatchStatisticSet mirrors the AWS SDK's StatisticSet.
+type CloudWatchStatisticSet struct {
+	SampleCount float64
+	Sum         float64
+	Minimum     float64
+	Maximum     float64
+}
+
+// CloudWatchOptions configures a CloudWatchListener.
+type CloudWatchOptions struct {
+	// Client sends the metrics. Required.
+	Client CloudWatchClient
+	// Namespace is the CloudWatch namespace metrics are published to. Defaults to "QuotaService".
+	Namespace string
+	// MaxDynamicBucketLabels is the number of dynamic buckets per namespace with their own Bucket
+	// dimension. Defaults to DefaultMaxDynamicBucketLabels; negative gives none their own.
+	MaxDynamicBucketLabels int
+	// BufferSize is the number of events queued for aggregation. Events are dropped when the queue
+	// is full. Defaults to 10000.
+	BufferSize int
+	// FlushInterval bounds how long metrics are aggregated before being sent. Defaults to one
+	// minute, CloudWatch's standard resolution.
+	FlushInterval time.Duration
+	// MaxBufferedDatums is the number of distinct metrics aggregated before they're sent early,
+	// without waiting for FlushInterval. Defaults to 1000.
+	MaxBufferedDatums int
+	// Timeout bounds each PutMetricData call. Defaults to 10s.
+	Timeout time.Duration
+}
+
+// CloudWatchListener publishes CloudWatch metrics from the event stream. Attach HandleEvent using
+// Server.SetListener. Events are aggregated by a background goroutine and sent in PutMetricData
+// calls of up to CloudWatchMaxDatumsPerRequest metrics and CloudWatchMaxRequestSize bytes, so
+// handling events never blocks on the network.
+//
+// The following metrics are published, with Namespace and Bucket dimensions guarded against
+// unbounded cardinality as described by OtherBucket:
+//
+//	RequestsServed                 count of requests served
+//	TokensServed                   count of tokens served
+//	WaitTime                       statistics of waits imposed for requests served, in milliseconds
+//	RequestsRejected{Reason}       count of requests rejected, by reason
+//	BucketsCreated, BucketsRemoved
+//	ConfigReloaded, ConfigReloadFailed
+//	Errors{Type}                   count of server and bucket errors
+type CloudWatchListener struct {
+	opts           CloudWatchOptions
+	labeler        *bucketLabeler
+	events         chan events.Event
+	done           chan struct{}
+	dropped        uint64 // Accessed atomically
+	droppedMetrics uint64 // Accessed atomically
+	once           sync.Once
+}
+
+// NewCloudWatchListener creates a CloudWatchListener and starts publishing metrics.
+func NewCloudWatchListener(opts CloudWatchOptions) *CloudWatchListener {
+	if opts.Namespace == "" {
+		opts.Namespace = defaultCloudWatchNamespace
+	}
+
+	if opts.MaxDynamicBucketLabels == 0 {
+		opts.MaxDynamicBucketLabels = DefaultMaxDynamicBucketLabels
+	}
+
+	if opts.BufferSize < 1 {
+		opts.BufferSize = defaultCloudWatchBufferSize
+	}
+
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = defaultCloudWatchFlushInterval
+	}
+
+	if opts.MaxBufferedDatums < 1 {
+		opts.MaxBufferedDatums = defaultCloudWatchMaxDatums
+	}
+
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultCloudWatchTimeout
+	}
+
+	c := &CloudWatchListener{
+		opts:    opts,
+		labeler: newBucketLabeler(opts.MaxDynamicBucketLabels),
+		events:  make(chan events.Event, opts.BufferSize),
+		done:    make(chan struct{})}
+
+	go c.run()
+	return c
+}
+
+// HandleEvent is an events.Listener. It never blocks; events are dropped if the queue is full.
+func (c *CloudWatchListener) HandleEvent(e events.Event) {
+	select {
+	case c.events <- e:
+	default:
+		atomic.AddUint64(&c.dropped, 1)
+	}
+}
+
+// Dropped returns the number of events dropped because the queue was full.
+func (c *CloudWatchListener) Dropped() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+// DroppedMetrics returns the number of metrics dropped because PutMetricData failed.
+func (c *CloudWatchListener) DroppedMetrics() uint64 {
+	return atomic.LoadUint64(&c.droppedMetrics)
+}
+
+// Close sends any aggregated metrics and stops the listener. HandleEvent must not be called after
+// Close.
+func (c *CloudWatchListener) Close() {
+	c.once.Do(func() {
+		close(c.events)
+		<-c.done
+	})
+}
+
+type cloudWatchKey struct {
+	metric, namespace, bucket, dimension, value string
+}
+
+func (c *CloudWatchListener) run() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(c.opts.FlushInterval)
+	defer ticker.Stop()
+
+	pending := make(map[cloudWatchKey]*CloudWatchDatum)
+	for {
+		select {
+		case e, ok := <-c.events:
+			if !ok {
+				c.flush(pending)
+				return
+			}
+
+			c.add(pending, e)
+			if len(pending) >= c.opts.MaxBufferedDatums {
+				c.flush(pending)
+			}
+		case <-ticker.C:
+			c.flush(pending)
+		}
+	}
+}
+
+// add aggregates the metrics for an event, scaled by its weight.
+func (c *CloudWatchListener) add(pending map[cloudWatchKey]*CloudWatchDatum, e events.Event) {
+	bucket := c.labeler.label(e)
+	if e.Dynamic() && e.EventType() == events.EVENT_BUCKET_REMOVED {
+		c.labeler.release(e.Namespace(), e.BucketName())
+	}
+
+	weight := float64(events.Weight(e))
+	count := func(metric, dimension, value string, n float64) {
+		d := datum(pending, cloudWatchKey{metric, e.Namespace(), bucket, dimension, value}, CloudWatchUnitCount)
+		d.Value += n
+	}
+
+	switch t := e.EventType(); t {
+	case events.EVENT_TOKENS_SERVED:
+		count("RequestsServed", "", "", weight)
+		count("TokensServed", "", "", float64(e.NumTokens())*weight)
+
+		wait := float64(e.WaitTime()) / float64(time.Millisecond)
+		d := datum(pending, cloudWatchKey{"WaitTime", e.Namespace(), bucket, "", ""}, CloudWatchUnitMilliseconds)
+		if d.StatisticValues == nil {
+			d.StatisticValues = &CloudWatchStatisticSet{Minimum: wait, Maximum: wait}
+		}
+
+		s := d.StatisticValues
+		s.SampleCount += weight
+		s.Sum += wait * weight
+		if wait < s.Minimum {
+			s.Minimum = wait
+		}
+
+		if wait > s.Maximum {
+			s.Maximum = wait
+		}
+	case events.EVENT_TIMEOUT_SERVING_TOKENS, events.EVENT_TOO_MANY_TOKENS_REQUESTED, events.EVENT_BUCKET_MISS,
+		events.EVENT_CAP_REACHED:
+		count("RequestsRejected", "Reason", eventName(t), weight)
+	case events.EVENT_BUCKET_CREATED:
+		count("BucketsCreated", "", "", weight)
+	case events.EVENT_BUCKET_REMOVED:
+		count("BucketsRemoved", "", "", weight)
+	case events.EVENT_BUCKET_CLAMPED:
+		count("BucketsClamped", "", "", weight)
+	case events.EVENT_UNKNOWN_NAMESPACE:
+		count("UnknownNamespaceRequests", "", "", weight)
+	case events.EVENT_WOULD_REJECT:
+		count("WouldRejectRequests", "", "", weight)
+	case events.EVENT_CONFIG_RELOADED:
+		count("ConfigReloaded", "", "", weight)
+	case events.EVENT_CONFIG_RELOAD_FAILED:
+		count("ConfigReloadFailed", "", "", weight)
+	case events.EVENT_CIRCUIT_BREAKER_STATE_CHANGED:
+		if c, ok := e.(events.CircuitBreakerEvent); ok {
+			count("CircuitBreakerStateChanged", "State", c.State().String(), weight)
+		}
+	default:
+		count("Errors", "Type", eventName(t), weight)
+	}
+}
+
+// datum returns the pending datum for a key, creating it if needed. CloudWatch rejects empty
+// dimension values, so those dimensions are left out.
+func datum(pending map[cloudWatchKey]*CloudWatchDatum, key cloudWatchKey, unit string) *CloudWatchDatum {
+	if d := pending[key]; d != nil {
+		return d
+	}
+
+	d := &CloudWatchDatum{MetricName: key.metric, Unit: unit}
+	for _, dim := range []CloudWatchDimension{{"Namespace", key.namespace}, {"Bucket", key.bucket}, {key.dimension, key.value}} {
+		if dim.Name != "" && dim.Value != "" {
+			d.Dimensions = append(d.Dimensions, dim)
+		}
+	}
+
+	pending[key] = d
+	return d
+}
+
+// flush sends and clears the pending metrics, in batches within CloudWatch's limits.
+func (c *CloudWatchListener) flush(pending map[cloudWatchKey]*CloudWatchDatum) {
+	if len(pending) == 0 {
+		return
+	}
+
+	now := time.Now()
+	data := make([]*CloudWatchDatum, 0, len(pending))
+	for k, d := range pending {
+		d.Timestamp = now
+		data = append(data, d)
+		delete(pending, k)
+	}
+
+	// Sorted, so batches are deterministic.
+	sort.Slice(data, func(i, j int) bool { return datumSortKey(data[i]) < datumSortKey(data[j]) })
+
+	for len(data) > 0 {
+		n, size := 0, cloudWatchRequestOverhead+len(c.opts.Namespace)
+		for n < len(data) && n < CloudWatchMaxDatumsPerRequest {
+			s := datumSize(data[n])
+			if n > 0 && size+s > CloudWatchMaxRequestSize {
+				break
+			}
+
+			size += s
+			n++
+		}
+
+		c.put(data[:n])
+		data = data[n:]
+	}
+}
+
+func (c *CloudWatchListener) put(data []*CloudWatchDatum) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.Timeout)
+	defer cancel()
+
+	err := c.opts.Client.PutMetricData(ctx, &CloudWatchPutMetricDataInput{Namespace: c.opts.Namespace, MetricData: data})
+	if err != nil {
+		atomic.AddUint64(&c.droppedMetrics, uint64(len(data)))
+		logging.Warn("Unable to publish CloudWatch metrics", "namespace", c.opts.Namespace, "metrics", len(data), "error", err)
+	}
+}
+
+// Estimates of the encoded size of a PutMetricData call, which is form-encoded with a parameter
+// name per field.
+const (
+	cloudWatchRequestOverhead = 64
+	cloudWatchDatumOverhead   = 256
+	cloudWatchFieldOverhead   = 64
+)
+
+func datumSize(d *CloudWatchDatum) int {
+	size := cloudWatchDatumOverhead + len(d.MetricName) + len(d.Unit)
+	for _, dim := range d.Dimensions {
+		size += 2*cloudWatchFieldOverhead + len(dim.Name) + len(dim.Value)
+	}
+
+	return size
+}
+
+func datumSortKey(d *CloudWatchDatum) string {
+	parts := []string{d.MetricName}
+	for _, dim := range d.Dimensions {
+		parts = append(parts, dim.Name, dim.Value)
+	}
+
+	return strings.Join(parts, "\x00")
+}
@@ -0,0 +1,227 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/square/quotaservice/events"
+)
+
+type mockCloudWatchClient struct {
+	inputs []*CloudWatchPutMetricDataInput
+	err    error
+	calls  chan struct{}
+	sync.Mutex
+}
+
+func newMockCloudWatchClient() *mockCloudWatchClient {
+	return &mockCloudWatchClient{calls: make(chan struct{}, 100)}
+}
+
+func (m *mockCloudWatchClient) PutMetricData(ctx context.Context, input *CloudWatchPutMetricDataInput) error {
+	m.Lock()
+	m.inputs = append(m.inputs, input)
+	m.Unlock()
+
+	m.calls <- struct{}{}
+	return m.err
+}
+
+// data returns the metrics sent, by metric name and dimension values.
+func (m *mockCloudWatchClient) data() map[string]*CloudWatchDatum {
+	m.Lock()
+	defer m.Unlock()
+
+	data := make(map[string]*CloudWatchDatum)
+	for _, input := range m.inputs {
+		for _, d := range input.MetricData {
+			name := d.MetricName
+			for _, dim := range d.Dimensions {
+				name += "," + dim.Name + "=" + dim.Value
+			}
+
+			data[name] = d
+		}
+	}
+
+	return data
+}
+
+func TestCloudWatchListener(t *testing.T) {
+	client := newMockCloudWatchClient()
+	c := NewCloudWatchListener(CloudWatchOptions{Client: client, Namespace: "qs", FlushInterval: time.Hour})
+
+	c.HandleEvent(events.NewTokensServedEvent("ns", "b", false, 5, 10*time.Millisecond))
+	c.HandleEvent(events.NewSampledEvent(events.NewTokensServedEvent("ns", "b", false, 1, 30*time.Millisecond), 2))
+	c.HandleEvent(events.NewTimedOutEvent("ns", "b", false, 10))
+	c.HandleEvent(events.NewServerErrorEvent("ns", "b", false))
+	c.HandleEvent(events.NewConfigReloadedEvent(3))
+	c.HandleEvent(events.NewCircuitBreakerEvent("redis", events.CircuitHalfOpen))
+	c.Close()
+
+	if len(client.inputs) != 1 || client.inputs[0].Namespace != "qs" {
+		t.Fatalf("Expected a single call for namespace qs, got %+v", client.inputs)
+	}
+
+	data := client.data()
+	expected := map[string]float64{
+		"RequestsServed,Namespace=ns,Bucket=b":                                 3,
+		"TokensServed,Namespace=ns,Bucket=b":                                   7,
+		"RequestsRejected,Namespace=ns,Bucket=b,Reason=timeout_serving_tokens": 1,
+		"Errors,Namespace=ns,Bucket=b,Type=server_error":                       1,
+		"CircuitBreakerStateChanged,State=half_open":                           1,
+		"ConfigReloaded": 1,
+	}
+
+	for name, value := range expected {
+		if d := data[name]; d == nil || d.Value != value || d.Unit != CloudWatchUnitCount || d.Timestamp.IsZero() {
+			t.Errorf("Expected %v to be %v, got %+v", name, value, d)
+		}
+	}
+
+	wait := data["WaitTime,Namespace=ns,Bucket=b"]
+	if wait == nil || wait.Unit != CloudWatchUnitMilliseconds ||
+		!reflect.DeepEqual(wait.StatisticValues, &CloudWatchStatisticSet{SampleCount: 3, Sum: 70, Minimum: 10, Maximum: 30}) {
+		t.Errorf("Unexpected wait time statistics %+v", wait)
+	}
+
+	if len(data) != len(expected)+1 {
+		t.Errorf("Expected %v metrics, got %v", len(expected)+1, data)
+	}
+}
+
+func TestCloudWatchBatching(t *testing.T) {
+	client := newMockCloudWatchClient()
+	c := NewCloudWatchListener(CloudWatchOptions{Client: client, FlushInterval: time.Hour})
+
+	for i := 0; i < 45; i++ {
+		c.HandleEvent(events.NewBucketCreatedEvent("ns", fmt.Sprintf("b%d", i), false))
+	}
+
+	c.Close()
+
+	var sizes []int
+	for _, input := range client.inputs {
+		sizes = append(sizes, len(input.MetricData))
+	}
+
+	if !reflect.DeepEqual(sizes, []int{20, 20, 5}) {
+		t.Errorf("Expected batches of at most %v metrics, got %v", CloudWatchMaxDatumsPerRequest, sizes)
+	}
+}
+
+func TestCloudWatchRequestSizeLimit(t *testing.T) {
+	client := newMockCloudWatchClient()
+	c := NewCloudWatchListener(CloudWatchOptions{Client: client, FlushInterval: time.Hour})
+
+	// Each metric is over a fifth of the size limit.
+	long := strings.Repeat("x", CloudWatchMaxRequestSize/5)
+	for i := 0; i < 10; i++ {
+		c.HandleEvent(events.NewBucketCreatedEvent("ns", fmt.Sprintf("%s%d", long, i), false))
+	}
+
+	c.Close()
+
+	for _, input := range client.inputs {
+		size := 0
+		for _, d := range input.MetricData {
+			size += datumSize(d)
+		}
+
+		if len(input.MetricData) > 4 || size > CloudWatchMaxRequestSize {
+			t.Errorf("Expected batches within %v bytes, got %v metrics of %v bytes", CloudWatchMaxRequestSize, len(input.MetricData), size)
+		}
+	}
+
+	if len(client.data()) != 10 {
+		t.Errorf("Expected all 10 metrics to be sent, got %v", len(client.data()))
+	}
+}
+
+func TestCloudWatchFlushOnBufferFill(t *testing.T) {
+	client := newMockCloudWatchClient()
+	c := NewCloudWatchListener(CloudWatchOptions{Client: client, FlushInterval: time.Hour, MaxBufferedDatums: 2})
+	defer c.Close()
+
+	c.HandleEvent(events.NewBucketCreatedEvent("ns", "a", false))
+	c.HandleEvent(events.NewBucketCreatedEvent("ns", "b", false))
+
+	select {
+	case <-client.calls:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected metrics to be sent once the buffer filled")
+	}
+
+	if len(client.data()) != 2 {
+		t.Errorf("Expected 2 metrics, got %v", client.data())
+	}
+}
+
+func TestCloudWatchFlushOnInterval(t *testing.T) {
+	client := newMockCloudWatchClient()
+	c := NewCloudWatchListener(CloudWatchOptions{Client: client, FlushInterval: 10 * time.Millisecond})
+	defer c.Close()
+
+	c.HandleEvent(events.NewBucketCreatedEvent("ns", "a", false))
+
+	select {
+	case <-client.calls:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected metrics to be sent on the flush interval")
+	}
+}
+
+func TestCloudWatchDynamicBucketCardinality(t *testing.T) {
+	client := newMockCloudWatchClient()
+	c := NewCloudWatchListener(CloudWatchOptions{Client: client, FlushInterval: time.Hour, MaxDynamicBucketLabels: 1})
+
+	for _, name := range []string{"d1", "d2", "d3"} {
+		c.HandleEvent(events.NewBucketCreatedEvent("ns", name, true))
+	}
+
+	c.Close()
+
+	data := client.data()
+	if d := data["BucketsCreated,Namespace=ns,Bucket=d1"]; d == nil || d.Value != 1 {
+		t.Errorf("Expected d1 to have its own dimension, got %+v", d)
+	}
+
+	if d := data["BucketsCreated,Namespace=ns,Bucket="+OtherBucket]; d == nil || d.Value != 2 {
+		t.Errorf("Expected d2 and d3 counted as %v, got %+v", OtherBucket, d)
+	}
+}
+
+func TestCloudWatchDroppedMetrics(t *testing.T) {
+	client := newMockCloudWatchClient()
+	client.err = errors.New("throttled")
+	c := NewCloudWatchListener(CloudWatchOptions{Client: client, FlushInterval: time.Hour})
+
+	c.HandleEvent(events.NewBucketCreatedEvent("ns", "a", false))
+	c.HandleEvent(events.NewBucketRemovedEvent("ns", "a", false))
+	c.Close()
+
+	if c.DroppedMetrics() != 2 {
+		t.Errorf("Expected 2 dropped metrics, got %v", c.DroppedMetrics())
+	}
+}
+
+func TestCloudWatchDrops(t *testing.T) {
+	// Without an aggregator running, the queue fills.
+	c := &CloudWatchListener{events: make(chan events.Event, 1)}
+
+	c.HandleEvent(events.NewBucketCreatedEvent("ns", "b", false))
+	c.HandleEvent(events.NewBucketCreatedEvent("ns", "b", false))
+
+	if c.Dropped() != 1 {
+		t.Errorf("Expected 1 dropped event, got %v", c.Dropped())
+	}
+}
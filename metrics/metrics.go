@@ -0,0 +1,162 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+// Package metrics exports quotaservice events to monitoring systems. Listeners in this package
+// consume the event stream, and are attached using Server.SetListener.
+package metrics
+
+import (
+	"strings"
+
+	"github.com/square/quotaservice/events"
+)
+
+// OtherBucket is the bucket label used for dynamic buckets that aren't labeled individually.
+const OtherBucket = "__other__"
+
+// DefaultMaxDynamicBucketLabels is the number of dynamic buckets per namespace labeled
+// individually by default.
+const DefaultMaxDynamicBucketLabels = 10
+
+// OtherLabelValue is the value used for bucket label dimensions beyond the values exported
+// individually.
+const OtherLabelValue = "__other__"
+
+// DefaultMaxLabelValues is the number of values of each bucket label dimension exported
+// individually by default.
+const DefaultMaxLabelValues = 100
+
+// eventName returns the name of an event type for use in metric names and labels, e.g.
+// "tokens_served" for EVENT_TOKENS_SERVED.
+func eventName(t events.EventType) string {
+	return strings.ToLower(strings.TrimPrefix(t.String(), "EVENT_"))
+}
+
+// bucketLabeler guards against unbounded metric cardinality from dynamic buckets. Named buckets are
+// always labeled individually. Up to max dynamic buckets per namespace are labeled individually
+// while active, in the order they are first seen; the rest are labeled OtherBucket. A dynamic
+// bucket's label is released when the bucket is removed. Not safe for concurrent use.
+type bucketLabeler struct {
+	max        int
+	namespaces map[string]map[string]struct{}
+}
+
+func newBucketLabeler(max int) *bucketLabeler {
+	if max < 0 {
+		max = 0
+	}
+
+	return &bucketLabeler{max: max, namespaces: make(map[string]map[string]struct{})}
+}
+
+// label returns the bucket label to use for an event.
+func (l *bucketLabeler) label(e events.Event) string {
+	if !e.Dynamic() {
+		return e.BucketName()
+	}
+
+	labeled := l.namespaces[e.Namespace()]
+	if labeled == nil {
+		labeled = make(map[string]struct{})
+		l.namespaces[e.Namespace()] = labeled
+	}
+
+	if _, ok := labeled[e.BucketName()]; ok {
+		return e.BucketName()
+	}
+
+	if len(labeled) < l.max && e.EventType() != events.EVENT_BUCKET_REMOVED {
+		labeled[e.BucketName()] = struct{}{}
+		return e.BucketName()
+	}
+
+	return OtherBucket
+}
+
+// dimensioner renders the bucket labels of events chosen as metric label dimensions, guarding
+// against unbounded cardinality. Up to max values of each dimension are exported individually, in
+// the order they are first seen; the rest are exported as OtherLabelValue. Not safe for
+// concurrent use.
+type dimensioner struct {
+	dimensions []string
+	max        int
+	values     []map[string]struct{}
+}
+
+// reservedLabels can't be used as dimensions, since metrics are already labeled with them.
+var reservedLabels = map[string]bool{"namespace": true, "bucket": true, "type": true, "le": true, "backend": true}
+
+func newDimensioner(dimensions []string, max int) *dimensioner {
+	if max < 1 {
+		max = DefaultMaxLabelValues
+	}
+
+	d := &dimensioner{max: max}
+	for _, dim := range dimensions {
+		if !reservedLabels[dim] {
+			d.dimensions = append(d.dimensions, dim)
+			d.values = append(d.values, make(map[string]struct{}))
+		}
+	}
+
+	return d
+}
+
+// render returns the label pairs of the dimensions an event's bucket is labeled with, in the order
+// of the dimensions, e.g. `team="search"`. Dimensions the bucket isn't labeled with are left out.
+func (d *dimensioner) render(e events.Event) string {
+	if len(d.dimensions) == 0 {
+		return ""
+	}
+
+	labels := events.Labels(e)
+	if len(labels) == 0 {
+		return ""
+	}
+
+	rendered := make([]string, 0, len(d.dimensions))
+	for i, dim := range d.dimensions {
+		value, ok := labels[dim]
+		if !ok || value == "" {
+			continue
+		}
+
+		if _, seen := d.values[i][value]; !seen {
+			if len(d.values[i]) >= d.max {
+				value = OtherLabelValue
+			} else {
+				d.values[i][value] = struct{}{}
+			}
+		}
+
+		rendered = append(rendered, dim+`="`+escapeLabelValue(value)+`"`)
+	}
+
+	return strings.Join(rendered, ",")
+}
+
+// labelFor returns the bucket label of a bucket already seen, without labeling it if it hasn't been,
+// for metrics not derived from events.
+func (l *bucketLabeler) labelFor(namespace, bucket string, dynamic bool) string {
+	if !dynamic {
+		return bucket
+	}
+
+	if _, ok := l.namespaces[namespace][bucket]; ok {
+		return bucket
+	}
+
+	return OtherBucket
+}
+
+// release frees the label of a removed dynamic bucket, returning whether it was labeled
+// individually.
+func (l *bucketLabeler) release(namespace, bucket string) bool {
+	labeled := l.namespaces[namespace]
+	if _, ok := labeled[bucket]; !ok {
+		return false
+	}
+
+	delete(labeled, bucket)
+	return true
+}
@@ -0,0 +1,563 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/square/quotaservice/config"
+	"github.com/square/quotaservice/events"
+	"github.com/square/quotaservice/logging"
+	"github.com/square/quotaservice/stats"
+)
+
+// DefaultWaitTimeBuckets are the upper bounds, in seconds, of the wait time histogram buckets.
+var DefaultWaitTimeBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// DefaultSaturationInterval is how long the saturation of buckets is served for before it is read
+// again, by default.
+const DefaultSaturationInterval = 10 * time.Second
+
+// PrometheusOptions configures a PrometheusListener.
+type PrometheusOptions struct {
+	// Prefix is prepended to metric names. Defaults to "quotaservice".
+	Prefix string
+	// MaxDynamicBucketLabels is the number of dynamic buckets per namespace labeled individually.
+	// Defaults to DefaultMaxDynamicBucketLabels; negative labels none.
+	MaxDynamicBucketLabels int
+	// WaitTimeBuckets are the upper bounds, in seconds, of the wait time histogram buckets.
+	// Defaults to DefaultWaitTimeBuckets.
+	WaitTimeBuckets []float64
+	// WaitTimeHistograms, if set, are served as per-namespace wait time histograms, using their
+	// own buckets.
+	WaitTimeHistograms *stats.WaitTimeHistograms
+	// LabelDimensions are the bucket labels, e.g. "team", added to the labels of bucket metrics
+	// for the buckets labeled with them. Labels named after the metrics' own labels are ignored.
+	LabelDimensions []string
+	// MaxLabelValues is the number of values of each label dimension labeled individually.
+	// Defaults to DefaultMaxLabelValues.
+	MaxLabelValues int
+	// LatestVersion, if set, typically to the config persister, reports the highest config version
+	// in the config store, served with when it was observed and how far the applied config lags it.
+	LatestVersion config.LatestVersionReporter
+	// Waiters, if set, typically to the Server, reports the requests waiting on each bucket, served
+	// as a gauge by bucket.
+	Waiters WaitersReporter
+	// Saturation, if set, typically to the Server, reports the fraction of recent time each bucket
+	// had no tokens available, served as a gauge by bucket.
+	Saturation SaturationReporter
+	// SaturationInterval is how long the saturation read from Saturation is served for, since
+	// reading it visits every bucket. Defaults to DefaultSaturationInterval.
+	SaturationInterval time.Duration
+}
+
+// WaitersReporter reports the number of requests waiting out waits granted by each active bucket,
+// as bounded by their max waiters.
+type WaitersReporter interface {
+	BucketWaiters(fn func(namespace, bucket string, dynamic bool, waiters int64))
+}
+
+// SaturationReporter reports the fraction of recent time each active bucket had no tokens
+// available, for the buckets that can tell.
+type SaturationReporter interface {
+	BucketSaturation(fn func(namespace, bucket string, dynamic bool, saturation float64))
+}
+
+type bucketKey struct {
+	namespace, bucket string
+	// dimensions are the rendered label dimensions of the bucket, if any.
+	dimensions string
+}
+
+type eventKey struct {
+	bucketKey
+	eventType string
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// PrometheusListener maintains Prometheus metrics from the event stream, and serves them in the
+// Prometheus text exposition format. Mount it on a mux, e.g. at /metrics, and attach HandleEvent
+// using Server.SetListener. Metrics are labeled by namespace and bucket, guarded against
+// unbounded cardinality as described by OtherBucket. When a labeled dynamic bucket is removed, its
+// series are deleted and its removal is counted under OtherBucket. Bucket metrics are also labeled
+// with the LabelDimensions of each bucket, guarded as described by OtherLabelValue.
+//
+// The following metrics are maintained, named with the configured prefix:
+//
+//	quotaservice_events_total{namespace, bucket, type}      counter of events by type
+//	quotaservice_tokens_served_total{namespace, bucket}     counter of tokens served
+//	quotaservice_wait_time_seconds{namespace, bucket}       histogram of waits imposed for tokens served
+//	quotaservice_namespace_wait_time_seconds{namespace}     the same by namespace, from WaitTimeHistograms
+//	quotaservice_namespace_queue_time_seconds{namespace}    histogram of the time requests queued, likewise
+//	quotaservice_dynamic_buckets_created_total{namespace}   counter of dynamic buckets created
+//	quotaservice_config_version                             gauge of the config version applied
+//	quotaservice_config_changes_total                       counter of configs applied
+//	quotaservice_config_latest_version                      gauge of the highest version stored, from LatestVersion
+//	quotaservice_config_latest_version_timestamp_seconds    gauge of when it was observed, in Unix seconds
+//	quotaservice_config_version_lag                         gauge of versions the applied config lags it by
+//	quotaservice_circuit_breaker_state{backend}             gauge of circuit breakers: 0 closed, 1 open, 2 half-open
+//	quotaservice_bucket_waiters{namespace, bucket}          gauge of requests waiting on buckets, from Waiters
+//	quotaservice_bucket_saturation_ratio{namespace, bucket} gauge of the fraction of recent time buckets were empty, from Saturation
+//
+// Bucket waiters and saturation are reported when served rather than from events, saturation as last
+// read within SaturationInterval, so carry no label dimensions. Named buckets are always served, and dynamic buckets only while requests wait on them
+// or they have been empty recently. Dynamic buckets that aren't labeled individually are served as
+// the most saturated of them.
+type PrometheusListener struct {
+	opts        PrometheusOptions
+	labeler     *bucketLabeler
+	dimensioner *dimensioner
+
+	events        map[eventKey]uint64
+	tokens        map[bucketKey]int64
+	waits         map[bucketKey]*histogram
+	created       map[string]uint64
+	configVersion int32
+	configChanges uint64
+	breakers      map[string]events.CircuitState
+	sync.Mutex
+
+	// saturation is the saturation last read from Saturation, at saturationReadAt, guarded by
+	// saturationLock rather than the listener's lock, so events aren't held up while it's read.
+	saturation       []bucketSaturation
+	saturationReadAt time.Time
+	saturationLock   sync.Mutex
+	now              func() time.Time
+}
+
+// bucketSaturation is the saturation of a bucket, as reported by a SaturationReporter.
+type bucketSaturation struct {
+	namespace, bucket string
+	dynamic           bool
+	saturation        float64
+}
+
+// NewPrometheusListener creates a PrometheusListener.
+func NewPrometheusListener(opts PrometheusOptions) *PrometheusListener {
+	if opts.Prefix == "" {
+		opts.Prefix = "quotaservice"
+	}
+
+	if opts.MaxDynamicBucketLabels == 0 {
+		opts.MaxDynamicBucketLabels = DefaultMaxDynamicBucketLabels
+	}
+
+	if len(opts.WaitTimeBuckets) == 0 {
+		opts.WaitTimeBuckets = DefaultWaitTimeBuckets
+	}
+
+	if opts.SaturationInterval <= 0 {
+		opts.SaturationInterval = DefaultSaturationInterval
+	}
+
+	return &PrometheusListener{
+		opts:        opts,
+		labeler:     newBucketLabeler(opts.MaxDynamicBucketLabels),
+		dimensioner: newDimensioner(opts.LabelDimensions, opts.MaxLabelValues),
+		events:      make(map[eventKey]uint64),
+		tokens:      make(map[bucketKey]int64),
+		waits:       make(map[bucketKey]*histogram),
+		created:     make(map[string]uint64),
+		breakers:    make(map[string]events.CircuitState),
+		now:         time.Now}
+}
+
+// HandleEvent is an events.Listener.
+func (p *PrometheusListener) HandleEvent(e events.Event) {
+	p.Lock()
+	defer p.Unlock()
+
+	if e.Dynamic() && e.EventType() == events.EVENT_BUCKET_REMOVED && p.labeler.release(e.Namespace(), e.BucketName()) {
+		p.deleteSeriesLocked(e.Namespace(), e.BucketName())
+	}
+
+	if c, ok := e.(events.CircuitBreakerEvent); ok {
+		p.breakers[c.Backend()] = c.State()
+	}
+
+	key := bucketKey{e.Namespace(), p.labeler.label(e), p.dimensioner.render(e)}
+	weight := events.Weight(e)
+	p.events[eventKey{key, eventName(e.EventType())}] += uint64(weight)
+
+	if e.Dynamic() && e.EventType() == events.EVENT_BUCKET_CREATED {
+		// By namespace, since each dynamic bucket is only created once.
+		p.created[e.Namespace()] += uint64(weight)
+	}
+
+	if e.EventType() != events.EVENT_TOKENS_SERVED {
+		return
+	}
+
+	p.tokens[key] += e.NumTokens() * weight
+
+	h := p.waits[key]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(p.opts.WaitTimeBuckets))}
+		p.waits[key] = h
+	}
+
+	wait := e.WaitTime().Seconds()
+	for i, upper := range p.opts.WaitTimeBuckets {
+		if wait <= upper {
+			h.counts[i] += uint64(weight)
+		}
+	}
+
+	h.count += uint64(weight)
+	h.sum += wait * float64(weight)
+}
+
+// deleteSeriesLocked deletes the series of a bucket, whatever its label dimensions.
+func (p *PrometheusListener) deleteSeriesLocked(namespace, bucket string) {
+	for k := range p.events {
+		if k.namespace == namespace && k.bucket == bucket {
+			delete(p.events, k)
+		}
+	}
+
+	for k := range p.tokens {
+		if k.namespace == namespace && k.bucket == bucket {
+			delete(p.tokens, k)
+			delete(p.waits, k)
+		}
+	}
+}
+
+// ObserveConfigChange records a config being applied.
+func (p *PrometheusListener) ObserveConfigChange(c *config.ConfigChange) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.configVersion = c.Version
+	p.configChanges++
+}
+
+// WatchConfigChanges records every config applied by source, until the returned function is called.
+func (p *PrometheusListener) WatchConfigChanges(source config.ConfigChangeSource) func() {
+	changes, unsubscribe := source.SubscribeConfigChanges(1)
+
+	go func() {
+		for c := range changes {
+			p.ObserveConfigChange(c)
+		}
+	}()
+
+	return unsubscribe
+}
+
+// ServeHTTP serves the metrics in the Prometheus text exposition format.
+func (p *PrometheusListener) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	if err := p.Write(w); err != nil {
+		logging.Printf("Error writing metrics! %+v", err)
+	}
+}
+
+// Write writes the metrics in the Prometheus text exposition format.
+func (p *PrometheusListener) Write(w io.Writer) error {
+	var saturation []bucketSaturation
+	if r := p.opts.Saturation; r != nil {
+		saturation = p.readSaturation(r)
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	b := bufio.NewWriter(w)
+
+	name := p.opts.Prefix + "_events_total"
+	writeHeader(b, name, "counter", "Events emitted by the quotaservice, by type.")
+	eventKeys := make([]eventKey, 0, len(p.events))
+	for k := range p.events {
+		eventKeys = append(eventKeys, k)
+	}
+
+	sort.Slice(eventKeys, func(i, j int) bool {
+		if eventKeys[i].bucketKey != eventKeys[j].bucketKey {
+			return lessBucketKey(eventKeys[i].bucketKey, eventKeys[j].bucketKey)
+		}
+
+		return eventKeys[i].eventType < eventKeys[j].eventType
+	})
+
+	for _, k := range eventKeys {
+		writeSample(b, name, labels(k.bucketKey, "type", k.eventType), float64(p.events[k]))
+	}
+
+	bucketKeys := make([]bucketKey, 0, len(p.tokens))
+	for k := range p.tokens {
+		bucketKeys = append(bucketKeys, k)
+	}
+
+	sort.Slice(bucketKeys, func(i, j int) bool { return lessBucketKey(bucketKeys[i], bucketKeys[j]) })
+
+	name = p.opts.Prefix + "_tokens_served_total"
+	writeHeader(b, name, "counter", "Tokens served by the quotaservice.")
+	for _, k := range bucketKeys {
+		writeSample(b, name, labels(k), float64(p.tokens[k]))
+	}
+
+	name = p.opts.Prefix + "_wait_time_seconds"
+	writeHeader(b, name, "histogram", "Wait times imposed when serving tokens.")
+	for _, k := range bucketKeys {
+		h := p.waits[k]
+		for i, upper := range p.opts.WaitTimeBuckets {
+			writeSample(b, name+"_bucket", labels(k, "le", formatFloat(upper)), float64(h.counts[i]))
+		}
+
+		writeSample(b, name+"_bucket", labels(k, "le", "+Inf"), float64(h.count))
+		writeSample(b, name+"_sum", labels(k), h.sum)
+		writeSample(b, name+"_count", labels(k), float64(h.count))
+	}
+
+	namespaces := make([]string, 0, len(p.created))
+	for ns := range p.created {
+		namespaces = append(namespaces, ns)
+	}
+
+	sort.Strings(namespaces)
+
+	name = p.opts.Prefix + "_dynamic_buckets_created_total"
+	writeHeader(b, name, "counter", "Dynamic buckets created, by namespace.")
+	for _, ns := range namespaces {
+		writeSample(b, name, `{namespace="`+escapeLabelValue(ns)+`"}`, float64(p.created[ns]))
+	}
+
+	if h := p.opts.WaitTimeHistograms; h != nil {
+		p.writeNamespaceHistograms(b, "_namespace_wait_time_seconds",
+			"Wait times imposed when serving tokens, by namespace.", h.NamespaceStats)
+		p.writeNamespaceHistograms(b, "_namespace_queue_time_seconds",
+			"Time requests queued for tokens, served or timed out, by namespace.", h.QueueTimeStats)
+	}
+
+	name = p.opts.Prefix + "_config_version"
+	writeHeader(b, name, "gauge", "Version of the config applied.")
+	writeSample(b, name, "", float64(p.configVersion))
+
+	name = p.opts.Prefix + "_config_changes_total"
+	writeHeader(b, name, "counter", "Configs applied.")
+	writeSample(b, name, "", float64(p.configChanges))
+
+	if r := p.opts.LatestVersion; r != nil {
+		if latest, observed := r.LatestVersion(); latest >= 0 {
+			name = p.opts.Prefix + "_config_latest_version"
+			writeHeader(b, name, "gauge", "Highest config version in the config store.")
+			writeSample(b, name, "", float64(latest))
+
+			name = p.opts.Prefix + "_config_latest_version_timestamp_seconds"
+			writeHeader(b, name, "gauge", "When the highest config version was observed, in seconds since the epoch.")
+			writeSample(b, name, "", float64(observed.UnixNano())/1e9)
+
+			// A config persisted by this instance may be applied before the store is next polled.
+			lag := latest - p.configVersion
+			if lag < 0 {
+				lag = 0
+			}
+
+			name = p.opts.Prefix + "_config_version_lag"
+			writeHeader(b, name, "gauge", "Config versions the applied config is behind the config store.")
+			writeSample(b, name, "", float64(lag))
+		}
+	}
+
+	if r := p.opts.Waiters; r != nil {
+		p.writeWaitersLocked(b, r)
+	}
+
+	if p.opts.Saturation != nil {
+		p.writeSaturationLocked(b, saturation)
+	}
+
+	if len(p.breakers) > 0 {
+		backends := make([]string, 0, len(p.breakers))
+		for backend := range p.breakers {
+			backends = append(backends, backend)
+		}
+
+		sort.Strings(backends)
+
+		name = p.opts.Prefix + "_circuit_breaker_state"
+		writeHeader(b, name, "gauge", "State of circuit breakers: 0 closed, 1 open, 2 half-open.")
+		for _, backend := range backends {
+			writeSample(b, name, `{backend="`+escapeLabelValue(backend)+`"}`, float64(p.breakers[backend]))
+		}
+	}
+
+	return b.Flush()
+}
+
+// writeWaitersLocked writes the gauge of requests waiting on each bucket, summing the dynamic buckets
+// that aren't labeled individually under OtherBucket.
+func (p *PrometheusListener) writeWaitersLocked(b *bufio.Writer, r WaitersReporter) {
+	waiters := make(map[bucketKey]int64)
+	r.BucketWaiters(func(namespace, bucket string, dynamic bool, n int64) {
+		if dynamic && n == 0 {
+			return
+		}
+
+		waiters[bucketKey{namespace: namespace, bucket: p.labeler.labelFor(namespace, bucket, dynamic)}] += n
+	})
+
+	keys := make([]bucketKey, 0, len(waiters))
+	for k := range waiters {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return lessBucketKey(keys[i], keys[j]) })
+
+	name := p.opts.Prefix + "_bucket_waiters"
+	writeHeader(b, name, "gauge", "Requests taking tokens that may wait for them, by bucket.")
+	for _, k := range keys {
+		writeSample(b, name, labels(k), float64(waiters[k]))
+	}
+}
+
+// readSaturation returns the saturation of each bucket, reading it from a reporter if it was last
+// read at least SaturationInterval ago. Dynamic buckets that haven't been empty are left out.
+func (p *PrometheusListener) readSaturation(r SaturationReporter) []bucketSaturation {
+	p.saturationLock.Lock()
+	defer p.saturationLock.Unlock()
+
+	now := p.now()
+	if !p.saturationReadAt.IsZero() && now.Sub(p.saturationReadAt) < p.opts.SaturationInterval {
+		return p.saturation
+	}
+
+	var saturation []bucketSaturation
+	r.BucketSaturation(func(namespace, bucket string, dynamic bool, s float64) {
+		if !dynamic || s > 0 {
+			saturation = append(saturation, bucketSaturation{namespace, bucket, dynamic, s})
+		}
+	})
+
+	p.saturation, p.saturationReadAt = saturation, now
+	return saturation
+}
+
+// writeSaturationLocked writes the gauge of the saturation of each bucket, serving the dynamic buckets
+// that aren't labeled individually under OtherBucket as the most saturated of them.
+func (p *PrometheusListener) writeSaturationLocked(b *bufio.Writer, buckets []bucketSaturation) {
+	saturation := make(map[bucketKey]float64)
+	for _, s := range buckets {
+		k := bucketKey{namespace: s.namespace, bucket: p.labeler.labelFor(s.namespace, s.bucket, s.dynamic)}
+		if current, ok := saturation[k]; !ok || s.saturation > current {
+			saturation[k] = s.saturation
+		}
+	}
+
+	keys := make([]bucketKey, 0, len(saturation))
+	for k := range saturation {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return lessBucketKey(keys[i], keys[j]) })
+
+	name := p.opts.Prefix + "_bucket_saturation_ratio"
+	writeHeader(b, name, "gauge", "Fraction of recent time buckets had no tokens available.")
+	for _, k := range keys {
+		writeSample(b, name, labels(k), saturation[k])
+	}
+}
+
+// writeNamespaceHistograms writes a histogram by namespace from WaitTimeHistograms, using snapshot to
+// get the histogram of each namespace.
+func (p *PrometheusListener) writeNamespaceHistograms(b *bufio.Writer, suffix, help string, snapshot func(string) *stats.HistogramSnapshot) {
+	name := p.opts.Prefix + suffix
+	writeHeader(b, name, "histogram", help)
+
+	for _, ns := range p.opts.WaitTimeHistograms.Namespaces() {
+		h := snapshot(ns)
+		if h == nil {
+			// Reset since listing the namespaces.
+			continue
+		}
+
+		nsLabel := `{namespace="` + escapeLabelValue(ns) + `"}`
+
+		var cumulative uint64
+		for _, bucket := range h.Buckets {
+			cumulative += bucket.Count
+
+			le := "+Inf"
+			if bucket.UpperBound > 0 {
+				le = formatFloat(bucket.UpperBound.Seconds())
+			}
+
+			writeSample(b, name+"_bucket", `{namespace="`+escapeLabelValue(ns)+`",le="`+le+`"}`,
+				float64(cumulative))
+		}
+
+		writeSample(b, name+"_sum", nsLabel, h.Sum.Seconds())
+		writeSample(b, name+"_count", nsLabel, float64(h.Count))
+	}
+}
+
+func lessBucketKey(a, b bucketKey) bool {
+	if a.namespace != b.namespace {
+		return a.namespace < b.namespace
+	}
+
+	if a.bucket != b.bucket {
+		return a.bucket < b.bucket
+	}
+
+	return a.dimensions < b.dimensions
+}
+
+func writeHeader(w *bufio.Writer, name, metricType, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func writeSample(w *bufio.Writer, name, labels string, value float64) {
+	fmt.Fprintf(w, "%s%s %s\n", name, labels, formatFloat(value))
+}
+
+// labels renders the namespace and bucket labels and label dimensions, followed by any extra
+// name/value pairs.
+func labels(k bucketKey, extra ...string) string {
+	rendered := make([]string, 0, 3+len(extra)/2)
+	rendered = append(rendered, `namespace="`+escapeLabelValue(k.namespace)+`"`, `bucket="`+escapeLabelValue(k.bucket)+`"`)
+
+	if k.dimensions != "" {
+		rendered = append(rendered, k.dimensions)
+	}
+
+	for i := 0; i < len(extra); i += 2 {
+		rendered = append(rendered, extra[i]+`="`+escapeLabelValue(extra[i+1])+`"`)
+	}
+
+	return "{" + strings.Join(rendered, ",") + "}"
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
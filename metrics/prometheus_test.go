@@ -0,0 +1,361 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/square/quotaservice/config"
+	"github.com/square/quotaservice/events"
+	"github.com/square/quotaservice/stats"
+	"github.com/square/quotaservice/test/helpers"
+)
+
+func scrape(t *testing.T, p *PrometheusListener) string {
+	t.Helper()
+
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	helpers.CheckError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type %v", ct)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	helpers.CheckError(t, err)
+	return string(b)
+}
+
+func expectLines(t *testing.T, metrics string, lines ...string) {
+	t.Helper()
+
+	for _, line := range lines {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("Expected line %q in metrics:\n%v", line, metrics)
+		}
+	}
+}
+
+func TestPrometheusListener(t *testing.T) {
+	p := NewPrometheusListener(PrometheusOptions{WaitTimeBuckets: []float64{0.1, 1}})
+
+	p.HandleEvent(events.NewTokensServedEvent("ns", "b", false, 5, 0))
+	p.HandleEvent(events.NewTokensServedEvent("ns", "b", false, 3, 500*time.Millisecond))
+	p.HandleEvent(events.NewTimedOutEvent("ns", "b", false, 10))
+	p.HandleEvent(events.NewTooManyTokensRequestedEvent("ns", "b", false, 100))
+	p.HandleEvent(events.NewBucketMissedEvent("ns", "missing", false))
+	p.ObserveConfigChange(&config.ConfigChange{Version: 7})
+
+	expectLines(t, scrape(t, p),
+		"# TYPE quotaservice_events_total counter",
+		`quotaservice_events_total{namespace="ns",bucket="b",type="timeout_serving_tokens"} 1`,
+		`quotaservice_events_total{namespace="ns",bucket="b",type="tokens_served"} 2`,
+		`quotaservice_events_total{namespace="ns",bucket="b",type="too_many_tokens_requested"} 1`,
+		`quotaservice_events_total{namespace="ns",bucket="missing",type="bucket_miss"} 1`,
+		`quotaservice_tokens_served_total{namespace="ns",bucket="b"} 8`,
+		"# TYPE quotaservice_wait_time_seconds histogram",
+		`quotaservice_wait_time_seconds_bucket{namespace="ns",bucket="b",le="0.1"} 1`,
+		`quotaservice_wait_time_seconds_bucket{namespace="ns",bucket="b",le="1"} 2`,
+		`quotaservice_wait_time_seconds_bucket{namespace="ns",bucket="b",le="+Inf"} 2`,
+		`quotaservice_wait_time_seconds_sum{namespace="ns",bucket="b"} 0.5`,
+		`quotaservice_wait_time_seconds_count{namespace="ns",bucket="b"} 2`,
+		"quotaservice_config_version 7",
+		"quotaservice_config_changes_total 1")
+}
+
+func TestPrometheusDynamicBucketCardinality(t *testing.T) {
+	p := NewPrometheusListener(PrometheusOptions{Prefix: "qs", MaxDynamicBucketLabels: 2})
+
+	for _, name := range []string{"d1", "d2", "d3", "d4", "d1"} {
+		p.HandleEvent(events.NewTokensServedEvent("ns", name, true, 1, 0))
+	}
+
+	expectLines(t, scrape(t, p),
+		`qs_tokens_served_total{namespace="ns",bucket="d1"} 2`,
+		`qs_tokens_served_total{namespace="ns",bucket="d2"} 1`,
+		`qs_tokens_served_total{namespace="ns",bucket="__other__"} 2`)
+
+	// Removing a labeled bucket frees its label for another.
+	p.HandleEvent(events.NewBucketRemovedEvent("ns", "d1", true))
+	p.HandleEvent(events.NewTokensServedEvent("ns", "d5", true, 1, 0))
+
+	metrics := scrape(t, p)
+	expectLines(t, metrics,
+		`qs_tokens_served_total{namespace="ns",bucket="d5"} 1`,
+		`qs_events_total{namespace="ns",bucket="__other__",type="bucket_removed"} 1`)
+
+	if strings.Contains(metrics, `bucket="d1"`) || strings.Contains(metrics, `bucket="d3"`) {
+		t.Errorf("Expected no series for d1 or d3:\n%v", metrics)
+	}
+}
+
+func TestPrometheusLabelDimensions(t *testing.T) {
+	p := NewPrometheusListener(PrometheusOptions{Prefix: "qs", LabelDimensions: []string{"team", "tier", "bucket"}, MaxLabelValues: 2})
+
+	labeled := func(e events.Event, labels ...string) events.Event {
+		m := make(map[string]string)
+		for i := 0; i < len(labels); i += 2 {
+			m[labels[i]] = labels[i+1]
+		}
+
+		return events.NewLabeledEvent(e, m)
+	}
+
+	p.HandleEvent(labeled(events.NewTokensServedEvent("ns", "a", false, 1, 0), "team", "search", "tier", "1", "bucket", "ignored"))
+	p.HandleEvent(labeled(events.NewTimedOutEvent("ns", "a", false, 1), "team", "search", "tier", "1"))
+	p.HandleEvent(labeled(events.NewTimedOutEvent("ns", "b", false, 1), "team", "ads", "owner", "unexported"))
+	p.HandleEvent(labeled(events.NewTimedOutEvent("ns", "c", false, 1), "team", "payments"))
+	p.HandleEvent(events.NewTimedOutEvent("ns", "d", false, 1))
+
+	metrics := scrape(t, p)
+	expectLines(t, metrics,
+		`qs_tokens_served_total{namespace="ns",bucket="a",team="search",tier="1"} 1`,
+		`qs_events_total{namespace="ns",bucket="a",team="search",tier="1",type="timeout_serving_tokens"} 1`,
+		`qs_events_total{namespace="ns",bucket="b",team="ads",type="timeout_serving_tokens"} 1`,
+		// Beyond the values labeled individually.
+		`qs_events_total{namespace="ns",bucket="c",team="__other__",type="timeout_serving_tokens"} 1`,
+		`qs_events_total{namespace="ns",bucket="d",type="timeout_serving_tokens"} 1`)
+
+	if strings.Contains(metrics, "unexported") || strings.Contains(metrics, "ignored") {
+		t.Errorf("Expected only label dimensions to be exported:\n%v", metrics)
+	}
+}
+
+func TestPrometheusLabelEscaping(t *testing.T) {
+	p := NewPrometheusListener(PrometheusOptions{})
+	p.HandleEvent(events.NewBucketMissedEvent("ns", "a\"b\\c\nd", false))
+
+	expectLines(t, scrape(t, p), `quotaservice_events_total{namespace="ns",bucket="a\"b\\c\nd",type="bucket_miss"} 1`)
+}
+
+func TestPrometheusSampledEvents(t *testing.T) {
+	p := NewPrometheusListener(PrometheusOptions{WaitTimeBuckets: []float64{1}})
+	p.HandleEvent(events.NewSampledEvent(events.NewTokensServedEvent("ns", "b", false, 2, 500*time.Millisecond), 10))
+
+	expectLines(t, scrape(t, p),
+		`quotaservice_events_total{namespace="ns",bucket="b",type="tokens_served"} 10`,
+		`quotaservice_tokens_served_total{namespace="ns",bucket="b"} 20`,
+		`quotaservice_wait_time_seconds_bucket{namespace="ns",bucket="b",le="1"} 10`,
+		`quotaservice_wait_time_seconds_sum{namespace="ns",bucket="b"} 5`,
+		`quotaservice_wait_time_seconds_count{namespace="ns",bucket="b"} 10`)
+}
+
+func TestPrometheusNamespaceWaitTimes(t *testing.T) {
+	h := stats.NewWaitTimeHistograms(stats.HistogramOptions{Buckets: []time.Duration{100 * time.Millisecond, time.Second}})
+	h.Observe("ns", "a", 50*time.Millisecond)
+	h.Observe("ns", "b", 500*time.Millisecond)
+	h.Observe("ns", "b", 2*time.Second)
+
+	p := NewPrometheusListener(PrometheusOptions{WaitTimeHistograms: h})
+
+	expectLines(t, scrape(t, p),
+		"# TYPE quotaservice_namespace_wait_time_seconds histogram",
+		`quotaservice_namespace_wait_time_seconds_bucket{namespace="ns",le="0.1"} 1`,
+		`quotaservice_namespace_wait_time_seconds_bucket{namespace="ns",le="1"} 2`,
+		`quotaservice_namespace_wait_time_seconds_bucket{namespace="ns",le="+Inf"} 3`,
+		`quotaservice_namespace_wait_time_seconds_sum{namespace="ns"} 2.55`,
+		`quotaservice_namespace_wait_time_seconds_count{namespace="ns"} 3`)
+}
+
+func TestPrometheusNamespaceQueueTimes(t *testing.T) {
+	h := stats.NewWaitTimeHistograms(stats.HistogramOptions{Buckets: []time.Duration{100 * time.Millisecond, time.Second}})
+	h.ObserveQueue("ns", 50*time.Millisecond)
+	h.ObserveQueue("ns", 2*time.Second)
+
+	p := NewPrometheusListener(PrometheusOptions{WaitTimeHistograms: h})
+
+	expectLines(t, scrape(t, p),
+		"# TYPE quotaservice_namespace_queue_time_seconds histogram",
+		`quotaservice_namespace_queue_time_seconds_bucket{namespace="ns",le="0.1"} 1`,
+		`quotaservice_namespace_queue_time_seconds_bucket{namespace="ns",le="1"} 1`,
+		`quotaservice_namespace_queue_time_seconds_bucket{namespace="ns",le="+Inf"} 2`,
+		`quotaservice_namespace_queue_time_seconds_sum{namespace="ns"} 2.05`,
+		`quotaservice_namespace_queue_time_seconds_count{namespace="ns"} 2`,
+		`quotaservice_namespace_wait_time_seconds_count{namespace="ns"} 0`)
+}
+
+func TestPrometheusDynamicBucketsCreated(t *testing.T) {
+	p := NewPrometheusListener(PrometheusOptions{})
+	p.HandleEvent(events.NewBucketCreatedEvent("ns", "d1", true))
+	p.HandleEvent(events.NewBucketCreatedEvent("ns", "d2", true))
+	p.HandleEvent(events.NewBucketCreatedEvent("other", "d1", true))
+	// Not dynamic.
+	p.HandleEvent(events.NewBucketCreatedEvent("static", "b", false))
+
+	metrics := scrape(t, p)
+	expectLines(t, metrics,
+		"# TYPE quotaservice_dynamic_buckets_created_total counter",
+		`quotaservice_dynamic_buckets_created_total{namespace="ns"} 2`,
+		`quotaservice_dynamic_buckets_created_total{namespace="other"} 1`)
+
+	if strings.Contains(metrics, `quotaservice_dynamic_buckets_created_total{namespace="static"}`) {
+		t.Errorf("Expected static buckets not to be counted, got:\n%v", metrics)
+	}
+}
+
+func TestPrometheusCircuitBreakers(t *testing.T) {
+	p := NewPrometheusListener(PrometheusOptions{})
+
+	if strings.Contains(scrape(t, p), "circuit_breaker") {
+		t.Error("Expected no circuit breaker metrics before any circuit breaker events")
+	}
+
+	p.HandleEvent(events.NewCircuitBreakerEvent("redis", events.CircuitOpen))
+	p.HandleEvent(events.NewCircuitBreakerEvent("redis", events.CircuitHalfOpen))
+
+	expectLines(t, scrape(t, p),
+		"# TYPE quotaservice_circuit_breaker_state gauge",
+		`quotaservice_circuit_breaker_state{backend="redis"} 2`,
+		`quotaservice_events_total{namespace="",bucket="",type="circuit_breaker_state_changed"} 2`)
+}
+
+type latestVersionReporter struct {
+	version  int32
+	observed time.Time
+}
+
+func (r *latestVersionReporter) LatestVersion() (int32, time.Time) {
+	return r.version, r.observed
+}
+
+// waitersReporter reports the waiters of fixed buckets.
+type waitersReporter []struct {
+	namespace, bucket string
+	dynamic           bool
+	waiters           int64
+}
+
+func (r waitersReporter) BucketWaiters(fn func(namespace, bucket string, dynamic bool, waiters int64)) {
+	for _, b := range r {
+		fn(b.namespace, b.bucket, b.dynamic, b.waiters)
+	}
+}
+
+func TestPrometheusBucketWaiters(t *testing.T) {
+	r := waitersReporter{
+		{"ns", "named", false, 0},
+		{"ns", "labeled", true, 2},
+		{"ns", "unlabeled1", true, 3},
+		{"ns", "unlabeled2", true, 4},
+		{"ns", "idle", true, 0},
+	}
+	p := NewPrometheusListener(PrometheusOptions{MaxDynamicBucketLabels: 1, Waiters: r})
+	p.HandleEvent(events.NewTokensServedEvent("ns", "labeled", true, 1, 0))
+
+	out := scrape(t, p)
+	expectLines(t, out,
+		"# TYPE quotaservice_bucket_waiters gauge",
+		`quotaservice_bucket_waiters{namespace="ns",bucket="labeled"} 2`,
+		`quotaservice_bucket_waiters{namespace="ns",bucket="named"} 0`,
+		`quotaservice_bucket_waiters{namespace="ns",bucket="`+OtherBucket+`"} 7`)
+
+	if strings.Contains(out, "idle") {
+		t.Errorf("Expected dynamic buckets without waiters to be left out, got %v", out)
+	}
+}
+
+// saturationReporter reports the saturation of fixed buckets.
+type saturationReporter []struct {
+	namespace, bucket string
+	dynamic           bool
+	saturation        float64
+}
+
+func (r saturationReporter) BucketSaturation(fn func(namespace, bucket string, dynamic bool, saturation float64)) {
+	for _, b := range r {
+		fn(b.namespace, b.bucket, b.dynamic, b.saturation)
+	}
+}
+
+func TestPrometheusBucketSaturation(t *testing.T) {
+	r := saturationReporter{
+		{"ns", "named", false, 0},
+		{"ns", "labeled", true, 0.5},
+		{"ns", "unlabeled1", true, 0.25},
+		{"ns", "unlabeled2", true, 0.75},
+		{"ns", "idle", true, 0},
+	}
+	p := NewPrometheusListener(PrometheusOptions{MaxDynamicBucketLabels: 1, Saturation: r})
+	p.HandleEvent(events.NewTokensServedEvent("ns", "labeled", true, 1, 0))
+
+	out := scrape(t, p)
+	expectLines(t, out,
+		"# TYPE quotaservice_bucket_saturation_ratio gauge",
+		`quotaservice_bucket_saturation_ratio{namespace="ns",bucket="labeled"} 0.5`,
+		`quotaservice_bucket_saturation_ratio{namespace="ns",bucket="named"} 0`,
+		`quotaservice_bucket_saturation_ratio{namespace="ns",bucket="`+OtherBucket+`"} 0.75`)
+
+	if strings.Contains(out, "idle") {
+		t.Errorf("Expected dynamic buckets never empty to be left out, got %v", out)
+	}
+}
+
+// countingSaturationReporter counts the times it's read, handling an event each time.
+type countingSaturationReporter struct {
+	p     *PrometheusListener
+	reads int
+}
+
+func (r *countingSaturationReporter) BucketSaturation(fn func(namespace, bucket string, dynamic bool, saturation float64)) {
+	r.reads++
+	// Events are handled while buckets are visited.
+	r.p.HandleEvent(events.NewTokensServedEvent("ns", "b", false, 1, 0))
+	fn("ns", "b", false, float64(r.reads)/10)
+}
+
+func TestPrometheusBucketSaturationInterval(t *testing.T) {
+	r := &countingSaturationReporter{}
+	p := NewPrometheusListener(PrometheusOptions{Saturation: r, SaturationInterval: time.Minute})
+	r.p = p
+	now := time.Unix(1500000000, 0)
+	p.now = func() time.Time { return now }
+
+	expectLines(t, scrape(t, p), `quotaservice_bucket_saturation_ratio{namespace="ns",bucket="b"} 0.1`)
+
+	// Served as read until the interval passes.
+	now = now.Add(59 * time.Second)
+	expectLines(t, scrape(t, p), `quotaservice_bucket_saturation_ratio{namespace="ns",bucket="b"} 0.1`)
+
+	now = now.Add(time.Second)
+	expectLines(t, scrape(t, p), `quotaservice_bucket_saturation_ratio{namespace="ns",bucket="b"} 0.2`)
+
+	if r.reads != 2 {
+		t.Errorf("Expected the saturation to be read twice, got %v", r.reads)
+	}
+}
+
+func TestPrometheusConfigVersionLag(t *testing.T) {
+	r := &latestVersionReporter{version: -1}
+	p := NewPrometheusListener(PrometheusOptions{LatestVersion: r})
+
+	if strings.Contains(scrape(t, p), "latest_version") {
+		t.Error("Expected no latest version before the store is polled")
+	}
+
+	r.version, r.observed = 9, time.Unix(1500000000, 0)
+	p.ObserveConfigChange(&config.ConfigChange{Version: 7})
+
+	expectLines(t, scrape(t, p),
+		"# TYPE quotaservice_config_latest_version gauge",
+		"quotaservice_config_latest_version 9",
+		"quotaservice_config_latest_version_timestamp_seconds 1.5e+09",
+		"quotaservice_config_version 7",
+		"quotaservice_config_version_lag 2")
+
+	p.ObserveConfigChange(&config.ConfigChange{Version: 9})
+	expectLines(t, scrape(t, p), "quotaservice_config_version_lag 0")
+
+	// Applied before the store is polled again.
+	p.ObserveConfigChange(&config.ConfigChange{Version: 10})
+	expectLines(t, scrape(t, p), "quotaservice_config_version_lag 0")
+}
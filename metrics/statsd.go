@@ -0,0 +1,278 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package metrics
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/square/quotaservice/events"
+	"github.com/square/quotaservice/logging"
+)
+
+const (
+	defaultStatsdBufferSize    = 10000
+	defaultStatsdFlushInterval = time.Second
+	// Fits in a single Ethernet frame, with room for IP and UDP headers.
+	defaultStatsdMaxPacketSize = 1432
+)
+
+// StatsdOptions configures a StatsdListener.
+type StatsdOptions struct {
+	// Address is the host:port of the StatsD server, reached over UDP.
+	Address string
+	// Prefix is prepended to metric names, e.g. "quotaservice." for "quotaservice.tokens.served".
+	Prefix string
+	// DogStatsD enables tags. Metrics are then tagged by namespace and bucket, guarded against
+	// unbounded cardinality as described by OtherBucket. Plain StatsD metrics aren't broken down by
+	// namespace or bucket.
+	DogStatsD bool
+	// Tags are added to every metric, as "key:value" strings. Requires DogStatsD.
+	Tags []string
+	// SampleRate is the fraction of events sent, between 0 and 1. Defaults to 1.
+	SampleRate float64
+	// MaxDynamicBucketLabels is the number of dynamic buckets per namespace tagged individually.
+	// Defaults to DefaultMaxDynamicBucketLabels; negative tags none.
+	MaxDynamicBucketLabels int
+	// BufferSize is the number of events queued for sending. Events are dropped when the queue is
+	// full. Defaults to 10000.
+	BufferSize int
+	// FlushInterval bounds how long metrics are buffered before being sent. Defaults to 1s.
+	FlushInterval time.Duration
+	// MaxPacketSize bounds the size of each UDP packet. Defaults to 1432 bytes.
+	MaxPacketSize int
+}
+
+// StatsdListener sends StatsD metrics from the event stream. Attach HandleEvent using
+// Server.SetListener. Events are queued and sent in batches by a background goroutine, so
+// handling events never blocks on the network.
+//
+// The following metrics are sent, named with the configured prefix:
+//
+//	requests.served                 counter of requests served
+//	tokens.served                   counter of tokens served
+//	wait_time                       timer of waits imposed for requests served
+//	queue_time                      timer of the time requests served queued, if events carry it
+//	requests.rejected(.{reason})    counter of requests rejected, by reason
+//	buckets.created, buckets.removed
+//	config.reloaded, config.reload_failed
+//	errors(.{type})                 counter of server and bucket errors
+//
+// With DogStatsD, reasons and types are sent as tags rather than name suffixes.
+type StatsdListener struct {
+	opts    StatsdOptions
+	conn    net.Conn
+	labeler *bucketLabeler
+	rand    *rand.Rand
+	events  chan events.Event
+	done    chan struct{}
+	dropped uint64 // Accessed atomically
+	once    sync.Once
+}
+
+// NewStatsdListener creates a StatsdListener and starts sending metrics to the StatsD server.
+func NewStatsdListener(opts StatsdOptions) (*StatsdListener, error) {
+	if opts.SampleRate <= 0 || opts.SampleRate > 1 {
+		opts.SampleRate = 1
+	}
+
+	if opts.MaxDynamicBucketLabels == 0 {
+		opts.MaxDynamicBucketLabels = DefaultMaxDynamicBucketLabels
+	}
+
+	if opts.BufferSize < 1 {
+		opts.BufferSize = defaultStatsdBufferSize
+	}
+
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = defaultStatsdFlushInterval
+	}
+
+	if opts.MaxPacketSize < 1 {
+		opts.MaxPacketSize = defaultStatsdMaxPacketSize
+	}
+
+	conn, err := net.Dial("udp", opts.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &StatsdListener{
+		opts:    opts,
+		conn:    conn,
+		labeler: newBucketLabeler(opts.MaxDynamicBucketLabels),
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		events:  make(chan events.Event, opts.BufferSize),
+		done:    make(chan struct{})}
+
+	go s.run()
+	return s, nil
+}
+
+// HandleEvent is an events.Listener. It never blocks; events are dropped if the queue is full.
+func (s *StatsdListener) HandleEvent(e events.Event) {
+	select {
+	case s.events <- e:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+// Dropped returns the number of events dropped because the queue was full.
+func (s *StatsdListener) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Close sends any buffered metrics and stops the listener. HandleEvent must not be called after
+// Close.
+func (s *StatsdListener) Close() error {
+	s.once.Do(func() {
+		close(s.events)
+		<-s.done
+	})
+
+	return s.conn.Close()
+}
+
+func (s *StatsdListener) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.opts.FlushInterval)
+	defer ticker.Stop()
+
+	buf := &bytes.Buffer{}
+	for {
+		select {
+		case e, ok := <-s.events:
+			if !ok {
+				s.flush(buf)
+				return
+			}
+
+			for _, line := range s.lines(e) {
+				if buf.Len() > 0 && buf.Len()+1+len(line) > s.opts.MaxPacketSize {
+					s.flush(buf)
+				}
+
+				if buf.Len() > 0 {
+					buf.WriteByte('\n')
+				}
+
+				buf.WriteString(line)
+			}
+		case <-ticker.C:
+			s.flush(buf)
+		}
+	}
+}
+
+func (s *StatsdListener) flush(buf *bytes.Buffer) {
+	if buf.Len() == 0 {
+		return
+	}
+
+	if _, err := s.conn.Write(buf.Bytes()); err != nil {
+		logging.Printf("Unable to send StatsD metrics to %v: %v", s.opts.Address, err)
+	}
+
+	buf.Reset()
+}
+
+// lines formats the metrics for an event, applying the sample rate.
+func (s *StatsdListener) lines(e events.Event) []string {
+	// The labeler tracks dynamic buckets, so must see every event, sampled or not.
+	var tags []string
+	if s.opts.DogStatsD {
+		tags = []string{"namespace:" + sanitizeTag(e.Namespace()), "bucket:" + sanitizeTag(s.labeler.label(e))}
+	}
+
+	if e.Dynamic() && e.EventType() == events.EVENT_BUCKET_REMOVED {
+		s.labeler.release(e.Namespace(), e.BucketName())
+	}
+
+	if s.opts.SampleRate < 1 && s.rand.Float64() >= s.opts.SampleRate {
+		return nil
+	}
+
+	// A sampled event stands in for several, so is sent at a proportionally lower rate.
+	rate := s.opts.SampleRate / float64(events.Weight(e))
+
+	switch t := e.EventType(); t {
+	case events.EVENT_TOKENS_SERVED:
+		lines := []string{
+			s.line("requests.served", "1", "c", rate, tags),
+			s.line("tokens.served", strconv.FormatInt(e.NumTokens(), 10), "c", rate, tags),
+			s.line("wait_time", strconv.FormatInt(int64(e.WaitTime()/time.Millisecond), 10), "ms", rate, tags)}
+
+		if queued, ok := events.QueueTime(e); ok {
+			lines = append(lines, s.line("queue_time", strconv.FormatInt(int64(queued/time.Millisecond), 10), "ms", rate, tags))
+		}
+
+		return lines
+	case events.EVENT_TIMEOUT_SERVING_TOKENS, events.EVENT_TOO_MANY_TOKENS_REQUESTED, events.EVENT_BUCKET_MISS,
+		events.EVENT_CAP_REACHED:
+		return []string{s.dimensionedLine("requests.rejected", "reason", eventName(t), rate, tags)}
+	case events.EVENT_BUCKET_CREATED:
+		return []string{s.line("buckets.created", "1", "c", rate, tags)}
+	case events.EVENT_BUCKET_REMOVED:
+		return []string{s.line("buckets.removed", "1", "c", rate, tags)}
+	case events.EVENT_BUCKET_CLAMPED:
+		return []string{s.line("buckets.clamped", "1", "c", rate, tags)}
+	case events.EVENT_UNKNOWN_NAMESPACE:
+		return []string{s.line("requests.unknown_namespace", "1", "c", rate, tags)}
+	case events.EVENT_WOULD_REJECT:
+		return []string{s.line("requests.would_reject", "1", "c", rate, tags)}
+	case events.EVENT_CONFIG_RELOADED:
+		return []string{s.line("config.reloaded", "1", "c", rate, tags)}
+	case events.EVENT_CONFIG_RELOAD_FAILED:
+		return []string{s.line("config.reload_failed", "1", "c", rate, tags)}
+	case events.EVENT_CIRCUIT_BREAKER_STATE_CHANGED:
+		if c, ok := e.(events.CircuitBreakerEvent); ok {
+			return []string{s.dimensionedLine("circuit_breaker."+c.Backend(), "state", c.State().String(), rate, tags)}
+		}
+
+		return nil
+	default:
+		return []string{s.dimensionedLine("errors", "type", eventName(t), rate, tags)}
+	}
+}
+
+// dimensionedLine formats a counter broken down by a dimension, as a tag with DogStatsD or a name
+// suffix otherwise.
+func (s *StatsdListener) dimensionedLine(name, dimension, value string, rate float64, tags []string) string {
+	if s.opts.DogStatsD {
+		return s.line(name, "1", "c", rate, append(tags, dimension+":"+value))
+	}
+
+	return s.line(name+"."+value, "1", "c", rate, tags)
+}
+
+func (s *StatsdListener) line(name, value, metricType string, rate float64, tags []string) string {
+	line := s.opts.Prefix + name + ":" + value + "|" + metricType
+
+	if rate < 1 {
+		line += "|@" + strconv.FormatFloat(rate, 'f', -1, 64)
+	}
+
+	if s.opts.DogStatsD {
+		if all := append(append([]string{}, s.opts.Tags...), tags...); len(all) > 0 {
+			line += "|#" + strings.Join(all, ",")
+		}
+	}
+
+	return line
+}
+
+// tagReplacer replaces characters that are delimiters in the DogStatsD protocol.
+var tagReplacer = strings.NewReplacer(",", "_", "|", "_", "\n", "_", "#", "_")
+
+func sanitizeTag(v string) string {
+	return tagReplacer.Replace(v)
+}
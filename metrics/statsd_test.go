@@ -0,0 +1,140 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package metrics
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/square/quotaservice/events"
+	"github.com/square/quotaservice/test/helpers"
+)
+
+// receiveLines reads n lines sent to a UDP listener.
+func receiveLines(t *testing.T, conn net.PacketConn, n int) []string {
+	t.Helper()
+
+	var lines []string
+	buf := make([]byte, 65536)
+	helpers.CheckError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	for len(lines) < n {
+		read, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Expected %v lines, got %v before error %v", n, lines, err)
+		}
+
+		lines = append(lines, strings.Split(string(buf[:read]), "\n")...)
+	}
+
+	sort.Strings(lines)
+	return lines
+}
+
+func newStatsdTestListener(t *testing.T, opts StatsdOptions) (*StatsdListener, net.PacketConn) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	helpers.CheckError(t, err)
+
+	opts.Address = conn.LocalAddr().String()
+	opts.FlushInterval = 10 * time.Millisecond
+
+	s, err := NewStatsdListener(opts)
+	helpers.CheckError(t, err)
+	return s, conn
+}
+
+func expectStatsdLines(t *testing.T, actual []string, expected ...string) {
+	t.Helper()
+
+	sort.Strings(expected)
+	if strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected lines:\n%v\ngot:\n%v", strings.Join(expected, "\n"), strings.Join(actual, "\n"))
+	}
+}
+
+func TestStatsdListener(t *testing.T) {
+	s, conn := newStatsdTestListener(t, StatsdOptions{Prefix: "qs."})
+	defer func() { _ = conn.Close() }()
+	defer func() { _ = s.Close() }()
+
+	s.HandleEvent(events.NewTokensServedEvent("ns", "b", false, 5, 250*time.Millisecond))
+	s.HandleEvent(events.NewTimedOutEvent("ns", "b", false, 10))
+	s.HandleEvent(events.NewBucketMissedEvent("ns", "b", false))
+	s.HandleEvent(events.NewServerErrorEvent("ns", "b", false))
+	s.HandleEvent(events.NewConfigReloadFailedEvent(3, errors.New("bad config")))
+	s.HandleEvent(events.NewCircuitBreakerEvent("redis", events.CircuitOpen))
+
+	expectStatsdLines(t, receiveLines(t, conn, 8),
+		"qs.requests.served:1|c",
+		"qs.tokens.served:5|c",
+		"qs.wait_time:250|ms",
+		"qs.requests.rejected.timeout_serving_tokens:1|c",
+		"qs.requests.rejected.bucket_miss:1|c",
+		"qs.errors.server_error:1|c",
+		"qs.config.reload_failed:1|c",
+		"qs.circuit_breaker.redis.open:1|c")
+}
+
+func TestDogStatsdListener(t *testing.T) {
+	s, conn := newStatsdTestListener(t, StatsdOptions{
+		DogStatsD:              true,
+		Tags:                   []string{"env:test"},
+		SampleRate:             0.999999,
+		MaxDynamicBucketLabels: 1})
+	defer func() { _ = conn.Close() }()
+
+	// Practically never drops an event, but includes the sample rate in each line.
+	s.HandleEvent(events.NewTooManyTokensRequestedEvent("ns", "b,1", false, 10))
+	s.HandleEvent(events.NewBucketCreatedEvent("ns", "d1", true))
+	s.HandleEvent(events.NewBucketCreatedEvent("ns", "d2", true))
+	helpers.CheckError(t, s.Close())
+
+	expectStatsdLines(t, receiveLines(t, conn, 3),
+		"requests.rejected:1|c|@0.999999|#env:test,namespace:ns,bucket:b_1,reason:too_many_tokens_requested",
+		"buckets.created:1|c|@0.999999|#env:test,namespace:ns,bucket:d1",
+		"buckets.created:1|c|@0.999999|#env:test,namespace:ns,bucket:__other__")
+}
+
+func TestStatsdSampledEvents(t *testing.T) {
+	s, conn := newStatsdTestListener(t, StatsdOptions{SampleRate: 0.999999})
+	defer func() { _ = conn.Close() }()
+
+	s.HandleEvent(events.NewSampledEvent(events.NewTokensServedEvent("ns", "b", false, 2, 0), 10))
+	helpers.CheckError(t, s.Close())
+
+	expectStatsdLines(t, receiveLines(t, conn, 3),
+		"requests.served:1|c|@0.0999999",
+		"tokens.served:2|c|@0.0999999",
+		"wait_time:0|ms|@0.0999999")
+}
+
+func TestStatsdQueueTime(t *testing.T) {
+	s, conn := newStatsdTestListener(t, StatsdOptions{})
+	defer func() { _ = conn.Close() }()
+
+	s.HandleEvent(events.NewQueuedEvent(events.NewTokensServedEvent("ns", "b", false, 1, 100*time.Millisecond), 40*time.Millisecond))
+	helpers.CheckError(t, s.Close())
+
+	expectStatsdLines(t, receiveLines(t, conn, 4),
+		"requests.served:1|c",
+		"tokens.served:1|c",
+		"wait_time:100|ms",
+		"queue_time:40|ms")
+}
+
+func TestStatsdDrops(t *testing.T) {
+	// Without a sender running, the queue fills.
+	s := &StatsdListener{events: make(chan events.Event, 1)}
+
+	s.HandleEvent(events.NewBucketCreatedEvent("ns", "b", false))
+	s.HandleEvent(events.NewBucketCreatedEvent("ns", "b", false))
+
+	if s.Dropped() != 1 {
+		t.Errorf("Expected 1 dropped event, got %v", s.Dropped())
+	}
+}
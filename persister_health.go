@@ -0,0 +1,104 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package quotaservice
+
+import (
+	"sync"
+	"time"
+
+	"github.com/square/quotaservice/admin"
+)
+
+// persisterHealth records the outcome of the latest operations on the config persister: reading,
+// persisting and reloading configs. It also records when a config change was last observed, to
+// detect a persister that stopped fetching changes.
+type persisterHealth struct {
+	lastErr     error
+	lastErrAt   time.Time
+	lastSuccess time.Time
+	lastChange  time.Time
+	sync.Mutex
+}
+
+func (h *persisterHealth) record(err error, now time.Time) {
+	h.Lock()
+	defer h.Unlock()
+
+	if err != nil {
+		h.lastErr = err
+		h.lastErrAt = now
+	} else {
+		h.lastSuccess = now
+	}
+}
+
+// snapshot reports the persister healthy unless its latest operation failed.
+func (h *persisterHealth) snapshot() *admin.PersisterHealth {
+	h.Lock()
+	defer h.Unlock()
+
+	health := &admin.PersisterHealth{Healthy: h.lastErr == nil || h.lastSuccess.After(h.lastErrAt)}
+	if !h.lastSuccess.IsZero() {
+		health.LastSuccessAt = h.lastSuccess.Unix()
+	}
+
+	if h.lastErr != nil {
+		health.LastError = h.lastErr.Error()
+		health.LastErrorAt = h.lastErrAt.Unix()
+	}
+
+	return health
+}
+
+// withReported folds in the latest error the persister itself reports, err at errAt, such as one
+// only met by a background poll, reporting the persister unhealthy until it clears.
+func withReported(health *admin.PersisterHealth, err error, errAt time.Time) *admin.PersisterHealth {
+	if err == nil {
+		return health
+	}
+
+	health.Healthy = false
+	if errAt.Unix() >= health.LastErrorAt {
+		health.LastError = err.Error()
+		health.LastErrorAt = errAt.Unix()
+	}
+
+	return health
+}
+
+func (h *persisterHealth) observedChange(now time.Time) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.lastChange = now
+}
+
+// freshness reports config changes stale if neither a change was observed nor has the persister
+// polled its store, at lastPolled, within threshold. Stable configs are only told apart from a
+// stuck persister if it reports when it polled. A threshold of 0 disables the check.
+func (h *persisterHealth) freshness(lastPolled time.Time, threshold time.Duration, now time.Time) *admin.ConfigHealth {
+	h.Lock()
+	lastChange := h.lastChange
+	h.Unlock()
+
+	health := &admin.ConfigHealth{Healthy: true, StalenessThresholdSeconds: int64(threshold / time.Second)}
+	if !lastChange.IsZero() {
+		health.LastChangeAt = lastChange.Unix()
+	}
+
+	if !lastPolled.IsZero() {
+		health.LastPolledAt = lastPolled.Unix()
+	}
+
+	if threshold > 0 {
+		latest := lastChange
+		if lastPolled.After(latest) {
+			latest = lastPolled
+		}
+
+		health.Healthy = now.Sub(latest) <= threshold
+	}
+
+	return health
+}
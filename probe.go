@@ -0,0 +1,185 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package quotaservice
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/square/quotaservice/config"
+	"github.com/square/quotaservice/logging"
+	pbconfig "github.com/square/quotaservice/protos/config"
+)
+
+// Probe implements QuotaService, checking a request the way allow does but probing buckets instead
+// of taking from them. Buckets aren't created to be probed; one that doesn't exist yet would be
+// created full. Probes don't emit events, even for unknown namespaces.
+func (s *server) Probe(ctx context.Context, namespace, name string, tokensRequested int64) (bool, time.Duration, error) {
+	if owner := s.owner(ctx, namespace, name); owner != nil {
+		granted, w, err := owner.Probe(ctx, namespace, name, tokensRequested)
+		if forwarded(err) {
+			return granted, w, err
+		}
+
+		logging.Warn("Unable to forward probe to the owner of its bucket, probing it locally",
+			"namespace", namespace, "bucket", name, "error", err)
+	}
+
+	var b, limit Bucket
+	var fresh *pbconfig.BucketConfig
+	var e error
+
+	s.RLock()
+	unknown, allowAll, reject := s.unknownNamespaceLocked(namespace)
+	disabled := s.namespaceDisabledLocked(namespace) || allowAll || s.failingOpenLocked()
+	if !disabled && !reject {
+		b, fresh, e = s.bucketContainer.probedBucket(namespace, name)
+		if e == nil && ((b == nil && fresh == nil) || unknown) && s.catchAllNamespace != "" {
+			// Probed as Allow would serve the request, from the catch-all.
+			namespace, name = s.catchAllNamespace, s.catchAllBucket
+			b, fresh, e = s.bucketContainer.probedBucket(namespace, name)
+		}
+
+		limit = s.bucketContainer.NamespaceLimit(namespace)
+	}
+	cost, costErr := s.requestCostLocked(ctx, namespace, tokensRequested, false)
+	s.RUnlock()
+
+	if reject {
+		return false, 0, newUnknownNamespaceError(namespace)
+	}
+
+	if disabled {
+		// Requests in disabled namespaces are granted without waiting.
+		return true, 0, nil
+	}
+
+	if costErr != nil {
+		return false, 0, costErr
+	}
+
+	units := tokensRequested
+	tokensRequested = cost
+	if e != nil {
+		return false, 0, newError("Cannot create dynamic bucket "+config.FullyQualifiedName(namespace, name), ER_TOO_MANY_BUCKETS)
+	}
+
+	cfg := fresh
+	if b != nil {
+		cfg = b.Config()
+	}
+
+	if cfg == nil && unknown {
+		return false, 0, newUnknownNamespaceError(namespace)
+	}
+
+	if cfg == nil {
+		return false, 0, newError("No such bucket "+config.FullyQualifiedName(namespace, name), ER_NO_BUCKET)
+	}
+
+	if cfg.Disabled {
+		// Requests for disabled buckets are granted without waiting, ignoring the namespace limit.
+		return true, 0, nil
+	}
+
+	// Requests that would be clamped are probed for the tokens they would be granted.
+	units, tokensRequested = clampRequest(cfg, units, tokensRequested)
+	if limit != nil {
+		_, tokensRequested = clampRequest(limit.Config(), units, tokensRequested)
+	}
+
+	if cfg.MaxTokensPerRequest < tokensRequested && cfg.MaxTokensPerRequest > 0 {
+		return false, 0, newTooManyTokensError(namespace, name, tokensRequested, cfg.MaxTokensPerRequest)
+	}
+
+	var w time.Duration
+	granted := true
+	if b == nil {
+		// A new bucket starts full, granting anything it could ever serve without waiting.
+		if maxTokens := config.MaxTokensAtOnce(fresh); tokensRequested > maxTokens {
+			return false, 0, newTooManyTokensError(namespace, name, tokensRequested, maxTokens)
+		}
+	} else if w, granted, e = probe(ctx, namespace, name, b, tokensRequested); e != nil {
+		return false, 0, e
+	}
+
+	if limit != nil {
+		if maxTokens := limit.Config().MaxTokensPerRequest; maxTokens > 0 && tokensRequested > maxTokens {
+			return false, 0, newTooManyTokensError(namespace, config.NamespaceLimitBucketName, tokensRequested, maxTokens)
+		}
+
+		limitWait, limitGranted, err := probe(ctx, namespace, config.NamespaceLimitBucketName, limit, tokensRequested)
+		if err != nil {
+			return false, 0, err
+		}
+
+		granted = granted && limitGranted
+		if limitWait > w {
+			w = limitWait
+		}
+	}
+
+	return granted, w, nil
+}
+
+// probe probes a bucket for tokens, within the max wait time configured on it.
+func probe(ctx context.Context, namespace, name string, b Bucket, tokensRequested int64) (time.Duration, bool, error) {
+	_, delegate := unwrapBucket(b)
+	p, ok := delegate.(Prober)
+	if !ok {
+		return 0, false, fmt.Errorf("bucket %v can't be probed", config.FullyQualifiedName(namespace, name))
+	}
+
+	w, granted, err := p.Probe(ctx, tokensRequested, time.Duration(b.Config().WaitTimeoutMillis)*time.Millisecond)
+	if tooMany, ok := errors.Cause(err).(*TooManyTokensError); ok {
+		return 0, false, newTooManyTokensError(namespace, name, tokensRequested, tooMany.MaxTokens)
+	}
+
+	if capReached, ok := errors.Cause(err).(*CapReachedError); ok {
+		return 0, false, newCapReachedError(namespace, name, capReached)
+	}
+
+	if err != nil {
+		return 0, false, errors.Wrap(err, "failed to probe tokens")
+	}
+
+	return w, granted, nil
+}
+
+// probedBucket returns the bucket FindBucket would, without creating it or recording activity. If
+// the bucket is yet to be created, its config is returned instead, or an error if it is a dynamic
+// bucket and the namespace has no room for more.
+func (bc *bucketContainer) probedBucket(namespace, name string) (Bucket, *pbconfig.BucketConfig, error) {
+	bc.RLock()
+	ns := bc.namespaces[namespace]
+	bc.RUnlock()
+
+	if ns == nil {
+		return bc.defaultBucket, nil, nil
+	}
+
+	ns.RLock()
+	defer ns.RUnlock()
+
+	if b := ns.buckets[name]; b != nil {
+		return b, nil, nil
+	}
+
+	if ns.cfg.DynamicBucketTemplate == nil {
+		return ns.defaultBucket, nil, nil
+	}
+
+	if cfg := ns.cfg.Buckets[name]; cfg != nil {
+		// A named bucket that has been invalidated, to be re-created.
+		return nil, cfg, nil
+	}
+
+	if ns.cfg.MaxDynamicBuckets > 0 && ns.dynamicBucketCount >= ns.cfg.MaxDynamicBuckets {
+		return nil, nil, errors.New("Cannot create dynamic bucket")
+	}
+
+	return nil, ns.cfg.DynamicBucketTemplate, nil
+}
@@ -7,11 +7,20 @@ Package quotaservice_configs is a generated protocol buffer package.
 
 It is generated from these files:
 	protos/config/configs.proto
+	protos/config/persister.proto
 
 It has these top-level messages:
 	ServiceConfig
 	NamespaceConfig
 	BucketConfig
+	RateWindow
+	ReadPersistedConfigRequest
+	ReadHistoricalConfigsRequest
+	ReadHistoricalConfigsResponse
+	PersistAndNotifyRequest
+	PersistAndNotifyResponse
+	WatchConfigChangesRequest
+	ConfigChangedNotification
 */
 package quotaservice_configs
 
@@ -38,6 +47,15 @@ type ServiceConfig struct {
 	Version int32  `protobuf:"varint,3,opt,name=version" json:"version,omitempty" yaml:"version"`
 	User    string `protobuf:"bytes,4,opt,name=user" json:"user,omitempty" yaml:"user"`
 	Date    int64  `protobuf:"varint,5,opt,name=date" json:"date,omitempty" yaml:"date"`
+	// Seconds since the epoch after which the config takes effect, keeping the previous version in
+	// force until then. Configs without one take effect once loaded.
+	ActivateAt int64 `protobuf:"varint,6,opt,name=activate_at,json=activateAt" json:"activate_at,omitempty" yaml:"activate_at"`
+	// Named bucket configs buckets can be created from, keyed by name.
+	Templates map[string]*BucketConfig `protobuf:"bytes,7,rep,name=templates" json:"templates,omitempty" yaml:"templates" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	// Ed25519 signature of the config marshalled without its signature fields, by the key with
+	// signature_key_id. Set when persisting through a config.SigningPersister.
+	Signature      []byte `protobuf:"bytes,8,opt,name=signature,proto3" json:"signature,omitempty" yaml:"signature"`
+	SignatureKeyId string `protobuf:"bytes,9,opt,name=signature_key_id,json=signatureKeyId" json:"signature_key_id,omitempty" yaml:"signature_key_id"`
 }
 
 func (m *ServiceConfig) Reset()                    { *m = ServiceConfig{} }
@@ -80,12 +98,59 @@ func (m *ServiceConfig) GetDate() int64 {
 	return 0
 }
 
+func (m *ServiceConfig) GetActivateAt() int64 {
+	if m != nil {
+		return m.ActivateAt
+	}
+	return 0
+}
+
+func (m *ServiceConfig) GetTemplates() map[string]*BucketConfig {
+	if m != nil {
+		return m.Templates
+	}
+	return nil
+}
+
+func (m *ServiceConfig) GetSignature() []byte {
+	if m != nil {
+		return m.Signature
+	}
+	return nil
+}
+
+func (m *ServiceConfig) GetSignatureKeyId() string {
+	if m != nil {
+		return m.SignatureKeyId
+	}
+	return ""
+}
+
 type NamespaceConfig struct {
 	Name                  string                   `protobuf:"bytes,1,opt,name=name" json:"name,omitempty" yaml:"name"`
 	DefaultBucket         *BucketConfig            `protobuf:"bytes,2,opt,name=default_bucket,json=defaultBucket" json:"default_bucket,omitempty" yaml:"default_bucket"`
 	DynamicBucketTemplate *BucketConfig            `protobuf:"bytes,3,opt,name=dynamic_bucket_template,json=dynamicBucketTemplate" json:"dynamic_bucket_template,omitempty" yaml:"dynamic_bucket_template"`
 	MaxDynamicBuckets     int32                    `protobuf:"varint,4,opt,name=max_dynamic_buckets,json=maxDynamicBuckets" json:"max_dynamic_buckets,omitempty" yaml:"max_dynamic_buckets"`
 	Buckets               map[string]*BucketConfig `protobuf:"bytes,5,rep,name=buckets" json:"buckets,omitempty" yaml:"buckets" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	// Token costs of kinds of requests, so callers pass a kind rather than hardcoding magnitudes.
+	RequestCosts map[string]int64 `protobuf:"bytes,6,rep,name=request_costs,json=requestCosts" json:"request_costs,omitempty" yaml:"request_costs" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"varint,2,opt,name=value"`
+	// Kill switch granting every request in the namespace, still emitting events for them. Namespaces
+	// are enabled unless disabled, since a proto3 bool defaults to false.
+	Disabled bool `protobuf:"varint,7,opt,name=disabled" json:"disabled,omitempty" yaml:"disabled"`
+	// A ceiling on the tokens taken from all buckets of the namespace together. Requests are granted
+	// only if both their bucket and the namespace limit have the tokens.
+	NamespaceLimit *BucketConfig `protobuf:"bytes,8,opt,name=namespace_limit,json=namespaceLimit" json:"namespace_limit,omitempty" yaml:"namespace_limit"`
+	// The backend holding the namespace's buckets, "redis" or "memory", selected by a
+	// quotaservice.BackendBucketFactory. Unset uses its default backend.
+	Backend string `protobuf:"bytes,9,opt,name=backend" json:"backend,omitempty" yaml:"backend"`
+	// Fractions of a token the namespace's buckets count, so callers may request fractions of
+	// tokens, e.g. 1000 for thousandths. Bucket sizes, fill rates and costs are still configured in
+	// whole tokens. Unset counts whole tokens.
+	TokenScale int64 `protobuf:"varint,10,opt,name=token_scale,json=tokenScale" json:"token_scale,omitempty" yaml:"token_scale"`
+	// Changes to the namespace are applied without the config debounce or jitter, and persisting
+	// them through a server forces it to poll its config store at once, at the cost of more polls
+	// and of every server reloading at the same time.
+	FastTrack bool `protobuf:"varint,11,opt,name=fast_track,json=fastTrack" json:"fast_track,omitempty" yaml:"fast_track"`
 }
 
 func (m *NamespaceConfig) Reset()                    { *m = NamespaceConfig{} }
@@ -128,6 +193,48 @@ func (m *NamespaceConfig) GetBuckets() map[string]*BucketConfig {
 	return nil
 }
 
+func (m *NamespaceConfig) GetRequestCosts() map[string]int64 {
+	if m != nil {
+		return m.RequestCosts
+	}
+	return nil
+}
+
+func (m *NamespaceConfig) GetDisabled() bool {
+	if m != nil {
+		return m.Disabled
+	}
+	return false
+}
+
+func (m *NamespaceConfig) GetNamespaceLimit() *BucketConfig {
+	if m != nil {
+		return m.NamespaceLimit
+	}
+	return nil
+}
+
+func (m *NamespaceConfig) GetBackend() string {
+	if m != nil {
+		return m.Backend
+	}
+	return ""
+}
+
+func (m *NamespaceConfig) GetTokenScale() int64 {
+	if m != nil {
+		return m.TokenScale
+	}
+	return 0
+}
+
+func (m *NamespaceConfig) GetFastTrack() bool {
+	if m != nil {
+		return m.FastTrack
+	}
+	return false
+}
+
 type BucketConfig struct {
 	Name                string `protobuf:"bytes,1,opt,name=name" json:"name,omitempty" yaml:"name"`
 	Namespace           string `protobuf:"bytes,2,opt,name=namespace" json:"namespace,omitempty" yaml:"namespace"`
@@ -137,6 +244,53 @@ type BucketConfig struct {
 	MaxIdleMillis       int64  `protobuf:"varint,6,opt,name=max_idle_millis,json=maxIdleMillis" json:"max_idle_millis,omitempty" yaml:"max_idle_millis"`
 	MaxDebtMillis       int64  `protobuf:"varint,7,opt,name=max_debt_millis,json=maxDebtMillis" json:"max_debt_millis,omitempty" yaml:"max_debt_millis"`
 	MaxTokensPerRequest int64  `protobuf:"varint,8,opt,name=max_tokens_per_request,json=maxTokensPerRequest" json:"max_tokens_per_request,omitempty" yaml:"max_tokens_per_request"`
+	// Ramps the fill rate from ramp_start_fill_rate up to fill_rate over ramp_duration_millis,
+	// starting at ramp_start_millis since the epoch, or when the bucket is created if unset.
+	// The ramp is linear, or in ramp_steps equal steps if set. Disabled if the duration is unset.
+	RampStartFillRate  int64 `protobuf:"varint,9,opt,name=ramp_start_fill_rate,json=rampStartFillRate" json:"ramp_start_fill_rate,omitempty" yaml:"ramp_start_fill_rate"`
+	RampStartMillis    int64 `protobuf:"varint,10,opt,name=ramp_start_millis,json=rampStartMillis" json:"ramp_start_millis,omitempty" yaml:"ramp_start_millis"`
+	RampDurationMillis int64 `protobuf:"varint,11,opt,name=ramp_duration_millis,json=rampDurationMillis" json:"ramp_duration_millis,omitempty" yaml:"ramp_duration_millis"`
+	RampSteps          int32 `protobuf:"varint,12,opt,name=ramp_steps,json=rampSteps" json:"ramp_steps,omitempty" yaml:"ramp_steps"`
+	// Free-form metadata, such as the owning team, carried into events for reporting.
+	Labels map[string]string `protobuf:"bytes,13,rep,name=labels" json:"labels,omitempty" yaml:"labels" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	// Overrides of this config evaluated by canary_percent of the buckets created from it, chosen by
+	// hashing the bucket's name. Fields unset on the canary are those of this config.
+	Canary        *BucketConfig `protobuf:"bytes,14,opt,name=canary" json:"canary,omitempty" yaml:"canary"`
+	CanaryPercent int32         `protobuf:"varint,15,opt,name=canary_percent,json=canaryPercent" json:"canary_percent,omitempty" yaml:"canary_percent"`
+	// The name of a template in the service config this config is created from. Fields unset on this
+	// config are those of the template.
+	Template string `protobuf:"bytes,16,opt,name=template" json:"template,omitempty" yaml:"template"`
+	// Tokens that may be taken beyond those available without waiting, leaving the bucket in debt
+	// repaid by the fill rate before it accumulates tokens again. Once in more debt, requests wait
+	// for it to be repaid down to max_debt, or are rejected. At most size.
+	MaxDebt int64 `protobuf:"varint,17,opt,name=max_debt,json=maxDebt" json:"max_debt,omitempty" yaml:"max_debt"`
+	// Kill switch granting every request for the bucket without waiting, still taking its tokens and
+	// emitting events for the requests it would reject. Buckets are enabled unless disabled.
+	Disabled bool `protobuf:"varint,18,opt,name=disabled" json:"disabled,omitempty" yaml:"disabled"`
+	// How requests for more than max_tokens_per_request are served: "reject", the default, fails
+	// them, while "clamp" grants max_tokens_per_request, reporting the tokens granted.
+	OverMaxTokensPolicy string `protobuf:"bytes,19,opt,name=over_max_tokens_policy,json=overMaxTokensPolicy" json:"over_max_tokens_policy,omitempty" yaml:"over_max_tokens_policy"`
+	// Requests waiting out waits granted by the bucket at once. Once as many waits granted haven't
+	// passed, further requests are only served tokens available immediately, and are rejected rather
+	// than granted a wait. Unlimited if unset.
+	MaxWaiters int64 `protobuf:"varint,20,opt,name=max_waiters,json=maxWaiters" json:"max_waiters,omitempty" yaml:"max_waiters"`
+	// Tokens the bucket may serve in total in each window of token_cap_window_millis since the epoch,
+	// or over its lifetime if the window is unset, enforced alongside the fill rate. Once the cap is
+	// reached, requests are rejected until the window rolls over. Uncapped if unset.
+	TokenCap             int64 `protobuf:"varint,21,opt,name=token_cap,json=tokenCap" json:"token_cap,omitempty" yaml:"token_cap"`
+	TokenCapWindowMillis int64 `protobuf:"varint,22,opt,name=token_cap_window_millis,json=tokenCapWindowMillis" json:"token_cap_window_millis,omitempty" yaml:"token_cap_window_millis"`
+	// Further limits of tokens per window enforced alongside the fill rate, such as 2000 a minute and
+	// 10000 an hour on top of 100 a second. Requests are granted only if every window grants them,
+	// waiting for the longest of their waits.
+	RateWindows []*RateWindow `protobuf:"bytes,23,rep,name=rate_windows,json=rateWindows" json:"rate_windows,omitempty" yaml:"rate_windows"`
+	// Serves the requests to Allow matching no bucket, such as those for namespaces missing from the
+	// config, in place of the global default bucket, with its own limits and events. At most one
+	// named bucket in the config may be the catch-all.
+	CatchAll bool `protobuf:"varint,24,opt,name=catch_all,json=catchAll" json:"catch_all,omitempty" yaml:"catch_all"`
+	// How long a dynamic bucket idle for max_idle_millis is kept, marked stale, before it is
+	// destroyed. A bucket accessed while stale keeps its tokens, as if it never went idle. Destroyed
+	// once idle if unset.
+	EvictionGraceMillis int64 `protobuf:"varint,25,opt,name=eviction_grace_millis,json=evictionGraceMillis" json:"eviction_grace_millis,omitempty" yaml:"eviction_grace_millis"`
 }
 
 func (m *BucketConfig) Reset()                    { *m = BucketConfig{} }
@@ -200,46 +354,226 @@ func (m *BucketConfig) GetMaxTokensPerRequest() int64 {
 	return 0
 }
 
+func (m *BucketConfig) GetRampStartFillRate() int64 {
+	if m != nil {
+		return m.RampStartFillRate
+	}
+	return 0
+}
+
+func (m *BucketConfig) GetRampStartMillis() int64 {
+	if m != nil {
+		return m.RampStartMillis
+	}
+	return 0
+}
+
+func (m *BucketConfig) GetRampDurationMillis() int64 {
+	if m != nil {
+		return m.RampDurationMillis
+	}
+	return 0
+}
+
+func (m *BucketConfig) GetRampSteps() int32 {
+	if m != nil {
+		return m.RampSteps
+	}
+	return 0
+}
+
+func (m *BucketConfig) GetLabels() map[string]string {
+	if m != nil {
+		return m.Labels
+	}
+	return nil
+}
+
+func (m *BucketConfig) GetCanary() *BucketConfig {
+	if m != nil {
+		return m.Canary
+	}
+	return nil
+}
+
+func (m *BucketConfig) GetCanaryPercent() int32 {
+	if m != nil {
+		return m.CanaryPercent
+	}
+	return 0
+}
+
+func (m *BucketConfig) GetTemplate() string {
+	if m != nil {
+		return m.Template
+	}
+	return ""
+}
+
+func (m *BucketConfig) GetMaxDebt() int64 {
+	if m != nil {
+		return m.MaxDebt
+	}
+	return 0
+}
+
+func (m *BucketConfig) GetDisabled() bool {
+	if m != nil {
+		return m.Disabled
+	}
+	return false
+}
+
+func (m *BucketConfig) GetOverMaxTokensPolicy() string {
+	if m != nil {
+		return m.OverMaxTokensPolicy
+	}
+	return ""
+}
+
+func (m *BucketConfig) GetMaxWaiters() int64 {
+	if m != nil {
+		return m.MaxWaiters
+	}
+	return 0
+}
+
+func (m *BucketConfig) GetTokenCap() int64 {
+	if m != nil {
+		return m.TokenCap
+	}
+	return 0
+}
+
+func (m *BucketConfig) GetTokenCapWindowMillis() int64 {
+	if m != nil {
+		return m.TokenCapWindowMillis
+	}
+	return 0
+}
+
+func (m *BucketConfig) GetRateWindows() []*RateWindow {
+	if m != nil {
+		return m.RateWindows
+	}
+	return nil
+}
+
+func (m *BucketConfig) GetCatchAll() bool {
+	if m != nil {
+		return m.CatchAll
+	}
+	return false
+}
+
+func (m *BucketConfig) GetEvictionGraceMillis() int64 {
+	if m != nil {
+		return m.EvictionGraceMillis
+	}
+	return 0
+}
+
+// A limit of tokens per window, enforced by a bucket like a bucket of size tokens refilling evenly
+// over window_millis.
+type RateWindow struct {
+	Tokens       int64 `protobuf:"varint,1,opt,name=tokens" json:"tokens,omitempty" yaml:"tokens"`
+	WindowMillis int64 `protobuf:"varint,2,opt,name=window_millis,json=windowMillis" json:"window_millis,omitempty" yaml:"window_millis"`
+}
+
+func (m *RateWindow) Reset()                    { *m = RateWindow{} }
+func (m *RateWindow) String() string            { return proto.CompactTextString(m) }
+func (*RateWindow) ProtoMessage()               {}
+func (*RateWindow) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
+
+func (m *RateWindow) GetTokens() int64 {
+	if m != nil {
+		return m.Tokens
+	}
+	return 0
+}
+
+func (m *RateWindow) GetWindowMillis() int64 {
+	if m != nil {
+		return m.WindowMillis
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*ServiceConfig)(nil), "quotaservice.configs.ServiceConfig")
 	proto.RegisterType((*NamespaceConfig)(nil), "quotaservice.configs.NamespaceConfig")
 	proto.RegisterType((*BucketConfig)(nil), "quotaservice.configs.BucketConfig")
+	proto.RegisterType((*RateWindow)(nil), "quotaservice.configs.RateWindow")
 }
 
 func init() { proto.RegisterFile("protos/config/configs.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 509 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x8c, 0x54, 0x4d, 0x6f, 0xd3, 0x40,
-	0x10, 0x95, 0xed, 0xa4, 0x69, 0xa6, 0x84, 0xd2, 0x2d, 0x05, 0xab, 0xe5, 0x10, 0x45, 0x02, 0xe5,
-	0x64, 0xa4, 0xe4, 0x52, 0xc1, 0x0d, 0xc2, 0xa1, 0x12, 0x20, 0xb4, 0x8d, 0x38, 0x70, 0xc0, 0xda,
-	0xc4, 0x93, 0x6a, 0x95, 0xb5, 0x9d, 0x7a, 0xd7, 0x21, 0xe1, 0x07, 0x71, 0xe0, 0x77, 0xf1, 0x43,
-	0xd0, 0x7e, 0x38, 0xd8, 0x55, 0x84, 0x72, 0xca, 0x64, 0xde, 0x9b, 0x37, 0xbb, 0xef, 0xad, 0x0c,
-	0x57, 0xab, 0x22, 0x57, 0xb9, 0x7c, 0x3d, 0xcf, 0xb3, 0x05, 0xbf, 0x73, 0x3f, 0x32, 0x32, 0x5d,
-	0xf2, 0xf4, 0xbe, 0xcc, 0x15, 0x93, 0x58, 0xac, 0xf9, 0x1c, 0x23, 0x87, 0x0d, 0xfe, 0xf8, 0xd0,
-	0xbb, 0xb5, 0xbd, 0xf7, 0xa6, 0x45, 0xbe, 0xc2, 0xc5, 0x9d, 0xc8, 0x67, 0x4c, 0xc4, 0x09, 0x2e,
-	0x58, 0x29, 0x54, 0x3c, 0x2b, 0xe7, 0x4b, 0x54, 0xa1, 0xd7, 0xf7, 0x86, 0x27, 0xa3, 0x41, 0xb4,
-	0x4f, 0x27, 0x7a, 0x67, 0x38, 0x56, 0x82, 0x9e, 0x5b, 0x81, 0x89, 0x9d, 0xb7, 0x10, 0xb9, 0x05,
-	0xc8, 0x58, 0x8a, 0x72, 0xc5, 0xe6, 0x28, 0x43, 0xbf, 0x1f, 0x0c, 0x4f, 0x46, 0xe3, 0xfd, 0x62,
-	0x8d, 0x03, 0x45, 0x9f, 0x77, 0x53, 0x1f, 0x32, 0x55, 0x6c, 0x69, 0x4d, 0x86, 0x84, 0xd0, 0x59,
-	0x63, 0x21, 0x79, 0x9e, 0x85, 0x41, 0xdf, 0x1b, 0xb6, 0x69, 0xf5, 0x97, 0x10, 0x68, 0x95, 0x12,
-	0x8b, 0xb0, 0xd5, 0xf7, 0x86, 0x5d, 0x6a, 0x6a, 0xdd, 0x4b, 0x98, 0xc2, 0xb0, 0xdd, 0xf7, 0x86,
-	0x01, 0x35, 0xf5, 0x65, 0x02, 0xa7, 0x0f, 0x16, 0x90, 0x27, 0x10, 0x2c, 0x71, 0x6b, 0xee, 0xdb,
-	0xa5, 0xba, 0x24, 0x6f, 0xa1, 0xbd, 0x66, 0xa2, 0xc4, 0xd0, 0x37, 0x1e, 0xbc, 0xdc, 0x7f, 0xec,
-	0x9d, 0x8e, 0xb3, 0xc1, 0xce, 0xbc, 0xf1, 0xaf, 0xbd, 0xc1, 0xef, 0xa0, 0xb6, 0xc6, 0x19, 0x4d,
-	0xa0, 0xa5, 0x6f, 0xe2, 0xf6, 0x98, 0x9a, 0xdc, 0xc0, 0xe3, 0x07, 0xae, 0xfb, 0x07, 0xbb, 0xde,
-	0x4b, 0x1a, 0x7e, 0x7f, 0x83, 0xe7, 0xc9, 0x36, 0x63, 0x29, 0x9f, 0x3b, 0xa9, 0x58, 0x61, 0xba,
-	0x12, 0xfa, 0xfe, 0xc1, 0xc1, 0x9a, 0x17, 0x4e, 0xc2, 0x36, 0xa7, 0x4e, 0x80, 0x44, 0x70, 0x9e,
-	0xb2, 0x4d, 0xdc, 0xd4, 0x97, 0xc6, 0xeb, 0x36, 0x3d, 0x4b, 0xd9, 0x66, 0x52, 0x1f, 0x93, 0xe4,
-	0x23, 0x74, 0x2a, 0x4e, 0xdb, 0x04, 0x3f, 0x3a, 0xc8, 0x41, 0x77, 0x16, 0x97, 0x7b, 0x25, 0x71,
-	0xf9, 0x1d, 0x1e, 0xd5, 0x81, 0x3d, 0x79, 0x5d, 0x37, 0xf3, 0x3a, 0xe4, 0xa6, 0xb5, 0xb0, 0x7e,
-	0xf9, 0xd5, 0x82, 0xff, 0x24, 0xf5, 0x02, 0xba, 0xbb, 0x77, 0x68, 0xd6, 0x74, 0xe9, 0xbf, 0x86,
-	0x9e, 0x90, 0xfc, 0xa7, 0x75, 0x3a, 0xa0, 0xa6, 0x26, 0x57, 0xd0, 0x5d, 0x70, 0x21, 0xe2, 0x42,
-	0x47, 0xd0, 0x32, 0xc0, 0xb1, 0x6e, 0x50, 0xe7, 0xe8, 0x0f, 0xc6, 0x55, 0xac, 0x78, 0x8a, 0x79,
-	0xa9, 0xe2, 0x94, 0x0b, 0xc1, 0xa5, 0x7b, 0xa9, 0x67, 0x1a, 0x9a, 0x5a, 0xe4, 0x93, 0x01, 0xc8,
-	0x2b, 0x38, 0xd5, 0x09, 0xf0, 0x44, 0x60, 0xc5, 0x3d, 0x32, 0xdc, 0x5e, 0xca, 0x36, 0x37, 0x89,
-	0xc0, 0x26, 0x2f, 0xc1, 0xd9, 0x4e, 0xb3, 0xb3, 0xe3, 0x4d, 0x70, 0x56, 0xe9, 0x8d, 0xe1, 0x99,
-	0xe6, 0xa9, 0x7c, 0x89, 0x99, 0x8c, 0x57, 0x58, 0xc4, 0x05, 0xde, 0x97, 0x28, 0x55, 0x78, 0x6c,
-	0xe8, 0x3a, 0xef, 0xa9, 0x01, 0xbf, 0x60, 0x41, 0x2d, 0x34, 0x3b, 0x32, 0x5f, 0x96, 0xf1, 0xdf,
-	0x00, 0x00, 0x00, 0xff, 0xff, 0x29, 0xba, 0x7e, 0x7d, 0x78, 0x04, 0x00, 0x00,
+	// 1045 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0xac, 0x56, 0xdd, 0x6f, 0x1b, 0x45,
+	0x10, 0x97, 0xeb, 0xf8, 0xe3, 0xc6, 0x1f, 0x49, 0x36, 0x4e, 0xb2, 0x75, 0x5b, 0x61, 0x05, 0x15,
+	0x59, 0x3c, 0xb8, 0x28, 0x11, 0xa2, 0x94, 0x07, 0x54, 0x12, 0x8a, 0xa2, 0xa6, 0x28, 0xba, 0x44,
+	0x54, 0x42, 0x88, 0x65, 0x7d, 0xb7, 0x09, 0x2b, 0xef, 0xdd, 0xb9, 0xbb, 0x6b, 0x27, 0xe6, 0x8d,
+	0x77, 0xfe, 0x35, 0xfe, 0x27, 0xb4, 0x1f, 0x77, 0x3e, 0x07, 0x8b, 0xfa, 0x81, 0x27, 0xef, 0xfe,
+	0x66, 0xe6, 0xb7, 0x73, 0x33, 0xbf, 0x19, 0x19, 0x9e, 0x4c, 0x65, 0xa6, 0x33, 0xf5, 0x22, 0xca,
+	0xd2, 0x1b, 0x7e, 0xeb, 0x7f, 0xd4, 0xc8, 0xa2, 0xa8, 0xf7, 0x61, 0x96, 0x69, 0xaa, 0x98, 0x9c,
+	0xf3, 0x88, 0x8d, 0xbc, 0xed, 0xe8, 0xcf, 0x1a, 0x74, 0xae, 0x1c, 0x76, 0x6a, 0x21, 0xf4, 0x13,
+	0xec, 0xdf, 0x8a, 0x6c, 0x4c, 0x05, 0x89, 0xd9, 0x0d, 0x9d, 0x09, 0x4d, 0xc6, 0xb3, 0x68, 0xc2,
+	0x34, 0xae, 0x0c, 0x2a, 0xc3, 0xd6, 0xf1, 0xd1, 0x68, 0x1d, 0xcf, 0xe8, 0x3b, 0xeb, 0xe3, 0x28,
+	0xc2, 0x3d, 0x47, 0x70, 0xe6, 0xe2, 0x9d, 0x09, 0x5d, 0x01, 0xa4, 0x34, 0x61, 0x6a, 0x4a, 0x23,
+	0xa6, 0xf0, 0xa3, 0x41, 0x75, 0xd8, 0x3a, 0x3e, 0x59, 0x4f, 0xb6, 0x92, 0xd0, 0xe8, 0xc7, 0x22,
+	0xea, 0xfb, 0x54, 0xcb, 0x45, 0x58, 0xa2, 0x41, 0x18, 0x1a, 0x73, 0x26, 0x15, 0xcf, 0x52, 0x5c,
+	0x1d, 0x54, 0x86, 0xb5, 0x30, 0xbf, 0x22, 0x04, 0x5b, 0x33, 0xc5, 0x24, 0xde, 0x1a, 0x54, 0x86,
+	0x41, 0x68, 0xcf, 0x06, 0x8b, 0xa9, 0x66, 0xb8, 0x36, 0xa8, 0x0c, 0xab, 0xa1, 0x3d, 0xa3, 0x4f,
+	0xa0, 0x45, 0x23, 0xcd, 0xe7, 0x54, 0x33, 0x42, 0x35, 0xae, 0x5b, 0x13, 0xe4, 0xd0, 0x6b, 0x8d,
+	0x2e, 0x21, 0xd0, 0x2c, 0x99, 0x0a, 0xaa, 0x99, 0xc2, 0x0d, 0x9b, 0xf6, 0xf1, 0x26, 0x69, 0x5f,
+	0xe7, 0x41, 0x2e, 0xeb, 0x25, 0x09, 0x7a, 0x0a, 0x81, 0xe2, 0xb7, 0x29, 0xd5, 0x33, 0xc9, 0x70,
+	0x73, 0x50, 0x19, 0xb6, 0xc3, 0x25, 0x80, 0x86, 0xb0, 0x53, 0x5c, 0xc8, 0x84, 0x2d, 0x08, 0x8f,
+	0x71, 0x60, 0x3f, 0xa2, 0x5b, 0xe0, 0x6f, 0xd9, 0xe2, 0x3c, 0xee, 0xc7, 0xb0, 0xfd, 0xa0, 0x36,
+	0x68, 0x07, 0xaa, 0x13, 0xb6, 0xb0, 0xad, 0x0a, 0x42, 0x73, 0x44, 0xdf, 0x40, 0x6d, 0x4e, 0xc5,
+	0x8c, 0xe1, 0x47, 0xb6, 0x7d, 0xcf, 0xd7, 0xa7, 0x5e, 0xf0, 0xf8, 0x0e, 0xba, 0x98, 0x57, 0x8f,
+	0x5e, 0x56, 0xfa, 0xbf, 0x41, 0x77, 0xf5, 0x53, 0xd6, 0x3c, 0xf2, 0x72, 0xf5, 0x91, 0x4d, 0x34,
+	0xb2, 0x7c, 0xe1, 0xe8, 0xaf, 0x7a, 0xe9, 0x43, 0x9c, 0xd9, 0xb4, 0xca, 0xb4, 0xd9, 0x3f, 0x62,
+	0xcf, 0xe8, 0x1c, 0xba, 0x0f, 0x24, 0xb9, 0xf9, 0x73, 0x9d, 0x78, 0x45, 0x8c, 0x3f, 0xc3, 0x61,
+	0xbc, 0x48, 0x69, 0xc2, 0x23, 0x4f, 0x45, 0xf2, 0xf6, 0xe0, 0xea, 0xc6, 0x9c, 0xfb, 0x9e, 0xc2,
+	0x81, 0x79, 0x91, 0xd0, 0x08, 0xf6, 0x12, 0x7a, 0x4f, 0x56, 0xf9, 0x95, 0x15, 0x62, 0x2d, 0xdc,
+	0x4d, 0xe8, 0xfd, 0x59, 0x39, 0x4c, 0xa1, 0x0b, 0x68, 0xe4, 0x3e, 0xb5, 0xff, 0x92, 0xd7, 0x83,
+	0x12, 0xf9, 0x5c, 0xbc, 0xbc, 0x72, 0x0a, 0xf4, 0x0b, 0x74, 0x24, 0xfb, 0x30, 0x63, 0x4a, 0x93,
+	0x28, 0x53, 0x5a, 0xe1, 0xba, 0xe5, 0xfc, 0x6a, 0x33, 0xce, 0xd0, 0x85, 0x9e, 0x66, 0x2a, 0x27,
+	0x6e, 0xcb, 0x12, 0x84, 0xfa, 0xd0, 0x8c, 0xb9, 0xa2, 0x63, 0xc1, 0x62, 0xdc, 0x18, 0x54, 0x86,
+	0xcd, 0xb0, 0xb8, 0xa3, 0xb7, 0xb0, 0x5d, 0x4c, 0x26, 0x11, 0x3c, 0xe1, 0x1a, 0x37, 0x37, 0xae,
+	0x65, 0xb7, 0x08, 0xbd, 0x30, 0x91, 0x66, 0xb0, 0xc7, 0x34, 0x9a, 0xb0, 0x34, 0x17, 0x7f, 0x7e,
+	0x35, 0x03, 0xab, 0xb3, 0x09, 0x4b, 0x89, 0x8a, 0xa8, 0x60, 0x18, 0xdc, 0xc0, 0x5a, 0xe8, 0xca,
+	0x20, 0xe8, 0x19, 0xc0, 0x0d, 0x55, 0x9a, 0x68, 0x49, 0xa3, 0x09, 0x6e, 0xd9, 0x2c, 0x03, 0x83,
+	0x5c, 0x1b, 0xa0, 0xff, 0x2b, 0xb4, 0xcb, 0x95, 0xfb, 0xbf, 0xd5, 0xdc, 0xff, 0x16, 0x76, 0xff,
+	0x55, 0xc5, 0x35, 0x8f, 0xf4, 0xca, 0x8f, 0x54, 0xcb, 0xe3, 0xf0, 0x77, 0x13, 0xda, 0x65, 0xf2,
+	0xb5, 0xb3, 0xf0, 0x14, 0x82, 0xa2, 0x62, 0x96, 0x22, 0x08, 0x97, 0x80, 0x89, 0x50, 0xfc, 0x0f,
+	0xa7, 0xe5, 0x6a, 0x68, 0xcf, 0xe8, 0x09, 0x04, 0x37, 0x5c, 0x08, 0x22, 0x8d, 0xc8, 0xb7, 0xac,
+	0xa1, 0x69, 0x80, 0xd0, 0x6b, 0xf6, 0x8e, 0x72, 0x4d, 0x34, 0x4f, 0x58, 0x36, 0xd3, 0x24, 0xe1,
+	0x42, 0x70, 0xe5, 0x17, 0xe5, 0xae, 0x31, 0x5d, 0x3b, 0xcb, 0x3b, 0x6b, 0x40, 0x9f, 0xc1, 0xb6,
+	0xd1, 0x38, 0x8f, 0x05, 0xcb, 0x7d, 0xdd, 0xe6, 0xec, 0x24, 0xf4, 0xfe, 0x3c, 0x16, 0x6c, 0xd5,
+	0x2f, 0x66, 0xe3, 0x82, 0xb3, 0x51, 0xf8, 0x9d, 0xb1, 0x71, 0xce, 0x77, 0x02, 0x07, 0xc6, 0xcf,
+	0x76, 0x51, 0x91, 0x29, 0x93, 0xc4, 0xcb, 0xce, 0x4a, 0xa8, 0x1a, 0x9a, 0x89, 0xba, 0xb6, 0xc6,
+	0x4b, 0x26, 0x7d, 0x79, 0xd1, 0x0b, 0xe8, 0x49, 0x9a, 0x4c, 0x89, 0xd2, 0x54, 0x6a, 0xb2, 0xfc,
+	0xb8, 0xc0, 0x65, 0x6d, 0x6c, 0x57, 0xc6, 0xf4, 0x26, 0xff, 0xca, 0xcf, 0x61, 0xb7, 0x14, 0xe0,
+	0xf3, 0x71, 0x02, 0xda, 0x2e, 0xbc, 0x7d, 0x46, 0x5f, 0x78, 0xf2, 0x78, 0x26, 0xa9, 0xe6, 0x59,
+	0x9a, 0xbb, 0xb7, 0xac, 0x3b, 0x32, 0xb6, 0x33, 0x6f, 0xf2, 0x11, 0xcf, 0x00, 0x3c, 0x3b, 0x9b,
+	0x2a, 0xdc, 0xb6, 0xe3, 0x1e, 0x38, 0x5a, 0x36, 0x55, 0xe8, 0x0d, 0xd4, 0x05, 0x1d, 0x33, 0xa1,
+	0x70, 0xc7, 0x4e, 0xe4, 0xe8, 0xe3, 0xb2, 0x1a, 0x5d, 0xd8, 0x00, 0x37, 0x88, 0x3e, 0x1a, 0xbd,
+	0x82, 0x7a, 0x44, 0x53, 0x2a, 0x17, 0xb8, 0xbb, 0xb1, 0x3c, 0x7d, 0x04, 0x7a, 0x0e, 0x5d, 0x77,
+	0x32, 0x25, 0x8e, 0x58, 0xaa, 0xf1, 0xb6, 0x4d, 0xb3, 0xe3, 0xd0, 0x4b, 0x07, 0x9a, 0x29, 0x2f,
+	0xd6, 0xe1, 0x8e, 0xd5, 0x56, 0x71, 0x47, 0x8f, 0xa1, 0x99, 0x77, 0x14, 0xef, 0xda, 0x5a, 0x34,
+	0x7c, 0x2b, 0x57, 0x96, 0x03, 0x7a, 0xb0, 0x1c, 0x4e, 0xe0, 0x20, 0x9b, 0x33, 0x49, 0xca, 0x5d,
+	0xce, 0x04, 0x8f, 0x16, 0x78, 0xcf, 0x3e, 0xb0, 0x67, 0xac, 0xef, 0x8a, 0x26, 0x5b, 0x93, 0x19,
+	0x75, 0xe3, 0x6f, 0xe4, 0xc7, 0xa4, 0xc2, 0x3d, 0x37, 0xea, 0x09, 0xbd, 0x7f, 0xef, 0x10, 0xa3,
+	0x69, 0xb7, 0x0b, 0x22, 0x3a, 0xc5, 0xfb, 0x4e, 0xd3, 0x16, 0x38, 0xa5, 0x53, 0xf4, 0x25, 0x1c,
+	0x16, 0x46, 0x72, 0xc7, 0xd3, 0x38, 0xbb, 0xcb, 0x9b, 0x78, 0x60, 0x5d, 0x7b, 0xb9, 0xeb, 0x7b,
+	0x6b, 0xf4, 0x6d, 0x3c, 0x85, 0xb6, 0x51, 0x91, 0x8f, 0x50, 0xf8, 0xd0, 0x76, 0x6b, 0xb0, 0xbe,
+	0xca, 0x46, 0x56, 0x2e, 0x3a, 0x6c, 0xc9, 0xe2, 0x6c, 0x13, 0x8b, 0xa8, 0x8e, 0x7e, 0x27, 0x54,
+	0x08, 0x8c, 0x5d, 0x2d, 0x2c, 0xf0, 0x5a, 0x08, 0x74, 0x0c, 0xfb, 0x6c, 0xce, 0x23, 0xab, 0xaa,
+	0x5b, 0x69, 0xb6, 0xa5, 0x4f, 0xeb, 0xb1, 0xd3, 0x7a, 0x6e, 0xfc, 0xc1, 0xd8, 0x5c, 0x56, 0xfd,
+	0xaf, 0xa1, 0x55, 0x12, 0xc3, 0xc7, 0xf6, 0x49, 0x50, 0xde, 0x27, 0xe7, 0x00, 0xcb, 0x34, 0xd1,
+	0x01, 0xd4, 0x5d, 0xfd, 0x6d, 0x70, 0x35, 0xf4, 0x37, 0xf4, 0x29, 0x74, 0x56, 0x6b, 0xe4, 0xf6,
+	0x52, 0xfb, 0xae, 0x54, 0x9b, 0x71, 0xdd, 0xfe, 0x95, 0x3c, 0xf9, 0x67, 0x00, 0x2e, 0x79, 0x95,
+	0x4a, 0x69, 0x0a, 0x00, 0x00,
 }
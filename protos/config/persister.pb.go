@@ -0,0 +1,354 @@
+// Code generated by protoc-gen-go.
+// source: protos/config/persister.proto
+// DO NOT EDIT!
+
+package quotaservice_configs
+
+import proto "github.com/golang/protobuf/proto"
+import fmt "fmt"
+import math "math"
+
+import (
+	context "golang.org/x/net/context"
+	grpc "google.golang.org/grpc"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+type ReadPersistedConfigRequest struct {
+}
+
+func (m *ReadPersistedConfigRequest) Reset()                    { *m = ReadPersistedConfigRequest{} }
+func (m *ReadPersistedConfigRequest) String() string            { return proto.CompactTextString(m) }
+func (*ReadPersistedConfigRequest) ProtoMessage()               {}
+func (*ReadPersistedConfigRequest) Descriptor() ([]byte, []int) { return fileDescriptor1, []int{0} }
+
+type ReadHistoricalConfigsRequest struct {
+}
+
+func (m *ReadHistoricalConfigsRequest) Reset()                    { *m = ReadHistoricalConfigsRequest{} }
+func (m *ReadHistoricalConfigsRequest) String() string            { return proto.CompactTextString(m) }
+func (*ReadHistoricalConfigsRequest) ProtoMessage()               {}
+func (*ReadHistoricalConfigsRequest) Descriptor() ([]byte, []int) { return fileDescriptor1, []int{1} }
+
+type ReadHistoricalConfigsResponse struct {
+	Configs []*ServiceConfig `protobuf:"bytes,1,rep,name=configs" json:"configs,omitempty"`
+}
+
+func (m *ReadHistoricalConfigsResponse) Reset()                    { *m = ReadHistoricalConfigsResponse{} }
+func (m *ReadHistoricalConfigsResponse) String() string            { return proto.CompactTextString(m) }
+func (*ReadHistoricalConfigsResponse) ProtoMessage()               {}
+func (*ReadHistoricalConfigsResponse) Descriptor() ([]byte, []int) { return fileDescriptor1, []int{2} }
+
+func (m *ReadHistoricalConfigsResponse) GetConfigs() []*ServiceConfig {
+	if m != nil {
+		return m.Configs
+	}
+	return nil
+}
+
+type PersistAndNotifyRequest struct {
+	OldHash string         `protobuf:"bytes,1,opt,name=old_hash,json=oldHash" json:"old_hash,omitempty"`
+	Config  *ServiceConfig `protobuf:"bytes,2,opt,name=config" json:"config,omitempty"`
+}
+
+func (m *PersistAndNotifyRequest) Reset()                    { *m = PersistAndNotifyRequest{} }
+func (m *PersistAndNotifyRequest) String() string            { return proto.CompactTextString(m) }
+func (*PersistAndNotifyRequest) ProtoMessage()               {}
+func (*PersistAndNotifyRequest) Descriptor() ([]byte, []int) { return fileDescriptor1, []int{3} }
+
+func (m *PersistAndNotifyRequest) GetOldHash() string {
+	if m != nil {
+		return m.OldHash
+	}
+	return ""
+}
+
+func (m *PersistAndNotifyRequest) GetConfig() *ServiceConfig {
+	if m != nil {
+		return m.Config
+	}
+	return nil
+}
+
+type PersistAndNotifyResponse struct {
+	// The version persisted, which ReadPersistedConfig then reports.
+	Version int32 `protobuf:"varint,1,opt,name=version" json:"version,omitempty"`
+}
+
+func (m *PersistAndNotifyResponse) Reset()                    { *m = PersistAndNotifyResponse{} }
+func (m *PersistAndNotifyResponse) String() string            { return proto.CompactTextString(m) }
+func (*PersistAndNotifyResponse) ProtoMessage()               {}
+func (*PersistAndNotifyResponse) Descriptor() ([]byte, []int) { return fileDescriptor1, []int{4} }
+
+func (m *PersistAndNotifyResponse) GetVersion() int32 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
+type WatchConfigChangesRequest struct {
+}
+
+func (m *WatchConfigChangesRequest) Reset()                    { *m = WatchConfigChangesRequest{} }
+func (m *WatchConfigChangesRequest) String() string            { return proto.CompactTextString(m) }
+func (*WatchConfigChangesRequest) ProtoMessage()               {}
+func (*WatchConfigChangesRequest) Descriptor() ([]byte, []int) { return fileDescriptor1, []int{5} }
+
+type ConfigChangedNotification struct {
+	Version int32 `protobuf:"varint,1,opt,name=version" json:"version,omitempty"`
+}
+
+func (m *ConfigChangedNotification) Reset()                    { *m = ConfigChangedNotification{} }
+func (m *ConfigChangedNotification) String() string            { return proto.CompactTextString(m) }
+func (*ConfigChangedNotification) ProtoMessage()               {}
+func (*ConfigChangedNotification) Descriptor() ([]byte, []int) { return fileDescriptor1, []int{6} }
+
+func (m *ConfigChangedNotification) GetVersion() int32 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
+func init() {
+	proto.RegisterType((*ReadPersistedConfigRequest)(nil), "quotaservice.configs.ReadPersistedConfigRequest")
+	proto.RegisterType((*ReadHistoricalConfigsRequest)(nil), "quotaservice.configs.ReadHistoricalConfigsRequest")
+	proto.RegisterType((*ReadHistoricalConfigsResponse)(nil), "quotaservice.configs.ReadHistoricalConfigsResponse")
+	proto.RegisterType((*PersistAndNotifyRequest)(nil), "quotaservice.configs.PersistAndNotifyRequest")
+	proto.RegisterType((*PersistAndNotifyResponse)(nil), "quotaservice.configs.PersistAndNotifyResponse")
+	proto.RegisterType((*WatchConfigChangesRequest)(nil), "quotaservice.configs.WatchConfigChangesRequest")
+	proto.RegisterType((*ConfigChangedNotification)(nil), "quotaservice.configs.ConfigChangedNotification")
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// Client API for ConfigPersisterService service
+
+type ConfigPersisterServiceClient interface {
+	ReadPersistedConfig(ctx context.Context, in *ReadPersistedConfigRequest, opts ...grpc.CallOption) (*ServiceConfig, error)
+	ReadHistoricalConfigs(ctx context.Context, in *ReadHistoricalConfigsRequest, opts ...grpc.CallOption) (*ReadHistoricalConfigsResponse, error)
+	PersistAndNotify(ctx context.Context, in *PersistAndNotifyRequest, opts ...grpc.CallOption) (*PersistAndNotifyResponse, error)
+	WatchConfigChanges(ctx context.Context, in *WatchConfigChangesRequest, opts ...grpc.CallOption) (ConfigPersisterService_WatchConfigChangesClient, error)
+}
+
+type configPersisterServiceClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewConfigPersisterServiceClient(cc *grpc.ClientConn) ConfigPersisterServiceClient {
+	return &configPersisterServiceClient{cc}
+}
+
+func (c *configPersisterServiceClient) ReadPersistedConfig(ctx context.Context, in *ReadPersistedConfigRequest, opts ...grpc.CallOption) (*ServiceConfig, error) {
+	out := new(ServiceConfig)
+	err := grpc.Invoke(ctx, "/quotaservice.configs.ConfigPersisterService/ReadPersistedConfig", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *configPersisterServiceClient) ReadHistoricalConfigs(ctx context.Context, in *ReadHistoricalConfigsRequest, opts ...grpc.CallOption) (*ReadHistoricalConfigsResponse, error) {
+	out := new(ReadHistoricalConfigsResponse)
+	err := grpc.Invoke(ctx, "/quotaservice.configs.ConfigPersisterService/ReadHistoricalConfigs", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *configPersisterServiceClient) PersistAndNotify(ctx context.Context, in *PersistAndNotifyRequest, opts ...grpc.CallOption) (*PersistAndNotifyResponse, error) {
+	out := new(PersistAndNotifyResponse)
+	err := grpc.Invoke(ctx, "/quotaservice.configs.ConfigPersisterService/PersistAndNotify", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *configPersisterServiceClient) WatchConfigChanges(ctx context.Context, in *WatchConfigChangesRequest, opts ...grpc.CallOption) (ConfigPersisterService_WatchConfigChangesClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_ConfigPersisterService_serviceDesc.Streams[0], c.cc, "/quotaservice.configs.ConfigPersisterService/WatchConfigChanges", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &configPersisterServiceWatchConfigChangesClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type ConfigPersisterService_WatchConfigChangesClient interface {
+	Recv() (*ConfigChangedNotification, error)
+	grpc.ClientStream
+}
+
+type configPersisterServiceWatchConfigChangesClient struct {
+	grpc.ClientStream
+}
+
+func (x *configPersisterServiceWatchConfigChangesClient) Recv() (*ConfigChangedNotification, error) {
+	m := new(ConfigChangedNotification)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Server API for ConfigPersisterService service
+
+type ConfigPersisterServiceServer interface {
+	ReadPersistedConfig(context.Context, *ReadPersistedConfigRequest) (*ServiceConfig, error)
+	ReadHistoricalConfigs(context.Context, *ReadHistoricalConfigsRequest) (*ReadHistoricalConfigsResponse, error)
+	PersistAndNotify(context.Context, *PersistAndNotifyRequest) (*PersistAndNotifyResponse, error)
+	WatchConfigChanges(*WatchConfigChangesRequest, ConfigPersisterService_WatchConfigChangesServer) error
+}
+
+func RegisterConfigPersisterServiceServer(s *grpc.Server, srv ConfigPersisterServiceServer) {
+	s.RegisterService(&_ConfigPersisterService_serviceDesc, srv)
+}
+
+func _ConfigPersisterService_ReadPersistedConfig_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReadPersistedConfigRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ConfigPersisterServiceServer).ReadPersistedConfig(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/quotaservice.configs.ConfigPersisterService/ReadPersistedConfig",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ConfigPersisterServiceServer).ReadPersistedConfig(ctx, req.(*ReadPersistedConfigRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ConfigPersisterService_ReadHistoricalConfigs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReadHistoricalConfigsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ConfigPersisterServiceServer).ReadHistoricalConfigs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/quotaservice.configs.ConfigPersisterService/ReadHistoricalConfigs",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ConfigPersisterServiceServer).ReadHistoricalConfigs(ctx, req.(*ReadHistoricalConfigsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ConfigPersisterService_PersistAndNotify_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PersistAndNotifyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ConfigPersisterServiceServer).PersistAndNotify(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/quotaservice.configs.ConfigPersisterService/PersistAndNotify",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ConfigPersisterServiceServer).PersistAndNotify(ctx, req.(*PersistAndNotifyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ConfigPersisterService_WatchConfigChanges_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchConfigChangesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ConfigPersisterServiceServer).WatchConfigChanges(m, &configPersisterServiceWatchConfigChangesServer{stream})
+}
+
+type ConfigPersisterService_WatchConfigChangesServer interface {
+	Send(*ConfigChangedNotification) error
+	grpc.ServerStream
+}
+
+type configPersisterServiceWatchConfigChangesServer struct {
+	grpc.ServerStream
+}
+
+func (x *configPersisterServiceWatchConfigChangesServer) Send(m *ConfigChangedNotification) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+var _ConfigPersisterService_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "quotaservice.configs.ConfigPersisterService",
+	HandlerType: (*ConfigPersisterServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ReadPersistedConfig",
+			Handler:    _ConfigPersisterService_ReadPersistedConfig_Handler,
+		},
+		{
+			MethodName: "ReadHistoricalConfigs",
+			Handler:    _ConfigPersisterService_ReadHistoricalConfigs_Handler,
+		},
+		{
+			MethodName: "PersistAndNotify",
+			Handler:    _ConfigPersisterService_PersistAndNotify_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchConfigChanges",
+			Handler:       _ConfigPersisterService_WatchConfigChanges_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "protos/config/persister.proto",
+}
+
+func init() { proto.RegisterFile("protos/config/persister.proto", fileDescriptor1) }
+
+var fileDescriptor1 = []byte{
+	// 357 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x94, 0x53, 0xcf, 0x4f, 0x32, 0x31,
+	0x10, 0x65, 0x3f, 0xf2, 0x81, 0x8e, 0x17, 0x53, 0x7f, 0x2d, 0x0b, 0x18, 0x52, 0x2f, 0x5c, 0x5c,
+	0x08, 0xe8, 0xc9, 0x78, 0x30, 0x5c, 0x38, 0x19, 0xb3, 0x1e, 0xbc, 0x69, 0xea, 0x6e, 0x61, 0x9b,
+	0x90, 0x16, 0x76, 0x0a, 0x89, 0x1e, 0xfd, 0xc3, 0x8d, 0x61, 0xdb, 0x25, 0x2a, 0xdb, 0x04, 0x8f,
+	0x9d, 0xd7, 0xf7, 0xde, 0x74, 0xde, 0x14, 0xda, 0xf3, 0x4c, 0x69, 0x85, 0xbd, 0x58, 0xc9, 0x89,
+	0x98, 0xf6, 0xe6, 0x3c, 0x43, 0x81, 0x9a, 0x67, 0x61, 0x5e, 0x27, 0xc7, 0x8b, 0xa5, 0xd2, 0x0c,
+	0x79, 0xb6, 0x12, 0x31, 0x0f, 0xcd, 0x25, 0x0c, 0x9a, 0x3f, 0x49, 0xb6, 0x6c, 0x28, 0xb4, 0x05,
+	0x41, 0xc4, 0x59, 0xf2, 0x60, 0x95, 0x92, 0x51, 0x8e, 0x46, 0x7c, 0xb1, 0xe4, 0xa8, 0xe9, 0x39,
+	0xb4, 0xd6, 0xe8, 0x58, 0xa0, 0x56, 0x99, 0x88, 0xd9, 0xcc, 0xc0, 0x58, 0xe0, 0xcf, 0xd0, 0x76,
+	0xe0, 0x38, 0x57, 0x12, 0x39, 0xb9, 0x85, 0xba, 0xf5, 0xf3, 0xbd, 0x4e, 0xb5, 0x7b, 0x30, 0xb8,
+	0x08, 0xcb, 0x7a, 0x0c, 0x1f, 0xcd, 0xd9, 0xba, 0x17, 0x1c, 0xba, 0x80, 0x33, 0xdb, 0xd9, 0x9d,
+	0x4c, 0xee, 0x95, 0x16, 0x93, 0x37, 0x6b, 0x4d, 0x1a, 0xb0, 0xa7, 0x66, 0xc9, 0x4b, 0xca, 0x30,
+	0xf5, 0xbd, 0x8e, 0xd7, 0xdd, 0x8f, 0xea, 0x6a, 0x96, 0x8c, 0x19, 0xa6, 0xe4, 0x06, 0x6a, 0x46,
+	0xc0, 0xff, 0xd7, 0xf1, 0x76, 0xf5, 0xb4, 0x14, 0x7a, 0x05, 0xfe, 0xb6, 0xa5, 0x7d, 0x8d, 0x0f,
+	0xf5, 0xd5, 0x1a, 0x53, 0x32, 0xb7, 0xfc, 0x1f, 0x15, 0x47, 0xda, 0x84, 0xc6, 0x13, 0xd3, 0x71,
+	0x6a, 0xc4, 0x46, 0x29, 0x93, 0x53, 0xbe, 0x99, 0xd2, 0x35, 0x34, 0xbe, 0xd7, 0x8d, 0xaa, 0x88,
+	0x99, 0x16, 0x4a, 0xba, 0x35, 0x07, 0x9f, 0x55, 0x38, 0x35, 0xbc, 0x22, 0x9d, 0xcc, 0xb6, 0x4c,
+	0x24, 0x1c, 0x95, 0xa4, 0x46, 0xfa, 0xe5, 0x0f, 0x75, 0x07, 0x1c, 0xec, 0x32, 0x1a, 0x5a, 0x21,
+	0x1f, 0x1e, 0x9c, 0x94, 0x06, 0x4d, 0x06, 0x6e, 0x4b, 0xd7, 0xd6, 0x04, 0xc3, 0x3f, 0x71, 0xcc,
+	0xec, 0x69, 0x85, 0x20, 0x1c, 0xfe, 0x4e, 0x86, 0x5c, 0x96, 0x4b, 0x39, 0x96, 0x26, 0x08, 0x77,
+	0xbd, 0xbe, 0x31, 0x7d, 0x07, 0xb2, 0x1d, 0x2c, 0xe9, 0x95, 0xeb, 0x38, 0x57, 0x20, 0x70, 0x10,
+	0x9c, 0x6b, 0x41, 0x2b, 0x7d, 0xef, 0xb5, 0x96, 0x7f, 0xd1, 0xe1, 0xd7, 0x00, 0xa9, 0xff, 0x5f,
+	0xd3, 0xf6, 0x03, 0x00, 0x00,
+}
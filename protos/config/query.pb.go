@@ -0,0 +1,288 @@
+// Code generated by protoc-gen-go.
+// source: protos/config/query.proto
+// DO NOT EDIT!
+
+package quotaservice_configs
+
+import proto "github.com/golang/protobuf/proto"
+import fmt "fmt"
+import math "math"
+
+import (
+	context "golang.org/x/net/context"
+	grpc "google.golang.org/grpc"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+type GetConfigRequest struct {
+}
+
+func (m *GetConfigRequest) Reset()                    { *m = GetConfigRequest{} }
+func (m *GetConfigRequest) String() string            { return proto.CompactTextString(m) }
+func (*GetConfigRequest) ProtoMessage()               {}
+func (*GetConfigRequest) Descriptor() ([]byte, []int) { return fileDescriptor2, []int{0} }
+
+type GetConfigResponse struct {
+	Config  *ServiceConfig `protobuf:"bytes,1,opt,name=config" json:"config,omitempty"`
+	Version int32          `protobuf:"varint,2,opt,name=version" json:"version,omitempty"`
+}
+
+func (m *GetConfigResponse) Reset()                    { *m = GetConfigResponse{} }
+func (m *GetConfigResponse) String() string            { return proto.CompactTextString(m) }
+func (*GetConfigResponse) ProtoMessage()               {}
+func (*GetConfigResponse) Descriptor() ([]byte, []int) { return fileDescriptor2, []int{1} }
+
+func (m *GetConfigResponse) GetConfig() *ServiceConfig {
+	if m != nil {
+		return m.Config
+	}
+	return nil
+}
+
+func (m *GetConfigResponse) GetVersion() int32 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
+type GetConfigHistoryRequest struct {
+	// *
+	// Number of configs to skip, newest first.
+	Offset int32 `protobuf:"varint,1,opt,name=offset" json:"offset,omitempty"`
+	// *
+	// Maximum number of configs to return, at most 100. Defaults to 20.
+	Limit int32 `protobuf:"varint,2,opt,name=limit" json:"limit,omitempty"`
+}
+
+func (m *GetConfigHistoryRequest) Reset()                    { *m = GetConfigHistoryRequest{} }
+func (m *GetConfigHistoryRequest) String() string            { return proto.CompactTextString(m) }
+func (*GetConfigHistoryRequest) ProtoMessage()               {}
+func (*GetConfigHistoryRequest) Descriptor() ([]byte, []int) { return fileDescriptor2, []int{2} }
+
+func (m *GetConfigHistoryRequest) GetOffset() int32 {
+	if m != nil {
+		return m.Offset
+	}
+	return 0
+}
+
+func (m *GetConfigHistoryRequest) GetLimit() int32 {
+	if m != nil {
+		return m.Limit
+	}
+	return 0
+}
+
+type GetConfigHistoryResponse struct {
+	Configs []*ServiceConfig `protobuf:"bytes,1,rep,name=configs" json:"configs,omitempty"`
+	// *
+	// Number of configs in the history, for paging through it.
+	Total int32 `protobuf:"varint,2,opt,name=total" json:"total,omitempty"`
+}
+
+func (m *GetConfigHistoryResponse) Reset()                    { *m = GetConfigHistoryResponse{} }
+func (m *GetConfigHistoryResponse) String() string            { return proto.CompactTextString(m) }
+func (*GetConfigHistoryResponse) ProtoMessage()               {}
+func (*GetConfigHistoryResponse) Descriptor() ([]byte, []int) { return fileDescriptor2, []int{3} }
+
+func (m *GetConfigHistoryResponse) GetConfigs() []*ServiceConfig {
+	if m != nil {
+		return m.Configs
+	}
+	return nil
+}
+
+func (m *GetConfigHistoryResponse) GetTotal() int32 {
+	if m != nil {
+		return m.Total
+	}
+	return 0
+}
+
+func init() {
+	proto.RegisterType((*GetConfigRequest)(nil), "quotaservice.configs.GetConfigRequest")
+	proto.RegisterType((*GetConfigResponse)(nil), "quotaservice.configs.GetConfigResponse")
+	proto.RegisterType((*GetConfigHistoryRequest)(nil), "quotaservice.configs.GetConfigHistoryRequest")
+	proto.RegisterType((*GetConfigHistoryResponse)(nil), "quotaservice.configs.GetConfigHistoryResponse")
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// Client API for ConfigQueryService service
+
+type ConfigQueryServiceClient interface {
+	// *
+	// Returns the config in force.
+	GetConfig(ctx context.Context, in *GetConfigRequest, opts ...grpc.CallOption) (*GetConfigResponse, error)
+	// *
+	// Returns the config in force with the buckets as they were created, resolved for templates
+	// and canaries.
+	GetEffectiveConfig(ctx context.Context, in *GetConfigRequest, opts ...grpc.CallOption) (*GetConfigResponse, error)
+	// *
+	// Returns a page of the configs persisted, newest first.
+	GetConfigHistory(ctx context.Context, in *GetConfigHistoryRequest, opts ...grpc.CallOption) (*GetConfigHistoryResponse, error)
+}
+
+type configQueryServiceClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewConfigQueryServiceClient(cc *grpc.ClientConn) ConfigQueryServiceClient {
+	return &configQueryServiceClient{cc}
+}
+
+func (c *configQueryServiceClient) GetConfig(ctx context.Context, in *GetConfigRequest, opts ...grpc.CallOption) (*GetConfigResponse, error) {
+	out := new(GetConfigResponse)
+	err := grpc.Invoke(ctx, "/quotaservice.configs.ConfigQueryService/GetConfig", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *configQueryServiceClient) GetEffectiveConfig(ctx context.Context, in *GetConfigRequest, opts ...grpc.CallOption) (*GetConfigResponse, error) {
+	out := new(GetConfigResponse)
+	err := grpc.Invoke(ctx, "/quotaservice.configs.ConfigQueryService/GetEffectiveConfig", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *configQueryServiceClient) GetConfigHistory(ctx context.Context, in *GetConfigHistoryRequest, opts ...grpc.CallOption) (*GetConfigHistoryResponse, error) {
+	out := new(GetConfigHistoryResponse)
+	err := grpc.Invoke(ctx, "/quotaservice.configs.ConfigQueryService/GetConfigHistory", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Server API for ConfigQueryService service
+
+type ConfigQueryServiceServer interface {
+	// *
+	// Returns the config in force.
+	GetConfig(context.Context, *GetConfigRequest) (*GetConfigResponse, error)
+	// *
+	// Returns the config in force with the buckets as they were created, resolved for templates
+	// and canaries.
+	GetEffectiveConfig(context.Context, *GetConfigRequest) (*GetConfigResponse, error)
+	// *
+	// Returns a page of the configs persisted, newest first.
+	GetConfigHistory(context.Context, *GetConfigHistoryRequest) (*GetConfigHistoryResponse, error)
+}
+
+func RegisterConfigQueryServiceServer(s *grpc.Server, srv ConfigQueryServiceServer) {
+	s.RegisterService(&_ConfigQueryService_serviceDesc, srv)
+}
+
+func _ConfigQueryService_GetConfig_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetConfigRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ConfigQueryServiceServer).GetConfig(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/quotaservice.configs.ConfigQueryService/GetConfig",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ConfigQueryServiceServer).GetConfig(ctx, req.(*GetConfigRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ConfigQueryService_GetEffectiveConfig_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetConfigRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ConfigQueryServiceServer).GetEffectiveConfig(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/quotaservice.configs.ConfigQueryService/GetEffectiveConfig",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ConfigQueryServiceServer).GetEffectiveConfig(ctx, req.(*GetConfigRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ConfigQueryService_GetConfigHistory_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetConfigHistoryRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ConfigQueryServiceServer).GetConfigHistory(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/quotaservice.configs.ConfigQueryService/GetConfigHistory",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ConfigQueryServiceServer).GetConfigHistory(ctx, req.(*GetConfigHistoryRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _ConfigQueryService_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "quotaservice.configs.ConfigQueryService",
+	HandlerType: (*ConfigQueryServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetConfig",
+			Handler:    _ConfigQueryService_GetConfig_Handler,
+		},
+		{
+			MethodName: "GetEffectiveConfig",
+			Handler:    _ConfigQueryService_GetEffectiveConfig_Handler,
+		},
+		{
+			MethodName: "GetConfigHistory",
+			Handler:    _ConfigQueryService_GetConfigHistory_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "protos/config/query.proto",
+}
+
+func init() { proto.RegisterFile("protos/config/query.proto", fileDescriptor2) }
+
+var fileDescriptor2 = []byte{
+	// 288 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0xb4, 0x92, 0xc1, 0x4a, 0xc3, 0x40,
+	0x10, 0x86, 0x4d, 0x25, 0x29, 0x8e, 0x97, 0x3a, 0x14, 0x8d, 0xf1, 0x12, 0x22, 0x68, 0x2f, 0xa6,
+	0x50, 0x8f, 0xe2, 0x49, 0x24, 0x5e, 0x8d, 0x77, 0xa1, 0x86, 0x49, 0x59, 0xa9, 0xd9, 0x26, 0x33,
+	0x09, 0xf4, 0x35, 0x7d, 0x22, 0x69, 0x76, 0x53, 0x6c, 0x2d, 0xb4, 0x17, 0x8f, 0xff, 0x30, 0xdf,
+	0x7e, 0x7f, 0x76, 0x03, 0x97, 0x8b, 0x4a, 0x8b, 0xe6, 0x71, 0xa6, 0x8b, 0x5c, 0xcd, 0xc6, 0x65,
+	0x4d, 0xd5, 0x32, 0x6e, 0x67, 0x38, 0x2c, 0x6b, 0x2d, 0x53, 0xa6, 0xaa, 0x51, 0x19, 0xc5, 0x66,
+	0x81, 0x83, 0xab, 0x4d, 0xc0, 0x8e, 0x0d, 0x12, 0x21, 0x0c, 0x12, 0x92, 0xa7, 0x76, 0x96, 0x52,
+	0x59, 0x13, 0x4b, 0xf4, 0x09, 0x67, 0xbf, 0x66, 0xbc, 0xd0, 0x05, 0x13, 0x3e, 0x80, 0x67, 0x48,
+	0xdf, 0x09, 0x9d, 0xd1, 0xe9, 0xe4, 0x3a, 0xde, 0x25, 0x8b, 0xdf, 0x4c, 0xb6, 0xb0, 0x45, 0xd0,
+	0x87, 0x7e, 0x43, 0x15, 0x2b, 0x5d, 0xf8, 0xbd, 0xd0, 0x19, 0xb9, 0x69, 0x17, 0xa3, 0x04, 0x2e,
+	0xd6, 0xae, 0x17, 0xc5, 0xa2, 0xab, 0xa5, 0xad, 0x81, 0xe7, 0xe0, 0xe9, 0x3c, 0x67, 0x92, 0xd6,
+	0xe8, 0xa6, 0x36, 0xe1, 0x10, 0xdc, 0xb9, 0xfa, 0x52, 0x62, 0x8f, 0x32, 0x21, 0xd2, 0xe0, 0xff,
+	0x3d, 0xc8, 0x76, 0x7f, 0x84, 0xbe, 0xed, 0xe7, 0x3b, 0xe1, 0xf1, 0xa1, 0xe5, 0x3b, 0x66, 0x25,
+	0x14, 0x2d, 0xd3, 0x79, 0x27, 0x6c, 0xc3, 0xe4, 0xbb, 0x07, 0x68, 0x36, 0x5f, 0x57, 0x4f, 0x60,
+	0x59, 0x7c, 0x87, 0x93, 0x75, 0x0f, 0xbc, 0xd9, 0xed, 0xd9, 0xbe, 0xf1, 0xe0, 0x76, 0xef, 0x9e,
+	0xf9, 0x92, 0xe8, 0x08, 0x67, 0x80, 0x09, 0xc9, 0x73, 0x9e, 0x53, 0x26, 0xaa, 0xa1, 0xff, 0x13,
+	0x31, 0x0c, 0xb6, 0x2f, 0x14, 0xef, 0xf6, 0xe0, 0x9b, 0x2f, 0x18, 0xc4, 0x87, 0xae, 0x77, 0xd2,
+	0x0f, 0xaf, 0xfd, 0x2b, 0xef, 0x7f, 0x06, 0x00, 0xdc, 0xae, 0xf0, 0x79, 0xe5, 0x02, 0x00, 0x00,
+}
@@ -11,6 +11,8 @@ It is generated from these files:
 It has these top-level messages:
 	AllowRequest
 	AllowResponse
+	ProbeRequest
+	ProbeResponse
 */
 package quotaservice
 
@@ -44,6 +46,7 @@ const (
 	AllowResponse_REJECTED_TOO_MANY_TOKENS_REQUESTED AllowResponse_Status = 4
 	AllowResponse_REJECTED_INVALID_REQUEST           AllowResponse_Status = 5
 	AllowResponse_REJECTED_SERVER_ERROR              AllowResponse_Status = 6
+	AllowResponse_REJECTED_CAP_REACHED               AllowResponse_Status = 7
 )
 
 var AllowResponse_Status_name = map[int32]string{
@@ -54,6 +57,7 @@ var AllowResponse_Status_name = map[int32]string{
 	4: "REJECTED_TOO_MANY_TOKENS_REQUESTED",
 	5: "REJECTED_INVALID_REQUEST",
 	6: "REJECTED_SERVER_ERROR",
+	7: "REJECTED_CAP_REACHED",
 }
 var AllowResponse_Status_value = map[string]int32{
 	"OK":                                 0,
@@ -63,6 +67,7 @@ var AllowResponse_Status_value = map[string]int32{
 	"REJECTED_TOO_MANY_TOKENS_REQUESTED": 4,
 	"REJECTED_INVALID_REQUEST":           5,
 	"REJECTED_SERVER_ERROR":              6,
+	"REJECTED_CAP_REACHED":               7,
 }
 
 func (x AllowResponse_Status) String() string {
@@ -128,7 +133,8 @@ func (m *AllowRequest) GetMaxWaitTimeOverride() bool {
 type AllowResponse struct {
 	Status AllowResponse_Status `protobuf:"varint,1,opt,name=status,enum=quotaservice.AllowResponse_Status" json:"status,omitempty"`
 	// *
-	// Number of tokens granted, if status == OK
+	// Number of tokens granted, if status == OK. Fewer than requested if the bucket clamps requests
+	// over its max_tokens_per_request.
 	TokensGranted int64 `protobuf:"varint,2,opt,name=tokens_granted,json=tokensGranted" json:"tokens_granted,omitempty"`
 	// *
 	// Wait for this many millis before proceeding, if status == OK. 0 if no waiting is required.
@@ -161,9 +167,74 @@ func (m *AllowResponse) GetWaitMillis() int64 {
 	return 0
 }
 
+type ProbeRequest struct {
+	Namespace  string `protobuf:"bytes,1,opt,name=namespace" json:"namespace,omitempty"`
+	BucketName string `protobuf:"bytes,2,opt,name=bucket_name,json=bucketName" json:"bucket_name,omitempty"`
+	// *
+	// Number of tokens to probe for. Defaults to 1.
+	TokensRequested int64 `protobuf:"varint,3,opt,name=tokens_requested,json=tokensRequested" json:"tokens_requested,omitempty"`
+}
+
+func (m *ProbeRequest) Reset()                    { *m = ProbeRequest{} }
+func (m *ProbeRequest) String() string            { return proto.CompactTextString(m) }
+func (*ProbeRequest) ProtoMessage()               {}
+func (*ProbeRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{2} }
+
+func (m *ProbeRequest) GetNamespace() string {
+	if m != nil {
+		return m.Namespace
+	}
+	return ""
+}
+
+func (m *ProbeRequest) GetBucketName() string {
+	if m != nil {
+		return m.BucketName
+	}
+	return ""
+}
+
+func (m *ProbeRequest) GetTokensRequested() int64 {
+	if m != nil {
+		return m.TokensRequested
+	}
+	return 0
+}
+
+type ProbeResponse struct {
+	// *
+	// OK if the tokens would be granted within the bucket's max wait time, or the status Allow
+	// would reject them with otherwise.
+	Status AllowResponse_Status `protobuf:"varint,1,opt,name=status,enum=quotaservice.AllowResponse_Status" json:"status,omitempty"`
+	// *
+	// Estimated wait, in millis, before the tokens would be available, even if status != OK.
+	WaitMillis int64 `protobuf:"varint,2,opt,name=wait_millis,json=waitMillis" json:"wait_millis,omitempty"`
+}
+
+func (m *ProbeResponse) Reset()                    { *m = ProbeResponse{} }
+func (m *ProbeResponse) String() string            { return proto.CompactTextString(m) }
+func (*ProbeResponse) ProtoMessage()               {}
+func (*ProbeResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
+
+func (m *ProbeResponse) GetStatus() AllowResponse_Status {
+	if m != nil {
+		return m.Status
+	}
+	return AllowResponse_OK
+}
+
+func (m *ProbeResponse) GetWaitMillis() int64 {
+	if m != nil {
+		return m.WaitMillis
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*AllowRequest)(nil), "quotaservice.AllowRequest")
 	proto.RegisterType((*AllowResponse)(nil), "quotaservice.AllowResponse")
+	proto.RegisterType((*ProbeRequest)(nil), "quotaservice.ProbeRequest")
+	proto.RegisterType((*ProbeResponse)(nil), "quotaservice.ProbeResponse")
 	proto.RegisterEnum("quotaservice.AllowResponse_Status", AllowResponse_Status_name, AllowResponse_Status_value)
 }
 
@@ -179,6 +250,7 @@ const _ = grpc.SupportPackageIsVersion4
 
 type QuotaServiceClient interface {
 	Allow(ctx context.Context, in *AllowRequest, opts ...grpc.CallOption) (*AllowResponse, error)
+	Probe(ctx context.Context, in *ProbeRequest, opts ...grpc.CallOption) (*ProbeResponse, error)
 }
 
 type quotaServiceClient struct {
@@ -198,10 +270,20 @@ func (c *quotaServiceClient) Allow(ctx context.Context, in *AllowRequest, opts .
 	return out, nil
 }
 
+func (c *quotaServiceClient) Probe(ctx context.Context, in *ProbeRequest, opts ...grpc.CallOption) (*ProbeResponse, error) {
+	out := new(ProbeResponse)
+	err := grpc.Invoke(ctx, "/quotaservice.QuotaService/Probe", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // Server API for QuotaService service
 
 type QuotaServiceServer interface {
 	Allow(context.Context, *AllowRequest) (*AllowResponse, error)
+	Probe(context.Context, *ProbeRequest) (*ProbeResponse, error)
 }
 
 func RegisterQuotaServiceServer(s *grpc.Server, srv QuotaServiceServer) {
@@ -226,6 +308,24 @@ func _QuotaService_Allow_Handler(srv interface{}, ctx context.Context, dec func(
 	return interceptor(ctx, in, info, handler)
 }
 
+func _QuotaService_Probe_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ProbeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(QuotaServiceServer).Probe(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/quotaservice.QuotaService/Probe",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(QuotaServiceServer).Probe(ctx, req.(*ProbeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _QuotaService_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "quotaservice.QuotaService",
 	HandlerType: (*QuotaServiceServer)(nil),
@@ -234,6 +334,10 @@ var _QuotaService_serviceDesc = grpc.ServiceDesc{
 			MethodName: "Allow",
 			Handler:    _QuotaService_Allow_Handler,
 		},
+		{
+			MethodName: "Probe",
+			Handler:    _QuotaService_Probe_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "protos/quota_service.proto",
@@ -242,33 +346,36 @@ var _QuotaService_serviceDesc = grpc.ServiceDesc{
 func init() { proto.RegisterFile("protos/quota_service.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 433 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x7c, 0x92, 0xd1, 0x6e, 0xd3, 0x30,
-	0x18, 0x85, 0x97, 0x74, 0x8d, 0xd8, 0x4f, 0x37, 0xac, 0x1f, 0x36, 0x65, 0x65, 0x88, 0x2a, 0x12,
-	0xa8, 0xdc, 0x14, 0x69, 0xbb, 0x40, 0xe2, 0xae, 0x5b, 0x2d, 0x54, 0x4a, 0x13, 0xcd, 0x49, 0x87,
-	0xb8, 0xb2, 0xbc, 0xce, 0x42, 0xd6, 0x9a, 0xa6, 0x8b, 0xdd, 0x75, 0x4f, 0xc7, 0x53, 0xf0, 0x0c,
-	0x3c, 0x07, 0xaa, 0xe3, 0xa6, 0x43, 0x20, 0x6e, 0xbf, 0x73, 0xce, 0xaf, 0x9c, 0x13, 0x43, 0x7b,
-	0x51, 0x16, 0xa6, 0xd0, 0xef, 0xef, 0x96, 0x85, 0x11, 0x5c, 0xcb, 0xf2, 0x5e, 0x4d, 0x65, 0xcf,
-	0x42, 0x6c, 0x59, 0xe8, 0x58, 0xf4, 0xcb, 0x83, 0x56, 0x7f, 0x36, 0x2b, 0x56, 0x4c, 0xde, 0x2d,
-	0xa5, 0x36, 0x78, 0x02, 0x7b, 0x73, 0x91, 0x4b, 0xbd, 0x10, 0x53, 0x19, 0x7a, 0x1d, 0xaf, 0xbb,
-	0xc7, 0xb6, 0x00, 0x5f, 0xc3, 0xd3, 0xeb, 0xe5, 0xf4, 0x56, 0x1a, 0xbe, 0x66, 0xa1, 0x6f, 0x75,
-	0xa8, 0x50, 0x2c, 0x72, 0x89, 0xef, 0x80, 0x98, 0xe2, 0x56, 0xce, 0x35, 0x2f, 0xab, 0x83, 0xf2,
-	0x26, 0x6c, 0x74, 0xbc, 0x6e, 0x83, 0x3d, 0xab, 0x38, 0xdb, 0x60, 0xfc, 0x00, 0x61, 0x2e, 0x1e,
-	0xf8, 0x4a, 0x28, 0xc3, 0x73, 0x35, 0x9b, 0x29, 0xcd, 0x8b, 0x7b, 0x59, 0x96, 0xea, 0x46, 0x86,
-	0xbb, 0x36, 0x72, 0x98, 0x8b, 0x87, 0xaf, 0x42, 0x99, 0xb1, 0x55, 0x13, 0x27, 0xe2, 0x19, 0x1c,
-	0xd5, 0x41, 0xa3, 0x72, 0xb9, 0x8d, 0x35, 0x3b, 0x5e, 0xf7, 0x09, 0x7b, 0xee, 0x62, 0x99, 0xca,
-	0xe5, 0x26, 0x14, 0xfd, 0xf4, 0x61, 0xdf, 0x15, 0xd5, 0x8b, 0x62, 0xae, 0x25, 0x7e, 0x84, 0x40,
-	0x1b, 0x61, 0x96, 0xda, 0xd6, 0x3c, 0x38, 0x8d, 0x7a, 0x8f, 0x97, 0xe9, 0xfd, 0x61, 0xee, 0xa5,
-	0xd6, 0xc9, 0x5c, 0x02, 0xdf, 0xc0, 0x81, 0xab, 0xf9, 0xbd, 0x14, 0xf3, 0x75, 0x49, 0xdf, 0x7e,
-	0xf1, 0x7e, 0x45, 0x3f, 0x55, 0x70, 0x3d, 0xd7, 0xa3, 0x7a, 0x6e, 0x08, 0x58, 0xd5, 0x95, 0xa2,
-	0x1f, 0x1e, 0x04, 0xd5, 0x69, 0x0c, 0xc0, 0x4f, 0x46, 0x64, 0x07, 0x5f, 0x00, 0x61, 0xf4, 0x33,
-	0xbd, 0xc8, 0xe8, 0x80, 0x67, 0xc3, 0x31, 0x4d, 0x26, 0x19, 0xf1, 0xf0, 0x08, 0xb0, 0xa6, 0x71,
-	0xc2, 0xcf, 0x27, 0x17, 0x23, 0x9a, 0x11, 0x1f, 0x5f, 0xc1, 0xf1, 0xd6, 0x9d, 0x24, 0x7c, 0xdc,
-	0x8f, 0xbf, 0x39, 0x35, 0x25, 0x0d, 0x7c, 0x0b, 0xd1, 0xdf, 0x72, 0x96, 0x8c, 0x68, 0x9c, 0x72,
-	0x46, 0x2f, 0x27, 0x34, 0xcd, 0xe8, 0x80, 0xec, 0xe2, 0x09, 0x84, 0xb5, 0x6f, 0x18, 0x5f, 0xf5,
-	0xbf, 0x0c, 0x07, 0x1b, 0x9d, 0x34, 0xf1, 0x18, 0x0e, 0x6b, 0x35, 0xa5, 0xec, 0x8a, 0x32, 0x4e,
-	0x19, 0x4b, 0x18, 0x09, 0x4e, 0x19, 0xb4, 0x2e, 0xd7, 0xab, 0xa5, 0xd5, 0x6a, 0x78, 0x0e, 0x4d,
-	0x3b, 0x1c, 0xb6, 0xff, 0xb9, 0xa6, 0xfd, 0xf7, 0xed, 0x97, 0xff, 0x59, 0x3a, 0xda, 0xb9, 0x0e,
-	0xec, 0x43, 0x3d, 0xfb, 0x1d, 0x00, 0x00, 0xff, 0xff, 0x66, 0x09, 0x72, 0xac, 0xc6, 0x02, 0x00,
-	0x00,
+	// 489 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0xbc, 0x93, 0xd1, 0x6e, 0xd3, 0x30,
+	0x18, 0x85, 0x97, 0x74, 0x2d, 0xec, 0xa7, 0x1d, 0x96, 0xd9, 0xa6, 0xac, 0x1b, 0xa2, 0x8a, 0x04,
+	0x2a, 0x37, 0x45, 0xda, 0x2e, 0x90, 0xb8, 0xcb, 0x5a, 0x0b, 0x4a, 0x69, 0xb2, 0x39, 0xe9, 0x10,
+	0x57, 0x96, 0xdb, 0x59, 0x28, 0x5a, 0xd2, 0x74, 0xb1, 0xbb, 0xf6, 0x49, 0x78, 0x36, 0x9e, 0x80,
+	0x4b, 0x9e, 0x01, 0xc5, 0x49, 0xd3, 0x52, 0x26, 0xae, 0x10, 0xb7, 0xdf, 0xf9, 0xcf, 0xb1, 0xcf,
+	0xef, 0x04, 0x9a, 0xb3, 0x34, 0x51, 0x89, 0x7c, 0x73, 0x37, 0x4f, 0x14, 0x67, 0x52, 0xa4, 0xf7,
+	0xe1, 0x44, 0x74, 0x34, 0xc4, 0x75, 0x0d, 0x0b, 0x66, 0xff, 0x30, 0xa0, 0xee, 0x44, 0x51, 0xb2,
+	0xa0, 0xe2, 0x6e, 0x2e, 0xa4, 0xc2, 0xa7, 0xb0, 0x37, 0xe5, 0xb1, 0x90, 0x33, 0x3e, 0x11, 0x96,
+	0xd1, 0x32, 0xda, 0x7b, 0x74, 0x0d, 0xf0, 0x0b, 0x78, 0x32, 0x9e, 0x4f, 0x6e, 0x85, 0x62, 0x19,
+	0xb3, 0x4c, 0xad, 0x43, 0x8e, 0x5c, 0x1e, 0x0b, 0xfc, 0x1a, 0x90, 0x4a, 0x6e, 0xc5, 0x54, 0xb2,
+	0x34, 0x0f, 0x14, 0x37, 0x56, 0xa5, 0x65, 0xb4, 0x2b, 0xf4, 0x69, 0xce, 0xe9, 0x0a, 0xe3, 0xb7,
+	0x60, 0xc5, 0x7c, 0xc9, 0x16, 0x3c, 0x54, 0x2c, 0x0e, 0xa3, 0x28, 0x94, 0x2c, 0xb9, 0x17, 0x69,
+	0x1a, 0xde, 0x08, 0x6b, 0x57, 0x5b, 0x0e, 0x63, 0xbe, 0xfc, 0xcc, 0x43, 0x35, 0xd4, 0xaa, 0x57,
+	0x88, 0xf8, 0x1c, 0x8e, 0x4a, 0xa3, 0x0a, 0x63, 0xb1, 0xb6, 0x55, 0x5b, 0x46, 0xfb, 0x31, 0x7d,
+	0x56, 0xd8, 0x82, 0x30, 0x16, 0x2b, 0x93, 0xfd, 0xd3, 0x84, 0x46, 0x51, 0x54, 0xce, 0x92, 0xa9,
+	0x14, 0xf8, 0x1d, 0xd4, 0xa4, 0xe2, 0x6a, 0x2e, 0x75, 0xcd, 0xfd, 0x33, 0xbb, 0xb3, 0xb9, 0x99,
+	0xce, 0x6f, 0xc3, 0x1d, 0x5f, 0x4f, 0xd2, 0xc2, 0x81, 0x5f, 0xc2, 0x7e, 0x51, 0xf3, 0x6b, 0xca,
+	0xa7, 0x59, 0x49, 0x53, 0xdf, 0xb8, 0x91, 0xd3, 0xf7, 0x39, 0xcc, 0xd6, 0xb5, 0x51, 0xaf, 0x58,
+	0x04, 0x2c, 0xca, 0x4a, 0xf6, 0x77, 0x03, 0x6a, 0x79, 0x34, 0xae, 0x81, 0xe9, 0x0d, 0xd0, 0x0e,
+	0x3e, 0x00, 0x44, 0xc9, 0x47, 0xd2, 0x0d, 0x48, 0x8f, 0x05, 0xfd, 0x21, 0xf1, 0x46, 0x01, 0x32,
+	0xf0, 0x11, 0xe0, 0x92, 0xba, 0x1e, 0xbb, 0x18, 0x75, 0x07, 0x24, 0x40, 0x26, 0x7e, 0x0e, 0xc7,
+	0xeb, 0x69, 0xcf, 0x63, 0x43, 0xc7, 0xfd, 0x52, 0xa8, 0x3e, 0xaa, 0xe0, 0x57, 0x60, 0xff, 0x29,
+	0x07, 0xde, 0x80, 0xb8, 0x3e, 0xa3, 0xe4, 0x6a, 0x44, 0xfc, 0x80, 0xf4, 0xd0, 0x2e, 0x3e, 0x05,
+	0xab, 0x9c, 0xeb, 0xbb, 0xd7, 0xce, 0xa7, 0x7e, 0x6f, 0xa5, 0xa3, 0x2a, 0x3e, 0x86, 0xc3, 0x52,
+	0xf5, 0x09, 0xbd, 0x26, 0x94, 0x11, 0x4a, 0x3d, 0x8a, 0x6a, 0xd8, 0x82, 0x83, 0x52, 0xea, 0x3a,
+	0x97, 0x8c, 0x12, 0xa7, 0xfb, 0x81, 0xf4, 0xd0, 0x23, 0x7b, 0x09, 0xf5, 0xcb, 0x34, 0x19, 0x8b,
+	0xff, 0xfe, 0x61, 0xd9, 0x11, 0x34, 0x8a, 0x93, 0xff, 0xc1, 0x4b, 0x6f, 0x3d, 0xa1, 0xb9, 0xfd,
+	0x84, 0x67, 0xdf, 0x0c, 0xa8, 0x5f, 0x65, 0x71, 0x7e, 0x1e, 0x87, 0x2f, 0xa0, 0xaa, 0x13, 0x71,
+	0xf3, 0xc1, 0x63, 0xf4, 0x2d, 0x9b, 0x27, 0x7f, 0xb9, 0x82, 0xbd, 0x93, 0x65, 0xe8, 0x0a, 0xdb,
+	0x19, 0x9b, 0x1b, 0x6d, 0x9e, 0x3c, 0xa8, 0xad, 0x32, 0xc6, 0x35, 0xfd, 0xbf, 0x9f, 0xff, 0x1a,
+	0x00, 0xe4, 0x58, 0x2f, 0x75, 0x0d, 0x04, 0x00, 0x00,
 }
@@ -49,6 +49,12 @@ var (
 	updateFile      = update.Flag("file", "File from which to read configs.").Short('f').String()
 	updateNamespace = update.Arg("namespace", "Namespace to update.").String()
 	updateBucket    = update.Arg("bucket", "Bucket to update.").String()
+
+	// import
+	importCmd      = app.Command("import", "Validates a whole config and persists it to disk as the next version.")
+	importFile     = importCmd.Flag("file", "File from which to read the config.").Short('f').String()
+	importFormat   = importCmd.Flag("format", "Format of the config: auto, proto, json or yaml.").Default("auto").Enum("auto", "proto", "json", "yaml")
+	importLocation = importCmd.Flag("location", "File the config is persisted to, as read by a disk config persister.").Short('l').Required().String()
 )
 
 func RunClient(args []string) {
@@ -66,6 +72,9 @@ func RunClient(args []string) {
 	case update.FullCommand():
 		doUpdate(*updateGDB, *updateNamespace, *updateBucket)
 		break
+	case importCmd.FullCommand():
+		doImport(*importFile, *importFormat, *importLocation)
+		break
 	default:
 		kingpin.FatalUsage("Unknown command; should never happen.")
 	}
@@ -119,7 +128,34 @@ func doUpdate(gdb bool, namespace, bucket string) {
 	_ = resp.Body.Close()
 }
 
+func doImport(f, formatName, location string) {
+	logf("Called import(file=%v, format=%v, location=%v)\n", f, formatName, location)
+	format, e := config.ParseFormat(formatName)
+	kingpin.FatalIfError(e, "Invalid format")
+
+	persister, e := config.NewDiskConfigPersister(location)
+	kingpin.FatalIfError(e, "Cannot persist to %v", location)
+
+	version, e := config.LoadAndPersist(persister, format, readAll(f))
+	if errs, ok := e.(config.ValidationErrors); ok {
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		kingpin.Fatalf("Config is invalid\n")
+	}
+
+	kingpin.FatalIfError(e, "Cannot persist config")
+	fmt.Printf("Persisted config version %v to %v\n", version, location)
+}
+
 func readCfg(f, namespace, bucket string) []byte {
+	cfgBytes := readAll(f)
+	validateJSON(cfgBytes, namespace, bucket)
+	return cfgBytes
+}
+
+// readAll reads a file, or STDIN if none is named.
+func readAll(f string) []byte {
 	var cfgBytes []byte
 	var e error
 
@@ -132,7 +168,6 @@ func readCfg(f, namespace, bucket string) []byte {
 
 	kingpin.FatalIfError(e, "Could not read config from %v", f)
 	logf("Read config %v from %v\n", string(cfgBytes), f)
-	validateJSON(cfgBytes, namespace, bucket)
 	return cfgBytes
 }
 
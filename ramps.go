@@ -0,0 +1,63 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package quotaservice
+
+import (
+	"time"
+
+	"github.com/square/quotaservice/config"
+	"github.com/square/quotaservice/events"
+	pb "github.com/square/quotaservice/protos/config"
+)
+
+// rampEnd is when the fill rate ramp of a bucket in the config in force finishes.
+type rampEnd struct {
+	namespace, bucketName string
+	dynamic               bool
+	endMillis             int64
+}
+
+// rampEnds returns when the fill rate ramps of a config's buckets finish. Ramps without a start time
+// start as each bucket is created, so they don't finish at any one time and are left out. Ramps of
+// dynamic bucket templates are reported once for the template.
+func rampEnds(cfg *pb.ServiceConfig) []rampEnd {
+	var ends []rampEnd
+	add := func(namespace, name string, dynamic bool, b *pb.BucketConfig) {
+		if b != nil && b.RampStartMillis > 0 && b.RampDurationMillis > 0 {
+			ends = append(ends, rampEnd{namespace, name, dynamic, b.RampStartMillis + b.RampDurationMillis})
+		}
+	}
+
+	add(config.GlobalNamespace, config.DefaultBucketName, false, cfg.GlobalDefaultBucket)
+	for nsName, ns := range cfg.Namespaces {
+		add(nsName, config.DefaultBucketName, false, ns.DefaultBucket)
+		add(nsName, config.DynamicBucketTemplateName, true, ns.DynamicBucketTemplate)
+		for name, b := range ns.Buckets {
+			add(nsName, name, false, b)
+		}
+	}
+
+	return ends
+}
+
+// emitRampsCompleted emits an EVENT_RAMP_COMPLETED event for each ramp of the config in force that
+// finished after one time, up to and including another. Checking consecutive periods reports each
+// ramp exactly once.
+func (s *server) emitRampsCompleted(after, until time.Time) {
+	afterMillis := after.UnixNano() / int64(time.Millisecond)
+	untilMillis := until.UnixNano() / int64(time.Millisecond)
+
+	s.RLock()
+	var completed []rampEnd
+	for _, r := range s.rampEnds {
+		if r.endMillis > afterMillis && r.endMillis <= untilMillis {
+			completed = append(completed, r)
+		}
+	}
+	s.RUnlock()
+
+	for _, r := range completed {
+		s.Emit(events.NewRampCompletedEvent(r.namespace, r.bucketName, r.dynamic))
+	}
+}
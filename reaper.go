@@ -7,16 +7,20 @@ import (
 	"time"
 
 	"github.com/square/quotaservice/config"
+	"github.com/square/quotaservice/events"
 	"github.com/square/quotaservice/logging"
 	pbconfig "github.com/square/quotaservice/protos/config"
 )
 
 // watcher watches reapableBuckets for activity.
 type watcher struct {
-	ns           string
-	bucketName   string
-	identifier   string
-	maxIdle      time.Duration
+	ns         string
+	bucketName string
+	identifier string
+	maxIdle    time.Duration
+	// grace is how long a bucket idle for maxIdle is kept, stale, before it is reaped.
+	grace        time.Duration
+	stale        bool
 	lastActivity time.Time
 	activities   <-chan struct{}
 }
@@ -82,6 +86,7 @@ type reaper struct {
 	cfg         config.ReaperConfig
 	newWatchers chan<- *watcher
 	watchers    map[string]*watcher
+	now         func() time.Time
 }
 
 func newReaper(bc *bucketContainer, r config.ReaperConfig) *reaper {
@@ -89,7 +94,12 @@ func newReaper(bc *bucketContainer, r config.ReaperConfig) *reaper {
 	reaper := &reaper{
 		cfg:         r,
 		watchers:    make(map[string]*watcher),
-		newWatchers: watcherChannel}
+		newWatchers: watcherChannel,
+		now:         r.Now}
+
+	if reaper.now == nil {
+		reaper.now = time.Now
+	}
 
 	go reaper.reapIdleBuckets(bc, watcherChannel)
 
@@ -103,28 +113,44 @@ func (r *reaper) stop() {
 
 func (r *reaper) addNewWatcher(w *watcher) {
 	r.watchers[w.identifier] = w
-	w.lastActivity = time.Now()
+	w.lastActivity = r.now()
 }
 
 // checkExpirations checks all watches registered with the reaper, and destroys idle buckets, updating the reaper
-// accordingly. Returns the duration after which it should run again.
+// accordingly. Idle buckets with a grace period are marked stale instead, and only destroyed once idle for
+// their grace period too. Returns the duration after which it should run again.
 func (r *reaper) checkExpirations(bc *bucketContainer) time.Duration {
-	now := time.Now()
+	now := r.now()
 	newSleep := r.cfg.MinFrequency
-	var reaped uint64
+	var reaped, staled uint64
 	for id, w := range r.watchers {
-		if w.tooIdle(now) {
+		switch {
+		case !w.tooIdle(now):
+			w.stale = false
+			if w.maxIdle < newSleep {
+				// Check if we're sleeping the right amount.
+				newSleep = w.maxIdle
+			}
+		case now.Sub(w.lastActivity) > w.maxIdle+w.grace:
 			// Reap bucket
 			reaped++
 			if bc.removeBucket(w.ns, w.bucketName) {
 				delete(r.watchers, id)
 			}
-		} else if w.maxIdle < newSleep {
-			// Check if we're sleeping the right amount.
-			newSleep = w.maxIdle
+		default:
+			// Keep the bucket, and its tokens, in case it's accessed again within its grace period.
+			if !w.stale {
+				w.stale = true
+				staled++
+				bc.n.Emit(events.NewBucketStaleEvent(w.ns, w.bucketName))
+			}
+
+			if w.grace < newSleep {
+				newSleep = w.grace
+			}
 		}
 	}
-	logging.Printf("Reaped %d buckets due to inactivity", reaped)
+	logging.Printf("Reaped %d buckets due to inactivity, marked %d stale", reaped, staled)
 	return newSleep
 }
 
@@ -170,6 +196,7 @@ func (r *reaper) applyWatch(delegate Bucket, namespace, bucketName string, cfg *
 		activityChannel := make(chan struct{}, 1)
 		rb := &reapableBucket{Bucket: delegate, activities: activityChannel}
 		w := createWatcher(namespace, bucketName, time.Duration(cfg.MaxIdleMillis)*time.Millisecond, activityChannel)
+		w.grace = time.Duration(cfg.EvictionGraceMillis) * time.Millisecond
 		r.newWatchers <- w
 		return rb, w
 	}
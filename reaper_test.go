@@ -4,11 +4,14 @@
 package quotaservice
 
 import (
+	"context"
 	"testing"
 	"time"
 
 	"github.com/square/quotaservice/config"
+	"github.com/square/quotaservice/events"
 	pbc "github.com/square/quotaservice/protos/config"
+	"github.com/square/quotaservice/test/helpers"
 )
 
 func TestNotReapable(t *testing.T) {
@@ -88,6 +91,120 @@ func TestIdleAndActivity(t *testing.T) {
 	reaperTeardown(bc)
 }
 
+func TestEvictionGrace(t *testing.T) {
+	clock := &testClock{t: time.Unix(1500000000, 0)}
+	bc, emitter, r, watchers := graceSetup(1000, 10000, clock)
+	defer reaperTeardown(bc)
+
+	b, err := bc.FindBucket("x", "y")
+	helpers.CheckError(t, err)
+	r.addNewWatcher(<-watchers)
+	r.checkExpirations(bc)
+
+	_, _, err = b.Take(context.Background(), 5, 0)
+	helpers.CheckError(t, err)
+
+	// Idle for longer than max idle, but within the grace period.
+	clock.advance(5 * time.Second)
+	r.checkExpirations(bc)
+
+	if !emitted(emitter, events.EVENT_BUCKET_STALE) {
+		t.Fatal("Expected the idle bucket to be marked stale")
+	}
+
+	if bc.inspectableBucket("x", "y") == nil {
+		t.Fatal("Expected the stale bucket to be kept")
+	}
+
+	// Accessed again while stale.
+	b, err = bc.FindBucket("x", "y")
+	helpers.CheckError(t, err)
+	clock.advance(5 * time.Second)
+	r.checkExpirations(bc)
+
+	if _, delegate := unwrapBucket(b); delegate.(*MockBucket).Taken != 5 {
+		t.Fatalf("Expected the bucket accessed within its grace period to keep its balance, got %+v", delegate)
+	}
+
+	// Idle for longer than max idle and the grace period.
+	clock.advance(time.Minute)
+	r.checkExpirations(bc)
+
+	if bc.inspectableBucket("x", "y") != nil {
+		t.Fatal("Expected the bucket to be reaped once its grace period ended")
+	}
+
+	b, err = bc.FindBucket("x", "y")
+	helpers.CheckError(t, err)
+
+	if _, delegate := unwrapBucket(b); delegate.(*MockBucket).Taken != 0 {
+		t.Fatalf("Expected a reaped bucket to be created anew, got %+v", delegate)
+	}
+}
+
+func TestNoEvictionGrace(t *testing.T) {
+	clock := &testClock{t: time.Unix(1500000000, 0)}
+	bc, emitter, r, watchers := graceSetup(1000, 0, clock)
+	defer reaperTeardown(bc)
+
+	_, err := bc.FindBucket("x", "y")
+	helpers.CheckError(t, err)
+	r.addNewWatcher(<-watchers)
+	r.checkExpirations(bc)
+
+	clock.advance(5 * time.Second)
+	r.checkExpirations(bc)
+
+	if bc.inspectableBucket("x", "y") != nil {
+		t.Fatal("Expected the idle bucket to be reaped")
+	}
+
+	if emitted(emitter, events.EVENT_BUCKET_STALE) {
+		t.Fatal("Expected a bucket without a grace period not to be marked stale")
+	}
+}
+
+// graceSetup creates a container of dynamic buckets idle for maxIdle with a grace period, whose
+// expirations are only checked when the test calls checkExpirations on the reaper returned, at the
+// time of clock. Watchers of the buckets created are registered from the channel returned.
+func graceSetup(maxIdle, grace int64, clock *testClock) (*bucketContainer, *MockEmitter, *reaper, <-chan *watcher) {
+	cfg := config.NewDefaultServiceConfig()
+	ns := config.NewDefaultNamespaceConfig("x")
+	tpl := config.NewDefaultBucketConfig("")
+	tpl.MaxIdleMillis = maxIdle
+	tpl.EvictionGraceMillis = grace
+	config.SetDynamicBucketTemplate(ns, tpl)
+	_ = config.AddNamespace(cfg, ns)
+
+	bc, _, emitter := NewBucketContainerWithMocks(cfg)
+	emitter.Events = make(chan events.Event, 100)
+
+	// Stop the reaper's goroutine, so the test checks expirations instead.
+	bc.r.stop()
+	watchers := make(chan *watcher, 10)
+	bc.r = &reaper{
+		cfg:         NewReaperConfigForTests(),
+		newWatchers: watchers,
+		watchers:    make(map[string]*watcher),
+		now:         clock.now}
+
+	return bc, emitter, bc.r, watchers
+}
+
+// emitted returns true if an event of a type was emitted, discarding the events emitted until then.
+func emitted(emitter *MockEmitter, eventType events.EventType) bool {
+	for {
+		select {
+		case e := <-emitter.Events:
+			if e.EventType() == eventType {
+				return true
+			}
+		default:
+			return false
+		}
+	}
+}
+
 func createTestReapableBucket(maxIdle int64, bc *bucketContainer) (*reapableBucket, *watcher) {
 	tb := &MockBucket{}
 	c := config.NewDefaultBucketConfig("y")
@@ -0,0 +1,69 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package quotaservice
+
+import (
+	"context"
+	"time"
+
+	"github.com/square/quotaservice/config"
+	"github.com/square/quotaservice/dedupe"
+	"github.com/square/quotaservice/logging"
+)
+
+// RequestIDMetadataKey is the metadata key RPC endpoints read the ID of a request from.
+const RequestIDMetadataKey = "quotaservice-request-id"
+
+type requestIDKey struct{}
+
+// ContextWithRequestID returns a context declaring the ID of a request, chosen by the client and
+// reused when retrying it. With a dedupe cache set, Allow and AllowUntil answer a repeat of a
+// granted request with its original result, rather than taking tokens again.
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the ID of a request declared using ContextWithRequestID, or an
+// empty string if none was.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// dedupeKey returns the key a request's result is remembered with, or an empty string if it isn't
+// deduped. IDs are scoped to their bucket.
+func (s *server) dedupeKey(ctx context.Context, namespace, name string) string {
+	id := RequestIDFromContext(ctx)
+	if s.dedupe == nil || id == "" {
+		return ""
+	}
+
+	return config.FullyQualifiedName(namespace, name) + "/" + id
+}
+
+// dedupedResult returns the result remembered for a repeated request, or nil if it wasn't seen.
+// Requests whose result can't be looked up are served as new.
+func (s *server) dedupedResult(key string) *dedupe.Result {
+	if key == "" {
+		return nil
+	}
+
+	r, err := s.dedupe.Get(key)
+	if err != nil {
+		logging.Warn("Unable to look up the result of a request", "key", key, "error", err)
+	}
+
+	return r
+}
+
+// rememberResult remembers the result of a granted request, so repeats of it are deduped.
+func (s *server) rememberResult(key string, granted int64, w time.Duration, dynamic bool) {
+	if key == "" {
+		return
+	}
+
+	if err := s.dedupe.Put(key, &dedupe.Result{Wait: w, Dynamic: dynamic, Granted: granted}); err != nil {
+		logging.Warn("Unable to remember the result of a request", "key", key, "error", err)
+	}
+}
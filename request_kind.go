@@ -0,0 +1,28 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package quotaservice
+
+import (
+	"context"
+)
+
+// RequestKindMetadataKey is the metadata key RPC endpoints read the kind of a request from.
+const RequestKindMetadataKey = "quotaservice-request-kind"
+
+type requestKindKey struct{}
+
+// ContextWithRequestKind returns a context declaring the kind of a request, such as "search" or
+// "health". Allow and AllowUntil look up the token cost of the kind in the request_costs of the
+// namespace, and take that many tokens for each token requested, so callers needn't hardcode how
+// expensive each kind of request is.
+func ContextWithRequestKind(ctx context.Context, kind string) context.Context {
+	return context.WithValue(ctx, requestKindKey{}, kind)
+}
+
+// RequestKindFromContext returns the kind of a request declared using ContextWithRequestKind, or
+// an empty string if none was.
+func RequestKindFromContext(ctx context.Context) string {
+	kind, _ := ctx.Value(requestKindKey{}).(string)
+	return kind
+}
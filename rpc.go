@@ -6,6 +6,8 @@ package quotaservice
 import (
 	"context"
 	"time"
+
+	pbconfig "github.com/square/quotaservice/protos/config"
 )
 
 // QuotaService is the interface used by RPC subsystems when fielding remote requests for quotas.
@@ -19,6 +21,65 @@ type QuotaService interface {
 	// tokens could not be obtained, and will contain more context once cast to
 	// quotaservice.QoutaServiceError.
 	Allow(ctx context.Context, namespace, name string, tokensRequested int64, maxWaitMillisOverride int64, maxWaitTimeOverride bool) (waitTime time.Duration, dynamic bool, err error)
+	// AllowUntil is like Allow, but waits for tokens until a deadline, such as the deadline of
+	// the request's context, instead of for a duration. The time left is measured when the bucket
+	// handles the request, so time spent reaching the bucket doesn't extend the wait. The maximum
+	// allowed wait time for the namespace and name still applies. With a deadline in the past,
+	// tokens are only granted if available without waiting.
+	AllowUntil(ctx context.Context, namespace, name string, tokensRequested int64, deadline time.Time) (waitTime time.Duration, dynamic bool, err error)
+	// Probe tells you whether the tokens requested in a given namespace and name would be granted
+	// within the maximum allowed wait time if requested now, and how long the caller would have to
+	// wait for them, without reserving them. The estimated wait is returned even if the tokens
+	// wouldn't be granted. Errors are those Allow would return.
+	Probe(ctx context.Context, namespace, name string, tokensRequested int64) (wouldGrant bool, estimatedWait time.Duration, err error)
+}
+
+// TokenGranter is implemented by QuotaServices that may grant fewer tokens than requested, such as
+// for buckets clamping requests over their max tokens per request, for RPC endpoints to report the
+// tokens granted.
+type TokenGranter interface {
+	// AllowTokens is like Allow, also returning the number of tokens granted, those requested unless
+	// the request was clamped.
+	AllowTokens(ctx context.Context, namespace, name string, tokensRequested int64, maxWaitMillisOverride int64, maxWaitTimeOverride bool) (tokensGranted int64, waitTime time.Duration, dynamic bool, err error)
+}
+
+// FractionGranter is implemented by QuotaServices that grant fractions of tokens, in namespaces
+// with a token scale, for callers whose requests cost less than a whole token.
+type FractionGranter interface {
+	// AllowFraction is like AllowTokens for tokens counted in fractions, rounded to the nearest
+	// fraction counted by the namespace's buckets. Requests for less than the finest fraction are
+	// rejected with ER_TOO_FEW_TOKENS_REQUESTED. In namespaces without a token scale, only whole
+	// tokens are counted.
+	AllowFraction(ctx context.Context, namespace, name string, tokensRequested float64, maxWaitMillisOverride int64, maxWaitTimeOverride bool) (tokensGranted float64, waitTime time.Duration, dynamic bool, err error)
+}
+
+// AllowTokens calls qs.AllowTokens if qs is a TokenGranter, or qs.Allow otherwise, in which case
+// the tokens requested are reported granted.
+func AllowTokens(ctx context.Context, qs QuotaService, namespace, name string, tokensRequested int64, maxWaitMillisOverride int64, maxWaitTimeOverride bool) (int64, time.Duration, bool, error) {
+	if g, ok := qs.(TokenGranter); ok {
+		return g.AllowTokens(ctx, namespace, name, tokensRequested, maxWaitMillisOverride, maxWaitTimeOverride)
+	}
+
+	w, dynamic, err := qs.Allow(ctx, namespace, name, tokensRequested, maxWaitMillisOverride, maxWaitTimeOverride)
+	return tokensRequested, w, dynamic, err
+}
+
+// ConfigReader is implemented by QuotaServices that can describe the config they apply, for RPC
+// endpoints to serve to tooling.
+type ConfigReader interface {
+	// Configs returns the config in force, or nil if none was applied yet.
+	Configs() *pbconfig.ServiceConfig
+	// EffectiveConfig returns the config in force with its buckets as they were created.
+	EffectiveConfig() *pbconfig.ServiceConfig
+	// HistoricalConfigs returns the configs persisted.
+	HistoricalConfigs() ([]*pbconfig.ServiceConfig, error)
+}
+
+// HealthChecker is implemented by QuotaServices that can report themselves degraded, for RPC
+// endpoints to surface through health checks.
+type HealthChecker interface {
+	// CheckHealth returns an error describing why the service is degraded, or nil if it is healthy.
+	CheckHealth() error
 }
 
 // RpcEndpoint defines a subsystem that listens on a network socket for external systems to
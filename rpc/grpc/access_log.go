@@ -0,0 +1,122 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package grpc
+
+import (
+	"strings"
+	"time"
+
+	"github.com/square/quotaservice/events"
+	"github.com/square/quotaservice/logging"
+	pb "github.com/square/quotaservice/protos"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// accessLogExemptPrefixes are the methods of services not logged, such as health checks.
+var accessLogExemptPrefixes = []string{
+	"/grpc.health.",
+	"/grpc.reflection.",
+}
+
+// AccessLogOptions configures the access log of quota decisions.
+type AccessLogOptions struct {
+	// Sampling logs only one in N granted requests of a namespace's buckets, as events are sampled.
+	// If nil, every granted request is logged.
+	Sampling events.SamplingPolicy
+	// SampleRejections samples rejected requests as granted ones are. By default, every rejected
+	// request is logged, since those matter individually.
+	SampleRejections bool
+	// Logger receives the access log at the info level. Defaults to the current structured logger,
+	// subject to the level set by logging.SetLevel.
+	Logger logging.StructuredLogger
+}
+
+// NewAccessLogInterceptor creates an interceptor logging the namespace, bucket, outcome, wait and
+// latency of Allow calls, and the latency of other calls. Health checks and reflection calls
+// aren't logged.
+func NewAccessLogInterceptor(opts AccessLogOptions) grpc.UnaryServerInterceptor {
+	var sampler *events.Sampler
+	if opts.Sampling != nil {
+		sampler = events.NewSampler(opts.Sampling)
+	}
+
+	log := opts.Logger
+	if log == nil {
+		log = currentStructuredLogger{}
+	}
+
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if accessLogExempt(info.FullMethod) {
+			return handler(ctx, req)
+		}
+
+		start := time.Now()
+		rsp, err := handler(ctx, req)
+		latency := time.Since(start)
+
+		allowReq, ok := req.(*pb.AllowRequest)
+		if !ok {
+			log.Info("gRPC call", "method", info.FullMethod, "latency", latency, "error", err)
+			return rsp, err
+		}
+
+		allowRsp, _ := rsp.(*pb.AllowResponse)
+		granted := err == nil && allowRsp != nil && allowRsp.Status == pb.AllowResponse_OK
+
+		if sampler != nil && (granted || opts.SampleRejections) &&
+			sampler.Sample(allowReq.Namespace, allowReq.BucketName) == 0 {
+			return rsp, err
+		}
+
+		keysAndValues := []interface{}{
+			"method", info.FullMethod,
+			"namespace", allowReq.Namespace,
+			"bucket", allowReq.BucketName,
+			"tokens", allowReq.TokensRequested,
+			"granted", granted,
+		}
+
+		if allowRsp != nil {
+			keysAndValues = append(keysAndValues, "status", allowRsp.Status, "wait_millis", allowRsp.WaitMillis)
+		}
+
+		keysAndValues = append(keysAndValues, "latency", latency)
+		if err != nil {
+			keysAndValues = append(keysAndValues, "error", err)
+		}
+
+		log.Info("Quota decision", keysAndValues...)
+		return rsp, err
+	}
+}
+
+func accessLogExempt(method string) bool {
+	for _, prefix := range accessLogExemptPrefixes {
+		if strings.HasPrefix(method, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// currentStructuredLogger logs to the structured logger set when logging, at the level set.
+type currentStructuredLogger struct{}
+
+func (currentStructuredLogger) Debug(msg string, keysAndValues ...interface{}) {
+	logging.Debug(msg, keysAndValues...)
+}
+
+func (currentStructuredLogger) Info(msg string, keysAndValues ...interface{}) {
+	logging.Info(msg, keysAndValues...)
+}
+
+func (currentStructuredLogger) Warn(msg string, keysAndValues ...interface{}) {
+	logging.Warn(msg, keysAndValues...)
+}
+
+func (currentStructuredLogger) Error(msg string, keysAndValues ...interface{}) {
+	logging.Error(msg, keysAndValues...)
+}
@@ -0,0 +1,122 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package grpc
+
+import (
+	"testing"
+
+	"github.com/square/quotaservice/events"
+	pb "github.com/square/quotaservice/protos"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+const allowMethod = "/QuotaService/Allow"
+
+// recordingLogger captures the fields of the records logged to it.
+type recordingLogger struct {
+	records []map[string]interface{}
+}
+
+func (r *recordingLogger) log(keysAndValues []interface{}) {
+	fields := make(map[string]interface{}, len(keysAndValues)/2)
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		fields[keysAndValues[i].(string)] = keysAndValues[i+1]
+	}
+
+	r.records = append(r.records, fields)
+}
+
+func (r *recordingLogger) Debug(msg string, keysAndValues ...interface{}) { r.log(keysAndValues) }
+func (r *recordingLogger) Info(msg string, keysAndValues ...interface{})  { r.log(keysAndValues) }
+func (r *recordingLogger) Warn(msg string, keysAndValues ...interface{})  { r.log(keysAndValues) }
+func (r *recordingLogger) Error(msg string, keysAndValues ...interface{}) { r.log(keysAndValues) }
+
+func respondWith(status pb.AllowResponse_Status) grpc.UnaryHandler {
+	return func(ctx context.Context, req interface{}) (interface{}, error) {
+		return &pb.AllowResponse{Status: status}, nil
+	}
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	r := &recordingLogger{}
+	interceptor := NewAccessLogInterceptor(AccessLogOptions{
+		Sampling: events.SampleNamespaces(map[string]int64{"ns": 10}),
+		Logger:   r})
+
+	req := &pb.AllowRequest{Namespace: "ns", BucketName: "b", TokensRequested: 1}
+	info := &grpc.UnaryServerInfo{FullMethod: allowMethod}
+
+	for i := 0; i < 100; i++ {
+		if _, err := interceptor(context.Background(), req, info, respondWith(pb.AllowResponse_OK)); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	}
+
+	if len(r.records) != 10 {
+		t.Fatalf("Expected 1 in 10 granted requests to be logged, got %v", len(r.records))
+	}
+
+	if f := r.records[0]; f["namespace"] != "ns" || f["bucket"] != "b" || f["granted"] != true {
+		t.Errorf("Expected a granted request of ns:b, got %v", f)
+	}
+
+	r.records = nil
+	for i := 0; i < 100; i++ {
+		if _, err := interceptor(context.Background(), req, info, respondWith(pb.AllowResponse_REJECTED_TIMEOUT)); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	}
+
+	if len(r.records) != 100 {
+		t.Fatalf("Expected every rejected request to be logged, got %v", len(r.records))
+	}
+
+	if f := r.records[0]; f["granted"] != false || f["status"] != pb.AllowResponse_REJECTED_TIMEOUT {
+		t.Errorf("Expected a rejected request, got %v", f)
+	}
+}
+
+func TestAccessLogSampleRejections(t *testing.T) {
+	r := &recordingLogger{}
+	interceptor := NewAccessLogInterceptor(AccessLogOptions{
+		Sampling:         events.SampleNamespaces(map[string]int64{"ns": 10}),
+		SampleRejections: true,
+		Logger:           r})
+
+	req := &pb.AllowRequest{Namespace: "ns", BucketName: "b"}
+	info := &grpc.UnaryServerInfo{FullMethod: allowMethod}
+
+	for i := 0; i < 100; i++ {
+		_, _ = interceptor(context.Background(), req, info, respondWith(pb.AllowResponse_REJECTED_TIMEOUT))
+	}
+
+	if len(r.records) != 10 {
+		t.Errorf("Expected 1 in 10 rejected requests to be logged, got %v", len(r.records))
+	}
+}
+
+func TestAccessLogExempt(t *testing.T) {
+	r := &recordingLogger{}
+	interceptor := NewAccessLogInterceptor(AccessLogOptions{Logger: r})
+
+	called := false
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		called = true
+		return nil, nil
+	}
+
+	for _, method := range []string{"/grpc.health.v1.Health/Check", "/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo"} {
+		called = false
+		_, _ = interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+
+		if !called {
+			t.Errorf("Expected %v to be handled", method)
+		}
+	}
+
+	if len(r.records) != 0 {
+		t.Errorf("Expected exempt calls not to be logged, got %v", r.records)
+	}
+}
@@ -0,0 +1,107 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package grpc
+
+import (
+	"sort"
+
+	"github.com/square/quotaservice"
+	pbconfig "github.com/square/quotaservice/protos/config"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	defaultConfigHistoryLimit = 20
+	maxConfigHistoryLimit     = 100
+)
+
+// configQueryServer serves the config of the quota service read-only, if it is a
+// quotaservice.ConfigReader.
+type configQueryServer struct {
+	g *GrpcEndpoint
+}
+
+func (c *configQueryServer) reader() (quotaservice.ConfigReader, error) {
+	r, ok := c.g.qs.(quotaservice.ConfigReader)
+	if !ok {
+		return nil, grpc.Errorf(codes.Unimplemented, "the quota service can't describe its config")
+	}
+
+	return r, nil
+}
+
+func (c *configQueryServer) GetConfig(ctx context.Context, req *pbconfig.GetConfigRequest) (*pbconfig.GetConfigResponse, error) {
+	r, err := c.reader()
+	if err != nil {
+		return nil, err
+	}
+
+	return configResponse(r.Configs())
+}
+
+func (c *configQueryServer) GetEffectiveConfig(ctx context.Context, req *pbconfig.GetConfigRequest) (*pbconfig.GetConfigResponse, error) {
+	r, err := c.reader()
+	if err != nil {
+		return nil, err
+	}
+
+	return configResponse(r.EffectiveConfig())
+}
+
+func configResponse(cfg *pbconfig.ServiceConfig) (*pbconfig.GetConfigResponse, error) {
+	if cfg == nil {
+		return nil, grpc.Errorf(codes.Unavailable, "no config was applied yet")
+	}
+
+	return &pbconfig.GetConfigResponse{Config: cfg, Version: cfg.Version}, nil
+}
+
+// GetConfigHistory returns a page of the configs persisted, newest first.
+func (c *configQueryServer) GetConfigHistory(ctx context.Context, req *pbconfig.GetConfigHistoryRequest) (*pbconfig.GetConfigHistoryResponse, error) {
+	limit := int(req.Limit)
+	if limit == 0 {
+		limit = defaultConfigHistoryLimit
+	}
+
+	if limit < 0 || limit > maxConfigHistoryLimit {
+		return nil, grpc.Errorf(codes.InvalidArgument, "limit must be between 1 and %v, was %v", maxConfigHistoryLimit, req.Limit)
+	}
+
+	if req.Offset < 0 {
+		return nil, grpc.Errorf(codes.InvalidArgument, "offset must not be negative, was %v", req.Offset)
+	}
+
+	r, err := c.reader()
+	if err != nil {
+		return nil, err
+	}
+
+	history, err := r.HistoricalConfigs()
+	if err != nil {
+		return nil, grpc.Errorf(codes.Unavailable, "unable to read the config history: %v", err)
+	}
+
+	configs := make([]*pbconfig.ServiceConfig, 0, len(history))
+	for _, cfg := range history {
+		if cfg != nil {
+			configs = append(configs, cfg)
+		}
+	}
+
+	sort.Slice(configs, func(i, j int) bool { return configs[i].Version > configs[j].Version })
+
+	rsp := &pbconfig.GetConfigHistoryResponse{Total: int32(len(configs))}
+	if offset := int(req.Offset); offset < len(configs) {
+		end := offset + limit
+		if end > len(configs) {
+			end = len(configs)
+		}
+
+		rsp.Configs = configs[offset:end]
+	}
+
+	return rsp, nil
+}
@@ -0,0 +1,148 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package grpc
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/square/quotaservice"
+	"github.com/square/quotaservice/config"
+	pbconfig "github.com/square/quotaservice/protos/config"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// startConfigQueryServer starts a quota service having persisted configs of versions 1 to
+// versions, returning a configQueryServer for it.
+func startConfigQueryServer(t *testing.T, versions int32) (*configQueryServer, quotaservice.Server) {
+	t.Helper()
+
+	persister := config.NewMemoryConfigPersister()
+	for v := int32(1); v <= versions; v++ {
+		cfg := config.NewDefaultServiceConfig()
+		cfg.Version = v
+		nsc := config.NewDefaultNamespaceConfig("ns")
+		nsc.DefaultBucket = config.NewDefaultBucketConfig("")
+		nsc.DefaultBucket.Size = int64(v * 10)
+		if err := config.AddNamespace(cfg, nsc); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := persister.PersistAndNotify("", cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	endpoint := &quotaservice.MockEndpoint{}
+	s := quotaservice.New(&quotaservice.MockBucketFactory{}, persister, config.NewReaperConfig(), 0, endpoint)
+	if _, err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	return &configQueryServer{g: &GrpcEndpoint{qs: endpoint.QuotaService}}, s
+}
+
+func TestGetConfig(t *testing.T) {
+	c, s := startConfigQueryServer(t, 3)
+	defer func() { _, _ = s.Stop() }()
+
+	loaded := c.g.qs.(quotaservice.ConfigReader)
+
+	rsp, err := c.GetConfig(context.Background(), &pbconfig.GetConfigRequest{})
+	if err != nil {
+		t.Fatalf("Unexpected error getting the config: %v", err)
+	}
+
+	if rsp.Version != 3 || !proto.Equal(rsp.Config, loaded.Configs()) {
+		t.Errorf("Expected the loaded config %+v, got %+v", loaded.Configs(), rsp)
+	}
+
+	rsp, err = c.GetEffectiveConfig(context.Background(), &pbconfig.GetConfigRequest{})
+	if err != nil {
+		t.Fatalf("Unexpected error getting the effective config: %v", err)
+	}
+
+	if rsp.Version != 3 || !proto.Equal(rsp.Config, loaded.EffectiveConfig()) {
+		t.Errorf("Expected the effective config %+v, got %+v", loaded.EffectiveConfig(), rsp)
+	}
+}
+
+func TestGetConfigHistory(t *testing.T) {
+	c, s := startConfigQueryServer(t, 5)
+	defer func() { _, _ = s.Stop() }()
+
+	for _, tc := range []struct {
+		offset, limit int32
+		versions      []int32
+	}{
+		{0, 0, []int32{5, 4, 3, 2, 1}},
+		{0, 2, []int32{5, 4}},
+		{2, 2, []int32{3, 2}},
+		{4, 2, []int32{1}},
+		{5, 2, nil},
+	} {
+		rsp, err := c.GetConfigHistory(context.Background(), &pbconfig.GetConfigHistoryRequest{Offset: tc.offset, Limit: tc.limit})
+		if err != nil {
+			t.Fatalf("Unexpected error getting the config history: %v", err)
+		}
+
+		var versions []int32
+		for _, cfg := range rsp.Configs {
+			versions = append(versions, cfg.Version)
+		}
+
+		if rsp.Total != 5 || len(versions) != len(tc.versions) {
+			t.Errorf("Expected versions %v of 5 at offset %v, limit %v, got %v of %v", tc.versions, tc.offset, tc.limit, versions, rsp.Total)
+			continue
+		}
+
+		for i := range versions {
+			if versions[i] != tc.versions[i] {
+				t.Errorf("Expected versions %v at offset %v, limit %v, got %v", tc.versions, tc.offset, tc.limit, versions)
+				break
+			}
+		}
+	}
+
+	for _, req := range []*pbconfig.GetConfigHistoryRequest{{Limit: 101}, {Limit: -1}, {Offset: -1}} {
+		if _, err := c.GetConfigHistory(context.Background(), req); grpc.Code(err) != codes.InvalidArgument {
+			t.Errorf("Expected InvalidArgument for %+v, got %v", req, err)
+		}
+	}
+}
+
+func TestGetConfigWithoutReader(t *testing.T) {
+	var qs struct{ quotaservice.QuotaService }
+	c := &configQueryServer{g: &GrpcEndpoint{qs: qs}}
+
+	if _, err := c.GetConfig(context.Background(), &pbconfig.GetConfigRequest{}); grpc.Code(err) != codes.Unimplemented {
+		t.Errorf("Expected Unimplemented, got %v", err)
+	}
+}
+
+func TestChainInterceptors(t *testing.T) {
+	var calls []string
+	interceptor := func(name string) grpc.UnaryServerInterceptor {
+		return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			calls = append(calls, name)
+			return handler(ctx, req)
+		}
+	}
+
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		calls = append(calls, "handler")
+		return nil, nil
+	}
+
+	chained := chainInterceptors([]grpc.UnaryServerInterceptor{interceptor("log"), interceptor("auth")})
+	if _, err := chained(context.Background(), nil, &grpc.UnaryServerInfo{}, handler); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(calls) != 3 || calls[0] != "log" || calls[1] != "auth" || calls[2] != "handler" {
+		t.Errorf("Expected the interceptors to be called in order, got %v", calls)
+	}
+}
@@ -6,6 +6,9 @@ package grpc
 import (
 	"fmt"
 	"net"
+	"net/http"
+	"os"
+	"strconv"
 	"strings"
 
 	"time"
@@ -15,31 +18,95 @@ import (
 	"github.com/square/quotaservice/lifecycle"
 	"github.com/square/quotaservice/logging"
 	pb "github.com/square/quotaservice/protos"
+	pbconfig "github.com/square/quotaservice/protos/config"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/grpclog"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
 )
 
+// MaxTokensMetadataKey is the trailer metadata key carrying the most tokens a bucket can serve a
+// single request, when a request asks for more.
+const MaxTokensMetadataKey = "quotaservice-max-tokens"
+
+// DefaultMaxRequestTokens is the most tokens a single request may ask for unless the endpoint's
+// options set MaxRequestTokens: far more than any bucket serves, but few enough that the wait for
+// them, in nanos, can't overflow.
+const DefaultMaxRequestTokens int64 = 1e9
+
+// httpShutdownTimeout is how long HTTP requests in flight when the endpoint stops may take to
+// finish, if it serves HTTP too.
+const httpShutdownTimeout = 5 * time.Second
+
 type GrpcEndpoint struct {
 	hostport      string
 	grpcServer    *grpc.Server
 	currentStatus lifecycle.Status
 	qs            quotaservice.QuotaService
 	producer      events.EventProducer
+	opts          Options
+	stopped       chan struct{}
+	// httpServer serves HTTP on the same port as gRPC, if the options set an HTTPHandler.
+	httpServer *http.Server
+}
+
+// Options configures a GrpcEndpoint.
+type Options struct {
+	// AccessLog logs the quota decisions made, if set. See NewAccessLogInterceptor.
+	AccessLog *AccessLogOptions
+	// Interceptor intercepts every call to the endpoint's services, after the access log, such as
+	// to authenticate callers. Config queries are intercepted just like Allow.
+	Interceptor grpc.UnaryServerInterceptor
+	// ServeConfig serves the config of the quota service read-only, as the ConfigQueryService, for
+	// tooling that can't reach the admin HTTP server. The quota service must be a
+	// quotaservice.ConfigReader. Disabled by default.
+	ServeConfig bool
+	// UnixSocket is the path of a Unix domain socket to listen on too, for clients on the same host
+	// such as in sidecar deployments. The hostport may be empty to only listen on the socket. A
+	// stale socket left at the path by a server that didn't shut down is replaced, and the socket
+	// is removed when the endpoint stops.
+	UnixSocket string
+	// MaxRequestTokens is the most tokens a single Allow or Probe may ask for, whatever its bucket
+	// serves. Requests for more fail with InvalidArgument before reaching the quota service, so
+	// huge counts from buggy or abusive clients never reach the buckets' arithmetic. Defaults to
+	// DefaultMaxRequestTokens.
+	MaxRequestTokens int64
+	// HTTPHandler serves HTTP/1.x requests on the same port as gRPC, such as a mux the admin console
+	// and metrics are served on, for deployments exposing one port. gRPC calls are told apart by
+	// the HTTP/2 preface their connections start with, so HTTP/2 requests are always gRPC. Requests
+	// in flight when the endpoint stops may take httpShutdownTimeout to finish. The Unix socket only
+	// serves gRPC.
+	HTTPHandler http.Handler
 }
 
 // New creates a new GrpcEndpoint, listening on hostport. Hostport is a string in the form
 // "host:port"
 func New(hostport string, producer *events.EventProducer) *GrpcEndpoint {
+	return NewWithOptions(hostport, producer, nil)
+}
+
+// NewWithOptions is like New, but allows passing in Options. A nil Options is equivalent to the
+// zero value.
+func NewWithOptions(hostport string, producer *events.EventProducer, opts *Options) *GrpcEndpoint {
+	if opts == nil {
+		opts = &Options{}
+	}
+
 	if producer == nil {
 		panic("producer was nil")
 	}
 
+	if hostport == "" && opts.UnixSocket != "" {
+		return &GrpcEndpoint{opts: *opts}
+	}
+
 	if !strings.Contains(hostport, ":") {
 		panic(fmt.Sprintf("hostport should be in the format 'host:port', but is currently %v",
 			hostport))
 	}
-	return &GrpcEndpoint{hostport: hostport}
+	return &GrpcEndpoint{hostport: hostport, opts: *opts}
 }
 
 func (g *GrpcEndpoint) Init(qs quotaservice.QuotaService) {
@@ -47,26 +114,166 @@ func (g *GrpcEndpoint) Init(qs quotaservice.QuotaService) {
 }
 
 func (g *GrpcEndpoint) Start() {
-	lis, err := net.Listen("tcp", g.hostport)
-	if err != nil {
-		logging.Fatalf("Cannot start server on port %v. Error %v", g.hostport, err)
+	var listeners []net.Listener
+	var mux *connMux
+	if g.hostport != "" {
+		lis, err := net.Listen("tcp", g.hostport)
+		if err != nil {
+			logging.Fatalf("Cannot start server on port %v. Error %v", g.hostport, err)
+		}
+
+		if g.opts.HTTPHandler != nil {
+			mux = newConnMux(lis)
+			lis = mux.grpc
+		}
+
+		listeners = append(listeners, lis)
+	}
+
+	if path := g.opts.UnixSocket; path != "" {
+		if err := removeStaleSocket(path); err != nil {
+			logging.Fatalf("Cannot start server on socket %v. Error %v", path, err)
+		}
+
+		lis, err := net.Listen("unix", path)
+		if err != nil {
+			logging.Fatalf("Cannot start server on socket %v. Error %v", path, err)
+		}
+
+		listeners = append(listeners, lis)
 	}
 
 	grpclog.SetLogger(logging.CurrentLogger())
-	g.grpcServer = grpc.NewServer()
+	var interceptors []grpc.UnaryServerInterceptor
+	if g.opts.AccessLog != nil {
+		interceptors = append(interceptors, NewAccessLogInterceptor(*g.opts.AccessLog))
+	}
+
+	if g.opts.Interceptor != nil {
+		interceptors = append(interceptors, g.opts.Interceptor)
+	}
+
+	var serverOpts []grpc.ServerOption
+	if len(interceptors) > 0 {
+		serverOpts = append(serverOpts, grpc.UnaryInterceptor(chainInterceptors(interceptors)))
+	}
+
+	g.grpcServer = grpc.NewServer(serverOpts...)
 	// Each service should be registered
 	pb.RegisterQuotaServiceServer(g.grpcServer, g)
-	go func() {
-		if e := g.grpcServer.Serve(lis); e != nil {
-			logging.Fatalf("Cannot start gRPC server. Error %v", e)
-		}
-	}()
+	healthpb.RegisterHealthServer(g.grpcServer, &healthServer{g: g})
+	if g.opts.ServeConfig {
+		pbconfig.RegisterConfigQueryServiceServer(g.grpcServer, &configQueryServer{g: g})
+	}
+
+	g.stopped = make(chan struct{})
+	for _, lis := range listeners {
+		go g.serve(lis)
+		logging.Printf("Starting server on %v", lis.Addr())
+	}
+
+	if mux != nil {
+		g.httpServer = &http.Server{Handler: g.opts.HTTPHandler}
+		go g.serveHTTP(mux.http)
+		go mux.serve()
+		logging.Printf("Serving HTTP on %v too", mux.root.Addr())
+	}
+
 	g.currentStatus = lifecycle.Started
-	logging.Printf("Starting server on %v", g.hostport)
 	logging.Printf("Server status: %v", g.currentStatus)
 }
 
+// serve serves gRPC on a listener until the endpoint stops.
+func (g *GrpcEndpoint) serve(lis net.Listener) {
+	err := g.grpcServer.Serve(lis)
+
+	select {
+	case <-g.stopped:
+		// Stopping closes the listener.
+	default:
+		if err != nil {
+			logging.Fatalf("Cannot start gRPC server. Error %v", err)
+		}
+	}
+}
+
+// serveHTTP serves HTTP on a listener sharing the gRPC port until the endpoint stops.
+func (g *GrpcEndpoint) serveHTTP(lis net.Listener) {
+	err := g.httpServer.Serve(lis)
+
+	select {
+	case <-g.stopped:
+		// Stopping shuts the HTTP server down.
+	default:
+		if err != nil {
+			logging.Fatalf("Cannot start HTTP server. Error %v", err)
+		}
+	}
+}
+
+// removeStaleSocket removes a Unix domain socket at path that no server is listening on, as left by
+// a server that didn't shut down. It refuses to remove anything else.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%v exists and is not a socket", path)
+	}
+
+	if conn, err := net.Dial("unix", path); err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("%v is in use by another server", path)
+	}
+
+	return os.Remove(path)
+}
+
+// chainInterceptors returns an interceptor calling each of interceptors in turn, the first
+// outermost, since a server only takes one.
+func chainInterceptors(interceptors []grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	if len(interceptors) == 1 {
+		return interceptors[0]
+	}
+
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		next := func(ctx context.Context, req interface{}) (interface{}, error) {
+			return chainInterceptors(interceptors[1:])(ctx, req, info, handler)
+		}
+
+		return interceptors[0](ctx, req, info, next)
+	}
+}
+
 func (g *GrpcEndpoint) Stop() {
+	if g.currentStatus == lifecycle.Started {
+		close(g.stopped)
+		if g.httpServer != nil {
+			// Shutting down closes the shared listener, so gRPC stops accepting connections too.
+			ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+			if err := g.httpServer.Shutdown(ctx); err != nil {
+				logging.Printf("HTTP requests still in flight after %v. Error %v", httpShutdownTimeout, err)
+				_ = g.httpServer.Close()
+			}
+			cancel()
+		}
+
+		g.grpcServer.Stop()
+	}
+
+	if path := g.opts.UnixSocket; path != "" {
+		// Closing the listener normally removes the socket.
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logging.Printf("Cannot remove socket %v. Error %v", path, err)
+		}
+	}
+
 	g.currentStatus = lifecycle.Stopped
 }
 
@@ -83,10 +290,29 @@ func (g *GrpcEndpoint) Allow(ctx context.Context, req *pb.AllowRequest) (*pb.All
 		tokensRequested = req.TokensRequested
 	}
 
-	wait, dynamic, err := g.qs.Allow(ctx, req.Namespace, req.BucketName, tokensRequested, req.MaxWaitMillisOverride, req.MaxWaitTimeOverride)
+	if err := g.checkRequestTokens(ctx, req.Namespace, req.BucketName, tokensRequested); err != nil {
+		return nil, err
+	}
+
+	ctx = fromMetadata(ctx)
+	granted, wait, dynamic, err := quotaservice.AllowTokens(ctx, g.qs, req.Namespace, req.BucketName, tokensRequested, req.MaxWaitMillisOverride, req.MaxWaitTimeOverride)
 
 	if err != nil {
 		if qsErr, ok := err.(quotaservice.QuotaServiceError); ok {
+			if qsErr.Reason == quotaservice.ER_TOO_MANY_TOKENS_REQUESTED {
+				// Unlike a throttled request, this can never succeed, so fail the call rather than
+				// rejecting it as if a retry might.
+				return nil, tooManyTokens(ctx, qsErr)
+			}
+
+			if qsErr.Reason == quotaservice.ER_UNKNOWN_NAMESPACE {
+				return nil, unknownNamespace(qsErr)
+			}
+
+			if qsErr.Reason == quotaservice.ER_TOO_MANY_WAITERS {
+				return nil, tooManyWaiters(qsErr)
+			}
+
 			rsp.Status = toPBStatus(qsErr)
 		} else {
 			logging.Printf("Caught error %v", err)
@@ -99,22 +325,140 @@ func (g *GrpcEndpoint) Allow(ctx context.Context, req *pb.AllowRequest) (*pb.All
 		}
 
 		g.producer.Emit(events.NewServerErrorEvent(req.Namespace, req.BucketName, dynamic))
+		granted = tokensRequested
 	}
 
 	rsp.Status = pb.AllowResponse_OK
-	rsp.TokensGranted = req.TokensRequested
+	rsp.TokensGranted = granted
 	rsp.WaitMillis = wait.Nanoseconds() / int64(time.Millisecond)
 
 	return rsp, nil
 }
 
+// Probe reports whether the tokens requested would be granted, and the estimated wait, without
+// taking them. Requests are rejected with the status Allow would reject them with, or
+// REJECTED_TIMEOUT if the tokens wouldn't be available within the max wait time.
+func (g *GrpcEndpoint) Probe(ctx context.Context, req *pb.ProbeRequest) (*pb.ProbeResponse, error) {
+	rsp := new(pb.ProbeResponse)
+	if req.BucketName == "" || req.Namespace == "" {
+		logging.Printf("Invalid request %+v", req)
+		rsp.Status = pb.AllowResponse_REJECTED_INVALID_REQUEST
+		return rsp, nil
+	}
+
+	var tokensRequested int64 = 1
+	if req.TokensRequested > 0 {
+		tokensRequested = req.TokensRequested
+	}
+
+	if err := g.checkRequestTokens(ctx, req.Namespace, req.BucketName, tokensRequested); err != nil {
+		return nil, err
+	}
+
+	granted, wait, err := g.qs.Probe(fromMetadata(ctx), req.Namespace, req.BucketName, tokensRequested)
+	if err != nil {
+		qsErr, ok := err.(quotaservice.QuotaServiceError)
+		if !ok {
+			logging.Printf("Caught error %v", err)
+			rsp.Status = pb.AllowResponse_REJECTED_SERVER_ERROR
+			return rsp, nil
+		}
+
+		if qsErr.Reason == quotaservice.ER_TOO_MANY_TOKENS_REQUESTED {
+			return nil, tooManyTokens(ctx, qsErr)
+		}
+
+		if qsErr.Reason == quotaservice.ER_UNKNOWN_NAMESPACE {
+			return nil, unknownNamespace(qsErr)
+		}
+
+		rsp.Status = toPBStatus(qsErr)
+		return rsp, nil
+	}
+
+	if !granted {
+		rsp.Status = pb.AllowResponse_REJECTED_TIMEOUT
+	}
+
+	rsp.WaitMillis = wait.Nanoseconds() / int64(time.Millisecond)
+	return rsp, nil
+}
+
+// fromMetadata returns a context carrying the request details clients may pass in metadata.
+func fromMetadata(ctx context.Context) context.Context {
+	md, ok := metadata.FromContext(ctx)
+	if !ok {
+		return ctx
+	}
+
+	// Clients may pass the kind of the request, taking the tokens configured for it.
+	if len(md[quotaservice.RequestKindMetadataKey]) > 0 {
+		ctx = quotaservice.ContextWithRequestKind(ctx, md[quotaservice.RequestKindMetadataKey][0])
+	}
+
+	// Clients may pass the ID of the request, so retries of it aren't charged twice.
+	if len(md[quotaservice.RequestIDMetadataKey]) > 0 {
+		ctx = quotaservice.ContextWithRequestID(ctx, md[quotaservice.RequestIDMetadataKey][0])
+	}
+
+	// Requests forwarded by another instance are served here, even if this instance doesn't own
+	// their bucket.
+	if len(md[quotaservice.ForwardedMetadataKey]) > 0 {
+		ctx = quotaservice.ContextWithForwarded(ctx)
+	}
+
+	return ctx
+}
+
+// checkRequestTokens returns an InvalidArgument error for a request asking for more than the
+// endpoint's max request tokens, as tooManyTokens does for a bucket's maximum, or nil.
+func (g *GrpcEndpoint) checkRequestTokens(ctx context.Context, namespace, name string, tokensRequested int64) error {
+	maxTokens := g.opts.MaxRequestTokens
+	if maxTokens <= 0 {
+		maxTokens = DefaultMaxRequestTokens
+	}
+
+	if tokensRequested <= maxTokens {
+		return nil
+	}
+
+	qsErr := quotaservice.NewQuotaServiceError(fmt.Sprintf("Too many tokens requested. Bucket %v:%v, tokensRequested=%v, maxRequestTokens=%v",
+		namespace, name, tokensRequested, maxTokens), quotaservice.ER_TOO_MANY_TOKENS_REQUESTED)
+	qsErr.MaxTokens = maxTokens
+	return tooManyTokens(ctx, qsErr)
+}
+
+// tooManyTokens returns an InvalidArgument error for a request asking for more tokens than its
+// bucket can serve, naming the bucket's maximum in the message and the MaxTokensMetadataKey trailer.
+func tooManyTokens(ctx context.Context, qsErr quotaservice.QuotaServiceError) error {
+	md := metadata.Pairs(MaxTokensMetadataKey, strconv.FormatInt(qsErr.MaxTokens, 10))
+	if err := grpc.SetTrailer(ctx, md); err != nil {
+		logging.Printf("Unable to set trailer %v: %v", md, err)
+	}
+
+	return grpc.Errorf(codes.InvalidArgument, "%v", qsErr)
+}
+
+// unknownNamespace returns a NotFound error for a request for a namespace missing from the config,
+// so clients can tell misrouted requests apart from throttled ones.
+func unknownNamespace(qsErr quotaservice.QuotaServiceError) error {
+	return grpc.Errorf(codes.NotFound, "%v", qsErr)
+}
+
+// tooManyWaiters returns a ResourceExhausted error for a request rejected without queueing, as its
+// bucket already had as many requests waiting as it allows, so clients can back off rather than
+// retry at once as after a timeout.
+func tooManyWaiters(qsErr quotaservice.QuotaServiceError) error {
+	return grpc.Errorf(codes.ResourceExhausted, "%v", qsErr)
+}
+
 func invalid(req *pb.AllowRequest) bool {
 	return req.BucketName == "" || req.Namespace == ""
 }
 
 func toPBStatus(qsErr quotaservice.QuotaServiceError) (r pb.AllowResponse_Status) {
 	switch qsErr.Reason {
-	case quotaservice.ER_NO_BUCKET:
+	case quotaservice.ER_NO_BUCKET, quotaservice.ER_UNKNOWN_NAMESPACE:
 		r = pb.AllowResponse_REJECTED_NO_BUCKET
 	case quotaservice.ER_TOO_MANY_BUCKETS:
 		r = pb.AllowResponse_REJECTED_TOO_MANY_BUCKETS
@@ -122,6 +466,10 @@ func toPBStatus(qsErr quotaservice.QuotaServiceError) (r pb.AllowResponse_Status
 		r = pb.AllowResponse_REJECTED_TOO_MANY_TOKENS_REQUESTED
 	case quotaservice.ER_TIMEOUT:
 		r = pb.AllowResponse_REJECTED_TIMEOUT
+	case quotaservice.ER_UNKNOWN_REQUEST_KIND, quotaservice.ER_TOO_FEW_TOKENS_REQUESTED:
+		r = pb.AllowResponse_REJECTED_INVALID_REQUEST
+	case quotaservice.ER_CAP_REACHED:
+		r = pb.AllowResponse_REJECTED_CAP_REACHED
 	default:
 		r = pb.AllowResponse_REJECTED_SERVER_ERROR
 	}
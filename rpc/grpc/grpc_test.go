@@ -0,0 +1,202 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package grpc
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/square/quotaservice"
+	pb "github.com/square/quotaservice/protos"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// probedQuotaService is a QuotaService answering probes as a test sets it.
+type probedQuotaService struct {
+	quotaservice.QuotaService
+	granted bool
+	wait    time.Duration
+	err     error
+}
+
+func (p *probedQuotaService) Probe(ctx context.Context, namespace, name string, tokensRequested int64) (bool, time.Duration, error) {
+	return p.granted, p.wait, p.err
+}
+
+func TestProbe(t *testing.T) {
+	qs := &probedQuotaService{}
+	g := &GrpcEndpoint{qs: qs}
+	req := &pb.ProbeRequest{Namespace: "ns", BucketName: "b"}
+
+	for _, tc := range []struct {
+		granted bool
+		wait    time.Duration
+		err     error
+		status  pb.AllowResponse_Status
+	}{
+		{true, 0, nil, pb.AllowResponse_OK},
+		{true, 50 * time.Millisecond, nil, pb.AllowResponse_OK},
+		{false, 2 * time.Second, nil, pb.AllowResponse_REJECTED_TIMEOUT},
+		{false, 0, quotaservice.NewQuotaServiceError("no bucket", quotaservice.ER_NO_BUCKET), pb.AllowResponse_REJECTED_NO_BUCKET},
+		{false, 0, errors.New("redis down"), pb.AllowResponse_REJECTED_SERVER_ERROR},
+	} {
+		qs.granted, qs.wait, qs.err = tc.granted, tc.wait, tc.err
+
+		rsp, err := g.Probe(context.Background(), req)
+		if err != nil {
+			t.Fatalf("Unexpected error probing: %v", err)
+		}
+
+		if rsp.Status != tc.status || rsp.WaitMillis != int64(tc.wait/time.Millisecond) {
+			t.Errorf("Expected %v after %v, got %+v", tc.status, tc.wait, rsp)
+		}
+	}
+
+	if rsp, _ := g.Probe(context.Background(), &pb.ProbeRequest{Namespace: "ns"}); rsp.Status != pb.AllowResponse_REJECTED_INVALID_REQUEST {
+		t.Errorf("Expected a probe without a bucket name to be invalid, got %+v", rsp)
+	}
+}
+
+func TestProbeTooManyTokens(t *testing.T) {
+	qsErr := quotaservice.NewQuotaServiceError("too many", quotaservice.ER_TOO_MANY_TOKENS_REQUESTED)
+	g := &GrpcEndpoint{qs: &probedQuotaService{err: qsErr}}
+
+	_, err := g.Probe(context.Background(), &pb.ProbeRequest{Namespace: "ns", BucketName: "b", TokensRequested: 1000})
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument, got %v", err)
+	}
+}
+
+// failingQuotaService is a QuotaService failing every request with an error.
+type failingQuotaService struct {
+	quotaservice.QuotaService
+	err error
+}
+
+func (f *failingQuotaService) Allow(ctx context.Context, namespace, name string, tokensRequested int64, maxWaitMillisOverride int64, maxWaitTimeOverride bool) (time.Duration, bool, error) {
+	return 0, false, f.err
+}
+
+func (f *failingQuotaService) Probe(ctx context.Context, namespace, name string, tokensRequested int64) (bool, time.Duration, error) {
+	return false, 0, f.err
+}
+
+// grantingQuotaService is a QuotaService granting fewer tokens than requested.
+type grantingQuotaService struct {
+	quotaservice.QuotaService
+	granted int64
+}
+
+func (g *grantingQuotaService) AllowTokens(ctx context.Context, namespace, name string, tokensRequested int64, maxWaitMillisOverride int64, maxWaitTimeOverride bool) (int64, time.Duration, bool, error) {
+	return g.granted, 0, false, nil
+}
+
+func TestAllowTokensGranted(t *testing.T) {
+	g := &GrpcEndpoint{qs: &grantingQuotaService{granted: 10}}
+
+	rsp, err := g.Allow(context.Background(), &pb.AllowRequest{Namespace: "ns", BucketName: "b", TokensRequested: 25})
+	if err != nil || rsp.Status != pb.AllowResponse_OK || rsp.TokensGranted != 10 {
+		t.Errorf("Expected 10 tokens to be granted, got %+v, %v", rsp, err)
+	}
+}
+
+func TestUnknownNamespace(t *testing.T) {
+	qsErr := quotaservice.NewQuotaServiceError("unknown namespace", quotaservice.ER_UNKNOWN_NAMESPACE)
+	g := &GrpcEndpoint{qs: &failingQuotaService{err: qsErr}}
+
+	if _, err := g.Allow(context.Background(), &pb.AllowRequest{Namespace: "ns", BucketName: "b"}); grpc.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound, got %v", err)
+	}
+
+	if _, err := g.Probe(context.Background(), &pb.ProbeRequest{Namespace: "ns", BucketName: "b"}); grpc.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound, got %v", err)
+	}
+}
+
+func TestTooManyWaiters(t *testing.T) {
+	qsErr := quotaservice.NewQuotaServiceError("too many waiters", quotaservice.ER_TOO_MANY_WAITERS)
+	g := &GrpcEndpoint{qs: &failingQuotaService{err: qsErr}}
+
+	if _, err := g.Allow(context.Background(), &pb.AllowRequest{Namespace: "ns", BucketName: "b"}); grpc.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Expected ResourceExhausted, got %v", err)
+	}
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quotaservice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	path := filepath.Join(dir, "qs.sock")
+	if err := removeStaleSocket(path); err != nil {
+		t.Errorf("Expected a missing socket to be left alone, got %v", err)
+	}
+
+	live, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := removeStaleSocket(path); err == nil {
+		t.Error("Expected a socket in use not to be removed")
+	}
+
+	live.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = live.Close()
+
+	if err := removeStaleSocket(path); err != nil {
+		t.Errorf("Expected a stale socket to be removed, got %v", err)
+	}
+
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected the stale socket to be gone, got %v", err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("not a socket"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := removeStaleSocket(path); err == nil {
+		t.Error("Expected a file that isn't a socket not to be removed")
+	}
+}
+
+func TestMaxRequestTokens(t *testing.T) {
+	g := &GrpcEndpoint{qs: &grantingQuotaService{granted: 100}, opts: Options{MaxRequestTokens: 100}}
+
+	if rsp, err := g.Allow(context.Background(), &pb.AllowRequest{Namespace: "ns", BucketName: "b", TokensRequested: 100}); err != nil || rsp.TokensGranted != 100 {
+		t.Errorf("Expected a request for the max request tokens to be granted, got %+v, %v", rsp, err)
+	}
+
+	// Requests over the ceiling never reach the quota service.
+	g.qs = &failingQuotaService{err: errors.New("should not be called")}
+	if _, err := g.Allow(context.Background(), &pb.AllowRequest{Namespace: "ns", BucketName: "b", TokensRequested: 101}); grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument, got %v", err)
+	}
+
+	if _, err := g.Probe(context.Background(), &pb.ProbeRequest{Namespace: "ns", BucketName: "b", TokensRequested: 101}); grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument, got %v", err)
+	}
+
+	// The default ceiling applies unless set.
+	g.opts.MaxRequestTokens = 0
+	if _, err := g.Allow(context.Background(), &pb.AllowRequest{Namespace: "ns", BucketName: "b", TokensRequested: DefaultMaxRequestTokens + 1}); grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument, got %v", err)
+	}
+
+	g.qs = &grantingQuotaService{granted: DefaultMaxRequestTokens}
+	if rsp, err := g.Allow(context.Background(), &pb.AllowRequest{Namespace: "ns", BucketName: "b", TokensRequested: DefaultMaxRequestTokens}); err != nil || rsp.Status != pb.AllowResponse_OK {
+		t.Errorf("Expected a request for the default max request tokens to be granted, got %+v, %v", rsp, err)
+	}
+}
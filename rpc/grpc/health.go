@@ -0,0 +1,39 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package grpc
+
+import (
+	"github.com/square/quotaservice"
+	"github.com/square/quotaservice/logging"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// quotaServiceName is the name health checks of the quota service itself can ask for, besides the
+// empty name for the server as a whole.
+const quotaServiceName = "quotaservice.QuotaService"
+
+// healthServer implements the gRPC health checking protocol, reporting NOT_SERVING while the
+// quota service is degraded, e.g. because config changes stopped reaching it.
+type healthServer struct {
+	g *GrpcEndpoint
+}
+
+func (h *healthServer) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	if req.Service != "" && req.Service != quotaServiceName {
+		return nil, grpc.Errorf(codes.NotFound, "unknown service %v", req.Service)
+	}
+
+	rsp := &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}
+	if checker, ok := h.g.qs.(quotaservice.HealthChecker); ok {
+		if err := checker.CheckHealth(); err != nil {
+			logging.Debug("Reporting degraded to health check", "error", err)
+			rsp.Status = healthpb.HealthCheckResponse_NOT_SERVING
+		}
+	}
+
+	return rsp, nil
+}
@@ -0,0 +1,72 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package grpc
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/square/quotaservice"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// checkedQuotaService is a QuotaService reporting its health as a test sets it.
+type checkedQuotaService struct {
+	quotaservice.QuotaService
+	err error
+}
+
+func (c *checkedQuotaService) CheckHealth() error {
+	return c.err
+}
+
+func checkHealth(t *testing.T, qs quotaservice.QuotaService, service string) healthpb.HealthCheckResponse_ServingStatus {
+	t.Helper()
+
+	h := &healthServer{g: &GrpcEndpoint{qs: qs}}
+	rsp, err := h.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+	if err != nil {
+		t.Fatalf("Unexpected error checking health of %q: %v", service, err)
+	}
+
+	return rsp.Status
+}
+
+func TestHealthCheck(t *testing.T) {
+	qs := &checkedQuotaService{}
+
+	for _, service := range []string{"", quotaServiceName} {
+		if status := checkHealth(t, qs, service); status != healthpb.HealthCheckResponse_SERVING {
+			t.Errorf("Expected %q to be serving, got %v", service, status)
+		}
+	}
+
+	qs.err = errors.New("no config change observed nor config store polled in 1m0s")
+
+	for _, service := range []string{"", quotaServiceName} {
+		if status := checkHealth(t, qs, service); status != healthpb.HealthCheckResponse_NOT_SERVING {
+			t.Errorf("Expected %q not to be serving while degraded, got %v", service, status)
+		}
+	}
+}
+
+func TestHealthCheckWithoutChecker(t *testing.T) {
+	var qs struct{ quotaservice.QuotaService }
+
+	if status := checkHealth(t, qs, ""); status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("Expected a quota service without health checks to be serving, got %v", status)
+	}
+}
+
+func TestHealthCheckUnknownService(t *testing.T) {
+	h := &healthServer{g: &GrpcEndpoint{qs: &checkedQuotaService{}}}
+
+	_, err := h.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "other.Service"})
+	if grpc.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound for an unknown service, got %v", err)
+	}
+}
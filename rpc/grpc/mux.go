@@ -0,0 +1,169 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package grpc
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/square/quotaservice/logging"
+)
+
+// http2Preface starts every HTTP/2 connection, sent by gRPC clients before anything else.
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// sniffTimeout is how long a connection may take to send enough to tell gRPC and HTTP apart.
+const sniffTimeout = 10 * time.Second
+
+// minAcceptDelay and maxAcceptDelay bound the delay before accepting again after a temporary error.
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+var errMuxClosed = errors.New("multiplexed listener closed")
+
+// connMux splits the connections accepted by a listener between gRPC and HTTP/1.x, like cmux:
+// connections starting with the HTTP/2 preface are gRPC, and any others HTTP/1.x.
+type connMux struct {
+	root       net.Listener
+	grpc, http *muxedListener
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+func newConnMux(root net.Listener) *connMux {
+	m := &connMux{root: root, done: make(chan struct{})}
+	m.grpc = &muxedListener{m: m, conns: make(chan net.Conn)}
+	m.http = &muxedListener{m: m, conns: make(chan net.Conn)}
+	return m
+}
+
+// serve accepts connections until the root listener is closed. Temporary errors, such as running
+// out of file descriptors, are retried after a delay doubling from minAcceptDelay to maxAcceptDelay,
+// as net/http's Server does, rather than spinning.
+func (m *connMux) serve() {
+	var delay time.Duration
+	for {
+		conn, err := m.root.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = minAcceptDelay
+				} else {
+					delay *= 2
+				}
+
+				if delay > maxAcceptDelay {
+					delay = maxAcceptDelay
+				}
+
+				logging.Warn("Retrying accepting connections", "error", err, "delay", delay)
+				select {
+				case <-time.After(delay):
+				case <-m.done:
+					return
+				}
+
+				continue
+			}
+
+			m.close()
+			return
+		}
+
+		delay = 0
+		go m.dispatch(conn)
+	}
+}
+
+// dispatch hands a connection to the gRPC or HTTP listener, depending on how it starts.
+func (m *connMux) dispatch(conn net.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	read, isGRPC, err := sniff(conn)
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		logging.Debug("Dropping connection that couldn't be sniffed", "remote", conn.RemoteAddr(), "error", err)
+		_ = conn.Close()
+		return
+	}
+
+	target := m.http
+	if isGRPC {
+		target = m.grpc
+	}
+
+	select {
+	case target.conns <- &sniffedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(read), conn)}:
+	case <-m.done:
+		_ = conn.Close()
+	}
+}
+
+// sniff reads from a connection until it either sent the HTTP/2 preface or something else,
+// returning what it read. HTTP/1.x requests are told apart from their first bytes, so ones shorter
+// than the preface don't wait for more.
+func sniff(conn net.Conn) ([]byte, bool, error) {
+	buf := make([]byte, len(http2Preface))
+	n := 0
+	for n < len(buf) {
+		read, err := conn.Read(buf[n:])
+		n += read
+		if !bytes.HasPrefix([]byte(http2Preface), buf[:n]) {
+			return buf[:n], false, nil
+		}
+
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	return buf, true, nil
+}
+
+func (m *connMux) close() {
+	m.closeOnce.Do(func() {
+		close(m.done)
+		_ = m.root.Close()
+	})
+}
+
+// muxedListener is a listener accepting the share of a connMux's connections for one protocol.
+// Closing it closes the connMux.
+type muxedListener struct {
+	m     *connMux
+	conns chan net.Conn
+}
+
+func (l *muxedListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.m.done:
+		return nil, errMuxClosed
+	}
+}
+
+func (l *muxedListener) Close() error {
+	l.m.close()
+	return nil
+}
+
+func (l *muxedListener) Addr() net.Addr {
+	return l.m.root.Addr()
+}
+
+// sniffedConn replays the bytes read while sniffing a connection before reading further.
+type sniffedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *sniffedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
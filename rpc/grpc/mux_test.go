@@ -0,0 +1,127 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package grpc
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnMux(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := newConnMux(lis)
+	go m.serve()
+	defer func() { _ = m.grpc.Close() }()
+
+	for _, tc := range []struct {
+		sent string
+		lis  *muxedListener
+	}{
+		{http2Preface + "frames", m.grpc},
+		{"POST /api/config HTTP/1.1\r\n\r\n", m.http},
+		// Shorter than the preface, so told apart from its first bytes.
+		{"GET / HTTP/1.0\r\n\r\n", m.http},
+	} {
+		client, err := net.Dial("tcp", lis.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := client.Write([]byte(tc.sent)); err != nil {
+			t.Fatal(err)
+		}
+		_ = client.(*net.TCPConn).CloseWrite()
+
+		conn, err := tc.lis.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// What was read to sniff the connection is read again.
+		received, err := ioutil.ReadAll(conn)
+		if err != nil || string(received) != tc.sent {
+			t.Errorf("Expected %q to be received on its listener, got %q (%v)", tc.sent, received, err)
+		}
+
+		_ = conn.Close()
+		_ = client.Close()
+	}
+}
+
+func TestConnMuxClose(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := newConnMux(lis)
+	go m.serve()
+
+	// Stopping either server closes the shared listener.
+	_ = m.http.Close()
+
+	if _, err := m.grpc.Accept(); err != errMuxClosed {
+		t.Errorf("Expected the gRPC listener to be closed, got %v", err)
+	}
+
+	if _, err := net.Dial("tcp", lis.Addr().String()); err == nil {
+		t.Error("Expected the shared listener to be closed")
+	}
+}
+
+// temporaryError is a net.Error that is temporary, such as running out of file descriptors.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// failingListener is a listener whose Accept fails temporarily a number of times, recording when,
+// then permanently.
+type failingListener struct {
+	net.Listener
+	temporary int
+	accepts   []time.Time
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.accepts = append(l.accepts, time.Now())
+	if len(l.accepts) <= l.temporary {
+		return nil, temporaryError{}
+	}
+
+	return nil, errors.New("closed")
+}
+
+func (l *failingListener) Close() error {
+	return nil
+}
+
+func TestConnMuxTemporaryErrors(t *testing.T) {
+	lis := &failingListener{temporary: 4}
+	m := newConnMux(lis)
+	m.serve()
+
+	if len(lis.accepts) != 5 {
+		t.Fatalf("Expected 5 accepts, got %v", len(lis.accepts))
+	}
+
+	// Retried after 5ms, doubling.
+	for i, expected := range []time.Duration{5, 10, 20, 40} {
+		if d := lis.accepts[i+1].Sub(lis.accepts[i]); d < expected*time.Millisecond {
+			t.Errorf("Expected accept %v to be retried after at least %vms, got %v", i+1, expected, d)
+		}
+	}
+
+	if _, err := m.grpc.Accept(); err != errMuxClosed {
+		t.Errorf("Expected a permanent error to close the listeners, got %v", err)
+	}
+}
@@ -6,6 +6,7 @@ package quotaservice
 import (
 	"context"
 	"fmt"
+	"math"
 	"math/rand"
 	"net/http"
 	"sort"
@@ -14,7 +15,9 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/square/quotaservice/admin"
+	"github.com/square/quotaservice/audit"
 	"github.com/square/quotaservice/config"
+	"github.com/square/quotaservice/dedupe"
 	"github.com/square/quotaservice/events"
 	"github.com/square/quotaservice/lifecycle"
 	"github.com/square/quotaservice/logging"
@@ -22,6 +25,17 @@ import (
 	"github.com/square/quotaservice/stats"
 )
 
+// defaultActivationPollInterval is how often a config pending activation is checked by default.
+const defaultActivationPollInterval = time.Second
+
+// maxConfigDebouncePeriods bounds how many debounce periods a config change can be delayed by
+// changes that keep arriving.
+const maxConfigDebouncePeriods = 10
+
+// defaultBucketMemoryBytes estimates the memory of a bucket for BucketFactories that aren't
+// MemoryEstimators.
+const defaultBucketMemoryBytes = 4096
+
 // Implements the quotaservice.Server interface
 type server struct {
 	currentStatus     lifecycle.Status
@@ -29,14 +43,51 @@ type server struct {
 	bucketFactory     BucketFactory
 	rpcEndpoints      []RpcEndpoint
 	listener          events.Listener
+	filteredListeners []*filteredListener
+	listeners         *events.ListenerRegistry
 	statsListener     stats.Listener
+	topTracker        *stats.TopTracker
+	waitTimes         *stats.WaitTimeHistograms
+	rateTracker       *stats.RateTracker
+	broadcaster       *events.Broadcaster
 	eventQueueBufSize int
+	eventDropPolicy   events.DropPolicy
+	aggregationPolicy events.AggregationPolicy
+	sampler           *events.Sampler
 	maxJitterMillis   int
+	configDebounce    time.Duration
 	producer          *events.EventProducer
 	cfgs              *pb.ServiceConfig
+	pendingCfg        *pb.ServiceConfig
+	rampEnds          []rampEnd
+	catchAllNamespace string // Empty unless the config in force declares a catch-all bucket
+	catchAllBucket    string
+	activationPoll    time.Duration
+	stopActivations   chan struct{}
+	now               func() time.Time
 	persister         config.ConfigPersister
 	reaperConfig      config.ReaperConfig
+	configChanges     *config.ConfigChangeBroadcaster
+	auditSink         audit.Sink
+	persisterHealth   persisterHealth
+	staleness         time.Duration
+	waitJitter        time.Duration
+	sharder           Sharder
+	defaultNamespace  DefaultNamespaceBehavior
+	dedupe            dedupe.Cache
+	startupPolicy     StartupPolicy
+	snapshotPath      string
+	startupRetry      time.Duration
+	degraded          bool
+	memoryBudget      int64
 	sync.RWMutex      // Embedded mutex
+
+	// detected is the latest config read from the persister, from which the versions persisted
+	// after it are audited as they're detected, unless selfPersisted, having been audited as this
+	// server persisted them.
+	detected      *pb.ServiceConfig
+	selfPersisted map[int32]bool
+	detectMu      sync.Mutex
 }
 
 func (s *server) String() string {
@@ -51,30 +102,77 @@ func (s *server) Start() (bool, error) {
 	}
 
 	// Set up listeners
-	s.producer = events.RegisterListener(func(e events.Event) {
+	s.producer = events.RegisterFilteredListener(func(e events.Event) {
+		// Top-N views of dynamic buckets get individual events; everything else may get events
+		// rolled up to the namespace.
+		if s.statsListener != nil {
+			s.statsListener.HandleEvent(e)
+		}
+
+		if s.topTracker != nil {
+			s.topTracker.HandleEvent(e)
+		}
+
+		if s.rateTracker != nil {
+			s.rateTracker.HandleEvent(e)
+		}
+
+		if s.broadcaster != nil {
+			s.broadcaster.HandleEvent(e)
+		}
+
+		e = events.Aggregate(e, s.aggregationPolicy)
+
 		if s.listener != nil {
 			s.listener(e)
 		}
 
-		if s.statsListener != nil {
-			s.statsListener.HandleEvent(e)
+		for _, l := range s.filteredListeners {
+			if l.types.Contains(e.EventType()) {
+				l.listener(e)
+			}
 		}
-	}, bufSize)
+
+		if s.waitTimes != nil {
+			s.waitTimes.HandleEvent(e)
+		}
+	}, bufSize, s.eventDropPolicy, s.eventTypes())
 
 	logging.Printf("Creating bucket container")
 	s.createBucketContainer()
 	logging.Printf("Creating bucket container: OK")
 
+	if e, ok := s.bucketFactory.(EventEmitter); ok {
+		e.SetEventEmitter(s.Emit)
+	}
+
+	if r, ok := s.persister.(config.ReloadFailureReporter); ok {
+		r.OnReloadFailure(func(version int32, err error) {
+			s.persisterHealth.record(err, s.now())
+			s.Emit(events.NewConfigReloadFailedEvent(version, err))
+		})
+	}
+
 	logging.Printf("Waiting for persister to start")
 	<-s.persister.ConfigChangedWatcher()
 	logging.Printf("Waiting for persister to start: OK")
 
 	logging.Printf("Reading latest config")
-	s.readUpdatedConfig(0)
+	retry, err := s.readInitialConfig()
+	if err != nil {
+		return false, err
+	}
 	logging.Printf("Reading latest config: OK")
 
 	go s.configListener(s.persister.ConfigChangedWatcher())
 
+	s.stopActivations = make(chan struct{})
+	go s.activationPoller(s.stopActivations)
+
+	if retry {
+		go s.startupRetrier(s.stopActivations)
+	}
+
 	// Start the RPC servers
 	logging.Printf("Starting RPC servers")
 	for _, rpcServer := range s.rpcEndpoints {
@@ -90,6 +188,11 @@ func (s *server) Start() (bool, error) {
 func (s *server) Stop() (bool, error) {
 	s.currentStatus = lifecycle.Stopped
 
+	if s.stopActivations != nil {
+		close(s.stopActivations)
+		s.stopActivations = nil
+	}
+
 	// Stop the RPC servers
 	for _, rpcServer := range s.rpcEndpoints {
 		rpcServer.Stop()
@@ -102,117 +205,1017 @@ func (s *server) Stop() (bool, error) {
 	return true, nil
 }
 
-func (s *server) Allow(ctx context.Context, namespace, name string, tokensRequested int64, maxWaitMillisOverride int64, maxWaitTimeOverride bool) (time.Duration, bool, error) {
-	s.RLock()
-	b, e := s.bucketContainer.FindBucket(namespace, name)
-	s.RUnlock()
+func (s *server) Allow(ctx context.Context, namespace, name string, tokensRequested int64, maxWaitMillisOverride int64, maxWaitTimeOverride bool) (time.Duration, bool, error) {
+	_, w, dynamic, err := s.AllowTokens(ctx, namespace, name, tokensRequested, maxWaitMillisOverride, maxWaitTimeOverride)
+	return w, dynamic, err
+}
+
+// AllowTokens implements TokenGranter, forwarding requests to the owner of their bucket as Allow
+// does. Owners that aren't TokenGranters are assumed to grant the tokens requested.
+func (s *server) AllowTokens(ctx context.Context, namespace, name string, tokensRequested int64, maxWaitMillisOverride int64, maxWaitTimeOverride bool) (int64, time.Duration, bool, error) {
+	if owner := s.owner(ctx, namespace, name); owner != nil {
+		granted, w, dynamic, err := AllowTokens(ctx, owner, namespace, name, tokensRequested, maxWaitMillisOverride, maxWaitTimeOverride)
+		if forwarded(err) {
+			return granted, w, dynamic, err
+		}
+
+		logging.Warn("Unable to forward request to the owner of its bucket, serving it locally",
+			"namespace", namespace, "bucket", name, "error", err)
+	}
+
+	return s.allow(ctx, namespace, name, tokensRequested, false, takeWithin(ctx, maxWaitMillisOverride, maxWaitTimeOverride))
+}
+
+// takeWithin returns a take function for allow taking tokens within the max wait time of the bucket,
+// or within maxWaitMillisOverride if maxWaitTimeOverride is set and it is shorter.
+func takeWithin(ctx context.Context, maxWaitMillisOverride int64, maxWaitTimeOverride bool) func(Bucket, int64) (time.Duration, bool, error) {
+	return func(b Bucket, tokensRequested int64) (time.Duration, bool, error) {
+		maxWaitTime := time.Millisecond
+		if maxWaitTimeOverride && maxWaitMillisOverride < b.Config().WaitTimeoutMillis {
+			// Use the max wait time override from the request.
+			maxWaitTime *= time.Duration(maxWaitMillisOverride)
+		} else {
+			// Fall back to the max wait time configured on the bucket.
+			maxWaitTime *= time.Duration(b.Config().WaitTimeoutMillis)
+		}
+
+		return b.Take(ctx, tokensRequested, maxWaitTime)
+	}
+}
+
+// AllowFraction implements FractionGranter, forwarding requests to the owner of their bucket if it
+// is a FractionGranter too, and serving them locally otherwise.
+func (s *server) AllowFraction(ctx context.Context, namespace, name string, tokensRequested float64, maxWaitMillisOverride int64, maxWaitTimeOverride bool) (float64, time.Duration, bool, error) {
+	if owner := s.owner(ctx, namespace, name); owner != nil {
+		if g, ok := owner.(FractionGranter); ok {
+			granted, w, dynamic, err := g.AllowFraction(ctx, namespace, name, tokensRequested, maxWaitMillisOverride, maxWaitTimeOverride)
+			if forwarded(err) {
+				return granted, w, dynamic, err
+			}
+
+			logging.Warn("Unable to forward request to the owner of its bucket, serving it locally",
+				"namespace", namespace, "bucket", name, "error", err)
+		}
+	}
+
+	s.RLock()
+	scale := config.TokenScale(s.cfgs.GetNamespaces()[namespace])
+	s.RUnlock()
+
+	// Fractions finer than the namespace's buckets count are rounded to the nearest they count.
+	units := int64(math.Round(tokensRequested * float64(scale)))
+	if units < 1 {
+		return 0, 0, false, newError(fmt.Sprintf("Too few tokens requested. Namespace %v counts 1/%v of a token, tokensRequested=%v",
+			namespace, scale, tokensRequested), ER_TOO_FEW_TOKENS_REQUESTED)
+	}
+
+	granted, w, dynamic, err := s.allow(ctx, namespace, name, units, true, takeWithin(ctx, maxWaitMillisOverride, maxWaitTimeOverride))
+	return float64(granted) / float64(scale), w, dynamic, err
+}
+
+func (s *server) AllowUntil(ctx context.Context, namespace, name string, tokensRequested int64, deadline time.Time) (time.Duration, bool, error) {
+	if owner := s.owner(ctx, namespace, name); owner != nil {
+		w, dynamic, err := owner.AllowUntil(ctx, namespace, name, tokensRequested, deadline)
+		if forwarded(err) {
+			return w, dynamic, err
+		}
+
+		logging.Warn("Unable to forward request to the owner of its bucket, serving it locally",
+			"namespace", namespace, "bucket", name, "error", err)
+	}
+
+	_, w, dynamic, err := s.allow(ctx, namespace, name, tokensRequested, false, func(b Bucket, tokensRequested int64) (time.Duration, bool, error) {
+		// The max wait time configured on the bucket still applies.
+		if latest := s.now().Add(time.Duration(b.Config().WaitTimeoutMillis) * time.Millisecond); latest.Before(deadline) {
+			deadline = latest
+		}
+
+		return TakeUntil(ctx, b, tokensRequested, deadline)
+	})
+
+	return w, dynamic, err
+}
+
+// owner returns the instance owning a bucket if it is a dynamic bucket owned by another instance,
+// or nil if the request should be served locally.
+func (s *server) owner(ctx context.Context, namespace, name string) QuotaService {
+	if s.sharder == nil || ForwardedFromContext(ctx) {
+		return nil
+	}
+
+	var ns *pb.NamespaceConfig
+	s.RLock()
+	if s.cfgs != nil {
+		ns = s.cfgs.Namespaces[namespace]
+	}
+	s.RUnlock()
+
+	if ns == nil || ns.DynamicBucketTemplate == nil || ns.Disabled || ns.Buckets[name] != nil {
+		return nil
+	}
+
+	return s.sharder.Owner(namespace, name)
+}
+
+// forwarded returns true if a request was served by the instance it was forwarded to, whether or
+// not it was granted, rather than failing to reach it.
+func forwarded(err error) bool {
+	_, served := err.(QuotaServiceError)
+	return err == nil || served
+}
+
+// allow takes tokens from a bucket using the take function, emitting events for the outcome. The
+// tokens requested are scaled by the cost of the request's kind, if it declares one, and by the
+// namespace's token scale unless fractional, before being checked and passed to take. Fractional
+// requests already count tokens as the namespace's buckets do. Requests in disabled namespaces are
+// granted without taking tokens, and requests in unknown namespaces are served according to the
+// default namespace behavior. In namespaces with a namespace limit, the tokens are also taken from
+// the limit. Requests for disabled buckets are granted without waiting, and without taking from the
+// namespace limit. Repeats of granted requests with the same request ID are answered with their
+// original result, if deduped. The tokens granted are those requested, unless clamped by a bucket
+// clamping requests over its max tokens per request, counted as those requested.
+func (s *server) allow(ctx context.Context, namespace, name string, tokensRequested int64, fractional bool, take func(Bucket, int64) (time.Duration, bool, error)) (int64, time.Duration, bool, error) {
+	key := s.dedupeKey(ctx, namespace, name)
+	if r := s.dedupedResult(key); r != nil {
+		if r.Granted == 0 {
+			return tokensRequested, r.Wait, r.Dynamic, nil
+		}
+
+		return r.Granted, r.Wait, r.Dynamic, nil
+	}
+
+	granted := tokensRequested
+
+	var b, limit Bucket
+	var e error
+
+	requestedNamespace, requestedName := namespace, name
+
+	s.RLock()
+	unknown, allowAll, reject := s.unknownNamespaceLocked(namespace)
+
+	// Requests matching no bucket are served by the catch-all, if any, as requests for it.
+	var requested string
+	disabled := s.namespaceDisabledLocked(namespace) || allowAll || s.failingOpenLocked()
+	if !disabled && !reject {
+		b, e = s.bucketContainer.FindBucket(namespace, name)
+		if e == nil && (b == nil || unknown) && s.catchAllNamespace != "" {
+			requested = config.FullyQualifiedName(requestedNamespace, requestedName)
+			namespace, name = s.catchAllNamespace, s.catchAllBucket
+			b, e = s.bucketContainer.FindBucket(namespace, name)
+		}
+
+		limit = s.bucketContainer.NamespaceLimit(namespace)
+	}
+	cost, costErr := s.requestCostLocked(ctx, namespace, tokensRequested, fractional)
+	s.RUnlock()
+
+	if unknown {
+		s.Emit(events.NewUnknownNamespaceEvent(requestedNamespace, requestedName))
+	}
+
+	if reject {
+		return 0, 0, false, newUnknownNamespaceError(namespace)
+	}
+
+	if disabled {
+		// Fail open, still emitting the tokens that would have been taken so usage stays observable.
+		if costErr == nil {
+			tokensRequested = cost
+		}
+
+		s.emitTokensServed(namespace, name, false, nil, tokensRequested, 0, 0)
+		return granted, 0, false, nil
+	}
+
+	tokensRequested = cost
+	if costErr != nil {
+		return 0, 0, false, costErr
+	}
+
+	if e != nil {
+		// Attempted to create a dynamic bucket and failed.
+		s.Emit(events.NewBucketMissedEvent(namespace, name, true))
+		return 0, 0, true, newError("Cannot create dynamic bucket "+config.FullyQualifiedName(namespace, name), ER_TOO_MANY_BUCKETS)
+	}
+
+	if b == nil {
+		if unknown {
+			// There is no global default bucket to serve the namespace.
+			return 0, 0, false, newUnknownNamespaceError(namespace)
+		}
+
+		s.Emit(events.NewBucketMissedEvent(namespace, name, false))
+		return 0, 0, false, newError("No such bucket "+config.FullyQualifiedName(namespace, name), ER_NO_BUCKET)
+	}
+
+	// Events about the bucket carry its labels.
+	labels := b.Config().Labels
+	if requested != "" {
+		labels = catchAllLabels(labels, requested)
+	}
+
+	// Time spent taking tokens is reported as the queue time of the request.
+	start := s.now()
+
+	if b.Config().Disabled {
+		s.takeDisabled(namespace, name, b, tokensRequested, take)
+		s.emitTokensServed(namespace, name, b.Dynamic(), labels, tokensRequested, 0, s.now().Sub(start))
+		s.rememberResult(key, granted, 0, b.Dynamic())
+		return granted, 0, b.Dynamic(), nil
+	}
+
+	// Buckets, and namespace limits, clamping requests over their max tokens per request grant as
+	// many tokens as they allow instead.
+	granted, tokensRequested = clampRequest(b.Config(), granted, tokensRequested)
+	if limit != nil {
+		granted, tokensRequested = clampRequest(limit.Config(), granted, tokensRequested)
+	}
+
+	if b.Config().MaxTokensPerRequest < tokensRequested && b.Config().MaxTokensPerRequest > 0 {
+		s.Emit(events.NewLabeledEvent(events.NewTooManyTokensRequestedEvent(namespace, name, b.Dynamic(), tokensRequested), labels))
+		return 0, 0, b.Dynamic(), newTooManyTokensError(namespace, name, tokensRequested, b.Config().MaxTokensPerRequest)
+	}
+
+	// The namespace limit is taken from first, so requests it denies leave their bucket untouched.
+	limitWait, limitErr := s.takeNamespaceLimit(namespace, limit, tokensRequested, start, take)
+	if limitErr != nil {
+		return 0, 0, b.Dynamic(), limitErr
+	}
+
+	w, success, err := take(b, tokensRequested)
+	if err != nil || !success {
+		returnToNamespaceLimit(ctx, limit, tokensRequested)
+	}
+
+	if tooManyWaiters, ok := errors.Cause(err).(*tooManyWaitersError); ok {
+		// Rejected without queueing, as the bucket already has as many requests waiting as it allows.
+		evt := events.NewQueuedEvent(events.NewTimedOutEvent(namespace, name, b.Dynamic(), tokensRequested), s.now().Sub(start))
+		s.Emit(events.NewLabeledEvent(evt, labels))
+		return 0, 0, b.Dynamic(), newTooManyWaitersError(namespace, name, tooManyWaiters.maxWaiters)
+	}
+
+	if capReached, ok := errors.Cause(err).(*CapReachedError); ok {
+		// The bucket has served its token cap, so won't serve any tokens until its window rolls over.
+		s.Emit(events.NewLabeledEvent(events.NewCapReachedEvent(namespace, name, b.Dynamic(), tokensRequested), labels))
+		return 0, 0, b.Dynamic(), newCapReachedError(namespace, name, capReached)
+	}
+
+	if tooMany, ok := errors.Cause(err).(*TooManyTokensError); ok {
+		// The bucket could never serve this many tokens at once.
+		s.Emit(events.NewLabeledEvent(events.NewTooManyTokensRequestedEvent(namespace, name, b.Dynamic(), tokensRequested), labels))
+		return 0, 0, b.Dynamic(), newTooManyTokensError(namespace, name, tokensRequested, tooMany.MaxTokens)
+	}
+
+	if err != nil {
+		s.Emit(events.NewLabeledEvent(events.NewBucketErrorEvent(namespace, name, b.Dynamic()), labels))
+		return 0, 0, b.Dynamic(), errors.Wrap(err, "failed to take tokens")
+	}
+
+	if !success {
+		// Could not claim tokens within the given max wait time
+		evt := events.NewQueuedEvent(events.NewTimedOutEvent(namespace, name, b.Dynamic(), tokensRequested), s.now().Sub(start))
+		s.Emit(events.NewLabeledEvent(evt, labels))
+		return 0, 0, b.Dynamic(), newError(fmt.Sprintf("Timed out waiting on %v:%v", namespace, name), ER_TIMEOUT)
+	}
+
+	if limitWait > w {
+		w = limitWait
+	}
+
+	// The only result that successfully claims tokens. Events report the wait before jitter.
+	s.emitTokensServed(namespace, name, b.Dynamic(), labels, tokensRequested, w, s.now().Sub(start))
+	w = s.jitter(w)
+	s.rememberResult(key, granted, w, b.Dynamic())
+	return granted, w, b.Dynamic(), nil
+}
+
+// catchAllLabels returns the labels of the catch-all bucket, labeled with the bucket requested of it.
+func catchAllLabels(labels map[string]string, requested string) map[string]string {
+	catchAll := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		catchAll[k] = v
+	}
+
+	catchAll[events.CatchAllLabel] = requested
+	return catchAll
+}
+
+// takeNamespaceLimit takes tokens from the namespace limit of a namespace, if it has one, using the
+// take function, and returns the time to wait for them. Requests the limit denies fail as they would
+// if denied by their bucket, with events about the limit, timeouts carrying the time queued since
+// start.
+func (s *server) takeNamespaceLimit(namespace string, limit Bucket, tokensRequested int64, start time.Time, take func(Bucket, int64) (time.Duration, bool, error)) (time.Duration, error) {
+	if limit == nil {
+		return 0, nil
+	}
+
+	name := config.NamespaceLimitBucketName
+	labels := limit.Config().Labels
+
+	if limit.Config().Disabled {
+		s.takeDisabled(namespace, name, limit, tokensRequested, take)
+		return 0, nil
+	}
+
+	if maxTokens := limit.Config().MaxTokensPerRequest; maxTokens > 0 && tokensRequested > maxTokens {
+		s.Emit(events.NewLabeledEvent(events.NewTooManyTokensRequestedEvent(namespace, name, false, tokensRequested), labels))
+		return 0, newTooManyTokensError(namespace, name, tokensRequested, maxTokens)
+	}
+
+	w, success, err := take(limit, tokensRequested)
+	if tooMany, ok := errors.Cause(err).(*TooManyTokensError); ok {
+		s.Emit(events.NewLabeledEvent(events.NewTooManyTokensRequestedEvent(namespace, name, false, tokensRequested), labels))
+		return 0, newTooManyTokensError(namespace, name, tokensRequested, tooMany.MaxTokens)
+	}
+
+	if tooManyWaiters, ok := errors.Cause(err).(*tooManyWaitersError); ok {
+		evt := events.NewQueuedEvent(events.NewTimedOutEvent(namespace, name, false, tokensRequested), s.now().Sub(start))
+		s.Emit(events.NewLabeledEvent(evt, labels))
+		return 0, newTooManyWaitersError(namespace, name, tooManyWaiters.maxWaiters)
+	}
+
+	if capReached, ok := errors.Cause(err).(*CapReachedError); ok {
+		s.Emit(events.NewLabeledEvent(events.NewCapReachedEvent(namespace, name, false, tokensRequested), labels))
+		return 0, newCapReachedError(namespace, name, capReached)
+	}
+
+	if err != nil {
+		s.Emit(events.NewLabeledEvent(events.NewBucketErrorEvent(namespace, name, false), labels))
+		return 0, errors.Wrap(err, "failed to take tokens from the namespace limit")
+	}
+
+	if !success {
+		evt := events.NewQueuedEvent(events.NewTimedOutEvent(namespace, name, false, tokensRequested), s.now().Sub(start))
+		s.Emit(events.NewLabeledEvent(evt, labels))
+		return 0, newError(fmt.Sprintf("Timed out waiting on the namespace limit of %v", namespace), ER_TIMEOUT)
+	}
+
+	return w, nil
+}
+
+// takeDisabled takes tokens from a disabled bucket using the take function, without failing the
+// request or making it wait. The tokens are still taken so the bucket tracks the requests it serves,
+// and those it would have rejected are reported with EVENT_WOULD_REJECT.
+func (s *server) takeDisabled(namespace, name string, b Bucket, tokensRequested int64, take func(Bucket, int64) (time.Duration, bool, error)) {
+	labels := b.Config().Labels
+
+	if maxTokens := b.Config().MaxTokensPerRequest; maxTokens > 0 && tokensRequested > maxTokens {
+		s.Emit(events.NewLabeledEvent(events.NewWouldRejectEvent(namespace, name, b.Dynamic(), tokensRequested), labels))
+		return
+	}
+
+	_, success, err := take(b, tokensRequested)
+	_, tooMany := errors.Cause(err).(*TooManyTokensError)
+	_, tooManyWaiters := errors.Cause(err).(*tooManyWaitersError)
+	_, capReached := errors.Cause(err).(*CapReachedError)
+
+	switch {
+	case tooMany || tooManyWaiters || capReached || (err == nil && !success):
+		s.Emit(events.NewLabeledEvent(events.NewWouldRejectEvent(namespace, name, b.Dynamic(), tokensRequested), labels))
+	case err != nil:
+		s.Emit(events.NewLabeledEvent(events.NewBucketErrorEvent(namespace, name, b.Dynamic()), labels))
+	}
+}
+
+// returnToNamespaceLimit gives back tokens taken from a namespace limit for a request its bucket then
+// denied, if the limit is a Returner. Otherwise the tokens are lost, erring on the side of the
+// limit.
+func returnToNamespaceLimit(ctx context.Context, limit Bucket, tokens int64) {
+	if limit == nil {
+		return
+	}
+
+	_, delegate := unwrapBucket(limit)
+	if r, ok := delegate.(Returner); ok {
+		if err := r.Return(ctx, tokens); err != nil {
+			logging.Printf("Unable to return %v tokens to namespace limit %v: %v", tokens, config.FQN(limit.Config()), err)
+		}
+	}
+}
+
+// clampRequest returns the tokens granted and taken for a request for granted tokens, scaled by its
+// cost to take tokens, clamped to the max tokens per request of a bucket clamping requests over it.
+// Fewer tokens are granted in proportion, as the most whose cost is within the max.
+func clampRequest(cfg *pb.BucketConfig, granted, tokens int64) (int64, int64) {
+	maxTokens := cfg.MaxTokensPerRequest
+	if cfg.OverMaxTokensPolicy != config.OverMaxTokensClamp || maxTokens <= 0 || tokens <= maxTokens || granted <= 0 {
+		return granted, tokens
+	}
+
+	// Request costs are whole, so tokens is a multiple of granted.
+	cost := tokens / granted
+	if maxTokens < cost {
+		// Not even a single token could be granted, so the request is rejected.
+		return granted, tokens
+	}
+
+	return maxTokens / cost, maxTokens / cost * cost
+}
+
+// emitTokensServed emits the event for tokens served, sampled if the server has a sampler. The wait
+// is that imposed on the caller, and the queue time how long the request blocked being served.
+func (s *server) emitTokensServed(namespace, name string, dynamic bool, labels map[string]string, tokensRequested int64, w, queueTime time.Duration) {
+	weight := int64(1)
+	if s.sampler != nil {
+		if weight = s.sampler.Sample(namespace, name); weight == 0 {
+			return
+		}
+	}
+
+	e := events.NewQueuedEvent(events.NewTokensServedEvent(namespace, name, dynamic, tokensRequested, w), queueTime)
+	s.Emit(events.NewSampledEvent(events.NewLabeledEvent(e, labels), weight))
+}
+
+// namespaceDisabledLocked returns true if the namespace is configured as disabled. Must be called
+// with s's lock held.
+func (s *server) namespaceDisabledLocked(namespace string) bool {
+	return s.cfgs != nil && s.cfgs.Namespaces[namespace].GetDisabled()
+}
+
+// unknownNamespaceLocked returns true if the namespace is missing from the config, and whether
+// requests for it are to be granted without taking tokens or rejected, according to the default
+// namespace behavior. Must be called with s's lock held.
+func (s *server) unknownNamespaceLocked(namespace string) (unknown, allowAll, reject bool) {
+	if s.cfgs == nil || s.cfgs.Namespaces[namespace] != nil {
+		return false, false, false
+	}
+
+	return true, s.defaultNamespace == DefaultNamespaceAllowAll, s.defaultNamespace == DefaultNamespaceReject
+}
+
+// requestCostLocked returns the tokens to take for a request, multiplying the tokens requested by
+// the cost configured for the kind of the request in its namespace, and by the token scale of the
+// namespace unless the request is fractional, already counting tokens as its buckets do. Requests
+// without a kind take the tokens requested. Must be called with s's lock held.
+func (s *server) requestCostLocked(ctx context.Context, namespace string, tokensRequested int64, fractional bool) (int64, error) {
+	ns := s.cfgs.GetNamespaces()[namespace]
+	if !fractional {
+		tokensRequested *= config.TokenScale(ns)
+	}
+
+	kind := RequestKindFromContext(ctx)
+	if kind == "" {
+		return tokensRequested, nil
+	}
+
+	cost := ns.GetRequestCosts()[kind]
+	if cost < 1 {
+		return 0, newError(fmt.Sprintf("Unknown request kind %v in namespace %v", kind, namespace), ER_UNKNOWN_REQUEST_KIND)
+	}
+
+	return tokensRequested * cost, nil
+}
+
+func (s *server) ServeAdminConsole(mux *http.ServeMux, assetsDir string, development bool) {
+	admin.ServeAdminConsole(s, mux, assetsDir, development)
+}
+
+func (s *server) ServeAdminConsoleWithOptions(mux *http.ServeMux, assetsDir string, development bool, opts *admin.Options) {
+	admin.ServeAdminConsoleWithOptions(s, mux, assetsDir, development, opts)
+}
+
+func (s *server) SetLogger(logger logging.Logger) {
+	if s.currentStatus == lifecycle.Started {
+		panic("Cannot set logger after server has started!")
+	}
+	logging.SetLogger(logger)
+}
+
+func (s *server) SetStructuredLogger(logger logging.StructuredLogger) {
+	if s.currentStatus == lifecycle.Started {
+		panic("Cannot set logger after server has started!")
+	}
+	logging.SetStructuredLogger(logger)
+}
+
+func (s *server) SetStatsListener(listener stats.Listener) {
+	if s.currentStatus == lifecycle.Started {
+		panic("Cannot add listener after server has started!")
+	}
+
+	s.statsListener = listener
+}
+
+func (s *server) SetTopTracker(tracker *stats.TopTracker) {
+	if s.currentStatus == lifecycle.Started {
+		panic("Cannot set top tracker after server has started!")
+	}
+
+	s.topTracker = tracker
+}
+
+func (s *server) SetWaitTimeHistograms(histograms *stats.WaitTimeHistograms) {
+	if s.currentStatus == lifecycle.Started {
+		panic("Cannot set wait time histograms after server has started!")
+	}
+
+	s.waitTimes = histograms
+}
+
+func (s *server) SetRateTracker(tracker *stats.RateTracker) {
+	if s.currentStatus == lifecycle.Started {
+		panic("Cannot set rate tracker after server has started!")
+	}
+
+	s.rateTracker = tracker
+}
+
+func (s *server) SetEventBroadcaster(broadcaster *events.Broadcaster, eventQueueBufSize int) {
+	if s.currentStatus == lifecycle.Started {
+		panic("Cannot set event broadcaster after server has started!")
+	}
+
+	if eventQueueBufSize < 1 {
+		panic("Event queue buffer size must be greater than 0")
+	}
+
+	s.broadcaster = broadcaster
+	if eventQueueBufSize > s.eventQueueBufSize {
+		s.eventQueueBufSize = eventQueueBufSize
+	}
+}
+
+func (s *server) SetAuditSink(sink audit.Sink) {
+	if s.currentStatus == lifecycle.Started {
+		panic("Cannot set audit sink after server has started!")
+	}
+
+	s.auditSink = sink
+}
+
+func (s *server) SetListener(listener events.Listener, eventQueueBufSize int) {
+	if s.currentStatus == lifecycle.Started {
+		panic("Cannot add listener after server has started!")
+	}
+
+	if eventQueueBufSize < 1 {
+		panic("Event queue buffer size must be greater than 0")
+	}
+
+	s.listener = listener
+	if eventQueueBufSize > s.eventQueueBufSize {
+		s.eventQueueBufSize = eventQueueBufSize
+	}
+}
+
+// filteredListener is a listener only notified of some event types.
+type filteredListener struct {
+	listener events.Listener
+	types    events.EventTypeSet
+}
+
+func (s *server) AddListener(listener events.Listener, eventQueueBufSize int, types ...events.EventType) {
+	if s.currentStatus == lifecycle.Started {
+		panic("Cannot add listener after server has started!")
+	}
+
+	if listener == nil {
+		panic("Cannot add a nil listener")
+	}
+
+	if eventQueueBufSize < 1 {
+		panic("Event queue buffer size must be greater than 0")
+	}
+
+	set := events.AllEventTypes
+	if len(types) > 0 {
+		set = events.NewEventTypeSet(types...)
+	}
+
+	s.filteredListeners = append(s.filteredListeners, &filteredListener{listener, set})
+	if eventQueueBufSize > s.eventQueueBufSize {
+		s.eventQueueBufSize = eventQueueBufSize
+	}
+}
+
+func (s *server) RegisterListener(name string, listener events.Listener, eventQueueBufSize int, types ...events.EventType) error {
+	if listener == nil {
+		panic("Cannot register a nil listener")
+	}
+
+	if eventQueueBufSize < 1 {
+		panic("Event queue buffer size must be greater than 0")
+	}
+
+	set := events.AllEventTypes
+	if len(types) > 0 {
+		set = events.NewEventTypeSet(types...)
+	}
+
+	return s.listeners.Register(name, listener, eventQueueBufSize, s.eventDropPolicy, set)
+}
+
+func (s *server) UnregisterListener(name string) bool {
+	return s.listeners.Unregister(name)
+}
+
+func (s *server) Listeners() []events.ListenerInfo {
+	return s.listeners.Listeners()
+}
+
+// eventTypes returns the event types wanted by any listener, which are the only events queued.
+func (s *server) eventTypes() events.EventTypeSet {
+	if s.listener != nil || s.statsListener != nil || s.topTracker != nil || s.waitTimes != nil || s.rateTracker != nil ||
+		s.broadcaster != nil {
+		return events.AllEventTypes
+	}
+
+	var types events.EventTypeSet
+	for _, l := range s.filteredListeners {
+		types |= l.types
+	}
+
+	return types
+}
+
+func (s *server) SetEventAggregation(policy events.AggregationPolicy) {
+	if s.currentStatus == lifecycle.Started {
+		panic("Cannot set event aggregation after server has started!")
+	}
+
+	s.aggregationPolicy = policy
+}
+
+func (s *server) SetEventSampling(policy events.SamplingPolicy) {
+	if s.currentStatus == lifecycle.Started {
+		panic("Cannot set event sampling after server has started!")
+	}
+
+	if policy == nil {
+		s.sampler = nil
+		return
+	}
+
+	s.sampler = events.NewSampler(policy)
+}
+
+func (s *server) SetConfigActivationPollInterval(interval time.Duration) {
+	if s.currentStatus == lifecycle.Started {
+		panic("Cannot set the config activation poll interval after server has started!")
+	}
+
+	s.activationPoll = interval
+}
+
+func (s *server) SetSharder(sharder Sharder) {
+	if s.currentStatus == lifecycle.Started {
+		panic("Cannot set sharder after server has started!")
+	}
+
+	s.sharder = sharder
+}
+
+func (s *server) SetConfigStalenessThreshold(threshold time.Duration) {
+	if s.currentStatus == lifecycle.Started {
+		panic("Cannot set the config staleness threshold after server has started!")
+	}
+
+	s.staleness = threshold
+}
+
+func (s *server) SetConfigDebounce(quiet time.Duration) {
+	if s.currentStatus == lifecycle.Started {
+		panic("Cannot set config debounce after server has started!")
+	}
+
+	if quiet < 0 {
+		panic("Config debounce must not be negative")
+	}
+
+	s.configDebounce = quiet
+}
+
+func (s *server) SetWaitJitter(maxJitter time.Duration) {
+	if s.currentStatus == lifecycle.Started {
+		panic("Cannot set wait jitter after server has started!")
+	}
+
+	if maxJitter < 0 {
+		panic("Wait jitter must not be negative")
+	}
+
+	s.waitJitter = maxJitter
+}
+
+// jitter adds up to the wait jitter to a wait time, unless it is 0.
+func (s *server) jitter(w time.Duration) time.Duration {
+	if w <= 0 || s.waitJitter == 0 {
+		return w
+	}
+
+	return w + time.Duration(rand.Int63n(int64(s.waitJitter)+1))
+}
+
+func (s *server) SetDefaultNamespaceBehavior(behavior DefaultNamespaceBehavior) {
+	if s.currentStatus == lifecycle.Started {
+		panic("Cannot set default namespace behavior after server has started!")
+	}
+
+	s.defaultNamespace = behavior
+}
+
+func (s *server) SetDedupeCache(cache dedupe.Cache) {
+	if s.currentStatus == lifecycle.Started {
+		panic("Cannot set dedupe cache after server has started!")
+	}
+
+	s.dedupe = cache
+}
+
+func (s *server) SetStartupPolicy(policy StartupPolicy) {
+	if s.currentStatus == lifecycle.Started {
+		panic("Cannot set startup policy after server has started!")
+	}
+
+	s.startupPolicy = policy
+}
+
+func (s *server) SetConfigSnapshot(path string) {
+	if s.currentStatus == lifecycle.Started {
+		panic("Cannot set config snapshot after server has started!")
+	}
+
+	s.snapshotPath = path
+}
+
+func (s *server) SetDynamicBucketMemoryBudget(maxBytes int64) {
+	if s.currentStatus == lifecycle.Started {
+		panic("Cannot set dynamic bucket memory budget after server has started!")
+	}
+
+	s.memoryBudget = maxBytes
+}
+
+// dynamicBucketMemoryBudget returns the budget configs are checked against, or nil if there is none.
+// Buckets are estimated by the BucketFactory, if it is a MemoryEstimator.
+func (s *server) dynamicBucketMemoryBudget() *config.MemoryBudget {
+	if s.memoryBudget <= 0 {
+		return nil
+	}
+
+	perBucket := int64(defaultBucketMemoryBytes)
+	if e, ok := s.bucketFactory.(MemoryEstimator); ok {
+		perBucket = e.BucketMemoryBytes()
+	}
+
+	return &config.MemoryBudget{MaxBytes: s.memoryBudget, BytesPerBucket: perBucket}
+}
+
+// backends returns the backends configs may select, or nil if the BucketFactory isn't a
+// BackendProvider and configs aren't checked.
+func (s *server) backends() []string {
+	if p, ok := s.bucketFactory.(BackendProvider); ok {
+		return p.Backends()
+	}
+
+	return nil
+}
+
+func (s *server) SetEventDropPolicy(policy events.DropPolicy) {
+	if s.currentStatus == lifecycle.Started {
+		panic("Cannot set event drop policy after server has started!")
+	}
+
+	s.eventDropPolicy = policy
+}
+
+func (s *server) EventsDropped() uint64 {
+	if s.producer == nil {
+		return 0
+	}
+
+	return s.producer.Dropped()
+}
+
+func (s *server) Emit(e events.Event) {
+	if s.sampler != nil && e.EventType() == events.EVENT_BUCKET_REMOVED {
+		s.sampler.Forget(e.Namespace(), e.BucketName())
+	}
+
+	if s.producer != nil {
+		s.producer.Emit(e)
+	}
+
+	s.listeners.Emit(events.Aggregate(e, s.aggregationPolicy))
+}
+
+func (s *server) configListener(ch <-chan struct{}) {
+	for range ch {
+		if s.fastTrackPending() || s.awaitQuietConfig(ch) {
+			// Jumps the queue, skipping the jitter too.
+			_ = s.readUpdatedConfig(0)
+			continue
+		}
+
+		jitter := 0
+		if s.maxJitterMillis != 0 {
+			// Pick a random number between 0 and maxJitterMillis
+			jitter = rand.Intn(s.maxJitterMillis)
+		}
+		_ = s.readUpdatedConfig(time.Duration(jitter) * time.Millisecond)
+	}
+}
+
+// awaitQuietConfig returns once no config change was notified on ch for the config debounce
+// period, coalescing the changes notified meanwhile since only the latest config is read after.
+// Changes that keep arriving delay it by at most maxConfigDebouncePeriods periods. Returns true,
+// as soon as it is notified, if a change notified is fast-tracked.
+func (s *server) awaitQuietConfig(ch <-chan struct{}) bool {
+	if s.configDebounce == 0 {
+		return false
+	}
+
+	deadline := time.NewTimer(maxConfigDebouncePeriods * s.configDebounce)
+	defer deadline.Stop()
+
+	for {
+		quiet := time.NewTimer(s.configDebounce)
+		select {
+		case _, ok := <-ch:
+			quiet.Stop()
+			if !ok {
+				return false
+			}
+
+			if s.fastTrackPending() {
+				return true
+			}
+		case <-quiet.C:
+			return false
+		case <-deadline.C:
+			quiet.Stop()
+			return false
+		}
+	}
+}
+
+// fastTrackPending returns whether the persister's config changes a fast-tracked namespace from the
+// config in force, so it should be applied at once. Reads the persister's config, which readers of
+// this notification read again to apply it.
+func (s *server) fastTrackPending() bool {
+	current := s.Configs()
+	if current == nil {
+		return false
+	}
+
+	newConfig, err := s.persister.ReadPersistedConfig()
+	if err != nil || newConfig == nil || newConfig.Version == current.Version {
+		return false
+	}
+
+	return len(config.FastTrackedChanges(current, newConfig)) > 0
+}
+
+// forcePollFastTracked forces the persister to poll its store, if it is a config.ForcePoller, after
+// a config changing fast-tracked namespaces was persisted, so it is applied without waiting for the
+// next scheduled poll.
+func (s *server) forcePollFastTracked(oldCfg, newCfg *pb.ServiceConfig) {
+	namespaces := config.FastTrackedChanges(oldCfg, newCfg)
+	if len(namespaces) == 0 {
+		return
+	}
+
+	p, ok := s.persister.(config.ForcePoller)
+	if !ok {
+		return
+	}
+
+	if _, err := p.ForcePoll(); err != nil {
+		s.persisterHealth.record(err, s.now())
+		logging.Warn("Unable to poll for a fast-tracked config", "version", newCfg.Version,
+			"namespaces", namespaces, "error", err)
+	}
+}
+
+// readUpdatedConfig reads the persister's config and applies it, returning an error if it can't
+// be read, or selects backends the bucket factory doesn't have.
+func (s *server) readUpdatedConfig(jitter time.Duration) error {
+	newConfig, err := s.persister.ReadPersistedConfig()
+	s.persisterHealth.record(err, s.now())
 
-	if e != nil {
-		// Attempted to create a dynamic bucket and failed.
-		s.Emit(events.NewBucketMissedEvent(namespace, name, true))
-		return 0, true, newError("Cannot create dynamic bucket "+config.FullyQualifiedName(namespace, name), ER_TOO_MANY_BUCKETS)
-	}
+	if err != nil {
+		logging.Println("error reading persisted config", err)
+		if sigErr, ok := err.(*config.SignatureError); ok {
+			s.Emit(events.NewConfigSignatureInvalidEvent(sigErr.Version, err))
+		}
 
-	if b == nil {
-		s.Emit(events.NewBucketMissedEvent(namespace, name, false))
-		return 0, false, newError("No such bucket "+config.FullyQualifiedName(namespace, name), ER_NO_BUCKET)
+		s.Emit(events.NewConfigReloadFailedEvent(-1, err))
+		return err
 	}
 
-	if b.Config().MaxTokensPerRequest < tokensRequested && b.Config().MaxTokensPerRequest > 0 {
-		s.Emit(events.NewTooManyTokensRequestedEvent(namespace, name, b.Dynamic(), tokensRequested))
-		return 0, b.Dynamic(), newError(fmt.Sprintf("Too many tokens requested. Bucket %v:%v, tokensRequested=%v, maxTokensPerRequest=%v",
-			namespace, name, tokensRequested, b.Config().MaxTokensPerRequest),
-			ER_TOO_MANY_TOKENS_REQUESTED)
+	s.persisterHealth.observedChange(s.now())
+	s.auditDetected(newConfig)
+
+	// Configs persisted elsewhere, such as by a server with other backends, weren't checked here.
+	if err := config.ValidateBackends(newConfig, s.backends()); err != nil {
+		logging.Error("Refusing config selecting backends that aren't configured", "version", newConfig.GetVersion(), "error", err)
+		s.Emit(events.NewConfigReloadFailedEvent(newConfig.GetVersion(), err))
+		return err
 	}
 
-	maxWaitTime := time.Millisecond
-	if maxWaitTimeOverride && maxWaitMillisOverride < b.Config().WaitTimeoutMillis {
-		// Use the max wait time override from the request.
-		maxWaitTime *= time.Duration(maxWaitMillisOverride)
-	} else {
-		// Fall back to the max wait time configured on the bucket.
-		maxWaitTime *= time.Duration(b.Config().WaitTimeoutMillis)
+	// Buckets created from templates the config doesn't have would be applied without a fill rate.
+	if err := config.ValidateTemplates(newConfig); err != nil {
+		logging.Error("Refusing config creating buckets from missing templates", "version", newConfig.GetVersion(), "error", err)
+		s.Emit(events.NewConfigReloadFailedEvent(newConfig.GetVersion(), err))
+		return err
 	}
 
-	w, success, err := b.Take(ctx, tokensRequested, maxWaitTime)
-	if err != nil {
-		s.Emit(events.NewBucketErrorEvent(namespace, name, b.Dynamic()))
-		return 0, b.Dynamic(), errors.Wrap(err, "failed to take tokens")
+	if jitter != 0 {
+		time.Sleep(jitter)
 	}
 
-	if !success {
-		// Could not claim tokens within the given max wait time
-		s.Emit(events.NewTimedOutEvent(namespace, name, b.Dynamic(), tokensRequested))
-		return 0, b.Dynamic(), newError(fmt.Sprintf("Timed out waiting on %v:%v", namespace, name), ER_TIMEOUT)
+	if s.Configs() == nil && !s.activeConfig(newConfig) {
+		// Nothing is in force yet, so start with the latest version that is.
+		if active := s.latestActiveConfig(); active != nil {
+			s.updateBucketContainer(active)
+		}
 	}
 
-	// The only result that successfully claims tokens
-	s.Emit(events.NewTokensServedEvent(namespace, name, b.Dynamic(), tokensRequested, w))
-	return w, b.Dynamic(), nil
-}
+	s.updateBucketContainer(newConfig)
 
-func (s *server) ServeAdminConsole(mux *http.ServeMux, assetsDir string, development bool) {
-	admin.ServeAdminConsole(s, mux, assetsDir, development)
-}
+	s.Lock()
+	s.degraded = false
+	s.Unlock()
 
-func (s *server) SetLogger(logger logging.Logger) {
-	if s.currentStatus == lifecycle.Started {
-		panic("Cannot set logger after server has started!")
-	}
-	logging.SetLogger(logger)
+	s.saveConfigSnapshot()
+	return nil
 }
 
-func (s *server) SetStatsListener(listener stats.Listener) {
-	if s.currentStatus == lifecycle.Started {
-		panic("Cannot add listener after server has started!")
+func (s *server) ReloadConfig() (int32, error) {
+	if p, ok := s.persister.(config.ForcePoller); ok {
+		if _, err := p.ForcePoll(); err != nil {
+			s.persisterHealth.record(err, s.now())
+			return 0, err
+		}
 	}
 
-	s.statsListener = listener
-}
-
-func (s *server) SetListener(listener events.Listener, eventQueueBufSize int) {
-	if s.currentStatus == lifecycle.Started {
-		panic("Cannot add listener after server has started!")
+	if err := s.readUpdatedConfig(0); err != nil {
+		return 0, err
 	}
 
-	if eventQueueBufSize < 1 {
-		panic("Event queue buffer size must be greater than 0")
+	cfg := s.Configs()
+	if cfg == nil {
+		return 0, nil
 	}
 
-	s.listener = listener
-	s.eventQueueBufSize = eventQueueBufSize
+	return cfg.Version, nil
 }
 
-func (s *server) Emit(e events.Event) {
-	if s.producer != nil {
-		s.producer.Emit(e)
-	}
+// activeConfig returns true if a config has no activation time, or it has passed.
+func (s *server) activeConfig(cfg *pb.ServiceConfig) bool {
+	return cfg.ActivateAt <= s.now().Unix()
 }
 
-func (s *server) configListener(ch <-chan struct{}) {
-	for range ch {
-		jitter := 0
-		if s.maxJitterMillis != 0 {
-			// Pick a random number between 0 and maxJitterMillis
-			jitter = rand.Intn(s.maxJitterMillis)
+// latestActiveConfig returns the highest version of the historical configs that is active, or nil
+// if there is none.
+func (s *server) latestActiveConfig() *pb.ServiceConfig {
+	configs, err := s.persister.ReadHistoricalConfigs()
+	if err != nil {
+		logging.Println("error reading historical configs", err)
+		return nil
+	}
+
+	var latest *pb.ServiceConfig
+	for _, cfg := range configs {
+		if s.activeConfig(cfg) && (latest == nil || cfg.Version > latest.Version) {
+			latest = cfg
 		}
-		s.readUpdatedConfig(time.Duration(jitter) * time.Millisecond)
 	}
-}
 
-func (s *server) readUpdatedConfig(jitter time.Duration) {
-	newConfig, err := s.persister.ReadPersistedConfig()
+	return latest
+}
 
-	if err != nil {
-		logging.Println("error reading persisted config", err)
-		return
+// activationPoller applies the pending config once its activation time has passed, and reports the
+// ramps of the config in force that finished, checking every activation poll interval until stop is
+// closed.
+func (s *server) activationPoller(stop <-chan struct{}) {
+	interval := s.activationPoll
+	if interval <= 0 {
+		interval = defaultActivationPollInterval
 	}
 
-	if jitter != 0 {
-		time.Sleep(jitter)
-	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-	s.updateBucketContainer(newConfig)
+	rampsCheckedAt := s.now()
+	for {
+		select {
+		case <-ticker.C:
+			if pending := s.PendingConfig(); pending != nil && s.activeConfig(pending) {
+				s.updateBucketContainer(pending)
+				s.saveConfigSnapshot()
+			}
+
+			// Ramps that finished before startup, or before the clock was set back, aren't reported.
+			if now := s.now(); now.After(rampsCheckedAt) {
+				s.emitRampsCompleted(rampsCheckedAt, now)
+				rampsCheckedAt = now
+			}
+		case <-stop:
+			return
+		}
+	}
 }
 
 func (s *server) createBucketContainer() {
@@ -226,6 +1229,15 @@ func (s *server) createBucketContainer() {
 }
 
 func (s *server) updateBucketContainer(newConfig *pb.ServiceConfig) {
+	// Emitted once the locks are released, so listeners reacting to them can read the new config.
+	for _, e := range s.applyConfig(newConfig) {
+		s.Emit(e)
+	}
+}
+
+// applyConfig puts a config in force, or keeps it pending until its activation time, and returns
+// the config events to emit for it.
+func (s *server) applyConfig(newConfig *pb.ServiceConfig) []events.Event {
 	s.Lock()
 	defer s.Unlock()
 
@@ -233,62 +1245,89 @@ func (s *server) updateBucketContainer(newConfig *pb.ServiceConfig) {
 	if s.cfgs != nil && newConfig.Version <= s.cfgs.Version {
 		logging.Printf("Proposed config version %d is lower than existing config version %d. Ignoring.",
 			newConfig.Version, s.cfgs.Version)
-		return
+		return nil
+	}
+
+	if s.cfgs != nil && !s.activeConfig(newConfig) {
+		// Keep the current config in force until the new one activates.
+		if s.pendingCfg == nil || s.pendingCfg.Version != newConfig.Version {
+			logging.Printf("Config version %d is pending activation at %v.", newConfig.Version, time.Unix(newConfig.ActivateAt, 0))
+		}
+
+		s.pendingCfg = newConfig
+		return nil
+	}
+
+	// Activated on schedule, rather than superseded by a later version.
+	activated := s.pendingCfg != nil && s.pendingCfg.Version == newConfig.Version
+
+	if s.pendingCfg != nil && s.pendingCfg.Version <= newConfig.Version {
+		// Activated, or superseded by a later version.
+		s.pendingCfg = nil
 	}
 
 	s.bucketContainer.Lock()
 	defer s.bucketContainer.Unlock()
 
+	// Buckets are created from their templates, so changing a template reconfigures them.
+	resolved := config.ResolveTemplates(newConfig)
+
 	// Initialize buckets
-	s.bucketFactory.Init(newConfig)
+	s.bucketFactory.Init(resolved)
 
 	// If there is no existing config, then this bucket container is brand-new and hasn't been used before.
 	firstTime := s.bucketContainer.cfg == nil
 
+	// Notify subscribers of the change before swapping out the old config
+	diff := config.Diff(s.cfgs, newConfig)
+	s.configChanges.Publish(&config.ConfigChange{
+		Version: newConfig.Version,
+		User:    newConfig.User,
+		Date:    newConfig.Date,
+		Diff:    diff,
+		Summary: diff.Summary()})
+
 	// Set the new config on the the server
 	s.cfgs = newConfig
+	s.rampEnds = rampEnds(resolved)
+	s.catchAllNamespace, s.catchAllBucket, _ = config.CatchAllBucket(resolved)
+	configEvents := []events.Event{events.NewConfigReloadedEvent(newConfig.Version)}
+	if activated {
+		configEvents = append(configEvents, events.NewConfigActivatedEvent(newConfig.Version))
+	}
 
 	if firstTime {
-		s.bucketContainer.initLocked(newConfig)
-		return
+		s.bucketContainer.initLocked(resolved)
+		return configEvents
 	}
 
-	s.bucketContainer.cfg = newConfig
+	s.bucketContainer.cfg = resolved
 	// Diff existing configs, buckets and namespaces against the new config and see what needs to be evicted
 
 	// Start with the globalDefaultBucket
-	var currentDefaultBucketCfg *pb.BucketConfig
-	if s.bucketContainer.defaultBucket != nil {
-		currentDefaultBucketCfg = s.bucketContainer.defaultBucket.Config()
-	}
+	s.bucketContainer.defaultBucket = s.bucketContainer.reconcileSingletonBucket(config.GlobalNamespace,
+		config.DefaultBucketName, s.bucketContainer.defaultBucket,
+		config.CanaryConfig(config.GlobalNamespace, config.DefaultBucketName, resolved.GlobalDefaultBucket))
 
-	if config.DifferentBucketConfigs(currentDefaultBucketCfg, newConfig.GlobalDefaultBucket) {
-		if s.bucketContainer.defaultBucket != nil {
-			// We need to destroy existing buckets even if we are replacing them.
-			s.bucketContainer.defaultBucket.Destroy()
+	// Scan through all namespaces in s.bucketContainer.namespaces and update the config to point to
+	// the new instance, *regardless* of whether the config has changed or not. If the config *has*
+	// changed, reconcile the namespace's buckets in place, so buckets keep their balances unless
+	// they're removed from the config.
+	for name, ns := range s.bucketContainer.namespaces {
+		newNsCfg, exists := resolved.Namespaces[name]
+		if exists && ns.cfg.Backend != newNsCfg.Backend {
+			// Buckets can't move between backends, so they're recreated with the new one below.
+			exists = false
 		}
 
-		if newConfig.GlobalDefaultBucket == nil {
-			s.bucketContainer.defaultBucket = nil
-		} else {
-			s.bucketContainer.createGlobalDefaultBucketLocked(s.cfgs.GlobalDefaultBucket)
+		if exists && config.TokenScale(ns.cfg) != config.TokenScale(newNsCfg) {
+			// Balances counted in fractions of the old scale can't be carried over either.
+			exists = false
 		}
-	}
 
-	// Scan through all namespaces in s.bucketContainer.namespaces and update the config to point to
-	// the new instance, *regardless* of whether the config has changed or not. Also, if the config *has*
-	// changed, throw away the old namespace and recreate it. We *could* scan all the buckets in a namespace
-	// and only recreate the ones that have changed, but this may have little benefit, since the real cost
-	// here is with dynamic buckets, and if the namespace config has changed, it's very likely that the
-	// change involves the dynamic bucket template.
-	for name, ns := range s.bucketContainer.namespaces {
-		newNsCfg, exists := newConfig.Namespaces[name]
 		if exists {
 			if config.DifferentNamespaceConfigs(ns.cfg, newNsCfg) {
-				// We need to destroy the old namespace before overwriting.
-				ns.destroy()
-				// This will overwrite the existing namespace
-				s.bucketContainer.createNamespaceLocked(newNsCfg)
+				s.bucketContainer.reconcileNamespaceLocked(ns, newNsCfg)
 			} else {
 				// Just correct the config pointer on the old namespace
 				ns.swapCfg(newNsCfg)
@@ -300,33 +1339,223 @@ func (s *server) updateBucketContainer(newConfig *pb.ServiceConfig) {
 	}
 
 	// Now look for any new namespaces in the new config and add them
-	for name, nsCfg := range newConfig.Namespaces {
+	for name, nsCfg := range resolved.Namespaces {
 		if _, exists := s.bucketContainer.namespaces[name]; !exists {
 			s.bucketContainer.createNamespaceLocked(nsCfg)
 		}
 	}
+
+	return configEvents
 }
 
 func (s *server) updateConfig(user string, updater func(*pb.ServiceConfig) error) error {
+	_, err := s.persistConfig(user, "", anyVersion, updater)
+	return err
+}
+
+// anyVersion is passed to persistConfig for changes that apply to whichever version is current.
+const anyVersion = -1
+
+// supersedingVersion is passed to persistConfig for changes that replace whichever version is
+// current, superseding any pending activation, such as rollbacks.
+const supersedingVersion = -2
+
+// persistConfig applies updater to a clone of the current config and persists the result as the
+// next version, returning the version assigned. If the persister is a config.ConditionalPersister,
+// the config is only persisted if no other version was persisted since the one it is based on.
+// Otherwise, the user is recorded as the author of the version with the persister if it is a
+// config.MetaPersister. The user is recorded in the audit log along with the note either way.
+// Changes without a user are attributed to admin.AnonymousPrincipal. Unless expectedVersion is
+// anyVersion, config.ErrStaleConfig is returned if the current config isn't that version.
+//
+// While a config is pending activation, changes are only made to it: those whose expectedVersion
+// is the pending version are applied to the pending config, and any others but those passing
+// supersedingVersion fail with config.ErrActivationPending, rather than dropping its changes.
+// Until a config has been read, changes fail with config.ErrNoConfig.
+func (s *server) persistConfig(user, note string, expectedVersion int32, updater func(*pb.ServiceConfig) error) (int32, error) {
+	if user == "" {
+		user = admin.AnonymousPrincipal
+	}
+
 	s.Lock()
-	clonedCfg := config.CloneConfig(s.cfgs)
-	currentVersion := clonedCfg.Version
+	currentCfg := s.cfgs
+	if currentCfg == nil {
+		// Changes to an empty config would replace the config that couldn't be read.
+		s.Unlock()
+		return 0, config.ErrNoConfig
+	}
+
+	currentVersion := currentCfg.Version
+	if pending := s.pendingCfg; pending != nil && pending.Version > currentVersion {
+		switch expectedVersion {
+		case pending.Version:
+			currentCfg = pending
+		case supersedingVersion:
+			// Numbered after the pending version, which it supersedes.
+		default:
+			s.Unlock()
+			return 0, config.ErrActivationPending
+		}
+
+		currentVersion = pending.Version
+	}
+	clonedCfg := config.CloneConfig(currentCfg)
 	s.Unlock()
 
+	if expectedVersion != anyVersion && expectedVersion != supersedingVersion && expectedVersion != currentVersion {
+		return 0, config.ErrStaleConfig
+	}
+
 	err := updater(clonedCfg)
 
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	config.ApplyDefaults(clonedCfg)
 
+	if err := config.ValidateTemplates(clonedCfg); err != nil {
+		return 0, err
+	}
+
+	if err := config.ValidateMemoryBudget(clonedCfg, s.dynamicBucketMemoryBudget()); err != nil {
+		return 0, err
+	}
+
+	if err := config.ValidateBackends(clonedCfg, s.backends()); err != nil {
+		return 0, err
+	}
+
 	clonedCfg.User = user
 	clonedCfg.Date = time.Now().Unix()
 	clonedCfg.Version = currentVersion + 1
+	s.markSelfPersisted(clonedCfg.Version, true)
+
+	if p, ok := s.persister.(config.ConditionalPersister); ok {
+		// Fails with config.ErrStaleConfig if another change was persisted since the version this
+		// one is based on, e.g. through another node's admin console.
+		err = p.PersistIfLatest(int(currentVersion), clonedCfg)
+	} else {
+		_, err = config.PersistAndNotifyWithMeta(s.persister, "", clonedCfg, &config.PersistMeta{Author: user, Note: note})
+	}
+
+	s.persisterHealth.record(err, s.now())
+	s.audit(user, note, currentCfg, clonedCfg, err)
+	if err != nil {
+		// Another writer's version with the same number is theirs to audit as detected.
+		s.markSelfPersisted(clonedCfg.Version, false)
+	} else {
+		s.forcePollFastTracked(currentCfg, clonedCfg)
+	}
+
+	return clonedCfg.Version, err
+}
+
+// audit records an attempt to persist a config in the audit log. Entries are written whether or
+// not persisting succeeded.
+func (s *server) audit(user, note string, oldCfg, newCfg *pb.ServiceConfig, persistErr error) {
+	e := &audit.Entry{
+		Time:       time.Now(),
+		Principal:  user,
+		OldVersion: oldCfg.Version,
+		NewVersion: newCfg.Version,
+		Summary:    config.Diff(oldCfg, newCfg).Summary(),
+		Note:       note}
+
+	if persistErr != nil {
+		e.Error = persistErr.Error()
+	}
+
+	s.writeAuditEntry(e)
+}
+
+func (s *server) writeAuditEntry(e *audit.Entry) {
+	if err := s.auditSink.Write(e); err != nil {
+		logging.Printf("Unable to write audit log entry %+v: %v", e, err)
+	}
+}
+
+// markSelfPersisted records whether this server is persisting a version, which it audits itself.
+func (s *server) markSelfPersisted(version int32, persisting bool) {
+	s.detectMu.Lock()
+	defer s.detectMu.Unlock()
+
+	if persisting {
+		s.selfPersisted[version] = true
+	} else {
+		delete(s.selfPersisted, version)
+	}
+}
+
+// auditDetected records the versions persisted since the config last read from the persister, up
+// to latest, in the audit log as detected, whichever process persisted them, e.g. another node or
+// a tool writing to the config store directly. Versions this server persisted are already audited.
+// Versions skipped over, such as those coalesced into a single read, are read from the historical
+// configs. The first config read is where detection starts, so isn't audited.
+func (s *server) auditDetected(latest *pb.ServiceConfig) {
+	s.detectMu.Lock()
+	defer s.detectMu.Unlock()
+
+	previous := s.detected
+	if previous != nil && latest.Version <= previous.Version {
+		return
+	}
+
+	s.detected = latest
+	if previous == nil {
+		return
+	}
+
+	versions := []*pb.ServiceConfig{latest}
+	if latest.Version > previous.Version+1 {
+		versions = s.detectedVersions(previous.Version, latest)
+	}
+
+	detectedAt := s.now()
+	for _, cfg := range versions {
+		if s.selfPersisted[cfg.Version] {
+			delete(s.selfPersisted, cfg.Version)
+		} else {
+			principal := cfg.User
+			if principal == "" {
+				principal = admin.AnonymousPrincipal
+			}
+
+			s.writeAuditEntry(&audit.Entry{
+				Time:       detectedAt,
+				Principal:  principal,
+				OldVersion: previous.Version,
+				NewVersion: cfg.Version,
+				Summary:    config.Diff(previous, cfg).Summary(),
+				Note:       audit.DetectedNote})
+		}
+
+		previous = cfg
+	}
+}
 
-	// TODO(manik) make use of the old hash for an optimistic version check
-	return s.persister.PersistAndNotify("", clonedCfg)
+// detectedVersions returns the historical configs after version up to latest, in order, ending with
+// latest. Returns only latest if they can't be read.
+func (s *server) detectedVersions(version int32, latest *pb.ServiceConfig) []*pb.ServiceConfig {
+	history, err := s.persister.ReadHistoricalConfigs()
+	if err != nil {
+		logging.Warn("Unable to read historical configs to audit the versions detected", "error", err)
+		return []*pb.ServiceConfig{latest}
+	}
+
+	versions := make([]*pb.ServiceConfig, 0)
+	for _, cfg := range history {
+		if cfg.Version > version && cfg.Version < latest.Version {
+			versions = append(versions, cfg)
+		}
+	}
+
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+	return append(versions, latest)
+}
+
+func (s *server) AuditEntries(offset, limit int) ([]*audit.Entry, int, error) {
+	return audit.List(s.auditSink, offset, limit)
 }
 
 // Implements admin.Administrable
@@ -336,6 +1565,12 @@ func (s *server) Configs() *pb.ServiceConfig {
 	return s.cfgs
 }
 
+func (s *server) PendingConfig() *pb.ServiceConfig {
+	s.RLock()
+	defer s.RUnlock()
+	return s.pendingCfg
+}
+
 func (s *server) UpdateConfig(c *pb.ServiceConfig, user string) error {
 	return s.updateConfig(user, func(clonedCfg *pb.ServiceConfig) error {
 		*clonedCfg = *c
@@ -343,6 +1578,51 @@ func (s *server) UpdateConfig(c *pb.ServiceConfig, user string) error {
 	})
 }
 
+func (s *server) UpdateConfigIfLatest(c *pb.ServiceConfig, expectedVersion int32, user string) error {
+	_, err := s.persistConfig(user, "", expectedVersion, func(clonedCfg *pb.ServiceConfig) error {
+		*clonedCfg = *c
+		return nil
+	})
+
+	return err
+}
+
+func (s *server) PersistConfig(c *pb.ServiceConfig, user string) (int32, error) {
+	if err := config.ValidateWithBudget(c, s.dynamicBucketMemoryBudget()); err != nil {
+		return 0, err
+	}
+
+	return s.persistConfig(user, "", anyVersion, func(clonedCfg *pb.ServiceConfig) error {
+		*clonedCfg = *c
+		return nil
+	})
+}
+
+func (s *server) RollbackConfig(version int32, user string) (int32, error) {
+	configs, err := s.persister.ReadHistoricalConfigs()
+	if err != nil {
+		return 0, err
+	}
+
+	var target *pb.ServiceConfig
+	for _, c := range configs {
+		if c != nil && c.Version == version {
+			target = c
+			break
+		}
+	}
+
+	if target == nil {
+		return 0, config.ErrUnknownVersion
+	}
+
+	note := fmt.Sprintf("rollback to version %v", version)
+	return s.persistConfig(user, note, supersedingVersion, func(clonedCfg *pb.ServiceConfig) error {
+		*clonedCfg = *config.CloneConfig(target)
+		return nil
+	})
+}
+
 func (s *server) AddBucket(namespace string, b *pb.BucketConfig, user string) error {
 	return s.updateConfig(user, func(clonedCfg *pb.ServiceConfig) error {
 		return config.CreateBucket(clonedCfg, namespace, b)
@@ -361,6 +1641,24 @@ func (s *server) DeleteBucket(namespace, name, user string) error {
 	})
 }
 
+func (s *server) AddTemplate(t *pb.BucketConfig, user string) error {
+	return s.updateConfig(user, func(clonedCfg *pb.ServiceConfig) error {
+		return config.CreateTemplate(clonedCfg, t)
+	})
+}
+
+func (s *server) UpdateTemplate(t *pb.BucketConfig, user string) error {
+	return s.updateConfig(user, func(clonedCfg *pb.ServiceConfig) error {
+		return config.UpdateTemplate(clonedCfg, t)
+	})
+}
+
+func (s *server) DeleteTemplate(name, user string) error {
+	return s.updateConfig(user, func(clonedCfg *pb.ServiceConfig) error {
+		return config.DeleteTemplate(clonedCfg, name)
+	})
+}
+
 func (s *server) AddNamespace(n *pb.NamespaceConfig, user string) error {
 	return s.updateConfig(user, func(clonedCfg *pb.ServiceConfig) error {
 		return config.CreateNamespace(clonedCfg, n)
@@ -403,6 +1701,97 @@ func (s *server) DynamicBucketStats(namespace, bucket string) *stats.BucketScore
 	return s.statsListener.Get(namespace, bucket)
 }
 
+func (s *server) TopBuckets(metric stats.TopMetric, n int) []*stats.TopBucket {
+	if s.topTracker == nil {
+		return nil
+	}
+
+	return s.topTracker.Top(metric, n)
+}
+
+func (s *server) ResetStats(namespace string) bool {
+	if s.statsListener == nil && s.topTracker == nil && s.waitTimes == nil && s.rateTracker == nil {
+		return false
+	}
+
+	if s.statsListener != nil {
+		s.statsListener.Reset(namespace)
+	}
+
+	if s.topTracker != nil {
+		s.topTracker.Reset(namespace)
+	}
+
+	if s.waitTimes != nil {
+		s.waitTimes.Reset(namespace)
+	}
+
+	if s.rateTracker != nil {
+		s.rateTracker.Reset(namespace)
+	}
+
+	return true
+}
+
+func (s *server) NamespaceRates() ([]*stats.NamespaceRate, time.Duration) {
+	if s.rateTracker == nil {
+		return nil, 0
+	}
+
+	return s.rateTracker.Rates(), s.rateTracker.Window()
+}
+
+func (s *server) SubscribeEvents(bufSize int, filter func(events.Event) bool) *events.Subscription {
+	if s.broadcaster == nil {
+		return nil
+	}
+
+	return s.broadcaster.Subscribe(bufSize, filter)
+}
+
+func (s *server) PersisterHealth() *admin.PersisterHealth {
+	health := s.persisterHealth.snapshot()
+	if r, ok := s.persister.(config.LastErrorReporter); ok {
+		err, at := r.LastError()
+		health = withReported(health, err, at)
+	}
+
+	return health
+}
+
+func (s *server) ConfigHealth() *admin.ConfigHealth {
+	var lastPolled time.Time
+	if r, ok := s.persister.(config.PollReporter); ok {
+		lastPolled = r.LastPolled()
+	}
+
+	health := s.persisterHealth.freshness(lastPolled, s.staleness, s.now())
+	if s.degradedStartup() {
+		health.Degraded = s.startupPolicy.String()
+		if cfg := s.Configs(); cfg != nil && s.startupPolicy == StartupLastKnownGood {
+			health.SnapshotVersion = cfg.Version
+		}
+	}
+
+	return health
+}
+
+// CheckHealth reports the server degraded if config changes may have stopped reaching it, so it
+// could be enforcing stale limits, or if the persister reports it is failing to reach its store.
+func (s *server) CheckHealth() error {
+	if !s.ConfigHealth().Healthy {
+		return errors.Errorf("no config change observed nor config store polled in %v", s.staleness)
+	}
+
+	if r, ok := s.persister.(config.LastErrorReporter); ok {
+		if err, _ := r.LastError(); err != nil {
+			return errors.Wrap(err, "config persister failing")
+		}
+	}
+
+	return nil
+}
+
 func (s *server) HistoricalConfigs() ([]*pb.ServiceConfig, error) {
 	configs, err := s.persister.ReadHistoricalConfigs()
 	if err != nil {
@@ -415,6 +1804,10 @@ func (s *server) HistoricalConfigs() ([]*pb.ServiceConfig, error) {
 	return sorted, nil
 }
 
+func (s *server) SubscribeConfigChanges(bufSize int) (<-chan *config.ConfigChange, func()) {
+	return s.configChanges.Subscribe(bufSize)
+}
+
 func (s *server) GetServerAdministrable() admin.Administrable {
 	return s
 }
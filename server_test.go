@@ -5,11 +5,30 @@ package quotaservice
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/golang/protobuf/proto"
+	"github.com/square/quotaservice/admin"
+	"github.com/square/quotaservice/audit"
 	"github.com/square/quotaservice/config"
+	"github.com/square/quotaservice/dedupe"
 	"github.com/square/quotaservice/events"
+	pb "github.com/square/quotaservice/protos/config"
+	"github.com/square/quotaservice/stats"
 	"github.com/square/quotaservice/test/helpers"
 )
 
@@ -70,96 +89,3279 @@ func TestUpdateConfig(t *testing.T) {
 	}
 }
 
+func TestPersistConfig(t *testing.T) {
+	p := config.NewMemoryConfig(config.NewDefaultServiceConfig())
+	s := New(&MockBucketFactory{}, p, NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	invalid := config.NewDefaultServiceConfig()
+	invalid.GlobalDefaultBucket = &pb.BucketConfig{Size: -1}
+
+	if _, err := s.PersistConfig(invalid, "test"); err == nil {
+		t.Fatal("Expected an invalid config to be rejected")
+	} else if _, ok := err.(config.ValidationErrors); !ok {
+		t.Fatalf("Expected ValidationErrors, got %v", err)
+	}
+
+	version, err := s.PersistConfig(config.NewDefaultServiceConfig(), "test")
+	helpers.CheckError(t, err)
+
+	if version != s.Configs().Version+1 {
+		t.Errorf("Expected version %v to be assigned, got %v", s.Configs().Version+1, version)
+	}
+
+	persisted, err := p.ReadPersistedConfig()
+	helpers.CheckError(t, err)
+
+	if persisted.Version != version || persisted.User != "test" {
+		t.Errorf("Unexpected persisted config %+v", persisted)
+	}
+}
+
+func TestPersistConfigMemoryBudget(t *testing.T) {
+	p := config.NewMemoryConfig(config.NewDefaultServiceConfig())
+	s := New(&MockBucketFactory{}, p, NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	s.SetDynamicBucketMemoryBudget(10 * defaultBucketMemoryBytes)
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	ns := config.NewDefaultNamespaceConfig("foo")
+	config.SetDynamicBucketTemplate(ns, config.NewDefaultBucketConfig(""))
+	ns.MaxDynamicBuckets = 1000000
+	cfg := config.NewDefaultServiceConfig()
+	helpers.CheckError(t, config.AddNamespace(cfg, ns))
+
+	if _, err := s.PersistConfig(cfg, "test"); err == nil {
+		t.Fatal("Expected a config overshooting the memory budget to be rejected")
+	} else if _, ok := err.(config.ValidationErrors); !ok {
+		t.Fatalf("Expected ValidationErrors, got %v", err)
+	}
+
+	if err := s.AddNamespace(ns, "test"); err == nil {
+		t.Error("Expected adding a namespace overshooting the memory budget to be rejected")
+	}
+
+	persisted, err := p.ReadPersistedConfig()
+	helpers.CheckError(t, err)
+
+	if len(persisted.Namespaces) != 0 {
+		t.Errorf("Expected nothing to be persisted, got %+v", persisted)
+	}
+
+	ns.MaxDynamicBuckets = 10
+	_, err = s.PersistConfig(cfg, "test")
+	helpers.CheckError(t, err)
+}
+
+// failingPersister fails every attempt to persist a config.
+type failingPersister struct {
+	config.ConfigPersister
+}
+
+func (f *failingPersister) PersistAndNotify(_ string, _ *pb.ServiceConfig) error {
+	return errors.New("persist failed")
+}
+
+func TestAuditLog(t *testing.T) {
+	s := New(&MockBucketFactory{}, config.NewMemoryConfig(config.NewDefaultServiceConfig()), NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	sink := audit.NewMemorySink(0)
+	s.SetAuditSink(sink)
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	changes, unsubscribe := s.SubscribeConfigChanges(1)
+	defer unsubscribe()
+
+	helpers.CheckError(t, s.AddNamespace(config.NewDefaultNamespaceConfig("foo"), "alice"))
+	<-changes
+	helpers.CheckError(t, s.AddBucket("foo", config.NewDefaultBucketConfig("bar"), "bob"))
+
+	entries, total, err := s.AuditEntries(0, 10)
+	helpers.CheckError(t, err)
+
+	if total != 2 || len(entries) != 2 {
+		t.Fatalf("Expected an entry per persist, got %v: %+v", total, entries)
+	}
+
+	// Newest first
+	e := entries[0]
+	if e.Principal != "bob" || e.OldVersion+1 != e.NewVersion || e.Error != "" {
+		t.Errorf("Unexpected entry %+v", e)
+	}
+
+	if !strings.Contains(e.Summary, "modified [foo]") {
+		t.Errorf("Expected a diff summary, got %+v", e)
+	}
+
+	if entries[1].Principal != "alice" || entries[1].NewVersion != e.OldVersion ||
+		!strings.Contains(entries[1].Summary, "added [foo]") {
+		t.Errorf("Unexpected entry %+v", entries[1])
+	}
+}
+
+func TestAuditLogPersistFailure(t *testing.T) {
+	p := &failingPersister{config.NewMemoryConfig(config.NewDefaultServiceConfig())}
+	s := New(&MockBucketFactory{}, p, NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	if err := s.AddNamespace(config.NewDefaultNamespaceConfig("foo"), "alice"); err == nil {
+		t.Fatal("Expected persisting to fail")
+	}
+
+	entries, _, err := s.AuditEntries(0, 10)
+	helpers.CheckError(t, err)
+
+	if len(entries) != 1 || entries[0].Error != "persist failed" {
+		t.Fatalf("Expected the failed persist to be recorded, got %+v", entries)
+	}
+}
+
+func TestAuditDetectedConfigs(t *testing.T) {
+	p := config.NewMemoryConfig(config.NewDefaultServiceConfig())
+	s := New(&MockBucketFactory{}, p, NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	changes, unsubscribe := s.SubscribeConfigChanges(3)
+	defer unsubscribe()
+
+	current := s.Configs().Version
+	cfg := s.Configs()
+
+	// Written to the store by a tool, rather than through the server.
+	write := func(namespace string) {
+		cfg = config.CloneConfig(cfg)
+		if cfg.Namespaces == nil {
+			cfg.Namespaces = make(map[string]*pb.NamespaceConfig)
+		}
+
+		helpers.CheckError(t, config.AddNamespace(cfg, config.NewDefaultNamespaceConfig(namespace)))
+		cfg.Version, cfg.User = cfg.Version+1, "cli"
+		helpers.CheckError(t, p.PersistAndNotify("", cfg))
+	}
+
+	write("foo")
+	<-changes
+
+	// Versions coalesced into a single read are each recorded too.
+	write("bar")
+	write("baz")
+	for change := <-changes; change.Version != current+3; change = <-changes {
+	}
+
+	// An admin change is recorded once, as persisted.
+	helpers.CheckError(t, s.AddNamespace(config.NewDefaultNamespaceConfig("qux"), "alice"))
+	<-changes
+
+	entries, total, err := s.AuditEntries(0, 10)
+	helpers.CheckError(t, err)
+
+	if total != 4 {
+		t.Fatalf("Expected an entry per version, got %+v", entries)
+	}
+
+	for i, namespace := range []string{"baz", "bar", "foo"} {
+		e := entries[i+1]
+		if e.Principal != "cli" || e.Note != audit.DetectedNote || e.NewVersion != current+3-int32(i) ||
+			e.OldVersion != e.NewVersion-1 || !strings.Contains(e.Summary, "added ["+namespace+"]") {
+			t.Errorf("Expected version %v to be recorded as detected, got %+v", current+3-int32(i), e)
+		}
+	}
+
+	if entries[0].Principal != "alice" || entries[0].Note == audit.DetectedNote {
+		t.Errorf("Expected the admin change to be recorded as persisted, got %+v", entries[0])
+	}
+}
+
+func TestPersisterHealth(t *testing.T) {
+	p := &failingPersister{config.NewMemoryConfig(config.NewDefaultServiceConfig())}
+	s := New(&MockBucketFactory{}, p, NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	if h := s.PersisterHealth(); !h.Healthy || h.LastSuccessAt == 0 || h.LastError != "" {
+		t.Fatalf("Expected the persister to be healthy after reading the config, got %+v", h)
+	}
+
+	if err := s.AddNamespace(config.NewDefaultNamespaceConfig("foo"), "alice"); err == nil {
+		t.Fatal("Expected persisting to fail")
+	}
+
+	if h := s.PersisterHealth(); h.Healthy || h.LastError != "persist failed" || h.LastErrorAt == 0 {
+		t.Errorf("Expected the persister to be unhealthy after failing to persist, got %+v", h)
+	}
+}
+
+// pollingPersister reports a poll time set by tests.
+type pollingPersister struct {
+	config.ConfigPersister
+	polled time.Time
+	sync.Mutex
+}
+
+func (p *pollingPersister) LastPolled() time.Time {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.polled
+}
+
+func (p *pollingPersister) poll(at time.Time) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.polled = at
+}
+
+// erroringPersister reports a last error set by tests.
+type erroringPersister struct {
+	config.ConfigPersister
+	err   error
+	errAt time.Time
+	sync.Mutex
+}
+
+func (p *erroringPersister) LastError() (error, time.Time) {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.err, p.errAt
+}
+
+func (p *erroringPersister) fail(err error, at time.Time) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.err, p.errAt = err, at
+}
+
+// outOfBandPersister simulates a store edited directly: configs written to it are only seen by the
+// persister once it polls.
+type outOfBandPersister struct {
+	config.ConfigPersister
+	store *pb.ServiceConfig
+	sync.Mutex
+}
+
+func (p *outOfBandPersister) edit(cfg *pb.ServiceConfig) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.store = cfg
+}
+
+func (p *outOfBandPersister) ForcePoll() (bool, error) {
+	p.Lock()
+	cfg := p.store
+	p.store = nil
+	p.Unlock()
+
+	if cfg == nil {
+		return false, nil
+	}
+
+	return true, p.ConfigPersister.PersistAndNotify("", cfg)
+}
+
+func TestReloadConfig(t *testing.T) {
+	p := &outOfBandPersister{ConfigPersister: config.NewMemoryConfig(config.NewDefaultServiceConfig())}
+	s := New(&MockBucketFactory{}, p, NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	edited := config.NewDefaultServiceConfig()
+	edited.Version = s.Configs().Version + 1
+	helpers.CheckError(t, config.AddNamespace(edited, config.NewDefaultNamespaceConfig("foo")))
+	p.edit(edited)
+
+	version, err := s.ReloadConfig()
+	helpers.CheckError(t, err)
+
+	if version != edited.Version || s.Configs().Version != edited.Version {
+		t.Fatalf("Expected version %v to be in force after reloading, got %v", edited.Version, version)
+	}
+
+	if _, exists := s.Configs().Namespaces["foo"]; !exists {
+		t.Errorf("Expected the edited config to be applied, got %+v", s.Configs())
+	}
+
+	// Nothing new to find.
+	version, err = s.ReloadConfig()
+	helpers.CheckError(t, err)
+
+	if version != edited.Version {
+		t.Errorf("Expected version %v to stay in force, got %v", edited.Version, version)
+	}
+}
+
+func TestConfigDebounce(t *testing.T) {
+	p := config.NewMemoryConfig(config.NewDefaultServiceConfig())
+	s := New(&MockBucketFactory{}, p, NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	s.SetConfigDebounce(50 * time.Millisecond)
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	changes, unsubscribe := s.SubscribeConfigChanges(10)
+	defer unsubscribe()
+
+	for v := int32(1); v <= 5; v++ {
+		cfg := config.NewDefaultServiceConfig()
+		cfg.Version = v
+		helpers.CheckError(t, p.PersistAndNotify("", cfg))
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	select {
+	case change := <-changes:
+		if change.Version != 5 {
+			t.Errorf("Expected the changes to be coalesced into version 5, got %v", change.Version)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the latest config to be applied")
+	}
+
+	select {
+	case change := <-changes:
+		t.Errorf("Expected a single reconcile, got another to version %v", change.Version)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// forcePolledPersister is a config.ForcePoller counting the polls forced.
+type forcePolledPersister struct {
+	config.ConfigPersister
+	sync.Mutex
+	polls int
+}
+
+func (p *forcePolledPersister) ForcePoll() (bool, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.polls++
+	return false, nil
+}
+
+func (p *forcePolledPersister) forcedPolls() int {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.polls
+}
+
+func TestFastTrackedConfigs(t *testing.T) {
+	cfg := config.NewDefaultServiceConfig()
+	fast := config.NewDefaultNamespaceConfig("fast")
+	fast.FastTrack = true
+	helpers.CheckError(t, config.AddNamespace(cfg, fast))
+	helpers.CheckError(t, config.AddNamespace(cfg, config.NewDefaultNamespaceConfig("slow")))
+
+	p := &forcePolledPersister{ConfigPersister: config.NewMemoryConfig(cfg)}
+	s := New(&MockBucketFactory{}, p, NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	// Long enough that only fast-tracked changes would be applied within the test.
+	s.SetConfigDebounce(time.Hour)
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	changes, unsubscribe := s.SubscribeConfigChanges(10)
+	defer unsubscribe()
+
+	expectChange := func(version int32, msg string) {
+		select {
+		case change := <-changes:
+			if change.Version != version {
+				t.Fatalf("Expected version %v to be applied, got %v", version, change.Version)
+			}
+		case <-time.After(time.Second):
+			t.Fatal(msg)
+		}
+	}
+
+	// Changes persisted by another server.
+	persist := func(version int32, namespace string) {
+		updated := config.CloneConfig(s.Configs())
+		updated.Version = version
+		updated.Namespaces[namespace].MaxDynamicBuckets++
+		helpers.CheckError(t, p.PersistAndNotify("", updated))
+	}
+
+	persist(1, "slow")
+	select {
+	case change := <-changes:
+		t.Fatalf("Expected a change to a namespace that isn't fast-tracked to be debounced, got version %v", change.Version)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	persist(2, "fast")
+	expectChange(2, "Expected a fast-tracked change to be applied without the debounce")
+
+	if n := p.forcedPolls(); n != 0 {
+		t.Errorf("Expected no poll forced for changes persisted elsewhere, got %v", n)
+	}
+
+	fast = config.CloneConfig(s.Configs()).Namespaces["fast"]
+	fast.MaxDynamicBuckets++
+	helpers.CheckError(t, s.UpdateNamespace(fast, "user"))
+	expectChange(3, "Expected a fast-tracked change persisted by the server to be applied at once")
+
+	if n := p.forcedPolls(); n != 1 {
+		t.Errorf("Expected a poll forced for a fast-tracked change, got %v", n)
+	}
+
+	slow := config.CloneConfig(s.Configs()).Namespaces["slow"]
+	slow.MaxDynamicBuckets++
+	helpers.CheckError(t, s.UpdateNamespace(slow, "user"))
+
+	if n := p.forcedPolls(); n != 1 {
+		t.Errorf("Expected no poll forced for a change to a namespace that isn't fast-tracked, got %v", n)
+	}
+}
+
+func TestConfigDebounceChangesKeepArriving(t *testing.T) {
+	p := config.NewMemoryConfig(config.NewDefaultServiceConfig())
+	s := New(&MockBucketFactory{}, p, NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	s.SetConfigDebounce(20 * time.Millisecond)
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	changes, unsubscribe := s.SubscribeConfigChanges(100)
+	defer unsubscribe()
+
+	// Changes arrive more often than the quiet period for longer than the debounce may delay them.
+	deadline := time.Now().Add(maxConfigDebouncePeriods * 20 * time.Millisecond * 2)
+	var v int32
+	for time.Now().Before(deadline) {
+		v++
+		cfg := config.NewDefaultServiceConfig()
+		cfg.Version = v
+		helpers.CheckError(t, p.PersistAndNotify("", cfg))
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	select {
+	case <-changes:
+	default:
+		t.Fatal("Expected a config to be applied while changes kept arriving")
+	}
+
+	timeout := time.After(time.Second)
+	for s.Configs().Version != v {
+		select {
+		case <-changes:
+		case <-timeout:
+			t.Fatalf("Expected the final version %v to be applied, got %v", v, s.Configs().Version)
+		}
+	}
+}
+
+func newStalenessServer(t *testing.T, p config.ConfigPersister, clock *testClock) *server {
+	t.Helper()
+
+	s := New(&MockBucketFactory{}, p, NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	s.now = clock.now
+	s.SetConfigStalenessThreshold(time.Minute)
+
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	return s
+}
+
+func TestConfigHealth(t *testing.T) {
+	clock := &testClock{t: time.Unix(1500000000, 0)}
+	p := &pollingPersister{ConfigPersister: config.NewMemoryConfig(config.NewDefaultServiceConfig())}
+	s := newStalenessServer(t, p, clock)
+	defer stopServer(t, s)
+
+	if h := s.ConfigHealth(); !h.Healthy || h.LastChangeAt != clock.now().Unix() || h.StalenessThresholdSeconds != 60 {
+		t.Fatalf("Expected config to be fresh after reading it, got %+v", h)
+	}
+
+	// The config is stable, but the persister keeps polling.
+	clock.advance(2 * time.Minute)
+	p.poll(clock.now())
+
+	if h := s.ConfigHealth(); !h.Healthy || h.LastPolledAt != clock.now().Unix() {
+		t.Errorf("Expected config to be fresh while the persister polls, got %+v", h)
+	}
+
+	helpers.CheckError(t, s.CheckHealth())
+}
+
+func TestConfigHealthStale(t *testing.T) {
+	clock := &testClock{t: time.Unix(1500000000, 0)}
+	p := &pollingPersister{ConfigPersister: config.NewMemoryConfig(config.NewDefaultServiceConfig())}
+	p.poll(clock.now())
+	s := newStalenessServer(t, p, clock)
+	defer stopServer(t, s)
+
+	// The persister stopped polling.
+	clock.advance(2 * time.Minute)
+
+	if h := s.ConfigHealth(); h.Healthy {
+		t.Errorf("Expected config to be stale, got %+v", h)
+	}
+
+	if err := s.CheckHealth(); err == nil {
+		t.Error("Expected the server to be degraded")
+	}
+
+	// A config change is observed.
+	changes, unsubscribe := s.SubscribeConfigChanges(1)
+	defer unsubscribe()
+	helpers.CheckError(t, s.AddNamespace(config.NewDefaultNamespaceConfig("foo"), "alice"))
+	<-changes
+
+	waitFor(t, "the config change to be observed", func() bool { return s.ConfigHealth().Healthy })
+	helpers.CheckError(t, s.CheckHealth())
+}
+
+func TestConfigHealthWithoutThreshold(t *testing.T) {
+	clock := &testClock{t: time.Unix(1500000000, 0)}
+	s := newScheduledServer(t, config.NewMemoryConfig(config.NewDefaultServiceConfig()), clock)
+	defer stopServer(t, s)
+
+	clock.advance(24 * time.Hour)
+
+	if h := s.ConfigHealth(); !h.Healthy || h.StalenessThresholdSeconds != 0 {
+		t.Errorf("Expected staleness not to be checked, got %+v", h)
+	}
+}
+
+func TestPersisterLastError(t *testing.T) {
+	clock := &testClock{t: time.Unix(1500000000, 0)}
+	p := &erroringPersister{ConfigPersister: config.NewMemoryConfig(config.NewDefaultServiceConfig())}
+	s := newScheduledServer(t, p, clock)
+	defer stopServer(t, s)
+
+	if h := s.PersisterHealth(); !h.Healthy || h.LastError != "" {
+		t.Fatalf("Expected the persister to be healthy, got %+v", h)
+	}
+
+	// A background poll fails.
+	clock.advance(time.Minute)
+	p.fail(errors.New("connection refused"), clock.now())
+
+	if h := s.PersisterHealth(); h.Healthy || h.LastError != "connection refused" || h.LastErrorAt != clock.now().Unix() {
+		t.Errorf("Expected the poll error to be reported, got %+v", h)
+	}
+
+	if err := s.CheckHealth(); err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("Expected the server to be degraded by the poll error, got %v", err)
+	}
+
+	// The next poll succeeds.
+	p.fail(nil, time.Time{})
+
+	if h := s.PersisterHealth(); !h.Healthy {
+		t.Errorf("Expected the persister to be healthy once the error cleared, got %+v", h)
+	}
+
+	helpers.CheckError(t, s.CheckHealth())
+}
+
+// metaPersister records the meta each config version is persisted with.
+type metaPersister struct {
+	config.ConfigPersister
+	metas map[int32]*config.PersistMeta
+	sync.Mutex
+}
+
+func (m *metaPersister) PersistAndNotifyWithMeta(oldHash string, c *pb.ServiceConfig, meta *config.PersistMeta) error {
+	m.Lock()
+	m.metas[c.Version] = meta
+	m.Unlock()
+
+	return m.PersistAndNotify(oldHash, c)
+}
+
+// addNamespaceViaAdmin adds a namespace through the admin API, returning the version persisted.
+func addNamespaceViaAdmin(t *testing.T, s *server, opts *admin.Options, name string, auth func(*http.Request)) int32 {
+	t.Helper()
+
+	changes, unsubscribe := s.SubscribeConfigChanges(1)
+	defer unsubscribe()
+
+	mux := http.NewServeMux()
+	s.ServeAdminConsoleWithOptions(mux, "", false, opts)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/"+name, strings.NewReader(`{"name": "`+name+`"}`))
+	req.Header.Set("Version", fmt.Sprint(s.Configs().Version))
+	if auth != nil {
+		auth(req)
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 adding namespace %v, got %v %v", name, w.Code, w.Body.String())
+	}
+
+	return (<-changes).Version
+}
+
+func TestChangeAttribution(t *testing.T) {
+	p := &metaPersister{
+		ConfigPersister: config.NewMemoryConfig(config.NewDefaultServiceConfig()),
+		metas:           make(map[int32]*config.PersistMeta)}
+	s := New(&MockBucketFactory{}, p, NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	opts := &admin.Options{Authenticator: admin.NewBasicAuthenticator("qs", map[string]string{"alice": "pw"})}
+	version := addNamespaceViaAdmin(t, s, opts, "foo", func(r *http.Request) { r.SetBasicAuth("alice", "pw") })
+
+	p.Lock()
+	meta := p.metas[version]
+	p.Unlock()
+
+	if meta == nil || meta.Author != "alice" {
+		t.Errorf("Expected version %v to be persisted with alice as its author, got %+v", version, meta)
+	}
+
+	if user := s.Configs().User; user != "alice" {
+		t.Errorf("Expected the config to be written by alice, got %v", user)
+	}
+
+	// Without authentication, writes are attributed to a sentinel principal.
+	version = addNamespaceViaAdmin(t, s, nil, "bar", nil)
+
+	p.Lock()
+	meta = p.metas[version]
+	p.Unlock()
+
+	if meta == nil || meta.Author != admin.AnonymousPrincipal {
+		t.Errorf("Expected version %v to be persisted with the anonymous principal, got %+v", version, meta)
+	}
+}
+
+// laggingPersister is a memory persister that doesn't notify the server of changes, as if they were
+// made by another node and not fetched yet.
+type laggingPersister struct {
+	*config.MemoryConfigPersister
+	watcher chan struct{}
+}
+
+func (l *laggingPersister) ConfigChangedWatcher() <-chan struct{} {
+	return l.watcher
+}
+
+func TestConcurrentChangesConflict(t *testing.T) {
+	p := &laggingPersister{config.NewMemoryConfig(config.NewDefaultServiceConfig()).(*config.MemoryConfigPersister), make(chan struct{}, 1)}
+	p.watcher <- struct{}{}
+	s := New(&MockBucketFactory{}, p, NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	loaded := s.Configs().Version
+
+	// Another node persists a change based on the same version first.
+	other := config.CloneConfig(s.Configs())
+	other.Version = loaded + 1
+	other.User = "bob"
+	helpers.CheckError(t, p.PersistIfLatest(int(loaded), other))
+
+	if err := s.AddNamespace(config.NewDefaultNamespaceConfig("foo"), "alice"); err != config.ErrStaleConfig {
+		t.Fatalf("Expected ErrStaleConfig, got %v", err)
+	}
+
+	if cfg, _ := p.ReadPersistedConfig(); cfg.User != "bob" {
+		t.Errorf("Expected the other node's change to be kept, got %+v", cfg)
+	}
+
+	entries, _, err := s.AuditEntries(0, 1)
+	helpers.CheckError(t, err)
+	if len(entries) != 1 || entries[0].Error != config.ErrStaleConfig.Error() {
+		t.Errorf("Expected the conflict to be audited, got %+v", entries)
+	}
+}
+
+func TestUpdateConfigIfLatest(t *testing.T) {
+	s := New(&MockBucketFactory{}, config.NewMemoryConfig(config.NewDefaultServiceConfig()), NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	loaded := s.Configs().Version
+	if err := s.UpdateConfigIfLatest(config.NewDefaultServiceConfig(), loaded+1, "alice"); err != config.ErrStaleConfig {
+		t.Errorf("Expected a change based on another version to be rejected, got %v", err)
+	}
+
+	helpers.CheckError(t, s.UpdateConfigIfLatest(config.NewDefaultServiceConfig(), loaded, "alice"))
+}
+
+func TestChangeAttributionWithoutMeta(t *testing.T) {
+	s := New(&MockBucketFactory{}, config.NewMemoryConfig(config.NewDefaultServiceConfig()), NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	opts := &admin.Options{Authenticator: admin.NewBasicAuthenticator("qs", map[string]string{"alice": "pw"})}
+	version := addNamespaceViaAdmin(t, s, opts, "foo", func(r *http.Request) { r.SetBasicAuth("alice", "pw") })
+
+	entries, _, err := s.AuditEntries(0, 1)
+	helpers.CheckError(t, err)
+
+	if len(entries) != 1 || entries[0].Principal != "alice" || entries[0].NewVersion != version {
+		t.Errorf("Expected version %v to be attributed to alice in the audit log, got %+v", version, entries)
+	}
+
+	// Changes made directly, rather than via the admin API, have no user either.
+	helpers.CheckError(t, s.AddNamespace(config.NewDefaultNamespaceConfig("bar"), ""))
+
+	entries, _, err = s.AuditEntries(0, 1)
+	helpers.CheckError(t, err)
+
+	if len(entries) != 1 || entries[0].Principal != admin.AnonymousPrincipal {
+		t.Errorf("Expected an anonymous change to be attributed to the sentinel principal, got %+v", entries)
+	}
+}
+
+func TestRollbackConfig(t *testing.T) {
+	p := config.NewMemoryConfig(config.NewDefaultServiceConfig())
+	s := New(&MockBucketFactory{}, p, NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	changes, unsubscribe := s.SubscribeConfigChanges(1)
+	defer unsubscribe()
+
+	helpers.CheckError(t, s.AddNamespace(config.NewDefaultNamespaceConfig("foo"), "alice"))
+	<-changes
+	goodCfg := s.Configs()
+
+	helpers.CheckError(t, s.AddNamespace(config.NewDefaultNamespaceConfig("bar"), "alice"))
+	<-changes
+
+	if _, err := s.RollbackConfig(99, "bob"); err != config.ErrUnknownVersion {
+		t.Fatalf("Expected ErrUnknownVersion, got %v", err)
+	}
+
+	version, err := s.RollbackConfig(goodCfg.Version, "bob")
+	helpers.CheckError(t, err)
+	<-changes
+
+	latest, err := p.ReadPersistedConfig()
+	helpers.CheckError(t, err)
+
+	if latest.Version != goodCfg.Version+2 || version != latest.Version || latest.User != "bob" {
+		t.Errorf("Expected version %v to be persisted by bob, got %+v", goodCfg.Version+2, latest)
+	}
+
+	expected := config.CloneConfig(goodCfg)
+	expected.Version, expected.User, expected.Date = latest.Version, latest.User, latest.Date
+	if !reflect.DeepEqual(latest, expected) {
+		t.Errorf("Expected %+v to be restored, got %+v", expected, latest)
+	}
+
+	entries, _, err := s.AuditEntries(0, 1)
+	helpers.CheckError(t, err)
+
+	if len(entries) != 1 || !strings.Contains(entries[0].Note, fmt.Sprintf("version %v", goodCfg.Version)) {
+		t.Errorf("Expected the rollback to be audited, got %+v", entries)
+	}
+}
+
+type testClock struct {
+	t time.Time
+	sync.Mutex
+}
+
+func (c *testClock) now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.t
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func scheduledConfig(version int32, activateAt time.Time, namespaces ...string) *pb.ServiceConfig {
+	cfg := config.NewDefaultServiceConfig()
+	cfg.Version = version
+	cfg.ActivateAt = activateAt.Unix()
+	for _, ns := range namespaces {
+		nsc := config.NewDefaultNamespaceConfig(ns)
+		config.SetDynamicBucketTemplate(nsc, config.NewDefaultBucketConfig(""))
+		_ = config.AddNamespace(cfg, nsc)
+	}
+
+	return cfg
+}
+
+func newScheduledServer(t *testing.T, p config.ConfigPersister, clock *testClock) *server {
+	t.Helper()
+
+	s := New(&MockBucketFactory{}, p, NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	s.now = clock.now
+	s.SetConfigActivationPollInterval(time.Millisecond)
+
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	return s
+}
+
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+
+	start := time.Now()
+	for !done() {
+		if time.Since(start) > time.Second {
+			t.Fatalf("Timeout waiting for %v!", what)
+		}
+
+		time.Sleep(time.Millisecond * 5)
+	}
+}
+
+func TestScheduledActivation(t *testing.T) {
+	clock := &testClock{t: time.Unix(1500000000, 0)}
+	p := config.NewMemoryConfigPersister()
+	helpers.CheckError(t, p.PersistAndNotify("", scheduledConfig(1, time.Time{}, "current")))
+
+	s := newScheduledServer(t, p, clock)
+	defer stopServer(t, s)
+
+	helpers.CheckError(t, p.PersistAndNotify("", scheduledConfig(2, clock.now().Add(time.Hour), "current", "scheduled")))
+	waitFor(t, "the config to be pending", func() bool { return s.PendingConfig() != nil })
+
+	// Polls before the activation time keep the current config in force.
+	time.Sleep(20 * time.Millisecond)
+	if v := s.Configs().Version; v != 1 {
+		t.Fatalf("Expected version 1 to remain in force, got %v", v)
+	}
+
+	if _, _, e := s.Allow(context.Background(), "scheduled", "b", 1, 0, false); e == nil {
+		t.Fatal("Expected the scheduled namespace not to exist yet")
+	}
+
+	clock.advance(time.Hour)
+	waitFor(t, "the config to activate", func() bool { return s.Configs().Version == 2 })
+
+	if pending := s.PendingConfig(); pending != nil {
+		t.Errorf("Expected no pending config once activated, got version %v", pending.Version)
+	}
+
+	if _, _, e := s.Allow(context.Background(), "scheduled", "b", 1, 0, false); e != nil {
+		t.Errorf("Expected the scheduled namespace to serve tokens, got %v", e)
+	}
+}
+
+func TestScheduledActivationSuperseded(t *testing.T) {
+	clock := &testClock{t: time.Unix(1500000000, 0)}
+	p := config.NewMemoryConfigPersister()
+	helpers.CheckError(t, p.PersistAndNotify("", scheduledConfig(1, time.Time{}, "current")))
+
+	s := newScheduledServer(t, p, clock)
+	defer stopServer(t, s)
+
+	helpers.CheckError(t, p.PersistAndNotify("", scheduledConfig(2, clock.now().Add(time.Hour), "scheduled")))
+	waitFor(t, "the config to be pending", func() bool { return s.PendingConfig() != nil })
+
+	// Rollbacks made in the meantime follow the pending version, superseding it.
+	v, err := s.RollbackConfig(1, "alice")
+	helpers.CheckError(t, err)
+
+	if v != 3 {
+		t.Fatalf("Expected version 3, got %v", v)
+	}
+
+	waitFor(t, "the new config", func() bool { return s.Configs().Version == 3 })
+
+	if s.PendingConfig() != nil {
+		t.Error("Expected the pending config to be superseded")
+	}
+
+	if _, exists := s.Configs().Namespaces["scheduled"]; exists {
+		t.Error("Expected the superseded namespace not to be applied")
+	}
+}
+
+func TestAdminEditWhileActivationPending(t *testing.T) {
+	clock := &testClock{t: time.Unix(1500000000, 0)}
+	p := config.NewMemoryConfigPersister()
+	helpers.CheckError(t, p.PersistAndNotify("", scheduledConfig(1, time.Time{}, "current")))
+
+	s := newScheduledServer(t, p, clock)
+	defer stopServer(t, s)
+
+	activateAt := clock.now().Add(time.Hour)
+	helpers.CheckError(t, p.PersistAndNotify("", scheduledConfig(2, activateAt, "current", "scheduled")))
+	waitFor(t, "the config to be pending", func() bool { return s.PendingConfig() != nil })
+
+	// Edits based on the active config would drop the scheduled changes.
+	err := s.AddNamespace(config.NewDefaultNamespaceConfig("urgent"), "alice")
+	if err != config.ErrActivationPending {
+		t.Fatalf("Expected ErrActivationPending, got %v", err)
+	}
+
+	if _, err = s.persistConfig("alice", "", 1, func(c *pb.ServiceConfig) error {
+		return config.AddNamespace(c, config.NewDefaultNamespaceConfig("urgent"))
+	}); err != config.ErrActivationPending {
+		t.Fatalf("Expected ErrActivationPending, got %v", err)
+	}
+
+	if pending := s.PendingConfig(); pending == nil || pending.Version != 2 {
+		t.Fatalf("Expected version 2 to remain pending, got %+v", pending)
+	}
+
+	// Edits based on the pending config are made to it, and activate with it.
+	v, err := s.persistConfig("alice", "", 2, func(c *pb.ServiceConfig) error {
+		return config.AddNamespace(c, config.NewDefaultNamespaceConfig("urgent"))
+	})
+	helpers.CheckError(t, err)
+
+	if v != 3 {
+		t.Fatalf("Expected version 3, got %v", v)
+	}
+
+	waitFor(t, "the edit to be pending", func() bool {
+		pending := s.PendingConfig()
+		return pending != nil && pending.Version == 3
+	})
+
+	pending := s.PendingConfig()
+	if pending.ActivateAt != activateAt.Unix() {
+		t.Errorf("Expected the edit to activate at %v, got %v", activateAt.Unix(), pending.ActivateAt)
+	}
+
+	if v := s.Configs().Version; v != 1 {
+		t.Fatalf("Expected version 1 to remain in force, got %v", v)
+	}
+
+	clock.advance(time.Hour)
+	waitFor(t, "the config to activate", func() bool { return s.Configs().Version == 3 })
+
+	for _, namespace := range []string{"current", "scheduled", "urgent"} {
+		if _, exists := s.Configs().Namespaces[namespace]; !exists {
+			t.Errorf("Expected namespace %v to be activated", namespace)
+		}
+	}
+}
+
+func TestScheduledActivationOnStartup(t *testing.T) {
+	clock := &testClock{t: time.Unix(1500000000, 0)}
+	p := config.NewMemoryConfigPersister()
+	helpers.CheckError(t, p.PersistAndNotify("", scheduledConfig(1, clock.now().Add(-time.Hour), "current")))
+	helpers.CheckError(t, p.PersistAndNotify("", scheduledConfig(2, clock.now().Add(time.Hour), "scheduled")))
+
+	// Starting before the activation time starts with the latest config already active.
+	s := newScheduledServer(t, p, clock)
+	defer stopServer(t, s)
+
+	if v := s.Configs().Version; v != 1 {
+		t.Fatalf("Expected to start with version 1, got %v", v)
+	}
+
+	if pending := s.PendingConfig(); pending == nil || pending.Version != 2 {
+		t.Fatalf("Expected version 2 to be pending, got %+v", pending)
+	}
+
+	clock.advance(time.Hour)
+	waitFor(t, "the config to activate", func() bool { return s.Configs().Version == 2 })
+}
+
+// newScheduledServerWithEvents is like newScheduledServer, also returning the events of the given
+// types emitted.
+func newScheduledServerWithEvents(t *testing.T, p config.ConfigPersister, clock *testClock, types ...events.EventType) (*server, chan events.Event) {
+	t.Helper()
+
+	s := New(&MockBucketFactory{}, p, NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	s.now = clock.now
+	s.SetConfigActivationPollInterval(time.Millisecond)
+
+	eventsCh := make(chan events.Event, 100)
+	s.AddListener(func(evt events.Event) {
+		eventsCh <- evt
+	}, 100, types...)
+
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	return s, eventsCh
+}
+
+// expectSingleEvent waits for an event, then checks no other follows over several polls.
+func expectSingleEvent(t *testing.T, eventsCh chan events.Event) events.Event {
+	t.Helper()
+
+	var evt events.Event
+	select {
+	case evt = <-eventsCh:
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for an event!")
+	}
+
+	select {
+	case extra := <-eventsCh:
+		t.Fatalf("Expected a single event, also got %v", extra)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	return evt
+}
+
+func TestConfigActivatedEvent(t *testing.T) {
+	clock := &testClock{t: time.Unix(1500000000, 0)}
+	p := config.NewMemoryConfigPersister()
+	helpers.CheckError(t, p.PersistAndNotify("", scheduledConfig(1, time.Time{}, "current")))
+
+	s, eventsCh := newScheduledServerWithEvents(t, p, clock, events.EVENT_CONFIG_ACTIVATED)
+	defer stopServer(t, s)
+
+	helpers.CheckError(t, p.PersistAndNotify("", scheduledConfig(2, clock.now().Add(time.Hour), "current", "scheduled")))
+	waitFor(t, "the config to be pending", func() bool { return s.PendingConfig() != nil })
+
+	// Polls before the activation time report nothing.
+	select {
+	case evt := <-eventsCh:
+		t.Fatalf("Expected no event before the activation time, got %v", evt)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	clock.advance(time.Hour)
+	evt := expectSingleEvent(t, eventsCh)
+
+	if ce, ok := evt.(events.ConfigEvent); !ok || ce.Version() != 2 {
+		t.Errorf("Expected version 2 to be reported activated, got %v", evt)
+	}
+}
+
+func TestConfigActivatedEventNotSentWhenSuperseded(t *testing.T) {
+	clock := &testClock{t: time.Unix(1500000000, 0)}
+	p := config.NewMemoryConfigPersister()
+	helpers.CheckError(t, p.PersistAndNotify("", scheduledConfig(1, time.Time{}, "current")))
+
+	s, eventsCh := newScheduledServerWithEvents(t, p, clock, events.EVENT_CONFIG_ACTIVATED)
+	defer stopServer(t, s)
+
+	helpers.CheckError(t, p.PersistAndNotify("", scheduledConfig(2, clock.now().Add(time.Hour), "scheduled")))
+	waitFor(t, "the config to be pending", func() bool { return s.PendingConfig() != nil })
+
+	helpers.CheckError(t, p.PersistAndNotify("", scheduledConfig(3, time.Time{}, "urgent")))
+	waitFor(t, "the new config", func() bool { return s.Configs().Version == 3 })
+
+	clock.advance(time.Hour)
+	select {
+	case evt := <-eventsCh:
+		t.Fatalf("Expected no event for a superseded config, got %v", evt)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestRampCompletedEvent(t *testing.T) {
+	clock := &testClock{t: time.Unix(1500000000, 0)}
+	cfg := scheduledConfig(1, time.Time{})
+	nsc := config.NewDefaultNamespaceConfig("ns")
+	ramped := config.NewDefaultBucketConfig("ramped")
+	ramped.RampStartFillRate = 10
+	ramped.RampStartMillis = clock.now().Add(time.Minute).UnixNano() / int64(time.Millisecond)
+	ramped.RampDurationMillis = time.Minute.Nanoseconds() / int64(time.Millisecond)
+	helpers.CheckError(t, config.AddBucket(nsc, ramped))
+	helpers.CheckError(t, config.AddNamespace(cfg, nsc))
+
+	p := config.NewMemoryConfigPersister()
+	helpers.CheckError(t, p.PersistAndNotify("", cfg))
+
+	s, eventsCh := newScheduledServerWithEvents(t, p, clock, events.EVENT_RAMP_COMPLETED)
+	defer stopServer(t, s)
+
+	// Polls during the ramp report nothing.
+	clock.advance(90 * time.Second)
+	select {
+	case evt := <-eventsCh:
+		t.Fatalf("Expected no event during the ramp, got %v", evt)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	clock.advance(time.Minute)
+	evt := expectSingleEvent(t, eventsCh)
+
+	if evt.Namespace() != "ns" || evt.BucketName() != "ramped" || evt.Dynamic() {
+		t.Errorf("Expected bucket ns:ramped to be reported, got %v", evt)
+	}
+
+	// Reloading a config with the finished ramp doesn't report it again.
+	reloaded := config.CloneConfig(cfg)
+	reloaded.Version = 2
+	helpers.CheckError(t, p.PersistAndNotify("", reloaded))
+	waitFor(t, "the new config", func() bool { return s.Configs().Version == 2 })
+
+	clock.advance(time.Minute)
+	select {
+	case evt := <-eventsCh:
+		t.Fatalf("Expected the ramp to be reported once, also got %v", evt)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
 func TestTooManyTokensRequested(t *testing.T) {
 	cfg := config.NewDefaultServiceConfig()
 	nsc := config.NewDefaultNamespaceConfig("dummy")
-	bc := config.NewDefaultBucketConfig("dummy")
-	bc.MaxTokensPerRequest = 5
-	helpers.CheckError(t, config.AddBucket(nsc, bc))
+	bc := config.NewDefaultBucketConfig("dummy")
+	bc.MaxTokensPerRequest = 5
+	helpers.CheckError(t, config.AddBucket(nsc, bc))
+	helpers.CheckError(t, config.AddNamespace(cfg, nsc))
+
+	s := New(&MockBucketFactory{}, config.NewMemoryConfig(cfg), NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	w, _, e := s.Allow(context.Background(), "dummy", "dummy", 1, 0, false)
+	if e != nil {
+		t.Fatal("Wasn't expecting an error to s.Allow()", e)
+	}
+
+	if w > 0 {
+		t.Fatalf("Wait time should be 0, not %v", w)
+	}
+
+	w, _, e = s.Allow(context.Background(), "dummy", "dummy", 10, 0, false)
+	if e == nil {
+		t.Fatal("Expecting an error to s.Allow()", e)
+	}
+
+	if e.(QuotaServiceError).Reason != ER_TOO_MANY_TOKENS_REQUESTED {
+		t.Fatalf("Expected Reason to be %v but was %v", ER_TOO_MANY_TOKENS_REQUESTED, e.(QuotaServiceError).Reason)
+	}
+
+	if e.(QuotaServiceError).MaxTokens != 5 {
+		t.Errorf("Expected MaxTokens to be 5 but was %v", e.(QuotaServiceError).MaxTokens)
+	}
+}
+
+// cappedBucket is a MockBucket serving at most maxTokens at once.
+type cappedBucket struct {
+	MockBucket
+	maxTokens int64
+}
+
+func (b *cappedBucket) Take(ctx context.Context, numTokens int64, maxWaitTime time.Duration) (time.Duration, bool, error) {
+	if numTokens > b.maxTokens {
+		return 0, false, &TooManyTokensError{MaxTokens: b.maxTokens}
+	}
+
+	return b.MockBucket.Take(ctx, numTokens, maxWaitTime)
+}
+
+type cappedBucketFactory struct {
+	MockBucketFactory
+}
+
+func (bf *cappedBucketFactory) NewBucket(namespace, bucketName string, cfg *pb.BucketConfig, dyn bool) Bucket {
+	return &cappedBucket{MockBucket: MockBucket{namespace: namespace, bucketName: bucketName, dyn: dyn, cfg: cfg}, maxTokens: 3}
+}
+
+func TestTooManyTokensForBucket(t *testing.T) {
+	cfg := config.NewDefaultServiceConfig()
+	nsc := config.NewDefaultNamespaceConfig("dummy")
+	bc := config.NewDefaultBucketConfig("dummy")
+	bc.MaxTokensPerRequest = 10
+	helpers.CheckError(t, config.AddBucket(nsc, bc))
+	helpers.CheckError(t, config.AddNamespace(cfg, nsc))
+
+	s := New(&cappedBucketFactory{}, config.NewMemoryConfig(cfg), NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	tooMany := make(chan events.Event, 1)
+	s.AddListener(func(evt events.Event) {
+		tooMany <- evt
+	}, 10, events.EVENT_TOO_MANY_TOKENS_REQUESTED)
+
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	// Within the max tokens per request, but more than the bucket serves at once.
+	_, _, e := s.Allow(context.Background(), "dummy", "dummy", 5, 0, false)
+	if qsErr, ok := e.(QuotaServiceError); !ok || qsErr.Reason != ER_TOO_MANY_TOKENS_REQUESTED || qsErr.MaxTokens != 3 {
+		t.Fatalf("Expected too many tokens requested with a max of 3, got %v", e)
+	}
+
+	select {
+	case evt := <-tooMany:
+		if evt.NumTokens() != 5 {
+			t.Errorf("Expected an event for 5 tokens, got %v", evt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a too many tokens requested event")
+	}
+}
+
+// blockingBucket is a MockBucket whose takes block until released, counting the takes blocked.
+type blockingBucket struct {
+	MockBucket
+	release chan struct{}
+	blocked *int32
+}
+
+func (b *blockingBucket) Take(ctx context.Context, numTokens int64, maxWaitTime time.Duration) (time.Duration, bool, error) {
+	atomic.AddInt32(b.blocked, 1)
+	<-b.release
+	return b.MockBucket.Take(ctx, numTokens, maxWaitTime)
+}
+
+type blockingBucketFactory struct {
+	MockBucketFactory
+	release chan struct{}
+	blocked int32
+}
+
+func (bf *blockingBucketFactory) NewBucket(namespace, bucketName string, cfg *pb.BucketConfig, dyn bool) Bucket {
+	return &blockingBucket{MockBucket: MockBucket{namespace: namespace, bucketName: bucketName, dyn: dyn, cfg: cfg}, release: bf.release, blocked: &bf.blocked}
+}
+
+func TestMaxWaitersInFlight(t *testing.T) {
+	cfg := config.NewDefaultServiceConfig()
+	nsc := config.NewDefaultNamespaceConfig("dummy")
+	bc := config.NewDefaultBucketConfig("dummy")
+	bc.MaxWaiters = 1
+	helpers.CheckError(t, config.AddBucket(nsc, bc))
+	helpers.CheckError(t, config.AddNamespace(cfg, nsc))
+
+	bf := &blockingBucketFactory{release: make(chan struct{})}
+	s := New(bf, config.NewMemoryConfig(cfg), NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	// Requests in flight aren't waiting, so those served tokens available immediately aren't
+	// rejected however many are in flight at once, e.g. on round trips to Redis.
+	results := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			_, _, err := s.Allow(context.Background(), "dummy", "dummy", 1, 0, false)
+			results <- err
+		}()
+	}
+
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&bf.blocked) < 3; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 3 requests in flight, got %v", atomic.LoadInt32(&bf.blocked))
+		}
+	}
+
+	close(bf.release)
+	for i := 0; i < 3; i++ {
+		helpers.CheckError(t, <-results)
+	}
+
+	var waiters int64
+	s.BucketWaiters(func(namespace, bucket string, dynamic bool, n int64) {
+		if namespace == "dummy" && bucket == "dummy" {
+			waiters = n
+		}
+	})
+
+	if waiters != 0 {
+		t.Errorf("Expected requests served without waiting not to be counted as waiters, got %v", waiters)
+	}
+}
+
+// tokenCappedBucket is a MockBucket serving at most the token cap of its config over its lifetime.
+type tokenCappedBucket struct {
+	MockBucket
+}
+
+func (b *tokenCappedBucket) Take(ctx context.Context, numTokens int64, maxWaitTime time.Duration) (time.Duration, bool, error) {
+	if err := b.checkCap(numTokens); err != nil {
+		return 0, false, err
+	}
+
+	return b.MockBucket.Take(ctx, numTokens, maxWaitTime)
+}
+
+func (b *tokenCappedBucket) Probe(ctx context.Context, numTokens int64, maxWaitTime time.Duration) (time.Duration, bool, error) {
+	if err := b.checkCap(numTokens); err != nil {
+		return 0, false, err
+	}
+
+	return b.MockBucket.Probe(ctx, numTokens, maxWaitTime)
+}
+
+func (b *tokenCappedBucket) checkCap(numTokens int64) error {
+	b.RLock()
+	defer b.RUnlock()
+
+	if b.Taken+numTokens > b.cfg.TokenCap {
+		return &CapReachedError{TokenCap: b.cfg.TokenCap}
+	}
+
+	return nil
+}
+
+// tokenCappedBucketFactory creates tokenCappedBuckets for configs with a token cap, and
+// MockBuckets for the rest.
+type tokenCappedBucketFactory struct {
+	MockBucketFactory
+}
+
+func (bf *tokenCappedBucketFactory) NewBucket(namespace, bucketName string, cfg *pb.BucketConfig, dyn bool) Bucket {
+	if cfg.TokenCap == 0 {
+		return bf.MockBucketFactory.NewBucket(namespace, bucketName, cfg, dyn)
+	}
+
+	return &tokenCappedBucket{MockBucket: MockBucket{namespace: namespace, bucketName: bucketName, dyn: dyn, cfg: cfg}}
+}
+
+func TestTokenCapReached(t *testing.T) {
+	cfg := config.NewDefaultServiceConfig()
+	nsc := config.NewDefaultNamespaceConfig("dummy")
+	capped := config.NewDefaultBucketConfig("capped")
+	capped.TokenCap = 5
+	helpers.CheckError(t, config.AddBucket(nsc, capped))
+	nsc.NamespaceLimit = config.NewDefaultBucketConfig("")
+	helpers.CheckError(t, config.AddNamespace(cfg, nsc))
+
+	bf := &tokenCappedBucketFactory{}
+	s := New(bf, config.NewMemoryConfig(cfg), NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	capReached := make(chan events.Event, 1)
+	s.AddListener(func(evt events.Event) {
+		capReached <- evt
+	}, 1, events.EVENT_CAP_REACHED)
+
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	if _, _, e := s.Allow(context.Background(), "dummy", "capped", 5, 0, false); e != nil {
+		t.Fatalf("Expected the tokens within the cap to be granted, got %v", e)
+	}
+
+	_, _, e := s.Allow(context.Background(), "dummy", "capped", 1, 0, false)
+	if qsErr, ok := e.(QuotaServiceError); !ok || qsErr.Reason != ER_CAP_REACHED {
+		t.Fatalf("Expected the cap to be reached, got %v", e)
+	}
+
+	select {
+	case evt := <-capReached:
+		if evt.BucketName() != "capped" || evt.NumTokens() != 1 {
+			t.Errorf("Expected a cap reached event for 1 token from capped, got %v", evt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a cap reached event")
+	}
+
+	// The namespace limit gets back the tokens of the rejected request.
+	if returned := bf.bucket("dummy", config.NamespaceLimitBucketName).Returned; returned != 1 {
+		t.Errorf("Expected 1 token returned to the namespace limit, got %v", returned)
+	}
+
+	if _, _, e := s.Probe(context.Background(), "dummy", "capped", 1); e == nil || e.(QuotaServiceError).Reason != ER_CAP_REACHED {
+		t.Errorf("Expected probing past the cap to report it reached, got %v", e)
+	}
+}
+
+func TestRegisterListener(t *testing.T) {
+	cfg := config.NewDefaultServiceConfig()
+	nsc := config.NewDefaultNamespaceConfig("dummy")
+	helpers.CheckError(t, config.AddBucket(nsc, config.NewDefaultBucketConfig("dummy")))
+	helpers.CheckError(t, config.AddNamespace(cfg, nsc))
+
+	s := New(&MockBucketFactory{}, config.NewMemoryConfig(cfg), NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	served := make(chan events.Event, 1)
+	helpers.CheckError(t, s.RegisterListener("served", func(evt events.Event) {
+		served <- evt
+	}, 10, events.EVENT_TOKENS_SERVED))
+
+	if err := s.RegisterListener("served", func(events.Event) {}, 10); err == nil {
+		t.Error("Expected registering a name twice to fail")
+	}
+
+	_, _, err = s.Allow(context.Background(), "dummy", "dummy", 1, 0, false)
+	helpers.CheckError(t, err)
+
+	select {
+	case evt := <-served:
+		if evt.NumTokens() != 1 {
+			t.Errorf("Expected an event for 1 token, got %v", evt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a listener registered after starting to be notified")
+	}
+
+	// Register and unregister listeners while requests emit events.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					_, _, _ = s.Allow(context.Background(), "dummy", "dummy", 1, 0, false)
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("l%v", i%3)
+		s.UnregisterListener(name)
+		helpers.CheckError(t, s.RegisterListener(name, func(events.Event) {}, 1))
+	}
+
+	close(stop)
+	wg.Wait()
+
+	// Fill the served listener's buffer, since events notifying it block.
+	for i := 0; i < 15; i++ {
+		_, _, err = s.Allow(context.Background(), "dummy", "dummy", 1, 0, false)
+		helpers.CheckError(t, err)
+	}
+
+	listeners := s.Listeners()
+	if len(listeners) != 4 || listeners[0].Name != "l0" || listeners[3].Name != "served" {
+		t.Fatalf("Expected 4 listeners ordered by name, got %+v", listeners)
+	}
+
+	if listeners[3].Types != events.NewEventTypeSet(events.EVENT_TOKENS_SERVED) || listeners[3].Dropped == 0 {
+		t.Errorf("Expected the served listener to have dropped events once its buffer filled, got %+v", listeners[3])
+	}
+
+	if !s.UnregisterListener("served") || s.UnregisterListener("served") {
+		t.Error("Expected a listener to be unregistered once")
+	}
+}
+
+func TestProbe(t *testing.T) {
+	cfg := config.NewDefaultServiceConfig()
+	nsc := config.NewDefaultNamespaceConfig("dummy")
+	bc := config.NewDefaultBucketConfig("dummy")
+	bc.MaxTokensPerRequest = 10
+	helpers.CheckError(t, config.AddBucket(nsc, bc))
+	config.SetDynamicBucketTemplate(nsc, config.NewDefaultBucketConfig(""))
+	helpers.CheckError(t, config.AddNamespace(cfg, nsc))
+
+	bf := &MockBucketFactory{}
+	s := New(bf, config.NewMemoryConfig(cfg), NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	served := make(chan events.Event, 10)
+	s.AddListener(func(evt events.Event) {
+		served <- evt
+	}, 10, events.EVENT_TOKENS_SERVED)
+
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	ctx := context.Background()
+	for _, wait := range []time.Duration{0, 500 * time.Millisecond, 2 * time.Second} {
+		bf.SetWaitTime("dummy", "dummy", wait)
+
+		granted, estimated, err := s.Probe(ctx, "dummy", "dummy", 1)
+		helpers.CheckError(t, err)
+		if estimated != wait {
+			t.Errorf("Expected a probe to estimate a wait of %v, got %v", wait, estimated)
+		}
+
+		// The bucket waits at most its configured 1s.
+		w, _, err := s.Allow(ctx, "dummy", "dummy", 1, 0, false)
+		if granted != (err == nil) || (granted && w != estimated) {
+			t.Errorf("Expected a probe predicting %v after %v to match taking tokens, got %v after %v", granted, estimated, err, w)
+		}
+	}
+
+	// Dynamic buckets aren't created by probes.
+	if granted, estimated, err := s.Probe(ctx, "dummy", "new", 1); err != nil || !granted || estimated != 0 {
+		t.Errorf("Expected a new dynamic bucket to grant tokens without waiting, got %v, %v, %v", granted, estimated, err)
+	}
+
+	if inspection, _ := s.InspectBucket("dummy", "new"); inspection != nil {
+		t.Error("Expected probing not to create a dynamic bucket")
+	}
+
+	if _, _, err := s.Probe(ctx, "dummy", "dummy", 11); err == nil || err.(QuotaServiceError).Reason != ER_TOO_MANY_TOKENS_REQUESTED {
+		t.Errorf("Expected too many tokens requested, got %v", err)
+	}
+
+	if _, _, err := s.Probe(ctx, "nope", "nope", 1); err == nil || err.(QuotaServiceError).Reason != ER_UNKNOWN_NAMESPACE {
+		t.Errorf("Expected an unknown namespace, got %v", err)
+	}
+
+	// Only the tokens taken are served; events are delivered in order, so all have been by the
+	// time the sentinel's is.
+	_, _, err = s.Allow(ctx, "dummy", "sentinel", 1, 0, false)
+	helpers.CheckError(t, err)
+
+	var taken int
+	for evt := range served {
+		if evt.BucketName() == "sentinel" {
+			break
+		}
+
+		taken++
+	}
+
+	if taken != 2 {
+		t.Errorf("Expected probes not to serve tokens, got %v tokens served events", taken)
+	}
+}
+
+func newJitterServer(t *testing.T, maxJitter time.Duration) (*server, *MockBucketFactory) {
+	cfg := config.NewDefaultServiceConfig()
+	nsc := config.NewDefaultNamespaceConfig("dummy")
+	helpers.CheckError(t, config.AddBucket(nsc, config.NewDefaultBucketConfig("dummy")))
+	helpers.CheckError(t, config.AddNamespace(cfg, nsc))
+
+	bf := &MockBucketFactory{}
+	s := New(bf, config.NewMemoryConfig(cfg), NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	if maxJitter > 0 {
+		s.SetWaitJitter(maxJitter)
+	}
+
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+
+	return s, bf
+}
+
+func TestWaitJitter(t *testing.T) {
+	s, bf := newJitterServer(t, 50*time.Millisecond)
+	defer stopServer(t, s)
+
+	trueWait := 100 * time.Millisecond
+	bf.SetWaitTime("dummy", "dummy", trueWait)
+
+	waits := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		w, _, err := s.Allow(context.Background(), "dummy", "dummy", 1, 0, false)
+		helpers.CheckError(t, err)
+
+		if w < trueWait || w > trueWait+50*time.Millisecond {
+			t.Fatalf("Expected a wait within [%v, %v], got %v", trueWait, trueWait+50*time.Millisecond, w)
+		}
+
+		waits[w] = true
+	}
+
+	if len(waits) < 2 {
+		t.Errorf("Expected waits to be spread, got %v", waits)
+	}
+
+	// Requests that don't have to wait still don't.
+	bf.SetWaitTime("dummy", "dummy", 0)
+	if w, _, err := s.Allow(context.Background(), "dummy", "dummy", 1, 0, false); err != nil || w != 0 {
+		t.Errorf("Expected no wait, got %v, %v", w, err)
+	}
+}
+
+func TestWaitJitterDisabled(t *testing.T) {
+	s, bf := newJitterServer(t, 0)
+	defer stopServer(t, s)
+
+	bf.SetWaitTime("dummy", "dummy", 100*time.Millisecond)
+	for i := 0; i < 10; i++ {
+		if w, _, err := s.Allow(context.Background(), "dummy", "dummy", 1, 0, false); err != nil || w != 100*time.Millisecond {
+			t.Fatalf("Expected the true wait without jitter, got %v, %v", w, err)
+		}
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	cfg := config.NewDefaultServiceConfig()
+	nsc := config.NewDefaultNamespaceConfig("dummy")
+	helpers.CheckError(t, config.AddBucket(nsc, config.NewDefaultBucketConfig("dummy")))
+	helpers.CheckError(t, config.AddBucket(nsc, config.NewDefaultBucketConfig("other")))
+	helpers.CheckError(t, config.AddNamespace(cfg, nsc))
+
+	bf := &MockBucketFactory{}
+	s := New(bf, config.NewMemoryConfig(cfg), NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	s.SetDedupeCache(dedupe.NewMemoryCache(time.Minute, 100))
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	bf.SetWaitTime("dummy", "dummy", 100*time.Millisecond)
+	ctx := ContextWithRequestID(context.Background(), "r1")
+	for i := 0; i < 3; i++ {
+		w, _, err := s.Allow(ctx, "dummy", "dummy", 2, 0, false)
+		helpers.CheckError(t, err)
+		if w != 100*time.Millisecond {
+			t.Errorf("Expected the original wait, got %v", w)
+		}
+
+		// Repeats are answered with the original result, even once the bucket's wait changes.
+		bf.SetWaitTime("dummy", "dummy", 0)
+	}
+
+	if taken := bf.bucket("dummy", "dummy").Taken; taken != 2 {
+		t.Errorf("Expected a repeated request ID to be charged once, got %v tokens taken", taken)
+	}
+
+	// Other IDs, requests without an ID and the same ID for another bucket are charged.
+	_, _, err = s.Allow(ContextWithRequestID(context.Background(), "r2"), "dummy", "dummy", 2, 0, false)
+	helpers.CheckError(t, err)
+	_, _, err = s.Allow(context.Background(), "dummy", "dummy", 2, 0, false)
+	helpers.CheckError(t, err)
+	_, _, err = s.Allow(ctx, "dummy", "other", 2, 0, false)
+	helpers.CheckError(t, err)
+
+	if taken := bf.bucket("dummy", "dummy").Taken; taken != 6 {
+		t.Errorf("Expected 6 tokens taken, got %v", taken)
+	}
+
+	if taken := bf.bucket("dummy", "other").Taken; taken != 2 {
+		t.Errorf("Expected 2 tokens taken from the other bucket, got %v", taken)
+	}
+
+	// Rejected requests aren't remembered, so their retries are served.
+	retry := ContextWithRequestID(context.Background(), "r3")
+	bf.SetWaitTime("dummy", "dummy", 2*time.Minute)
+	if _, _, err := s.Allow(retry, "dummy", "dummy", 2, 0, false); err == nil {
+		t.Fatal("Expected a timeout")
+	}
+
+	bf.SetWaitTime("dummy", "dummy", 0)
+	_, _, err = s.Allow(retry, "dummy", "dummy", 2, 0, false)
+	helpers.CheckError(t, err)
+
+	if taken := bf.bucket("dummy", "dummy").Taken; taken != 8 {
+		t.Errorf("Expected the retry of a rejected request to be charged, got %v tokens taken", taken)
+	}
+}
+
+func TestRequestCosts(t *testing.T) {
+	cfg := config.NewDefaultServiceConfig()
+	nsc := config.NewDefaultNamespaceConfig("dummy")
+	bc := config.NewDefaultBucketConfig("dummy")
+	bc.MaxTokensPerRequest = 10
+	helpers.CheckError(t, config.AddBucket(nsc, bc))
+	config.SetRequestCost(nsc, "health", 1)
+	config.SetRequestCost(nsc, "search", 5)
+	helpers.CheckError(t, config.AddNamespace(cfg, nsc))
+
+	s := New(&MockBucketFactory{}, config.NewMemoryConfig(cfg), NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	served := make(chan events.Event, 10)
+	s.AddListener(func(evt events.Event) {
+		served <- evt
+	}, 10, events.EVENT_TOKENS_SERVED)
+
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	allow := func(kind string, tokensRequested int64) error {
+		ctx := context.Background()
+		if kind != "" {
+			ctx = ContextWithRequestKind(ctx, kind)
+		}
+
+		_, _, e := s.Allow(ctx, "dummy", "dummy", tokensRequested, 0, false)
+		return e
+	}
+
+	for _, tc := range []struct {
+		kind            string
+		tokensRequested int64
+		expected        int64
+	}{
+		{"", 3, 3},
+		{"health", 1, 1},
+		{"search", 1, 5},
+		{"search", 2, 10},
+	} {
+		helpers.CheckError(t, allow(tc.kind, tc.tokensRequested))
+		if evt := <-served; evt.NumTokens() != tc.expected {
+			t.Errorf("Expected %v x %v to take %v tokens, took %v", tc.tokensRequested, tc.kind, tc.expected, evt.NumTokens())
+		}
+	}
+
+	// Costs still count against the max tokens per request.
+	if e := allow("search", 3); e == nil || e.(QuotaServiceError).Reason != ER_TOO_MANY_TOKENS_REQUESTED {
+		t.Errorf("Expected 3 searches to be too many tokens, got %v", e)
+	}
+
+	if e := allow("export", 1); e == nil || e.(QuotaServiceError).Reason != ER_UNKNOWN_REQUEST_KIND {
+		t.Errorf("Expected an unknown request kind, got %v", e)
+	}
+
+	// Costs can change without recreating buckets.
+	before, _ := s.bucketContainer.FindBucket("dummy", "dummy")
+	version := s.Configs().Version
+	helpers.CheckError(t, s.updateConfig("alice", func(c *pb.ServiceConfig) error {
+		config.SetRequestCost(c.Namespaces["dummy"], "export", 7)
+		return nil
+	}))
+
+	start := time.Now()
+	for s.Configs().Version == version {
+		if time.Since(start) > time.Second {
+			t.Fatal("Timeout waiting for config to change!")
+		}
+
+		time.Sleep(time.Millisecond * 5)
+	}
+
+	if after, _ := s.bucketContainer.FindBucket("dummy", "dummy"); after != before {
+		t.Error("Expected changing request costs to keep the bucket")
+	}
+
+	helpers.CheckError(t, allow("export", 1))
+	if evt := <-served; evt.NumTokens() != 7 {
+		t.Errorf("Expected an export to take 7 tokens, took %v", evt.NumTokens())
+	}
+}
+
+func TestBucketLabelsInEvents(t *testing.T) {
+	cfg := config.NewDefaultServiceConfig()
+	nsc := config.NewDefaultNamespaceConfig("dummy")
+	bc := config.NewDefaultBucketConfig("dummy")
+	bc.Labels = map[string]string{"team": "search"}
+	helpers.CheckError(t, config.AddBucket(nsc, bc))
+	helpers.CheckError(t, config.AddBucket(nsc, config.NewDefaultBucketConfig("unlabeled")))
+	helpers.CheckError(t, config.AddNamespace(cfg, nsc))
+
+	mbf := &MockBucketFactory{}
+	s := New(mbf, config.NewMemoryConfig(cfg), NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	emitted := make(chan events.Event, 10)
+	s.AddListener(func(evt events.Event) {
+		emitted <- evt
+	}, 10, events.EVENT_TOKENS_SERVED, events.EVENT_TIMEOUT_SERVING_TOKENS)
+
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	if _, _, e := s.Allow(context.Background(), "dummy", "dummy", 1, 0, false); e != nil {
+		t.Fatalf("Not expecting error %+v", e)
+	}
+
+	mbf.SetWaitTime("dummy", "dummy", 2*time.Minute)
+	if _, _, e := s.Allow(context.Background(), "dummy", "dummy", 1, 0, false); e == nil {
+		t.Fatal("Expected a timeout")
+	}
+
+	for _, eventType := range []events.EventType{events.EVENT_TOKENS_SERVED, events.EVENT_TIMEOUT_SERVING_TOKENS} {
+		if evt := <-emitted; evt.EventType() != eventType || events.Labels(evt)["team"] != "search" {
+			t.Errorf("Expected a labeled %v event, got %v", eventType, evt)
+		}
+	}
+
+	if _, _, e := s.Allow(context.Background(), "dummy", "unlabeled", 1, 0, false); e != nil {
+		t.Fatalf("Not expecting error %+v", e)
+	}
+
+	if evt := <-emitted; events.Labels(evt) != nil {
+		t.Errorf("Expected an unlabeled event, got %v", evt)
+	}
+}
+
+func TestCanaryInEvents(t *testing.T) {
+	cfg := config.NewDefaultServiceConfig()
+	nsc := config.NewDefaultNamespaceConfig("dummy")
+	tpl := config.NewDefaultBucketConfig("")
+	tpl.Canary = &pb.BucketConfig{FillRate: 500}
+	tpl.CanaryPercent = 50
+	config.SetDynamicBucketTemplate(nsc, tpl)
+	helpers.CheckError(t, config.AddNamespace(cfg, nsc))
+	// As persisting the config will, so buckets aren't recreated by it.
+	config.ApplyDefaults(cfg)
+
+	mbf := &MockBucketFactory{}
+	s := New(mbf, config.NewMemoryConfig(cfg), NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	served := make(chan events.Event, 100)
+	s.AddListener(func(evt events.Event) {
+		served <- evt
+	}, 100, events.EVENT_TOKENS_SERVED)
+
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	groups := make(map[string]int)
+	canaries := make(map[string]Bucket)
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("client.%v", i)
+		if _, _, e := s.Allow(context.Background(), "dummy", name, 1, 0, false); e != nil {
+			t.Fatalf("Not expecting error %+v", e)
+		}
+
+		evt := <-served
+		group := events.Labels(evt)[config.CanaryLabel]
+		groups[group]++
+
+		expected, fillRate := config.BaselineGroup, tpl.FillRate
+		if config.InCanary("dummy", name, 50) {
+			expected, fillRate = config.CanaryGroup, 500
+			canaries[name], _ = s.bucketContainer.FindBucket("dummy", name)
+		}
+
+		if group != expected {
+			t.Errorf("Expected bucket %v to be in group %v, got %v", name, expected, group)
+		}
+
+		if b, _ := s.bucketContainer.FindBucket("dummy", name); b.Config().FillRate != fillRate {
+			t.Errorf("Expected bucket %v to fill at %v, got %v", name, fillRate, b.Config().FillRate)
+		}
+	}
+
+	if groups[config.CanaryGroup] == 0 || groups[config.BaselineGroup] == 0 {
+		t.Fatalf("Expected buckets in both groups, got %v", groups)
+	}
+
+	// Growing the canary moves the baseline buckets into it, leaving those already in it as they are.
+	version := s.Configs().Version
+	helpers.CheckError(t, s.updateConfig("alice", func(c *pb.ServiceConfig) error {
+		c.Namespaces["dummy"].DynamicBucketTemplate.CanaryPercent = 100
+		return nil
+	}))
+
+	start := time.Now()
+	for s.Configs().Version == version {
+		if time.Since(start) > time.Second {
+			t.Fatal("Timeout waiting for config to change!")
+		}
+
+		time.Sleep(time.Millisecond * 5)
+	}
+
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("client.%v", i)
+		b, _ := s.bucketContainer.FindBucket("dummy", name)
+		if b.Config().Labels[config.CanaryLabel] != config.CanaryGroup || b.Config().FillRate != 500 {
+			t.Errorf("Expected bucket %v to be in the canary, got %v", name, b.Config())
+		}
+
+		if canary, existed := canaries[name]; existed && canary != b {
+			t.Errorf("Expected canary bucket %v to be kept", name)
+		}
+	}
+}
+
+const effectiveCfgYaml = `global_default_bucket:
+  size: 300
+namespaces:
+  static:
+    default_bucket:
+      fill_rate: 800
+    buckets:
+      inherits:
+        size: 10
+      canary:
+        fill_rate: 100
+        labels:
+          team: search
+        canary_percent: 100
+        canary:
+          fill_rate: 200
+  dynamic:
+    dynamic_bucket_template:
+      fill_rate: 999
+      canary_percent: 50
+      canary:
+        wait_timeout_millis: 5
+`
+
+func TestEffectiveConfig(t *testing.T) {
+	cfg := config.ReadConfig(strings.NewReader(effectiveCfgYaml))
+	s := New(&MockBucketFactory{}, config.NewMemoryConfig(cfg), NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	if _, _, e := s.Allow(context.Background(), "dynamic", "client", 1, 0, false); e != nil {
+		t.Fatalf("Not expecting error %+v", e)
+	}
+
+	mux := http.NewServeMux()
+	admin.ServeAdminConsole(s, mux, "", false)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/config/effective", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %v %v", w.Code, w.Body.String())
+	}
+
+	effective, err := config.FromJSON(w.Body.Bytes())
+	helpers.CheckError(t, err)
+
+	// Every bucket is described by the config it was created with.
+	created := []struct {
+		namespace, name string
+		cfg             *pb.BucketConfig
+	}{
+		{config.GlobalNamespace, config.DefaultBucketName, effective.GlobalDefaultBucket},
+		{"static", config.DefaultBucketName, effective.Namespaces["static"].DefaultBucket},
+		{"static", "inherits", effective.Namespaces["static"].Buckets["inherits"]},
+		{"static", "canary", effective.Namespaces["static"].Buckets["canary"]},
+	}
+
+	for _, r := range created {
+		b := s.bucketContainer.inspectableBucket(r.namespace, r.name)
+		if b == nil || !proto.Equal(b.Config(), r.cfg) {
+			t.Errorf("Expected the effective config of %v:%v to be %+v, got %+v", r.namespace, r.name, b, r.cfg)
+		}
+	}
+
+	if inherits := effective.Namespaces["static"].Buckets["inherits"]; inherits.Size != 10 || inherits.FillRate != 50 ||
+		inherits.WaitTimeoutMillis != 1000 || inherits.MaxTokensPerRequest != 50 {
+		t.Errorf("Expected defaulted fields to be explicit, got %+v", inherits)
+	}
+
+	if canary := effective.Namespaces["static"].Buckets["canary"]; canary.FillRate != 200 || canary.Canary != nil ||
+		canary.Labels["team"] != "search" || canary.Labels[config.CanaryLabel] != config.CanaryGroup {
+		t.Errorf("Expected the canary to be resolved, got %+v", canary)
+	}
+
+	// Dynamic buckets resolve the template by their own names.
+	tpl := effective.Namespaces["dynamic"].DynamicBucketTemplate
+	if !proto.Equal(tpl, s.Configs().Namespaces["dynamic"].DynamicBucketTemplate) {
+		t.Errorf("Expected the dynamic bucket template to be %+v, got %+v", s.Configs().Namespaces["dynamic"].DynamicBucketTemplate, tpl)
+	}
+
+	if b := s.bucketContainer.inspectableBucket("dynamic", "client"); !proto.Equal(b.Config(), config.CanaryConfig("dynamic", "client", tpl)) {
+		t.Errorf("Expected dynamic bucket to be created from the template, got %+v", b.Config())
+	}
+
+	if _, exists := effective.Namespaces["dynamic"].Buckets["client"]; exists {
+		t.Error("Expected dynamic buckets not to be listed as static buckets")
+	}
+
+	// The effective config differs from the config applied only in the canary resolved.
+	applied := config.CloneConfig(s.Configs())
+	applied.Namespaces["static"].Buckets["canary"] = effective.Namespaces["static"].Buckets["canary"]
+	if !proto.Equal(applied, effective) {
+		t.Errorf("Expected the effective config to match the config applied %+v, got %+v", applied, effective)
+	}
+}
+
+func TestNamespaceLimit(t *testing.T) {
+	cfg := config.NewDefaultServiceConfig()
+	nsc := config.NewDefaultNamespaceConfig("dummy")
+	config.SetDynamicBucketTemplate(nsc, config.NewDefaultBucketConfig(""))
+	nsc.NamespaceLimit = config.NewDefaultBucketConfig("")
+	nsc.NamespaceLimit.MaxTokensPerRequest = 5
+	helpers.CheckError(t, config.AddNamespace(cfg, nsc))
+	config.ApplyDefaults(cfg)
+
+	mbf := &MockBucketFactory{}
+	s := New(mbf, config.NewMemoryConfig(cfg), NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	timedOut := make(chan events.Event, 10)
+	s.AddListener(func(evt events.Event) {
+		timedOut <- evt
+	}, 10, events.EVENT_TIMEOUT_SERVING_TOKENS)
+
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	// The namespace limit is exhausted, so every bucket is denied although they have tokens.
+	mbf.SetWaitTime("dummy", config.NamespaceLimitBucketName, 2*time.Minute)
+	for _, name := range []string{"a", "b", "c"} {
+		if _, _, e := s.Allow(context.Background(), "dummy", name, 1, 0, false); e == nil || e.(QuotaServiceError).Reason != ER_TIMEOUT {
+			t.Fatalf("Expected bucket %v to time out on the namespace limit, got %v", name, e)
+		}
+
+		if evt := <-timedOut; evt.BucketName() != config.NamespaceLimitBucketName || evt.NumTokens() != 1 {
+			t.Errorf("Expected the namespace limit to time out, got %v", evt)
+		}
+	}
+
+	if _, _, e := s.Allow(context.Background(), "dummy", "a", 8, 0, false); e == nil || e.(QuotaServiceError).Reason != ER_TOO_MANY_TOKENS_REQUESTED ||
+		e.(QuotaServiceError).MaxTokens != 5 {
+		t.Errorf("Expected too many tokens for the namespace limit, got %v", e)
+	}
+
+	// Waiting for both the namespace limit and the bucket takes as long as the longest wait.
+	mbf.SetWaitTime("dummy", config.NamespaceLimitBucketName, 5*time.Millisecond)
+	if w, _, e := s.Allow(context.Background(), "dummy", "a", 1, 0, false); e != nil || w != 5*time.Millisecond {
+		t.Errorf("Expected to wait for the namespace limit, got %v, %v", w, e)
+	}
+
+	// Tokens taken from the namespace limit for requests their bucket denies are returned.
+	mbf.SetWaitTime("dummy", "a", 2*time.Minute)
+	if _, _, e := s.Allow(context.Background(), "dummy", "a", 3, 0, false); e == nil || e.(QuotaServiceError).Reason != ER_TIMEOUT {
+		t.Fatalf("Expected bucket a to time out, got %v", e)
+	}
+
+	if evt := <-timedOut; evt.BucketName() != "a" {
+		t.Errorf("Expected bucket a to time out, got %v", evt)
+	}
+
+	limit := mbf.bucket("dummy", config.NamespaceLimitBucketName)
+	limit.RLock()
+	returned := limit.Returned
+	limit.RUnlock()
+
+	if returned != 3 {
+		t.Errorf("Expected 3 tokens to be returned to the namespace limit, got %v", returned)
+	}
+
+	// Removing the namespace limit leaves only the buckets.
+	version := s.Configs().Version
+	helpers.CheckError(t, s.updateConfig("alice", func(c *pb.ServiceConfig) error {
+		c.Namespaces["dummy"].NamespaceLimit = nil
+		return nil
+	}))
+
+	start := time.Now()
+	for s.Configs().Version == version {
+		if time.Since(start) > time.Second {
+			t.Fatal("Timeout waiting for config to change!")
+		}
+
+		time.Sleep(time.Millisecond * 5)
+	}
+
+	if s.bucketContainer.NamespaceLimit("dummy") != nil {
+		t.Error("Expected the namespace limit to be removed")
+	}
+
+	if _, _, e := s.Allow(context.Background(), "dummy", "b", 8, 0, false); e != nil {
+		t.Errorf("Expected tokens to be granted without the namespace limit, got %v", e)
+	}
+}
+
+func TestDisabledBucket(t *testing.T) {
+	cfg := config.NewDefaultServiceConfig()
+	nsc := config.NewDefaultNamespaceConfig("dummy")
+	off := config.NewDefaultBucketConfig("off")
+	off.Disabled = true
+	off.MaxTokensPerRequest = 10
+	helpers.CheckError(t, config.AddBucket(nsc, off))
+	helpers.CheckError(t, config.AddBucket(nsc, config.NewDefaultBucketConfig("on")))
+	nsc.NamespaceLimit = config.NewDefaultBucketConfig("")
+	helpers.CheckError(t, config.AddNamespace(cfg, nsc))
+
+	mbf := &MockBucketFactory{}
+	s := New(mbf, config.NewMemoryConfig(cfg), NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	evts := make(chan events.Event, 10)
+	s.AddListener(func(evt events.Event) {
+		evts <- evt
+	}, 10, events.EVENT_TOKENS_SERVED, events.EVENT_WOULD_REJECT, events.EVENT_TIMEOUT_SERVING_TOKENS)
+
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	expectEvent := func(eventType events.EventType, name string, tokens int64) {
+		t.Helper()
+
+		if evt := <-evts; evt.EventType() != eventType || evt.BucketName() != name || evt.NumTokens() != tokens {
+			t.Errorf("Expected %v for %v tokens from %v, got %v", eventType, tokens, name, evt)
+		}
+	}
+
+	// Granted without waiting, while still taking tokens.
+	mbf.SetWaitTime("dummy", "off", time.Second)
+	if w, _, e := s.Allow(context.Background(), "dummy", "off", 3, 1, false); e != nil || w != 0 {
+		t.Fatalf("Expected a disabled bucket to grant without waiting, got %v, %v", w, e)
+	}
+
+	expectEvent(events.EVENT_TOKENS_SERVED, "off", 3)
+	if taken := mbf.bucket("dummy", "off").Taken; taken != 3 {
+		t.Errorf("Expected the disabled bucket to take 3 tokens, took %v", taken)
+	}
+
+	// Requests the bucket, or the namespace limit, would reject are granted, reporting the rejection.
+	mbf.SetWaitTime("dummy", "off", 2*time.Minute)
+	mbf.SetWaitTime("dummy", config.NamespaceLimitBucketName, 2*time.Minute)
+	for _, tokens := range []int64{1, 20} {
+		if w, _, e := s.Allow(context.Background(), "dummy", "off", tokens, 1, false); e != nil || w != 0 {
+			t.Fatalf("Expected a disabled bucket to grant %v tokens, got %v, %v", tokens, w, e)
+		}
+
+		expectEvent(events.EVENT_WOULD_REJECT, "off", tokens)
+		expectEvent(events.EVENT_TOKENS_SERVED, "off", tokens)
+	}
+
+	granted, w, err := s.Probe(context.Background(), "dummy", "off", 1)
+	if !granted || w != 0 || err != nil {
+		t.Errorf("Expected probing a disabled bucket to grant, got %v, %v, %v", granted, w, err)
+	}
+
+	// Other buckets of the namespace are still enforced.
+	if _, _, e := s.Allow(context.Background(), "dummy", "on", 1, 1, false); e == nil || e.(QuotaServiceError).Reason != ER_TIMEOUT {
+		t.Errorf("Expected an enabled bucket to be enforced, got %v", e)
+	}
+
+	expectEvent(events.EVENT_TIMEOUT_SERVING_TOKENS, config.NamespaceLimitBucketName, 1)
+}
+
+func TestDisabledNamespace(t *testing.T) {
+	cfg := config.NewDefaultServiceConfig()
+	nsc := config.NewDefaultNamespaceConfig("dummy")
+	helpers.CheckError(t, config.AddBucket(nsc, config.NewDefaultBucketConfig("dummy")))
+	config.SetRequestCost(nsc, "search", 5)
+	nsc.Disabled = true
+	helpers.CheckError(t, config.AddNamespace(cfg, nsc))
+
+	mbf := &MockBucketFactory{}
+	s := New(mbf, config.NewMemoryConfig(cfg), NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	served := make(chan events.Event, 10)
+	s.AddListener(func(evt events.Event) {
+		served <- evt
+	}, 10, events.EVENT_TOKENS_SERVED)
+
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	// The bucket would time out, if it were asked.
+	mbf.SetWaitTime("dummy", "dummy", 2*time.Minute)
+
+	for _, tc := range []struct {
+		name            string
+		kind            string
+		tokensRequested int64
+		expected        int64
+	}{
+		{"dummy", "", 3, 3},
+		{"dummy", "search", 2, 10},
+		// Granted even without a bucket, or with an unknown kind.
+		{"missing", "", 1, 1},
+		{"dummy", "export", 4, 4},
+	} {
+		ctx := context.Background()
+		if tc.kind != "" {
+			ctx = ContextWithRequestKind(ctx, tc.kind)
+		}
+
+		if w, _, e := s.Allow(ctx, "dummy", tc.name, tc.tokensRequested, 1, false); e != nil || w != 0 {
+			t.Fatalf("Expected %v tokens from disabled bucket %v to be granted, got %v, %v", tc.tokensRequested, tc.name, w, e)
+		}
+
+		if evt := <-served; evt.Namespace() != "dummy" || evt.BucketName() != tc.name || evt.NumTokens() != tc.expected {
+			t.Errorf("Expected %v tokens served from %v, got %v", tc.expected, tc.name, evt)
+		}
+	}
+
+	// Re-enabling the namespace takes tokens again.
+	version := s.Configs().Version
+	helpers.CheckError(t, s.updateConfig("alice", func(c *pb.ServiceConfig) error {
+		c.Namespaces["dummy"].Disabled = false
+		return nil
+	}))
+
+	start := time.Now()
+	for s.Configs().Version == version {
+		if time.Since(start) > time.Second {
+			t.Fatal("Timeout waiting for config to change!")
+		}
+
+		time.Sleep(time.Millisecond * 5)
+	}
+
+	// Persisting the config applied defaults to the bucket, recreating it.
+	mbf.SetWaitTime("dummy", "dummy", 2*time.Minute)
+	if _, _, e := s.Allow(context.Background(), "dummy", "dummy", 1, 1, false); e == nil || e.(QuotaServiceError).Reason != ER_TIMEOUT {
+		t.Errorf("Expected a timeout from the re-enabled namespace, got %v", e)
+	}
+}
+
+func TestDefaultNamespaceBehavior(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		behavior      DefaultNamespaceBehavior
+		globalDefault bool
+		granted       bool
+	}{
+		{"global default", DefaultNamespaceUseGlobalDefault, true, true},
+		{"no global default", DefaultNamespaceUseGlobalDefault, false, false},
+		{"reject", DefaultNamespaceReject, true, false},
+		{"allow all", DefaultNamespaceAllowAll, false, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := config.NewDefaultServiceConfig()
+			nsc := config.NewDefaultNamespaceConfig("dummy")
+			helpers.CheckError(t, config.AddBucket(nsc, config.NewDefaultBucketConfig("dummy")))
+			helpers.CheckError(t, config.AddNamespace(cfg, nsc))
+			if tc.globalDefault {
+				cfg.GlobalDefaultBucket = config.NewDefaultBucketConfig(config.DefaultBucketName)
+			}
+
+			s := New(&MockBucketFactory{}, config.NewMemoryConfig(cfg), NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+			s.SetDefaultNamespaceBehavior(tc.behavior)
+			evts := make(chan events.Event, 10)
+			s.AddListener(func(evt events.Event) {
+				evts <- evt
+			}, 10, events.EVENT_TOKENS_SERVED, events.EVENT_UNKNOWN_NAMESPACE)
+
+			_, err := s.Start()
+			helpers.CheckError(t, err)
+			defer stopServer(t, s)
+
+			// Known namespaces are served as usual.
+			_, _, err = s.Allow(context.Background(), "dummy", "dummy", 1, 0, false)
+			helpers.CheckError(t, err)
+			if evt := <-evts; evt.EventType() != events.EVENT_TOKENS_SERVED {
+				t.Errorf("Expected tokens served from a known namespace, got %v", evt)
+			}
+
+			_, _, err = s.Allow(context.Background(), "nope", "nope", 1, 0, false)
+			if tc.granted {
+				helpers.CheckError(t, err)
+			} else if err == nil || err.(QuotaServiceError).Reason != ER_UNKNOWN_NAMESPACE {
+				t.Errorf("Expected an unknown namespace, got %v", err)
+			}
+
+			if evt := <-evts; evt.EventType() != events.EVENT_UNKNOWN_NAMESPACE || evt.Namespace() != "nope" || evt.BucketName() != "nope" {
+				t.Errorf("Expected an unknown namespace event, got %v", evt)
+			}
+
+			if tc.granted {
+				if evt := <-evts; evt.EventType() != events.EVENT_TOKENS_SERVED || evt.Namespace() != "nope" {
+					t.Errorf("Expected tokens served from the unknown namespace, got %v", evt)
+				}
+			}
+
+			// Probes agree with Allow.
+			granted, _, err := s.Probe(context.Background(), "nope", "nope", 1)
+			if granted != tc.granted || (err != nil) == tc.granted {
+				t.Errorf("Expected a probe to be granted %v, got %v, %v", tc.granted, granted, err)
+			}
+		})
+	}
+}
+
+func TestCatchAllBucket(t *testing.T) {
+	cfg := config.NewDefaultServiceConfig()
+	cfg.GlobalDefaultBucket = config.NewDefaultBucketConfig(config.DefaultBucketName)
+	nsc := config.NewDefaultNamespaceConfig("known")
+	helpers.CheckError(t, config.AddBucket(nsc, config.NewDefaultBucketConfig("b")))
+	helpers.CheckError(t, config.AddNamespace(cfg, nsc))
+
+	catchAllNs := config.NewDefaultNamespaceConfig("fallback")
+	catchAll := config.NewDefaultBucketConfig("unmatched")
+	catchAll.CatchAll = true
+	catchAll.Labels = map[string]string{"team": "traffic"}
+	helpers.CheckError(t, config.AddBucket(catchAllNs, catchAll))
+	helpers.CheckError(t, config.AddNamespace(cfg, catchAllNs))
+
+	s := New(&MockBucketFactory{}, config.NewMemoryConfig(cfg), NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	evts := make(chan events.Event, 10)
+	s.AddListener(func(evt events.Event) {
+		evts <- evt
+	}, 10, events.EVENT_TOKENS_SERVED)
+
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	for _, tc := range []struct {
+		namespace, bucket, catchAllLabel string
+	}{
+		{"known", "b", ""},
+		{"unknown", "x", "unknown:x"},
+		{"known", "missing", "known:missing"},
+		{"fallback", "unmatched", ""},
+	} {
+		_, _, err := s.Allow(context.Background(), tc.namespace, tc.bucket, 2, 0, false)
+		helpers.CheckError(t, err)
+
+		evt := <-evts
+		labels := events.Labels(evt)
+		if tc.catchAllLabel == "" {
+			if evt.Namespace() != tc.namespace || evt.BucketName() != tc.bucket || labels[events.CatchAllLabel] != "" {
+				t.Errorf("Expected tokens served from %v:%v itself, got %v", tc.namespace, tc.bucket, evt)
+			}
+
+			continue
+		}
+
+		// Unmatched requests are attributed to the catch-all, labeled with the bucket requested.
+		if evt.Namespace() != "fallback" || evt.BucketName() != "unmatched" || labels[events.CatchAllLabel] != tc.catchAllLabel ||
+			labels["team"] != "traffic" {
+			t.Errorf("Expected tokens served from the catch-all for %v:%v, got %v", tc.namespace, tc.bucket, evt)
+		}
+
+		granted, _, err := s.Probe(context.Background(), tc.namespace, tc.bucket, 1)
+		if !granted || err != nil {
+			t.Errorf("Expected a probe of %v:%v to be granted by the catch-all, got %v, %v", tc.namespace, tc.bucket, granted, err)
+		}
+	}
+
+	if catchAll.Labels[events.CatchAllLabel] != "" {
+		t.Errorf("Expected the catch-all's labels to be left as they are, got %v", catchAll.Labels)
+	}
+
+	b, err := s.bucketContainer.FindBucket("fallback", "unmatched")
+	helpers.CheckError(t, err)
+
+	if _, delegate := unwrapBucket(b); delegate.(*MockBucket).Taken != 6 {
+		t.Errorf("Expected the catch-all to serve 6 tokens, got %v", delegate.(*MockBucket).Taken)
+	}
+
+	if _, delegate := unwrapBucket(s.bucketContainer.defaultBucket); delegate.(*MockBucket).Taken != 0 {
+		t.Errorf("Expected the global default bucket to serve nothing, got %v", delegate.(*MockBucket).Taken)
+	}
+}
+
+func TestInitWithLowerVersionedConfig(t *testing.T) {
+	p := config.NewMemoryConfigPersister()
+	s := New(&MockBucketFactory{}, p, NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+
+	// Write a config with version 2
+	s.cfgs = config.NewDefaultServiceConfig()
+	s.cfgs.Version = 2
+
+	// Attempt to write a version 1 of the config
+	newCfg := config.NewDefaultServiceConfig()
+	newCfg.Version = 1
+
+	s.updateBucketContainer(newCfg)
+
+	if s.cfgs.Version != 2 {
+		t.Fatal("Expected version 2 to not have been overwritten")
+	}
+}
+
+func TestBucketErrorEmitsEvent(t *testing.T) {
+	cfg := config.NewDefaultServiceConfig()
+	nsc := config.NewDefaultNamespaceConfig("dummy")
+	bc := config.NewDefaultBucketConfig("dummy")
+	helpers.CheckError(t, config.AddBucket(nsc, bc))
+	helpers.CheckError(t, config.AddNamespace(cfg, nsc))
+	bf := MockBucketFactory{
+		SimulateFailure: true,
+	}
+	s := New(&bf, config.NewMemoryConfig(cfg), NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	eventsCh := make(chan events.Event)
+	s.SetListener(func(evt events.Event) {
+		eventsCh <- evt
+	}, 1000)
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	_, _, err = s.Allow(context.Background(), "dummy", "dummy", 1, 0, false)
+	if err == nil {
+		t.Fatal("Expected an Allow() error due to SimulateFailure=true on the mock bucket")
+	}
+
+	for {
+		select {
+		case evt := <-eventsCh:
+			if evt.EventType() == events.EVENT_BUCKET_ERROR {
+				// Success condition
+				return
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatalf("did not get event with type %s within timeout", events.EVENT_BUCKET_ERROR)
+		}
+	}
+}
+
+// reloadFailingPersister lets tests report failures to load configs.
+type reloadFailingPersister struct {
+	config.ConfigPersister
+	onReloadFailure func(version int32, err error)
+}
+
+func (r *reloadFailingPersister) OnReloadFailure(f func(version int32, err error)) {
+	r.onReloadFailure = f
+}
+
+func expectConfigEvent(t *testing.T, eventsCh <-chan events.Event, eventType events.EventType) events.ConfigEvent {
+	t.Helper()
+
+	for {
+		select {
+		case evt := <-eventsCh:
+			if evt.EventType() == eventType {
+				return evt.(events.ConfigEvent)
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatalf("did not get event with type %s within timeout", eventType)
+		}
+	}
+}
+
+// emittingBucketFactory is a MockBucketFactory emitting events of its own.
+type emittingBucketFactory struct {
+	MockBucketFactory
+	emit func(events.Event)
+}
+
+func (bf *emittingBucketFactory) SetEventEmitter(emit func(events.Event)) {
+	bf.emit = emit
+}
+
+func TestBucketFactoryEvents(t *testing.T) {
+	bf := &emittingBucketFactory{}
+	s := New(bf, config.NewMemoryConfig(config.NewDefaultServiceConfig()), NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	eventsCh := make(chan events.Event, 10)
+	s.AddListener(func(evt events.Event) {
+		eventsCh <- evt
+	}, 10, events.EVENT_CIRCUIT_BREAKER_STATE_CHANGED)
+
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	if bf.emit == nil {
+		t.Fatal("Expected the server to set the bucket factory's event emitter")
+	}
+
+	bf.emit(events.NewCircuitBreakerEvent("redis", events.CircuitOpen))
+
+	select {
+	case evt := <-eventsCh:
+		if c, ok := evt.(events.CircuitBreakerEvent); !ok || c.State() != events.CircuitOpen {
+			t.Errorf("Expected an open circuit breaker event, got %v", evt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the bucket factory's event")
+	}
+}
+
+// balanceBucket is a MockBucket with a balance, carried over when it's reconfigured.
+type balanceBucket struct {
+	MockBucket
+	tokens int64
+}
+
+func (b *balanceBucket) Take(_ context.Context, numTokens int64, _ time.Duration) (time.Duration, bool, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.tokens -= numTokens
+	return 0, true, nil
+}
+
+func (b *balanceBucket) Reconfigure(cfg *pb.BucketConfig) (Bucket, int64) {
+	b.RLock()
+	defer b.RUnlock()
+
+	tokens, clamped := b.tokens, int64(0)
+	if tokens > cfg.Size {
+		tokens, clamped = cfg.Size, tokens-cfg.Size
+	}
+
+	return &balanceBucket{MockBucket: MockBucket{namespace: b.namespace, bucketName: b.bucketName, dyn: b.dyn, cfg: cfg}, tokens: tokens}, clamped
+}
+
+type balanceBucketFactory struct {
+	MockBucketFactory
+}
+
+func (bf *balanceBucketFactory) NewBucket(namespace, bucketName string, cfg *pb.BucketConfig, dyn bool) Bucket {
+	return &balanceBucket{MockBucket: MockBucket{namespace: namespace, bucketName: bucketName, dyn: dyn, cfg: cfg}, tokens: cfg.Size}
+}
+
+func TestReloadKeepsBalances(t *testing.T) {
+	cfg := config.NewDefaultServiceConfig()
+	cfg.Version = 1
+	nsc := config.NewDefaultNamespaceConfig("ns")
+	nsc.DynamicBucketTemplate = config.NewDefaultBucketConfig(config.DefaultBucketName)
+	for _, name := range []string{"kept", "shrunk", "removed"} {
+		helpers.CheckError(t, config.AddBucket(nsc, config.NewDefaultBucketConfig(name)))
+	}
+	helpers.CheckError(t, config.AddNamespace(cfg, nsc))
+
+	s := New(&balanceBucketFactory{}, config.NewMemoryConfig(cfg), NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	eventsCh := make(chan events.Event, 10)
+	s.AddListener(func(evt events.Event) {
+		eventsCh <- evt
+	}, 10, events.EVENT_BUCKET_CLAMPED, events.EVENT_BUCKET_REMOVED)
+
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	find := func(name string) Bucket {
+		t.Helper()
+
+		b, err := s.bucketContainer.FindBucket("ns", name)
+		helpers.CheckError(t, err)
+		return b
+	}
+
+	balance := func(b Bucket) int64 {
+		_, delegate := unwrapBucket(b)
+		return delegate.(*balanceBucket).tokens
+	}
+
+	kept, dyn := find("kept"), find("dyn")
+	for _, b := range []Bucket{kept, find("shrunk"), dyn} {
+		_, _, _ = b.Take(context.Background(), 30, 0)
+	}
+
+	// Only shrink one of the buckets, and remove another.
+	newCfg := config.CloneConfig(cfg)
+	newCfg.Version = 2
+	newCfg.Namespaces["ns"].Buckets["shrunk"].Size = 50
+	delete(newCfg.Namespaces["ns"].Buckets, "removed")
+	s.updateBucketContainer(newCfg)
+
+	if b := find("kept"); b != kept || balance(b) != 70 {
+		t.Errorf("Expected the unchanged bucket to keep its balance of 70, got %v", balance(b))
+	}
+
+	if b := find("dyn"); b != dyn || balance(b) != 70 {
+		t.Errorf("Expected the dynamic bucket to keep its balance of 70, got %v", balance(b))
+	}
+
+	if b := find("shrunk"); b.Config().Size != 50 || balance(b) != 50 {
+		t.Errorf("Expected the shrunk bucket to be clamped to 50 tokens, got %v", balance(b))
+	}
+
+	if s.bucketContainer.Exists("ns", "removed") {
+		t.Error("Expected the removed bucket to be destroyed")
+	}
+
+	expected := map[events.EventType]string{events.EVENT_BUCKET_CLAMPED: "shrunk", events.EVENT_BUCKET_REMOVED: "removed"}
+	for len(expected) > 0 {
+		select {
+		case evt := <-eventsCh:
+			if expected[evt.EventType()] != evt.BucketName() {
+				t.Errorf("Unexpected event %v", evt)
+			}
+
+			if evt.EventType() == events.EVENT_BUCKET_CLAMPED && evt.NumTokens() != 20 {
+				t.Errorf("Expected 20 tokens to be clamped, got %v", evt.NumTokens())
+			}
+
+			delete(expected, evt.EventType())
+		case <-time.After(time.Second):
+			t.Fatalf("Expected events %v", expected)
+		}
+	}
+}
+
+func TestBucketConfigChangeEvents(t *testing.T) {
+	cfg := config.NewDefaultServiceConfig()
+	cfg.Version = 1
+	nsc := config.NewDefaultNamespaceConfig("ns")
+	for _, name := range []string{"changed", "removed"} {
+		helpers.CheckError(t, config.AddBucket(nsc, config.NewDefaultBucketConfig(name)))
+	}
+	helpers.CheckError(t, config.AddNamespace(cfg, nsc))
+
+	s := New(&MockBucketFactory{}, config.NewMemoryConfig(cfg), NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	eventsCh := make(chan events.Event, 10)
+	s.AddListener(func(evt events.Event) {
+		eventsCh <- evt
+	}, 10, events.EVENT_BUCKET_CREATED, events.EVENT_BUCKET_MODIFIED, events.EVENT_BUCKET_REMOVED)
+
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	newCfg := config.CloneConfig(cfg)
+	newCfg.Version = 2
+	newCfg.Namespaces["ns"].Buckets["changed"].Size = 50
+	delete(newCfg.Namespaces["ns"].Buckets, "removed")
+	helpers.CheckError(t, config.AddBucket(newCfg.Namespaces["ns"], config.NewDefaultBucketConfig("added")))
+	s.updateBucketContainer(newCfg)
+
+	expected := map[events.EventType]string{
+		events.EVENT_BUCKET_MODIFIED: "changed",
+		events.EVENT_BUCKET_REMOVED:  "removed",
+		events.EVENT_BUCKET_CREATED:  "added"}
+	for len(expected) > 0 {
+		select {
+		case evt := <-eventsCh:
+			if evt.EventType() == events.EVENT_BUCKET_CREATED && evt.BucketName() != "added" {
+				// Created on startup.
+				continue
+			}
+
+			if expected[evt.EventType()] != evt.BucketName() {
+				t.Errorf("Unexpected event %v", evt)
+				continue
+			}
+
+			delete(expected, evt.EventType())
+
+			oldCfg, newCfg, ok := events.BucketConfigs(evt)
+			if !ok {
+				t.Errorf("Expected event %v to carry the bucket's configs", evt)
+				continue
+			}
+
+			switch evt.EventType() {
+			case events.EVENT_BUCKET_MODIFIED:
+				if oldCfg.Size != 100 || newCfg.Size != 50 {
+					t.Errorf("Expected the size to change from 100 to 50, got %v to %v", oldCfg.Size, newCfg.Size)
+				}
+
+				if changed := config.ChangedBucketFields(oldCfg, newCfg); !reflect.DeepEqual(changed, []string{"size"}) {
+					t.Errorf("Expected only the size to change, got %v", changed)
+				}
+			case events.EVENT_BUCKET_REMOVED:
+				if oldCfg == nil || oldCfg.Name != "removed" || newCfg != nil {
+					t.Errorf("Expected the removed bucket's config before only, got %v to %v", oldCfg, newCfg)
+				}
+			case events.EVENT_BUCKET_CREATED:
+				if oldCfg != nil || newCfg == nil || newCfg.Name != "added" {
+					t.Errorf("Expected the created bucket's config after only, got %v to %v", oldCfg, newCfg)
+				}
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected events %v", expected)
+		}
+	}
+}
+
+func TestConfigReloadedEvent(t *testing.T) {
+	cfg := config.NewDefaultServiceConfig()
+	cfg.Version = 3
+	s := New(&MockBucketFactory{}, config.NewMemoryConfig(cfg), NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	eventsCh := make(chan events.Event, 10)
+	s.SetListener(func(evt events.Event) {
+		eventsCh <- evt
+	}, 10)
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	evt := expectConfigEvent(t, eventsCh, events.EVENT_CONFIG_RELOADED)
+	if evt.Version() != 3 || evt.Error() != nil {
+		t.Errorf("Unexpected event %+v", evt)
+	}
+}
+
+func TestConfigReloadFailedEvent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quotaservice")
+	helpers.CheckError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	p, err := config.NewDiskConfigPersister(filepath.Join(dir, "config"))
+	helpers.CheckError(t, err)
+	helpers.CheckError(t, p.PersistAndNotify("", config.NewDefaultServiceConfig()))
+
+	s := New(&MockBucketFactory{}, p, NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	eventsCh := make(chan events.Event, 10)
+	s.SetListener(func(evt events.Event) {
+		eventsCh <- evt
+	}, 10)
+	_, err = s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	expectConfigEvent(t, eventsCh, events.EVENT_CONFIG_RELOADED)
+
+	// Corrupt the persisted config, so it can't be unmarshalled. Nothing is subscribed to config
+	// changes, but the event should still fire.
+	helpers.CheckError(t, ioutil.WriteFile(filepath.Join(dir, "config"), []byte{0xff, 0xff, 0xff}, 0644))
+	p.Notify()
+
+	evt := expectConfigEvent(t, eventsCh, events.EVENT_CONFIG_RELOAD_FAILED)
+	if evt.Version() != -1 || evt.Error() == nil {
+		t.Errorf("Unexpected event %+v", evt)
+	}
+
+	if s.Configs().Version != 0 {
+		t.Errorf("Expected the previous config to still be applied, got version %v", s.Configs().Version)
+	}
+}
+
+func TestConfigSignatureInvalid(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	helpers.CheckError(t, err)
+	signer := config.NewSigner("k1", private)
+
+	cfg := config.NewDefaultServiceConfig()
+	helpers.CheckError(t, signer.Sign(cfg))
+	store := config.NewMemoryConfig(cfg).(*config.MemoryConfigPersister)
+	p := config.NewSigningPersister(store, signer, config.NewVerifier(map[string]ed25519.PublicKey{"k1": public}))
+
+	s := New(&MockBucketFactory{}, p, NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	eventsCh := make(chan events.Event, 10)
+	s.SetListener(func(evt events.Event) {
+		eventsCh <- evt
+	}, 10)
+	_, err = s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	expectConfigEvent(t, eventsCh, events.EVENT_CONFIG_RELOADED)
+
+	// Alter the stored config without re-signing it.
+	tampered := config.CloneConfig(cfg)
+	tampered.Namespaces = make(map[string]*pb.NamespaceConfig)
+	helpers.CheckError(t, config.AddNamespace(tampered, config.NewDefaultNamespaceConfig("evil")))
+	helpers.CheckError(t, store.PersistAndNotify("", tampered))
+
+	evt := expectConfigEvent(t, eventsCh, events.EVENT_CONFIG_SIGNATURE_INVALID)
+	if evt.Version() != 0 || evt.Error() == nil {
+		t.Errorf("Unexpected event %+v", evt)
+	}
+
+	if _, exists := s.Configs().Namespaces["evil"]; exists {
+		t.Error("Expected the tampered config to be refused")
+	}
+
+	// Changes made through the server are signed.
+	helpers.CheckError(t, s.AddNamespace(config.NewDefaultNamespaceConfig("foo"), "alice"))
+	if evt := expectConfigEvent(t, eventsCh, events.EVENT_CONFIG_RELOADED); evt.Version() != 1 {
+		t.Errorf("Expected version 1 to be applied, got %v", evt.Version())
+	}
+}
+
+func TestConfigReloadFailureReported(t *testing.T) {
+	p := &reloadFailingPersister{ConfigPersister: config.NewMemoryConfig(config.NewDefaultServiceConfig())}
+	s := New(&MockBucketFactory{}, p, NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	eventsCh := make(chan events.Event, 10)
+	s.SetListener(func(evt events.Event) {
+		eventsCh <- evt
+	}, 10)
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	if p.onReloadFailure == nil {
+		t.Fatal("Expected the server to register for reload failures")
+	}
+
+	p.onReloadFailure(5, errors.New("unmarshal failed"))
+
+	evt := expectConfigEvent(t, eventsCh, events.EVENT_CONFIG_RELOAD_FAILED)
+	if evt.Version() != 5 || evt.Error().Error() != "unmarshal failed" {
+		t.Errorf("Unexpected event %+v", evt)
+	}
+}
+
+func TestFilteredListeners(t *testing.T) {
+	cfg := config.NewDefaultServiceConfig()
+	nsc := config.NewDefaultNamespaceConfig("ns")
+	helpers.CheckError(t, config.AddBucket(nsc, config.NewDefaultBucketConfig("b")))
+	helpers.CheckError(t, config.AddNamespace(cfg, nsc))
+
+	endpoint := &MockEndpoint{}
+	s := New(&MockBucketFactory{}, config.NewMemoryConfig(cfg), NewReaperConfigForTests(), 0, endpoint).(*server)
+
+	misses := make(chan events.Event, 10)
+	s.AddListener(func(evt events.Event) {
+		misses <- evt
+	}, 10, events.EVENT_BUCKET_MISS)
+
+	all := make(chan events.Event, 10)
+	s.AddListener(func(evt events.Event) {
+		all <- evt
+	}, 10)
+
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	_, _, err = endpoint.QuotaService.Allow(context.Background(), "ns", "b", 1, 0, false)
+	helpers.CheckError(t, err)
+	_, _, err = endpoint.QuotaService.Allow(context.Background(), "ns", "missing", 1, 0, false)
+	if err == nil {
+		t.Fatal("Expected a bucket miss")
+	}
+
+	// The wildcard listener sees everything, in order, up to the miss.
+	expectConfigEvent(t, all, events.EVENT_CONFIG_RELOADED)
+	for _, expected := range []events.EventType{events.EVENT_TOKENS_SERVED, events.EVENT_BUCKET_MISS} {
+		if evt := <-all; evt.EventType() != expected {
+			t.Errorf("Expected %v, got %v", expected, evt.EventType())
+		}
+	}
+
+	if evt := <-misses; evt.EventType() != events.EVENT_BUCKET_MISS || evt.BucketName() != "missing" {
+		t.Errorf("Unexpected event %+v", evt)
+	}
+
+	select {
+	case evt := <-misses:
+		t.Errorf("Filtered listener received excluded event %v", evt.EventType())
+	default:
+	}
+}
+
+func TestEventAggregation(t *testing.T) {
+	cfg := config.NewDefaultServiceConfig()
+	nsc := config.NewDefaultNamespaceConfig("ns")
+	config.SetDynamicBucketTemplate(nsc, config.NewDefaultBucketConfig(""))
+	helpers.CheckError(t, config.AddNamespace(cfg, nsc))
+
+	endpoint := &MockEndpoint{}
+	s := New(&MockBucketFactory{}, config.NewMemoryConfig(cfg), NewReaperConfigForTests(), 0, endpoint).(*server)
+	s.SetEventAggregation(events.AggregateNamespaces("ns"))
+	tracker := stats.NewTopTracker(stats.TopOptions{})
+	s.SetTopTracker(tracker)
+
+	served := make(chan events.Event, 10)
+	s.AddListener(func(evt events.Event) {
+		served <- evt
+	}, 10, events.EVENT_TOKENS_SERVED)
+
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	for _, bucket := range []string{"a", "b", "a"} {
+		_, _, err = endpoint.QuotaService.Allow(context.Background(), "ns", bucket, 1, 0, false)
+		helpers.CheckError(t, err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if evt := <-served; evt.BucketName() != events.AggregatedBucket {
+			t.Errorf("Expected an aggregated event, got %+v", evt)
+		}
+	}
+
+	// The top tracker still sees individual buckets.
+	top := tracker.Top(stats.TopByRequests, 10)
+	if len(top) != 2 || top[0].Bucket != "a" || top[0].Score != 2 || top[1].Bucket != "b" {
+		t.Errorf("Expected individual buckets in the top-N view, got %v", top)
+	}
+}
+
+func TestEventSampling(t *testing.T) {
+	cfg := config.NewDefaultServiceConfig()
+	nsc := config.NewDefaultNamespaceConfig("ns")
+	template := config.NewDefaultBucketConfig("")
+	template.MaxTokensPerRequest = 10
+	config.SetDynamicBucketTemplate(nsc, template)
+	helpers.CheckError(t, config.AddNamespace(cfg, nsc))
+
+	endpoint := &MockEndpoint{}
+	s := New(&MockBucketFactory{}, config.NewMemoryConfig(cfg), NewReaperConfigForTests(), 0, endpoint).(*server)
+	s.SetEventSampling(events.SampleNamespaces(map[string]int64{"ns": 4}))
+
+	received := make(chan events.Event, 20)
+	s.AddListener(func(evt events.Event) {
+		received <- evt
+	}, 20, events.EVENT_TOKENS_SERVED, events.EVENT_TOO_MANY_TOKENS_REQUESTED)
+
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	for i := 0; i < 8; i++ {
+		_, _, err = endpoint.QuotaService.Allow(context.Background(), "ns", "dyn", 1, 0, false)
+		helpers.CheckError(t, err)
+	}
+
+	// Rejections are never sampled.
+	for i := 0; i < 2; i++ {
+		_, _, err = endpoint.QuotaService.Allow(context.Background(), "ns", "dyn", 1000, 0, false)
+		if err == nil {
+			t.Fatal("Expected too many tokens to be rejected")
+		}
+	}
+
+	var served, rejected, weight int64
+	for i := 0; i < 4; i++ {
+		evt := <-received
+		switch evt.EventType() {
+		case events.EVENT_TOKENS_SERVED:
+			served++
+			weight += events.Weight(evt)
+		case events.EVENT_TOO_MANY_TOKENS_REQUESTED:
+			rejected++
+		}
+	}
+
+	if served != 2 || weight != 8 || rejected != 2 {
+		t.Errorf("Expected 2 served events weighing 8 and 2 rejections, got %v weighing %v and %v", served, weight, rejected)
+	}
+}
+
+func TestResetStats(t *testing.T) {
+	cfg := config.NewDefaultServiceConfig()
+	nsc := config.NewDefaultNamespaceConfig("ns")
+	config.SetDynamicBucketTemplate(nsc, config.NewDefaultBucketConfig(""))
+	helpers.CheckError(t, config.AddNamespace(cfg, nsc))
+
+	endpoint := &MockEndpoint{}
+	s := New(&MockBucketFactory{}, config.NewMemoryConfig(cfg), NewReaperConfigForTests(), 0, endpoint).(*server)
+	s.SetStatsListener(stats.NewMemoryStatsListener())
+	histograms := stats.NewWaitTimeHistograms(stats.HistogramOptions{})
+	s.SetWaitTimeHistograms(histograms)
+	rates := stats.NewRateTracker(stats.RateOptions{})
+	s.SetRateTracker(rates)
+
+	served := make(chan events.Event, 10)
+	s.AddListener(func(evt events.Event) {
+		served <- evt
+	}, 10, events.EVENT_TOKENS_SERVED)
+
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	for i := 0; i < 3; i++ {
+		_, _, err = endpoint.QuotaService.Allow(context.Background(), "ns", "dyn", 1, 0, false)
+		helpers.CheckError(t, err)
+		<-served
+	}
+
+	if scores := s.DynamicBucketStats("ns", "dyn"); scores.Hits != 3 {
+		t.Fatalf("Expected 3 hits before the reset, got %+v", scores)
+	}
+
+	if r, window := s.NamespaceRates(); len(r) != 1 || r[0].Granted != 3/window.Seconds() {
+		t.Fatalf("Expected 3 requests granted before the reset, got %+v", r)
+	}
+
+	if !s.ResetStats("ns") {
+		t.Fatal("Expected stats to be reset")
+	}
+
+	if scores := s.DynamicBucketStats("ns", "dyn"); scores.Hits != 0 || scores.Misses != 0 {
+		t.Errorf("Expected no hits or misses after the reset, got %+v", scores)
+	}
+
+	if h := histograms.NamespaceStats("ns"); h != nil {
+		t.Errorf("Expected no wait times after the reset, got %+v", h)
+	}
+
+	if r, _ := s.NamespaceRates(); len(r) != 0 {
+		t.Errorf("Expected no rates after the reset, got %+v", r)
+	}
+}
+
+func TestNoEventsQueuedWithoutListeners(t *testing.T) {
+	s := New(&MockBucketFactory{}, config.NewMemoryConfig(config.NewDefaultServiceConfig()), NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	misses := make(chan events.Event, 10)
+	s.AddListener(func(evt events.Event) {
+		misses <- evt
+	}, 1, events.EVENT_BUCKET_MISS)
+
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	// Excluded events don't take up room in the buffer, so aren't counted as dropped.
+	for i := 0; i < 10; i++ {
+		s.Emit(events.NewTokensServedEvent("ns", "b", false, 1, 0))
+	}
+
+	if s.EventsDropped() != 0 {
+		t.Errorf("Expected no events dropped, got %v", s.EventsDropped())
+	}
+}
+
+func stopServer(t *testing.T, s *server) {
+	t.Helper()
+
+	_, err := s.Stop()
+	helpers.CheckError(t, err)
+}
+
+func TestTemplates(t *testing.T) {
+	cfg := config.NewDefaultServiceConfig()
+	cfg.Templates = map[string]*pb.BucketConfig{"standard": {FillRate: 10}}
+	nsc := config.NewDefaultNamespaceConfig("dummy")
+	nsc.Buckets["a"] = &pb.BucketConfig{Template: "standard"}
+	nsc.Buckets["b"] = &pb.BucketConfig{Template: "standard", FillRate: 20}
 	helpers.CheckError(t, config.AddNamespace(cfg, nsc))
+	config.ApplyDefaults(cfg)
 
 	s := New(&MockBucketFactory{}, config.NewMemoryConfig(cfg), NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
 	_, err := s.Start()
 	helpers.CheckError(t, err)
 	defer stopServer(t, s)
 
-	w, _, e := s.Allow(context.Background(), "dummy", "dummy", 1, 0, false)
-	if e != nil {
-		t.Fatal("Wasn't expecting an error to s.Allow()", e)
+	a, _ := s.bucketContainer.FindBucket("dummy", "a")
+	b, _ := s.bucketContainer.FindBucket("dummy", "b")
+	if a.Config().FillRate != 10 || b.Config().FillRate != 20 {
+		t.Fatalf("Expected buckets created from the template, got %+v and %+v", a.Config(), b.Config())
 	}
 
-	if w > 0 {
-		t.Fatalf("Wait time should be 0, not %v", w)
+	// Changing the template persists a new version, reconfiguring the buckets created from it.
+	version := s.Configs().Version
+	helpers.CheckError(t, s.UpdateTemplate(&pb.BucketConfig{Name: "standard", FillRate: 30, Size: 300}, "alice"))
+	waitFor(t, "the template change", func() bool { return s.Configs().Version == version+1 })
+
+	a, _ = s.bucketContainer.FindBucket("dummy", "a")
+	b, _ = s.bucketContainer.FindBucket("dummy", "b")
+	if a.Config().FillRate != 30 || a.Config().Size != 300 || b.Config().FillRate != 20 || b.Config().Size != 300 {
+		t.Errorf("Expected buckets reconfigured from the template, got %+v and %+v", a.Config(), b.Config())
 	}
 
-	w, _, e = s.Allow(context.Background(), "dummy", "dummy", 10, 0, false)
-	if e == nil {
-		t.Fatal("Expecting an error to s.Allow()", e)
+	if e := s.EffectiveConfig().Namespaces["dummy"].Buckets["a"]; e.FillRate != 30 || e.Template != "standard" {
+		t.Errorf("Expected the effective config to resolve the template, got %+v", e)
 	}
 
-	if e.(QuotaServiceError).Reason != ER_TOO_MANY_TOKENS_REQUESTED {
-		t.Fatalf("Expected Reason to be %v but was %v", ER_TOO_MANY_TOKENS_REQUESTED, e.(QuotaServiceError).Reason)
+	if _, ok := s.DeleteTemplate("standard", "alice").(*config.TemplateInUseError); !ok {
+		t.Error("Expected a template in use not to be deleted")
 	}
 }
 
-func TestInitWithLowerVersionedConfig(t *testing.T) {
+func TestMissingTemplatesRefused(t *testing.T) {
+	cfg := config.NewDefaultServiceConfig()
+	cfg.Version = 1
+	nsc := config.NewDefaultNamespaceConfig("ns")
+	helpers.CheckError(t, config.AddBucket(nsc, config.NewDefaultBucketConfig("a")))
+	helpers.CheckError(t, config.AddNamespace(cfg, nsc))
+
 	p := config.NewMemoryConfigPersister()
+	helpers.CheckError(t, p.PersistAndNotify("", cfg))
 	s := New(&MockBucketFactory{}, p, NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
 
-	// Write a config with version 2
-	s.cfgs = config.NewDefaultServiceConfig()
-	s.cfgs.Version = 2
+	// Buckets created from a missing template would be applied without a fill rate.
+	err = s.AddBucket("ns", &pb.BucketConfig{Name: "b", Template: "nope"}, "alice")
+	if _, ok := err.(config.ValidationErrors); !ok {
+		t.Fatalf("Expected ValidationErrors, got %v", err)
+	}
 
-	// Attempt to write a version 1 of the config
-	newCfg := config.NewDefaultServiceConfig()
-	newCfg.Version = 1
+	if v := s.Configs().Version; v != 1 {
+		t.Errorf("Expected no version to be persisted, got version %v", v)
+	}
 
-	s.updateBucketContainer(newCfg)
+	// Nor are such configs applied when persisted by other servers.
+	newCfg := config.CloneConfig(cfg)
+	newCfg.Version = 2
+	helpers.CheckError(t, config.AddBucket(newCfg.Namespaces["ns"], &pb.BucketConfig{Name: "b", Template: "nope"}))
+	helpers.CheckError(t, p.PersistAndNotify("", newCfg))
 
-	if s.cfgs.Version != 2 {
-		t.Fatal("Expected version 2 to not have been overwritten")
+	if _, ok := s.readUpdatedConfig(0).(config.ValidationErrors); !ok {
+		t.Error("Expected the config to be refused")
+	}
+
+	if v := s.Configs().Version; v != 1 {
+		t.Errorf("Expected version 1 to remain in force, got version %v", v)
 	}
 }
 
-func TestBucketErrorEmitsEvent(t *testing.T) {
+func TestEventBroadcaster(t *testing.T) {
+	s := New(&MockBucketFactory{}, config.NewMemoryConfig(config.NewDefaultServiceConfig()), NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	s.SetEventBroadcaster(events.NewBroadcaster(), 10)
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	sub := s.SubscribeEvents(10, func(e events.Event) bool { return e.Namespace() == "ns" })
+	defer sub.Unsubscribe()
+
+	s.Emit(events.NewBucketMissedEvent("other", "a", false))
+	s.Emit(events.NewBucketMissedEvent("ns", "b", false))
+
+	select {
+	case e := <-sub.C:
+		if e.Namespace() != "ns" || e.BucketName() != "b" {
+			t.Errorf("Expected only the event in ns to be delivered, got %v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the event to be delivered to the subscriber")
+	}
+}
+
+// remoteOwner is a Sharder owning every dynamic bucket, recording the requests forwarded to it.
+type remoteOwner struct {
+	forwarded []string
+	err       error
+	sync.Mutex
+}
+
+func (r *remoteOwner) Owner(namespace, name string) QuotaService {
+	return r
+}
+
+func (r *remoteOwner) Allow(ctx context.Context, namespace, name string, tokensRequested int64, maxWaitMillisOverride int64, maxWaitTimeOverride bool) (time.Duration, bool, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.forwarded = append(r.forwarded, name)
+	return 0, true, r.err
+}
+
+func (r *remoteOwner) Probe(ctx context.Context, namespace, name string, tokensRequested int64) (bool, time.Duration, error) {
+	_, _, err := r.Allow(ctx, namespace, name, tokensRequested, 0, false)
+	return err == nil, 0, err
+}
+
+func (r *remoteOwner) AllowUntil(ctx context.Context, namespace, name string, tokensRequested int64, deadline time.Time) (time.Duration, bool, error) {
+	return r.Allow(ctx, namespace, name, tokensRequested, 0, true)
+}
+
+func TestSharding(t *testing.T) {
 	cfg := config.NewDefaultServiceConfig()
-	nsc := config.NewDefaultNamespaceConfig("dummy")
-	bc := config.NewDefaultBucketConfig("dummy")
-	helpers.CheckError(t, config.AddBucket(nsc, bc))
+	nsc := config.NewDefaultNamespaceConfig("sharded")
+	config.SetDynamicBucketTemplate(nsc, config.NewDefaultBucketConfig(""))
+	helpers.CheckError(t, config.AddBucket(nsc, config.NewDefaultBucketConfig("static")))
 	helpers.CheckError(t, config.AddNamespace(cfg, nsc))
-	bf := MockBucketFactory{
-		SimulateFailure: true,
+
+	owner := &remoteOwner{}
+	s := New(&MockBucketFactory{}, config.NewMemoryConfig(cfg), NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	s.SetSharder(owner)
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	ctx := context.Background()
+	_, _, err = s.Allow(ctx, "sharded", "dynamic", 1, 0, false)
+	helpers.CheckError(t, err)
+	_, _, err = s.AllowUntil(ctx, "sharded", "dynamic", 1, time.Now().Add(time.Second))
+	helpers.CheckError(t, err)
+	_, _, err = s.Probe(ctx, "sharded", "dynamic", 1)
+	helpers.CheckError(t, err)
+
+	// Static buckets and requests already forwarded are served locally.
+	_, _, err = s.Allow(ctx, "sharded", "static", 1, 0, false)
+	helpers.CheckError(t, err)
+	_, _, err = s.Allow(ContextWithForwarded(ctx), "sharded", "forwarded", 1, 0, false)
+	helpers.CheckError(t, err)
+
+	if !reflect.DeepEqual(owner.forwarded, []string{"dynamic", "dynamic", "dynamic"}) {
+		t.Errorf("Expected only the dynamic bucket to be forwarded, got %v", owner.forwarded)
 	}
-	s := New(&bf, config.NewMemoryConfig(cfg), NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
-	eventsCh := make(chan events.Event)
-	s.SetListener(func(evt events.Event) {
-		eventsCh <- evt
-	}, 1000)
+
+	if inspection, _ := s.InspectBucket("sharded", "forwarded"); inspection == nil {
+		t.Error("Expected the forwarded request to be served locally")
+	}
+
+	// Requests the owner rejects aren't served locally...
+	owner.err = newError("timed out", ER_TIMEOUT)
+	if _, _, err := s.Allow(ctx, "sharded", "rejected", 1, 0, false); err != owner.err {
+		t.Errorf("Expected the owner's rejection, got %v", err)
+	}
+
+	// ... but those failing to reach it are.
+	owner.err = errors.New("connection refused")
+	if _, _, err := s.Allow(ctx, "sharded", "unreachable", 1, 0, false); err != nil {
+		t.Errorf("Expected the request to be served locally, got %v", err)
+	}
+}
+
+func TestQueueTime(t *testing.T) {
+	cfg := config.NewDefaultServiceConfig()
+	nsc := config.NewDefaultNamespaceConfig("dummy")
+	helpers.CheckError(t, config.AddBucket(nsc, config.NewDefaultBucketConfig("b")))
+	nsc.NamespaceLimit = config.NewDefaultBucketConfig("")
+	helpers.CheckError(t, config.AddNamespace(cfg, nsc))
+
+	mbf := &MockBucketFactory{}
+	clock := &testClock{t: time.Unix(1500000000, 0)}
+	s := New(mbf, config.NewMemoryConfig(cfg), NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	s.now = clock.now
+	evts := make(chan events.Event, 10)
+	s.AddListener(func(evt events.Event) {
+		evts <- evt
+	}, 10, events.EVENT_TOKENS_SERVED, events.EVENT_TIMEOUT_SERVING_TOKENS)
+
 	_, err := s.Start()
 	helpers.CheckError(t, err)
 	defer stopServer(t, s)
 
-	_, _, err = s.Allow(context.Background(), "dummy", "dummy", 1, 0, false)
-	if err == nil {
-		t.Fatal("Expected an Allow() error due to SimulateFailure=true on the mock bucket")
+	// Every take, from the namespace limit and then the bucket, blocks for 10ms.
+	take := func(b Bucket, tokens int64) (time.Duration, bool, error) {
+		clock.advance(10 * time.Millisecond)
+		return b.Take(context.Background(), tokens, time.Second)
 	}
 
-	for {
-		select {
-		case evt := <-eventsCh:
-			if evt.EventType() == events.EVENT_BUCKET_ERROR {
-				// Success condition
-				return
-			}
-		case <-time.After(1 * time.Second):
-			t.Fatalf("did not get event with type %s within timeout", events.EVENT_BUCKET_ERROR)
+	expectQueueTime := func(eventType events.EventType, name string, expected time.Duration) {
+		t.Helper()
+
+		evt := <-evts
+		if q, ok := events.QueueTime(evt); evt.EventType() != eventType || evt.BucketName() != name || !ok || q != expected {
+			t.Errorf("Expected %v from %v queued for %v, got %v", eventType, name, expected, evt)
 		}
 	}
+
+	// The queue time is measured, while the wait is that predicted by the bucket.
+	mbf.SetWaitTime("dummy", "b", 100*time.Millisecond)
+	if _, w, _, e := s.allow(context.Background(), "dummy", "b", 1, false, take); e != nil || w != 100*time.Millisecond {
+		t.Fatalf("Expected a wait of 100ms, got %v, %v", w, e)
+	}
+
+	evt := <-evts
+	if q, _ := events.QueueTime(evt); evt.WaitTime() != 100*time.Millisecond || q != 20*time.Millisecond {
+		t.Errorf("Expected a wait of 100ms after queueing for 20ms, got %v", evt)
+	}
+
+	// Requests giving up report how long they queued before giving up.
+	mbf.SetWaitTime("dummy", "b", 2*time.Second)
+	if _, _, _, e := s.allow(context.Background(), "dummy", "b", 1, false, take); e == nil {
+		t.Fatal("Expected the request to time out")
+	}
+
+	expectQueueTime(events.EVENT_TIMEOUT_SERVING_TOKENS, "b", 20*time.Millisecond)
+
+	mbf.SetWaitTime("dummy", config.NamespaceLimitBucketName, 2*time.Second)
+	if _, _, _, e := s.allow(context.Background(), "dummy", "b", 1, false, take); e == nil {
+		t.Fatal("Expected the request to time out on the namespace limit")
+	}
+
+	expectQueueTime(events.EVENT_TIMEOUT_SERVING_TOKENS, config.NamespaceLimitBucketName, 10*time.Millisecond)
+
+	// Requests served without blocking queue for no time at all.
+	mbf.SetWaitTime("dummy", config.NamespaceLimitBucketName, 0)
+	mbf.SetWaitTime("dummy", "b", 0)
+	_, _, err = s.Allow(context.Background(), "dummy", "b", 1, 0, false)
+	helpers.CheckError(t, err)
+	expectQueueTime(events.EVENT_TOKENS_SERVED, "b", 0)
 }
 
-func stopServer(t *testing.T, s *server) {
-	t.Helper()
+func TestOverMaxTokensPolicy(t *testing.T) {
+	cfg := config.NewDefaultServiceConfig()
+	nsc := config.NewDefaultNamespaceConfig("dummy")
+	for name, policy := range map[string]string{"reject": config.OverMaxTokensReject, "clamp": config.OverMaxTokensClamp} {
+		bc := config.NewDefaultBucketConfig(name)
+		bc.MaxTokensPerRequest = 10
+		bc.OverMaxTokensPolicy = policy
+		helpers.CheckError(t, config.AddBucket(nsc, bc))
+	}
 
-	_, err := s.Stop()
+	config.SetRequestCost(nsc, "search", 3)
+	helpers.CheckError(t, config.AddNamespace(cfg, nsc))
+
+	mbf := &MockBucketFactory{}
+	s := New(mbf, config.NewMemoryConfig(cfg), NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	s.SetDedupeCache(dedupe.NewMemoryCache(time.Minute, 100))
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	// Buckets reject requests over their max tokens per request by default.
+	if _, _, _, e := s.AllowTokens(context.Background(), "dummy", "reject", 25, 0, false); e == nil || e.(QuotaServiceError).Reason != ER_TOO_MANY_TOKENS_REQUESTED {
+		t.Errorf("Expected the request to be rejected, got %v", e)
+	}
+
+	// Buckets clamping them grant the max instead.
+	granted, _, _, err := s.AllowTokens(context.Background(), "dummy", "clamp", 25, 0, false)
 	helpers.CheckError(t, err)
+	if taken := mbf.bucket("dummy", "clamp").Taken; granted != 10 || taken != 10 {
+		t.Errorf("Expected 10 tokens to be granted and taken, got %v granted and %v taken", granted, taken)
+	}
+
+	// Requests within the max are granted in full.
+	if granted, _, _, err = s.AllowTokens(context.Background(), "dummy", "clamp", 4, 0, false); err != nil || granted != 4 {
+		t.Errorf("Expected 4 tokens to be granted, got %v, %v", granted, err)
+	}
+
+	// Clamped requests of a kind are granted as many tokens as their cost fits in the max.
+	ctx := ContextWithRequestID(ContextWithRequestKind(context.Background(), "search"), "r1")
+	for i := 0; i < 2; i++ {
+		granted, _, _, err = s.AllowTokens(ctx, "dummy", "clamp", 5, 0, false)
+		helpers.CheckError(t, err)
+		if granted != 3 {
+			t.Errorf("Expected 3 tokens to be granted, got %v", granted)
+		}
+	}
+
+	// Repeats are answered with the tokens originally granted, without taking more.
+	if taken := mbf.bucket("dummy", "clamp").Taken; taken != 10+4+9 {
+		t.Errorf("Expected %v tokens taken, got %v", 10+4+9, taken)
+	}
+
+	if ok, _, e := s.Probe(context.Background(), "dummy", "clamp", 25); !ok || e != nil {
+		t.Errorf("Expected probing a clamped request to grant, got %v, %v", ok, e)
+	}
+
+	if _, _, e := s.Probe(context.Background(), "dummy", "reject", 25); e == nil {
+		t.Error("Expected probing a rejected request to fail")
+	}
 }
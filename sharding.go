@@ -0,0 +1,36 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package quotaservice
+
+import (
+	"context"
+)
+
+// ForwardedMetadataKey is the metadata key marking requests forwarded to the instance owning their
+// bucket. RPC endpoints declare such requests with ContextWithForwarded.
+const ForwardedMetadataKey = "quotaservice-forwarded"
+
+// Sharder assigns each dynamic bucket to a single instance of a cluster, so instances that don't
+// share bucket storage, such as memory buckets, still enforce limits across the cluster. Requests
+// for buckets another instance owns are forwarded to it. See package sharding.
+type Sharder interface {
+	// Owner returns the instance owning a dynamic bucket, or nil if it is this instance.
+	Owner(namespace, name string) QuotaService
+}
+
+type forwardedKey struct{}
+
+// ContextWithForwarded returns a context declaring a request was forwarded by another instance.
+// Forwarded requests are served by the instance receiving them, even if it doesn't consider itself
+// the owner of their bucket, so instances disagreeing on ownership while membership changes don't
+// forward requests back and forth.
+func ContextWithForwarded(ctx context.Context) context.Context {
+	return context.WithValue(ctx, forwardedKey{}, true)
+}
+
+// ForwardedFromContext returns true if a request was declared forwarded using ContextWithForwarded.
+func ForwardedFromContext(ctx context.Context) bool {
+	forwarded, _ := ctx.Value(forwardedKey{}).(bool)
+	return forwarded
+}
@@ -0,0 +1,83 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package sharding
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// DefaultReplicas is the number of points each member is placed at on a Ring by default.
+const DefaultReplicas = 100
+
+// Ring maps keys to members by consistent hashing. Each member is placed at a number of points on a
+// ring of hashes, and owns the keys hashing up to each of its points from the previous one, so
+// adding or removing a member only moves the keys it gains or loses. Rings are immutable, and map
+// keys the same way given the same members, in any order.
+type Ring struct {
+	members []string
+	points  []uint32
+	owners  map[uint32]string
+}
+
+// NewRing creates a Ring placing each member at replicas points, or DefaultReplicas if not
+// positive. More points even out the share of keys each member owns.
+func NewRing(replicas int, members ...string) *Ring {
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+
+	r := &Ring{owners: make(map[uint32]string, replicas*len(members))}
+
+	unique := make(map[string]bool, len(members))
+	for _, m := range members {
+		if unique[m] {
+			continue
+		}
+
+		unique[m] = true
+		r.members = append(r.members, m)
+
+		for i := 0; i < replicas; i++ {
+			point := crc32.ChecksumIEEE([]byte(m + "#" + strconv.Itoa(i)))
+			// On the rare collision, the point is owned by the lowest member, independent of order.
+			if owner, exists := r.owners[point]; exists && owner < m {
+				continue
+			} else if !exists {
+				r.points = append(r.points, point)
+			}
+
+			r.owners[point] = m
+		}
+	}
+
+	sort.Strings(r.members)
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+
+	return r
+}
+
+// Owner returns the member owning a key, or an empty string if the ring has no members.
+func (r *Ring) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		// Past the last point; wrap around to the first.
+		i = 0
+	}
+
+	return r.owners[r.points[i]]
+}
+
+// Members returns the members of the ring, sorted.
+func (r *Ring) Members() []string {
+	members := make([]string, len(r.members))
+	copy(members, r.members)
+	return members
+}
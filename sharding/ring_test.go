@@ -0,0 +1,55 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package sharding
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	r := NewRing(0, "c:1", "a:1", "b:1", "a:1")
+	if members := r.Members(); !reflect.DeepEqual(members, []string{"a:1", "b:1", "c:1"}) {
+		t.Fatalf("Expected unique, sorted members, got %v", members)
+	}
+
+	reordered := NewRing(0, "b:1", "c:1", "a:1")
+	owned := make(map[string]int)
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("ns:bucket-%v", i)
+		owner := r.Owner(key)
+		if other := reordered.Owner(key); other != owner {
+			t.Fatalf("Expected %v to be owned by %v regardless of member order, got %v", key, owner, other)
+		}
+
+		owned[owner]++
+	}
+
+	for _, m := range r.Members() {
+		if owned[m] < 200 {
+			t.Errorf("Expected keys to be spread across members, got %v", owned)
+		}
+	}
+}
+
+func TestRingRehash(t *testing.T) {
+	before := NewRing(0, "a:1", "b:1", "c:1")
+	after := NewRing(0, "a:1", "b:1")
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("ns:bucket-%v", i)
+		if owner := before.Owner(key); owner != "c:1" && after.Owner(key) != owner {
+			t.Fatalf("Expected only the keys of the removed member to move, but %v moved from %v to %v",
+				key, owner, after.Owner(key))
+		}
+	}
+}
+
+func TestEmptyRing(t *testing.T) {
+	if owner := NewRing(0).Owner("ns:bucket"); owner != "" {
+		t.Errorf("Expected no owner, got %v", owner)
+	}
+}
@@ -0,0 +1,301 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+// Package sharding implements a quotaservice.Sharder assigning dynamic buckets to the members of a
+// cluster by consistent hashing, so a cluster of instances keeping buckets in memory enforces
+// approximately global limits without Redis. Requests for buckets owned by another member are
+// forwarded to it over gRPC, so every member should serve a gRPC endpoint at its member address.
+//
+// Limits are approximate: while members disagree on membership, e.g. during a rolling change to
+// it, a bucket may briefly be held by more than one member, and buckets moving to a new owner start
+// full there. Namespace limits are enforced by the member serving each request.
+package sharding
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/square/quotaservice"
+	"github.com/square/quotaservice/client"
+	"github.com/square/quotaservice/config"
+	"github.com/square/quotaservice/logging"
+	pb "github.com/square/quotaservice/protos"
+	qsgrpc "github.com/square/quotaservice/rpc/grpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+// defaultTimeout bounds forwarding a request by default.
+const defaultTimeout = time.Second
+
+// Options configures a Sharder.
+type Options struct {
+	// Replicas is the number of points each member is placed at on the hash ring. Defaults to
+	// DefaultReplicas.
+	Replicas int
+	// Timeout bounds forwarding a request to the owner of its bucket, after which it is served
+	// locally. Defaults to 1 second.
+	Timeout time.Duration
+	// DialOptions are used to connect to other members. Defaults to grpc.WithInsecure().
+	DialOptions []grpc.DialOption
+}
+
+var _ quotaservice.Sharder = (*Sharder)(nil)
+
+// Sharder implements quotaservice.Sharder, owning the dynamic buckets hashing to this member on a
+// Ring of the members of the cluster.
+type Sharder struct {
+	self   string
+	opts   Options
+	ring   *Ring
+	owners map[string]*owner
+	sync.RWMutex
+}
+
+// New creates a Sharder for the member self of a cluster, whose members are identified by the
+// addresses of their gRPC endpoints. A nil Options is equivalent to the zero value.
+func New(self string, members []string, opts *Options) *Sharder {
+	if self == "" {
+		panic("self was empty")
+	}
+
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	s := &Sharder{self: self, opts: *opts, owners: make(map[string]*owner)}
+	if s.opts.Timeout <= 0 {
+		s.opts.Timeout = defaultTimeout
+	}
+
+	if len(s.opts.DialOptions) == 0 {
+		s.opts.DialOptions = []grpc.DialOption{grpc.WithInsecure()}
+	}
+
+	s.ring = NewRing(s.opts.Replicas, members...)
+	return s
+}
+
+// SetMembers replaces the members of the cluster, rehashing buckets to their new owners.
+// Connections to members no longer in the cluster are closed.
+func (s *Sharder) SetMembers(members []string) {
+	ring := NewRing(s.opts.Replicas, members...)
+	current := make(map[string]bool, len(members))
+	for _, m := range ring.Members() {
+		current[m] = true
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.ring = ring
+	for addr, o := range s.owners {
+		if !current[addr] {
+			o.close()
+			delete(s.owners, addr)
+		}
+	}
+
+	logging.Info("Sharding buckets across members", "members", ring.Members())
+}
+
+// Members returns the members of the cluster, sorted.
+func (s *Sharder) Members() []string {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.ring.Members()
+}
+
+// Owner implements quotaservice.Sharder, returning nil for buckets this member owns.
+func (s *Sharder) Owner(namespace, name string) quotaservice.QuotaService {
+	s.RLock()
+	addr := s.ring.Owner(config.FullyQualifiedName(namespace, name))
+	o := s.owners[addr]
+	s.RUnlock()
+
+	if addr == "" || addr == s.self {
+		return nil
+	}
+
+	if o != nil {
+		return o
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if o = s.owners[addr]; o != nil {
+		return o
+	}
+
+	c, err := client.New(addr, s.opts.DialOptions...)
+	if err != nil {
+		logging.Warn("Unable to connect to the owner of a bucket", "owner", addr, "error", err)
+		return nil
+	}
+
+	o = &owner{addr: addr, client: c, timeout: s.opts.Timeout}
+	s.owners[addr] = o
+	return o
+}
+
+// Close closes the connections to other members.
+func (s *Sharder) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	for addr, o := range s.owners {
+		o.close()
+		delete(s.owners, addr)
+	}
+
+	return nil
+}
+
+// owner is a quotaservice.QuotaService forwarding requests to another member. Requests it fails to
+// forward return errors other than quotaservice.QuotaServiceError, so they are served locally.
+type owner struct {
+	addr    string
+	client  *client.Client
+	timeout time.Duration
+}
+
+func (o *owner) Allow(ctx context.Context, namespace, name string, tokensRequested int64, maxWaitMillisOverride int64, maxWaitTimeOverride bool) (time.Duration, bool, error) {
+	_, w, dynamic, err := o.AllowTokens(ctx, namespace, name, tokensRequested, maxWaitMillisOverride, maxWaitTimeOverride)
+	return w, dynamic, err
+}
+
+// AllowTokens implements quotaservice.TokenGranter, reporting the tokens the owner granted.
+func (o *owner) AllowTokens(ctx context.Context, namespace, name string, tokensRequested int64, maxWaitMillisOverride int64, maxWaitTimeOverride bool) (int64, time.Duration, bool, error) {
+	ctx, cancel := o.forwardContext(ctx)
+	defer cancel()
+
+	var trailer metadata.MD
+	rsp, err := o.client.AllowWithContext(ctx, &pb.AllowRequest{
+		Namespace:             namespace,
+		BucketName:            name,
+		TokensRequested:       tokensRequested,
+		MaxWaitMillisOverride: maxWaitMillisOverride,
+		MaxWaitTimeOverride:   maxWaitTimeOverride}, grpc.Trailer(&trailer))
+
+	if err != nil {
+		return 0, 0, true, callError(err, trailer)
+	}
+
+	if err := o.statusError(rsp.Status, namespace, name); err != nil {
+		return 0, 0, true, err
+	}
+
+	return rsp.TokensGranted, time.Duration(rsp.WaitMillis) * time.Millisecond, true, nil
+}
+
+// AllowUntil forwards the time left until the deadline as the max wait time.
+func (o *owner) AllowUntil(ctx context.Context, namespace, name string, tokensRequested int64, deadline time.Time) (time.Duration, bool, error) {
+	maxWaitMillis := int64(time.Until(deadline) / time.Millisecond)
+	if maxWaitMillis < 0 {
+		maxWaitMillis = 0
+	}
+
+	return o.Allow(ctx, namespace, name, tokensRequested, maxWaitMillis, true)
+}
+
+func (o *owner) Probe(ctx context.Context, namespace, name string, tokensRequested int64) (bool, time.Duration, error) {
+	ctx, cancel := o.forwardContext(ctx)
+	defer cancel()
+
+	var trailer metadata.MD
+	rsp, err := o.client.Probe(ctx, &pb.ProbeRequest{
+		Namespace:       namespace,
+		BucketName:      name,
+		TokensRequested: tokensRequested}, grpc.Trailer(&trailer))
+
+	if err != nil {
+		return false, 0, callError(err, trailer)
+	}
+
+	wait := time.Duration(rsp.WaitMillis) * time.Millisecond
+	if rsp.Status == pb.AllowResponse_REJECTED_TIMEOUT {
+		return false, wait, nil
+	}
+
+	if err := o.statusError(rsp.Status, namespace, name); err != nil {
+		return false, 0, err
+	}
+
+	return true, wait, nil
+}
+
+// forwardContext returns a context for forwarding a request to the owner, marking it forwarded and
+// carrying its kind and ID, cancelled once the timeout elapses.
+func (o *owner) forwardContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	md := metadata.Pairs(quotaservice.ForwardedMetadataKey, "true")
+	if kind := quotaservice.RequestKindFromContext(ctx); kind != "" {
+		md = metadata.Join(md, metadata.Pairs(quotaservice.RequestKindMetadataKey, kind))
+	}
+
+	if id := quotaservice.RequestIDFromContext(ctx); id != "" {
+		md = metadata.Join(md, metadata.Pairs(quotaservice.RequestIDMetadataKey, id))
+	}
+
+	return context.WithTimeout(metadata.NewContext(ctx, md), o.timeout)
+}
+
+// callError converts the error of a call the owner failed with InvalidArgument, for too many tokens
+// requested, NotFound, for an unknown namespace, or ResourceExhausted, for too many requests
+// waiting, into a quotaservice.QuotaServiceError. Other errors are returned as is.
+func callError(err error, trailer metadata.MD) error {
+	if grpc.Code(err) == codes.InvalidArgument && len(trailer[qsgrpc.MaxTokensMetadataKey]) > 0 {
+		qsErr := quotaservice.NewQuotaServiceError(grpc.ErrorDesc(err), quotaservice.ER_TOO_MANY_TOKENS_REQUESTED)
+		qsErr.MaxTokens, _ = strconv.ParseInt(trailer[qsgrpc.MaxTokensMetadataKey][0], 10, 64)
+		return qsErr
+	}
+
+	if grpc.Code(err) == codes.NotFound {
+		return quotaservice.NewQuotaServiceError(grpc.ErrorDesc(err), quotaservice.ER_UNKNOWN_NAMESPACE)
+	}
+
+	if grpc.Code(err) == codes.ResourceExhausted {
+		return quotaservice.NewQuotaServiceError(grpc.ErrorDesc(err), quotaservice.ER_TOO_MANY_WAITERS)
+	}
+
+	return err
+}
+
+// statusError returns the error for a status the owner rejected a request with, or nil if it
+// granted it.
+func (o *owner) statusError(status pb.AllowResponse_Status, namespace, name string) error {
+	switch status {
+	case pb.AllowResponse_OK:
+		return nil
+	case pb.AllowResponse_REJECTED_TIMEOUT:
+		return o.rejected(status, namespace, name, quotaservice.ER_TIMEOUT)
+	case pb.AllowResponse_REJECTED_NO_BUCKET:
+		return o.rejected(status, namespace, name, quotaservice.ER_NO_BUCKET)
+	case pb.AllowResponse_REJECTED_TOO_MANY_BUCKETS:
+		return o.rejected(status, namespace, name, quotaservice.ER_TOO_MANY_BUCKETS)
+	case pb.AllowResponse_REJECTED_INVALID_REQUEST:
+		// The bucket names are valid, so the kind of the request must be unknown.
+		return o.rejected(status, namespace, name, quotaservice.ER_UNKNOWN_REQUEST_KIND)
+	case pb.AllowResponse_REJECTED_CAP_REACHED:
+		return o.rejected(status, namespace, name, quotaservice.ER_CAP_REACHED)
+	default:
+		// Served as if the owner couldn't be reached.
+		return fmt.Errorf("unexpected status %v from %v", status, o.addr)
+	}
+}
+
+func (o *owner) rejected(status pb.AllowResponse_Status, namespace, name string, reason quotaservice.ErrorReason) quotaservice.QuotaServiceError {
+	return quotaservice.NewQuotaServiceError("Bucket "+config.FullyQualifiedName(namespace, name)+" owned by "+o.addr+
+		" rejected the request: "+status.String(), reason)
+}
+
+func (o *owner) close() {
+	if err := o.client.Close(); err != nil {
+		logging.Warn("Unable to close connection to member", "member", o.addr, "error", err)
+	}
+}
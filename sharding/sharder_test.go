@@ -0,0 +1,232 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package sharding
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/square/quotaservice"
+	"github.com/square/quotaservice/buckets/memory"
+	"github.com/square/quotaservice/config"
+	"github.com/square/quotaservice/events"
+	qsgrpc "github.com/square/quotaservice/rpc/grpc"
+	"github.com/square/quotaservice/test/helpers"
+)
+
+// node is a member of an in-process cluster.
+type node struct {
+	addr     string
+	server   quotaservice.Server
+	endpoint *quotaservice.MockEndpoint
+	sharder  *Sharder
+}
+
+// startNode starts a server keeping buckets in memory, serving gRPC at addr unless empty, sharding
+// the dynamic buckets of namespace "sharded" across members. Its buckets hold 10 tokens, refilling
+// one per second.
+func startNode(t *testing.T, addr string, members []string, opts *Options) *node {
+	t.Helper()
+
+	cfg := config.NewDefaultServiceConfig()
+	nsc := config.NewDefaultNamespaceConfig("sharded")
+	tpl := config.NewDefaultBucketConfig("")
+	tpl.Size = 10
+	tpl.FillRate = 1
+	config.SetDynamicBucketTemplate(nsc, tpl)
+	helpers.CheckError(t, config.AddBucket(nsc, config.NewDefaultBucketConfig("static")))
+	helpers.CheckError(t, config.AddNamespace(cfg, nsc))
+
+	n := &node{addr: addr, endpoint: &quotaservice.MockEndpoint{}}
+	endpoints := []quotaservice.RpcEndpoint{n.endpoint}
+	if addr != "" {
+		endpoints = append(endpoints, qsgrpc.New(addr, events.NewNilProducer()))
+	} else {
+		n.addr = "local"
+	}
+
+	n.server = quotaservice.New(memory.NewBucketFactory(), config.NewMemoryConfig(cfg),
+		quotaservice.NewReaperConfigForTests(), 0, endpoints...)
+	n.sharder = New(n.addr, members, opts)
+	n.server.SetSharder(n.sharder)
+
+	_, err := n.server.Start()
+	helpers.CheckError(t, err)
+
+	return n
+}
+
+func (n *node) stop() {
+	_ = n.sharder.Close()
+	_, _ = n.server.Stop()
+}
+
+// allow takes a token from a bucket without waiting, returning whether it was granted.
+func (n *node) allow(t *testing.T, bucket string) bool {
+	t.Helper()
+
+	_, _, err := n.endpoint.QuotaService.Allow(context.Background(), "sharded", bucket, 1, 0, true)
+	if qsErr, ok := err.(quotaservice.QuotaServiceError); ok && qsErr.Reason == quotaservice.ER_TIMEOUT {
+		return false
+	}
+
+	helpers.CheckError(t, err)
+	return true
+}
+
+// holds returns whether the node holds a bucket.
+func (n *node) holds(t *testing.T, bucket string) bool {
+	t.Helper()
+
+	inspection, err := n.server.GetServerAdministrable().InspectBucket("sharded", bucket)
+	helpers.CheckError(t, err)
+	return inspection != nil
+}
+
+func startCluster(t *testing.T, addrs ...string) []*node {
+	t.Helper()
+
+	nodes := make([]*node, len(addrs))
+	for i, addr := range addrs {
+		nodes[i] = startNode(t, addr, addrs, nil)
+	}
+
+	return nodes
+}
+
+func TestBucketOwnedByOneNode(t *testing.T) {
+	nodes := startCluster(t, "127.0.0.1:10993", "127.0.0.1:10994")
+	for _, n := range nodes {
+		defer n.stop()
+	}
+
+	owned := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		bucket := fmt.Sprintf("bucket-%v", i)
+
+		// The bucket's 10 tokens, and one claimed ahead of its availability, are shared wherever
+		// they are taken from...
+		for j := 0; j < 11; j++ {
+			if !nodes[j%2].allow(t, bucket) {
+				t.Fatalf("Expected token %v of %v to be granted via %v", j, bucket, nodes[j%2].addr)
+			}
+		}
+
+		// ... so neither node has any left.
+		for _, n := range nodes {
+			if n.allow(t, bucket) {
+				t.Errorf("Expected %v to be depleted via %v", bucket, n.addr)
+			}
+		}
+
+		// Only the owner holds the bucket.
+		var holders []string
+		for _, n := range nodes {
+			if n.holds(t, bucket) {
+				holders = append(holders, n.addr)
+			}
+		}
+
+		if len(holders) != 1 || holders[0] != nodes[0].sharder.ring.Owner("sharded:"+bucket) {
+			t.Fatalf("Expected %v to be held by its owner alone, got %v", bucket, holders)
+		}
+
+		owned[holders[0]]++
+	}
+
+	if len(owned) != 2 {
+		t.Errorf("Expected buckets to be spread across both nodes, got %v", owned)
+	}
+
+	// Static buckets aren't sharded.
+	for _, n := range nodes {
+		if !n.allow(t, "static") {
+			t.Errorf("Expected the static bucket to be served via %v", n.addr)
+		}
+	}
+}
+
+func TestProbeForwarded(t *testing.T) {
+	nodes := startCluster(t, "127.0.0.1:10997", "127.0.0.1:10998")
+	for _, n := range nodes {
+		defer n.stop()
+	}
+
+	probe := func(n *node) (bool, time.Duration) {
+		granted, wait, err := n.endpoint.QuotaService.Probe(context.Background(), "sharded", "probed", 1)
+		helpers.CheckError(t, err)
+		return granted, wait
+	}
+
+	for _, n := range nodes {
+		if granted, wait := probe(n); !granted || wait != 0 {
+			t.Errorf("Expected a new bucket to grant tokens without waiting via %v, got %v, %v", n.addr, granted, wait)
+		}
+	}
+
+	for _, n := range nodes {
+		if n.holds(t, "probed") {
+			t.Errorf("Expected probing not to create the bucket on %v", n.addr)
+		}
+	}
+
+	// Drain the bucket and claim a token ahead, so the next one is a second away.
+	for i := 0; i < 11; i++ {
+		nodes[i%2].allow(t, "probed")
+	}
+
+	for _, n := range nodes {
+		if granted, wait := probe(n); wait <= 0 || wait > time.Second || granted != (wait <= time.Second) {
+			t.Errorf("Expected the owner to estimate a wait of up to a second via %v, got %v, %v", n.addr, granted, wait)
+		}
+	}
+}
+
+func TestMembershipChange(t *testing.T) {
+	nodes := startCluster(t, "127.0.0.1:10995", "127.0.0.1:10996")
+	for _, n := range nodes {
+		defer n.stop()
+	}
+
+	// The second node leaves; the first takes over all buckets.
+	for _, n := range nodes {
+		n.sharder.SetMembers([]string{nodes[0].addr})
+	}
+
+	for i := 0; i < 10; i++ {
+		bucket := fmt.Sprintf("bucket-%v", i)
+		if !nodes[1].allow(t, bucket) {
+			t.Fatalf("Expected %v to be served", bucket)
+		}
+
+		if !nodes[0].holds(t, bucket) || nodes[1].holds(t, bucket) {
+			t.Fatalf("Expected %v to be held by the remaining member", bucket)
+		}
+	}
+}
+
+func TestOwnerUnreachable(t *testing.T) {
+	// Nothing listens on port 1.
+	n := startNode(t, "", []string{"local", "127.0.0.1:1"}, &Options{Timeout: 100 * time.Millisecond})
+	defer n.stop()
+
+	served := 0
+	for i := 0; i < 10; i++ {
+		bucket := fmt.Sprintf("bucket-%v", i)
+		if n.sharder.Owner("sharded", bucket) == nil {
+			continue
+		}
+
+		served++
+		if !n.allow(t, bucket) || !n.holds(t, bucket) {
+			t.Fatalf("Expected %v to be served locally while its owner is unreachable", bucket)
+		}
+	}
+
+	if served == 0 {
+		t.Fatal("Expected some buckets to be owned by the unreachable member")
+	}
+}
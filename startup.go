@@ -0,0 +1,175 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package quotaservice
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/square/quotaservice/config"
+	"github.com/square/quotaservice/logging"
+	pb "github.com/square/quotaservice/protos/config"
+)
+
+// defaultStartupRetryInterval is how often a config that couldn't be read at startup is retried by
+// default.
+const defaultStartupRetryInterval = 5 * time.Second
+
+// StartupPolicy decides how the server starts if the persister's config can't be read.
+type StartupPolicy int
+
+const (
+	// StartupFailClosed refuses to start, Start returning the error.
+	StartupFailClosed StartupPolicy = iota
+
+	// StartupFailOpen starts granting every request without taking tokens, retrying to read the
+	// config until it can be.
+	StartupFailOpen
+
+	// StartupLastKnownGood starts with the config saved to the config snapshot, retrying to read
+	// the persister's config until it can be. Start fails if there is no snapshot to read.
+	StartupLastKnownGood
+)
+
+func (p StartupPolicy) String() string {
+	switch p {
+	case StartupFailClosed:
+		return "fail-closed"
+	case StartupFailOpen:
+		return "fail-open"
+	case StartupLastKnownGood:
+		return "last-known-good"
+	default:
+		return "unknown"
+	}
+}
+
+// readInitialConfig reads the persister's config at startup. If it can't be read, the startup
+// policy decides whether to fail or to start degraded, in which case retry is true and the config
+// should be retried in the background.
+func (s *server) readInitialConfig() (retry bool, err error) {
+	err = s.readUpdatedConfig(0)
+	if err == nil {
+		return false, nil
+	}
+
+	switch s.startupPolicy {
+	case StartupFailOpen:
+		logging.Warn("Unable to read config, starting with every request granted", "error", err)
+	case StartupLastKnownGood:
+		cfg, snapErr := s.loadConfigSnapshot()
+		if snapErr != nil {
+			return false, errors.Wrapf(err, "unable to read config, nor the config snapshot (%v)", snapErr)
+		}
+
+		logging.Warn("Unable to read config, starting with the config snapshot", "version", cfg.Version, "error", err)
+		s.updateBucketContainer(cfg)
+	default:
+		return false, errors.Wrap(err, "unable to read config")
+	}
+
+	s.Lock()
+	s.degraded = true
+	s.Unlock()
+
+	return true, nil
+}
+
+// startupRetrier retries reading the persister's config until it can be, or stop is closed.
+func (s *server) startupRetrier(stop <-chan struct{}) {
+	interval := s.startupRetry
+	if interval <= 0 {
+		interval = defaultStartupRetryInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for s.degradedStartup() {
+		select {
+		case <-ticker.C:
+			_ = s.readUpdatedConfig(0)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// degradedStartup returns true if the server started without the persister's config, and hasn't
+// read it since.
+func (s *server) degradedStartup() bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.degraded
+}
+
+// failingOpenLocked returns true if every request is granted, since the server started without
+// any config under StartupFailOpen. Must be called with s's lock held.
+func (s *server) failingOpenLocked() bool {
+	return s.cfgs == nil && s.startupPolicy == StartupFailOpen
+}
+
+// saveConfigSnapshot saves the config in force to the config snapshot, if one is set.
+func (s *server) saveConfigSnapshot() {
+	cfg := s.Configs()
+	if s.snapshotPath == "" || cfg == nil {
+		return
+	}
+
+	if err := writeConfigSnapshot(s.snapshotPath, cfg); err != nil {
+		logging.Warn("Unable to save the config snapshot", "path", s.snapshotPath, "version", cfg.Version, "error", err)
+	}
+}
+
+// loadConfigSnapshot reads the config snapshot, refusing it unless it's valid and selects only
+// backends the server has, since it was saved by whatever version of the server last ran.
+func (s *server) loadConfigSnapshot() (*pb.ServiceConfig, error) {
+	cfg, err := readConfigSnapshot(s.snapshotPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := config.Validate(cfg); err != nil {
+		return nil, errors.Wrap(err, "invalid config snapshot")
+	}
+
+	if err := config.ValidateBackends(cfg, s.backends()); err != nil {
+		return nil, errors.Wrap(err, "invalid config snapshot")
+	}
+
+	return cfg, nil
+}
+
+func readConfigSnapshot(path string) (*pb.ServiceConfig, error) {
+	if path == "" {
+		return nil, errors.New("no config snapshot is set")
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return config.UnmarshalBytes(b)
+}
+
+// writeConfigSnapshot replaces the snapshot at a path by renaming a temporary file over it, so a
+// crash doesn't leave a partly written snapshot.
+func writeConfigSnapshot(path string, cfg *pb.ServiceConfig) error {
+	b, err := proto.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,270 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package quotaservice
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/square/quotaservice/config"
+	pb "github.com/square/quotaservice/protos/config"
+	"github.com/square/quotaservice/test/helpers"
+)
+
+// unreadablePersister fails to read configs until made readable.
+type unreadablePersister struct {
+	config.ConfigPersister
+	readable bool
+	sync.Mutex
+}
+
+func (u *unreadablePersister) ReadPersistedConfig() (*pb.ServiceConfig, error) {
+	u.Lock()
+	defer u.Unlock()
+
+	if !u.readable {
+		return nil, errors.New("config store unavailable")
+	}
+
+	return u.ConfigPersister.ReadPersistedConfig()
+}
+
+func (u *unreadablePersister) setReadable() {
+	u.Lock()
+	defer u.Unlock()
+
+	u.readable = true
+}
+
+func newStartupServer(policy StartupPolicy, snapshot string) (*server, *unreadablePersister) {
+	cfg := config.NewDefaultServiceConfig()
+	cfg.Version = 3
+	nsc := config.NewDefaultNamespaceConfig("dummy")
+	_ = config.AddBucket(nsc, config.NewDefaultBucketConfig("dummy"))
+	_ = config.AddNamespace(cfg, nsc)
+
+	p := &unreadablePersister{ConfigPersister: config.NewMemoryConfig(cfg)}
+	s := New(&MockBucketFactory{}, p, NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	s.SetStartupPolicy(policy)
+	s.SetConfigSnapshot(snapshot)
+	s.startupRetry = 5 * time.Millisecond
+
+	return s, p
+}
+
+func waitForConfig(t *testing.T, s *server) {
+	t.Helper()
+
+	start := time.Now()
+	for s.Configs() == nil || s.degradedStartup() {
+		if time.Since(start) > time.Second {
+			t.Fatal("Timeout waiting for the config to be read")
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestStartupFailClosed(t *testing.T) {
+	s, _ := newStartupServer(StartupFailClosed, "")
+	if _, err := s.Start(); err == nil {
+		t.Fatal("Expected the server to refuse to start without a config")
+	}
+}
+
+func TestStartupFailOpen(t *testing.T) {
+	s, p := newStartupServer(StartupFailOpen, "")
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	if h := s.ConfigHealth(); h.Degraded != "fail-open" {
+		t.Errorf("Expected the server to report starting fail-open, got %+v", h)
+	}
+
+	// Every request is granted, even for buckets that won't exist.
+	for _, name := range []string{"dummy", "missing"} {
+		if w, _, err := s.Allow(context.Background(), "nope", name, 100, 0, false); err != nil || w != 0 {
+			t.Errorf("Expected %v to be granted, got %v, %v", name, w, err)
+		}
+
+		if granted, _, err := s.Probe(context.Background(), "nope", name, 100); err != nil || !granted {
+			t.Errorf("Expected a probe of %v to be granted, got %v, %v", name, granted, err)
+		}
+	}
+
+	// The config is retried until it can be read.
+	p.setReadable()
+	waitForConfig(t, s)
+
+	if h := s.ConfigHealth(); h.Degraded != "" {
+		t.Errorf("Expected the server not to be degraded once the config is read, got %+v", h)
+	}
+
+	if _, _, err := s.Allow(context.Background(), "nope", "missing", 1, 0, false); err == nil {
+		t.Error("Expected requests to be limited once the config is read")
+	}
+}
+
+func TestStartupFailOpenAdmin(t *testing.T) {
+	s, p := newStartupServer(StartupFailOpen, "")
+	_, err := s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	mux := http.NewServeMux()
+	s.ServeAdminConsole(mux, "", false)
+
+	// There is no config to read or change until it can be read.
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/api/", nil),
+		httptest.NewRequest(http.MethodGet, "/api/dummy/dummy", nil),
+		httptest.NewRequest(http.MethodPost, "/api/ns", strings.NewReader(`{"name": "ns"}`)),
+		httptest.NewRequest(http.MethodGet, "/api/stats/dummy", nil),
+		httptest.NewRequest(http.MethodGet, "/api/templates", nil),
+		httptest.NewRequest(http.MethodGet, "/api/config", nil),
+	} {
+		req.Header.Set("Version", "0")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("Expected 503 for %v %v, got %v %v", req.Method, req.URL, w.Code, w.Body.String())
+		}
+	}
+
+	if err := s.AddNamespace(config.NewDefaultNamespaceConfig("ns"), "alice"); err != config.ErrNoConfig {
+		t.Errorf("Expected ErrNoConfig adding a namespace, got %v", err)
+	}
+
+	if inspection, err := s.InspectBucket("dummy", "dummy"); inspection != nil || err != nil {
+		t.Errorf("Expected no bucket to inspect, got %+v, %v", inspection, err)
+	}
+
+	p.setReadable()
+	waitForConfig(t, s)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected 200 once the config is read, got %v %v", w.Code, w.Body.String())
+	}
+}
+
+func TestStartupLastKnownGood(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quotaservice")
+	helpers.CheckError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	snapshot := filepath.Join(dir, "snapshot")
+
+	// Without a snapshot to start with, the server can't start.
+	s, _ := newStartupServer(StartupLastKnownGood, snapshot)
+	if _, err := s.Start(); err == nil {
+		t.Fatal("Expected the server to refuse to start without a snapshot")
+	}
+
+	// A server reading its config saves a snapshot of it.
+	s, p := newStartupServer(StartupLastKnownGood, snapshot)
+	p.setReadable()
+	_, err = s.Start()
+	helpers.CheckError(t, err)
+	stopServer(t, s)
+
+	s, p = newStartupServer(StartupLastKnownGood, snapshot)
+	_, err = s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	if cfg := s.Configs(); cfg == nil || cfg.Version != 3 {
+		t.Fatalf("Expected the snapshot to be in force, got %+v", cfg)
+	}
+
+	if h := s.ConfigHealth(); h.Degraded != "last-known-good" || h.SnapshotVersion != 3 {
+		t.Errorf("Expected the server to report starting with the snapshot, got %+v", h)
+	}
+
+	if _, _, err := s.Allow(context.Background(), "dummy", "dummy", 1, 0, false); err != nil {
+		t.Errorf("Expected the snapshot's buckets to serve requests, got %v", err)
+	}
+
+	p.setReadable()
+	waitForConfig(t, s)
+}
+
+func TestStartupLastKnownGoodInvalidSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quotaservice")
+	helpers.CheckError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	snapshot := filepath.Join(dir, "snapshot")
+
+	cfg := config.NewDefaultServiceConfig()
+	cfg.Version = 3
+	cfg.GlobalDefaultBucket = config.NewDefaultBucketConfig(config.DefaultBucketName)
+	cfg.GlobalDefaultBucket.Size = -1
+	helpers.CheckError(t, writeConfigSnapshot(snapshot, cfg))
+
+	s, _ := newStartupServer(StartupLastKnownGood, snapshot)
+	if _, err := s.Start(); err == nil {
+		stopServer(t, s)
+		t.Fatal("Expected the server to refuse to start with an invalid snapshot")
+	}
+}
+
+func TestConfigSnapshotWrittenThrough(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quotaservice")
+	helpers.CheckError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	snapshot := filepath.Join(dir, "snapshot")
+
+	clock := &testClock{t: time.Unix(1500000000, 0)}
+	p := config.NewMemoryConfigPersister()
+	helpers.CheckError(t, p.PersistAndNotify("", scheduledConfig(1, time.Time{}, "current")))
+
+	s := New(&MockBucketFactory{}, p, NewReaperConfigForTests(), 0, &MockEndpoint{}).(*server)
+	s.now = clock.now
+	s.SetConfigActivationPollInterval(time.Millisecond)
+	s.SetConfigSnapshot(snapshot)
+	_, err = s.Start()
+	helpers.CheckError(t, err)
+	defer stopServer(t, s)
+
+	snapshotVersion := func() int32 {
+		cfg, err := readConfigSnapshot(snapshot)
+		if err != nil {
+			return 0
+		}
+
+		return cfg.Version
+	}
+
+	if v := snapshotVersion(); v != 1 {
+		t.Fatalf("Expected the initial config to be saved, got version %v", v)
+	}
+
+	helpers.CheckError(t, p.PersistAndNotify("", scheduledConfig(2, time.Time{}, "current", "next")))
+	waitFor(t, "the config change to be saved", func() bool { return snapshotVersion() == 2 })
+
+	// Configs aren't saved until they're in force, then saved when activated on schedule.
+	helpers.CheckError(t, p.PersistAndNotify("", scheduledConfig(3, clock.now().Add(time.Hour), "scheduled")))
+	waitFor(t, "the config to be pending", func() bool { return s.PendingConfig() != nil })
+
+	if v := snapshotVersion(); v != 2 {
+		t.Fatalf("Expected the pending config not to be saved, got version %v", v)
+	}
+
+	clock.advance(time.Hour)
+	waitFor(t, "the activated config to be saved", func() bool { return snapshotVersion() == 3 })
+
+	if _, err := os.Stat(snapshot + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("Expected no temporary snapshot to be left, got %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package quotaservice
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/square/quotaservice/config"
+	"github.com/square/quotaservice/logging"
+	pbconfig "github.com/square/quotaservice/protos/config"
+)
+
+const stateFormatVersion = 1
+
+// StatefulBucket is implemented by buckets whose balance can be captured and set, so the state of a
+// server's buckets can be dumped and loaded into another, e.g. to reproduce throttling locally.
+type StatefulBucket interface {
+	// State returns the bucket's balance, negative if it is in debt, and when it was taken. Returns
+	// false if the bucket has been destroyed.
+	State() (int64, time.Time, bool)
+	// SetState sets the bucket's balance as of a time, clamped to its size, with tokens accumulating
+	// from then on at its fill rate. Returns false if the bucket has been destroyed.
+	SetState(tokens int64, at time.Time) bool
+}
+
+// bucketState is the state of a bucket in a dump.
+type bucketState struct {
+	Namespace string                 `json:"namespace"`
+	Bucket    string                 `json:"bucket"`
+	Dynamic   bool                   `json:"dynamic"`
+	Config    *pbconfig.BucketConfig `json:"config"`
+	// Tokens is the balance of the bucket at AtNanos, in nanos since the epoch. Both are omitted for
+	// buckets that aren't StatefulBuckets.
+	Tokens  *int64 `json:"tokens,omitempty"`
+	AtNanos int64  `json:"atNanos,omitempty"`
+}
+
+type stateDump struct {
+	Version int            `json:"version"`
+	Buckets []*bucketState `json:"buckets"`
+}
+
+// DumpState serializes the configs and balances of every active bucket, in the order visited by
+// ForEachBucket, as JSON that LoadState can load into another container.
+func (bc *bucketContainer) DumpState() ([]byte, error) {
+	dump := &stateDump{Version: stateFormatVersion, Buckets: make([]*bucketState, 0)}
+
+	bc.ForEachBucket(func(namespace, name string, b Bucket) bool {
+		state := &bucketState{Namespace: namespace, Bucket: name, Dynamic: b.Dynamic(), Config: b.Config()}
+
+		_, delegate := unwrapBucket(b)
+		if s, ok := delegate.(StatefulBucket); ok {
+			if tokens, at, ok := s.State(); ok {
+				state.Tokens = &tokens
+				state.AtNanos = at.UnixNano()
+			}
+		}
+
+		dump.Buckets = append(dump.Buckets, state)
+		return true
+	})
+
+	return json.Marshal(dump)
+}
+
+// LoadState sets the balances of the container's buckets from a dump by DumpState, creating the
+// dynamic buckets dumped. Only the balances are loaded: buckets keep the configs they have, so the
+// throttling dumped is only reproduced with the same configs, which the dump holds. Buckets dumped
+// without a balance are skipped. Returns an error naming the buckets whose balance couldn't be
+// set, such as those missing from the container, after setting the others.
+func (bc *bucketContainer) LoadState(state []byte) error {
+	var dump stateDump
+	if err := json.Unmarshal(state, &dump); err != nil {
+		return errors.Wrap(err, "malformed bucket state")
+	}
+
+	if dump.Version != stateFormatVersion {
+		return errors.Errorf("unknown bucket state version %v", dump.Version)
+	}
+
+	var failed []string
+	for _, s := range dump.Buckets {
+		if s.Tokens == nil {
+			continue
+		}
+
+		fullName := config.FullyQualifiedName(s.Namespace, s.Bucket)
+
+		b := bc.inspectableBucket(s.Namespace, s.Bucket)
+		if b == nil && s.Dynamic {
+			// FindBucket falls back to default buckets, which mustn't take a dynamic bucket's balance.
+			if found, _ := bc.FindBucket(s.Namespace, s.Bucket); found != nil && found.Dynamic() {
+				b = found
+			}
+		}
+
+		if b == nil {
+			failed = append(failed, fullName)
+			continue
+		}
+
+		_, delegate := unwrapBucket(b)
+		stateful, ok := delegate.(StatefulBucket)
+		if !ok || !stateful.SetState(*s.Tokens, time.Unix(0, s.AtNanos)) {
+			failed = append(failed, fullName)
+			continue
+		}
+
+		if s.Config != nil && config.DifferentBucketConfigs(b.Config(), s.Config) {
+			logging.Warn("Loaded the state of a bucket configured differently from when it was dumped",
+				"bucket", fullName)
+		}
+	}
+
+	if len(failed) > 0 {
+		return errors.Errorf("unable to load the state of buckets %v", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+func (s *server) DumpBucketState() ([]byte, error) {
+	s.RLock()
+	bc := s.bucketContainer
+	s.RUnlock()
+
+	if bc == nil {
+		return nil, errors.New("server not started")
+	}
+
+	return bc.DumpState()
+}
+
+func (s *server) LoadBucketState(state []byte) error {
+	s.RLock()
+	bc := s.bucketContainer
+	s.RUnlock()
+
+	if bc == nil {
+		return errors.New("server not started")
+	}
+
+	return bc.LoadState(state)
+}
@@ -0,0 +1,332 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package stats
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/square/quotaservice/events"
+)
+
+// DefaultWaitTimeBuckets are the upper bounds of the wait time histogram buckets.
+var DefaultWaitTimeBuckets = []time.Duration{
+	time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond,
+	50 * time.Millisecond, 100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second}
+
+const defaultMaxBucketHistograms = 100
+
+// HistogramOptions configures WaitTimeHistograms.
+type HistogramOptions struct {
+	// Buckets are the upper bounds of the histogram buckets, in increasing order. Defaults to
+	// DefaultWaitTimeBuckets.
+	Buckets []time.Duration
+	// PerBucket also keeps a histogram for each bucket, in addition to each namespace.
+	PerBucket bool
+	// MaxBucketsPerNamespace caps the buckets per namespace with their own histogram, guarding
+	// against unbounded memory from dynamic buckets. Requests for other buckets are only counted
+	// in the namespace histogram. Defaults to 100.
+	MaxBucketsPerNamespace int
+}
+
+// HistogramBucket is a bucket of a HistogramSnapshot.
+type HistogramBucket struct {
+	// UpperBound is the largest wait time counted, or 0 for the last bucket, which has no bound.
+	UpperBound time.Duration `json:"upperBound"`
+	// Count is the number of wait times counted in this bucket and no other.
+	Count uint64 `json:"count"`
+}
+
+// HistogramSnapshot is a copy of a histogram of wait times.
+type HistogramSnapshot struct {
+	Buckets []HistogramBucket `json:"buckets"`
+	Count   uint64            `json:"count"`
+	Sum     time.Duration     `json:"sum"`
+}
+
+// Quantile estimates a quantile of the wait times, such as 0.99 for the p99, interpolating within
+// the bucket it falls in. Wait times beyond the last bound are estimated as the last bound.
+func (h *HistogramSnapshot) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+
+	rank := q * float64(h.Count)
+	var seen uint64
+	var lower time.Duration
+
+	for _, b := range h.Buckets {
+		if b.UpperBound == 0 {
+			return lower
+		}
+
+		if b.Count > 0 && float64(seen+b.Count) >= rank {
+			fraction := (rank - float64(seen)) / float64(b.Count)
+			return lower + time.Duration(fraction*float64(b.UpperBound-lower))
+		}
+
+		seen += b.Count
+		lower = b.UpperBound
+	}
+
+	return lower
+}
+
+// WaitTimeHistograms keeps histograms of the wait times imposed on requests served, per namespace
+// and optionally per bucket. Attach it using Server.SetWaitTimeHistograms. Recording a wait time
+// only takes a read lock and atomic increments, except the first time a namespace or bucket is
+// seen. It also keeps a histogram per namespace of the time requests actually queued, whether
+// served or timed out, for events carrying an events.QueueTime; comparing the two tells errors in
+// predicted waits apart from real contention.
+type WaitTimeHistograms struct {
+	opts       HistogramOptions
+	namespaces map[string]*namespaceHistograms
+	sync.RWMutex
+}
+
+type namespaceHistograms struct {
+	total   *histogram
+	buckets map[string]*histogram
+	// queue counts queue times rather than wait times.
+	queue *histogram
+}
+
+// NewWaitTimeHistograms creates WaitTimeHistograms.
+func NewWaitTimeHistograms(opts HistogramOptions) *WaitTimeHistograms {
+	if len(opts.Buckets) == 0 {
+		opts.Buckets = DefaultWaitTimeBuckets
+	}
+
+	if opts.MaxBucketsPerNamespace < 1 {
+		opts.MaxBucketsPerNamespace = defaultMaxBucketHistograms
+	}
+
+	return &WaitTimeHistograms{opts: opts, namespaces: make(map[string]*namespaceHistograms)}
+}
+
+// HandleEvent is an events.Listener, recording the wait times of tokens served, and the queue times
+// of requests served or timed out.
+func (w *WaitTimeHistograms) HandleEvent(e events.Event) {
+	switch e.EventType() {
+	case events.EVENT_TOKENS_SERVED:
+		w.observe(e.Namespace(), e.BucketName(), e.WaitTime(), uint64(events.Weight(e)))
+	case events.EVENT_TIMEOUT_SERVING_TOKENS:
+		// Requests timed out imposed no wait, but still queued.
+	default:
+		return
+	}
+
+	if queued, ok := events.QueueTime(e); ok {
+		w.observeQueue(e.Namespace(), queued, uint64(events.Weight(e)))
+	}
+}
+
+// Observe records a wait time for a bucket.
+func (w *WaitTimeHistograms) Observe(namespace, bucket string, wait time.Duration) {
+	w.observe(namespace, bucket, wait, 1)
+}
+
+// observe records a wait time count times, such as for a sampled event.
+func (w *WaitTimeHistograms) observe(namespace, bucket string, wait time.Duration, count uint64) {
+	w.RLock()
+	ns := w.namespaces[namespace]
+	var b *histogram
+	capped := false
+	if ns != nil && w.opts.PerBucket {
+		b = ns.buckets[bucket]
+		capped = b == nil && len(ns.buckets) >= w.opts.MaxBucketsPerNamespace
+	}
+	w.RUnlock()
+
+	if ns == nil || (w.opts.PerBucket && b == nil && !capped) {
+		ns, b = w.create(namespace, bucket)
+	}
+
+	ns.total.observe(wait, count)
+	if b != nil {
+		b.observe(wait, count)
+	}
+}
+
+// ObserveQueue records a queue time for a namespace.
+func (w *WaitTimeHistograms) ObserveQueue(namespace string, queued time.Duration) {
+	w.observeQueue(namespace, queued, 1)
+}
+
+func (w *WaitTimeHistograms) observeQueue(namespace string, queued time.Duration, count uint64) {
+	w.RLock()
+	ns := w.namespaces[namespace]
+	w.RUnlock()
+
+	if ns == nil {
+		w.Lock()
+		ns = w.namespaceLocked(namespace)
+		w.Unlock()
+	}
+
+	ns.queue.observe(queued, count)
+}
+
+// create adds the histograms for a bucket, returning the namespace's histograms and the bucket's,
+// which is nil if bucket histograms are disabled or capped.
+func (w *WaitTimeHistograms) create(namespace, bucket string) (*namespaceHistograms, *histogram) {
+	w.Lock()
+	defer w.Unlock()
+
+	ns := w.namespaceLocked(namespace)
+	if !w.opts.PerBucket {
+		return ns, nil
+	}
+
+	b := ns.buckets[bucket]
+	if b == nil && len(ns.buckets) < w.opts.MaxBucketsPerNamespace {
+		b = newHistogram(w.opts.Buckets)
+		ns.buckets[bucket] = b
+	}
+
+	return ns, b
+}
+
+// namespaceLocked returns the histograms of a namespace, adding them if missing. Must be called with
+// w's lock held.
+func (w *WaitTimeHistograms) namespaceLocked(namespace string) *namespaceHistograms {
+	ns := w.namespaces[namespace]
+	if ns == nil {
+		ns = &namespaceHistograms{
+			total:   newHistogram(w.opts.Buckets),
+			buckets: make(map[string]*histogram),
+			queue:   newHistogram(w.opts.Buckets),
+		}
+
+		w.namespaces[namespace] = ns
+	}
+
+	return ns
+}
+
+// NamespaceStats returns the histogram of wait times for a namespace, or nil if none were
+// recorded.
+func (w *WaitTimeHistograms) NamespaceStats(namespace string) *HistogramSnapshot {
+	w.RLock()
+	defer w.RUnlock()
+
+	ns := w.namespaces[namespace]
+	if ns == nil {
+		return nil
+	}
+
+	return ns.total.snapshot()
+}
+
+// QueueTimeStats returns the histogram of queue times for a namespace, or nil if neither wait
+// times nor queue times were recorded.
+func (w *WaitTimeHistograms) QueueTimeStats(namespace string) *HistogramSnapshot {
+	w.RLock()
+	defer w.RUnlock()
+
+	ns := w.namespaces[namespace]
+	if ns == nil {
+		return nil
+	}
+
+	return ns.queue.snapshot()
+}
+
+// BucketStats returns the histogram of wait times for a bucket, or nil if none were recorded,
+// because bucket histograms are disabled or capped, or the bucket served no tokens.
+func (w *WaitTimeHistograms) BucketStats(namespace, bucket string) *HistogramSnapshot {
+	w.RLock()
+	defer w.RUnlock()
+
+	ns := w.namespaces[namespace]
+	if ns == nil || ns.buckets[bucket] == nil {
+		return nil
+	}
+
+	return ns.buckets[bucket].snapshot()
+}
+
+// Namespaces returns the namespaces with histograms, sorted.
+func (w *WaitTimeHistograms) Namespaces() []string {
+	w.RLock()
+	defer w.RUnlock()
+
+	names := make([]string, 0, len(w.namespaces))
+	for name := range w.namespaces {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Buckets returns the buckets with histograms in a namespace, sorted.
+func (w *WaitTimeHistograms) Buckets(namespace string) []string {
+	w.RLock()
+	defer w.RUnlock()
+
+	ns := w.namespaces[namespace]
+	if ns == nil {
+		return nil
+	}
+
+	names := make([]string, 0, len(ns.buckets))
+	for name := range ns.buckets {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Reset discards the histograms of a namespace and its buckets, or of every namespace if namespace
+// is empty.
+func (w *WaitTimeHistograms) Reset(namespace string) {
+	w.Lock()
+	defer w.Unlock()
+
+	if namespace == "" {
+		w.namespaces = make(map[string]*namespaceHistograms)
+		return
+	}
+
+	delete(w.namespaces, namespace)
+}
+
+// histogram counts wait times using atomic operations, so observations need no lock.
+type histogram struct {
+	bounds []time.Duration
+	counts []uint64 // One more than bounds, for wait times beyond the last bound
+	sum    int64
+}
+
+func newHistogram(bounds []time.Duration) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(wait time.Duration, count uint64) {
+	i := sort.Search(len(h.bounds), func(i int) bool { return wait <= h.bounds[i] })
+	atomic.AddUint64(&h.counts[i], count)
+	atomic.AddInt64(&h.sum, int64(wait)*int64(count))
+}
+
+func (h *histogram) snapshot() *HistogramSnapshot {
+	s := &HistogramSnapshot{
+		Buckets: make([]HistogramBucket, len(h.counts)),
+		Sum:     time.Duration(atomic.LoadInt64(&h.sum))}
+
+	for i := range h.counts {
+		s.Buckets[i].Count = atomic.LoadUint64(&h.counts[i])
+		s.Count += s.Buckets[i].Count
+
+		if i < len(h.bounds) {
+			s.Buckets[i].UpperBound = h.bounds[i]
+		}
+	}
+
+	return s
+}
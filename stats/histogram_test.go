@@ -0,0 +1,200 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package stats
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/square/quotaservice/events"
+)
+
+func TestWaitTimeHistogramBucketing(t *testing.T) {
+	h := NewWaitTimeHistograms(HistogramOptions{Buckets: []time.Duration{10 * time.Millisecond, 100 * time.Millisecond}})
+
+	for _, wait := range []time.Duration{0, 10 * time.Millisecond, 11 * time.Millisecond, 100 * time.Millisecond, time.Second} {
+		h.HandleEvent(events.NewTokensServedEvent("ns", "b", false, 1, wait))
+	}
+
+	// Only tokens served are recorded.
+	h.HandleEvent(events.NewTimedOutEvent("ns", "b", false, 1))
+
+	expected := &HistogramSnapshot{
+		Buckets: []HistogramBucket{
+			{UpperBound: 10 * time.Millisecond, Count: 2},
+			{UpperBound: 100 * time.Millisecond, Count: 2},
+			{UpperBound: 0, Count: 1}},
+		Count: 5,
+		Sum:   1121 * time.Millisecond}
+
+	if s := h.NamespaceStats("ns"); !reflect.DeepEqual(s, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, s)
+	}
+
+	if h.NamespaceStats("unknown") != nil {
+		t.Error("Expected no histogram for an unknown namespace")
+	}
+
+	if h.BucketStats("ns", "b") != nil {
+		t.Error("Expected no bucket histograms unless enabled")
+	}
+}
+
+func TestWaitTimeHistogramQuantiles(t *testing.T) {
+	h := NewWaitTimeHistograms(HistogramOptions{Buckets: []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond}})
+
+	// 50 waits in (0, 10ms], 40 in (10ms, 20ms], 10 in (20ms, 40ms]
+	for i := 0; i < 100; i++ {
+		wait := 5 * time.Millisecond
+		switch {
+		case i >= 90:
+			wait = 30 * time.Millisecond
+		case i >= 50:
+			wait = 15 * time.Millisecond
+		}
+
+		h.Observe("ns", "b", wait)
+	}
+
+	s := h.NamespaceStats("ns")
+	for q, expected := range map[float64]time.Duration{
+		0.5:  10 * time.Millisecond,
+		0.7:  15 * time.Millisecond,
+		0.95: 30 * time.Millisecond,
+		1:    40 * time.Millisecond} {
+		if actual := s.Quantile(q); actual != expected {
+			t.Errorf("Expected quantile %v to be %v, got %v", q, expected, actual)
+		}
+	}
+
+	h.Observe("ns", "b", time.Minute)
+	if actual := h.NamespaceStats("ns").Quantile(1); actual != 40*time.Millisecond {
+		t.Errorf("Expected waits beyond the last bound to be estimated as the last bound, got %v", actual)
+	}
+
+	if (&HistogramSnapshot{}).Quantile(0.5) != 0 {
+		t.Error("Expected 0 for an empty histogram")
+	}
+}
+
+func TestWaitTimeBucketHistogramsCapped(t *testing.T) {
+	h := NewWaitTimeHistograms(HistogramOptions{PerBucket: true, MaxBucketsPerNamespace: 2})
+
+	for _, b := range []string{"a", "b", "c", "a"} {
+		h.Observe("ns", b, time.Millisecond)
+	}
+
+	if s := h.BucketStats("ns", "a"); s == nil || s.Count != 2 {
+		t.Errorf("Expected 2 waits for bucket a, got %+v", s)
+	}
+
+	if h.BucketStats("ns", "c") != nil {
+		t.Error("Expected no histogram for bucket c beyond the cap")
+	}
+
+	if s := h.NamespaceStats("ns"); s.Count != 4 {
+		t.Errorf("Expected every wait in the namespace histogram, got %v", s.Count)
+	}
+
+	if b := h.Buckets("ns"); !reflect.DeepEqual(b, []string{"a", "b"}) {
+		t.Errorf("Unexpected buckets %v", b)
+	}
+}
+
+func TestWaitTimeHistogramsConcurrent(t *testing.T) {
+	h := NewWaitTimeHistograms(HistogramOptions{PerBucket: true})
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				h.Observe("ns", "b", time.Millisecond)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if s := h.BucketStats("ns", "b"); s.Count != 1000 || s.Sum != time.Second {
+		t.Errorf("Expected 1000 waits totalling 1s, got %+v", s)
+	}
+}
+
+func TestWaitTimeHistogramsReset(t *testing.T) {
+	h := NewWaitTimeHistograms(HistogramOptions{PerBucket: true})
+	h.Observe("ns", "a", time.Millisecond)
+	h.Observe("other", "b", time.Millisecond)
+
+	h.Reset("ns")
+
+	if h.NamespaceStats("ns") != nil || h.BucketStats("ns", "a") != nil {
+		t.Error("Expected no histograms for ns after a reset")
+	}
+
+	if s := h.NamespaceStats("other"); s == nil || s.Count != 1 {
+		t.Errorf("Expected the histogram of other to be kept, got %+v", s)
+	}
+
+	h.Observe("ns", "a", time.Millisecond)
+	h.Reset("")
+
+	if n := h.Namespaces(); len(n) != 0 {
+		t.Errorf("Expected no namespaces after resetting all, got %v", n)
+	}
+}
+
+func TestWaitTimeHistogramsSampledEvents(t *testing.T) {
+	h := NewWaitTimeHistograms(HistogramOptions{})
+	h.HandleEvent(events.NewSampledEvent(events.NewTokensServedEvent("ns", "b", false, 1, time.Millisecond), 10))
+
+	if s := h.NamespaceStats("ns"); s.Count != 10 || s.Sum != 10*time.Millisecond {
+		t.Errorf("Expected 10 waits totalling 10ms, got %+v", s)
+	}
+}
+
+func TestQueueTimeHistograms(t *testing.T) {
+	h := NewWaitTimeHistograms(HistogramOptions{Buckets: []time.Duration{10 * time.Millisecond, 100 * time.Millisecond}})
+
+	// Served requests record their wait and queue times separately, and timed out requests only
+	// their queue time.
+	h.HandleEvent(events.NewQueuedEvent(events.NewTokensServedEvent("ns", "b", false, 1, 50*time.Millisecond), 5*time.Millisecond))
+	h.HandleEvent(events.NewSampledEvent(events.NewQueuedEvent(events.NewTokensServedEvent("ns", "b", false, 1, 0), 50*time.Millisecond), 2))
+	h.HandleEvent(events.NewQueuedEvent(events.NewTimedOutEvent("ns", "b", false, 1), time.Second))
+	h.HandleEvent(events.NewTokensServedEvent("ns", "b", false, 1, 0))
+
+	expected := &HistogramSnapshot{
+		Buckets: []HistogramBucket{
+			{UpperBound: 10 * time.Millisecond, Count: 1},
+			{UpperBound: 100 * time.Millisecond, Count: 2},
+			{UpperBound: 0, Count: 1}},
+		Count: 4,
+		Sum:   1105 * time.Millisecond}
+
+	if s := h.QueueTimeStats("ns"); !reflect.DeepEqual(s, expected) {
+		t.Errorf("Expected queue times %+v, got %+v", expected, s)
+	}
+
+	if s := h.NamespaceStats("ns"); s.Count != 4 || s.Sum != 50*time.Millisecond {
+		t.Errorf("Expected 4 waits totalling 50ms, got %+v", s)
+	}
+
+	// A namespace only timing out has queue times, but no waits.
+	h.HandleEvent(events.NewQueuedEvent(events.NewTimedOutEvent("other", "b", false, 1), time.Millisecond))
+	if s := h.QueueTimeStats("other"); s.Count != 1 {
+		t.Errorf("Expected a queue time for other, got %+v", s)
+	}
+
+	if s := h.NamespaceStats("other"); s.Count != 0 {
+		t.Errorf("Expected no waits for other, got %+v", s)
+	}
+
+	h.Reset("")
+	if s := h.QueueTimeStats("ns"); s != nil {
+		t.Errorf("Expected no queue times after a reset, got %+v", s)
+	}
+}
@@ -5,6 +5,7 @@ package stats
 
 import (
 	"sort"
+	"sync"
 
 	"github.com/square/quotaservice/events"
 )
@@ -15,18 +16,20 @@ type namespaceStats struct {
 
 type memoryListener struct {
 	namespaces map[string]*namespaceStats
+	sync.RWMutex
 }
 
 // NewMemoryStatsListener creates an in-memory stats listener.
 func NewMemoryStatsListener() Listener {
-	return &memoryListener{make(map[string]*namespaceStats)}
+	return &memoryListener{namespaces: make(map[string]*namespaceStats)}
 }
 
 func (l *memoryListener) bucketScoreTop10(scoreMap map[string]*BucketScore) []*BucketScore {
 	arr := make(BucketScoreArray, 0)
 
 	for _, value := range scoreMap {
-		arr = append(arr, value)
+		// Copied, since scores keep changing after the lock is released.
+		arr = append(arr, &BucketScore{value.Bucket, value.Score})
 	}
 
 	sort.Sort(arr)
@@ -43,6 +46,9 @@ func (l *memoryListener) bucketScoreTop10(scoreMap map[string]*BucketScore) []*B
 // TopHits returns a sorted list of the 10 buckets with the highest # of hits
 // in the specified namespace
 func (l *memoryListener) TopHits(namespace string) []*BucketScore {
+	l.RLock()
+	defer l.RUnlock()
+
 	stats, ok := l.namespaces[namespace]
 
 	if !ok {
@@ -56,6 +62,9 @@ func (l *memoryListener) TopHits(namespace string) []*BucketScore {
 // TopMisses returns a sorted list of the 10 buckets with the highest # of misses
 // in the specified namespace
 func (l *memoryListener) TopMisses(namespace string) []*BucketScore {
+	l.RLock()
+	defer l.RUnlock()
+
 	stats, ok := l.namespaces[namespace]
 
 	if !ok {
@@ -68,6 +77,9 @@ func (l *memoryListener) TopMisses(namespace string) []*BucketScore {
 // Get is implemented for stats.Listener
 // Get returns the hits and misses for a bucket in the specified namespace
 func (l *memoryListener) Get(namespace, bucket string) *BucketScores {
+	l.RLock()
+	defer l.RUnlock()
+
 	stats, ok := l.namespaces[namespace]
 
 	if !ok {
@@ -96,6 +108,9 @@ func (l *memoryListener) HandleEvent(event events.Event) {
 
 	namespace := event.Namespace()
 
+	l.Lock()
+	defer l.Unlock()
+
 	if _, ok := l.namespaces[namespace]; !ok {
 		l.namespaces[namespace] = &namespaceStats{
 			make(map[string]*BucketScore),
@@ -111,7 +126,7 @@ func (l *memoryListener) HandleEvent(event events.Event) {
 	case events.EVENT_BUCKET_MISS:
 		statsBucket = stats.misses
 	case events.EVENT_TOKENS_SERVED:
-		numTokens = event.NumTokens()
+		numTokens = event.NumTokens() * events.Weight(event)
 		statsBucket = stats.hits
 	default:
 		return
@@ -125,3 +140,17 @@ func (l *memoryListener) HandleEvent(event events.Event) {
 
 	statsBucket[key].Score += numTokens
 }
+
+// Reset is implemented for stats.Listener
+// Reset discards the stats of a namespace, or of every namespace if empty
+func (l *memoryListener) Reset(namespace string) {
+	l.Lock()
+	defer l.Unlock()
+
+	if namespace == "" {
+		l.namespaces = make(map[string]*namespaceStats)
+		return
+	}
+
+	delete(l.namespaces, namespace)
+}
@@ -127,3 +127,71 @@ func TestMemoryTop10Misses(t *testing.T) {
 		t.Fatalf("Misses top10 is not correct %+v", misses)
 	}
 }
+
+func TestMemoryReset(t *testing.T) {
+	listener = NewMemoryStatsListener()
+	listener.HandleEvent(events.NewTokensServedEvent("test", "dyn", true, 5, 0))
+	listener.HandleEvent(events.NewBucketMissedEvent("test", "dyn", true))
+	listener.HandleEvent(events.NewTokensServedEvent("other", "dyn", true, 2, 0))
+
+	listener.Reset("test")
+
+	if scores := listener.Get("test", "dyn"); scores.Hits != 0 || scores.Misses != 0 {
+		t.Fatalf("Bucket score was not reset: %+v != [Hits=0, Misses=0]", scores)
+	}
+
+	if hits := listener.TopHits("test"); len(hits) != 0 {
+		t.Fatalf("Hits top10 was not reset %+v", hits)
+	}
+
+	if scores := listener.Get("other", "dyn"); scores.Hits != 2 {
+		t.Fatalf("Bucket score of another namespace was reset: %+v != [Hits=2, Misses=0]", scores)
+	}
+
+	listener.HandleEvent(events.NewTokensServedEvent("test", "dyn", true, 1, 0))
+	listener.Reset("")
+
+	if scores := listener.Get("test", "dyn"); scores.Hits != 0 {
+		t.Fatalf("Bucket score was not reset: %+v != [Hits=0, Misses=0]", scores)
+	}
+
+	if scores := listener.Get("other", "dyn"); scores.Hits != 0 {
+		t.Fatalf("Bucket score was not reset: %+v != [Hits=0, Misses=0]", scores)
+	}
+}
+
+func TestMemoryResetConcurrent(t *testing.T) {
+	listener = NewMemoryStatsListener()
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			listener.HandleEvent(events.NewTokensServedEvent("test", "dyn", true, 1, 0))
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		listener.Reset("test")
+
+		if scores := listener.Get("test", "dyn"); scores.Hits < 0 || scores.Hits > 1000 {
+			t.Fatalf("Bucket score out of range: %+v", scores)
+		}
+	}
+
+	<-done
+	listener.Reset("test")
+
+	if scores := listener.Get("test", "dyn"); scores.Hits != 0 {
+		t.Fatalf("Bucket score was not reset: %+v != [Hits=0, Misses=0]", scores)
+	}
+}
+
+func TestMemorySampledHits(t *testing.T) {
+	listener = NewMemoryStatsListener()
+	listener.HandleEvent(events.NewSampledEvent(events.NewTokensServedEvent("test", "dyn", true, 2, 0), 10))
+
+	if scores := listener.Get("test", "dyn"); scores.Hits != 20 {
+		t.Fatalf("Sampled hits were not scaled: %+v != [Hits=20, Misses=0]", scores)
+	}
+}
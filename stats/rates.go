@@ -0,0 +1,160 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package stats
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/square/quotaservice/events"
+)
+
+const (
+	defaultRateWindow = 10 * time.Second
+	rateSlotCount     = 10
+)
+
+// RateOptions configures a RateTracker.
+type RateOptions struct {
+	// Window is the rolling period rates are averaged over, tracked in tenths. Defaults to 10
+	// seconds.
+	Window time.Duration
+}
+
+// NamespaceRate is the rate of requests granted and rejected in a namespace, per second, and of
+// dynamic buckets created. Dynamic buckets created at a sudden rate suggest a client generating
+// unique bucket names, abusively or by mistake.
+type NamespaceRate struct {
+	Namespace             string  `json:"namespace"`
+	Granted               float64 `json:"granted"`
+	Rejected              float64 `json:"rejected"`
+	DynamicBucketsCreated float64 `json:"dynamicBucketsCreated"`
+}
+
+// RateTracker keeps the rates of requests granted and rejected, and of dynamic buckets created, per
+// namespace over a short rolling window, for dashboards. Attach it using Server.SetRateTracker. Memory is bounded by the number
+// of namespaces, not buckets.
+type RateTracker struct {
+	slot       time.Duration
+	now        func() time.Time
+	namespaces map[string]*rateSlots
+	sync.Mutex
+}
+
+// rateSlots holds the counts of a namespace for each tenth of the window, indexed by the number of
+// slots elapsed since the epoch modulo rateSlotCount.
+type rateSlots [rateSlotCount]rateSlot
+
+type rateSlot struct {
+	index                      int64
+	granted, rejected, created float64
+}
+
+// NewRateTracker creates a RateTracker.
+func NewRateTracker(opts RateOptions) *RateTracker {
+	if opts.Window <= 0 {
+		opts.Window = defaultRateWindow
+	}
+
+	slot := opts.Window / rateSlotCount
+	if slot <= 0 {
+		slot = 1
+	}
+
+	return &RateTracker{slot: slot, now: time.Now, namespaces: make(map[string]*rateSlots)}
+}
+
+// HandleEvent is an events.Listener.
+func (t *RateTracker) HandleEvent(e events.Event) {
+	var granted, rejected, created float64
+
+	switch e.EventType() {
+	case events.EVENT_TOKENS_SERVED:
+		granted = float64(events.Weight(e))
+	case events.EVENT_TIMEOUT_SERVING_TOKENS, events.EVENT_TOO_MANY_TOKENS_REQUESTED, events.EVENT_BUCKET_MISS,
+		events.EVENT_CAP_REACHED:
+		rejected = 1
+	case events.EVENT_BUCKET_CREATED:
+		if !e.Dynamic() {
+			return
+		}
+
+		created = float64(events.Weight(e))
+	default:
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	slots := t.namespaces[e.Namespace()]
+	if slots == nil {
+		slots = &rateSlots{}
+		t.namespaces[e.Namespace()] = slots
+	}
+
+	index := t.now().UnixNano() / int64(t.slot)
+	s := &slots[index%rateSlotCount]
+	if s.index != index {
+		*s = rateSlot{index: index}
+	}
+
+	s.granted += granted
+	s.rejected += rejected
+	s.created += created
+}
+
+// Rates returns the rates of the namespaces with requests during the window, by namespace name.
+func (t *RateTracker) Rates() []*NamespaceRate {
+	t.Lock()
+	defer t.Unlock()
+
+	current := t.now().UnixNano() / int64(t.slot)
+	window := (t.slot * rateSlotCount).Seconds()
+
+	rates := make([]*NamespaceRate, 0, len(t.namespaces))
+	for namespace, slots := range t.namespaces {
+		r := &NamespaceRate{Namespace: namespace}
+		for _, s := range slots {
+			if s.index > current-rateSlotCount && s.index <= current {
+				r.Granted += s.granted
+				r.Rejected += s.rejected
+				r.DynamicBucketsCreated += s.created
+			}
+		}
+
+		if r.Granted == 0 && r.Rejected == 0 && r.DynamicBucketsCreated == 0 {
+			// Idle for a whole window.
+			delete(t.namespaces, namespace)
+			continue
+		}
+
+		r.Granted /= window
+		r.Rejected /= window
+		r.DynamicBucketsCreated /= window
+		rates = append(rates, r)
+	}
+
+	sort.Slice(rates, func(i, j int) bool { return rates[i].Namespace < rates[j].Namespace })
+	return rates
+}
+
+// Window returns the period rates are averaged over.
+func (t *RateTracker) Window() time.Duration {
+	return t.slot * rateSlotCount
+}
+
+// Reset discards the counts of a namespace, or of every namespace if namespace is empty.
+func (t *RateTracker) Reset(namespace string) {
+	t.Lock()
+	defer t.Unlock()
+
+	if namespace == "" {
+		t.namespaces = make(map[string]*rateSlots)
+		return
+	}
+
+	delete(t.namespaces, namespace)
+}
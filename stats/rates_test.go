@@ -0,0 +1,54 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package stats
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/square/quotaservice/events"
+)
+
+func newTestRateTracker() (*RateTracker, *fakeClock) {
+	t := NewRateTracker(RateOptions{})
+	clock := &fakeClock{time.Unix(1000, 0)}
+	t.now = clock.now
+	return t, clock
+}
+
+func TestRates(t *testing.T) {
+	tracker, clock := newTestRateTracker()
+
+	for i := 0; i < 30; i++ {
+		tracker.HandleEvent(events.NewTokensServedEvent("ns", "a", false, 1, 0))
+	}
+
+	tracker.HandleEvent(events.NewTimedOutEvent("ns", "a", false, 1))
+	clock.t = clock.t.Add(5 * time.Second)
+	tracker.HandleEvent(events.NewBucketMissedEvent("other", "b", true))
+	tracker.HandleEvent(events.NewTooManyTokensRequestedEvent("other", "b", true, 100))
+	tracker.HandleEvent(events.NewBucketCreatedEvent("other", "b", true))
+	// Not counted, since only dynamic buckets are created by requests.
+	tracker.HandleEvent(events.NewBucketCreatedEvent("other", "c", false))
+
+	expected := []*NamespaceRate{
+		{Namespace: "ns", Granted: 3, Rejected: 0.1},
+		{Namespace: "other", Rejected: 0.2, DynamicBucketsCreated: 0.1}}
+	if rates := tracker.Rates(); !reflect.DeepEqual(rates, expected) {
+		t.Errorf("Expected rates %+v, got %+v", expected, rates)
+	}
+
+	// The first events fall out of the window.
+	clock.t = clock.t.Add(6 * time.Second)
+	expected = []*NamespaceRate{{Namespace: "other", Rejected: 0.2, DynamicBucketsCreated: 0.1}}
+	if rates := tracker.Rates(); !reflect.DeepEqual(rates, expected) {
+		t.Errorf("Expected rates %+v, got %+v", expected, rates)
+	}
+
+	tracker.Reset("other")
+	if rates := tracker.Rates(); len(rates) != 0 {
+		t.Errorf("Expected no rates after a reset, got %+v", rates)
+	}
+}
@@ -127,7 +127,7 @@ func (l *redisListener) HandleEvent(event events.Event) {
 	case events.EVENT_BUCKET_MISS:
 		key = "misses"
 	case events.EVENT_TOKENS_SERVED:
-		numTokens = event.NumTokens()
+		numTokens = event.NumTokens() * events.Weight(event)
 		key = "hits"
 	default:
 		return
@@ -217,3 +217,37 @@ func (l *redisListener) submitBatch(pipe redis.Pipeliner) {
 		}
 	}
 }
+
+// Reset is implemented for stats.Listener
+// Reset deletes the stats of a namespace, or of every namespace if empty. Updates
+// queued before the reset are submitted first, and new updates are held until the
+// stats are deleted, so no update is lost or applied out of order.
+func (l *redisListener) Reset(namespace string) {
+	var keys []string
+
+	if namespace == "" {
+		iter := l.client.Scan(0, "stats:*", 100).Iterator()
+		for iter.Next() {
+			keys = append(keys, iter.Val())
+		}
+
+		if err := iter.Err(); err != nil {
+			logging.Printf("RedisStatsListener.Reset scan error %v", err)
+		}
+	} else {
+		keys = []string{statsNamespace("hits", namespace), statsNamespace("misses", namespace)}
+	}
+
+	l.statsUpdatesLock.Lock()
+	defer l.statsUpdatesLock.Unlock()
+
+	pipe := l.pipe
+	l.pipe = l.client.Pipeline()
+	l.queuedUpdates = 0
+
+	if len(keys) > 0 {
+		pipe.Del(keys...)
+	}
+
+	l.submitBatch(pipe)
+}
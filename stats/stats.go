@@ -16,6 +16,8 @@ type Listener interface {
 	TopMisses(string) []*BucketScore
 	Get(string, string) *BucketScores
 	HandleEvent(events.Event)
+	// Reset zeroes the stats of a namespace, or of every namespace if empty.
+	Reset(string)
 }
 
 // BucketScores stores a specific bucket's
@@ -0,0 +1,343 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package stats
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/square/quotaservice/events"
+)
+
+// TopMetric is what buckets are ranked by in a TopTracker.
+type TopMetric string
+
+const (
+	// TopByRequests ranks buckets by requests for tokens, served or rejected.
+	TopByRequests TopMetric = "requests"
+	// TopByRejections ranks buckets by requests rejected: timed out, too many tokens requested or
+	// bucket misses.
+	TopByRejections TopMetric = "rejections"
+	// TopByWaitTime ranks buckets by the total wait time imposed on requests served, in seconds.
+	TopByWaitTime TopMetric = "wait"
+)
+
+// TopMetrics lists the metrics buckets can be ranked by.
+var TopMetrics = []TopMetric{TopByRequests, TopByRejections, TopByWaitTime}
+
+const (
+	defaultTopCapacity = 100
+	defaultTopWindow   = time.Minute
+)
+
+// TopOptions configures a TopTracker.
+type TopOptions struct {
+	// Capacity is the number of buckets tracked per metric, bounding memory however many buckets
+	// there are. Rankings of up to Capacity buckets are available. Counts are exact while fewer
+	// buckets than Capacity are active, and approximate beyond that. Defaults to 100.
+	Capacity int
+	// Window is the period counts are reported over. Counts decay smoothly, rather than resetting
+	// at the end of each window. Defaults to one minute.
+	Window time.Duration
+	// ResetOnRead reports counts since the previous read of the same metric instead, ignoring
+	// Window.
+	ResetOnRead bool
+}
+
+// TopBucket is a bucket's score in a TopTracker ranking.
+type TopBucket struct {
+	Namespace string `json:"namespace"`
+	Bucket    string `json:"bucket"`
+	// Score is the count of requests or rejections, or the wait time in seconds.
+	Score float64 `json:"score"`
+	// Rate is the score per second.
+	Rate float64 `json:"rate"`
+}
+
+func (b *TopBucket) String() string {
+	return fmt.Sprintf("{%s.%s, %g}", b.Namespace, b.Bucket, b.Score)
+}
+
+// TopTracker ranks the busiest buckets, named and dynamic, by each of the TopMetrics. Attach it
+// using Server.SetTopTracker. Each metric is tracked with the space-saving algorithm, so memory and
+// time per event stay bounded even with many dynamic buckets, at the cost of overestimating the
+// scores of buckets that only recently became busy.
+type TopTracker struct {
+	opts    TopOptions
+	now     func() time.Time
+	metrics map[TopMetric]*topWindow
+	sync.Mutex
+}
+
+// NewTopTracker creates a TopTracker.
+func NewTopTracker(opts TopOptions) *TopTracker {
+	if opts.Capacity < 1 {
+		opts.Capacity = defaultTopCapacity
+	}
+
+	if opts.Window <= 0 {
+		opts.Window = defaultTopWindow
+	}
+
+	t := &TopTracker{opts: opts, now: time.Now, metrics: make(map[TopMetric]*topWindow)}
+	start := t.now()
+	for _, m := range TopMetrics {
+		t.metrics[m] = &topWindow{current: newSpaceSaving(opts.Capacity), start: start}
+	}
+
+	return t
+}
+
+// HandleEvent is an events.Listener.
+func (t *TopTracker) HandleEvent(e events.Event) {
+	key := topKey{e.Namespace(), e.BucketName()}
+
+	t.Lock()
+	defer t.Unlock()
+
+	now := t.now()
+	switch e.EventType() {
+	case events.EVENT_TOKENS_SERVED:
+		weight := float64(events.Weight(e))
+		t.addLocked(TopByRequests, key, weight, now)
+
+		if wait := e.WaitTime(); wait > 0 {
+			t.addLocked(TopByWaitTime, key, wait.Seconds()*weight, now)
+		}
+	case events.EVENT_TIMEOUT_SERVING_TOKENS, events.EVENT_TOO_MANY_TOKENS_REQUESTED, events.EVENT_BUCKET_MISS,
+		events.EVENT_CAP_REACHED:
+		t.addLocked(TopByRequests, key, 1, now)
+		t.addLocked(TopByRejections, key, 1, now)
+	}
+}
+
+func (t *TopTracker) addLocked(m TopMetric, key topKey, weight float64, now time.Time) {
+	w := t.metrics[m]
+	if !t.opts.ResetOnRead {
+		w.rotate(now, t.opts.Window, t.opts.Capacity)
+	}
+
+	w.current.add(key, weight)
+}
+
+// Top returns up to n buckets with the highest scores for a metric, highest first. It returns nil
+// for an unknown metric.
+func (t *TopTracker) Top(m TopMetric, n int) []*TopBucket {
+	t.Lock()
+	defer t.Unlock()
+
+	w := t.metrics[m]
+	if w == nil {
+		return nil
+	}
+
+	now := t.now()
+	var scores map[topKey]float64
+	var period time.Duration
+
+	if t.opts.ResetOnRead {
+		scores = w.current.scores(1, nil)
+		period = now.Sub(w.start)
+		w.current = newSpaceSaving(t.opts.Capacity)
+		w.start = now
+	} else {
+		w.rotate(now, t.opts.Window, t.opts.Capacity)
+		scores = w.current.scores(1, nil)
+		if w.previous != nil {
+			// Weigh the previous window by how much of it still overlaps the sliding window.
+			scores = w.previous.scores(1-float64(now.Sub(w.start))/float64(t.opts.Window), scores)
+		}
+
+		period = t.opts.Window
+	}
+
+	top := make([]*TopBucket, 0, len(scores))
+	for k, score := range scores {
+		b := &TopBucket{Namespace: k.namespace, Bucket: k.bucket, Score: score}
+		if period > 0 {
+			b.Rate = score / period.Seconds()
+		}
+
+		top = append(top, b)
+	}
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Score != top[j].Score {
+			return top[i].Score > top[j].Score
+		}
+
+		if top[i].Namespace != top[j].Namespace {
+			return top[i].Namespace < top[j].Namespace
+		}
+
+		return top[i].Bucket < top[j].Bucket
+	})
+
+	if n >= 0 && len(top) > n {
+		top = top[:n]
+	}
+
+	return top
+}
+
+// Reset discards the counts of the buckets in a namespace, or of every bucket if namespace is
+// empty.
+func (t *TopTracker) Reset(namespace string) {
+	t.Lock()
+	defer t.Unlock()
+
+	for _, w := range t.metrics {
+		if namespace == "" {
+			w.current = newSpaceSaving(t.opts.Capacity)
+			w.previous = nil
+			w.start = t.now()
+			continue
+		}
+
+		w.current.removeNamespace(namespace)
+		if w.previous != nil {
+			w.previous.removeNamespace(namespace)
+		}
+	}
+}
+
+// Capacity returns the number of buckets tracked per metric.
+func (t *TopTracker) Capacity() int {
+	return t.opts.Capacity
+}
+
+type topKey struct {
+	namespace, bucket string
+}
+
+// topWindow holds the counts of a metric for the current window and, for a sliding window, the
+// previous one.
+type topWindow struct {
+	current, previous *spaceSaving
+	start             time.Time
+}
+
+func (w *topWindow) rotate(now time.Time, window time.Duration, capacity int) {
+	elapsed := now.Sub(w.start)
+	if elapsed < window {
+		return
+	}
+
+	if elapsed < 2*window {
+		w.previous = w.current
+	} else {
+		w.previous = nil
+	}
+
+	w.current = newSpaceSaving(capacity)
+	w.start = w.start.Add(elapsed - elapsed%window)
+}
+
+// spaceSaving approximates the heaviest keys in a stream with a fixed number of counters. When all
+// counters are in use, a new key takes over the smallest counter, adding to its count, so counts
+// may be overestimated by at most the smallest count.
+type spaceSaving struct {
+	capacity int
+	counters map[topKey]*topCounter
+	heap     counterHeap
+}
+
+type topCounter struct {
+	key   topKey
+	count float64
+	index int
+}
+
+func newSpaceSaving(capacity int) *spaceSaving {
+	return &spaceSaving{capacity: capacity, counters: make(map[topKey]*topCounter)}
+}
+
+func (s *spaceSaving) add(key topKey, weight float64) {
+	if c, ok := s.counters[key]; ok {
+		c.count += weight
+		heap.Fix(&s.heap, c.index)
+		return
+	}
+
+	if len(s.heap) < s.capacity {
+		c := &topCounter{key: key, count: weight}
+		s.counters[key] = c
+		heap.Push(&s.heap, c)
+		return
+	}
+
+	min := s.heap[0]
+	delete(s.counters, min.key)
+	min.key = key
+	min.count += weight
+	s.counters[key] = min
+	heap.Fix(&s.heap, 0)
+}
+
+// removeNamespace discards the counters of the keys in a namespace, freeing them for other keys.
+func (s *spaceSaving) removeNamespace(namespace string) {
+	kept := s.heap[:0]
+	for _, c := range s.heap {
+		if c.key.namespace == namespace {
+			delete(s.counters, c.key)
+			continue
+		}
+
+		c.index = len(kept)
+		kept = append(kept, c)
+	}
+
+	for i := len(kept); i < len(s.heap); i++ {
+		s.heap[i] = nil
+	}
+
+	s.heap = kept
+	heap.Init(&s.heap)
+}
+
+// scores adds the counts, multiplied by factor, to a map of scores, creating it if nil.
+func (s *spaceSaving) scores(factor float64, scores map[topKey]float64) map[topKey]float64 {
+	if scores == nil {
+		scores = make(map[topKey]float64, len(s.counters))
+	}
+
+	for k, c := range s.counters {
+		scores[k] += c.count * factor
+	}
+
+	return scores
+}
+
+// counterHeap is a min-heap of counters, implementing heap.Interface.
+type counterHeap []*topCounter
+
+func (h counterHeap) Len() int {
+	return len(h)
+}
+
+func (h counterHeap) Less(i, j int) bool {
+	return h[i].count < h[j].count
+}
+
+func (h counterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *counterHeap) Push(x interface{}) {
+	c := x.(*topCounter)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *counterHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
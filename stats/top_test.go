@@ -0,0 +1,169 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package stats
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/square/quotaservice/events"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func newTestTopTracker(opts TopOptions) (*TopTracker, *fakeClock) {
+	t := NewTopTracker(opts)
+	clock := &fakeClock{time.Unix(1000, 0)}
+	t.now = clock.now
+	for _, w := range t.metrics {
+		w.start = clock.t
+	}
+
+	return t, clock
+}
+
+func expectRanking(t *testing.T, top []*TopBucket, expected ...string) {
+	t.Helper()
+
+	var actual []string
+	for _, b := range top {
+		actual = append(actual, b.String())
+	}
+
+	if fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Errorf("Expected ranking %v, got %v", expected, actual)
+	}
+}
+
+func TestTopRanking(t *testing.T) {
+	tracker, _ := newTestTopTracker(TopOptions{})
+
+	for i := 0; i < 3; i++ {
+		tracker.HandleEvent(events.NewTokensServedEvent("ns", "a", false, 1, 0))
+	}
+
+	tracker.HandleEvent(events.NewTokensServedEvent("ns", "b", false, 1, 2*time.Second))
+	tracker.HandleEvent(events.NewTimedOutEvent("ns", "b", false, 1))
+	tracker.HandleEvent(events.NewBucketMissedEvent("other", "c", true))
+	tracker.HandleEvent(events.NewTooManyTokensRequestedEvent("other", "c", true, 100))
+	tracker.HandleEvent(events.NewBucketMissedEvent("other", "c", true))
+	tracker.HandleEvent(events.NewTokensServedEvent("ns", "d", true, 1, 500*time.Millisecond))
+
+	expectRanking(t, tracker.Top(TopByRequests, 10), "{ns.a, 3}", "{other.c, 3}", "{ns.b, 2}", "{ns.d, 1}")
+	expectRanking(t, tracker.Top(TopByRejections, 10), "{other.c, 3}", "{ns.b, 1}")
+	expectRanking(t, tracker.Top(TopByWaitTime, 1), "{ns.b, 2}")
+
+	if top := tracker.Top(TopByRequests, 1); top[0].Rate != 3.0/60 {
+		t.Errorf("Expected a rate over the one minute window, got %v", top[0].Rate)
+	}
+
+	if tracker.Top("unknown", 10) != nil {
+		t.Error("Expected no ranking for an unknown metric")
+	}
+}
+
+func TestTopBoundedCapacity(t *testing.T) {
+	tracker, _ := newTestTopTracker(TopOptions{Capacity: 10})
+
+	// Two heavy hitters among many buckets seen once. Buckets with more than a tenth of the 750
+	// events are guaranteed to be tracked and ranked above the rest.
+	for i := 0; i < 500; i++ {
+		tracker.HandleEvent(events.NewBucketMissedEvent("ns", fmt.Sprintf("dyn%d", i), true))
+		if i%5 == 0 {
+			tracker.HandleEvent(events.NewBucketMissedEvent("ns", "heavy", true))
+		}
+
+		if i%10 == 0 {
+			tracker.HandleEvent(events.NewBucketMissedEvent("ns", "heavier", false))
+			tracker.HandleEvent(events.NewBucketMissedEvent("ns", "heavier", false))
+			tracker.HandleEvent(events.NewBucketMissedEvent("ns", "heavier", false))
+		}
+	}
+
+	if n := len(tracker.metrics[TopByRejections].current.counters); n != 10 {
+		t.Errorf("Expected 10 buckets tracked, got %v", n)
+	}
+
+	top := tracker.Top(TopByRejections, 2)
+	if len(top) != 2 || top[0].Bucket != "heavier" || top[1].Bucket != "heavy" {
+		t.Errorf("Expected the heavy hitters to be ranked first, got %v", top)
+	}
+}
+
+func TestTopSlidingWindow(t *testing.T) {
+	tracker, clock := newTestTopTracker(TopOptions{Window: 10 * time.Second})
+
+	for i := 0; i < 10; i++ {
+		tracker.HandleEvent(events.NewBucketMissedEvent("ns", "a", false))
+	}
+
+	// Half way through the next window, half of the previous window still counts.
+	clock.t = clock.t.Add(15 * time.Second)
+	tracker.HandleEvent(events.NewBucketMissedEvent("ns", "b", false))
+	tracker.HandleEvent(events.NewBucketMissedEvent("ns", "b", false))
+
+	expectRanking(t, tracker.Top(TopByRejections, 10), "{ns.a, 5}", "{ns.b, 2}")
+
+	// Once a full window has passed, the old counts are gone.
+	clock.t = clock.t.Add(20 * time.Second)
+	expectRanking(t, tracker.Top(TopByRejections, 10))
+}
+
+func TestTopResetOnRead(t *testing.T) {
+	tracker, clock := newTestTopTracker(TopOptions{ResetOnRead: true})
+
+	tracker.HandleEvent(events.NewBucketMissedEvent("ns", "a", false))
+	tracker.HandleEvent(events.NewBucketMissedEvent("ns", "a", false))
+	clock.t = clock.t.Add(2 * time.Minute)
+	tracker.HandleEvent(events.NewBucketMissedEvent("ns", "b", false))
+
+	top := tracker.Top(TopByRejections, 10)
+	expectRanking(t, top, "{ns.a, 2}", "{ns.b, 1}")
+
+	if top[0].Rate != 2.0/120 {
+		t.Errorf("Expected a rate since the last read, got %v", top[0].Rate)
+	}
+
+	expectRanking(t, tracker.Top(TopByRejections, 10))
+
+	// Only the metric read is reset.
+	expectRanking(t, tracker.Top(TopByRequests, 10), "{ns.a, 2}", "{ns.b, 1}")
+}
+
+func TestTopReset(t *testing.T) {
+	tracker, clock := newTestTopTracker(TopOptions{Capacity: 3})
+
+	tracker.HandleEvent(events.NewBucketMissedEvent("ns", "a", true))
+	tracker.HandleEvent(events.NewBucketMissedEvent("ns", "b", true))
+	tracker.HandleEvent(events.NewBucketMissedEvent("other", "c", true))
+	clock.t = clock.t.Add(time.Minute)
+	tracker.HandleEvent(events.NewBucketMissedEvent("ns", "a", true))
+
+	tracker.Reset("ns")
+	expectRanking(t, tracker.Top(TopByRejections, 10), "{other.c, 1}")
+
+	// Counters freed by the reset are available to other buckets.
+	tracker.HandleEvent(events.NewBucketMissedEvent("ns", "d", true))
+	tracker.HandleEvent(events.NewBucketMissedEvent("ns", "e", true))
+	expectRanking(t, tracker.Top(TopByRejections, 10), "{ns.d, 1}", "{ns.e, 1}", "{other.c, 1}")
+
+	tracker.Reset("")
+	expectRanking(t, tracker.Top(TopByRequests, 10))
+}
+
+func TestTopSampledEvents(t *testing.T) {
+	tracker, _ := newTestTopTracker(TopOptions{})
+	tracker.HandleEvent(events.NewSampledEvent(events.NewTokensServedEvent("ns", "a", false, 1, time.Second), 10))
+	tracker.HandleEvent(events.NewTokensServedEvent("ns", "b", false, 1, 0))
+
+	expectRanking(t, tracker.Top(TopByRequests, 10), "{ns.a, 10}", "{ns.b, 1}")
+	expectRanking(t, tracker.Top(TopByWaitTime, 10), "{ns.a, 10}")
+}
@@ -17,6 +17,7 @@ import (
 )
 
 var _ Bucket = (*MockBucket)(nil)
+var _ Prober = (*MockBucket)(nil)
 
 type MockBucket struct {
 	sync.RWMutex
@@ -26,21 +27,42 @@ type MockBucket struct {
 	dyn                   bool
 	cfg                   *pbconfig.BucketConfig
 	simulateFailure       bool
+	// Taken counts the tokens taken from the bucket.
+	Taken int64
+	// Returned counts the tokens returned to the bucket.
+	Returned int64
 }
 
 func (b *MockBucket) Take(_ context.Context, numTokens int64, maxWaitTime time.Duration) (time.Duration, bool, error) {
 	if b.simulateFailure {
 		return 0, false, errors.New("mock bucket had an error!")
 	}
-	b.RLock()
-	defer b.RUnlock()
+	b.Lock()
+	defer b.Unlock()
 
 	if b.WaitTime > maxWaitTime {
 		return 0, false, nil
 	}
 
+	b.Taken += numTokens
 	return b.WaitTime, true, nil
 }
+func (b *MockBucket) Probe(_ context.Context, numTokens int64, maxWaitTime time.Duration) (time.Duration, bool, error) {
+	if b.simulateFailure {
+		return 0, false, errors.New("mock bucket had an error!")
+	}
+	b.RLock()
+	defer b.RUnlock()
+
+	return b.WaitTime, b.WaitTime <= maxWaitTime, nil
+}
+func (b *MockBucket) Return(_ context.Context, numTokens int64) error {
+	b.Lock()
+	defer b.Unlock()
+
+	b.Returned += numTokens
+	return nil
+}
 func (b *MockBucket) Config() *pbconfig.BucketConfig {
 	return b.cfg
 }
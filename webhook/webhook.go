@@ -0,0 +1,215 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+// Package webhook notifies an HTTP endpoint whenever the quotaservice applies a new config.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/square/quotaservice/config"
+	"github.com/square/quotaservice/logging"
+)
+
+// SignatureHeader carries the hex-encoded HMAC-SHA256 of the request body, keyed with the shared
+// secret and prefixed with "sha256=".
+const SignatureHeader = "X-Quotaservice-Signature"
+
+const (
+	defaultMaxAttempts    = 5
+	defaultInitialBackoff = time.Second
+	defaultMaxBackoff     = 30 * time.Second
+	defaultTimeout        = 10 * time.Second
+	subscriptionBufSize   = 16
+)
+
+// Options configures a Notifier.
+type Options struct {
+	// URL receives a POST of a Payload for every config change.
+	URL string
+	// Secret signs payloads, if set. See SignatureHeader.
+	Secret string
+	// MaxAttempts bounds deliveries of each payload. Defaults to 5.
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry, doubling for each retry up to MaxBackoff.
+	// Defaults to 1s and 30s respectively.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Client sends requests. Defaults to a client with a 10s timeout.
+	Client *http.Client
+}
+
+// Payload is the JSON body POSTed for each config change.
+type Payload struct {
+	Version int32 `json:"version"`
+	// Author is who persisted the config, if known.
+	Author    string             `json:"author,omitempty"`
+	Timestamp time.Time          `json:"timestamp"`
+	Summary   string             `json:"summary"`
+	Diff      *config.ConfigDiff `json:"diff,omitempty"`
+}
+
+// Notifier delivers config changes to a webhook. Failed deliveries are retried with exponential
+// backoff, and are logged and counted rather than being fatal.
+type Notifier struct {
+	opts      Options
+	stop      chan struct{}
+	stopOnce  sync.Once
+	delivered uint64 // Accessed atomically
+	failed    uint64 // Accessed atomically
+}
+
+// New creates a Notifier.
+func New(opts Options) *Notifier {
+	if opts.MaxAttempts < 1 {
+		opts.MaxAttempts = defaultMaxAttempts
+	}
+
+	if opts.InitialBackoff <= 0 {
+		opts.InitialBackoff = defaultInitialBackoff
+	}
+
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = defaultMaxBackoff
+	}
+
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: defaultTimeout}
+	}
+
+	return &Notifier{opts: opts, stop: make(chan struct{})}
+}
+
+// Start delivers every change published by source until Stop is called.
+func (n *Notifier) Start(source config.ConfigChangeSource) {
+	changes, unsubscribe := source.SubscribeConfigChanges(subscriptionBufSize)
+
+	go func() {
+		defer unsubscribe()
+
+		for {
+			select {
+			case c, ok := <-changes:
+				if !ok {
+					return
+				}
+
+				if err := n.Deliver(c); err != nil {
+					logging.Printf("Unable to deliver config version %v to webhook %v: %v", c.Version, n.opts.URL, err)
+				}
+			case <-n.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops delivering changes, abandoning any retries in progress.
+func (n *Notifier) Stop() {
+	n.stopOnce.Do(func() {
+		close(n.stop)
+	})
+}
+
+// Deliver POSTs a change to the webhook, retrying failures, and counts the outcome.
+func (n *Notifier) Deliver(c *config.ConfigChange) error {
+	p := &Payload{
+		Version:   c.Version,
+		Author:    c.User,
+		Timestamp: time.Now(),
+		Summary:   c.Summary,
+		Diff:      c.Diff}
+
+	if c.Date > 0 {
+		p.Timestamp = time.Unix(c.Date, 0)
+	}
+
+	body, err := json.Marshal(p)
+	if err != nil {
+		atomic.AddUint64(&n.failed, 1)
+		return err
+	}
+
+	backoff := n.opts.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := n.post(body)
+		if err == nil {
+			atomic.AddUint64(&n.delivered, 1)
+			return nil
+		}
+
+		if !retry || attempt >= n.opts.MaxAttempts {
+			atomic.AddUint64(&n.failed, 1)
+			return fmt.Errorf("giving up after %v attempts: %v", attempt, err)
+		}
+
+		logging.Printf("Webhook delivery attempt %v of config version %v failed, retrying in %v: %v",
+			attempt, c.Version, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-n.stop:
+			atomic.AddUint64(&n.failed, 1)
+			return fmt.Errorf("stopped after %v attempts: %v", attempt, err)
+		}
+
+		if backoff *= 2; backoff > n.opts.MaxBackoff {
+			backoff = n.opts.MaxBackoff
+		}
+	}
+}
+
+// post sends a payload once, returning whether a failure is worth retrying.
+func (n *Notifier) post(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, n.opts.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if n.opts.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(n.opts.Secret, body))
+	}
+
+	resp, err := n.opts.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+
+	_ = resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("webhook responded %v", resp.Status)
+	default:
+		return false, fmt.Errorf("webhook responded %v", resp.Status)
+	}
+}
+
+// Delivered returns the number of changes delivered.
+func (n *Notifier) Delivered() uint64 {
+	return atomic.LoadUint64(&n.delivered)
+}
+
+// Failed returns the number of changes that couldn't be delivered.
+func (n *Notifier) Failed() uint64 {
+	return atomic.LoadUint64(&n.failed)
+}
+
+// Sign returns the value of SignatureHeader for a body, so receivers can verify payloads.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
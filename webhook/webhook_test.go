@@ -0,0 +1,142 @@
+// Licensed under the Apache License, Version 2.0
+// Details: https://raw.githubusercontent.com/square/quotaservice/master/LICENSE
+
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/square/quotaservice/config"
+	"github.com/square/quotaservice/test/helpers"
+)
+
+type broadcasterSource struct {
+	*config.ConfigChangeBroadcaster
+}
+
+func (b *broadcasterSource) SubscribeConfigChanges(bufSize int) (<-chan *config.ConfigChange, func()) {
+	return b.Subscribe(bufSize)
+}
+
+type received struct {
+	payload   *Payload
+	signature string
+}
+
+func newReceiver(t *testing.T, statuses ...int) (*httptest.Server, <-chan *received) {
+	ch := make(chan *received, 10)
+	var requests int32
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := int(atomic.AddInt32(&requests, 1)) - 1
+		if i < len(statuses) && statuses[i] != http.StatusOK {
+			w.WriteHeader(statuses[i])
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		helpers.CheckError(t, err)
+
+		p := &Payload{}
+		helpers.CheckError(t, json.Unmarshal(body, p))
+
+		if r.Header.Get(SignatureHeader) != Sign("s3cret", body) {
+			t.Errorf("Invalid signature %v", r.Header.Get(SignatureHeader))
+		}
+
+		ch <- &received{p, r.Header.Get(SignatureHeader)}
+	}))
+
+	return ts, ch
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	ts, ch := newReceiver(t)
+	defer ts.Close()
+
+	b := &broadcasterSource{config.NewConfigChangeBroadcaster()}
+	n := New(Options{URL: ts.URL, Secret: "s3cret"})
+	n.Start(b)
+	defer n.Stop()
+
+	newCfg := config.NewDefaultServiceConfig()
+	newCfg.Version = 1
+	helpers.CheckError(t, config.AddNamespace(newCfg, config.NewDefaultNamespaceConfig("foo")))
+	diff := config.Diff(config.NewDefaultServiceConfig(), newCfg)
+	b.Publish(&config.ConfigChange{Version: 1, User: "alice", Date: 1489427115, Diff: diff, Summary: diff.Summary()})
+
+	select {
+	case r := <-ch:
+		p := r.payload
+		if p.Version != 1 || p.Author != "alice" || p.Timestamp.Unix() != 1489427115 || p.Summary != diff.Summary() {
+			t.Errorf("Unexpected payload %+v", p)
+		}
+
+		if p.Diff == nil || p.Diff.ToVersion != 1 {
+			t.Errorf("Expected a diff, got %+v", p.Diff)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for webhook")
+	}
+
+	waitForCount(t, n.Delivered, 1)
+}
+
+func TestWebhookRetries(t *testing.T) {
+	ts, ch := newReceiver(t, http.StatusServiceUnavailable, http.StatusInternalServerError)
+	defer ts.Close()
+
+	n := New(Options{URL: ts.URL, Secret: "s3cret", InitialBackoff: time.Millisecond})
+	helpers.CheckError(t, n.Deliver(&config.ConfigChange{Version: 2}))
+
+	if r := <-ch; r.payload.Version != 2 {
+		t.Errorf("Unexpected payload %+v", r.payload)
+	}
+
+	if n.Delivered() != 1 || n.Failed() != 0 {
+		t.Errorf("Expected 1 delivery, got %v delivered and %v failed", n.Delivered(), n.Failed())
+	}
+}
+
+func TestWebhookFailures(t *testing.T) {
+	// Client errors aren't retried
+	ts, _ := newReceiver(t, http.StatusBadRequest, http.StatusOK)
+	defer ts.Close()
+
+	n := New(Options{URL: ts.URL, InitialBackoff: time.Millisecond})
+	if err := n.Deliver(&config.ConfigChange{Version: 3}); err == nil {
+		t.Error("Expected delivery to fail")
+	}
+
+	// Server errors are retried until MaxAttempts
+	ts, _ = newReceiver(t, 500, 500, 500, http.StatusOK)
+	defer ts.Close()
+
+	n2 := New(Options{URL: ts.URL, InitialBackoff: time.Millisecond, MaxAttempts: 3})
+	if err := n2.Deliver(&config.ConfigChange{Version: 3}); err == nil {
+		t.Error("Expected delivery to fail after 3 attempts")
+	}
+
+	if n.Failed() != 1 || n2.Failed() != 1 || n.Delivered()+n2.Delivered() != 0 {
+		t.Errorf("Expected failures to be counted, got %v and %v", n.Failed(), n2.Failed())
+	}
+}
+
+func waitForCount(t *testing.T, count func() uint64, expected uint64) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for count() != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected count %v, got %v", expected, count())
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}